@@ -0,0 +1,633 @@
+package sheepcount
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/oschwald/geoip2-golang"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/blake2b"
+	"zgo.at/isbot"
+)
+
+// A request in the access log of a web server.
+type accessLogEntry struct {
+	Time      time.Time
+	IP        net.IP
+	Host      string // Only in Caddy logs, as the others are usually one per site
+	Method    string
+	URI       string
+	Status    int
+	Referrer  string
+	UserAgent string
+}
+
+// The formats of access logs that can be imported.
+var accessLogParsers = map[string]func(string) (accessLogEntry, error){
+	// The Combined Log Format, the default of nginx and what most Apache sites use
+	"combined": parseCombinedLogLine,
+	"nginx":    parseCombinedLogLine,
+	"apache":   parseCombinedLogLine,
+
+	// The Common Log Format, which has no referrer or user agent
+	"common": parseCombinedLogLine,
+
+	// The JSON access logs of Caddy
+	"caddy": parseCaddyLogLine,
+}
+
+// The Common Log Format, optionally followed by the referrer and user agent of the Combined Log Format
+var combinedLogRegexp = regexp.MustCompile(`^(\S+) \S+ \S+ \[([^\]]+)\] "(\S+) (\S+)[^"]*" (\d{3}) \S+(?: "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)")?`)
+
+func parseCombinedLogLine(line string) (accessLogEntry, error) {
+	var entry accessLogEntry
+
+	m := combinedLogRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return entry, errors.New("not in combined or common log format")
+	}
+
+	t, err := time.Parse("02/Jan/2006:15:04:05 -0700", m[2])
+	if err != nil {
+		return entry, err
+	}
+
+	entry.Time = t
+	entry.IP = net.ParseIP(m[1])
+	entry.Method = m[3]
+	entry.URI = m[4]
+	entry.Status, _ = strconv.Atoi(m[5])
+	entry.Referrer = unescapeLogField(m[6])
+	entry.UserAgent = unescapeLogField(m[7])
+
+	return entry, nil
+}
+
+// nginx and Apache escape quotes and backslashes, and write a missing header as -.
+func unescapeLogField(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(s)
+}
+
+func parseCaddyLogLine(line string) (accessLogEntry, error) {
+	var entry accessLogEntry
+
+	var log struct {
+		Ts      json.RawMessage `json:"ts"`
+		Status  int             `json:"status"`
+		Request struct {
+			ClientIP   string      `json:"client_ip"`
+			RemoteIP   string      `json:"remote_ip"`
+			RemoteAddr string      `json:"remote_addr"` // Before Caddy 2.5
+			Host       string      `json:"host"`
+			Method     string      `json:"method"`
+			URI        string      `json:"uri"`
+			Headers    http.Header `json:"headers"`
+		} `json:"request"`
+	}
+	if err := json.Unmarshal([]byte(line), &log); err != nil {
+		return entry, err
+	}
+
+	// Seconds since the epoch unless a time_format is configured
+	var seconds float64
+	var formatted string
+	if err := json.Unmarshal(log.Ts, &seconds); err == nil {
+		entry.Time = time.Unix(0, int64(seconds*float64(time.Second)))
+	} else if err := json.Unmarshal(log.Ts, &formatted); err == nil {
+		t, err := time.Parse(time.RFC3339Nano, formatted)
+		if err != nil {
+			return entry, err
+		}
+		entry.Time = t
+	} else {
+		return entry, fmt.Errorf("invalid ts: %s", log.Ts)
+	}
+
+	ip := log.Request.ClientIP
+	if ip == "" {
+		ip = log.Request.RemoteIP
+	}
+	if ip == "" {
+		ip, _, _ = net.SplitHostPort(log.Request.RemoteAddr)
+	}
+	entry.IP = net.ParseIP(ip)
+
+	entry.Host = log.Request.Host
+	if host, _, err := net.SplitHostPort(entry.Host); err == nil {
+		entry.Host = host
+	}
+	entry.Method = log.Request.Method
+	entry.URI = log.Request.URI
+	entry.Status = log.Status
+	entry.Referrer = log.Request.Headers.Get("Referer")
+	entry.UserAgent = log.Request.Headers.Get("User-Agent")
+
+	return entry, nil
+}
+
+// Requests for files with these extensions are for the assets of pages, not pages.
+var assetExtensions = map[string]bool{
+	".avif": true, ".bmp": true, ".css": true, ".eot": true, ".gif": true, ".gz": true,
+	".ico": true, ".jpeg": true, ".jpg": true, ".js": true, ".json": true, ".map": true,
+	".mjs": true, ".mp3": true, ".mp4": true, ".ogg": true, ".otf": true, ".pdf": true,
+	".png": true, ".svg": true, ".ttf": true, ".txt": true, ".wasm": true, ".wav": true,
+	".webm": true, ".webp": true, ".woff": true, ".woff2": true, ".xml": true, ".zip": true,
+}
+
+func isAsset(uri string) bool {
+	p, _, _ := cut(uri, "?")
+	return assetExtensions[strings.ToLower(path.Ext(p))] || strings.HasPrefix(p, "/.well-known/")
+}
+
+// The most hits that are written in one transaction.
+const accessLogBatchSize = 1000
+
+// Imports the page loads in access logs as if they had been sent by the script, with the rules of the
+// configuration. Visitors are told apart with salts that rotate like the real ones, but which are
+// made up for the import and then forgotten, so imported visitors cannot be linked to the visitors
+// that have been counted since.
+type accessLogImporter struct {
+	sheepcount *SheepCount
+	db         *sql.DB
+	writer     *HitWriter
+	geo        *GeoIP // Nil if there is no GeoIP database
+	site       string // The site of the logs, unless they say
+
+	salts     map[int64][]byte
+	firstHits map[string]sql.NullInt64 // The first hit of each site before the import
+
+	hits     []Hit
+	earliest int64
+	imported int
+	skipped  map[string]int
+}
+
+func newAccessLogImporter(ctx context.Context, db *sql.DB, config Config, geo *GeoIP, site string) (*accessLogImporter, error) {
+	ignore, err := config.Ignore.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	referrerSpam, err := newReferrerSpam(&config.ReferrerSpam)
+	if err != nil {
+		return nil, err
+	}
+
+	config.AllowLocalhost = false
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessLogImporter{
+		sheepcount: &SheepCount{
+			db:           db,
+			ignore:       ignore,
+			referrerSpam: referrerSpam,
+			geo:          config.Geo.compile(),
+			dedup:        newDeduplicator(config.DedupWindow),
+			Config:       config,
+		},
+		db:        db,
+		writer:    writer,
+		geo:       geo,
+		site:      strings.ToLower(site),
+		salts:     make(map[int64][]byte),
+		firstHits: make(map[string]sql.NullInt64),
+		earliest:  time.Now().Unix(),
+		skipped:   make(map[string]int),
+	}, nil
+}
+
+func (importer *accessLogImporter) Close() error {
+	return importer.writer.Close()
+}
+
+// Import each line of the log. Lines that are not page loads, or that are not counted, are skipped.
+func (importer *accessLogImporter) Import(ctx context.Context, r io.Reader, parse func(string) (accessLogEntry, error)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		entry, err := parse(scanner.Text())
+		if err != nil {
+			importer.skipped["malformed"]++
+			continue
+		}
+
+		hit, reason, err := importer.hit(ctx, &entry)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			importer.skipped[reason]++
+			continue
+		}
+
+		importer.hits = append(importer.hits, hit)
+		if len(importer.hits) >= accessLogBatchSize {
+			if err := importer.flush(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Create the hit of the entry, or give why it is skipped.
+func (importer *accessLogImporter) hit(ctx context.Context, entry *accessLogEntry) (Hit, string, error) {
+	sheepcount := importer.sheepcount
+	var hit Hit
+
+	if entry.Method != http.MethodGet {
+		return hit, "method", nil
+	}
+	if !(entry.Status >= 200 && entry.Status < 300 || entry.Status == http.StatusNotModified) {
+		return hit, "status", nil
+	}
+	if !strings.HasPrefix(entry.URI, "/") {
+		return hit, "invalid", nil
+	}
+	if sheepcount.AnonymizeIPs && entry.IP != nil {
+		entry.IP = anonymizeIP(entry.IP)
+	}
+	if isAsset(entry.URI) {
+		return hit, "asset", nil
+	}
+	if sheepcount.ignore.ignoreIP(entry.IP) {
+		return hit, "ignored", nil
+	}
+
+	site := importer.site
+	if site == "" {
+		site = strings.ToLower(entry.Host)
+	}
+
+	hit.Timestamp = entry.Time.Unix()
+	hit.Event = PageLoad
+	hit.UserAgent = entry.UserAgent
+	hit.Device = deviceClass(hit.UserAgent, sql.NullInt32{})
+	if bot := botIPRange(entry.IP); isbot.Is(bot) {
+		hit.Bot = sql.NullInt16{Int16: int16(bot), Valid: true}
+	}
+	if importer.geo != nil {
+		hit.IP = entry.IP
+	}
+
+	if err := hit.setPageAndReferrer(sheepcount, sheepcount.AllowLocalhost, "https://"+site+entry.URI, "", entry.Referrer); err != nil {
+		if _, ok := err.(*ErrIgnored); ok {
+			return hit, "ignored", nil
+		}
+		return hit, "invalid", nil
+	}
+	hit.Goals = sheepcount.completedGoals(&hit)
+
+	// The visits since the first hit of the site have been counted already
+	first, err := importer.firstHit(ctx, hit.Domain)
+	if err != nil {
+		return hit, "", err
+	}
+	if first.Valid && hit.Timestamp >= first.Int64 {
+		return hit, "counted", nil
+	}
+
+	identCurrent, identPrevious, err := importer.identifiers(hit.Domain, entry)
+	if err != nil {
+		return hit, "", err
+	}
+	hit.setIdentifiers(sheepcount.AnonymousVisitors, identCurrent, identPrevious)
+
+	if sheepcount.dedup.Duplicate(&hit) {
+		return hit, "duplicate", nil
+	}
+
+	return hit, "", nil
+}
+
+func (importer *accessLogImporter) firstHit(ctx context.Context, site string) (sql.NullInt64, error) {
+	if first, ok := importer.firstHits[site]; ok {
+		return first, nil
+	}
+
+	var first sql.NullInt64
+	row := importer.db.QueryRowContext(
+		ctx,
+		"SELECT MIN(hits.timestamp) FROM hits INNER JOIN sites ON hits.site_id = sites.site_id WHERE sites.domain = ?",
+		site,
+	)
+	if err := row.Scan(&first); err != nil {
+		return first, err
+	}
+
+	importer.firstHits[site] = first
+	return first, nil
+}
+
+// The identifiers of the visitor, in the same way as fingerprint_mode would have at the time except
+// that the logs only have the user agent of the headers. Logs have no identifiers for etag, so every
+// hit is from a different visitor.
+func (importer *accessLogImporter) identifiers(site string, entry *accessLogEntry) ([]byte, []byte, error) {
+	switch importer.sheepcount.FingerprintMode {
+	case "none", "etag":
+		identifier := make([]byte, blake2b.Size256)
+		if _, err := rand.Read(identifier); err != nil {
+			return nil, nil, err
+		}
+		return identifier, identifier, nil
+
+	case "daily-site":
+		day := entry.Time.Unix() / (24 * 60 * 60)
+		salt, err := importer.salt(day)
+		if err != nil {
+			return nil, nil, err
+		}
+		identifier, err := hashVisitor(salt, site+"\x00"+entry.IP.String(), entry.UserAgent)
+		return identifier, identifier, err
+	}
+
+	rotation := int64(importer.sheepcount.SaltRotationDuration / time.Second)
+	period := entry.Time.Unix() / rotation
+
+	current, err := importer.salt(period)
+	if err != nil {
+		return nil, nil, err
+	}
+	previous, err := importer.salt(period - 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if importer.sheepcount.SiteSalts {
+		current, previous = siteSalt(current, site), siteSalt(previous, site)
+	}
+
+	identCurrent, err := hashVisitor(current, entry.IP.String(), entry.UserAgent)
+	if err != nil {
+		return nil, nil, err
+	}
+	identPrevious, err := hashVisitor(previous, entry.IP.String(), entry.UserAgent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return identCurrent, identPrevious, nil
+}
+
+// The made up salt of a rotation period, or of a day with daily-site.
+func (importer *accessLogImporter) salt(period int64) ([]byte, error) {
+	if salt, ok := importer.salts[period]; ok {
+		return salt, nil
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	importer.salts[period] = salt
+	return salt, nil
+}
+
+func hashVisitor(salt []byte, values ...string) ([]byte, error) {
+	hasher, err := blake2b.New(blake2b.Size256, salt)
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		hasher.Write([]byte(value))
+	}
+	return hasher.Sum(nil), nil
+}
+
+// Look up the locations of the hits so far and write them.
+func (importer *accessLogImporter) flush(ctx context.Context) error {
+	n := len(importer.hits)
+	hits := resolveLocations(importer.hits, importer.geo, importer.sheepcount.geo)
+	if blocked := n - len(hits); blocked > 0 {
+		importer.skipped["location"] += blocked
+	}
+
+	conn, err := importer.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := importer.writer.WriteBatch(ctx, conn, hits); err != nil {
+		return err
+	}
+
+	for i := range hits {
+		if hits[i].Timestamp < importer.earliest {
+			importer.earliest = hits[i].Timestamp
+		}
+	}
+	importer.imported += len(hits)
+	importer.hits = importer.hits[:0]
+
+	return nil
+}
+
+// Write the rest of the hits, then stitch them into visits and roll them up from the earliest.
+func (importer *accessLogImporter) Finish(ctx context.Context) error {
+	if err := importer.flush(ctx); err != nil {
+		return err
+	}
+
+	if importer.imported == 0 {
+		return nil
+	}
+
+	if err := dbStitchSessions(ctx, importer.db); err != nil {
+		return fmt.Errorf("cannot stitch sessions: %w", err)
+	}
+
+	if err := dbAggregateFrom(ctx, importer.db, importer.earliest); err != nil {
+		return fmt.Errorf("cannot aggregate: %w", err)
+	}
+
+	return nil
+}
+
+// The GeoIP database that the server uses, if any. It is never downloaded by the import.
+func loadGeoIP(statePath string, external string) (*GeoIP, error) {
+	if external != "" {
+		geo := &GeoIP{external: external}
+		if err := geo.Reload(); err != nil {
+			return nil, err
+		}
+		return geo, nil
+	}
+
+	f, err := os.Open(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var state struct {
+		GeoIP GeoIP `json:"geoip"`
+	}
+	if err := json.NewDecoder(f).Decode(&state); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", statePath, err)
+	}
+	if state.GeoIP.path == "" {
+		return nil, nil
+	}
+
+	reader, err := geoip2.Open(state.GeoIP.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GeoIP{path: state.GeoIP.path, reader: reader}, nil
+}
+
+func openAccessLog(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(name, ".gz") {
+		return f, nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipFile{Reader: gz, file: f}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (gz *gzipFile) Close() error {
+	gz.Reader.Close()
+	return gz.file.Close()
+}
+
+func newImportCommand(configPath *string, databasePath *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import hits from elsewhere",
+	}
+
+	var format string
+	var site string
+
+	accessLog := &cobra.Command{
+		Use:   "accesslog [file...]",
+		Short: "Import the page loads in web server access logs, oldest first, or from stdin",
+		Long: `Import the page loads in web server access logs, such as to count the visits from before
+SheepCount was set up. Requests for assets, and requests that were not successful, are skipped, as are
+the requests from after the first hit of each site, which have been counted already. Files ending in
+.gz are decompressed.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config := DefaultConfig()
+			if _, err := toml.DecodeFile(*configPath, &config); err != nil {
+				return err
+			}
+
+			if config.clickhouseStorage() {
+				return errors.New("access logs can only be imported with sqlite storage")
+			}
+
+			parse, ok := accessLogParsers[format]
+			if !ok {
+				return fmt.Errorf("unknown format %s", format)
+			}
+			if site == "" && format != "caddy" {
+				return errors.New("--site is required, as only Caddy logs have the site of each request")
+			}
+
+			geo, err := loadGeoIP(statePath, config.GeoIPPath)
+			if err != nil {
+				return err
+			}
+			if geo != nil {
+				defer geo.Close()
+			}
+
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			importer, err := newAccessLogImporter(cmd.Context(), db, config, geo, site)
+			if err != nil {
+				return err
+			}
+			defer importer.Close()
+
+			if len(args) == 0 {
+				args = []string{"-"}
+			}
+			for _, name := range args {
+				f, err := openAccessLog(name)
+				if err != nil {
+					return err
+				}
+				err = importer.Import(cmd.Context(), f, parse)
+				f.Close()
+				if err != nil {
+					return fmt.Errorf("cannot import %s: %w", name, err)
+				}
+			}
+
+			if err := importer.Finish(cmd.Context()); err != nil {
+				return err
+			}
+
+			fmt.Printf("%-10s %d\n", "imported", importer.imported)
+			reasons := make([]string, 0, len(importer.skipped))
+			for reason := range importer.skipped {
+				reasons = append(reasons, reason)
+			}
+			sort.Strings(reasons)
+			for _, reason := range reasons {
+				fmt.Printf("%-10s %d\n", reason, importer.skipped[reason])
+			}
+
+			return nil
+		},
+	}
+
+	accessLog.Flags().StringVar(&format, "format", "combined", "Format of the logs: combined, nginx, apache, common or caddy")
+	accessLog.Flags().StringVar(&site, "site", "", "Site of the logs, unless they are Caddy logs")
+
+	cmd.AddCommand(accessLog)
+
+	return cmd
+}
@@ -0,0 +1,113 @@
+package sheepcount
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAccessLogs(t *testing.T) {
+	entry, err := parseCombinedLogLine(`203.0.113.7 - - [01/Jun/2022:10:00:00 +0100] "GET /blog/?page=2 HTTP/1.1" 200 5120 "https://www.google.com/" "Mozilla/5.0 (\"quoted\")"`)
+	require.NoError(t, err)
+	assert.True(t, time.Date(2022, 6, 1, 9, 0, 0, 0, time.UTC).Equal(entry.Time))
+	assert.Equal(t, net.ParseIP("203.0.113.7"), entry.IP)
+	assert.Equal(t, "GET", entry.Method)
+	assert.Equal(t, "/blog/?page=2", entry.URI)
+	assert.Equal(t, 200, entry.Status)
+	assert.Equal(t, "https://www.google.com/", entry.Referrer)
+	assert.Equal(t, `Mozilla/5.0 ("quoted")`, entry.UserAgent)
+
+	// The common log format has no referrer or user agent, which are - when not sent
+	for _, line := range []string{
+		`203.0.113.7 - frank [01/Jun/2022:10:00:00 +0100] "GET / HTTP/1.0" 304 -`,
+		`203.0.113.7 - - [01/Jun/2022:10:00:00 +0100] "GET / HTTP/1.1" 304 0 "-" "-"`,
+	} {
+		entry, err := parseCombinedLogLine(line)
+		require.NoError(t, err, line)
+		assert.Equal(t, "/", entry.URI, line)
+		assert.Equal(t, 304, entry.Status, line)
+		assert.Empty(t, entry.Referrer, line)
+		assert.Empty(t, entry.UserAgent, line)
+	}
+
+	_, err = parseCombinedLogLine(`203.0.113.7 - - [yesterday] "GET / HTTP/1.1" 200 0`)
+	assert.Error(t, err)
+
+	entry, err = parseCaddyLogLine(`{"level":"info","ts":1654074000.25,"logger":"http.log.access","msg":"handled request","request":{"remote_ip":"10.0.0.1","client_ip":"203.0.113.7","proto":"HTTP/2.0","method":"GET","host":"example.com:443","uri":"/about","headers":{"User-Agent":["Mozilla/5.0"],"Referer":["https://example.org/"]}},"status":200}`)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1654074000), entry.Time.Unix())
+	assert.Equal(t, net.ParseIP("203.0.113.7"), entry.IP)
+	assert.Equal(t, "example.com", entry.Host)
+	assert.Equal(t, "/about", entry.URI)
+	assert.Equal(t, "https://example.org/", entry.Referrer)
+	assert.Equal(t, "Mozilla/5.0", entry.UserAgent)
+
+	// Older versions of Caddy, and a time_format
+	entry, err = parseCaddyLogLine(`{"ts":"2022-06-01T09:00:00Z","request":{"remote_addr":"203.0.113.7:51234","method":"GET","host":"example.com","uri":"/"},"status":200}`)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1654074000), entry.Time.Unix())
+	assert.Equal(t, net.ParseIP("203.0.113.7"), entry.IP)
+}
+
+func TestImportAccessLog(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+
+	config := DefaultConfig()
+	config.Domains = []string{"example.com"}
+
+	importer, err := newAccessLogImporter(ctx, db, config, nil, "Example.com")
+	require.NoError(t, err)
+	defer importer.Close()
+
+	const ua = `"https://www.google.com/" "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0"`
+	log := strings.Join([]string{
+		`203.0.113.7 - - [01/Jun/2022:10:00:00 +0000] "GET / HTTP/1.1" 200 5120 ` + ua,
+		`203.0.113.7 - - [01/Jun/2022:10:00:01 +0000] "GET /style.css HTTP/1.1" 200 512 ` + ua,
+		`203.0.113.7 - - [01/Jun/2022:10:05:00 +0000] "GET /about HTTP/1.1" 200 2048 ` + ua,
+		`203.0.113.7 - - [01/Jun/2022:10:05:01 +0000] "GET /about HTTP/1.1" 304 0 ` + ua,
+		`203.0.113.7 - - [01/Jun/2022:10:06:00 +0000] "POST /contact HTTP/1.1" 200 0 ` + ua,
+		`203.0.113.7 - - [01/Jun/2022:10:07:00 +0000] "GET /missing HTTP/1.1" 404 0 ` + ua,
+		`not a log line`,
+	}, "\n")
+
+	require.NoError(t, importer.Import(ctx, strings.NewReader(log), parseCombinedLogLine))
+	require.NoError(t, importer.Finish(ctx))
+	assert.Equal(t, 2, importer.imported)
+	assert.Equal(t, map[string]int{"asset": 1, "duplicate": 1, "method": 1, "status": 1, "malformed": 1}, importer.skipped)
+
+	// The page loads are one visit of one visitor, and are rolled up although they are from long ago
+	var pageviews, visitors, sessions int
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT SUM(pageviews), SUM(visitors) FROM totals_daily").Scan(&pageviews, &visitors))
+	assert.Equal(t, 2, pageviews)
+	assert.Equal(t, 1, visitors)
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sessions").Scan(&sessions))
+	assert.Equal(t, 1, sessions)
+
+	// Requests from after the first hit have been counted already
+	importer, err = newAccessLogImporter(ctx, db, config, nil, "example.com")
+	require.NoError(t, err)
+	defer importer.Close()
+
+	log = strings.Join([]string{
+		`203.0.113.8 - - [31/May/2022:10:00:00 +0000] "GET / HTTP/1.1" 200 5120 ` + ua,
+		`203.0.113.8 - - [01/Jun/2022:11:00:00 +0000] "GET / HTTP/1.1" 200 5120 ` + ua,
+	}, "\n")
+	require.NoError(t, importer.Import(ctx, strings.NewReader(log), parseCombinedLogLine))
+	require.NoError(t, importer.Finish(ctx))
+	assert.Equal(t, 1, importer.imported)
+	assert.Equal(t, map[string]int{"counted": 1}, importer.skipped)
+
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT SUM(pageviews), SUM(visitors) FROM totals_daily").Scan(&pageviews, &visitors))
+	assert.Equal(t, 3, pageviews)
+	assert.Equal(t, 2, visitors)
+}
@@ -0,0 +1,573 @@
+package sheepcount
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Roles of dashboard accounts
+const (
+	roleAdmin  = "admin"
+	roleViewer = "viewer" // Read-only
+)
+
+var ErrInvalidLogin = errors.New("invalid name or password")
+
+// An account that can log in to the dashboard. Before any accounts are added, logging in with the
+// shared password of the configuration gives an admin that can see every site.
+type account struct {
+	Id         int64
+	Name       string
+	Role       string
+	Sites      []string // The only sites that the account can see, or all of them if empty
+	Generation int64    // Increased when the password changes, which logs out the sessions
+	TwoFactor  bool     // Whether logging in needs a TOTP code as well as the password
+
+	// The time zone that the dashboard counts days in for the account, or nil for that of the
+	// dashboard
+	Timezone *time.Location
+}
+
+// Can the account see the stats of the site? An empty site stands for all of them.
+func (account *account) canSee(site string) bool {
+	if len(account.Sites) == 0 {
+		return true
+	}
+	for _, s := range account.Sites {
+		if s == site {
+			return true
+		}
+	}
+	return false
+}
+
+func (account *account) canWrite() bool {
+	return account.Role == roleAdmin
+}
+
+func validRole(role string) bool {
+	return role == roleAdmin || role == roleViewer
+}
+
+func dbAddAccount(ctx context.Context, db *sql.DB, name string, password string, role string, sites []string) error {
+	if !validRole(role) {
+		return fmt.Errorf("role must be %s or %s, not %s", roleAdmin, roleViewer, role)
+	}
+
+	salt, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRowContext(
+		ctx,
+		"INSERT INTO users_admin (name, password_hash, password_salt, role) VALUES (?, ?, ?, ?) RETURNING account_id",
+		name, hashPassword(password, []byte(salt)), salt, role,
+	).Scan(&id)
+	if isConstraintError(err) {
+		return fmt.Errorf("an account called %s already exists", name)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, site := range sites {
+		_, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO users_admin_sites (account_id, domain) VALUES (?, ?)", id, strings.ToLower(site))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func dbRemoveAccount(ctx context.Context, db *sql.DB, name string) (bool, error) {
+	result, err := db.ExecContext(ctx, "DELETE FROM users_admin WHERE name = ?", name)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Change the password of an account, which logs out all of its sessions.
+func dbSetAccountPassword(ctx context.Context, db *sql.DB, name string, password string) (bool, error) {
+	salt, err := randomHex(16)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := db.ExecContext(
+		ctx,
+		"UPDATE users_admin SET password_hash = ?, password_salt = ?, generation = generation + 1 WHERE name = ?",
+		hashPassword(password, []byte(salt)), salt, name,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Set the time zone of an account, or go back to that of the dashboard if it is empty.
+func dbSetAccountTimezone(ctx context.Context, db *sql.DB, name string, timezone string) (bool, error) {
+	if timezone != "" {
+		if _, err := loadTimezone(timezone); err != nil {
+			return false, fmt.Errorf("invalid timezone: %w", err)
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(
+		ctx,
+		"UPDATE users_admin SET timezone = ? WHERE name = ?",
+		sql.NullString{String: timezone, Valid: timezone != ""}, name,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	// Its days are rolled up from the next aggregation, and a time zone that is no longer used
+	// stops being rolled up when the server restarts
+	if timezone != "" && timezone != "UTC" {
+		if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO rollup_timezones (timezone) VALUES (?)", timezone); err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+// The time zone that the dashboard counts days in for the account.
+func (sheepcount *SheepCount) accountLocation(account *account) *time.Location {
+	if account.Timezone != nil {
+		return account.Timezone
+	}
+	return sheepcount.location
+}
+
+func dbHasAccounts(ctx context.Context, db *sql.DB) (bool, error) {
+	var has bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users_admin)").Scan(&has)
+	return has, err
+}
+
+func dbAccountSites(ctx context.Context, db *sql.DB, id int64) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT domain FROM users_admin_sites WHERE account_id = ? ORDER BY domain", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sites []string
+	for rows.Next() {
+		var site string
+		if err := rows.Scan(&site); err != nil {
+			return nil, err
+		}
+		sites = append(sites, site)
+	}
+
+	return sites, rows.Err()
+}
+
+// The account with the ID, or nil if there is none.
+func dbAccount(ctx context.Context, db *sql.DB, id int64) (*account, error) {
+	a := account{Id: id}
+	var timezone sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT name, role, generation, totp_secret IS NOT NULL, timezone FROM users_admin WHERE account_id = ?", id).Scan(&a.Name, &a.Role, &a.Generation, &a.TwoFactor, &timezone)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The time zone was checked when it was set, but could since have gone from the time zone
+	// database
+	if timezone.Valid {
+		if a.Timezone, err = loadTimezone(timezone.String); err != nil {
+			log.Printf("account %s: %s", a.Name, err)
+		}
+	}
+
+	if a.Sites, err = dbAccountSites(ctx, db, id); err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+// Check the name and password of an account, returning ErrInvalidLogin if either is wrong.
+func dbLogin(ctx context.Context, db *sql.DB, name string, password string) (*account, error) {
+	var id int64
+	var hash, salt string
+	err := db.QueryRowContext(ctx, "SELECT account_id, password_hash, password_salt FROM users_admin WHERE name = ?", name).Scan(&id, &hash, &salt)
+	if err == sql.ErrNoRows {
+		// Take as long as a wrong password, so that names cannot be guessed from the time taken
+		hashPassword(password, []byte(name))
+		return nil, ErrInvalidLogin
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashPassword(password, []byte(salt))), []byte(hash)) != 1 {
+		return nil, ErrInvalidLogin
+	}
+
+	return dbAccount(ctx, db, id)
+}
+
+func hashSessionID(id string) []byte {
+	hash := blake2b.Sum256([]byte(id))
+	return hash[:]
+}
+
+// Start a session of the account, or of the shared password if the ID is zero, returning the ID for
+// the cookie. Expired sessions are cleared out at the same time.
+func dbCreateAdminSession(ctx context.Context, db *sql.DB, accountID int64, expires time.Time) (string, error) {
+	id, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM admin_sessions WHERE expires_at <= strftime('%s', 'now')"); err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO admin_sessions (hash, account_id, expires_at) VALUES (?, ?, ?)",
+		hashSessionID(id), sql.NullInt64{Int64: accountID, Valid: accountID != 0}, expires.Unix(),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return id, tx.Commit()
+}
+
+func dbAdminSessionValid(ctx context.Context, db *sql.DB, id string, accountID int64, now time.Time) (bool, error) {
+	var valid bool
+	err := db.QueryRowContext(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM admin_sessions WHERE hash = ? AND account_id IS ? AND expires_at > ?)",
+		hashSessionID(id), sql.NullInt64{Int64: accountID, Valid: accountID != 0}, now.Unix(),
+	).Scan(&valid)
+	return valid, err
+}
+
+func dbEndAdminSession(ctx context.Context, db *sql.DB, id string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM admin_sessions WHERE hash = ?", hashSessionID(id))
+	return err
+}
+
+// End the sessions of the account, or every session if the name is empty, returning how many there
+// were.
+func dbEndAccountSessions(ctx context.Context, db *sql.DB, name string) (int64, error) {
+	var result sql.Result
+	var err error
+	if name == "" {
+		result, err = db.ExecContext(ctx, "DELETE FROM admin_sessions")
+	} else {
+		result, err = db.ExecContext(ctx, "DELETE FROM admin_sessions WHERE account_id = (SELECT account_id FROM users_admin WHERE name = ?)", name)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// The account that the request is logged in to the dashboard as, or nil if it is not. Sessions end
+// when they expire or are ended on the server, when their account is removed or its password or
+// second factor changes, and sessions of the shared password end once the first account is added.
+func (sheepcount *SheepCount) session(r *http.Request) *account {
+	token := sheepcount.getAuthCookie(r)
+	if !token.LoggedIn {
+		return nil
+	}
+
+	valid, err := dbAdminSessionValid(r.Context(), sheepcount.db, token.Session, token.Account, time.Now())
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	if !valid {
+		return nil
+	}
+
+	if token.Account == 0 {
+		has, err := dbHasAccounts(r.Context(), sheepcount.db)
+		if err != nil {
+			log.Print(err)
+			return nil
+		}
+		if has {
+			return nil
+		}
+		return &account{Role: roleAdmin}
+	}
+
+	a, err := dbAccount(r.Context(), sheepcount.db, token.Account)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	if a == nil || a.Generation != token.Generation {
+		return nil
+	}
+
+	return a
+}
+
+func newUserCommand(databasePath *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "user",
+		Short: "Manage the accounts that can log in to the dashboard",
+	}
+
+	var role string
+	var sites []string
+
+	add := &cobra.Command{
+		Use:   "add <name>",
+		Short: "Add an account, reading its password from the terminal or stdin",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !validRole(role) {
+				return fmt.Errorf("role must be %s or %s, not %s", roleAdmin, roleViewer, role)
+			}
+
+			password, err := readPassword()
+			if err != nil {
+				return err
+			}
+			if password == "" {
+				return errors.New("password cannot be empty")
+			}
+
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			hadAccounts, err := dbHasAccounts(cmd.Context(), db)
+			if err != nil {
+				return err
+			}
+
+			if err := dbAddAccount(cmd.Context(), db, args[0], password, role, sites); err != nil {
+				return err
+			}
+
+			if !hadAccounts {
+				log.Print("The shared password no longer logs in to the dashboard now that there is an account.")
+			}
+			return nil
+		},
+	}
+	add.Flags().StringVar(&role, "role", roleAdmin, "admin, or viewer for read-only access")
+	add.Flags().StringArrayVar(&sites, "site", nil, "A site that the account can see, instead of all of them (repeatable)")
+	cmd.AddCommand(add)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "remove <name>",
+		Short: "Remove an account, logging it out",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			ok, err := dbRemoveAccount(cmd.Context(), db, args[0])
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("no such account: %s", args[0])
+			}
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "set-password <name>",
+		Short: "Change the password of an account, logging out its sessions",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			password, err := readPassword()
+			if err != nil {
+				return err
+			}
+			if password == "" {
+				return errors.New("password cannot be empty")
+			}
+
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			ok, err := dbSetAccountPassword(cmd.Context(), db, args[0], password)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("no such account: %s", args[0])
+			}
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "set-timezone <name> [<timezone>]",
+		Short: "Set the time zone that the dashboard counts days in for an account, or without one go back to that of the dashboard",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var timezone string
+			if len(args) == 2 {
+				timezone = args[1]
+			}
+
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			ok, err := dbSetAccountTimezone(cmd.Context(), db, args[0], timezone)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("no such account: %s", args[0])
+			}
+			return nil
+		},
+	})
+
+	cmd.AddCommand(newTOTPCommand(databasePath))
+
+	var all bool
+	logout := &cobra.Command{
+		Use:   "logout [<name>]",
+		Short: "End the sessions of an account, or of everyone with --all",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if all == (len(args) == 1) {
+				return errors.New("give either the name of an account or --all")
+			}
+
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			var name string
+			if !all {
+				name = args[0]
+			}
+
+			n, err := dbEndAccountSessions(cmd.Context(), db, name)
+			if err != nil {
+				return err
+			}
+
+			log.Printf("Ended %d sessions.", n)
+			return nil
+		},
+	}
+	logout.Flags().BoolVar(&all, "all", false, "End every session, including those of the shared password")
+	cmd.AddCommand(logout)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the accounts",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			rows, err := db.QueryContext(
+				cmd.Context(),
+				`SELECT name, role, totp_secret IS NOT NULL, created_at, timezone, (SELECT group_concat(domain, ' ') FROM users_admin_sites WHERE users_admin_sites.account_id = users_admin.account_id)
+				FROM users_admin ORDER BY name`,
+			)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(tw, "NAME\tROLE\tTOTP\tCREATED\tTIMEZONE\tSITES")
+			for rows.Next() {
+				var name, role string
+				var totp bool
+				var createdAt int64
+				var timezone, sites sql.NullString
+				if err := rows.Scan(&name, &role, &totp, &createdAt, &timezone, &sites); err != nil {
+					return err
+				}
+
+				if !timezone.Valid {
+					timezone.String = "dashboard"
+				}
+				if !sites.Valid {
+					sites.String = "all"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%t\t%s\t%s\t%s\n", name, role, totp, time.Unix(createdAt, 0).Format(time.RFC3339), timezone.String, sites.String)
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			return tw.Flush()
+		},
+	})
+
+	return cmd
+}
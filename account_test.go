@@ -0,0 +1,268 @@
+package sheepcount
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccounts(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+
+	config := DefaultConfig()
+	config.CookieKey = "0123456789abcdef0123456789abcdef"
+	config.Password = hashPassword("shared", config.passwordSalt())
+	queries, err := NewQueries(db)
+	require.NoError(t, err)
+	sheepcount := &SheepCount{db: db, queries: queries, Config: config}
+
+	// A request with the cookie that logging in set
+	request := func(token authCookie) *http.Request {
+		encoded, err := sheepcount.cookieCodec().Encode(authCookieName, token)
+		require.NoError(t, err)
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: authCookieName, Value: encoded})
+		return r
+	}
+
+	// Before there are any accounts, the shared password logs in as an admin of every site
+	token, err := sheepcount.login(ctx, "", "shared")
+	require.NoError(t, err)
+	assert.True(t, token.LoggedIn)
+	shared := request(token)
+	if account := sheepcount.session(shared); assert.NotNil(t, account) {
+		assert.True(t, account.canWrite())
+		assert.True(t, account.canSee(""))
+	}
+
+	token, err = sheepcount.login(ctx, "", "wrong")
+	require.NoError(t, err)
+	assert.False(t, token.LoggedIn)
+	assert.True(t, token.InvalidPassword)
+
+	require.NoError(t, dbAddAccount(ctx, db, "alice", "secret", roleAdmin, nil))
+	require.NoError(t, dbAddAccount(ctx, db, "bob", "hunter2", roleViewer, []string{"Example.com"}))
+	assert.Error(t, dbAddAccount(ctx, db, "alice", "again", roleAdmin, nil))
+	assert.Error(t, dbAddAccount(ctx, db, "carol", "secret", "owner", nil))
+
+	// Then only the accounts can log in, and the sessions of the shared password end
+	assert.Nil(t, sheepcount.session(shared))
+	token, err = sheepcount.login(ctx, "", "shared")
+	require.NoError(t, err)
+	assert.False(t, token.LoggedIn)
+
+	for _, login := range [][2]string{{"alice", "hunter2"}, {"nobody", "secret"}} {
+		_, err := dbLogin(ctx, db, login[0], login[1])
+		assert.Equal(t, ErrInvalidLogin, err, login[0])
+	}
+
+	token, err = sheepcount.login(ctx, "bob", "hunter2")
+	require.NoError(t, err)
+	assert.True(t, token.LoggedIn)
+	bob := request(token)
+	if account := sheepcount.session(bob); assert.NotNil(t, account) {
+		assert.Equal(t, "bob", account.Name)
+		assert.False(t, account.canWrite())
+		assert.True(t, account.canSee("example.com"))
+		assert.False(t, account.canSee("example.org"))
+		assert.False(t, account.canSee(""))
+	}
+
+	// Bob cannot query the other sites
+	for _, site := range []string{"example.org", ""} {
+		r := request(token)
+		r.URL.Path = "/queries/pages"
+		r.URL.RawQuery = "site=" + site
+		w := httptest.NewRecorder()
+		handleQueries(sheepcount, w, r)
+		assert.Equal(t, http.StatusForbidden, w.Code, site)
+	}
+
+	// Nor the queries that are for administrators, and queries are only given what they declare
+	for path, status := range map[string]int{
+		"/queries/unparsed_user_agents": http.StatusForbidden,
+		"/queries/pages":                http.StatusBadRequest,
+	} {
+		r := request(token)
+		r.URL.Path = path
+		r.URL.RawQuery = "site=example.com&start_date=2022-06-01&end_date=2022-06-30&country=GB"
+		w := httptest.NewRecorder()
+		handleQueries(sheepcount, w, r)
+		assert.Equal(t, status, w.Code, path)
+	}
+
+	// An account can count days in its own time zone
+	ok, err := dbSetAccountTimezone(ctx, db, "bob", "Asia/Kolkata")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	_, err = dbSetAccountTimezone(ctx, db, "bob", "Nowhere/Else")
+	assert.Error(t, err)
+	ok, err = dbSetAccountTimezone(ctx, db, "bob", "America/New_York")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = dbSetAccountTimezone(ctx, db, "nobody", "UTC")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	if account := sheepcount.session(bob); assert.NotNil(t, account) {
+		assert.Equal(t, "America/New_York", sheepcount.accountLocation(account).String())
+	}
+
+	// A pageview at 02:00 UTC on 2 June is on 1 June in New York, unless another time zone is given
+	_, err = db.Exec("INSERT INTO sites (domain) VALUES ('example.com')")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO totals_hourly (hour, site_id, bot, pageviews, visitors) VALUES (1654135200, 1, 0, 1, 1)")
+	require.NoError(t, err)
+	for timezone, expected := range map[string]string{"": `[{"date": "2022-06-01", "pageviews": 1, "visitors": 1, "new_visitors": 1, "returning_visitors": 0, "annotations": []}]`, "UTC": "[]"} {
+		r := request(token)
+		r.URL.Path = "/queries/pageviews"
+		r.URL.RawQuery = "site=example.com&start_date=2022-06-01&end_date=2022-06-01"
+		if timezone != "" {
+			r.URL.RawQuery += "&timezone=" + timezone
+		}
+		w := httptest.NewRecorder()
+		handleQueries(sheepcount, w, r)
+		assert.Equal(t, http.StatusOK, w.Code, timezone)
+		assert.JSONEq(t, expected, w.Body.String(), timezone)
+	}
+
+	// Another time zone must be one whose days are rolled up
+	r := request(token)
+	r.URL.Path = "/queries/pageviews"
+	r.URL.RawQuery = "site=example.com&start_date=2022-06-01&end_date=2022-06-01&timezone=America/Chicago"
+	w := httptest.NewRecorder()
+	handleQueries(sheepcount, w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Changing the password logs out the sessions of the account
+	ok, err = dbSetAccountPassword(ctx, db, "bob", "correct horse")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Nil(t, sheepcount.session(bob))
+
+	token, err = sheepcount.login(ctx, "alice", "secret")
+	require.NoError(t, err)
+	alice := request(token)
+	assert.NotNil(t, sheepcount.session(alice))
+
+	// As does removing the account
+	ok, err = dbRemoveAccount(ctx, db, "alice")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Nil(t, sheepcount.session(alice))
+
+	ok, err = dbRemoveAccount(ctx, db, "alice")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestAdminSessions(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+
+	config := DefaultConfig()
+	config.CookieKey = "0123456789abcdef0123456789abcdef"
+	config.ReverseProxy = true
+	config.CookieSameSite = "strict"
+	sheepcount := &SheepCount{db: db, Config: config}
+
+	require.NoError(t, dbAddAccount(ctx, db, "alice", "secret", roleAdmin, nil))
+
+	login := func() *http.Cookie {
+		token, err := sheepcount.login(ctx, "alice", "secret")
+		require.NoError(t, err)
+		require.True(t, token.LoggedIn)
+
+		w := httptest.NewRecorder()
+		require.NoError(t, sheepcount.setAuthCookie(w, httptest.NewRequest(http.MethodPost, "/login", nil), token))
+		cookies := w.Result().Cookies()
+		require.Len(t, cookies, 1)
+		return cookies[0]
+	}
+
+	request := func(cookie *http.Cookie) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/logout", nil)
+		r.AddCookie(cookie)
+		return r
+	}
+
+	cookie := login()
+	assert.True(t, cookie.Secure)
+	assert.True(t, cookie.HttpOnly)
+	assert.Equal(t, http.SameSiteStrictMode, cookie.SameSite)
+	assert.Equal(t, int(config.SessionLifetime/time.Second), cookie.MaxAge)
+	assert.NotNil(t, sheepcount.session(request(cookie)))
+
+	// The cookie is encrypted, so cannot be read without the key
+	sc := securecookie.New([]byte(config.CookieKey), nil)
+	sc.SetSerializer(securecookie.JSONEncoder{})
+	assert.Error(t, sc.Decode(authCookieName, cookie.Value, &authCookie{}))
+
+	// Logging out ends the session, even if the cookie is used again
+	w := httptest.NewRecorder()
+	handleLogout(sheepcount, w, request(cookie))
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Nil(t, sheepcount.session(request(cookie)))
+
+	// As does ending the sessions of the account on the server, while other accounts stay logged in
+	first, second := login(), login()
+	require.NoError(t, dbAddAccount(ctx, db, "bob", "hunter2", roleViewer, nil))
+	token, err := sheepcount.login(ctx, "bob", "hunter2")
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	require.NoError(t, sheepcount.setAuthCookie(w, httptest.NewRequest(http.MethodPost, "/login", nil), token))
+	bob := w.Result().Cookies()[0]
+
+	n, err := dbEndAccountSessions(ctx, db, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	assert.Nil(t, sheepcount.session(request(first)))
+	assert.Nil(t, sheepcount.session(request(second)))
+	assert.NotNil(t, sheepcount.session(request(bob)))
+
+	// Sessions expire on the server along with their cookies
+	_, err = db.ExecContext(ctx, "UPDATE admin_sessions SET expires_at = strftime('%s', 'now')")
+	require.NoError(t, err)
+	assert.Nil(t, sheepcount.session(request(bob)))
+}
+
+func TestSites(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec("INSERT INTO sites (domain) VALUES ('example.com'), ('localhost')")
+	require.NoError(t, err)
+
+	// The configured domains have room to grow, which the visited sites must not be written into,
+	// as other requests read them at the same time
+	config := DefaultConfig()
+	config.Domains = make([]string, 1, 4)
+	config.Domains[0] = "example.com"
+	sheepcount := &SheepCount{db: db, Config: config}
+
+	sites, err := sheepcount.sites(context.Background(), &account{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com", "localhost"}, sites)
+	assert.Equal(t, []string{"example.com", "", "", ""}, config.Domains[:4])
+
+	sites, err = sheepcount.sites(context.Background(), &account{Sites: []string{"localhost"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"localhost"}, sites)
+}
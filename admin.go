@@ -0,0 +1,238 @@
+package sheepcount
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/term"
+)
+
+// Names of the rows in the settings table
+const (
+	settingPassword     = "password"
+	settingPasswordSalt = "password_salt"
+	settingCookieKey    = "cookie_key"
+	settingTimezone     = "timezone"
+)
+
+// The dashboard password is stored as a hex-encoded argon2id hash.
+func hashPassword(password string, salt []byte) string {
+	return hex.EncodeToString(argon2.IDKey([]byte(password), salt, 1, 64*1024, 4, 32))
+}
+
+// The salt for the password hash. Passwords in old configuration files are salted with the cookie key.
+func (config *Config) passwordSalt() []byte {
+	if config.PasswordSalt != "" {
+		return []byte(config.PasswordSalt)
+	}
+	return []byte(config.CookieKey)
+}
+
+// Override the configuration file with any settings stored in the database.
+func (config *Config) applySettings(settings map[string]string) {
+	if password, ok := settings[settingPassword]; ok {
+		config.Password = password
+		config.PasswordSalt = settings[settingPasswordSalt]
+	}
+	if cookieKey, ok := settings[settingCookieKey]; ok {
+		config.CookieKey = cookieKey
+	}
+	if timezone, ok := settings[settingTimezone]; ok {
+		config.Timezone = timezone
+	}
+}
+
+func dbSettings(ctx context.Context, db *sql.DB) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name, value FROM settings")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settings := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		settings[name] = value
+	}
+
+	return settings, rows.Err()
+}
+
+func dbSetSettings(ctx context.Context, db *sql.DB, settings map[string]string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for name, value := range settings {
+		_, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO settings (name, value) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET value = excluded.value",
+			name,
+			value,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Read the new password from the terminal without echoing it, or else from the first line of stdin.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !isatty.IsTerminal(os.Stdin.Fd()) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "New password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprint(os.Stderr, "Confirm password: ")
+	confirm, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if string(password) != string(confirm) {
+		return "", errors.New("passwords do not match")
+	}
+
+	return string(password), nil
+}
+
+func newAdminCommand(databasePath *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "admin",
+		Short: "Manage the dashboard password, time zone and keys",
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "set-password",
+		Short: "Set the dashboard password",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			password, err := readPassword()
+			if err != nil {
+				return err
+			}
+			if password == "" {
+				return errors.New("password cannot be empty")
+			}
+
+			salt, err := randomHex(16)
+			if err != nil {
+				return err
+			}
+
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			err = dbSetSettings(cmd.Context(), db, map[string]string{
+				settingPassword:     hashPassword(password, []byte(salt)),
+				settingPasswordSalt: salt,
+			})
+			if err != nil {
+				return err
+			}
+
+			log.Print("Password set. Restart SheepCount for it to take effect.")
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "set-timezone <name>",
+		Short: "Set the time zone that the dashboard counts days in, such as Europe/London",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if _, err := loadTimezone(args[0]); err != nil {
+				return fmt.Errorf("invalid timezone: %w", err)
+			}
+
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			if err := dbSetSettings(cmd.Context(), db, map[string]string{settingTimezone: args[0]}); err != nil {
+				return err
+			}
+
+			log.Print("Time zone set. Restart SheepCount for it to take effect.")
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "rotate-cookie-key",
+		Short: "Generate a new cookie key, logging everyone out",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			settings, err := dbSettings(cmd.Context(), db)
+			if err != nil {
+				return err
+			}
+
+			key, err := randomHex(32)
+			if err != nil {
+				return err
+			}
+
+			if err := dbSetSettings(cmd.Context(), db, map[string]string{settingCookieKey: key}); err != nil {
+				return err
+			}
+
+			log.Print("Cookie key rotated. Restart SheepCount for it to take effect.")
+			if _, ok := settings[settingPassword]; !ok {
+				log.Print("The password in the configuration file is salted with the old cookie key, so set it again with `sheepcount admin set-password`.")
+			}
+			return nil
+		},
+	})
+
+	return cmd
+}
@@ -0,0 +1,510 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// Periodically stitch hits into sessions and roll up the raw hits into the hourly and daily tables,
+// and those of the days of other time zones, which the dashboard queries use instead of scanning
+// every hit. aggregated is called after each roll up, so that cached results of the queries can be
+// dropped.
+func Aggregator(ctx context.Context, db *sql.DB, interval time.Duration, aggregated func()) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := dbStitchSessions(ctx, db); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("cannot stitch sessions: %s", err)
+		}
+
+		if err := dbAggregate(ctx, db); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("cannot aggregate hits: %s", err)
+		} else {
+			aggregated()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// The hits of each period of a rollup are selected by the period expression, and the join that it
+// needs if any: UTC hours and days are divisions of the timestamp, but the days of other time zones
+// start and end at the UTC timestamps in :days, as bindPeriod gives them.
+const (
+	utcPeriod   = "(hits.timestamp / :period) * :period"
+	localPeriod = "days.start"
+	localJoin   = `INNER JOIN (
+			SELECT json_extract(value, '$.start') AS start, json_extract(value, '$.end') AS end FROM json_each(:days)
+		) AS days ON hits.timestamp >= days.start AND hits.timestamp < days.end`
+)
+
+// Hits are joined to the country of their location (the root of the locations tree) and the browser
+// of their user agent. A hit is from a bot if either its user agent or the hit itself, e.g. from a
+// botty IP address range, says so.
+const aggregateHitsQuery = `
+	WITH RECURSIVE
+		countries(location_id, country) AS (
+			SELECT location_id, country FROM locations WHERE country IS NOT NULL
+			UNION ALL
+			SELECT locations.location_id, countries.country
+			FROM locations INNER JOIN countries ON locations.parent_id = countries.location_id
+		)
+	SELECT %[2]s
+		, hits.site_id
+		, hits.path_id
+		, hits.referrer_id
+		, countries.country
+		, user_agents.browser_id
+		, COALESCE(hits.bot, 0) >= 2 OR user_agents.bot >= 2
+		, COUNT(*)
+		, COUNT(DISTINCT hits.user_id)
+	FROM %[1]s AS hits
+	%[3]s
+	INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+	LEFT JOIN countries ON hits.location_id = countries.location_id
+	WHERE hits.event = 'l' AND hits.timestamp >= :since
+	GROUP BY 1, 2, 3, 4, 5, 6, 7`
+
+// A hit is from a returning visitor if they had an earlier visit, which ended at least sessionTimeout
+// before the visit that the hit is in started, so they were first seen before then. Comparing with
+// the start of the visit rather than of the first visit keeps hits that were written late, and so
+// moved when the user was first seen, in the visit that they belong to. The session stitcher runs
+// first, so every page load is in a visit, but in case one is not the hit is taken to start it.
+const aggregateTotalsQuery = `
+	WITH totals AS (
+		SELECT %[2]s AS period
+			, hits.site_id
+			, hits.user_id
+			, COALESCE(hits.bot, 0) >= 2 OR user_agents.bot >= 2 AS bot
+			, COALESCE(users.created_at < COALESCE(sessions.started, hits.timestamp) - 1800, 0) AS returned
+		FROM %[1]s AS hits
+		%[3]s
+		INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+		INNER JOIN users ON hits.user_id = users.user_id
+		LEFT JOIN session_pages ON hits.hit_id = session_pages.hit_id
+		LEFT JOIN sessions ON session_pages.session_id = sessions.session_id
+		WHERE hits.event = 'l' AND hits.timestamp >= :since
+	)
+	SELECT period
+		, site_id
+		, bot
+		, COUNT(*)
+		, COUNT(DISTINCT user_id)
+		, SUM(returned)
+		, COUNT(DISTINCT CASE WHEN returned THEN user_id END)
+	FROM totals
+	GROUP BY 1, 2, 3`
+
+type rollup struct {
+	table   string
+	column  string
+	columns string
+	period  int64
+	query   string
+}
+
+var rollups = []rollup{
+	{
+		table:   "hits_hourly",
+		column:  "hour",
+		columns: "site_id, path_id, referrer_id, country, browser_id, bot, pageviews, visitors",
+		period:  60 * 60,
+		query:   aggregateHitsQuery,
+	},
+	{
+		table:   "hits_daily",
+		column:  "day",
+		columns: "site_id, path_id, referrer_id, country, browser_id, bot, pageviews, visitors",
+		period:  24 * 60 * 60,
+		query:   aggregateHitsQuery,
+	},
+	{
+		table:   "totals_hourly",
+		column:  "hour",
+		columns: "site_id, bot, pageviews, visitors, returning_pageviews, returning_visitors",
+		period:  60 * 60,
+		query:   aggregateTotalsQuery,
+	},
+	{
+		table:   "totals_daily",
+		column:  "day",
+		columns: "site_id, bot, pageviews, visitors, returning_pageviews, returning_visitors",
+		period:  24 * 60 * 60,
+		query:   aggregateTotalsQuery,
+	},
+}
+
+// Recompute the rollups from the most recent period onwards. The most recent period is probably
+// incomplete, and hits may be written a little after they happened, so it is always recomputed.
+func dbAggregate(ctx context.Context, db *sql.DB) error {
+	return dbAggregateFrom(ctx, db, math.MaxInt64)
+}
+
+// Recompute the rollups from the period of the timestamp onwards if that is earlier, such as after
+// hits from long ago have been imported.
+func dbAggregateFrom(ctx context.Context, db *sql.DB, from int64) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// See the comment in HitWriter.WriteBatch
+	if _, err := tx.ExecContext(ctx, "ROLLBACK; BEGIN IMMEDIATE"); err != nil {
+		return err
+	}
+
+	// The rollups of months whose hits have been dropped are kept as they are, as they cannot be
+	// recomputed
+	partitions, err := dbHitPartitions(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if len(partitions) == 0 {
+		return nil
+	}
+	oldest := partitions[0].start
+
+	for _, rollup := range rollups {
+		var latest sql.NullInt64
+		row := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT MAX(%s) FROM %s", rollup.column, rollup.table))
+		if err := row.Scan(&latest); err != nil {
+			return fmt.Errorf("%s select error: %w", rollup.table, err)
+		}
+
+		// Also recompute the previous period in case hits were written late
+		since := latest.Int64 - rollup.period
+		if !latest.Valid || since < 0 {
+			since = 0
+		}
+		if start := from - from%rollup.period; start < since {
+			since = start
+		}
+		if since < oldest {
+			since = oldest
+		}
+
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s >= ? AND %s", rollup.table, rollup.column, hitsMonths(rollup.column, partitions)), since)
+		if err != nil {
+			return fmt.Errorf("%s delete error: %w", rollup.table, err)
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			fmt.Sprintf("INSERT INTO %s (%s, %s) %s", rollup.table, rollup.column, rollup.columns, fmt.Sprintf(rollup.query, hitsUnion(partitions, since), utcPeriod, "")),
+			sql.Named("period", rollup.period),
+			sql.Named("since", since),
+		)
+		if err != nil {
+			return fmt.Errorf("%s insert error: %w", rollup.table, err)
+		}
+
+		if rollup.table == "totals_daily" {
+			if err := dbEstimateDailyVisitors(ctx, tx, since); err != nil {
+				return fmt.Errorf("visitor estimate error: %w", err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return dbAggregateLocalDays(ctx, db, from, time.Now())
+}
+
+// The most days of a time zone that are rolled up in one transaction. The first roll up of a time
+// zone is of all of the hits, which in one transaction would keep the hit writer waiting for longer
+// than its busy timeout.
+const localDaysPerTransaction = 31
+
+// The rollups of the days of the time zones in rollup_timezones, which have a timezone column
+// before the day.
+var localRollups = []struct {
+	table   string
+	columns string
+	query   string
+}{
+	{
+		table:   "hits_local_daily",
+		columns: "site_id, path_id, referrer_id, country, browser_id, bot, pageviews, visitors",
+		query:   aggregateHitsQuery,
+	},
+	{
+		table:   "totals_local_daily",
+		columns: "site_id, bot, pageviews, visitors, returning_pageviews, returning_visitors",
+		query:   aggregateTotalsQuery,
+	},
+}
+
+// Recompute the rollups of the days of each time zone from the day before the most recent one, or
+// the day of the timestamp if that is earlier, up to the day of now, localDaysPerTransaction days at
+// a time. A time zone that has not been rolled up before is from the day that the oldest hits start
+// in, or from the first local midnight after them if that day is partly in months that have been
+// dropped, whose hits only the rollups of UTC hours have.
+func dbAggregateLocalDays(ctx context.Context, db *sql.DB, from int64, now time.Time) error {
+	timezones, err := dbLocalRollupStarts(ctx, db, from)
+	if err != nil {
+		return err
+	}
+
+	for _, tz := range timezones {
+		today := startOfDay(now.In(tz.loc))
+		for start := tz.since; !start.After(today); start = start.AddDate(0, 0, localDaysPerTransaction) {
+			end := start.AddDate(0, 0, localDaysPerTransaction-1)
+			if end.After(today) {
+				end = today
+			}
+			if err := dbAggregateLocalDayRange(ctx, db, tz.name, start, end, end.Equal(today)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// A time zone whose days are rolled up, and the local midnight to recompute them from.
+type localRollupStart struct {
+	name  string
+	loc   *time.Location
+	since time.Time
+}
+
+// The days to recompute of each time zone, recording the first day of those that have not been
+// rolled up before.
+func dbLocalRollupStarts(ctx context.Context, db *sql.DB, from int64) ([]localRollupStart, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// See the comment in HitWriter.WriteBatch
+	if _, err := tx.ExecContext(ctx, "ROLLBACK; BEGIN IMMEDIATE"); err != nil {
+		return nil, err
+	}
+
+	partitions, err := dbHitPartitions(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	if len(partitions) == 0 {
+		return nil, nil
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT timezone, since FROM rollup_timezones ORDER BY timezone")
+	if err != nil {
+		return nil, err
+	}
+	type rollupTimezone struct {
+		name  string
+		since sql.NullInt64
+	}
+	var timezones []rollupTimezone
+	for rows.Next() {
+		var tz rollupTimezone
+		if err := rows.Scan(&tz.name, &tz.since); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		timezones = append(timezones, tz)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var starts []localRollupStart
+	for _, tz := range timezones {
+		// The time zone was checked when it was added, but could since have gone from the time zone
+		// database
+		loc, err := loadTimezone(tz.name)
+		if err != nil {
+			log.Printf("cannot aggregate the days of %s: %s", tz.name, err)
+			continue
+		}
+
+		first := startOfDay(time.Unix(partitions[0].start, 0).In(loc))
+		if first.Unix() < partitions[0].start {
+			var dropped bool
+			err := tx.QueryRowContext(
+				ctx,
+				`SELECT EXISTS (
+					SELECT 1 FROM sites INNER JOIN totals_hourly ON totals_hourly.site_id = sites.site_id
+					WHERE totals_hourly.hour >= ? AND totals_hourly.hour < ?
+				)`,
+				first.Unix(), partitions[0].start,
+			).Scan(&dropped)
+			if err != nil {
+				return nil, fmt.Errorf("totals_hourly select error: %w", err)
+			}
+			if dropped {
+				first = first.AddDate(0, 0, 1)
+			}
+		}
+		if !tz.since.Valid {
+			if _, err := tx.ExecContext(ctx, "UPDATE rollup_timezones SET since = ? WHERE timezone = ?", first.Unix(), tz.name); err != nil {
+				return nil, err
+			}
+			tz.since = sql.NullInt64{Int64: first.Unix(), Valid: true}
+		}
+
+		var latest sql.NullInt64
+		if err := tx.QueryRowContext(ctx, "SELECT MAX(day) FROM totals_local_daily WHERE timezone = ?", tz.name).Scan(&latest); err != nil {
+			return nil, fmt.Errorf("totals_local_daily select error: %w", err)
+		}
+
+		// Also recompute the previous day in case hits were written late
+		since := first
+		if latest.Valid {
+			since = startOfDay(time.Unix(latest.Int64, 0).In(loc)).AddDate(0, 0, -1)
+		}
+		if from != math.MaxInt64 {
+			if start := startOfDay(time.Unix(from, 0).In(loc)); start.Before(since) {
+				since = start
+			}
+		}
+		if since.Before(first) {
+			since = first
+		}
+		if since.Unix() < tz.since.Int64 {
+			since = time.Unix(tz.since.Int64, 0).In(loc)
+		}
+
+		starts = append(starts, localRollupStart{name: tz.name, loc: loc, since: since})
+	}
+
+	return starts, tx.Commit()
+}
+
+// Recompute the rollups of the days of the time zone from the local midnight start to the day of
+// end inclusive. The rollups of any later days are dropped too if last.
+func dbAggregateLocalDayRange(ctx context.Context, db *sql.DB, timezone string, start time.Time, end time.Time, last bool) error {
+	days, ok := localDays(start.Format("2006-01-02"), end.Format("2006-01-02"), start.Location())
+	if !ok || len(days) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(days)
+	if err != nil {
+		return err
+	}
+	until := days[len(days)-1].End
+	if last {
+		until = math.MaxInt64
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// See the comment in HitWriter.WriteBatch
+	if _, err := tx.ExecContext(ctx, "ROLLBACK; BEGIN IMMEDIATE"); err != nil {
+		return err
+	}
+
+	// Only the months that the days are in, which may have been dropped since the days were chosen
+	partitions, err := dbHitPartitions(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if len(partitions) == 0 || start.Unix() < startOfDay(time.Unix(partitions[0].start, 0).In(start.Location())).Unix() {
+		return nil
+	}
+	var months []hitPartition
+	for _, partition := range partitions {
+		if partition.start < days[len(days)-1].End {
+			months = append(months, partition)
+		}
+	}
+
+	for _, rollup := range localRollups {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE timezone = ? AND day >= ? AND day < ?", rollup.table), timezone, start.Unix(), until)
+		if err != nil {
+			return fmt.Errorf("%s delete error: %w", rollup.table, err)
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			fmt.Sprintf("INSERT INTO %s (timezone, day, %s) SELECT :timezone, * FROM (%s)", rollup.table, rollup.columns, fmt.Sprintf(rollup.query, hitsUnion(months, start.Unix()), localPeriod, localJoin)),
+			sql.Named("timezone", timezone),
+			sql.Named("days", string(b)),
+			sql.Named("since", start.Unix()),
+		)
+		if err != nil {
+			return fmt.Errorf("%s insert error: %w", rollup.table, err)
+		}
+	}
+
+	if err := dbEstimateLocalVisitors(ctx, tx, timezone, string(b)); err != nil {
+		return fmt.Errorf("visitor estimate error: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// Roll up the days of the time zone of the dashboard and of those of the accounts, and stop rolling up
+// any others. UTC days are rolled up already.
+func dbSetRollupTimezones(ctx context.Context, db *sql.DB, dashboard *time.Location) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(
+		ctx,
+		"DELETE FROM rollup_timezones WHERE timezone != ? AND timezone NOT IN (SELECT timezone FROM users_admin WHERE timezone IS NOT NULL)",
+		dashboard.String(),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT OR IGNORE INTO rollup_timezones (timezone)
+		SELECT ? UNION SELECT timezone FROM users_admin WHERE timezone IS NOT NULL
+		EXCEPT SELECT 'UTC'`,
+		dashboard.String(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Whether the days of the time zone are rolled up, so that queries count each visitor once a day.
+func dbRolledUpTimezone(ctx context.Context, db *sql.DB, timezone string) (bool, error) {
+	if timezone == "UTC" {
+		return true, nil
+	}
+
+	var ok bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM rollup_timezones WHERE timezone = ?)", timezone).Scan(&ok)
+	return ok, err
+}
+
+// Midnight at the start of the day of the time, in its time zone.
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
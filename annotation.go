@@ -0,0 +1,129 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrUnknownSite = errors.New("unknown site")
+
+// The body of POST /api/annotations. The time defaults to now.
+type annotationRequest struct {
+	Site string     `json:"site"`
+	Text string     `json:"text"`
+	Time *time.Time `json:"time"`
+}
+
+type annotation struct {
+	Id   int64     `json:"id"`
+	Site string    `json:"site"`
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+// Add a note on the traffic of a site. The site must have had some hits.
+func dbCreateAnnotation(ctx context.Context, db *sql.DB, site string, text string, timestamp time.Time) (int64, error) {
+	result, err := db.ExecContext(
+		ctx,
+		"INSERT INTO annotations (site_id, timestamp, text) SELECT site_id, ?, ? FROM sites WHERE domain = ?",
+		timestamp.Unix(), text, site,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, ErrUnknownSite
+	}
+
+	return result.LastInsertId()
+}
+
+func handleAnnotations(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// Admins logged in to the dashboard can add annotations from its pages, as well as with API tokens
+	account := sheepcount.session(r)
+	if account != nil && r.Header.Get("Authorization") == "" {
+		if !account.canWrite() {
+			writeAPIError(w, http.StatusForbidden, "read-only account")
+			return
+		}
+		if !sheepcount.sameOrigin(r) {
+			writeAPIError(w, http.StatusForbidden, "invalid origin")
+			return
+		}
+	} else {
+		if account = apiAuthenticated(sheepcount, w, r); account == nil {
+			return
+		}
+		if !account.canWrite() {
+			writeAPIError(w, http.StatusForbidden, "read-only token")
+			return
+		}
+	}
+
+	var request annotationRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	request.Site = strings.ToLower(request.Site)
+	request.Text = strings.TrimSpace(request.Text)
+	if request.Site == "" {
+		writeAPIError(w, http.StatusBadRequest, "site is required")
+		return
+	}
+	if request.Text == "" {
+		writeAPIError(w, http.StatusBadRequest, "text is required")
+		return
+	}
+	if account != nil && !account.canSee(request.Site) {
+		writeAPIError(w, http.StatusForbidden, "no access to the site")
+		return
+	}
+
+	timestamp := time.Now()
+	if request.Time != nil {
+		timestamp = *request.Time
+	}
+
+	id, err := dbCreateAnnotation(r.Context(), sheepcount.db, request.Site, request.Text, timestamp)
+	if err == ErrUnknownSite {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		writeAPIError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	// The graphs of pageviews show the annotations
+	sheepcount.queryCache.Invalidate()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(annotation{
+		Id:   id,
+		Site: request.Site,
+		Text: request.Text,
+		Time: timestamp.UTC().Truncate(time.Second),
+	})
+}
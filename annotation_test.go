@@ -0,0 +1,80 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnotations(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	require.NoError(t, err)
+	defer writer.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	for _, domain := range []string{"example.com", "example.org"} {
+		require.NoError(t, writer.InsertHit(ctx, tx, &Hit{
+			Timestamp:         1654041600, // 2022-06-01 00:00
+			IdentifierCurrent: []byte("a"),
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             PageLoad,
+			Domain:            domain,
+			Path:              "/",
+		}))
+	}
+	require.NoError(t, tx.Commit())
+	require.NoError(t, dbAggregate(ctx, db))
+
+	create := func(site string, text string, timestamp string) error {
+		ts, err := time.Parse(time.RFC3339, timestamp)
+		require.NoError(t, err)
+		_, err = dbCreateAnnotation(ctx, db, site, text, ts)
+		return err
+	}
+
+	require.NoError(t, create("example.com", "Newsletter sent", "2022-06-01T09:30:00Z"))
+	require.NoError(t, create("example.com", "Launched v2.0", "2022-06-01T08:00:00Z"))
+	require.NoError(t, create("example.com", "Went quiet", "2022-06-03T12:00:00Z"))
+	require.NoError(t, create("example.org", "Not this site", "2022-06-01T10:00:00Z"))
+	assert.Equal(t, ErrUnknownSite, create("example.net", "Never visited", "2022-06-01T10:00:00Z"))
+
+	queries, err := NewQueries(db)
+	require.NoError(t, err)
+
+	query, err := queries.Get("pageviews")
+	require.NoError(t, err)
+
+	var output string
+	row := query.QueryRowContext(ctx, sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-04"), sql.Named("include_bots", false))
+	require.NoError(t, row.Scan(&output))
+
+	// A day without pageviews is included for its annotation
+	assert.JSONEq(
+		t,
+		`[
+			{"date": "2022-06-01", "pageviews": 1, "visitors": 1, "new_visitors": 1, "returning_visitors": 0, "annotations": [
+				{"time": "2022-06-01T08:00:00Z", "text": "Launched v2.0"},
+				{"time": "2022-06-01T09:30:00Z", "text": "Newsletter sent"}
+			]},
+			{"date": "2022-06-03", "pageviews": 0, "visitors": 0, "new_visitors": 0, "returning_visitors": 0, "annotations": [
+				{"time": "2022-06-03T12:00:00Z", "text": "Went quiet"}
+			]}
+		]`,
+		output,
+	)
+}
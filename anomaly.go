@@ -0,0 +1,295 @@
+package sheepcount
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// Alerts about unusual traffic, sent as a POST request with a JSON body to a webhook. Each check
+// compares the pageviews of the last hour with the average hour of the week before.
+type AlertConfig struct {
+	WebhookURL string `toml:"webhook_url"` // Empty disables alerts
+
+	// Key for the signature of the body, sent as X-SheepCount-Signature: sha256=<hex HMAC-SHA256>
+	Secret string `toml:"secret"`
+
+	CheckInterval time.Duration `toml:"check_interval"`
+	SpikeFactor   float64       `toml:"spike_factor"`   // A spike is this many times the usual pageviews
+	MinPageviews  int64         `toml:"min_pageviews"`  // Quieter hours, before or after a change, are not unusual
+	ReferrerShare float64       `toml:"referrer_share"` // A referrer dominates with this share of the pageviews
+}
+
+func (config *AlertConfig) validate() error {
+	if config.WebhookURL == "" {
+		return nil
+	}
+	if u, err := url.Parse(config.WebhookURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid alert webhook_url: %s", config.WebhookURL)
+	}
+	if config.CheckInterval <= 0 {
+		return errors.New("alert check_interval must be positive")
+	}
+	if config.SpikeFactor <= 1 {
+		return errors.New("alert spike_factor must be more than 1")
+	}
+	if config.ReferrerShare <= 0 || config.ReferrerShare > 1 {
+		return errors.New("alert referrer_share must be more than 0 and at most 1")
+	}
+	return nil
+}
+
+// How much history a site needs before its traffic can be called unusual.
+const anomalyMinHistory = 24 * time.Hour
+
+// The same kind of alert is sent for a site at most once in this long.
+const anomalyCooldown = time.Hour
+
+type anomalyKind string
+
+const (
+	anomalySpike    anomalyKind = "spike"    // Many more pageviews than usual
+	anomalyDrop     anomalyKind = "drop"     // No pageviews at all, when there usually are some
+	anomalyReferrer anomalyKind = "referrer" // Most pageviews are from a referrer that is usually rare
+)
+
+// The body of the webhook.
+type anomaly struct {
+	Kind      anomalyKind `json:"kind"`
+	Site      string      `json:"site"`
+	Time      time.Time   `json:"time"`
+	Pageviews int64       `json:"pageviews"` // In the last hour
+	Baseline  float64     `json:"baseline"`  // In the average hour of the week before
+	Referrer  string      `json:"referrer,omitempty"`
+	Share     float64     `json:"share,omitempty"` // Of the referrer in the last hour
+}
+
+// The pageviews of each site in the hour up to :now, and the source with the most of them.
+const anomalyCurrentQuery = `
+	SELECT sites.site_id
+		, sites.domain
+		, (
+			SELECT COUNT(*)
+			FROM hits INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+			WHERE hits.site_id = sites.site_id AND hits.event = 'l'
+			  AND hits.timestamp >= :now - 3600 AND hits.timestamp < :now
+			  AND COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2
+		) AS pageviews
+		, top.source
+		, COALESCE(top.pageviews, 0)
+	FROM sites
+	LEFT JOIN (
+		SELECT site_id, source, pageviews
+		FROM (
+			SELECT hits.site_id
+				, referrer_sources.source
+				, COUNT(*) AS pageviews
+				, ROW_NUMBER() OVER (PARTITION BY hits.site_id ORDER BY COUNT(*) DESC, referrer_sources.source) AS rank
+			FROM hits
+			INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+			INNER JOIN referrer_sources ON hits.referrer_id = referrer_sources.referrer_id
+			WHERE hits.event = 'l'
+			  AND hits.timestamp >= :now - 3600 AND hits.timestamp < :now
+			  AND COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2
+			GROUP BY hits.site_id, referrer_sources.source
+		)
+		WHERE rank = 1
+	) AS top ON sites.site_id = top.site_id`
+
+// The pageviews of a site in the hourly rollups from :start to :end, the first hour with any, and
+// the pageviews from a source.
+const anomalyBaselineQuery = `
+	SELECT COALESCE(SUM(hits_hourly.pageviews), 0)
+		, MIN(hits_hourly.hour)
+		, COALESCE(SUM(CASE WHEN referrer_sources.source = :source THEN hits_hourly.pageviews END), 0)
+	FROM hits_hourly
+	LEFT JOIN referrer_sources ON hits_hourly.referrer_id = referrer_sources.referrer_id
+	WHERE hits_hourly.site_id = :site_id
+	  AND hits_hourly.bot = 0
+	  AND hits_hourly.hour >= :start
+	  AND hits_hourly.hour < :end`
+
+// Find the sites whose traffic in the hour up to now is unusual.
+func dbAnomalies(ctx context.Context, db *sql.DB, config *AlertConfig, now time.Time) ([]anomaly, error) {
+	type current struct {
+		siteId    int64
+		site      string
+		pageviews int64
+		source    sql.NullString
+		sourceHit int64
+	}
+
+	rows, err := db.QueryContext(ctx, anomalyCurrentQuery, sql.Named("now", now.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sites []current
+	for rows.Next() {
+		var c current
+		if err := rows.Scan(&c.siteId, &c.site, &c.pageviews, &c.source, &c.sourceHit); err != nil {
+			return nil, err
+		}
+		sites = append(sites, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The week of whole hours before the hour that is being checked
+	end := now.Add(-time.Hour).Truncate(time.Hour)
+	start := end.Add(-7 * 24 * time.Hour)
+
+	var anomalies []anomaly
+	for _, c := range sites {
+		var total, fromSource int64
+		var first sql.NullInt64
+		err := db.QueryRowContext(
+			ctx,
+			anomalyBaselineQuery,
+			sql.Named("site_id", c.siteId),
+			sql.Named("source", c.source),
+			sql.Named("start", start.Unix()),
+			sql.Named("end", end.Unix()),
+		).Scan(&total, &first, &fromSource)
+		if err != nil {
+			return nil, err
+		}
+
+		if !first.Valid || end.Sub(time.Unix(first.Int64, 0)) < anomalyMinHistory {
+			continue
+		}
+		hours := end.Sub(time.Unix(first.Int64, 0)).Hours()
+		baseline := float64(total) / hours
+
+		a := anomaly{Site: c.site, Time: now.UTC(), Pageviews: c.pageviews, Baseline: baseline}
+
+		switch {
+		case c.pageviews >= config.MinPageviews && float64(c.pageviews) >= config.SpikeFactor*baseline:
+			a.Kind = anomalySpike
+			anomalies = append(anomalies, a)
+		case c.pageviews == 0 && baseline >= float64(config.MinPageviews):
+			a.Kind = anomalyDrop
+			anomalies = append(anomalies, a)
+		}
+
+		// A referrer that usually sends few visitors but now sends most of them, such as from the
+		// front page of Hacker News
+		if c.source.Valid && c.pageviews >= config.MinPageviews {
+			share := float64(c.sourceHit) / float64(c.pageviews)
+			usual := 0.0
+			if total > 0 {
+				usual = float64(fromSource) / float64(total)
+			}
+			if share >= config.ReferrerShare && usual < config.ReferrerShare/2 {
+				a.Kind = anomalyReferrer
+				a.Referrer = c.source.String
+				a.Share = share
+				anomalies = append(anomalies, a)
+			}
+		}
+	}
+
+	return anomalies, nil
+}
+
+// Sign the body with the secret, so that the receiver can check that it came from SheepCount.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func sendWebhook(ctx context.Context, client *retryablehttp.Client, config *AlertConfig, a *anomaly) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodPost, config.WebhookURL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "SheepCount")
+	if config.Secret != "" {
+		req.Header.Set("X-SheepCount-Signature", webhookSignature(config.Secret, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Remembers when each alert was last sent, so that a spike lasting all afternoon is only reported
+// once an hour.
+type alerter struct {
+	sync.Mutex
+	sent map[string]time.Time
+}
+
+func (alerter *alerter) due(a *anomaly, now time.Time) bool {
+	alerter.Lock()
+	defer alerter.Unlock()
+
+	key := a.Site + " " + string(a.Kind) + " " + a.Referrer
+	if last, ok := alerter.sent[key]; ok && now.Sub(last) < anomalyCooldown {
+		return false
+	}
+	alerter.sent[key] = now
+	return true
+}
+
+// Check for unusual traffic every interval and send an alert for each, until the context is done.
+func Monitor(ctx context.Context, db *sql.DB, config *AlertConfig) error {
+	client := newClient()
+	alerter := &alerter{sent: make(map[string]time.Time)}
+
+	ticker := time.NewTicker(config.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		anomalies, err := dbAnomalies(ctx, db, config, now)
+		if err != nil {
+			log.Printf("Cannot check for unusual traffic: %s", err)
+			continue
+		}
+
+		for i := range anomalies {
+			a := &anomalies[i]
+			if !alerter.due(a, now) {
+				continue
+			}
+			if err := sendWebhook(ctx, client, config, a); err != nil {
+				log.Printf("Cannot send %s alert for %s: %s", a.Kind, a.Site, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnomalies(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	require.NoError(t, err)
+	defer writer.Close()
+
+	now := time.Date(2022, 6, 10, 12, 30, 0, 0, time.UTC)
+
+	tx, err := db.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	insert := func(timestamp time.Time, site string, n int, referrer string) {
+		for i := 0; i < n; i++ {
+			hit := &Hit{
+				Timestamp:         timestamp.Unix() + int64(i),
+				IdentifierCurrent: []byte(site + timestamp.String() + string(rune('a'+i))),
+				UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+				Event:             PageLoad,
+				Domain:            site,
+				Path:              "/",
+			}
+			if referrer != "" {
+				hit.ReferrerDomain = sql.NullString{String: referrer, Valid: true}
+			}
+			require.NoError(t, writer.InsertHit(ctx, tx, hit))
+		}
+	}
+
+	// A week of history, up to two hours ago
+	for hour := now.Add(-8 * 24 * time.Hour).Truncate(time.Hour); hour.Before(now.Add(-2 * time.Hour)); hour = hour.Add(time.Hour) {
+		insert(hour, "spike.example", 2, "www.google.com")
+		insert(hour, "quiet.example", 6, "")
+		insert(hour, "steady.example", 2, "")
+	}
+
+	// The last hour
+	insert(now.Add(-30*time.Minute), "spike.example", 10, "news.ycombinator.com")
+	insert(now.Add(-30*time.Minute), "steady.example", 2, "")
+	insert(now.Add(-30*time.Minute), "new.example", 50, "")
+
+	require.NoError(t, tx.Commit())
+	require.NoError(t, dbAggregate(ctx, db))
+
+	config := DefaultConfig().Alerts
+	config.MinPageviews = 5
+
+	anomalies, err := dbAnomalies(ctx, db, &config, now)
+	require.NoError(t, err)
+
+	kinds := make(map[string][]anomalyKind)
+	for _, a := range anomalies {
+		kinds[a.Site] = append(kinds[a.Site], a.Kind)
+		if a.Kind == anomalyReferrer {
+			assert.Equal(t, "news.ycombinator.com", a.Referrer)
+			assert.Equal(t, 1.0, a.Share)
+		}
+		if a.Site == "spike.example" {
+			assert.Equal(t, int64(10), a.Pageviews)
+			assert.InDelta(t, 2, a.Baseline, 0.01)
+		}
+	}
+	assert.Equal(t, map[string][]anomalyKind{
+		"spike.example": {anomalySpike, anomalyReferrer},
+		"quiet.example": {anomalyDrop},
+	}, kinds)
+}
+
+func TestSendWebhook(t *testing.T) {
+	var body []byte
+	var signature string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get("X-SheepCount-Signature")
+	}))
+	defer server.Close()
+
+	config := DefaultConfig().Alerts
+	config.WebhookURL = server.URL
+	config.Secret = "hunter2"
+	require.NoError(t, config.validate())
+
+	a := &anomaly{Kind: anomalySpike, Site: "example.com", Time: time.Date(2022, 6, 10, 12, 30, 0, 0, time.UTC), Pageviews: 100, Baseline: 10}
+	require.NoError(t, sendWebhook(context.Background(), newClient(), &config, a))
+
+	var received anomaly
+	require.NoError(t, json.Unmarshal(body, &received))
+	assert.Equal(t, *a, received)
+	assert.Equal(t, webhookSignature("hunter2", body), signature)
+	assert.Regexp(t, "^sha256=[0-9a-f]{64}$", signature)
+
+	// An alert is not repeated until the cooldown has passed
+	alerter := &alerter{sent: make(map[string]time.Time)}
+	assert.True(t, alerter.due(a, a.Time))
+	assert.False(t, alerter.due(a, a.Time.Add(30*time.Minute)))
+	assert.True(t, alerter.due(&anomaly{Kind: anomalyDrop, Site: "example.com"}, a.Time))
+	assert.True(t, alerter.due(a, a.Time.Add(anomalyCooldown)))
+}
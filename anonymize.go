@@ -0,0 +1,142 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+type anonymization struct {
+	Users  int64 // Whose identifiers were replaced
+	Merged int64 // Collapsed into another user with the same browser dimensions
+}
+
+// Users whose hits all have the same user agent, languages and display, and the user with the
+// lowest ID among those with the same dimensions, which the others are merged into.
+const anonymizeMergesQuery = `
+	CREATE TEMP TABLE anonymize_merges AS
+	SELECT user_id, target
+	FROM (
+		SELECT user_id
+			, MIN(user_id) OVER (PARTITION BY user_agent_id, language_id, secondary_language_id, display_id) AS target
+		FROM (
+			SELECT user_id
+				, MIN(user_agent_id) AS user_agent_id
+				, MIN(language_id) AS language_id
+				, MIN(secondary_language_id) AS secondary_language_id
+				, MIN(display_id) AS display_id
+			FROM hits
+			WHERE user_id != 0 -- anonymousUserId, which is not a visitor
+			GROUP BY user_id
+			HAVING COUNT(DISTINCT user_agent_id) = 1
+			   AND COUNT(DISTINCT COALESCE(language_id, -1)) = 1
+			   AND COUNT(DISTINCT COALESCE(secondary_language_id, -1)) = 1
+			   AND COUNT(DISTINCT COALESCE(display_id, -1)) = 1
+		)
+	)
+	WHERE user_id != target`
+
+// Replace the identifier of every user, so that no hit can be linked to a visitor from their browser
+// or IP address any more, either with a random value or with NULL. Random values keep each user
+// distinct from the visitors that are still being identified by a running server, without being
+// derived from anything. As secure_delete is on, the old identifiers are overwritten on disk.
+//
+// With collapse, users whose hits all have the same browser dimensions are also merged into one, so
+// that they cannot be told apart by their hits either. This changes the number of visitors counted
+// from the hits, but not the rollups that have already been aggregated.
+func dbAnonymize(ctx context.Context, db *sql.DB, null bool, collapse bool) (anonymization, error) {
+	var anonymized anonymization
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return anonymized, err
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE users SET identifier = randomblob(32) WHERE identifier IS NOT NULL"
+	if null {
+		query = "UPDATE users SET identifier = NULL WHERE identifier IS NOT NULL"
+	}
+	result, err := tx.ExecContext(ctx, query)
+	if err != nil {
+		return anonymized, err
+	}
+	if anonymized.Users, err = result.RowsAffected(); err != nil {
+		return anonymized, err
+	}
+
+	if collapse {
+		if _, err := tx.ExecContext(ctx, anonymizeMergesQuery); err != nil {
+			return anonymized, err
+		}
+
+		for _, query := range []string{
+			`UPDATE users
+			SET first_seen = merged.first_seen, last_seen = merged.last_seen, created_at = merged.created_at
+			FROM (
+				SELECT anonymize_merges.target
+					, MIN(users.first_seen) AS first_seen
+					, MAX(users.last_seen) AS last_seen
+					, MIN(users.created_at) AS created_at
+				FROM anonymize_merges INNER JOIN users ON anonymize_merges.user_id = users.user_id
+				GROUP BY anonymize_merges.target
+			) AS merged
+			WHERE users.user_id = merged.target
+			  AND (merged.first_seen < users.first_seen OR merged.last_seen > users.last_seen OR merged.created_at < users.created_at)`,
+			"UPDATE sessions SET user_id = anonymize_merges.target FROM anonymize_merges WHERE sessions.user_id = anonymize_merges.user_id",
+		} {
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return anonymized, err
+			}
+		}
+		if _, err := dbUpdateHits(ctx, tx, "UPDATE %s SET user_id = anonymize_merges.target FROM anonymize_merges WHERE hits.user_id = anonymize_merges.user_id"); err != nil {
+			return anonymized, err
+		}
+
+		result, err := tx.ExecContext(ctx, "DELETE FROM users WHERE user_id IN (SELECT user_id FROM anonymize_merges)")
+		if err != nil {
+			return anonymized, err
+		}
+		if anonymized.Merged, err = result.RowsAffected(); err != nil {
+			return anonymized, err
+		}
+
+		if _, err := tx.ExecContext(ctx, "DROP TABLE temp.anonymize_merges"); err != nil {
+			return anonymized, err
+		}
+	}
+
+	return anonymized, tx.Commit()
+}
+
+func newAnonymizeCommand(databasePath *string) *cobra.Command {
+	var null, collapse bool
+
+	cmd := &cobra.Command{
+		Use:   "anonymize",
+		Short: "Replace the identifiers of all visitors, such as before sharing the database or backing it up offsite",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			anonymized, err := dbAnonymize(cmd.Context(), db, null, collapse)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("users   %d\nmerged  %d\n", anonymized.Users, anonymized.Merged)
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&null, "null", false, "Remove the identifiers instead of replacing them with random values")
+	cmd.Flags().BoolVar(&collapse, "collapse", false, "Merge visitors whose hits all have the same user agent, languages and display")
+
+	return cmd
+}
@@ -0,0 +1,83 @@
+package sheepcount
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnonymize(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	require.NoError(t, err)
+	defer writer.Close()
+
+	const firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0"
+	const chrome = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/102.0.0.0 Safari/537.36"
+
+	tx, err := db.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	for i, h := range []struct {
+		identifier string
+		userAgent  string
+		language   string
+	}{
+		{"a", firefox, "eng"},
+		{"a", firefox, "eng"},
+		{"b", firefox, "eng"},
+		{"c", firefox, "fra"},
+		{"d", chrome, "eng"},
+		{"e", firefox, "eng"},
+		{"e", chrome, "eng"},
+	} {
+		require.NoError(t, writer.InsertHit(ctx, tx, &Hit{
+			Timestamp:         1654041600 + int64(i),
+			IdentifierCurrent: []byte(h.identifier),
+			UserAgent:         h.userAgent,
+			Language:          h.language,
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              "/",
+		}))
+	}
+	require.NoError(t, tx.Commit())
+
+	// The identifiers are replaced by random ones, and every user is kept
+	anonymized, err := dbAnonymize(ctx, db, false, false)
+	require.NoError(t, err)
+	assert.Equal(t, anonymization{Users: 5}, anonymized)
+
+	var random int
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT COUNT(DISTINCT identifier) FROM users WHERE length(identifier) = 32").Scan(&random))
+	assert.Equal(t, 5, random)
+
+	// Then removed, with a and b merged as they have the same browser dimensions, and e kept apart
+	// as it used two browsers
+	anonymized, err = dbAnonymize(ctx, db, true, true)
+	require.NoError(t, err)
+	assert.Equal(t, anonymization{Users: 5, Merged: 1}, anonymized)
+
+	var visitors, total int
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT COUNT(DISTINCT user_id), COUNT(*) FROM hits").Scan(&visitors, &total))
+	assert.Equal(t, 4, visitors)
+	assert.Equal(t, 7, total)
+
+	var identified int
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE identifier IS NOT NULL").Scan(&identified))
+	assert.Zero(t, identified)
+
+	var merged int
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT MAX(n) FROM (SELECT COUNT(*) AS n FROM hits GROUP BY user_id)").Scan(&merged))
+	assert.Equal(t, 3, merged)
+}
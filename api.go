@@ -0,0 +1,446 @@
+package sheepcount
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/blake2b"
+)
+
+const apiTokenPrefix = "sc_"
+
+var ErrInvalidToken = errors.New("invalid API token")
+
+// The stats endpoints of the REST API and the queries that they run.
+var apiEndpoints = map[string]string{
+	"pageviews":           "pageviews",
+	"pages":               "pages",
+	"referrers":           "referrers",
+	"referrers/sources":   "referrer_sources",
+	"referrers/returning": "returning_referrers",
+	"countries":           "countries",
+	"countries/regions":   "subdivisions",
+	"countries/cities":    "cities",
+	"browsers":            "browsers",
+	"browsers/versions":   "browser_versions",
+	"systems/versions":    "os_versions",
+	"devices":             "devices",
+	"languages":           "languages",
+	"devices/screens":     "resolutions",
+	"campaigns":           "campaigns",
+	"clicks":              "clicks",
+	"sessions":            "sessions",
+	"time_on_page":        "time_on_page",
+	"bots":                "bots",
+	"engagement":          "engagement",
+	"performance":         "performance",
+	"keywords":            "keywords",
+	"goals":               "goals",
+	"goals/referrers":     "goal_referrers",
+	"goals/campaigns":     "goal_campaigns",
+	"events":              "events",
+	"events/pages":        "event_pages",
+}
+
+func hashAPIToken(token string) []byte {
+	hash := blake2b.Sum256([]byte(token))
+	return hash[:]
+}
+
+// Create a new API token with the role of an account, which can only see the sites if there are
+// any. Only its hash is stored so the token must be shown to the user now.
+func dbCreateAPIToken(ctx context.Context, db *sql.DB, name string, role string, sites []string) (string, error) {
+	if !validRole(role) {
+		return "", fmt.Errorf("role must be %s or %s, not %s", roleAdmin, roleViewer, role)
+	}
+
+	var random [32]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", err
+	}
+	token := apiTokenPrefix + hex.EncodeToString(random[:])
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRowContext(
+		ctx,
+		"INSERT INTO api_tokens (name, hash, role) VALUES (?, ?, ?) RETURNING token_id",
+		name, hashAPIToken(token), role,
+	).Scan(&id)
+	if err != nil {
+		return "", err
+	}
+
+	for _, site := range sites {
+		_, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO api_token_sites (token_id, domain) VALUES (?, ?)", id, strings.ToLower(site))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return token, tx.Commit()
+}
+
+func dbRevokeAPIToken(ctx context.Context, db *sql.DB, name string) (bool, error) {
+	result, err := db.ExecContext(ctx, "DELETE FROM api_tokens WHERE name = ?", name)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Check an API token, returning what it can do as an account with the name and role of the token
+// and the sites that it can see.
+func dbCheckAPIToken(ctx context.Context, db *sql.DB, token string) (*account, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, ErrInvalidToken
+	}
+
+	var id int64
+	var a account
+	err := db.QueryRowContext(
+		ctx,
+		"UPDATE api_tokens SET last_used = strftime('%s', 'now') WHERE hash = ? RETURNING token_id, name, role",
+		hashAPIToken(token),
+	).Scan(&id, &a.Name, &a.Role)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT domain FROM api_token_sites WHERE token_id = ? ORDER BY domain", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var site string
+		if err := rows.Scan(&site); err != nil {
+			return nil, err
+		}
+		a.Sites = append(a.Sites, site)
+	}
+
+	return &a, rows.Err()
+}
+
+func writeAPIError(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{Error: message})
+}
+
+// Check the bearer token of an API request, returning what the token can do, or nil after writing
+// the error response if it is missing or invalid.
+func apiAuthenticated(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) *account {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sheepcount"`)
+		writeAPIError(w, http.StatusUnauthorized, "missing bearer token")
+		return nil
+	}
+
+	token, err := dbCheckAPIToken(r.Context(), sheepcount.db, strings.TrimPrefix(authorization, "Bearer "))
+	if err == ErrInvalidToken {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sheepcount", error="invalid_token"`)
+		writeAPIError(w, http.StatusUnauthorized, err.Error())
+		return nil
+	}
+	if err != nil {
+		log.Print(err)
+		writeAPIError(w, http.StatusInternalServerError, "internal error")
+		return nil
+	}
+
+	return token
+}
+
+func handleAPI(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	token := apiAuthenticated(sheepcount, w, r)
+	if token == nil {
+		return
+	}
+
+	queryName, ok := apiEndpoints[strings.TrimPrefix(r.URL.Path, "/api/v1/")]
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "no such endpoint")
+		return
+	}
+
+	query, err := sheepcount.queries.Get(queryName)
+	if err != nil {
+		log.Print(err)
+		writeAPIError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	params := r.URL.Query()
+
+	site := params.Get("site")
+	if site == "" {
+		writeAPIError(w, http.StatusBadRequest, "site is required")
+		return
+	}
+	if !token.canSee(site) {
+		writeAPIError(w, http.StatusForbidden, "no access to the site")
+		return
+	}
+
+	loc := sheepcount.location
+	if v := params.Get("timezone"); v != "" {
+		if loc, err = loadTimezone(v); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "timezone must be an IANA time zone name")
+			return
+		}
+
+		ok, err := dbRolledUpTimezone(r.Context(), sheepcount.db, loc.String())
+		if err != nil {
+			log.Print(err)
+			writeAPIError(w, http.StatusInternalServerError, "internal error")
+			return
+		}
+		if !ok {
+			writeAPIError(w, http.StatusBadRequest, errTimezoneNotRolledUp.Error())
+			return
+		}
+	}
+
+	startDate, endDate, ok := requestDates(params, loc)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "dates must be in YYYY-MM-DD format")
+		return
+	}
+
+	// Bots are excluded by default
+	includeBots := false
+	if v := params.Get("include_bots"); v != "" {
+		if includeBots, err = strconv.ParseBool(v); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "include_bots must be true or false")
+			return
+		}
+	}
+
+	args := []interface{}{
+		sql.Named("site", site),
+		sql.Named("start_date", startDate),
+		sql.Named("end_date", endDate),
+		sql.Named("include_bots", includeBots),
+		sql.Named("timezone", loc),
+	}
+
+	// The other parameters that the query declares, such as the country of the regions
+	args, err = query.Manifest().bindRest(params, args)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// With a comparison period, the data is an object with both series
+	output, err := sheepcount.runQuery(r.Context(), queryName, query, params.Get("compare"), args)
+	if err == errQueryTimeout {
+		writeAPIError(w, http.StatusGatewayTimeout, err.Error())
+		return
+	}
+	if _, ok := err.(*ErrBadInput); ok {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		writeAPIError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	var buf bytes.Buffer
+	err = json.NewEncoder(&buf).Encode(struct {
+		Site      string          `json:"site"`
+		StartDate string          `json:"start_date"`
+		EndDate   string          `json:"end_date"`
+		Data      json.RawMessage `json:"data"`
+	}{
+		Site:      site,
+		StartDate: startDate,
+		EndDate:   endDate,
+		Data:      output,
+	})
+	if err != nil {
+		log.Print(err)
+		writeAPIError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	buf.WriteTo(w)
+}
+
+// Whether the request either is logged in to the dashboard as an account that can see the site, or
+// has a valid API token that can. An empty site stands for all of them.
+func authorized(sheepcount *SheepCount, r *http.Request, site string) bool {
+	if account := sheepcount.session(r); account != nil && account.canSee(site) {
+		return true
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+
+	token, err := dbCheckAPIToken(r.Context(), sheepcount.db, strings.TrimPrefix(authorization, "Bearer "))
+	if err != nil && err != ErrInvalidToken {
+		log.Print(err)
+	}
+	return token != nil && token.canSee(site)
+}
+
+// The start_date and end_date parameters, defaulting to the last 30 days in loc.
+func requestDates(params url.Values, loc *time.Location) (string, string, bool) {
+	endDate := params.Get("end_date")
+	if endDate == "" {
+		endDate = time.Now().In(loc).Format("2006-01-02")
+	}
+	startDate := params.Get("start_date")
+	if startDate == "" {
+		end, _ := time.Parse("2006-01-02", endDate)
+		startDate = end.AddDate(0, 0, -29).Format("2006-01-02")
+	}
+
+	return startDate, endDate, validDate(startDate) && validDate(endDate)
+}
+
+func newTokenCommand(databasePath *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "token",
+		Short: "Manage REST API tokens",
+	}
+
+	var role string
+	var sites []string
+
+	create := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create a new API token",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			token, err := dbCreateAPIToken(cmd.Context(), db, args[0], role, sites)
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(token)
+			return nil
+		},
+	}
+	create.Flags().StringVar(&role, "role", roleAdmin, "admin, or viewer for read-only access")
+	create.Flags().StringArrayVar(&sites, "site", nil, "A site that the token can see, instead of all of them (repeatable)")
+	cmd.AddCommand(create)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List API tokens",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			rows, err := db.QueryContext(
+				cmd.Context(),
+				`SELECT name, role, created_at, last_used, (SELECT group_concat(domain, ' ') FROM api_token_sites WHERE api_token_sites.token_id = api_tokens.token_id)
+				FROM api_tokens ORDER BY name`,
+			)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(tw, "NAME\tROLE\tCREATED\tLAST USED\tSITES")
+			for rows.Next() {
+				var name, role string
+				var sites sql.NullString
+				var createdAt int64
+				var lastUsed sql.NullInt64
+				if err := rows.Scan(&name, &role, &createdAt, &lastUsed, &sites); err != nil {
+					return err
+				}
+
+				if !sites.Valid {
+					sites.String = "all"
+				}
+				used := "never"
+				if lastUsed.Valid {
+					used = time.Unix(lastUsed.Int64, 0).Format(time.RFC3339)
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", name, role, time.Unix(createdAt, 0).Format(time.RFC3339), used, sites.String)
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			return tw.Flush()
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "revoke <name>",
+		Short: "Revoke an API token",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			ok, err := dbRevokeAPIToken(cmd.Context(), db, args[0])
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("no such token: %s", args[0])
+			}
+			return nil
+		},
+	})
+
+	return cmd
+}
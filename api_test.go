@@ -0,0 +1,156 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIAuthentication(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+	token, err := dbCreateAPIToken(ctx, db, "reports", roleAdmin, nil)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(token, apiTokenPrefix))
+	revoked, err := dbCreateAPIToken(ctx, db, "old", roleAdmin, nil)
+	require.NoError(t, err)
+	ok, err := dbRevokeAPIToken(ctx, db, "old")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = dbRevokeAPIToken(ctx, db, "old")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	queries, err := NewQueries(db)
+	require.NoError(t, err)
+
+	config := DefaultConfig()
+	config.Domains = []string{"example.com"}
+	sheepcount := &SheepCount{
+		db:          db,
+		queries:     queries,
+		realtime:    NewRealtime(),
+		broadcaster: NewBroadcaster(),
+		hits:        make(chan Hit, 1),
+		Config:      config,
+	}
+	handler := sheepcount.Handler()
+
+	request := func(method string, path string, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader("{}"))
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	stats := "/api/v1/pageviews?site=example.com&start_date=2022-06-01&end_date=2022-06-01"
+
+	// Every API endpoint needs a token, even those that do not exist, so that they cannot be probed
+	for _, endpoint := range []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, stats},
+		{http.MethodGet, "/api/v1/nothing"},
+		{http.MethodPost, "/api/v1/hits"},
+		{http.MethodPost, "/api/v1/erase"},
+	} {
+		w := request(endpoint.method, endpoint.path, "")
+		assert.Equal(t, http.StatusUnauthorized, w.Code, endpoint.path)
+		assert.Equal(t, `Bearer realm="sheepcount"`, w.Header().Get("WWW-Authenticate"), endpoint.path)
+
+		// Which is not a password
+		w = request(endpoint.method, endpoint.path, "Basic "+token)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, endpoint.path)
+
+		for _, invalid := range []string{strings.TrimPrefix(token, apiTokenPrefix), apiTokenPrefix + "0123", revoked} {
+			w = request(endpoint.method, endpoint.path, "Bearer "+invalid)
+			assert.Equal(t, http.StatusUnauthorized, w.Code, endpoint.path)
+			assert.Contains(t, w.Header().Get("WWW-Authenticate"), `error="invalid_token"`, endpoint.path)
+		}
+	}
+
+	var lastUsed sql.NullInt64
+	require.NoError(t, db.QueryRow("SELECT last_used FROM api_tokens WHERE name = 'reports'").Scan(&lastUsed))
+	assert.False(t, lastUsed.Valid)
+
+	w := request(http.MethodGet, stats, "Bearer "+token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Site string          `json:"site"`
+		Data json.RawMessage `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, "example.com", response.Site)
+	assert.NotEmpty(t, response.Data)
+
+	require.NoError(t, db.QueryRow("SELECT last_used FROM api_tokens WHERE name = 'reports'").Scan(&lastUsed))
+	assert.True(t, lastUsed.Valid)
+
+	w = request(http.MethodGet, "/api/v1/nothing", "Bearer "+token)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.JSONEq(t, `{"error": "no such endpoint"}`, w.Body.String())
+
+	// Days can only be counted in time zones whose days are rolled up, those of the dashboard and accounts
+	for _, timezone := range []string{"America/Chicago", "Asia/Kolkata"} {
+		w = request(http.MethodGet, stats+"&timezone="+timezone, "Bearer "+token)
+		assert.Equal(t, http.StatusBadRequest, w.Code, timezone)
+	}
+	w = request(http.MethodGet, stats+"&timezone=UTC", "Bearer "+token)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = request(http.MethodPost, stats, "Bearer "+token)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	// A valid token gets past authentication to the erasure itself
+	w = request(http.MethodPost, "/api/v1/erase", "Bearer "+token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Tokens can only see their own sites, and viewers cannot change anything
+	viewer, err := dbCreateAPIToken(ctx, db, "viewer", roleViewer, []string{"Example.com"})
+	require.NoError(t, err)
+	other, err := dbCreateAPIToken(ctx, db, "other", roleAdmin, []string{"example.org"})
+	require.NoError(t, err)
+	_, err = dbCreateAPIToken(ctx, db, "editor", "editor", nil)
+	assert.Error(t, err)
+
+	w = request(http.MethodGet, stats, "Bearer "+viewer)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = request(http.MethodGet, stats, "Bearer "+other)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = request(http.MethodGet, "/api/realtime?site=example.com", "Bearer "+other)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = request(http.MethodGet, "/debug/vars", "Bearer "+viewer)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = request(http.MethodGet, "/debug/vars", "Bearer "+token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = request(http.MethodPost, "/api/annotations", "Bearer "+viewer)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = request(http.MethodPost, "/api/v1/hits", "Bearer "+other)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	for _, scoped := range []string{viewer, other} {
+		w = request(http.MethodPost, "/api/v1/erase", "Bearer "+scoped)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	}
+
+	ok, err = dbRevokeAPIToken(ctx, db, "viewer")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	var sites int
+	require.NoError(t, db.QueryRow("SELECT count(*) FROM api_token_sites").Scan(&sites))
+	assert.Equal(t, 1, sites)
+}
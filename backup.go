@@ -0,0 +1,143 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type BackupConfig struct {
+	Schedule  string `toml:"schedule"`  // When to back up, in cron format such as "0 3 * * *" or @daily. Empty disables backups.
+	Directory string `toml:"directory"` // Where to write the backups
+	Keep      int    `toml:"keep"`      // How many backups to keep. Zero keeps them all.
+}
+
+const backupPrefix = "sheepcount-"
+const backupSuffix = ".sqlite3"
+
+// Write a consistent snapshot of the database to dest with VACUUM INTO, which reads in a single
+// transaction so the server can keep writing to the WAL meanwhile. The snapshot is written next to
+// dest and renamed so that a partial backup is never left at dest.
+func backupDatabase(ctx context.Context, db *sql.DB, dest string) error {
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+
+	tmp := dest + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot back up database: %w", err)
+	}
+
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// Delete all but the newest keep backups in directory. The timestamps in the names sort in order.
+func pruneBackups(directory string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			backups = append(backups, name)
+		}
+	}
+	sort.Strings(backups)
+
+	for len(backups) > keep {
+		if err := os.Remove(filepath.Join(directory, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+func backupPath(directory string, now time.Time) string {
+	return filepath.Join(directory, backupPrefix+now.UTC().Format("20060102T150405Z")+backupSuffix)
+}
+
+// Back up the database on the configured schedule.
+func Backuper(ctx context.Context, db *sql.DB, config *BackupConfig) error {
+	schedule, err := parseCron(config.Schedule)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(config.Directory, 0700); err != nil {
+		return err
+	}
+
+	for {
+		next := schedule.Next(time.Now())
+		if next.IsZero() {
+			return fmt.Errorf("backup schedule %q never runs", config.Schedule)
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		dest := backupPath(config.Directory, time.Now())
+		if err := backupDatabase(ctx, db, dest); err != nil {
+			log.Printf("Cannot back up database: %s", err)
+			continue
+		}
+		log.Printf("Backed up database to %s", dest)
+
+		if err := pruneBackups(config.Directory, config.Keep); err != nil {
+			log.Printf("Cannot delete old backups: %s", err)
+		}
+	}
+}
+
+func newBackupCommand(databasePath *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "backup <dest>",
+		Short: "Write a consistent snapshot of the database, even while the server is running",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			if err := backupDatabase(cmd.Context(), db, args[0]); err != nil {
+				return err
+			}
+			log.Printf("Backed up database to %s", args[0])
+			return nil
+		},
+	}
+}
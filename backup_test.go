@@ -0,0 +1,56 @@
+package sheepcount
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := dbConnect(filepath.Join(dir, "sheepcount.sqlite3"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec("INSERT INTO sites(domain) VALUES ('example.com')")
+	require.NoError(t, err)
+
+	dest := filepath.Join(dir, "backup.sqlite3")
+	require.NoError(t, backupDatabase(context.Background(), db, dest))
+	assert.Error(t, backupDatabase(context.Background(), db, dest), "should not overwrite a backup")
+
+	backup, err := dbConnect(dest)
+	require.NoError(t, err)
+	defer backup.Close()
+
+	var site string
+	require.NoError(t, backup.QueryRow("SELECT domain FROM sites").Scan(&site))
+	assert.Equal(t, "example.com", site)
+}
+
+func TestPruneBackups(t *testing.T) {
+	dir := t.TempDir()
+
+	now := time.Date(2022, 6, 1, 3, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, os.WriteFile(backupPath(dir, now.AddDate(0, 0, i)), nil, 0600))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other.sqlite3"), nil, 0600))
+
+	require.NoError(t, pruneBackups(dir, 2))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"other.sqlite3", "sheepcount-20220604T030000Z.sqlite3", "sheepcount-20220605T030000Z.sqlite3"}, names)
+}
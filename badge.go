@@ -0,0 +1,231 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Badges with the pageviews of a page, or of the whole site, are cached for this long, which is as
+// fresh as they need to be.
+const badgeCacheTTL = 10 * time.Minute
+
+// The most counts that are cached, so that requests for made up paths cannot use up memory
+const badgeCacheSize = 10000
+
+type badgeCount struct {
+	pageviews int64
+	fetched   time.Time
+}
+
+// The cached counts of the badges, and a rate limit for each client on counting those that are not
+// cached. It is safe for concurrent use.
+type badges struct {
+	sync.Mutex
+	counts  map[string]badgeCount
+	limiter *rateLimiter
+}
+
+func newBadges() *badges {
+	return &badges{
+		counts:  make(map[string]badgeCount),
+		limiter: newRateLimiter(1, 30),
+	}
+}
+
+func (badges *badges) get(key string, now time.Time) (int64, bool) {
+	badges.Lock()
+	defer badges.Unlock()
+
+	count, ok := badges.counts[key]
+	if !ok || now.Sub(count.fetched) >= badgeCacheTTL {
+		return 0, false
+	}
+	return count.pageviews, true
+}
+
+func (badges *badges) put(key string, pageviews int64, now time.Time) {
+	badges.Lock()
+	defer badges.Unlock()
+
+	if len(badges.counts) >= badgeCacheSize {
+		for k, count := range badges.counts {
+			if now.Sub(count.fetched) >= badgeCacheTTL {
+				delete(badges.counts, k)
+			}
+		}
+		// Start again if every count is fresh
+		if len(badges.counts) >= badgeCacheSize {
+			badges.counts = make(map[string]badgeCount)
+		}
+	}
+
+	badges.counts[key] = badgeCount{pageviews: pageviews, fetched: now}
+}
+
+func (config *Config) hasBadges(site string) bool {
+	for _, badgeSite := range config.BadgeSites {
+		if badgeSite == site {
+			return true
+		}
+	}
+	return config.isPublic(site)
+}
+
+// The pageviews of the path, or of the whole site if the path is empty, by people rather than bots.
+func dbBadgePageviews(ctx context.Context, db *sql.DB, site string, path string) (int64, error) {
+	var pageviews int64
+	var err error
+	if path == "" {
+		err = db.QueryRowContext(
+			ctx,
+			`SELECT COALESCE(SUM(pageviews), 0) FROM totals_daily
+			WHERE site_id = (SELECT site_id FROM sites WHERE domain = ?) AND bot = 0`,
+			site,
+		).Scan(&pageviews)
+	} else {
+		err = db.QueryRowContext(
+			ctx,
+			`SELECT COALESCE(SUM(hits_daily.pageviews), 0) FROM hits_daily
+			JOIN sites ON sites.site_id = hits_daily.site_id
+			JOIN paths ON paths.path_id = hits_daily.path_id AND paths.site_id = hits_daily.site_id
+			WHERE sites.domain = ? AND paths.path = ? AND hits_daily.bot = 0`,
+			site, path,
+		).Scan(&pageviews)
+	}
+	return pageviews, err
+}
+
+// The pageviews of the path, or of the whole site if the path is empty, by people rather than bots,
+// when hits are stored in ClickHouse.
+func clickhouseBadgePageviews(ctx context.Context, client *clickhouseClient, site string, path string) (int64, error) {
+	var row struct {
+		Pageviews int64 `json:"pageviews"`
+	}
+	err := client.queryRow(
+		ctx,
+		`SELECT count() AS pageviews FROM hits
+		WHERE site = {site:String} AND event = 'l' AND bot < 2 AND (empty({path:String}) OR path = {path:String})`,
+		url.Values{"param_site": {clickhouseParam(site)}, "param_path": {clickhouseParam(path)}},
+		&row,
+	)
+	return row.Pageviews, err
+}
+
+// Shorten a count to at most four characters or so, such as 1.2k or 35M.
+func compactCount(n int64) string {
+	if n < 1000 {
+		return strconv.FormatInt(n, 10)
+	}
+
+	value := float64(n)
+	for _, unit := range []string{"k", "M", "B"} {
+		value /= 1000
+		rounded := math.Round(value*10) / 10
+		if rounded < 1000 || unit == "B" {
+			if rounded >= 100 {
+				return strconv.FormatFloat(math.Round(value), 'f', 0, 64) + unit
+			}
+			return strconv.FormatFloat(rounded, 'f', -1, 64) + unit
+		}
+	}
+	panic("unreachable")
+}
+
+// A flat badge in the style of shields.io. The widths of the text are guessed, as Verdana at 11px is
+// about 7px for each character.
+func badgeSVG(label string, value string) string {
+	labelWidth := 10 + 7*len([]rune(label))
+	valueWidth := 10 + 7*len([]rune(value))
+	width := labelWidth + valueWidth
+	label, value = html.EscapeString(label), html.EscapeString(value)
+
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[4]s: %[5]s">
+<title>%[4]s: %[5]s</title>
+<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)"><rect width="%[2]d" height="20" fill="#555"/><rect x="%[2]d" width="%[3]d" height="20" fill="#4c1"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[6]d" y="15" fill="#010101" fill-opacity=".3">%[4]s</text><text x="%[6]d" y="14">%[4]s</text>
+<text x="%[7]d" y="15" fill="#010101" fill-opacity=".3">%[5]s</text><text x="%[7]d" y="14">%[5]s</text>
+</g>
+</svg>
+`, width, labelWidth, valueWidth, label, value, labelWidth/2, labelWidth+valueWidth/2)
+}
+
+// Serve the badge of a page at /badge/<site>/<path>.svg, such as /badge/example.com/blog/post.svg,
+// or of the whole site at /badge/<site>.svg. The home page is /badge/<site>/.svg. The label defaults
+// to views and can be changed with ?label=.
+func handleBadge(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/badge/")
+	if !strings.HasSuffix(rest, ".svg") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rest = strings.TrimSuffix(rest, ".svg")
+
+	site, path := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		site, path = rest[:i], rest[i:]
+	}
+
+	if !sheepcount.hasBadges(site) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	label := r.URL.Query().Get("label")
+	if label == "" {
+		label = "views"
+	}
+	if len([]rune(label)) > 32 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	key := site + path
+	pageviews, ok := sheepcount.badges.get(key, now)
+	if !ok {
+		if allowed, wait := sheepcount.badges.limiter.Allow(r.RemoteAddr, now); !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		var err error
+		if sheepcount.clickhouse != nil {
+			pageviews, err = clickhouseBadgePageviews(r.Context(), sheepcount.clickhouse, site, path)
+		} else {
+			pageviews, err = dbBadgePageviews(r.Context(), sheepcount.readDB, site, path)
+		}
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		sheepcount.badges.put(key, pageviews, now)
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(badgeCacheTTL/time.Second)))
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	if r.Method == http.MethodHead {
+		return
+	}
+	fmt.Fprint(w, badgeSVG(label, compactCount(pageviews)))
+}
@@ -0,0 +1,108 @@
+package sheepcount
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactCount(t *testing.T) {
+	for n, expected := range map[int64]string{
+		0:             "0",
+		999:           "999",
+		1000:          "1k",
+		1234:          "1.2k",
+		12345:         "12.3k",
+		123456:        "123k",
+		999950:        "1M",
+		35000000:      "35M",
+		2500000000:    "2.5B",
+		1234000000000: "1234B",
+	} {
+		assert.Equal(t, expected, compactCount(n), n)
+	}
+}
+
+func TestBadge(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	require.NoError(t, err)
+	defer writer.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	for i, h := range []struct {
+		domain    string
+		path      string
+		userAgent string
+	}{
+		// Paths are of each site, and another site having the path first must not change the count
+		{"example.org", "/", "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0"},
+		{"example.com", "/blog/post", "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0"},
+		{"example.com", "/blog/post", "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0"},
+		{"example.com", "/blog/post", "Googlebot/2.1 (+http://www.google.com/bot.html)"},
+		{"example.com", "/", "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0"},
+		{"example.org", "/blog/post", "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0"},
+	} {
+		require.NoError(t, writer.InsertHit(ctx, tx, &Hit{
+			Timestamp:         1654041600 + int64(i)*86400,
+			IdentifierCurrent: []byte("a"),
+			UserAgent:         h.userAgent,
+			Event:             PageLoad,
+			Domain:            h.domain,
+			Path:              h.path,
+		}))
+	}
+	require.NoError(t, tx.Commit())
+	require.NoError(t, dbAggregate(ctx, db))
+
+	config := DefaultConfig()
+	config.BadgeSites = []string{"example.com"}
+	sheepcount := &SheepCount{db: db, readDB: db, badges: newBadges(), Config: config}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleBadge(sheepcount, w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	// Bots are not counted
+	w := get("/badge/example.com/blog/post.svg")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/svg+xml", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "<title>views: 2</title>")
+
+	assert.Contains(t, get("/badge/example.com.svg").Body.String(), "<title>views: 3</title>")
+	assert.Contains(t, get("/badge/example.com/.svg").Body.String(), "<title>views: 1</title>")
+	assert.Contains(t, get("/badge/example.com/missing.svg").Body.String(), "<title>views: 0</title>")
+	assert.Contains(t, get("/badge/example.com/blog/post.svg?label=%3Creads%3E").Body.String(), "<title>&lt;reads&gt;: 2</title>")
+
+	// Only sites with badges have them
+	assert.Equal(t, http.StatusNotFound, get("/badge/example.org/blog/post.svg").Code)
+	assert.Equal(t, http.StatusNotFound, get("/badge/example.com/blog/post").Code)
+
+	// The count is cached
+	_, err = db.ExecContext(ctx, "DELETE FROM hits_daily")
+	require.NoError(t, err)
+	assert.Contains(t, get("/badge/example.com/blog/post.svg").Body.String(), "<title>views: 2</title>")
+
+	// And counting those that are not is rate limited
+	for i := 0; i < 40; i++ {
+		w = get("/badge/example.com/" + string(rune('a'+i%26)) + string(rune('a'+i/26)) + ".svg")
+	}
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
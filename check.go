@@ -0,0 +1,383 @@
+package sheepcount
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/oschwald/geoip2-golang"
+	"github.com/spf13/cobra"
+)
+
+// Check the configuration for mistakes that would otherwise only be found once Sheep Count is
+// running, if at all.
+func (config *Config) Validate() []error {
+	var errs []error
+
+	if len(config.Domains) == 0 && !config.AllowLocalhost {
+		errs = append(errs, errors.New("domains must not be empty"))
+	}
+	if config.ReverseProxy && config.Hostname == "" {
+		errs = append(errs, errors.New("hostname must be set when behind a reverse proxy"))
+	} else if config.AdminListener.Enabled() && config.Hostname == "" {
+		errs = append(errs, errors.New("hostname must be set with a separate admin listener"))
+	} else if config.Hostname == "" {
+		// Requests through Unix sockets come from a reverse proxy
+		for i := range config.Listeners {
+			if _, ok := config.Listeners[i].unixPath(); ok {
+				errs = append(errs, errors.New("hostname must be set when a listener is a Unix socket"))
+				break
+			}
+		}
+	}
+	if config.CookieKey == "" {
+		errs = append(errs, errors.New("cookie_key must be set"))
+	}
+	if config.SessionLifetime < time.Minute {
+		errs = append(errs, fmt.Errorf("session_lifetime must be at least a minute, not %s", config.SessionLifetime))
+	}
+	if config.CookieSameSite != "lax" && config.CookieSameSite != "strict" {
+		errs = append(errs, fmt.Errorf("cookie_same_site must be lax or strict, not %q", config.CookieSameSite))
+	}
+	if config.SaltRotationDuration < time.Hour || config.SaltRotationDuration > 7*24*time.Hour {
+		errs = append(errs, fmt.Errorf("rotation_frequency must be between an hour and a week, not %s", config.SaltRotationDuration))
+	}
+	if config.MaxEventSize <= 0 {
+		errs = append(errs, fmt.Errorf("max_event_size must be positive, not %d", config.MaxEventSize))
+	}
+	if config.DedupWindow < 0 {
+		errs = append(errs, fmt.Errorf("dedup_window must not be negative, not %s", config.DedupWindow))
+	}
+	if config.QueryCacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("query_cache_ttl must not be negative, not %s", config.QueryCacheTTL))
+	}
+	if config.QueryTimeout < 0 {
+		errs = append(errs, fmt.Errorf("query_timeout must not be negative, not %s", config.QueryTimeout))
+	}
+	if config.AggregationInterval <= 0 {
+		errs = append(errs, fmt.Errorf("aggregation_interval must be positive, not %s", config.AggregationInterval))
+	}
+
+	if _, err := newFingerprinter(config.FingerprintMode); err != nil {
+		errs = append(errs, err)
+	} else if config.SiteSalts && config.FingerprintMode != "" && config.FingerprintMode != "ip-headers" {
+		errs = append(errs, fmt.Errorf("site_salts only applies to the ip-headers fingerprint mode, not %s", config.FingerprintMode))
+	} else if config.RequireConsent && config.FingerprintMode == "etag" {
+		// The identifier is kept in the browser cache as soon as the page loads, before any consent
+		errs = append(errs, errors.New("require_consent cannot be used with the etag fingerprint mode"))
+	}
+	if _, err := config.location(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid timezone: %w", err))
+	}
+	if err := validateGoals(config.Goals); err != nil {
+		errs = append(errs, err)
+	}
+	for i := range config.Sinks {
+		if err := config.Sinks[i].validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := config.validateStorage(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := config.Paths.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := config.Endpoints.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := config.Socket.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := config.AdminListener.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("admin_listener: %w", err))
+	}
+	for i := range config.Listeners {
+		listener := &config.Listeners[i]
+		if !listener.Enabled() {
+			errs = append(errs, fmt.Errorf("listener %d has no address", i+1))
+		} else if err := listener.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := config.OIDC.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := config.PageTitles.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := config.Alerts.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := config.Telemetry.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateCORSOrigins(config.CORSOrigins); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := config.Ignore.compile(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseNetworks(config.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("invalid trusted proxies: %w", err))
+	}
+	if _, err := newReferrerSpam(&config.ReferrerSpam); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := referrerGroups(config.ReferrerGroups); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newRateLimit(&SheepCount{Config: *config}); err != nil {
+		errs = append(errs, err)
+	}
+
+	if config.Report.Schedule != "" {
+		if _, err := parseCron(config.Report.Schedule); err != nil {
+			errs = append(errs, err)
+		}
+		if _, _, err := reportPeriods(config.Report.Period, time.Now()); err != nil {
+			errs = append(errs, err)
+		}
+		if len(config.Report.To) == 0 {
+			errs = append(errs, errors.New("report recipients must be set to send reports"))
+		}
+		if config.Report.SMTP.Host == "" {
+			errs = append(errs, errors.New("an SMTP host must be set to send reports"))
+		}
+	}
+
+	if config.Backup.Schedule != "" {
+		if _, err := parseCron(config.Backup.Schedule); err != nil {
+			errs = append(errs, err)
+		}
+		if config.Backup.Directory == "" {
+			errs = append(errs, errors.New("a backup directory must be set to back up"))
+		}
+	}
+
+	if config.Maintenance.CheckpointInterval < 0 {
+		errs = append(errs, fmt.Errorf("checkpoint_interval must not be negative, not %s", config.Maintenance.CheckpointInterval))
+	}
+	if config.Maintenance.RetentionMonths < 0 {
+		errs = append(errs, fmt.Errorf("retention_months must not be negative, not %d", config.Maintenance.RetentionMonths))
+	}
+	if config.Maintenance.IntegrityCheck != "" {
+		if _, err := parseCron(config.Maintenance.IntegrityCheck); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if config.TLS.Enabled() {
+		if err := config.TLS.validateChallenge(); err != nil {
+			errs = append(errs, err)
+		}
+		if config.TLS.Autocert {
+			if config.Hostname == "" {
+				errs = append(errs, errors.New("hostname must be set to use autocert"))
+			}
+		} else if config.TLS.Certificate == "" || config.TLS.Key == "" {
+			errs = append(errs, errors.New("both a TLS certificate and key must be given"))
+		} else if _, err := tls.LoadX509KeyPair(config.TLS.Certificate, config.TLS.Key); err != nil {
+			errs = append(errs, fmt.Errorf("cannot load TLS certificate: %w", err))
+		}
+	}
+
+	return errs
+}
+
+// Prints the result of each check and remembers whether any failed.
+type checker struct {
+	w      io.Writer
+	failed bool
+}
+
+func (c *checker) ok(name string, detail string) {
+	fmt.Fprintf(c.w, "ok    %s: %s\n", name, detail)
+}
+
+func (c *checker) fail(name string, err error) {
+	c.failed = true
+	fmt.Fprintf(c.w, "FAIL  %s: %s\n", name, err)
+}
+
+func (c *checker) checkConfig(configPath string) (Config, bool) {
+	config := DefaultConfig()
+
+	metadata, err := toml.DecodeFile(configPath, &config)
+	if err != nil {
+		c.fail("config", err)
+		return config, false
+	}
+
+	if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		c.fail("config", fmt.Errorf("unknown keys: %s", strings.Join(keys, ", ")))
+	}
+
+	errs := config.Validate()
+	for _, err := range errs {
+		c.fail("config", err)
+	}
+	if len(errs) == 0 {
+		c.ok("config", configPath)
+	}
+
+	return config, true
+}
+
+// Open the database read-only so that checking does not apply migrations.
+func (c *checker) checkDatabase(ctx context.Context, databasePath string, config *Config) {
+	if _, err := os.Stat(databasePath); errors.Is(err, os.ErrNotExist) {
+		c.ok("database", fmt.Sprintf("%s does not exist and will be created", databasePath))
+		if config.Password == "" && !config.OIDC.Enabled() {
+			c.fail("password", errors.New("no password is set"))
+		}
+		return
+	}
+
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro&_busy_timeout=5000", databasePath))
+	if err != nil {
+		c.fail("database", err)
+		return
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRowContext(ctx, "PRAGMA quick_check").Scan(&result); err != nil {
+		c.fail("database", err)
+		return
+	}
+	if result != "ok" {
+		c.fail("database", fmt.Errorf("integrity check failed: %s", result))
+		return
+	}
+
+	migrations, err := loadMigrations(contentFs)
+	if err != nil {
+		c.fail("database", err)
+		return
+	}
+
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		c.fail("database", err)
+		return
+	}
+
+	switch {
+	case version > len(migrations):
+		c.fail("database", fmt.Errorf("schema version %d is newer than the latest supported version %d", version, len(migrations)))
+	case version < len(migrations):
+		c.ok("database", fmt.Sprintf("%s will be migrated from schema version %d to %d", databasePath, version, len(migrations)))
+	default:
+		c.ok("database", fmt.Sprintf("%s is at schema version %d", databasePath, version))
+	}
+
+	// Older databases do not have the settings table yet
+	var hasSettings bool
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'settings'").Scan(&hasSettings); err != nil {
+		c.fail("database", err)
+		return
+	}
+
+	password := config.Password
+	if hasSettings {
+		settings, err := dbSettings(ctx, db)
+		if err != nil {
+			c.fail("database", err)
+			return
+		}
+		if p, ok := settings[settingPassword]; ok {
+			password = p
+		}
+	}
+
+	// Accounts replace the shared password, and logging in with OpenID Connect creates them
+	var accounts int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'users_admin'").Scan(&accounts)
+	if err == nil && accounts > 0 {
+		err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users_admin").Scan(&accounts)
+	}
+	if err != nil {
+		c.fail("database", err)
+		return
+	}
+
+	if accounts > 0 {
+		c.ok("accounts", fmt.Sprintf("%d can log in to the dashboard", accounts))
+	} else if password == "" && !config.OIDC.Enabled() {
+		c.fail("password", errors.New("no password is set and there are no accounts"))
+	}
+}
+
+// The GeoIP database is geoip_path if it is set, and otherwise is recorded in the state file, and
+// downloaded on the first start if not.
+func (c *checker) checkGeoIP(external string) {
+	path := external
+	if path == "" {
+		f, err := os.Open(statePath)
+		if errors.Is(err, os.ErrNotExist) {
+			c.ok("geoip", "no state yet, so the database will be downloaded")
+			return
+		}
+		if err != nil {
+			c.fail("geoip", err)
+			return
+		}
+		defer f.Close()
+
+		var state struct {
+			GeoIP struct {
+				Path string `json:"path"`
+			} `json:"geoip"`
+		}
+		if err := json.NewDecoder(f).Decode(&state); err != nil {
+			c.fail("geoip", fmt.Errorf("cannot read %s: %w", statePath, err))
+			return
+		}
+		path = state.GeoIP.Path
+	}
+
+	reader, err := geoip2.Open(path)
+	if err != nil {
+		c.fail("geoip", err)
+		return
+	}
+	defer reader.Close()
+
+	buildTime := time.Unix(int64(reader.Metadata().BuildEpoch), 0).UTC()
+	c.ok("geoip", fmt.Sprintf("%s built %s", path, buildTime.Format("2006-01-02")))
+}
+
+func newCheckCommand(configPath *string, databasePath *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "check",
+		Short: "Check the configuration, database and GeoIP database",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c := &checker{w: os.Stdout}
+
+			config, ok := c.checkConfig(*configPath)
+			if ok {
+				c.checkDatabase(cmd.Context(), *databasePath, &config)
+			}
+			c.checkGeoIP(config.GeoIPPath)
+
+			if c.failed {
+				return errors.New("some checks failed")
+			}
+			return nil
+		},
+	}
+}
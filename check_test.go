@@ -0,0 +1,51 @@
+package sheepcount
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	config := DefaultConfig()
+	config.Domains = []string{"example.com"}
+	config.CookieKey = "secret"
+	assert.Empty(t, config.Validate())
+
+	config.TLS.Autocert = true
+	config.Hostname = "stats.example.com"
+	config.TLS.Challenge = "http-01"
+	assert.Empty(t, config.Validate())
+	config.TLS.RedirectAddress = ""
+	assert.Len(t, config.Validate(), 1)
+	config.TLS = DefaultConfig().TLS
+	config.Hostname = ""
+
+	config.Domains = nil
+	config.ReverseProxy = true
+	config.Ignore.PathRegexps = []string{"("}
+	config.Report.Schedule = "61 * * * *"
+	config.SessionLifetime = 0
+	config.CookieSameSite = "none"
+	config.FingerprintMode = "etag"
+	config.SiteSalts = true
+	assert.Len(t, config.Validate(), 9)
+
+	config = DefaultConfig()
+	config.Domains = []string{"example.com"}
+	config.CookieKey = "secret"
+	config.RequireConsent = true
+	assert.Empty(t, config.Validate())
+	config.FingerprintMode = "etag"
+	assert.Len(t, config.Validate(), 1)
+
+	config = DefaultConfig()
+	config.Domains = []string{"example.com"}
+	config.CookieKey = "secret"
+	config.Listeners = []ListenerConfig{{Address: "127.0.0.1:4444"}, {Address: "unix:/run/sheepcount/sheepcount.sock"}}
+	assert.Len(t, config.Validate(), 1)
+	config.Hostname = "stats.example.com"
+	assert.Empty(t, config.Validate())
+	config.Listeners = append(config.Listeners, ListenerConfig{}, ListenerConfig{Address: "127.0.0.1"})
+	assert.Len(t, config.Validate(), 2)
+}
@@ -0,0 +1,299 @@
+package sheepcount
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"zgo.at/gadget"
+	"zgo.at/isbot"
+)
+
+// The table of hits in ClickHouse, which is created if it does not exist. It is where hits are
+// stored with storage = "clickhouse", and otherwise a copy of them that ClickHouse sinks write to.
+//
+//go:embed db/clickhouse/schema.sql
+var clickhouseSchema string
+
+// Tables created before titles were stored do not have them.
+const clickhouseAddTitle = "ALTER TABLE hits ADD COLUMN IF NOT EXISTS title Nullable(String) AFTER path"
+
+// The ClickHouse server that hits are stored in with storage = "clickhouse", configured with
+// [clickhouse].
+type ClickHouseConfig struct {
+	URL      string `toml:"url"`      // The HTTP interface, such as http://localhost:8123
+	Database string `toml:"database"` // Or the default database of the user if empty
+	User     string `toml:"user"`
+	Password string `toml:"password"`
+}
+
+// Where hits are stored and the dashboard, API, reports and badges count them from.
+const (
+	storageSQLite     = "sqlite"
+	storageClickHouse = "clickhouse"
+)
+
+// With ClickHouse storage, SQLite still has the accounts, settings, annotations and so on, but
+// the features that work on its hits themselves cannot be used.
+func (config *Config) validateStorage() error {
+	switch config.Storage {
+	case "", storageSQLite:
+		return nil
+	case storageClickHouse:
+	default:
+		return fmt.Errorf("storage must be %s or %s, not %q", storageSQLite, storageClickHouse, config.Storage)
+	}
+
+	if u, err := url.Parse(config.ClickHouse.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid clickhouse url: %s", config.ClickHouse.URL)
+	}
+	if config.Alerts.WebhookURL != "" {
+		return errors.New("alerts cannot be sent with clickhouse storage")
+	}
+	if config.Maintenance.RetentionMonths > 0 {
+		return errors.New("retention_months cannot be used with clickhouse storage, so set a TTL on its hits table instead")
+	}
+	if config.PageTitles.Enabled() {
+		return errors.New("page_titles cannot be used with clickhouse storage, so use track_titles instead")
+	}
+	return nil
+}
+
+func (config *Config) clickhouseStorage() bool {
+	return config.Storage == storageClickHouse
+}
+
+// Talks to ClickHouse over its HTTP interface.
+type clickhouseClient struct {
+	config ClickHouseConfig
+	client *retryablehttp.Client
+}
+
+// A client whose requests take at most timeout, or however long their context allows if it is zero.
+func newClickhouseClient(config ClickHouseConfig, timeout time.Duration) *clickhouseClient {
+	client := newClient()
+	client.RetryMax = 2
+	client.HTTPClient.Timeout = timeout
+	return &clickhouseClient{config: config, client: client}
+}
+
+// Send a statement, with the body after the query if there is one, and return the response.
+func (client *clickhouseClient) do(ctx context.Context, query string, settings url.Values, body []byte) ([]byte, error) {
+	params := url.Values{"query": {query}}
+	if client.config.Database != "" {
+		params.Set("database", client.config.Database)
+	}
+	for name, values := range settings {
+		params[name] = values
+	}
+
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(client.config.URL, "/")+"/?"+params.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "SheepCount")
+	if client.config.User != "" {
+		req.Header.Set("X-ClickHouse-User", client.config.User)
+		req.Header.Set("X-ClickHouse-Key", client.config.Password)
+	}
+
+	resp, err := client.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("clickhouse returned %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Run a statement that returns nothing.
+func (client *clickhouseClient) exec(ctx context.Context, query string, settings url.Values, body []byte) error {
+	_, err := client.do(ctx, query, settings, body)
+	return err
+}
+
+// Run a query with its parameters, given as param_<name>, and return its rows, one JSON object per
+// line. 64-bit integers are numbers rather than strings, as they are from SQLite.
+func (client *clickhouseClient) query(ctx context.Context, query string, params url.Values) ([]byte, error) {
+	settings := url.Values{"default_format": {"JSONEachRow"}, "output_format_json_quote_64bit_integers": {"0"}}
+	for name, values := range params {
+		settings[name] = values
+	}
+	return client.do(ctx, query, settings, nil)
+}
+
+// Run a query that returns a single row, such as of aggregates without GROUP BY, into row.
+func (client *clickhouseClient) queryRow(ctx context.Context, query string, params url.Values, row interface{}) error {
+	output, err := client.query(ctx, query, params)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes.TrimSpace(output), row)
+}
+
+// Whether ClickHouse is up, for the readiness check.
+func (client *clickhouseClient) ping(ctx context.Context) error {
+	_, err := client.do(ctx, "SELECT 1", nil, nil)
+	return err
+}
+
+// A row of the hits table in ClickHouse, with the dimensions that SQLite normalises into tables of
+// their own.
+type clickhouseHit struct {
+	Timestamp         int64    `json:"timestamp"`
+	Site              string   `json:"site"`
+	Event             string   `json:"event"`
+	Path              string   `json:"path"`
+	Title             *string  `json:"title"`
+	ReferrerDomain    *string  `json:"referrer_domain"`
+	ReferrerPath      *string  `json:"referrer_path"`
+	Keyword           *string  `json:"keyword"`
+	UTMSource         *string  `json:"utm_source"`
+	UTMMedium         *string  `json:"utm_medium"`
+	UTMCampaign       *string  `json:"utm_campaign"`
+	UTMTerm           *string  `json:"utm_term"`
+	UTMContent        *string  `json:"utm_content"`
+	Target            *string  `json:"target"`
+	EventName         *string  `json:"event_name"`
+	Goals             []string `json:"goals"`
+	Visitor           uint64   `json:"visitor"`
+	UserAgent         string   `json:"user_agent"`
+	BrowserName       string   `json:"browser_name"`
+	BrowserVersion    string   `json:"browser_version"`
+	OSName            string   `json:"os_name"`
+	OSVersion         string   `json:"os_version"`
+	Bot               uint8    `json:"bot"`
+	Device            *string  `json:"device"`
+	Language          string   `json:"language"`
+	SecondaryLanguage string   `json:"secondary_language"`
+	Country           *string  `json:"country"`
+	Subdivision       *string  `json:"subdivision"`
+	City              *string  `json:"city"`
+	Postal            *string  `json:"postal"`
+	ScreenHeight      *int32   `json:"screen_height"`
+	ScreenWidth       *int32   `json:"screen_width"`
+	PixelRatio        *float64 `json:"pixel_ratio"`
+	ScrollDepth       *int16   `json:"scroll_depth"`
+	EngagedSeconds    *int32   `json:"engaged_seconds"`
+	TimeToFirstByte   *int32   `json:"time_to_first_byte"`
+	DOMContentLoaded  *int32   `json:"dom_content_loaded"`
+	LoadTime          *int32   `json:"load_time"`
+}
+
+func newClickhouseHit(hit *Hit) clickhouseHit {
+	ua := gadget.ParseUA(hit.UserAgent)
+
+	row := clickhouseHit{
+		Timestamp:         hit.Timestamp,
+		Site:              hit.Domain,
+		Event:             string(hit.Event),
+		Path:              hit.Path,
+		Title:             nullableString(hit.Title),
+		ReferrerDomain:    nullableString(hit.ReferrerDomain),
+		ReferrerPath:      nullableString(hit.ReferrerPath),
+		Keyword:           nullableString(hit.Keyword),
+		UTMSource:         nullableString(hit.Campaign.Source),
+		UTMMedium:         nullableString(hit.Campaign.Medium),
+		UTMCampaign:       nullableString(hit.Campaign.Name),
+		UTMTerm:           nullableString(hit.Campaign.Term),
+		UTMContent:        nullableString(hit.Campaign.Content),
+		Target:            nullableString(hit.Target),
+		EventName:         nullableString(hit.EventName),
+		Goals:             hit.Goals,
+		Visitor:           hit.Visitor,
+		UserAgent:         hit.UserAgent,
+		BrowserName:       ua.BrowserName,
+		BrowserVersion:    ua.BrowserVersion,
+		OSName:            ua.OSName,
+		OSVersion:         ua.OSVersion,
+		Device:            nullableString(hit.Device),
+		Language:          hit.Language,
+		SecondaryLanguage: hit.SecondaryLanguage,
+		Country:           nullableString(hit.Country),
+		Subdivision:       nullableString(hit.Subdivision),
+		City:              nullableString(hit.City),
+		Postal:            nullableString(hit.Postal),
+		ScreenHeight:      nullableInt32(hit.ScreenHeight),
+		ScreenWidth:       nullableInt32(hit.ScreenWidth),
+		ScrollDepth:       nullableInt16(hit.ScrollDepth),
+		EngagedSeconds:    nullableInt32(hit.EngagedSeconds),
+		TimeToFirstByte:   nullableInt32(hit.TimeToFirstByte),
+		DOMContentLoaded:  nullableInt32(hit.DOMContentLoaded),
+		LoadTime:          nullableInt32(hit.LoadTime),
+	}
+
+	if row.Goals == nil {
+		row.Goals = []string{}
+	}
+
+	// Without anonymous visitors, the visitor is the start of the identifier, which is a hash already
+	if row.Visitor == 0 && len(hit.IdentifierCurrent) >= 8 {
+		row.Visitor = binary.BigEndian.Uint64(hit.IdentifierCurrent)
+	}
+
+	// The higher bot score of the request and the user agent, as in the queries of SQLite
+	row.Bot = uint8(isbot.UserAgent(hit.UserAgent))
+	if hit.Bot.Valid && hit.Bot.Int16 > int16(row.Bot) {
+		row.Bot = uint8(hit.Bot.Int16)
+	}
+
+	if hit.PixelRatio.Valid {
+		pixelRatio := hit.PixelRatio.Float64
+		row.PixelRatio = &pixelRatio
+	}
+
+	return row
+}
+
+// Inserts hits into ClickHouse, for sites with more traffic than SQLite can keep up with. Inserts are
+// asynchronous, so ClickHouse buffers the small batches of the database writer into larger parts.
+type clickhouseSink struct {
+	client *clickhouseClient
+	ready  bool // Whether the table has been created
+}
+
+func (sink *clickhouseSink) WriteBatch(ctx context.Context, hits []Hit) error {
+	if !sink.ready {
+		if err := sink.client.exec(ctx, clickhouseSchema, nil, nil); err != nil {
+			return fmt.Errorf("cannot create table: %w", err)
+		}
+		if err := sink.client.exec(ctx, clickhouseAddTitle, nil, nil); err != nil {
+			return fmt.Errorf("cannot add titles to table: %w", err)
+		}
+		sink.ready = true
+	}
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for i := range hits {
+		if err := encoder.Encode(newClickhouseHit(&hits[i])); err != nil {
+			return err
+		}
+	}
+
+	// Wait for the insert to be flushed, so that failures are known
+	settings := url.Values{"async_insert": {"1"}, "wait_for_async_insert": {"1"}}
+	return sink.client.exec(ctx, "INSERT INTO hits FORMAT JSONEachRow", settings, body.Bytes())
+}
+
+func (sink *clickhouseSink) Close() error {
+	return nil
+}
+
+func (sink *clickhouseSink) String() string {
+	return "clickhouse sink " + sink.client.config.URL
+}
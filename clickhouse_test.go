@@ -0,0 +1,85 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"zgo.at/isbot"
+)
+
+func TestClickhouseSink(t *testing.T) {
+	var queries []string
+	var rows []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "analytics", r.URL.Query().Get("database"))
+		assert.Equal(t, "sheepcount", r.Header.Get("X-ClickHouse-User"))
+		assert.Equal(t, "secret", r.Header.Get("X-ClickHouse-Key"))
+
+		query := r.URL.Query().Get("query")
+		queries = append(queries, query)
+		if strings.HasPrefix(query, "INSERT") {
+			assert.Equal(t, "1", r.URL.Query().Get("async_insert"))
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+				var row map[string]interface{}
+				require.NoError(t, json.Unmarshal([]byte(line), &row))
+				rows = append(rows, row)
+			}
+		}
+	}))
+	defer server.Close()
+
+	sinks, err := newSinks([]SinkConfig{{Type: "clickhouse", URL: server.URL, Database: "analytics", User: "sheepcount", Password: "secret"}})
+	require.NoError(t, err)
+	sink := sinks[0]
+	defer sink.Close()
+
+	hits := []Hit{
+		{
+			Timestamp:         1654041600,
+			IdentifierCurrent: []byte("abcdefgh"),
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              "/",
+			ReferrerDomain:    sql.NullString{String: "www.google.com", Valid: true},
+		},
+		{
+			Timestamp: 1654041660,
+			UserAgent: "Googlebot/2.1 (+http://www.google.com/bot.html)",
+			Event:     PageLoad,
+			Domain:    "example.com",
+			Path:      "/about",
+		},
+	}
+	require.NoError(t, sink.WriteBatch(context.Background(), hits))
+	require.NoError(t, sink.WriteBatch(context.Background(), hits[:1]))
+
+	// The table is only created, and given the columns added since, before the first batch
+	require.Len(t, queries, 4)
+	assert.Contains(t, queries[0], "CREATE TABLE IF NOT EXISTS hits")
+	assert.Equal(t, clickhouseAddTitle, queries[1])
+	assert.Equal(t, "INSERT INTO hits FORMAT JSONEachRow", queries[2])
+
+	require.Len(t, rows, 3)
+	assert.Equal(t, float64(1654041600), rows[0]["timestamp"])
+	assert.Equal(t, "example.com", rows[0]["site"])
+	assert.Equal(t, "l", rows[0]["event"])
+	assert.Equal(t, "www.google.com", rows[0]["referrer_domain"])
+	assert.Nil(t, rows[0]["keyword"])
+	assert.Equal(t, "Firefox", rows[0]["browser_name"])
+	assert.Equal(t, float64(isbot.NoBotNoMatch), rows[0]["bot"])
+	assert.Equal(t, []interface{}{}, rows[0]["goals"])
+	assert.NotZero(t, rows[0]["visitor"])
+	assert.Equal(t, float64(isbot.UserAgent(hits[1].UserAgent)), rows[1]["bot"])
+	assert.GreaterOrEqual(t, rows[1]["bot"], float64(2))
+}
@@ -0,0 +1,436 @@
+package sheepcount
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The dashboard and API queries, of SQLite or, with storage = "clickhouse", of the ClickHouse server
+// that the hits are stored in, whose client is returned too.
+func (config *Config) newQueries(db *sql.DB) (Queries, *clickhouseClient, error) {
+	if err := config.validateStorage(); err != nil {
+		return nil, nil, err
+	}
+
+	if !config.clickhouseStorage() {
+		queries, err := NewQueries(db)
+		return queries, nil, err
+	}
+
+	groups, err := referrerGroups(config.ReferrerGroups)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Queries are interrupted after query_timeout by their context instead
+	client := newClickhouseClient(config.ClickHouse, 0)
+	queries, err := NewClickhouseQueries(client, db, groups)
+	return queries, client, err
+}
+
+// The queries of db/queries for ClickHouse storage. Each has an equivalent in db/clickhouse/queries
+// that counts the same things from the hits table in ClickHouse, with the same manifest and so the
+// same parameters, which it uses as ClickHouse query parameters such as {site:String}. The period is
+// converted by bindPeriod as for SQLite, and the referrer groups are given to the queries that use
+// them as the arrays {group_domains:Array(String)} and {group_names:Array(String)}.
+type ClickhouseQueries map[string]*clickhouseQuery
+
+func (queries ClickhouseQueries) Get(name string) (Query, error) {
+	query, ok := queries[name]
+	if ok {
+		return query, nil
+	}
+
+	return nil, ErrQueryNotFound
+}
+
+var clickhouseParameterRegexp = regexp.MustCompile(`\{([a-z_]+):`)
+
+func NewClickhouseQueries(client *clickhouseClient, db *sql.DB, groups map[string]string) (ClickhouseQueries, error) {
+	entries, err := fs.ReadDir(contentFs, "db/queries")
+	if err != nil {
+		return nil, err
+	}
+
+	// The domains of the groups, longest first so that the first that a referrer is or is a subdomain
+	// of is the most specific, and their names at the same indexes
+	domains := make([]string, 0, len(groups))
+	for domain := range groups {
+		domains = append(domains, domain)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		if len(domains[i]) != len(domains[j]) {
+			return len(domains[i]) > len(domains[j])
+		}
+		return domains[i] < domains[j]
+	})
+	names := make([]string, len(domains))
+	for i, domain := range domains {
+		names[i] = groups[domain]
+	}
+	groupParams := url.Values{
+		"param_group_domains": {clickhouseArray(domains)},
+		"param_group_names":   {clickhouseArray(names)},
+	}
+
+	queries := make(ClickhouseQueries)
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+
+		sqliteQuery, err := fs.ReadFile(contentFs, path.Join("db", "queries", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		manifestData, err := fs.ReadFile(contentFs, path.Join("db", "queries", name+".toml"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read manifest of %s: %w", name, err)
+		}
+		manifest, err := parseQueryManifest(string(manifestData), string(sqliteQuery))
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest of %s: %w", name, err)
+		}
+
+		query, err := fs.ReadFile(contentFs, path.Join("db", "clickhouse", "queries", entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("%s has no clickhouse query: %w", name, err)
+		}
+		parameters, err := clickhouseQueryParameters(string(query), manifest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid clickhouse query %s: %w", name, err)
+		}
+
+		params := url.Values{}
+		for name, values := range groupParams {
+			if parameters[strings.TrimPrefix(name, "param_")] {
+				params[name] = values
+			}
+		}
+
+		queries[name] = &clickhouseQuery{
+			name:       name,
+			query:      string(query),
+			parameters: parameters,
+			manifest:   manifest,
+			params:     params,
+			client:     client,
+			db:         db,
+		}
+	}
+
+	return queries, nil
+}
+
+// The names of the parameters of a ClickHouse query, which are checked against its manifest as
+// parseQueryManifest checks the SQLite query.
+func clickhouseQueryParameters(query string, manifest *queryManifest) (map[string]bool, error) {
+	used := make(map[string]bool)
+	for _, match := range clickhouseParameterRegexp.FindAllStringSubmatch(sqlCommentRegexp.ReplaceAllString(query, ""), -1) {
+		used[match[1]] = true
+	}
+
+	for name := range used {
+		switch {
+		case name == "group_domains" || name == "group_names":
+		case derivedParameters[name]:
+			if manifest.Parameters["start_date"] == nil || manifest.Parameters["end_date"] == nil {
+				return nil, fmt.Errorf("the query uses {%s} but start_date and end_date are not declared", name)
+			}
+		case manifest.Parameters[name] == nil || periodParameters[name]:
+			return nil, fmt.Errorf("the query uses {%s} but it is not declared", name)
+		}
+	}
+	for name := range manifest.Parameters {
+		if periodParameters[name] {
+			if !used["start"] && !used["end"] && !used["days"] {
+				return nil, fmt.Errorf("%s is declared but the query has no period", name)
+			}
+			continue
+		}
+		if !used[name] {
+			return nil, fmt.Errorf("%s is declared but the query does not use it", name)
+		}
+	}
+
+	return used, nil
+}
+
+type clickhouseQuery struct {
+	name       string
+	query      string
+	parameters map[string]bool
+	manifest   *queryManifest
+	params     url.Values // The referrer groups, if the query uses them
+	client     *clickhouseClient
+	db         *sql.DB // For the annotations and language names, which are not in ClickHouse
+}
+
+func (query *clickhouseQuery) Manifest() *queryManifest {
+	return query.manifest
+}
+
+// ClickHouse returns a row per line, which are put together into the array, or the object of
+// sessions, that the SQLite query returns.
+func (query *clickhouseQuery) QueryRowContext(ctx context.Context, args ...interface{}) Row {
+	args = query.manifest.bindDefaults(args)
+
+	given := make(map[string]interface{})
+	for _, arg := range args {
+		if named, ok := arg.(sql.NamedArg); ok {
+			given[named.Name] = named.Value
+		}
+	}
+
+	params := url.Values{}
+	for name, values := range query.params {
+		params[name] = values
+	}
+	for _, arg := range bindPeriod(query.parameters, args) {
+		named, ok := arg.(sql.NamedArg)
+		if !ok {
+			return &clickhouseRow{err: errors.New("clickhouse queries only have named parameters")}
+		}
+		params.Set("param_"+named.Name, clickhouseParam(named.Value))
+	}
+
+	output, err := query.client.query(ctx, query.query, params)
+	if err != nil {
+		return &clickhouseRow{err: err}
+	}
+	rows := bytes.Split(bytes.TrimSpace(output), []byte("\n"))
+	if len(rows) == 1 && len(rows[0]) == 0 {
+		rows = nil
+	}
+
+	switch query.name {
+	case "sessions":
+		if len(rows) != 1 {
+			return &clickhouseRow{err: fmt.Errorf("sessions returned %d rows", len(rows))}
+		}
+		return &clickhouseRow{output: rows[0]}
+	case "sites":
+		output, err := clickhouseSites(rows)
+		return &clickhouseRow{output: output, err: err}
+	case "pageviews":
+		output, err := query.withAnnotations(ctx, rows, given)
+		return &clickhouseRow{output: output, err: err}
+	case "languages":
+		output, err := query.withLanguageNames(ctx, rows)
+		return &clickhouseRow{output: output, err: err}
+	default:
+		return &clickhouseRow{output: clickhouseArrayOfRows(rows)}
+	}
+}
+
+func clickhouseArrayOfRows(rows [][]byte) []byte {
+	return append(append([]byte("["), bytes.Join(rows, []byte(","))...), ']')
+}
+
+// The sites are an array of their domains.
+func clickhouseSites(rows [][]byte) ([]byte, error) {
+	domains := []string{}
+	for _, row := range rows {
+		var site struct {
+			Domain string `json:"domain"`
+		}
+		if err := json.Unmarshal(row, &site); err != nil {
+			return nil, err
+		}
+		domains = append(domains, site.Domain)
+	}
+	return json.Marshal(domains)
+}
+
+type clickhouseAnnotation struct {
+	Time string `json:"time"`
+	Text string `json:"text"`
+}
+
+type clickhousePageviews struct {
+	Date              string                 `json:"date"`
+	Pageviews         int64                  `json:"pageviews"`
+	Visitors          int64                  `json:"visitors"`
+	NewVisitors       int64                  `json:"new_visitors"`
+	ReturningVisitors int64                  `json:"returning_visitors"`
+	Annotations       []clickhouseAnnotation `json:"annotations"`
+}
+
+// The annotations of each day from SQLite, with the days that only have annotations added.
+func (query *clickhouseQuery) withAnnotations(ctx context.Context, rows [][]byte, given map[string]interface{}) ([]byte, error) {
+	counted := make(map[string]clickhousePageviews)
+	for _, row := range rows {
+		var day clickhousePageviews
+		if err := json.Unmarshal(row, &day); err != nil {
+			return nil, err
+		}
+		counted[day.Date] = day
+	}
+
+	loc := time.UTC
+	if l, ok := given["timezone"].(*time.Location); ok && l != nil {
+		loc = l
+	}
+	startDate, _ := given["start_date"].(string)
+	endDate, _ := given["end_date"].(string)
+	days, ok := localDays(startDate, endDate, loc)
+	if !ok {
+		return []byte("[]"), nil
+	}
+
+	site, _ := given["site"].(string)
+	annotations, err := dbAnnotationsBetween(ctx, query.db, site, days[0].Start, days[len(days)-1].End)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []clickhousePageviews{}
+	for _, day := range days {
+		pageviews, ok := counted[day.Date]
+		pageviews.Date = day.Date
+		pageviews.Annotations = []clickhouseAnnotation{}
+		for len(annotations) > 0 && annotations[0].timestamp < day.End {
+			pageviews.Annotations = append(pageviews.Annotations, clickhouseAnnotation{
+				Time: time.Unix(annotations[0].timestamp, 0).UTC().Format("2006-01-02T15:04:05Z"),
+				Text: annotations[0].text,
+			})
+			annotations = annotations[1:]
+		}
+
+		if ok || len(pageviews.Annotations) > 0 {
+			result = append(result, pageviews)
+		}
+	}
+
+	return json.Marshal(result)
+}
+
+type annotationAt struct {
+	timestamp int64
+	text      string
+}
+
+// The annotations of the site from start until end, in order.
+func dbAnnotationsBetween(ctx context.Context, db *sql.DB, site string, start int64, end int64) ([]annotationAt, error) {
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT timestamp, text FROM annotations
+		WHERE site_id = (SELECT site_id FROM sites WHERE domain = ?) AND timestamp >= ? AND timestamp < ?
+		ORDER BY timestamp, annotation_id`,
+		site,
+		start,
+		end,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var annotations []annotationAt
+	for rows.Next() {
+		var annotation annotationAt
+		if err := rows.Scan(&annotation.timestamp, &annotation.text); err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, annotation)
+	}
+
+	return annotations, rows.Err()
+}
+
+type clickhouseLanguage struct {
+	Language          string `json:"language"`
+	Name              string `json:"name"`
+	Visitors          int64  `json:"visitors"`
+	SecondaryVisitors int64  `json:"secondary_visitors"`
+}
+
+// The names of the languages are in SQLite. Those that it does not know are left out, as SQLite
+// only counts the languages that it knows.
+func (query *clickhouseQuery) withLanguageNames(ctx context.Context, rows [][]byte) ([]byte, error) {
+	languages := []clickhouseLanguage{}
+	for _, row := range rows {
+		var language clickhouseLanguage
+		if err := json.Unmarshal(row, &language); err != nil {
+			return nil, err
+		}
+
+		err := query.db.QueryRowContext(ctx, "SELECT name FROM languages WHERE iso_639_3 = ?", language.Language).Scan(&language.Name)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		languages = append(languages, language)
+	}
+
+	return json.Marshal(languages)
+}
+
+// A parameter value in the escaped format that ClickHouse parses them in.
+func clickhouseParam(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return `\N`
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case string:
+		return strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`).Replace(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// An array of strings as a parameter value.
+func clickhouseArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(value) + "'"
+	}
+	return "[" + strings.Join(quoted, ",") + "]"
+}
+
+// The result of a ClickHouse query as a row of JSON, as SQLite returns it.
+type clickhouseRow struct {
+	output []byte
+	err    error
+}
+
+func (row *clickhouseRow) Scan(dest ...interface{}) error {
+	if row.err != nil {
+		return row.err
+	}
+	if len(dest) != 1 {
+		return fmt.Errorf("expected 1 destination, not %d", len(dest))
+	}
+
+	switch d := dest[0].(type) {
+	case *[]byte:
+		*d = row.output
+	case *string:
+		*d = string(row.output)
+	default:
+		return fmt.Errorf("cannot scan JSON into %T", d)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClickhouseQueriesLoad(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	sqliteQueries, err := NewQueries(db)
+	require.NoError(t, err)
+
+	groups := map[string]string{"google.com": "Google", "news.google.com": "Google News", "t.co": "Twitter"}
+	queries, err := NewClickhouseQueries(newClickhouseClient(ClickHouseConfig{URL: "http://localhost:8123"}, 0), db, groups)
+	require.NoError(t, err)
+
+	// Every query has an equivalent, with the same manifest
+	require.Len(t, queries, len(sqliteQueries))
+	for name := range sqliteQueries {
+		query, err := queries.Get(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, sqliteQueries[name].Manifest(), query.Manifest(), name)
+	}
+
+	// The most specific group of a referrer is the first
+	sources := queries["referrer_sources"].params
+	assert.Equal(t, "['news.google.com','google.com','t.co']", sources.Get("param_group_domains"))
+	assert.Equal(t, "['Google News','Google','Twitter']", sources.Get("param_group_names"))
+	assert.Empty(t, queries["pages"].params)
+}
+
+func TestClickhouseQueryParameters(t *testing.T) {
+	manifest, err := parseQueryManifest(
+		"[parameters.site]\ntype = \"string\"\nrequired = true\n[parameters.start_date]\ntype = \"date\"\n[parameters.end_date]\ntype = \"date\"",
+		"SELECT :site, :start, :end",
+	)
+	require.NoError(t, err)
+
+	used, err := clickhouseQueryParameters("SELECT {site:String}, {start:Int64}, {end:Int64}", manifest)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"site": true, "start": true, "end": true}, used)
+
+	_, err = clickhouseQueryParameters("SELECT {site:String}, {start:Int64}, {path:String}", manifest)
+	assert.EqualError(t, err, "the query uses {path} but it is not declared")
+
+	_, err = clickhouseQueryParameters("SELECT {start:Int64} -- {site:String}", manifest)
+	assert.EqualError(t, err, "site is declared but the query does not use it")
+}
+
+func TestClickhouseParam(t *testing.T) {
+	assert.Equal(t, `\N`, clickhouseParam(nil))
+	assert.Equal(t, "1", clickhouseParam(true))
+	assert.Equal(t, "0", clickhouseParam(false))
+	assert.Equal(t, "1654041600", clickhouseParam(int64(1654041600)))
+	assert.Equal(t, `%50\\_off%`, clickhouseParam(likePattern("50_off")))
+	assert.Equal(t, `a\tb\nc`, clickhouseParam("a\tb\nc"))
+	assert.Equal(t, `['it\'s','a\\b']`, clickhouseArray([]string{"it's", `a\b`}))
+}
+
+func TestClickhouseQueries(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+
+	require.NoError(t, dbAddSites(ctx, db, []string{"Example.com"}))
+	_, err = dbCreateAnnotation(ctx, db, "example.com", "Launched", time.Date(2022, 6, 3, 12, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+
+	var params url.Values
+	responses := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params = r.URL.Query()
+		assert.Equal(t, "JSONEachRow", params.Get("default_format"))
+		for name, response := range responses {
+			if params.Get("query") == clickhouseQueryText(t, name) {
+				io.WriteString(w, response)
+				return
+			}
+		}
+		t.Errorf("unexpected query %s", params.Get("query"))
+	}))
+	defer server.Close()
+
+	client := newClickhouseClient(ClickHouseConfig{URL: server.URL}, 0)
+	queries, err := NewClickhouseQueries(client, db, map[string]string{})
+	require.NoError(t, err)
+
+	run := func(name string, args ...interface{}) string {
+		query, err := queries.Get(name)
+		require.NoError(t, err)
+
+		var output string
+		require.NoError(t, query.QueryRowContext(ctx, args...).Scan(&output))
+		return output
+	}
+
+	// The rows are put together into an array, with the period and the defaults as parameters
+	responses["pages"] = `{"path":"/","title":null,"pageviews":2,"visitors":1}` + "\n" + `{"path":"/about","title":"About","pageviews":1,"visitors":1}` + "\n"
+	output := run("pages", sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-01"), sql.Named("timezone", time.FixedZone("Etc/GMT-1", 3600)))
+	assert.JSONEq(t, `[{"path":"/","title":null,"pageviews":2,"visitors":1},{"path":"/about","title":"About","pageviews":1,"visitors":1}]`, output)
+	assert.Equal(t, "example.com", params.Get("param_site"))
+	assert.Equal(t, "1654038000", params.Get("param_start"))
+	assert.Equal(t, "1654124400", params.Get("param_end"))
+	assert.Equal(t, "Etc/GMT-1", params.Get("param_zone"))
+	assert.Equal(t, "0", params.Get("param_include_bots"))
+	assert.Equal(t, "100", params.Get("param_limit"))
+	assert.Equal(t, `\N`, params.Get("param_search"))
+	assert.False(t, params.Has("param_start_date"))
+
+	responses["browsers"] = ""
+	assert.Equal(t, "[]", run("browsers", sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-01")))
+
+	// The sites are an array of their domains
+	responses["sites"] = `{"domain":"example.com"}` + "\n" + `{"domain":"example.org"}` + "\n"
+	assert.JSONEq(t, `["example.com","example.org"]`, run("sites"))
+
+	// Sessions are a single object
+	responses["sessions"] = `{"visits":3,"bounce_rate":0.5,"average_duration":null}` + "\n"
+	assert.JSONEq(t, `{"visits":3,"bounce_rate":0.5,"average_duration":null}`, run("sessions", sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-01")))
+
+	// The annotations are added from SQLite, with the days that only have annotations
+	responses["pageviews"] = `{"date":"2022-06-01","pageviews":2,"visitors":1,"new_visitors":1,"returning_visitors":0}` + "\n"
+	output = run("pageviews", sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-04"))
+	assert.JSONEq(
+		t,
+		`[
+			{"date":"2022-06-01","pageviews":2,"visitors":1,"new_visitors":1,"returning_visitors":0,"annotations":[]},
+			{"date":"2022-06-03","pageviews":0,"visitors":0,"new_visitors":0,"returning_visitors":0,"annotations":[
+				{"time":"2022-06-03T12:00:00Z","text":"Launched"}
+			]}
+		]`,
+		output,
+	)
+
+	// Languages that SQLite does not know are left out
+	responses["languages"] = `{"language":"eng","visitors":2,"secondary_visitors":0}` + "\n" + `{"language":"xyz","visitors":1,"secondary_visitors":0}` + "\n"
+	output = run("languages", sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-01"))
+	assert.JSONEq(t, `[{"language":"eng","name":"English","visitors":2,"secondary_visitors":0}]`, output)
+
+	// Errors from ClickHouse are returned by Scan
+	server.Close()
+	client.client.RetryWaitMax = time.Millisecond
+	query, err := queries.Get("browsers")
+	require.NoError(t, err)
+	var ignored string
+	assert.Error(t, query.QueryRowContext(ctx, sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-01")).Scan(&ignored))
+}
+
+func clickhouseQueryText(t *testing.T, name string) string {
+	query, err := contentFs.Open("db/clickhouse/queries/" + name + ".sql")
+	require.NoError(t, err)
+	defer query.Close()
+
+	text, err := io.ReadAll(query)
+	require.NoError(t, err)
+	return string(text)
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/james-atkins/sheepcount"
+)
+
+func main() {
+	if err := sheepcount.Execute(); err != nil {
+		log.Printf("%+v", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,157 @@
+package sheepcount
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+)
+
+// Run the command given on the command line, as the sheepcount binary does. An error means that
+// SheepCount should exit with a non-zero status, such as when the configuration or database is
+// invalid or it cannot listen, so that service managers and scripts can tell that it failed.
+func Execute() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Exit on Ctrl-C
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+
+	defer func() {
+		signal.Stop(signalChan)
+		close(signalChan)
+	}()
+
+	go func() {
+		// First signal: exit gracefully
+		select {
+		case <-signalChan:
+			log.Print("Exiting...")
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+
+		// Second signal: force exit
+		_, ok := <-signalChan
+		if ok {
+			os.Exit(1)
+		}
+	}()
+
+	var configPath string
+	var databasePath string
+
+	var port int
+	var socket string
+
+	cmd := cobra.Command{
+		Use: "sheepcount",
+		// Errors are logged by main, and are not caused by misuse of the flags
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config := DefaultConfig()
+
+			if _, err := toml.DecodeFile(configPath, &config); err != nil {
+				return fmt.Errorf("cannot read configuration: %w", err)
+			}
+
+			if err := config.Telemetry.validate(); err != nil {
+				return err
+			}
+			shutdownTelemetry, err := startTelemetry(ctx, &config.Telemetry)
+			if err != nil {
+				return fmt.Errorf("cannot start telemetry: %w", err)
+			}
+			defer func() {
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				if err := shutdownTelemetry(shutdownCtx); err != nil {
+					log.Printf("Cannot export telemetry: %s", err)
+				}
+			}()
+
+			sheepcount, err := New(databasePath, config)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := sheepcount.Close(); err != nil {
+					log.Print(err)
+				}
+			}()
+
+			var sockets []net.Listener
+			if len(sheepcount.Listeners) > 0 {
+				if cmd.Flags().Changed("port") || cmd.Flags().Changed("socket") {
+					return errors.New("--port and --socket cannot be given with listeners in the configuration")
+				}
+
+				// Whether the proxy headers are trusted and TLS is used depends on each listener
+				sockets, err = listenAll(sheepcount.Listeners)
+			} else {
+				var l net.Listener
+				if socket != "" {
+					l, err = listenUnix(socket, &sheepcount.Socket)
+					if err != nil {
+						return err
+					}
+
+					sheepcount.AllowLocalhost = false
+					sheepcount.ReverseProxy = true
+				} else if sheepcount.TLS.Enabled() {
+					// Serve HTTPS directly without a reverse proxy
+					l, err = net.Listen("tcp", sheepcount.TLS.Address)
+					sheepcount.AllowLocalhost = false
+					sheepcount.ReverseProxy = false
+				} else {
+					l, err = net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+					sheepcount.AllowLocalhost = true
+				}
+				sockets = []net.Listener{l}
+			}
+			if err != nil {
+				return fmt.Errorf("cannot listen: %w", err)
+			}
+
+			// Exiting after a signal is a success
+			if err := sheepcount.Run(ctx, sockets); err != nil && !errors.Is(err, context.Canceled) {
+				return err
+			}
+			return nil
+		},
+	}
+
+	cmd.PersistentFlags().StringVar(&configPath, "config", "sheepcount.toml", "Path to configuration file")
+	cmd.PersistentFlags().StringVar(&databasePath, "database", "sheepcount.sqlite3", "Path to database")
+	cmd.PersistentFlags().IntVar(&port, "port", 4444, "Port to listen on")
+	cmd.PersistentFlags().StringVar(&socket, "socket", "", "Socket to listen on")
+
+	cmd.AddCommand(newExportCommand(&databasePath))
+	cmd.AddCommand(newTokenCommand(&databasePath))
+	cmd.AddCommand(newAdminCommand(&databasePath))
+	cmd.AddCommand(newUserCommand(&databasePath))
+	cmd.AddCommand(newReportCommand(&configPath, &databasePath))
+	cmd.AddCommand(newStatsCommand(&configPath, &databasePath))
+	cmd.AddCommand(newCheckCommand(&configPath, &databasePath))
+	cmd.AddCommand(newBackupCommand(&databasePath))
+	cmd.AddCommand(newGCCommand(&databasePath))
+	cmd.AddCommand(newMaintenanceCommand(&databasePath))
+	cmd.AddCommand(newDeleteUserCommand(&configPath, &databasePath))
+	cmd.AddCommand(newAnonymizeCommand(&databasePath))
+	cmd.AddCommand(newImportCommand(&configPath, &databasePath))
+
+	return cmd.ExecuteContext(ctx)
+}
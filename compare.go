@@ -0,0 +1,100 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The dates of the period to compare start_date to end_date (inclusive) with. The previous period
+// is the same number of days immediately before, and year is the same dates in the previous year.
+func comparisonDates(compare string, startDate string, endDate string) (string, string, error) {
+	start, err := time.Parse("2006-01-02", startDate)
+	if err != nil {
+		return "", "", err
+	}
+	end, err := time.Parse("2006-01-02", endDate)
+	if err != nil {
+		return "", "", err
+	}
+	if end.Before(start) {
+		return "", "", fmt.Errorf("end date %s is before start date %s", endDate, startDate)
+	}
+
+	switch compare {
+	case "previous":
+		days := int(end.Sub(start).Hours() / 24)
+		end = start.AddDate(0, 0, -1)
+		start = end.AddDate(0, 0, -days)
+	case "year":
+		start = start.AddDate(-1, 0, 0)
+		end = end.AddDate(-1, 0, 0)
+	default:
+		return "", "", fmt.Errorf("invalid comparison: %s", compare)
+	}
+
+	return start.Format("2006-01-02"), end.Format("2006-01-02"), nil
+}
+
+// Both series of a query run with a comparison period.
+type comparison struct {
+	Current             json.RawMessage `json:"current"`
+	Comparison          json.RawMessage `json:"comparison"`
+	ComparisonStartDate string          `json:"comparison_start_date"`
+	ComparisonEndDate   string          `json:"comparison_end_date"`
+}
+
+// Run the query for the dates in args and again for the comparison period, returning both in one
+// JSON document.
+func queryWithComparison(ctx context.Context, query Query, compare string, args []interface{}) ([]byte, error) {
+	var startDate, endDate string
+	for _, arg := range args {
+		if named, ok := arg.(sql.NamedArg); ok {
+			switch named.Name {
+			case "start_date":
+				startDate, _ = named.Value.(string)
+			case "end_date":
+				endDate, _ = named.Value.(string)
+			}
+		}
+	}
+	if startDate == "" || endDate == "" {
+		return nil, BadInput(errors.New("a comparison needs a start_date and end_date"))
+	}
+
+	comparisonStart, comparisonEnd, err := comparisonDates(compare, startDate, endDate)
+	if err != nil {
+		return nil, BadInput(err)
+	}
+
+	comparisonArgs := make([]interface{}, len(args))
+	for i, arg := range args {
+		if named, ok := arg.(sql.NamedArg); ok {
+			switch named.Name {
+			case "start_date":
+				arg = sql.Named("start_date", comparisonStart)
+			case "end_date":
+				arg = sql.Named("end_date", comparisonEnd)
+			}
+		}
+		comparisonArgs[i] = arg
+	}
+
+	var current, previous []byte
+	if err := query.QueryRowContext(ctx, args...).Scan(&current); err != nil {
+		return nil, err
+	}
+	if err := query.QueryRowContext(ctx, comparisonArgs...).Scan(&previous); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(comparison{
+		Current:             current,
+		Comparison:          previous,
+		ComparisonStartDate: comparisonStart,
+		ComparisonEndDate:   comparisonEnd,
+	})
+}
@@ -0,0 +1,33 @@
+package sheepcount
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComparisonDates(t *testing.T) {
+	tests := []struct {
+		compare    string
+		start, end string
+		want       [2]string
+	}{
+		{"previous", "2022-06-08", "2022-06-14", [2]string{"2022-06-01", "2022-06-07"}},
+		{"previous", "2022-06-01", "2022-06-01", [2]string{"2022-05-31", "2022-05-31"}},
+		{"previous", "2022-03-01", "2022-03-31", [2]string{"2022-01-29", "2022-02-28"}},
+		{"year", "2022-06-08", "2022-06-14", [2]string{"2021-06-08", "2021-06-14"}},
+	}
+
+	for _, test := range tests {
+		start, end, err := comparisonDates(test.compare, test.start, test.end)
+		if assert.NoError(t, err) {
+			assert.Equal(t, test.want, [2]string{start, end}, "%s %s to %s", test.compare, test.start, test.end)
+		}
+	}
+
+	_, _, err := comparisonDates("decade", "2022-06-08", "2022-06-14")
+	assert.Error(t, err)
+
+	_, _, err = comparisonDates("previous", "2022-06-14", "2022-06-08")
+	assert.Error(t, err)
+}
@@ -0,0 +1,109 @@
+package sheepcount
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// Responses smaller than this are sent as they are, as compressing them saves little or nothing.
+const minCompressSize = 1024
+
+// Middleware to compress responses with gzip if the client accepts it. The handler does not need to
+// know: the ETag of a compressed response has -gz added, as it is a different representation, and
+// is removed from If-None-Match so that the handler sees the ETag that it set.
+func gzipResponse(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !acceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip") || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		if inm := r.Header.Get("If-None-Match"); strings.Contains(inm, `-gz"`) {
+			gw.gzipTag = true
+			r.Header.Set("If-None-Match", strings.ReplaceAll(inm, `-gz"`, `"`))
+		}
+		defer gw.Close()
+
+		next.ServeHTTP(gw, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	gz      *gzip.Writer
+	started bool
+	gzipTag bool // The client asked whether its compressed copy is fresh
+}
+
+func (gw *gzipResponseWriter) WriteHeader(status int) {
+	if !gw.started {
+		gw.status = status
+	}
+}
+
+// Hold on to the start of the body until it is clear whether it is worth compressing.
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	if gw.started {
+		if gw.gz != nil {
+			return gw.gz.Write(b)
+		}
+		return gw.ResponseWriter.Write(b)
+	}
+
+	gw.buf = append(gw.buf, b...)
+	if len(gw.buf) >= minCompressSize {
+		if err := gw.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Send the headers and the body so far, compressed if it is large enough, has not already been
+// encoded and is of a type that compresses well.
+func (gw *gzipResponseWriter) start(large bool) error {
+	gw.started = true
+	h := gw.Header()
+
+	compress := large && gw.status == http.StatusOK && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type"))
+	if compress {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	}
+	if compress || (gw.status == http.StatusNotModified && gw.gzipTag) {
+		if etag := h.Get("ETag"); strings.HasSuffix(etag, `"`) {
+			h.Set("ETag", strings.TrimSuffix(etag, `"`)+`-gz"`)
+		}
+	}
+
+	gw.ResponseWriter.WriteHeader(gw.status)
+
+	buf := gw.buf
+	gw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := gw.Write(buf)
+	return err
+}
+
+func (gw *gzipResponseWriter) Close() error {
+	if !gw.started {
+		if err := gw.start(false); err != nil {
+			return err
+		}
+	}
+	if gw.gz != nil {
+		return gw.gz.Close()
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package sheepcount
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGzipResponse(t *testing.T) {
+	large := strings.Repeat("console.log('baa');\n", 100)
+
+	handler := gzipResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := large
+		if r.URL.Path == "/small" {
+			body = "{}"
+		}
+
+		if r.Header.Get("If-None-Match") == `"abc"` {
+			w.Header().Set("ETag", `"abc"`)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Header().Set("ETag", `"abc"`)
+		w.Write([]byte(body))
+	}))
+
+	get := func(path string, acceptEncoding string, ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/large", "gzip", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Equal(t, `"abc-gz"`, w.Header().Get("ETag"))
+	reader, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, large, string(b))
+
+	// The compressed copy is revalidated with its own ETag
+	w = get("/large", "gzip", `"abc-gz"`)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, `"abc-gz"`, w.Header().Get("ETag"))
+	assert.Empty(t, w.Body.String())
+
+	// Without gzip
+	w = get("/large", "", "")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Equal(t, `"abc"`, w.Header().Get("ETag"))
+	assert.Equal(t, large, w.Body.String())
+
+	w = get("/large", "gzip", `"abc"`)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, `"abc"`, w.Header().Get("ETag"))
+
+	// Small responses are not worth compressing
+	w = get("/small", "gzip", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, `"abc"`, w.Header().Get("ETag"))
+	assert.Equal(t, "{}", w.Body.String())
+}
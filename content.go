@@ -1,6 +1,6 @@
 //go:build !development
 
-package main
+package sheepcount
 
 import (
 	"database/sql"
@@ -11,6 +11,7 @@ import (
 	"io/fs"
 	"path"
 	"strings"
+	"sync"
 )
 
 //go:embed static
@@ -35,7 +36,7 @@ func NewTemplates() (TemplateMap, error) {
 	fs.WalkDir(contentFs, "tmpl", func(templatePath string, d fs.DirEntry, err error) error {
 		name := path.Base(templatePath)
 		if name != "tmpl/base.html.tmpl" && strings.HasSuffix(name, ".tmpl") {
-			t, err := template.ParseFS(contentFs, "tmpl/base.html.tmpl", path.Join("tmpl", name))
+			t, err := template.New(name).Funcs(templateFuncs).ParseFS(contentFs, "tmpl/base.html.tmpl", path.Join("tmpl", name))
 			if err != nil {
 				return err
 			}
@@ -48,20 +49,34 @@ func NewTemplates() (TemplateMap, error) {
 	return tmpls, nil
 }
 
-type PreparedQueries map[string]*sql.Stmt
+var embeddedStatic struct {
+	sync.Once
+	assets *staticAssets
+	err    error
+}
+
+// The static files are embedded, so they are only hashed and compressed once.
+func NewStaticAssets() (*staticAssets, error) {
+	embeddedStatic.Do(func() {
+		embeddedStatic.assets, embeddedStatic.err = loadStaticAssets(contentFs)
+	})
+	return embeddedStatic.assets, embeddedStatic.err
+}
+
+type PreparedQueries map[string]*preparedQuery
 
 func (queries PreparedQueries) Get(name string) (Query, error) {
-	stmt, ok := queries[name]
+	query, ok := queries[name]
 	if ok {
-		return stmt, nil
+		return query, nil
 	}
 
 	return nil, ErrQueryNotFound
 }
 
 func (queries PreparedQueries) Close() error {
-	for _, stmt := range queries {
-		if err := stmt.Close(); err != nil {
+	for _, query := range queries {
+		if err := query.stmt.Close(); err != nil {
 			return err
 		}
 	}
@@ -95,12 +110,21 @@ func NewQueries(db *sql.DB) (PreparedQueries, error) {
 			return nil, err
 		}
 
+		manifestData, err := contentFs.ReadFile(strings.TrimSuffix(fpath, ".sql") + ".toml")
+		if err != nil {
+			return nil, fmt.Errorf("cannot read manifest of %s: %w", name, err)
+		}
+		manifest, err := parseQueryManifest(string(manifestData), string(query))
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest of %s: %w", name, err)
+		}
+
 		stmt, err := db.Prepare(string(query))
 		if err != nil {
 			return nil, fmt.Errorf("cannot prepare statement: %w", err)
 		}
 
-		stmts[name] = stmt
+		stmts[name] = &preparedQuery{db: db, stmt: stmt, parameters: queryParameters(string(query)), manifest: manifest}
 	}
 
 	return stmts, nil
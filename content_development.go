@@ -1,11 +1,12 @@
 //go:build development
 
-package main
+package sheepcount
 
 import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"html/template"
 	"io"
 	"io/fs"
@@ -26,7 +27,7 @@ func NewTemplates() (DiskTemplates, error) {
 }
 
 func (templates DiskTemplates) ExecuteTemplate(wr io.Writer, name string, data interface{}) error {
-	tmpl, err := template.ParseFiles("tmpl/base.html.tmpl", path.Join("tmpl", name))
+	tmpl, err := template.New(name).Funcs(templateFuncs).ParseFiles("tmpl/base.html.tmpl", path.Join("tmpl", name))
 	if err != nil {
 		return err
 	}
@@ -34,6 +35,11 @@ func (templates DiskTemplates) ExecuteTemplate(wr io.Writer, name string, data i
 	return tmpl.ExecuteTemplate(wr, name, data)
 }
 
+// The static files are read again each time so that changes to them show up without a restart.
+func NewStaticAssets() (*staticAssets, error) {
+	return loadStaticAssets(contentFs)
+}
+
 type DiskQueries struct {
 	db *sql.DB
 }
@@ -53,14 +59,33 @@ func (queries *DiskQueries) Get(name string) (Query, error) {
 		return nil, err
 	}
 
-	return &DiskQuery{db: queries.db, query: string(query)}, nil
+	manifestData, err := fs.ReadFile(contentFs, path.Join("db", "queries", name+".toml"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read manifest of %s: %w", name, err)
+	}
+	manifest, err := parseQueryManifest(string(manifestData), string(query))
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest of %s: %w", name, err)
+	}
+
+	return &DiskQuery{db: queries.db, query: string(query), manifest: manifest}, nil
 }
 
 type DiskQuery struct {
-	db    *sql.DB
-	query string
+	db       *sql.DB
+	query    string
+	manifest *queryManifest
+}
+
+func (query *DiskQuery) QueryRowContext(ctx context.Context, args ...interface{}) Row {
+	parameters := queryParameters(query.query)
+	args = query.manifest.bindDefaults(args)
+	if err := checkHourlyPeriod(ctx, query.db, parameters, args); err != nil {
+		return errRow{err}
+	}
+	return query.db.QueryRowContext(ctx, query.query, bindPeriod(parameters, args)...)
 }
 
-func (query *DiskQuery) QueryRowContext(ctx context.Context, args ...interface{}) *sql.Row {
-	return query.db.QueryRowContext(ctx, query.query, args...)
+func (query *DiskQuery) Manifest() *queryManifest {
+	return query.manifest
 }
@@ -0,0 +1,79 @@
+package sheepcount
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long browsers can cache the answer to a preflight request.
+const corsMaxAge = 24 * time.Hour
+
+func validateCORSOrigins(origins []string) error {
+	for _, origin := range origins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return fmt.Errorf("invalid cors origin: %s", origin)
+		}
+	}
+	return nil
+}
+
+// Can pages on the origin send events? By default, pages of the configured domains can, over HTTP
+// or HTTPS and on any port.
+func (sheepcount *SheepCount) allowedOrigin(origin string, allowLocalhost bool) bool {
+	if len(sheepcount.CORSOrigins) > 0 {
+		for _, allowed := range sheepcount.CORSOrigins {
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+		return false
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return false
+	}
+
+	return sheepcount.allowedDomain(strings.ToLower(u.Hostname()), allowLocalhost)
+}
+
+// Set the CORS headers of a response to the event endpoint, and say whether the origin of the
+// request can send events. Requests without an origin are not from browsers, or are from the same
+// origin, so CORS does not apply to them.
+func (sheepcount *SheepCount) cors(w http.ResponseWriter, r *http.Request) bool {
+	// Responses depend on the origin, so must not be cached for a different one
+	w.Header().Add("Vary", "Origin")
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if !sheepcount.allowedOrigin(origin, sheepcount.listenerOptions(r).allowLocalhost) {
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	return true
+}
+
+// Answer the preflight request that browsers make before sending events that are not simple
+// requests, such as those with a JSON content type.
+func handlePreflight(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	if !sheepcount.cors(w, r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+	w.WriteHeader(http.StatusNoContent)
+}
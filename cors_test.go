@@ -0,0 +1,60 @@
+package sheepcount
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORS(t *testing.T) {
+	config := DefaultConfig()
+	config.Domains = []string{"example.com"}
+	sheepcount := &SheepCount{Config: config}
+
+	request := func(method string, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "http://stats.example.com/event", strings.NewReader("{"))
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		w := httptest.NewRecorder()
+		handleEvent(sheepcount, nil, w, r)
+		return w
+	}
+
+	// Preflight
+	w := request(http.MethodOptions, "https://example.com")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Origin", w.Header().Get("Vary"))
+	assert.Equal(t, "86400", w.Header().Get("Access-Control-Max-Age"))
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), http.MethodPost)
+
+	w = request(http.MethodOptions, "https://example.org")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// Events from other sites are refused before they are parsed
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "https://example.org").Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "null").Code)
+	w = request(http.MethodPost, "http://example.com:8080")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "http://example.com:8080", w.Header().Get("Access-Control-Allow-Origin"))
+	w = request(http.MethodPost, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// The origins can be configured instead
+	sheepcount.CORSOrigins = []string{"https://www.example.net"}
+	assert.True(t, sheepcount.allowedOrigin("https://www.example.net", false))
+	assert.False(t, sheepcount.allowedOrigin("https://example.com", false))
+	sheepcount.CORSOrigins = []string{"*"}
+	assert.True(t, sheepcount.allowedOrigin("https://example.com", false))
+
+	assert.NoError(t, validateCORSOrigins([]string{"*", "https://example.com", "http://localhost:3000"}))
+	assert.Error(t, validateCORSOrigins([]string{"example.com"}))
+	assert.Error(t, validateCORSOrigins([]string{"https://example.com/"}))
+}
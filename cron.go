@@ -0,0 +1,154 @@
+package sheepcount
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A schedule in the standard five field cron format: minute, hour, day of month, month and day of
+// week. Each field may be *, a number, a range (1-5), a list (1,3,5) or have a step (*/15, 0-30/10).
+// Sundays are 0 or 7. As in cron, if both the day of month and day of week are restricted then a
+// time matches if either does.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+var cronShortcuts = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	if shortcut, ok := cronShortcuts[expr]; ok {
+		expr = shortcut
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: expected five fields", expr)
+	}
+
+	var schedule cronSchedule
+	var err error
+
+	if schedule.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("invalid minute in schedule %q: %w", expr, err)
+	}
+	if schedule.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("invalid hour in schedule %q: %w", expr, err)
+	}
+	if schedule.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("invalid day of month in schedule %q: %w", expr, err)
+	}
+	if schedule.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("invalid month in schedule %q: %w", expr, err)
+	}
+	if schedule.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("invalid day of week in schedule %q: %w", expr, err)
+	}
+
+	// Sunday can be either 0 or 7
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+
+	schedule.domStar = fields[2] == "*"
+	schedule.dowStar = fields[4] == "*"
+
+	return &schedule, nil
+}
+
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step: %s", part)
+			}
+			part = part[:i]
+		}
+
+		start, end := min, max
+		if part != "*" {
+			if i := strings.Index(part, "-"); i >= 0 {
+				var err1, err2 error
+				start, err1 = strconv.Atoi(part[:i])
+				end, err2 = strconv.Atoi(part[i+1:])
+				if err1 != nil || err2 != nil {
+					return 0, fmt.Errorf("invalid range: %s", part)
+				}
+			} else {
+				var err error
+				if start, err = strconv.Atoi(part); err != nil {
+					return 0, fmt.Errorf("invalid value: %s", part)
+				}
+				end = start
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("out of range: %s", part)
+		}
+
+		for i := start; i <= end; i += step {
+			bits |= 1 << i
+		}
+	}
+
+	return bits, nil
+}
+
+func (schedule *cronSchedule) matchesDay(t time.Time) bool {
+	dom := schedule.dom&(1<<t.Day()) != 0
+	dow := schedule.dow&(1<<t.Weekday()) != 0
+
+	switch {
+	case schedule.domStar && schedule.dowStar:
+		return true
+	case schedule.domStar:
+		return dow
+	case schedule.dowStar:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// The first time after t that matches the schedule, in the location of t.
+func (schedule *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// Every valid schedule matches at least once in a few years
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if schedule.month&(1<<t.Month()) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !schedule.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if schedule.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if schedule.minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,40 @@
+package sheepcount
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCron(t *testing.T) {
+	// Wednesday 1 June 2022 12:30
+	now := time.Date(2022, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		schedule string
+		next     time.Time
+	}{
+		{"* * * * *", time.Date(2022, 6, 1, 12, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2022, 6, 1, 12, 45, 0, 0, time.UTC)},
+		{"0 8 * * 1", time.Date(2022, 6, 6, 8, 0, 0, 0, time.UTC)},
+		{"0 8 * * 7", time.Date(2022, 6, 5, 8, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 9 1,15 * *", time.Date(2022, 6, 15, 9, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2022, 6, 3, 0, 0, 0, 0, time.UTC)}, // Day of month or day of week
+	}
+
+	for _, test := range tests {
+		schedule, err := parseCron(test.schedule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, test.next, schedule.Next(now), test.schedule)
+	}
+
+	for _, invalid := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *"} {
+		_, err := parseCron(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
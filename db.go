@@ -1,22 +1,32 @@
-package main
+package sheepcount
 
 import (
 	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/fs"
 	"log"
+	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"golang.org/x/sync/errgroup"
 	"zgo.at/gadget"
 	"zgo.at/isbot"
 )
 
-func DatabaseWriter(ctx context.Context, db *sql.DB, hitC <-chan Hit) error {
+// Batches that cannot be written are saved to the spool and retried by the recovery goroutine. The
+// locations of hits are looked up here, off the request path, before they are written or spooled,
+// and the batches are then sent to the other sinks too. Hits are written to ClickHouse instead of
+// the database if there is a client for it.
+func DatabaseWriter(ctx context.Context, db *sql.DB, clickhouse *clickhouseClient, spool *Spool, hitC <-chan Hit, geo *GeoIP, rules *geoRules, gcInterval time.Duration, sinks []Sink) error {
 	errgrp, ctx := errgroup.WithContext(ctx)
 
 	// Writing each hit one-by-one can be slow. So instead, batch them and then
@@ -62,57 +72,213 @@ func DatabaseWriter(ctx context.Context, db *sql.DB, hitC <-chan Hit) error {
 		}
 	})
 
+	// Each of the other sinks is written to by a goroutine of its own
+	sinkCs := make([]chan []Hit, len(sinks))
+	for i, sink := range sinks {
+		sink, c := sink, make(chan []Hit, sinkBacklog)
+		sinkCs[i] = c
+		errgrp.Go(func() error {
+			defer sink.Close()
+			runSink(sink, c)
+			return nil
+		})
+	}
+
 	errgrp.Go(func() error {
-		// Grab a connection from the pool and keep it for the whole life of the goroutine
-		conn, err := db.Conn(ctx)
-		if err != nil {
-			return err
+		defer func() {
+			for _, c := range sinkCs {
+				close(c)
+			}
+		}()
+
+		// Grab a connection from the pool and keep it for the whole life of the goroutine. It is
+		// grabbed even if we are already shutting down, as the batches are still sent here.
+		var database Sink
+		var sqlite *sqliteSink
+		if clickhouse != nil {
+			database = &spooledSink{sink: &clickhouseSink{client: clickhouse}, spool: spool}
+		} else {
+			var err error
+			if sqlite, err = newSQLiteSink(context.Background(), db, spool); err != nil {
+				return err
+			}
+			database = sqlite
+		}
+		defer database.Close()
+
+		// Garbage is collected here, between batches, so that the writer never uses the cached ID
+		// of a row that has just been deleted. ClickHouse has no dimension rows to collect.
+		var gcC <-chan time.Time
+		if gcInterval > 0 && sqlite != nil {
+			ticker := time.NewTicker(gcInterval)
+			defer ticker.Stop()
+			gcC = ticker.C
 		}
-		defer conn.Close()
-
-		// TODO: prepared statements
 
 		// When ctx.Done() closes, the above goroutine sends any remaining batched hits
 		// to the channel and then closes it. So there is no need to select on ctx.Done()
 		// here too.
 		// Note: As we want to write hits to the database even when we are shutting down, we use
 		// the background context in all database function calls.
-		for hits := range hitsC {
-			err := func() error {
-				tx, err := conn.BeginTx(context.Background(), nil)
-				if err != nil {
-					return err
+		for {
+			select {
+			case hits, ok := <-hitsC:
+				if !ok {
+					return nil
 				}
-				defer tx.Rollback()
-
-				// In WAL mode, if we start a transaction and run a SELECT followed by an INSERT, SQLite will
-				// immediately report a locked database error if there is already another write transaction.
-				// As we know that we are going to insert data, let's always start the transaction in IMMEDIATE
-				// mode. This works around this known bug: https://github.com/mattn/go-sqlite3/issues/400.
-				if _, err := tx.ExecContext(context.Background(), "ROLLBACK; BEGIN IMMEDIATE"); err != nil {
-					return err
+
+				start := time.Now()
+				batchCtx, span := tracer.Start(context.Background(), "DatabaseWriter batch", trace.WithAttributes(attribute.Int("hits", len(hits))))
+
+				_, geoSpan := tracer.Start(batchCtx, "GeoIP lookup")
+				hits = resolveLocations(hits, geo, rules)
+				geoSpan.End()
+				if len(hits) == 0 {
+					span.End()
+					continue
 				}
 
-				for _, hit := range hits {
-					if err := dbInsertHit(context.Background(), tx, &hit); err != nil {
-						return err
+				for i, c := range sinkCs {
+					select {
+					case c <- hits:
+					default:
+						log.Printf("Dropping %d hits, as %s has fallen behind", len(hits), sinks[i])
+						sinkDroppedHits.Add(sinks[i].String(), int64(len(hits)))
 					}
 				}
 
-				return tx.Commit()
-			}()
+				if err := database.WriteBatch(batchCtx, hits); err != nil {
+					span.RecordError(err)
+					log.Print(err)
+				}
+				span.End()
+
+				batchDuration.Record(batchCtx, milliseconds(time.Since(start)))
+				batchSize.Record(batchCtx, int64(len(hits)))
 
-			if err != nil {
-				log.Print(err)
+			case <-gcC:
+				collected, err := sqlite.collectGarbage(ctx)
+				if err != nil {
+					log.Printf("Cannot collect garbage: %s", err)
+					continue
+				}
+
+				var deleted int64
+				for _, garbage := range collected {
+					deleted += garbage.deleted
+				}
+				if deleted > 0 {
+					log.Printf("Deleted %d unused dimension rows.", deleted)
+				}
 			}
 		}
+	})
 
-		return nil
+	// Replay any spooled hits on startup, in case we crashed, and then regularly
+	errgrp.Go(func() error {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		replay := func() error {
+			return replaySpool(ctx, db, spool)
+		}
+		if clickhouse != nil {
+			replay = func() error {
+				return replaySpoolTo(ctx, &clickhouseSink{client: clickhouse}, spool)
+			}
+		}
+
+		for {
+			if err := replay(); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				log.Printf("Cannot replay spooled hits: %s", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+		}
 	})
 
 	return errgrp.Wait()
 }
 
+func replaySpool(ctx context.Context, db *sql.DB, spool *Spool) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	n, err := spool.Replay(func(hits []Hit) (int, error) {
+		err := writer.WriteBatch(ctx, conn, hits)
+		if err == nil {
+			return len(hits), nil
+		}
+		if !isConstraintError(err) {
+			return 0, err
+		}
+
+		// A hit that violates a constraint will never be written, so write the hits one at a time and
+		// drop the bad ones rather than retrying them forever. If another error stops this partway, the
+		// hits before it have been committed and must not be replayed again.
+		for i := range hits {
+			if err := writer.WriteBatch(ctx, conn, hits[i:i+1]); err != nil {
+				if !isConstraintError(err) {
+					return i, err
+				}
+				log.Printf("Dropping spooled hit: %s", err)
+			}
+		}
+
+		return len(hits), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		log.Printf("Replayed %d spooled hits.", n)
+	}
+
+	return nil
+}
+
+// Replay the spooled hits to a sink, such as ClickHouse when hits are stored there. Unlike the
+// database, it has no constraints for a hit to violate, so a batch that fails is retried later.
+func replaySpoolTo(ctx context.Context, sink Sink, spool *Spool) error {
+	n, err := spool.Replay(func(hits []Hit) (int, error) {
+		if err := sink.WriteBatch(ctx, hits); err != nil {
+			return 0, err
+		}
+		return len(hits), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		log.Printf("Replayed %d spooled hits.", n)
+	}
+
+	return nil
+}
+
+func isConstraintError(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint
+}
+
 func dbConnect(path string) (*sql.DB, error) {
 	uri := fmt.Sprintf("%s?_foreign_keys=true&_journal=WAL&_synchronous=NORMAL&__secure_delete=true&_busy_timeout=5000", path)
 
@@ -121,19 +287,25 @@ func dbConnect(path string) (*sql.DB, error) {
 		return nil, err
 	}
 
-	tx, err := db.Begin()
-	if err != nil {
+	if err := dbMigrate(context.Background(), db); err != nil {
+		db.Close()
 		return nil, err
 	}
-	defer tx.Rollback()
 
-	schema, err := fs.ReadFile(contentFs, "db/schema.sql")
+	moved, err := dbMoveTemplateHits(context.Background(), db)
 	if err != nil {
-		return nil, err
+		db.Close()
+		return nil, fmt.Errorf("cannot move hits into their months: %w", err)
+	}
+	if moved > 0 {
+		log.Printf("Moved %d hits into their months", moved)
 	}
-	if _, err := tx.Exec(string(schema)); err != nil {
+
+	tx, err := db.Begin()
+	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 
 	languages, err := fs.ReadFile(contentFs, "db/languages.sql")
 	if err != nil {
@@ -150,145 +322,670 @@ func dbConnect(path string) (*sql.DB, error) {
 	return db, nil
 }
 
-func dbInsertHit(ctx context.Context, tx *sql.Tx, hit *Hit) error {
-	// User ID
-	userId, err := dbInsertUser(ctx, tx, hit.IdentifierCurrent, hit.IdentifierPrevious)
+// Open the database read-only for the dashboard and API queries. SQLite allows any number of readers
+// alongside the writer in WAL mode, so a long report neither waits for hits to be written nor holds
+// them up. The database must already have been created and migrated by dbConnect.
+func dbConnectReadOnly(path string) (*sql.DB, error) {
+	uri := fmt.Sprintf("file:%s?mode=ro&_query_only=true&_busy_timeout=5000", path)
+
+	db, err := sql.Open("sqlite3", uri)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Path
-	var pathId int64
-	row := tx.QueryRowContext(ctx, "SELECT path_id FROM paths WHERE domain = ? AND path = ?", hit.Domain, hit.Path)
-	err = row.Scan(&pathId)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Writes hits to the database. The statements are prepared once and the IDs of rows in the
+// dimension tables (sites, paths, referrers, campaigns, targets, event names, keywords, user agents,
+// locations and displays) are cached, so most hits only need a couple of statements. Users are not
+// cached as their identifiers change. A HitWriter is not safe for concurrent use.
+type HitWriter struct {
+	stmts map[string]*sql.Stmt
+
+	sites      *lruCache
+	paths      *lruCache
+	referrers  *lruCache
+	campaigns  *lruCache
+	targets    *lruCache
+	eventNames *lruCache
+	keywords   *lruCache
+	userAgents *lruCache
+	languages  *lruCache
+	locations  *lruCache
+	displays   *lruCache
+	titles     *lruCache // A hash of the title last written to each path
+}
+
+const (
+	selectUserQuery           = "SELECT user_id, identifier FROM users WHERE identifier = ? OR identifier = ?"
+	insertUserQuery           = "INSERT INTO users (identifier, created_at) VALUES (?, ?) RETURNING user_id"
+	updateUserLastSeenQuery   = "UPDATE users SET last_seen = strftime('%s', 'now'), created_at = MIN(created_at, ?) WHERE user_id = ?"
+	updateUserIdentifierQuery = "UPDATE users SET identifier = ?, last_seen = strftime('%s', 'now'), created_at = MIN(created_at, ?) WHERE user_id = ?"
+	selectSiteQuery           = "SELECT site_id FROM sites WHERE domain = ?"
+	insertSiteQuery           = "INSERT INTO sites (domain) VALUES (?) RETURNING site_id"
+	selectPathQuery           = "SELECT path_id FROM paths WHERE site_id = ? AND path = ?"
+	insertPathQuery           = "INSERT INTO paths (site_id, path) VALUES (?, ?) RETURNING path_id"
+	updatePathTitleQuery      = "UPDATE paths SET title = ?, title_source = 'page' WHERE path_id = ? AND title IS NOT ? AND title_source IS NOT 'mapping'"
+	selectReferrerQuery       = "SELECT referrer_id FROM referrers WHERE domain = ? AND path IS ?"
+	insertReferrerQuery       = "INSERT INTO referrers (domain, path) VALUES (?, ?) RETURNING referrer_id"
+	selectCampaignQuery       = "SELECT campaign_id FROM campaigns WHERE source IS ? AND medium IS ? AND campaign IS ? AND term IS ? AND content IS ?"
+	insertCampaignQuery       = "INSERT INTO campaigns (source, medium, campaign, term, content) VALUES (?, ?, ?, ?, ?) RETURNING campaign_id"
+	selectTargetQuery         = "SELECT target_id FROM targets WHERE url = ?"
+	insertTargetQuery         = "INSERT INTO targets (url) VALUES (?) RETURNING target_id"
+	selectEventNameQuery      = "SELECT event_name_id FROM event_names WHERE name = ?"
+	insertEventNameQuery      = "INSERT INTO event_names (name) VALUES (?) RETURNING event_name_id"
+	selectKeywordQuery        = "SELECT keyword_id FROM keywords WHERE keyword = ?"
+	insertKeywordQuery        = "INSERT INTO keywords (keyword) VALUES (?) RETURNING keyword_id"
+	selectUserAgentQuery      = "SELECT user_agent_id FROM user_agents WHERE user_agent = ?"
+	insertUserAgentQuery      = "INSERT INTO user_agents (user_agent, browser_id, os_id, bot) VALUES (?, ?, ?, ?) RETURNING user_agent_id"
+	selectBrowserQuery        = "SELECT browser_id FROM browsers WHERE browser_name = ? AND browser_version IS ?"
+	insertBrowserQuery        = "INSERT INTO browsers (browser_name, browser_version) VALUES (?, ?) RETURNING browser_id"
+	selectOSQuery             = "SELECT os_id FROM oss WHERE os_name = ? AND os_version IS ?"
+	insertOSQuery             = "INSERT INTO oss (os_name, os_version) VALUES (?, ?) RETURNING os_id"
+	selectLanguageQuery       = "SELECT language_id FROM languages WHERE iso_639_3 = ?"
+	selectDisplayQuery        = "SELECT display_id FROM displays WHERE screen_height = ? AND screen_width = ? AND pixel_ratio = ?"
+	insertDisplayQuery        = "INSERT INTO displays (screen_height, screen_width, pixel_ratio) VALUES (?, ?, ?) RETURNING display_id"
+	insertCountryQuery        = "INSERT INTO locations (country) VALUES (?) RETURNING location_id"
+	insertSubdivisionQuery    = "INSERT INTO locations (parent_id, subdivision) VALUES (?, ?) RETURNING location_id"
+	insertCityQuery           = "INSERT INTO locations (parent_id, city) VALUES (?, ?) RETURNING location_id"
+	insertPostalQuery         = "INSERT INTO locations (parent_id, postal) VALUES (?, ?) RETURNING location_id"
+
+	// Get the location or the nearest parent location
+	selectLocationQuery = `
+	WITH RECURSIVE
+		l(location_id, parent_id, country, subdivision, city, postal) AS (
+			SELECT location_id, parent_id, country, subdivision, city, postal FROM locations WHERE country = :country
+			UNION ALL
+			SELECT locations.location_id
+				, locations.parent_id
+				, CASE WHEN locations.country IS NOT NULL THEN locations.country ELSE l.country END
+				, CASE WHEN locations.subdivision IS NOT NULL THEN locations.subdivision ELSE l.subdivision END
+				, CASE WHEN locations.city IS NOT NULL THEN locations.city ELSE l.city END
+				, CASE WHEN locations.postal IS NOT NULL THEN locations.postal ELSE l.postal END
+			FROM locations INNER JOIN l ON locations.parent_id = l.location_id
+			WHERE (locations.subdivision IS NULL OR locations.subdivision = :subdivision OR l.subdivision = :subdivision)
+			AND   (locations.city IS NULL OR locations.city = :city OR l.city = :city)
+			AND   (locations.postal IS NULL OR locations.postal = :postal OR l.postal = :postal)
+		)
+	SELECT location_id, country, subdivision, city, postal FROM l
+	ORDER BY country NULLS LAST
+		, subdivision NULLS LAST
+		, city NULLS LAST
+		, postal NULLS LAST
+	LIMIT 1`
+
+	// The hits of each month of a batch are inserted by a single statement, from a JSON array of
+	// their rows, so that most of the transaction is spent looking up dimensions, which are mostly
+	// cached. It is not prepared as the table is that of the month.
+	insertHitsQuery = `
+	INSERT INTO %s ( hit_id
+	               , timestamp
+	               , site_id
+	               , event
+	               , user_id
+	               , user_agent_id
+	               , bot
+	               , path_id
+	               , referrer_id
+	               , location_id
+	               , language_id
+	               , secondary_language_id
+	               , display_id
+	               , device
+	               , campaign_id
+	               , target_id
+	               , event_name_id
+	               , keyword_id
+	               , scroll_depth
+	               , engaged_seconds
+	               , ttfb_ms
+	               , dom_content_loaded_ms
+	               , load_ms )
+	SELECT json_extract(value, '$.hit_id')
+	     , json_extract(value, '$.timestamp')
+	     , json_extract(value, '$.site_id')
+	     , json_extract(value, '$.event')
+	     , json_extract(value, '$.user_id')
+	     , json_extract(value, '$.user_agent_id')
+	     , json_extract(value, '$.bot')
+	     , json_extract(value, '$.path_id')
+	     , json_extract(value, '$.referrer_id')
+	     , json_extract(value, '$.location_id')
+	     , json_extract(value, '$.language_id')
+	     , json_extract(value, '$.secondary_language_id')
+	     , json_extract(value, '$.display_id')
+	     , json_extract(value, '$.device')
+	     , json_extract(value, '$.campaign_id')
+	     , json_extract(value, '$.target_id')
+	     , json_extract(value, '$.event_name_id')
+	     , json_extract(value, '$.keyword_id')
+	     , json_extract(value, '$.scroll_depth')
+	     , json_extract(value, '$.engaged_seconds')
+	     , json_extract(value, '$.ttfb_ms')
+	     , json_extract(value, '$.dom_content_loaded_ms')
+	     , json_extract(value, '$.load_ms')
+	FROM json_each(?)`
+
+	insertGoalsQuery = `
+	INSERT INTO goals (goal, hit_id)
+	SELECT json_extract(value, '$.goal'), json_extract(value, '$.hit_id') FROM json_each(?)`
+)
+
+var hitWriterQueries = []string{
+	insertSketchesQuery,
+	selectUserQuery,
+	insertUserQuery,
+	updateUserLastSeenQuery,
+	updateUserIdentifierQuery,
+	selectSiteQuery,
+	insertSiteQuery,
+	selectPathQuery,
+	insertPathQuery,
+	updatePathTitleQuery,
+	selectReferrerQuery,
+	insertReferrerQuery,
+	selectCampaignQuery,
+	insertCampaignQuery,
+	selectTargetQuery,
+	insertTargetQuery,
+	selectEventNameQuery,
+	insertEventNameQuery,
+	selectKeywordQuery,
+	insertKeywordQuery,
+	selectUserAgentQuery,
+	insertUserAgentQuery,
+	selectBrowserQuery,
+	insertBrowserQuery,
+	selectOSQuery,
+	insertOSQuery,
+	selectLanguageQuery,
+	selectDisplayQuery,
+	insertDisplayQuery,
+	insertCountryQuery,
+	insertSubdivisionQuery,
+	insertCityQuery,
+	insertPostalQuery,
+	selectLocationQuery,
+	insertGoalsQuery,
+}
+
+func NewHitWriter(ctx context.Context, db *sql.DB) (*HitWriter, error) {
+	writer := &HitWriter{
+		stmts:      make(map[string]*sql.Stmt, len(hitWriterQueries)),
+		sites:      newLRUCache(64),
+		paths:      newLRUCache(4096),
+		referrers:  newLRUCache(4096),
+		campaigns:  newLRUCache(1024),
+		targets:    newLRUCache(1024),
+		eventNames: newLRUCache(256),
+		keywords:   newLRUCache(1024),
+		userAgents: newLRUCache(4096),
+		languages:  newLRUCache(256),
+		locations:  newLRUCache(4096),
+		displays:   newLRUCache(1024),
+		titles:     newLRUCache(4096),
+	}
+
+	for _, query := range hitWriterQueries {
+		stmt, err := db.PrepareContext(ctx, query)
+		if err != nil {
+			writer.Close()
+			return nil, fmt.Errorf("cannot prepare statement: %w", err)
+		}
+		writer.stmts[query] = stmt
+	}
+
+	return writer, nil
+}
+
+func (writer *HitWriter) Close() error {
+	for _, stmt := range writer.stmts {
+		if err := stmt.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Forget all cached IDs, for example because the transaction that inserted them was rolled back.
+func (writer *HitWriter) ClearCache() {
+	for _, cache := range []*lruCache{
+		writer.sites,
+		writer.paths,
+		writer.referrers,
+		writer.campaigns,
+		writer.targets,
+		writer.eventNames,
+		writer.keywords,
+		writer.userAgents,
+		writer.languages,
+		writer.locations,
+		writer.displays,
+		writer.titles,
+	} {
+		cache.Clear()
+	}
+}
+
+func (writer *HitWriter) stmt(ctx context.Context, tx *sql.Tx, query string) *sql.Stmt {
+	stmt, ok := writer.stmts[query]
+	if !ok {
+		panic("statement has not been prepared")
+	}
+	return tx.StmtContext(ctx, stmt)
+}
+
+// Write a batch of hits in a single transaction on the given connection.
+func (writer *HitWriter) WriteBatch(ctx context.Context, conn *sql.Conn, hits []Hit) error {
+	tx, err := conn.BeginTx(ctx, nil)
 	if err != nil {
-		if err != sql.ErrNoRows {
-			return fmt.Errorf("path select error: %w", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	// In WAL mode, if we start a transaction and run a SELECT followed by an INSERT, SQLite will
+	// immediately report a locked database error if there is already another write transaction.
+	// As we know that we are going to insert data, let's always start the transaction in IMMEDIATE
+	// mode. This works around this known bug: https://github.com/mattn/go-sqlite3/issues/400.
+	if _, err := tx.ExecContext(ctx, "ROLLBACK; BEGIN IMMEDIATE"); err != nil {
+		return err
+	}
+
+	rows := make([]hitRow, len(hits))
+	for i := range hits {
+		row, err := writer.resolveHit(ctx, tx, &hits[i])
+		if err != nil {
+			writer.ClearCache()
+			return err
 		}
+		rows[i] = row
+	}
+
+	if err := writer.insertHits(ctx, tx, rows); err != nil {
+		writer.ClearCache()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		writer.ClearCache()
+		return err
+	}
+
+	return nil
+}
 
-		row := tx.QueryRowContext(ctx, "INSERT INTO paths (domain, path) VALUES (?, ?) RETURNING path_id", hit.Domain, hit.Path)
-		if err := row.Scan(&pathId); err != nil {
-			return fmt.Errorf("path insert error: %w", err)
+// Look up the ID of a dimension row in the cache or else in the database, inserting it if it does
+// not exist yet.
+func (writer *HitWriter) getOrInsert(ctx context.Context, tx *sql.Tx, cache *lruCache, key string, selectQuery string, insertQuery string, args ...interface{}) (int64, error) {
+	if id, ok := cache.Get(key); ok {
+		return id, nil
+	}
+
+	var id int64
+	err := writer.stmt(ctx, tx, selectQuery).QueryRowContext(ctx, args...).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = writer.stmt(ctx, tx, insertQuery).QueryRowContext(ctx, args...).Scan(&id)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	cache.Put(key, id)
+	return id, nil
+}
+
+// The latest title that a page sends replaces the previous one, unless that is from the configured
+// mapping. Most page loads send the same title as the last, so those are skipped without a write.
+func (writer *HitWriter) updatePathTitle(ctx context.Context, tx *sql.Tx, pathId int64, title string) error {
+	hash := fnv.New64a()
+	hash.Write([]byte(title))
+	sum := int64(hash.Sum64())
+
+	key := cacheKey(pathId)
+	if last, ok := writer.titles.Get(key); ok && last == sum {
+		return nil
+	}
+
+	if _, err := writer.stmt(ctx, tx, updatePathTitleQuery).ExecContext(ctx, title, pathId, title); err != nil {
+		return err
+	}
+
+	writer.titles.Put(key, sum)
+	return nil
+}
+
+// Write a single hit, in a transaction that has been started already.
+func (writer *HitWriter) InsertHit(ctx context.Context, tx *sql.Tx, hit *Hit) error {
+	row, err := writer.resolveHit(ctx, tx, hit)
+	if err != nil {
+		return err
+	}
+	return writer.insertHits(ctx, tx, []hitRow{row})
+}
+
+// The row of a hit in the hits table, with the IDs of its dimensions.
+type hitRow struct {
+	HitId               int64     `json:"hit_id"`
+	Timestamp           int64     `json:"timestamp"`
+	SiteId              int64     `json:"site_id"`
+	Event               EventType `json:"event"`
+	UserId              int64     `json:"user_id"`
+	UserAgentId         int64     `json:"user_agent_id"`
+	Bot                 *int16    `json:"bot"`
+	PathId              int64     `json:"path_id"`
+	ReferrerId          *int64    `json:"referrer_id"`
+	LocationId          *int64    `json:"location_id"`
+	LanguageId          *int64    `json:"language_id"`
+	SecondaryLanguageId *int64    `json:"secondary_language_id"`
+	DisplayId           *int64    `json:"display_id"`
+	Device              *string   `json:"device"`
+	CampaignId          *int64    `json:"campaign_id"`
+	TargetId            *int64    `json:"target_id"`
+	EventNameId         *int64    `json:"event_name_id"`
+	KeywordId           *int64    `json:"keyword_id"`
+	ScrollDepth         *int16    `json:"scroll_depth"`
+	EngagedSeconds      *int32    `json:"engaged_seconds"`
+	TimeToFirstByte     *int32    `json:"ttfb_ms"`
+	DOMContentLoaded    *int32    `json:"dom_content_loaded_ms"`
+	LoadTime            *int32    `json:"load_ms"`
+
+	goals   []string
+	visitor uint64
+}
+
+// Look up, or insert, the user and the dimensions of a hit.
+func (writer *HitWriter) resolveHit(ctx context.Context, tx *sql.Tx, hit *Hit) (hitRow, error) {
+	// User ID
+	userId, err := writer.insertUser(ctx, tx, hit.IdentifierCurrent, hit.IdentifierPrevious, hit.Timestamp)
+	if err != nil {
+		return hitRow{}, err
+	}
+
+	// Site
+	siteId, err := writer.getOrInsert(ctx, tx, writer.sites, cacheKey(hit.Domain), selectSiteQuery, insertSiteQuery, hit.Domain)
+	if err != nil {
+		return hitRow{}, fmt.Errorf("site error: %w", err)
+	}
+
+	// Path
+	pathId, err := writer.getOrInsert(ctx, tx, writer.paths, cacheKey(siteId, hit.Path), selectPathQuery, insertPathQuery, siteId, hit.Path)
+	if err != nil {
+		return hitRow{}, fmt.Errorf("path error: %w", err)
+	}
+	if hit.Title.Valid {
+		if err := writer.updatePathTitle(ctx, tx, pathId, hit.Title.String); err != nil {
+			return hitRow{}, fmt.Errorf("path title error: %w", err)
 		}
 	}
 
 	// Referrer
 	var referrerId sql.NullInt64
 	if hit.ReferrerDomain.Valid {
-		row := tx.QueryRowContext(ctx, "SELECT referrer_id FROM referrers WHERE domain = ? AND path IS ?", hit.ReferrerDomain, hit.ReferrerPath)
-		err := row.Scan(&referrerId)
+		id, err := writer.getOrInsert(
+			ctx,
+			tx,
+			writer.referrers,
+			cacheKey(hit.ReferrerDomain, hit.ReferrerPath),
+			selectReferrerQuery,
+			insertReferrerQuery,
+			hit.ReferrerDomain,
+			hit.ReferrerPath,
+		)
 		if err != nil {
-			if err != sql.ErrNoRows {
-				return fmt.Errorf("referrer select error: %w", err)
-			}
+			return hitRow{}, fmt.Errorf("referrer error: %w", err)
+		}
+		referrerId = sql.NullInt64{Int64: id, Valid: true}
+	}
 
-			row := tx.QueryRowContext(ctx, "INSERT INTO referrers (domain, path) VALUES (?, ?) RETURNING referrer_id", hit.ReferrerDomain, hit.ReferrerPath)
-			if err := row.Scan(&referrerId); err != nil {
-				return fmt.Errorf("referrer insert error: %w", err)
-			}
+	// Campaign
+	var campaignId sql.NullInt64
+	if campaign := &hit.Campaign; campaign.Valid() {
+		id, err := writer.getOrInsert(
+			ctx,
+			tx,
+			writer.campaigns,
+			cacheKey(campaign.Source, campaign.Medium, campaign.Name, campaign.Term, campaign.Content),
+			selectCampaignQuery,
+			insertCampaignQuery,
+			campaign.Source,
+			campaign.Medium,
+			campaign.Name,
+			campaign.Term,
+			campaign.Content,
+		)
+		if err != nil {
+			return hitRow{}, fmt.Errorf("campaign error: %w", err)
+		}
+		campaignId = sql.NullInt64{Int64: id, Valid: true}
+	}
+
+	// Link target
+	var targetId sql.NullInt64
+	if hit.Target.Valid {
+		id, err := writer.getOrInsert(ctx, tx, writer.targets, hit.Target.String, selectTargetQuery, insertTargetQuery, hit.Target.String)
+		if err != nil {
+			return hitRow{}, fmt.Errorf("target error: %w", err)
+		}
+		targetId = sql.NullInt64{Int64: id, Valid: true}
+	}
+
+	// Custom event name
+	var eventNameId sql.NullInt64
+	if hit.EventName.Valid {
+		id, err := writer.getOrInsert(ctx, tx, writer.eventNames, hit.EventName.String, selectEventNameQuery, insertEventNameQuery, hit.EventName.String)
+		if err != nil {
+			return hitRow{}, fmt.Errorf("event name error: %w", err)
 		}
+		eventNameId = sql.NullInt64{Int64: id, Valid: true}
+	}
+
+	// Search terms
+	var keywordId sql.NullInt64
+	if hit.Keyword.Valid {
+		id, err := writer.getOrInsert(ctx, tx, writer.keywords, hit.Keyword.String, selectKeywordQuery, insertKeywordQuery, hit.Keyword.String)
+		if err != nil {
+			return hitRow{}, fmt.Errorf("keyword error: %w", err)
+		}
+		keywordId = sql.NullInt64{Int64: id, Valid: true}
 	}
 
 	// User Agent
-	userAgentId, err := dbInsertUserAgent(ctx, tx, hit.UserAgent)
+	userAgentId, err := writer.insertUserAgent(ctx, tx, hit.UserAgent)
 	if err != nil {
-		return err
+		return hitRow{}, err
 	}
 
-	// Language
-	var languageId sql.NullInt64
-	if hit.Language != "" {
-		row := tx.QueryRowContext(ctx, "SELECT language_id FROM languages WHERE iso_639_3 = ?", hit.Language)
-		if err := row.Scan(&languageId); err != nil && err != sql.ErrNoRows {
-			return fmt.Errorf("language select error: %w", err)
-		}
+	// Languages
+	languageId, err := writer.languageId(ctx, tx, hit.Language)
+	if err != nil {
+		return hitRow{}, err
+	}
+	secondaryLanguageId, err := writer.languageId(ctx, tx, hit.SecondaryLanguage)
+	if err != nil {
+		return hitRow{}, err
 	}
 
 	// Location
-	locationId, err := dbInsertLocation(ctx, tx, &hit.Location)
+	locationId, err := writer.insertLocation(ctx, tx, &hit.Location)
 	if err != nil {
-		return err
+		return hitRow{}, err
 	}
 
 	// Display
 	var displayId sql.NullInt64
 	if hit.ScreenHeight.Valid && hit.ScreenWidth.Valid && hit.PixelRatio.Valid {
-		row := tx.QueryRowContext(
+		id, err := writer.getOrInsert(
 			ctx,
-			"SELECT display_id FROM displays WHERE screen_height = ? AND screen_width = ? AND pixel_ratio = ?",
+			tx,
+			writer.displays,
+			cacheKey(hit.ScreenHeight, hit.ScreenWidth, hit.PixelRatio),
+			selectDisplayQuery,
+			insertDisplayQuery,
 			hit.ScreenHeight,
 			hit.ScreenWidth,
 			hit.PixelRatio,
 		)
-		err := row.Scan(&displayId)
 		if err != nil {
-			if err != sql.ErrNoRows {
-				return fmt.Errorf("display select error: %w", err)
-			}
-
-			row := tx.QueryRowContext(
-				ctx,
-				"INSERT INTO displays (screen_height, screen_width, pixel_ratio) VALUES (?, ?, ?) RETURNING display_id",
-				hit.ScreenHeight,
-				hit.ScreenWidth,
-				hit.PixelRatio,
-			)
-			if err := row.Scan(&displayId); err != nil {
-				return fmt.Errorf("display insert error: %w", err)
-			}
+			return hitRow{}, fmt.Errorf("display error: %w", err)
 		}
+		displayId = sql.NullInt64{Int64: id, Valid: true}
 	}
 
-	_, err = tx.ExecContext(
-		ctx,
-		`INSERT INTO hits ( timestamp
-			              , event
-			              , user_id
-			              , user_agent_id
-						  , bot
-						  , path_id
-						  , referrer_id
-						  , location_id
-						  , language_id
-						  , display_id )
-		VALUES ( :timestamp
-			   , :event
-			   , :user_id
-			   , :user_agent_id
-			   , :bot
-			   , :path_id
-			   , :referrer_id
-			   , :location_id
-			   , :language_id
-			   , :display_id )`,
-		sql.Named("timestamp", hit.Timestamp),
-		sql.Named("event", hit.Event),
-		sql.Named("user_id", userId),
-		sql.Named("user_agent_id", userAgentId),
-		sql.Named("bot", hit.Bot),
-		sql.Named("path_id", pathId),
-		sql.Named("referrer_id", referrerId),
-		sql.Named("location_id", locationId),
-		sql.Named("language_id", languageId),
-		sql.Named("display_id", displayId),
-	)
+	row := hitRow{
+		Timestamp:           hit.Timestamp,
+		SiteId:              siteId,
+		Event:               hit.Event,
+		UserId:              userId,
+		UserAgentId:         userAgentId,
+		Bot:                 nullableInt16(hit.Bot),
+		PathId:              pathId,
+		ReferrerId:          nullableInt64(referrerId),
+		LocationId:          nullableInt64(locationId),
+		LanguageId:          nullableInt64(languageId),
+		SecondaryLanguageId: nullableInt64(secondaryLanguageId),
+		DisplayId:           nullableInt64(displayId),
+		Device:              nullableString(hit.Device),
+		CampaignId:          nullableInt64(campaignId),
+		TargetId:            nullableInt64(targetId),
+		EventNameId:         nullableInt64(eventNameId),
+		KeywordId:           nullableInt64(keywordId),
+		ScrollDepth:         nullableInt16(hit.ScrollDepth),
+		EngagedSeconds:      nullableInt32(hit.EngagedSeconds),
+		TimeToFirstByte:     nullableInt32(hit.TimeToFirstByte),
+		DOMContentLoaded:    nullableInt32(hit.DOMContentLoaded),
+		LoadTime:            nullableInt32(hit.LoadTime),
+		goals:               hit.Goals,
+	}
+	if hit.Event == PageLoad {
+		row.visitor = hit.Visitor
+	}
+	return row, nil
+}
+
+// Insert the rows of hits into the tables of their months, with their goals and visitor sketches,
+// with a statement each. The transaction must have been started with BEGIN IMMEDIATE so that the
+// IDs of the hits can be assigned here, which the goals need.
+func (writer *HitWriter) insertHits(ctx context.Context, tx *sql.Tx, rows []hitRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	timestamps := make([]int64, len(rows))
+	for i, row := range rows {
+		timestamps[i] = row.Timestamp
+	}
+	partitions, err := dbEnsureHitPartitions(ctx, tx, timestamps)
+	if err != nil {
+		return err
+	}
+
+	hitId, err := dbNextHitIds(ctx, tx, partitions, len(rows))
 	if err != nil {
 		return err
 	}
 
+	type goalRow struct {
+		Goal  string `json:"goal"`
+		HitId int64  `json:"hit_id"`
+	}
+	type sketchRow struct {
+		SiteId      int64  `json:"site_id"`
+		Timestamp   int64  `json:"timestamp"`
+		Bot         *int16 `json:"bot"`
+		UserAgentId int64  `json:"user_agent_id"`
+		Register    int64  `json:"register"`
+		Rank        int64  `json:"rank"`
+	}
+
+	var goals []goalRow
+	var sketches []sketchRow
+	var months []string
+	monthRows := make(map[string][]hitRow)
+	for i := range rows {
+		row := &rows[i]
+		row.HitId = hitId
+		hitId++
+
+		month := hitPartitionOf(row.Timestamp).table
+		if _, ok := monthRows[month]; !ok {
+			months = append(months, month)
+		}
+		monthRows[month] = append(monthRows[month], *row)
+
+		for _, goal := range row.goals {
+			goals = append(goals, goalRow{Goal: goal, HitId: row.HitId})
+		}
+		if row.visitor != 0 {
+			register, rank := sketchRegister(row.visitor)
+			sketches = append(sketches, sketchRow{
+				SiteId:      row.SiteId,
+				Timestamp:   row.Timestamp,
+				Bot:         row.Bot,
+				UserAgentId: row.UserAgentId,
+				Register:    register,
+				Rank:        rank,
+			})
+		}
+	}
+
+	for _, month := range months {
+		array, err := json.Marshal(monthRows[month])
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(insertHitsQuery, month), string(array)); err != nil {
+			return err
+		}
+	}
+	if len(goals) > 0 {
+		if err := writer.execJSON(ctx, tx, insertGoalsQuery, goals); err != nil {
+			return fmt.Errorf("goal error: %w", err)
+		}
+	}
+	if len(sketches) > 0 {
+		if err := writer.execJSON(ctx, tx, insertSketchesQuery, sketches); err != nil {
+			return fmt.Errorf("sketch error: %w", err)
+		}
+	}
+
 	return nil
 }
 
-func dbInsertUser(ctx context.Context, tx *sql.Tx, currentIdentifier []byte, previousIdentifier []byte) (int64, error) {
+// Run a prepared statement with rows encoded as a JSON array, for json_each.
+func (writer *HitWriter) execJSON(ctx context.Context, tx *sql.Tx, query string, rows interface{}) error {
+	array, err := json.Marshal(rows)
+	if err != nil {
+		return err
+	}
+	_, err = writer.stmt(ctx, tx, query).ExecContext(ctx, string(array))
+	return err
+}
+
+func nullableInt64(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
+
+// Users are created at the time of their first hit, which can be earlier than any hit written so
+// far if it was spooled. The hits of anonymous visitors all have the same user.
+func (writer *HitWriter) insertUser(ctx context.Context, tx *sql.Tx, currentIdentifier []byte, previousIdentifier []byte, timestamp int64) (int64, error) {
+	if currentIdentifier == nil {
+		return anonymousUserId, nil
+	}
+
 	var userId int64
 	var identifier []byte
 
-	row := tx.QueryRowContext(
-		ctx,
-		"SELECT user_id, identifier FROM users WHERE identifier = ? OR identifier = ?",
-		currentIdentifier,
-		previousIdentifier,
-	)
+	row := writer.stmt(ctx, tx, selectUserQuery).QueryRowContext(ctx, currentIdentifier, previousIdentifier)
 
 	err := row.Scan(&userId, &identifier)
 	if err != nil && err != sql.ErrNoRows {
@@ -296,30 +993,17 @@ func dbInsertUser(ctx context.Context, tx *sql.Tx, currentIdentifier []byte, pre
 	}
 
 	if err == sql.ErrNoRows {
-		row := tx.QueryRowContext(
-			ctx,
-			"INSERT INTO users (identifier) VALUES (?) RETURNING user_id",
-			currentIdentifier,
-		)
+		row := writer.stmt(ctx, tx, insertUserQuery).QueryRowContext(ctx, currentIdentifier, timestamp)
 		if err := row.Scan(&userId); err != nil {
 			return userId, err
 		}
 	} else if bytes.Equal(identifier, currentIdentifier) {
-		_, err := tx.ExecContext(
-			ctx,
-			"UPDATE users SET last_seen = strftime('%s', 'now') WHERE user_id = ?",
-			userId,
-		)
+		_, err := writer.stmt(ctx, tx, updateUserLastSeenQuery).ExecContext(ctx, timestamp, userId)
 		if err != nil {
 			return userId, err
 		}
 	} else if bytes.Equal(identifier, previousIdentifier) {
-		_, err := tx.ExecContext(
-			ctx,
-			"UPDATE users SET identifier = ?, last_seen = strftime('%s', 'now') WHERE user_id = ?",
-			currentIdentifier,
-			userId,
-		)
+		_, err := writer.stmt(ctx, tx, updateUserIdentifierQuery).ExecContext(ctx, currentIdentifier, timestamp, userId)
 		if err != nil {
 			return userId, err
 		}
@@ -330,16 +1014,17 @@ func dbInsertUser(ctx context.Context, tx *sql.Tx, currentIdentifier []byte, pre
 	return userId, nil
 }
 
-func dbInsertUserAgent(ctx context.Context, tx *sql.Tx, userAgent string) (int64, error) {
-	row := tx.QueryRowContext(
-		ctx,
-		"SELECT user_agent_id FROM user_agents WHERE user_agent = ?",
-		userAgent,
-	)
+func (writer *HitWriter) insertUserAgent(ctx context.Context, tx *sql.Tx, userAgent string) (int64, error) {
+	if uaId, ok := writer.userAgents.Get(userAgent); ok {
+		return uaId, nil
+	}
+
+	row := writer.stmt(ctx, tx, selectUserAgentQuery).QueryRowContext(ctx, userAgent)
 
 	var uaId int64
 	err := row.Scan(&uaId)
 	if err == nil {
+		writer.userAgents.Put(userAgent, uaId)
 		return uaId, nil
 	}
 
@@ -378,24 +1063,14 @@ func dbInsertUserAgent(ctx context.Context, tx *sql.Tx, userAgent string) (int64
 	var browserId sql.NullInt64
 
 	if browserName.Valid {
-		rowBrowser := tx.QueryRowContext(
-			ctx,
-			"SELECT browser_id FROM browsers WHERE browser_name = ? AND browser_version IS ?",
-			browserName,
-			browserVersion,
-		)
+		rowBrowser := writer.stmt(ctx, tx, selectBrowserQuery).QueryRowContext(ctx, browserName, browserVersion)
 
 		if err := rowBrowser.Scan(&browserId); err != nil {
 			if err != sql.ErrNoRows {
 				return uaId, err
 			}
 
-			row := tx.QueryRowContext(
-				ctx,
-				"INSERT INTO browsers (browser_name, browser_version) VALUES (?, ?) RETURNING browser_id",
-				browserName,
-				browserVersion,
-			)
+			row := writer.stmt(ctx, tx, insertBrowserQuery).QueryRowContext(ctx, browserName, browserVersion)
 			if err := row.Scan(&browserId); err != nil {
 				return uaId, err
 			}
@@ -406,24 +1081,14 @@ func dbInsertUserAgent(ctx context.Context, tx *sql.Tx, userAgent string) (int64
 	var osId sql.NullInt64
 
 	if osName.Valid {
-		rowOS := tx.QueryRowContext(
-			ctx,
-			"SELECT os_id FROM oss WHERE os_name = ? AND os_version IS ?",
-			osName,
-			osVersion,
-		)
+		rowOS := writer.stmt(ctx, tx, selectOSQuery).QueryRowContext(ctx, osName, osVersion)
 
 		if err := rowOS.Scan(&osId); err != nil {
 			if err != sql.ErrNoRows {
 				return uaId, err
 			}
 
-			row := tx.QueryRowContext(
-				ctx,
-				"INSERT INTO oss (os_name, os_version) VALUES (?, ?) RETURNING os_id",
-				osName,
-				osVersion,
-			)
+			row := writer.stmt(ctx, tx, insertOSQuery).QueryRowContext(ctx, osName, osVersion)
 			if err := row.Scan(&osId); err != nil {
 				return uaId, err
 			}
@@ -431,54 +1096,51 @@ func dbInsertUserAgent(ctx context.Context, tx *sql.Tx, userAgent string) (int64
 	}
 
 	// Now insert user agent
-	row = tx.QueryRowContext(
-		ctx,
-		"INSERT INTO user_agents (user_agent, browser_id, os_id, bot) VALUES (?, ?, ?, ?) RETURNING user_agent_id",
-		userAgent,
-		browserId,
-		osId,
-		bot,
-	)
+	row = writer.stmt(ctx, tx, insertUserAgentQuery).QueryRowContext(ctx, userAgent, browserId, osId, bot)
 	if err := row.Scan(&uaId); err != nil {
 		return uaId, err
 	}
 
+	writer.userAgents.Put(userAgent, uaId)
 	return uaId, nil
 }
 
-func dbInsertLocation(ctx context.Context, tx *sql.Tx, location *Location) (sql.NullInt64, error) {
+// Languages are never inserted, as the table holds all of ISO 639-3, so a code that is not in it
+// has no ID.
+func (writer *HitWriter) languageId(ctx context.Context, tx *sql.Tx, iso string) (sql.NullInt64, error) {
+	var languageId sql.NullInt64
+	if iso == "" {
+		return languageId, nil
+	}
+
+	if id, ok := writer.languages.Get(iso); ok {
+		return sql.NullInt64{Int64: id, Valid: true}, nil
+	}
+
+	row := writer.stmt(ctx, tx, selectLanguageQuery).QueryRowContext(ctx, iso)
+	if err := row.Scan(&languageId); err != nil && err != sql.ErrNoRows {
+		return languageId, fmt.Errorf("language select error: %w", err)
+	}
+	if languageId.Valid {
+		writer.languages.Put(iso, languageId.Int64)
+	}
+
+	return languageId, nil
+}
+
+func (writer *HitWriter) insertLocation(ctx context.Context, tx *sql.Tx, location *Location) (sql.NullInt64, error) {
 	if !location.Country.Valid {
 		// Unknown location
 		return sql.NullInt64{}, nil
 	}
 
-	// Get the location or the nearest parent location
-	const query = `
-	WITH RECURSIVE
-		l(location_id, parent_id, country, subdivision, city, postal) AS (
-			SELECT location_id, parent_id, country, subdivision, city, postal FROM locations WHERE country = :country
-			UNION ALL
-			SELECT locations.location_id
-				, locations.parent_id
-				, CASE WHEN locations.country IS NOT NULL THEN locations.country ELSE l.country END
-				, CASE WHEN locations.subdivision IS NOT NULL THEN locations.subdivision ELSE l.subdivision END
-				, CASE WHEN locations.city IS NOT NULL THEN locations.city ELSE l.city END
-				, CASE WHEN locations.postal IS NOT NULL THEN locations.postal ELSE l.postal END
-			FROM locations INNER JOIN l ON locations.parent_id = l.location_id
-			WHERE (locations.subdivision IS NULL OR locations.subdivision = :subdivision OR l.subdivision = :subdivision)
-			AND   (locations.city IS NULL OR locations.city = :city OR l.city = :city)
-			AND   (locations.postal IS NULL OR locations.postal = :postal OR l.postal = :postal)
-		)
-	SELECT location_id, country, subdivision, city, postal FROM l
-	ORDER BY country NULLS LAST
-		, subdivision NULLS LAST
-		, city NULLS LAST
-		, postal NULLS LAST
-	LIMIT 1`
+	key := cacheKey(location.Country, location.Subdivision, location.City, location.Postal)
+	if id, ok := writer.locations.Get(key); ok {
+		return sql.NullInt64{Int64: id, Valid: true}, nil
+	}
 
-	row := tx.QueryRowContext(
+	row := writer.stmt(ctx, tx, selectLocationQuery).QueryRowContext(
 		ctx,
-		query,
 		sql.Named("country", location.Country),
 		sql.Named("subdivision", location.Subdivision),
 		sql.Named("city", location.City),
@@ -501,34 +1163,35 @@ func dbInsertLocation(ctx context.Context, tx *sql.Tx, location *Location) (sql.
 		if !locationId.Valid {
 			panic("locationId must be valid")
 		}
+		writer.locations.Put(key, locationId.Int64)
 		return locationId, nil
 	}
 
 	// We have to insert some or part of the location
 
 	if country != location.Country && location.Country.Valid {
-		row := tx.QueryRowContext(ctx, "INSERT INTO locations (country) VALUES (?) RETURNING location_id", location.Country)
+		row := writer.stmt(ctx, tx, insertCountryQuery).QueryRowContext(ctx, location.Country)
 		if err := row.Scan(&locationId); err != nil {
 			return sql.NullInt64{}, err
 		}
 	}
 
 	if subdivision != location.Subdivision && location.Subdivision.Valid {
-		row := tx.QueryRowContext(ctx, "INSERT INTO locations (parent_id, subdivision) VALUES (?, ?) RETURNING location_id", locationId, location.Subdivision)
+		row := writer.stmt(ctx, tx, insertSubdivisionQuery).QueryRowContext(ctx, locationId, location.Subdivision)
 		if err := row.Scan(&locationId); err != nil {
 			return sql.NullInt64{}, err
 		}
 	}
 
 	if city != location.City && location.City.Valid {
-		row := tx.QueryRowContext(ctx, "INSERT INTO locations (parent_id, city) VALUES (?, ?) RETURNING location_id", locationId, location.City)
+		row := writer.stmt(ctx, tx, insertCityQuery).QueryRowContext(ctx, locationId, location.City)
 		if err := row.Scan(&locationId); err != nil {
 			return sql.NullInt64{}, err
 		}
 	}
 
 	if postal != location.Postal && location.Postal.Valid {
-		row := tx.QueryRowContext(ctx, "INSERT INTO locations (parent_id, postal) VALUES (?, ?) RETURNING location_id", locationId, location.Postal)
+		row := writer.stmt(ctx, tx, insertPostalQuery).QueryRowContext(ctx, locationId, location.Postal)
 		if err := row.Scan(&locationId); err != nil {
 			return sql.NullInt64{}, err
 		}
@@ -537,6 +1200,7 @@ func dbInsertLocation(ctx context.Context, tx *sql.Tx, location *Location) (sql.
 	if !locationId.Valid {
 		panic("locationId must be valid")
 	}
+	writer.locations.Put(key, locationId.Int64)
 	return locationId, nil
 }
 
@@ -563,3 +1227,33 @@ func dbDeleteExpired(ctx context.Context, deleteSince time.Duration, db *sql.DB)
 
 	return result.RowsAffected()
 }
+
+// The domains of all sites that have been visited
+func dbSites(ctx context.Context, db *sql.DB) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT domain FROM sites ORDER BY domain")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sites []string
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return nil, err
+		}
+		sites = append(sites, domain)
+	}
+
+	return sites, rows.Err()
+}
+
+// Add the sites if they do not exist yet, for when hits are not stored in the database to add them
+func dbAddSites(ctx context.Context, db *sql.DB, domains []string) error {
+	for _, domain := range domains {
+		if _, err := db.ExecContext(ctx, "INSERT OR IGNORE INTO sites (domain) VALUES (?)", strings.ToLower(domain)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
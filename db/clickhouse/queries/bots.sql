@@ -0,0 +1,23 @@
+-- Bot traffic by user agent on site between start_date and end_date (inclusive, in timezone), as in
+-- db/queries/bots.sql. The bot score of each hit is the highest of the user agent and IP address
+-- range or Javascript checks already.
+SELECT user_agent
+     , highest_bot AS bot
+     , all_hits AS hits
+     , page_loads AS pageviews
+     , unique_visitors AS visitors
+FROM (
+    SELECT user_agent
+         , max(bot) AS highest_bot
+         , count() AS all_hits
+         , countIf(event = 'l') AS page_loads
+         , uniqExact(visitor) AS unique_visitors
+    FROM hits
+    WHERE site = {site:String}
+      AND timestamp >= toDateTime({start:Int64}, 'UTC')
+      AND timestamp < toDateTime({end:Int64}, 'UTC')
+      AND bot >= 2
+    GROUP BY user_agent
+)
+ORDER BY hits DESC
+LIMIT 100
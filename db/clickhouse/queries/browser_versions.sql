@@ -0,0 +1,33 @@
+-- Visitors to site between start_date and end_date (inclusive, in timezone) by browser and major
+-- version, such as 102 for 102.0.5005.61, with their share of all visitors as a percentage, as in
+-- db/queries/browser_versions.sql. The ten with the most visitors are listed and the rest are put
+-- together as Other. Unknown names and versions are empty rather than null until the end, so that
+-- they can be joined. Bots are excluded unless include_bots is true.
+WITH
+    filtered AS (
+        SELECT visitor
+             , browser_name
+             , splitByChar('.', browser_version)[1] AS major
+        FROM hits
+        WHERE site = {site:String}
+          AND event = 'l'
+          AND timestamp >= toDateTime({start:Int64}, 'UTC')
+          AND timestamp < toDateTime({end:Int64}, 'UTC')
+          AND ({include_bots:UInt8} OR bot < 2)
+    ),
+    ranked AS (
+        SELECT browser_name
+             , major
+             , row_number() OVER (ORDER BY uniqExact(visitor) DESC, count() DESC, browser_name = '', browser_name, toInt64OrZero(major) DESC, major) AS rank
+        FROM filtered
+        GROUP BY browser_name, major
+    )
+SELECT if(min(ranked.rank) <= 10, nullIf(any(filtered.browser_name), ''), 'Other') AS browser
+     , if(min(ranked.rank) <= 10, nullIf(any(filtered.major), ''), NULL) AS version
+     , count() AS pageviews
+     , uniqExact(filtered.visitor) AS visitors
+     , round(100 * visitors / (SELECT uniqExact(visitor) FROM filtered), 1) AS share
+FROM filtered
+INNER JOIN ranked ON filtered.browser_name = ranked.browser_name AND filtered.major = ranked.major
+GROUP BY least(ranked.rank, 11)
+ORDER BY min(ranked.rank)
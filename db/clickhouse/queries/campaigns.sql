@@ -0,0 +1,19 @@
+-- Top UTM campaigns on site between start_date and end_date (inclusive, in timezone), as in
+-- db/queries/campaigns.sql. Bots are excluded unless include_bots is true.
+SELECT utm_source AS source
+     , utm_medium AS medium
+     , utm_campaign AS campaign
+     , utm_term AS term
+     , utm_content AS content
+     , count() AS pageviews
+     , uniqExact(visitor) AS visitors
+FROM hits
+WHERE site = {site:String}
+  AND event = 'l'
+  AND coalesce(utm_source, utm_medium, utm_campaign, utm_term, utm_content) IS NOT NULL
+  AND timestamp >= toDateTime({start:Int64}, 'UTC')
+  AND timestamp < toDateTime({end:Int64}, 'UTC')
+  AND ({include_bots:UInt8} OR bot < 2)
+GROUP BY utm_source, utm_medium, utm_campaign, utm_term, utm_content
+ORDER BY pageviews DESC
+LIMIT 100
@@ -0,0 +1,16 @@
+-- Pageviews by city in region on site between start_date and end_date (inclusive, in timezone), as
+-- in db/queries/cities.sql. The region is a country or a subdivision given by its ISO code, such as
+-- GB or GB-ENG. Bots are excluded unless include_bots is true.
+SELECT city
+     , count() AS pageviews
+     , uniqExact(visitor) AS visitors
+FROM hits
+WHERE site = {site:String}
+  AND event = 'l'
+  AND timestamp >= toDateTime({start:Int64}, 'UTC')
+  AND timestamp < toDateTime({end:Int64}, 'UTC')
+  AND ({include_bots:UInt8} OR bot < 2)
+  AND (country = {region:String} OR concat(country, '-', subdivision) = {region:String})
+GROUP BY city
+ORDER BY pageviews DESC, city
+LIMIT 100
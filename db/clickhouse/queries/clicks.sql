@@ -0,0 +1,16 @@
+-- Most clicked outbound links and downloads on site between start_date and end_date (inclusive, in
+-- timezone), as in db/queries/clicks.sql. Bots are excluded unless include_bots is true.
+SELECT target AS url
+     , if(event = 'o', 'outbound', 'download') AS type
+     , count() AS clicks
+     , uniqExact(visitor) AS visitors
+FROM hits
+WHERE site = {site:String}
+  AND event IN ('o', 'd')
+  AND target IS NOT NULL
+  AND timestamp >= toDateTime({start:Int64}, 'UTC')
+  AND timestamp < toDateTime({end:Int64}, 'UTC')
+  AND ({include_bots:UInt8} OR bot < 2)
+GROUP BY target, event
+ORDER BY clicks DESC
+LIMIT 100
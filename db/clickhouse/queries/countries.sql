@@ -0,0 +1,20 @@
+-- Pageviews by country on site between start_date and end_date (inclusive, in timezone), as in
+-- db/queries/countries.sql. The visitors of each day of zone are summed, as they are from its daily
+-- rollups. Bots are excluded unless include_bots is true.
+SELECT country_code AS country
+     , sum(day_pageviews) AS pageviews
+     , sum(day_visitors) AS visitors
+FROM (
+    SELECT country AS country_code
+         , count() AS day_pageviews
+         , uniqExact(visitor) AS day_visitors
+    FROM hits
+    WHERE site = {site:String}
+      AND event = 'l'
+      AND timestamp >= toDateTime({start:Int64}, 'UTC')
+      AND timestamp < toDateTime({end:Int64}, 'UTC')
+      AND ({include_bots:UInt8} OR bot < 2)
+    GROUP BY country, toDate(timestamp, {zone:String})
+)
+GROUP BY country_code
+ORDER BY pageviews DESC
@@ -0,0 +1,21 @@
+-- The share of visitors using a mobile, tablet or desktop on site between start_date and end_date
+-- (inclusive, in timezone), as a percentage of the visitors whose device is known, as in
+-- db/queries/devices.sql. Bots are excluded unless include_bots is true.
+SELECT device_class AS device
+     , pageviews
+     , visitors
+     , round(100 * visitors / sum(visitors) OVER (), 1) AS share
+FROM (
+    SELECT device AS device_class
+         , count() AS pageviews
+         , uniqExact(visitor) AS visitors
+    FROM hits
+    WHERE site = {site:String}
+      AND event = 'l'
+      AND device IS NOT NULL
+      AND timestamp >= toDateTime({start:Int64}, 'UTC')
+      AND timestamp < toDateTime({end:Int64}, 'UTC')
+      AND ({include_bots:UInt8} OR bot < 2)
+    GROUP BY device
+)
+ORDER BY visitors DESC, device_class
@@ -0,0 +1,23 @@
+-- Average scroll depth (as a percentage) and engaged time (in seconds) for the pages on site between
+-- start_date and end_date (inclusive, in timezone), from the page hides sent with engagement
+-- tracking enabled, as in db/queries/engagement.sql. Bots are excluded unless include_bots is true.
+SELECT page AS path
+     , average_scroll_depth AS scroll_depth
+     , average_engaged_seconds AS engaged_seconds
+     , views
+FROM (
+    SELECT path AS page
+         , avg(scroll_depth) AS average_scroll_depth
+         , avg(engaged_seconds) AS average_engaged_seconds
+         , count() AS views
+    FROM hits
+    WHERE site = {site:String}
+      AND event = 'h'
+      AND scroll_depth IS NOT NULL
+      AND timestamp >= toDateTime({start:Int64}, 'UTC')
+      AND timestamp < toDateTime({end:Int64}, 'UTC')
+      AND ({include_bots:UInt8} OR bot < 2)
+    GROUP BY path
+)
+ORDER BY views DESC
+LIMIT 100
@@ -0,0 +1,16 @@
+-- The pages of site that the custom event was sent from between start_date and end_date
+-- (inclusive, in timezone), as in db/queries/event_pages.sql. Bots are excluded unless
+-- include_bots is true.
+SELECT path
+     , count() AS events
+     , uniqExact(visitor) AS visitors
+FROM hits
+WHERE site = {site:String}
+  AND event = 'c'
+  AND event_name = {event:String}
+  AND timestamp >= toDateTime({start:Int64}, 'UTC')
+  AND timestamp < toDateTime({end:Int64}, 'UTC')
+  AND ({include_bots:UInt8} OR bot < 2)
+GROUP BY path
+ORDER BY events DESC, path
+LIMIT 100
@@ -0,0 +1,25 @@
+-- Custom events sent on site between start_date and end_date (inclusive, in timezone) by name, with
+-- the percentage of the visitors with a page load in the period who sent each, as in
+-- db/queries/events.sql. Bots are excluded unless include_bots is true.
+SELECT event_name AS name
+     , count() AS events
+     , uniqExact(visitor) AS visitors
+     , round(100 * visitors / greatest((
+           SELECT uniqExact(visitor)
+           FROM hits
+           WHERE site = {site:String}
+             AND event = 'l'
+             AND timestamp >= toDateTime({start:Int64}, 'UTC')
+             AND timestamp < toDateTime({end:Int64}, 'UTC')
+             AND ({include_bots:UInt8} OR bot < 2)
+       ), 1), 1) AS conversion_rate
+FROM hits
+WHERE site = {site:String}
+  AND event = 'c'
+  AND event_name IS NOT NULL
+  AND timestamp >= toDateTime({start:Int64}, 'UTC')
+  AND timestamp < toDateTime({end:Int64}, 'UTC')
+  AND ({include_bots:UInt8} OR bot < 2)
+GROUP BY event_name
+ORDER BY events DESC, name
+LIMIT 100
@@ -0,0 +1,41 @@
+-- Conversion rate of each goal by UTM campaign on site between start_date and end_date (inclusive,
+-- in timezone): of the visitors who arrived with each source, medium and campaign, the percentage
+-- who completed the goal in the period, as in db/queries/goal_campaigns.sql. Only goals completed in
+-- the period are included. Bots are excluded from the arrivals unless include_bots is true.
+WITH
+    arrivals AS (
+        SELECT DISTINCT utm_source AS source, utm_medium AS medium, utm_campaign AS campaign, visitor
+        FROM hits
+        WHERE site = {site:String}
+          AND event = 'l'
+          AND coalesce(utm_source, utm_medium, utm_campaign, utm_term, utm_content) IS NOT NULL
+          AND timestamp >= toDateTime({start:Int64}, 'UTC')
+          AND timestamp < toDateTime({end:Int64}, 'UTC')
+          AND ({include_bots:UInt8} OR bot < 2)
+    ),
+    completions AS (
+        SELECT DISTINCT arrayJoin(goals) AS goal_name, visitor
+        FROM hits
+        WHERE site = {site:String}
+          AND notEmpty(goals)
+          AND timestamp >= toDateTime({start:Int64}, 'UTC')
+          AND timestamp < toDateTime({end:Int64}, 'UTC')
+    )
+SELECT goal_name AS goal
+     , source
+     , medium
+     , campaign
+     , count() AS visitors
+     , countIf(completed) AS conversions
+     , round(100 * conversions / visitors, 1) AS conversion_rate
+FROM (
+    SELECT goal_names.goal_name
+         , arrivals.source
+         , arrivals.medium
+         , arrivals.campaign
+         , (goal_names.goal_name, arrivals.visitor) IN (SELECT goal_name, visitor FROM completions) AS completed
+    FROM (SELECT DISTINCT goal_name FROM completions) AS goal_names
+    CROSS JOIN arrivals
+)
+GROUP BY goal_name, source, medium, campaign
+ORDER BY goal_name, conversions DESC, visitors DESC
@@ -0,0 +1,39 @@
+-- Conversion rate of each goal by referring domain on site between start_date and end_date
+-- (inclusive, in timezone): of the visitors whose first page load in the period came from each
+-- domain, or directly if the domain is null, the percentage who completed the goal in the period, as
+-- in db/queries/goal_referrers.sql. The domain is in a tuple so that argMin does not skip a direct
+-- page load. Only goals completed in the period are included. Bots are excluded from the arrivals
+-- unless include_bots is true.
+WITH
+    arrivals AS (
+        SELECT visitor, argMin(tuple(referrer_domain), timestamp).1 AS domain
+        FROM hits
+        WHERE site = {site:String}
+          AND event = 'l'
+          AND timestamp >= toDateTime({start:Int64}, 'UTC')
+          AND timestamp < toDateTime({end:Int64}, 'UTC')
+          AND ({include_bots:UInt8} OR bot < 2)
+        GROUP BY visitor
+    ),
+    completions AS (
+        SELECT DISTINCT arrayJoin(goals) AS goal_name, visitor
+        FROM hits
+        WHERE site = {site:String}
+          AND notEmpty(goals)
+          AND timestamp >= toDateTime({start:Int64}, 'UTC')
+          AND timestamp < toDateTime({end:Int64}, 'UTC')
+    )
+SELECT goal_name AS goal
+     , domain
+     , count() AS visitors
+     , countIf(completed) AS conversions
+     , round(100 * conversions / visitors, 1) AS conversion_rate
+FROM (
+    SELECT goal_names.goal_name
+         , arrivals.domain
+         , (goal_names.goal_name, arrivals.visitor) IN (SELECT goal_name, visitor FROM completions) AS completed
+    FROM (SELECT DISTINCT goal_name FROM completions) AS goal_names
+    CROSS JOIN arrivals
+)
+GROUP BY goal_name, domain
+ORDER BY goal_name, conversions DESC, visitors DESC
@@ -0,0 +1,23 @@
+-- Completions of each goal on site between start_date and end_date (inclusive, in timezone), with
+-- the percentage of the visitors with a page load in the period who completed it, as in
+-- db/queries/goals.sql. Bots are excluded unless include_bots is true.
+SELECT arrayJoin(goals) AS goal
+     , count() AS completions
+     , uniqExact(visitor) AS visitors
+     , round(100 * visitors / greatest((
+           SELECT uniqExact(visitor)
+           FROM hits
+           WHERE site = {site:String}
+             AND event = 'l'
+             AND timestamp >= toDateTime({start:Int64}, 'UTC')
+             AND timestamp < toDateTime({end:Int64}, 'UTC')
+             AND ({include_bots:UInt8} OR bot < 2)
+       ), 1), 1) AS conversion_rate
+FROM hits
+WHERE site = {site:String}
+  AND notEmpty(goals)
+  AND timestamp >= toDateTime({start:Int64}, 'UTC')
+  AND timestamp < toDateTime({end:Int64}, 'UTC')
+  AND ({include_bots:UInt8} OR bot < 2)
+GROUP BY goal
+ORDER BY completions DESC, goal
@@ -0,0 +1,17 @@
+-- Top search terms for each path on site between start_date and end_date (inclusive, in timezone):
+-- the ten with the most page loads for each path, as in db/queries/keywords.sql. Bots are excluded
+-- unless include_bots is true.
+SELECT path
+     , keyword
+     , count() AS pageviews
+     , uniqExact(visitor) AS visitors
+FROM hits
+WHERE site = {site:String}
+  AND event = 'l'
+  AND keyword IS NOT NULL
+  AND timestamp >= toDateTime({start:Int64}, 'UTC')
+  AND timestamp < toDateTime({end:Int64}, 'UTC')
+  AND ({include_bots:UInt8} OR bot < 2)
+GROUP BY path, keyword
+ORDER BY path, pageviews DESC, keyword
+LIMIT 10 BY path
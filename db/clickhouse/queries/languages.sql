@@ -0,0 +1,25 @@
+-- Visitors to site between start_date and end_date (inclusive, in timezone) by the language that
+-- they prefer, and how many more prefer it second, as in db/queries/languages.sql. The names of the
+-- languages are added from SQLite. Bots are excluded unless include_bots is true.
+SELECT iso_639_3 AS language
+     , uniqExactIf(visitor, preferred) AS visitors
+     , uniqExactIf(visitor, NOT preferred) AS secondary_visitors
+FROM (
+    SELECT visitor
+         , tupleElement(choice, 1) AS iso_639_3
+         , tupleElement(choice, 2) AS preferred
+    FROM (
+        SELECT visitor
+             , arrayJoin([(language, 1), (secondary_language, 0)]) AS choice
+        FROM hits
+        WHERE site = {site:String}
+          AND event = 'l'
+          AND timestamp >= toDateTime({start:Int64}, 'UTC')
+          AND timestamp < toDateTime({end:Int64}, 'UTC')
+          AND ({include_bots:UInt8} OR bot < 2)
+    )
+)
+WHERE iso_639_3 != ''
+GROUP BY iso_639_3
+ORDER BY visitors DESC, secondary_visitors DESC, iso_639_3
+LIMIT 100
@@ -0,0 +1,33 @@
+-- Visitors to site between start_date and end_date (inclusive, in timezone) by operating system and
+-- major version, such as 15 for iOS 15.5, with their share of all visitors as a percentage, as in
+-- db/queries/os_versions.sql. The ten with the most visitors are listed and the rest are put
+-- together as Other. Unknown names and versions are empty rather than null until the end, so that
+-- they can be joined. Bots are excluded unless include_bots is true.
+WITH
+    filtered AS (
+        SELECT visitor
+             , os_name
+             , splitByChar('.', os_version)[1] AS major
+        FROM hits
+        WHERE site = {site:String}
+          AND event = 'l'
+          AND timestamp >= toDateTime({start:Int64}, 'UTC')
+          AND timestamp < toDateTime({end:Int64}, 'UTC')
+          AND ({include_bots:UInt8} OR bot < 2)
+    ),
+    ranked AS (
+        SELECT os_name
+             , major
+             , row_number() OVER (ORDER BY uniqExact(visitor) DESC, count() DESC, os_name = '', os_name, toInt64OrZero(major) DESC, major) AS rank
+        FROM filtered
+        GROUP BY os_name, major
+    )
+SELECT if(min(ranked.rank) <= 10, nullIf(any(filtered.os_name), ''), 'Other') AS os
+     , if(min(ranked.rank) <= 10, nullIf(any(filtered.major), ''), NULL) AS version
+     , count() AS pageviews
+     , uniqExact(filtered.visitor) AS visitors
+     , round(100 * visitors / (SELECT uniqExact(visitor) FROM filtered), 1) AS share
+FROM filtered
+INNER JOIN ranked ON filtered.os_name = ranked.os_name AND filtered.major = ranked.major
+GROUP BY least(ranked.rank, 11)
+ORDER BY min(ranked.rank)
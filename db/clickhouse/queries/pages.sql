@@ -0,0 +1,27 @@
+-- Most viewed pages on site between start_date and end_date (inclusive, in timezone), as in
+-- db/queries/pages.sql. The visitors of each day of zone are summed, as they are from its daily
+-- rollups, and the title of each page is the latest that it was sent with. Bots are excluded unless
+-- include_bots is true. The pages are paged with limit and offset, and only those whose path or
+-- title matches the LIKE pattern search are included unless it is null.
+SELECT page AS path
+     , argMax(day_title, day) AS title
+     , sum(day_pageviews) AS pageviews
+     , sum(day_visitors) AS visitors
+FROM (
+    SELECT path AS page
+         , toDate(timestamp, {zone:String}) AS day
+         , argMax(title, timestamp) AS day_title
+         , count() AS day_pageviews
+         , uniqExact(visitor) AS day_visitors
+    FROM hits
+    WHERE site = {site:String}
+      AND event = 'l'
+      AND timestamp >= toDateTime({start:Int64}, 'UTC')
+      AND timestamp < toDateTime({end:Int64}, 'UTC')
+      AND ({include_bots:UInt8} OR bot < 2)
+    GROUP BY path, day
+)
+GROUP BY page
+HAVING isNull({search:Nullable(String)}) OR page ILIKE {search:Nullable(String)} OR title ILIKE {search:Nullable(String)}
+ORDER BY pageviews DESC, page
+LIMIT {limit:UInt32} OFFSET {offset:UInt32}
@@ -0,0 +1,51 @@
+-- Pageviews and unique visitors for each day of zone on site between start_date and end_date
+-- (inclusive, in timezone), as in db/queries/pageviews.sql, split into new visitors and returning
+-- ones, who had visited before. As in the totals rollups, a page load is from a returning visitor if
+-- they were first seen at least 30 minutes before the start of its visit. There is no session
+-- stitcher, so a visit starts with a hit more than 30 minutes after the last page load, view or hide
+-- of the visitor, from a day before the period onwards. The annotations, and the days that only have
+-- annotations, are added from SQLite. Bots are excluded unless include_bots is true.
+WITH
+    stitched AS (
+        SELECT timestamp
+             , visitor
+             , event
+             , bot
+             , toUnixTimestamp(timestamp) - lagInFrame(toUnixTimestamp(timestamp), 1, 0) OVER (
+                   PARTITION BY visitor ORDER BY timestamp ROWS BETWEEN 1 PRECEDING AND CURRENT ROW
+               ) > 1800 AS starts_visit
+        FROM hits
+        WHERE site = {site:String}
+          AND event IN ('l', 'v', 'h')
+          AND timestamp >= toDateTime({start:Int64} - 86400, 'UTC')
+          AND timestamp < toDateTime({end:Int64}, 'UTC')
+    ),
+    visits AS (
+        SELECT timestamp
+             , visitor
+             , event
+             , bot
+             , max(if(starts_visit, toUnixTimestamp(timestamp), 0)) OVER (
+                   PARTITION BY visitor ORDER BY timestamp ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW
+               ) AS visit_start
+        FROM stitched
+    ),
+    seen AS (
+        SELECT visitor, toUnixTimestamp(min(timestamp)) AS first_seen
+        FROM hits
+        WHERE timestamp < toDateTime({end:Int64}, 'UTC')
+          AND visitor IN (SELECT visitor FROM stitched)
+        GROUP BY visitor
+    )
+SELECT toString(toDate(visits.timestamp, {zone:String})) AS date
+     , count() AS pageviews
+     , uniqExact(visits.visitor) AS visitors
+     , visitors - returning_visitors AS new_visitors
+     , uniqExactIf(visits.visitor, seen.first_seen < visits.visit_start - 1800) AS returning_visitors
+FROM visits
+INNER JOIN seen ON visits.visitor = seen.visitor
+WHERE visits.event = 'l'
+  AND visits.timestamp >= toDateTime({start:Int64}, 'UTC')
+  AND ({include_bots:UInt8} OR visits.bot < 2)
+GROUP BY date
+ORDER BY date
@@ -0,0 +1,30 @@
+-- The median and 95th percentile time to first byte, DOMContentLoaded and load, in milliseconds, for
+-- the pages on site between start_date and end_date (inclusive, in timezone), from the page hides
+-- sent with performance tracking enabled, as in db/queries/performance.sql. The nearest rank of the
+-- pth percentile of the n values that were sent is ceil(n * p / 100), which is also its index in
+-- the sorted array, as arrays start at 1. Bots are excluded unless include_bots is true.
+SELECT page AS path
+     , views
+     , if(empty(ttfbs), NULL, ttfbs[intDiv(length(ttfbs) * 50 + 99, 100)]) AS ttfb_p50
+     , if(empty(ttfbs), NULL, ttfbs[intDiv(length(ttfbs) * 95 + 99, 100)]) AS ttfb_p95
+     , if(empty(dom_content_loadeds), NULL, dom_content_loadeds[intDiv(length(dom_content_loadeds) * 50 + 99, 100)]) AS dom_content_loaded_p50
+     , if(empty(dom_content_loadeds), NULL, dom_content_loadeds[intDiv(length(dom_content_loadeds) * 95 + 99, 100)]) AS dom_content_loaded_p95
+     , if(empty(loads), NULL, loads[intDiv(length(loads) * 50 + 99, 100)]) AS load_p50
+     , if(empty(loads), NULL, loads[intDiv(length(loads) * 95 + 99, 100)]) AS load_p95
+FROM (
+    SELECT path AS page
+         , count() AS views
+         , arraySort(groupArray(time_to_first_byte)) AS ttfbs
+         , arraySort(groupArray(dom_content_loaded)) AS dom_content_loadeds
+         , arraySort(groupArray(load_time)) AS loads
+    FROM hits
+    WHERE site = {site:String}
+      AND event = 'h'
+      AND load_time IS NOT NULL
+      AND timestamp >= toDateTime({start:Int64}, 'UTC')
+      AND timestamp < toDateTime({end:Int64}, 'UTC')
+      AND ({include_bots:UInt8} OR bot < 2)
+    GROUP BY path
+)
+ORDER BY views DESC
+LIMIT 100
@@ -0,0 +1,33 @@
+-- Top referrer sources on site between start_date and end_date (inclusive, in timezone), with
+-- referrers grouped as in db/queries/referrer_sources.sql: the source of a referrer is the name of
+-- the group of the first of group_domains, which are longest first, that it is or is a subdomain
+-- of, or else its domain without www. The visitors of each day of zone are summed, as they are from
+-- its daily rollups. Bots are excluded unless include_bots is true.
+SELECT if(
+           group_index > 0,
+           {group_names:Array(String)}[group_index],
+           if(startsWith(domain, 'www.'), substring(domain, 5), domain)
+       ) AS source
+     , sum(day_pageviews) AS pageviews
+     , sum(day_visitors) AS visitors
+FROM (
+    SELECT assumeNotNull(referrer_domain) AS domain
+         , arrayFirstIndex(
+               group_domain -> domain = group_domain OR endsWith(domain, concat('.', group_domain)),
+               {group_domains:Array(String)}
+           ) AS group_index
+         , toDate(timestamp, {zone:String}) AS day
+         , count() AS day_pageviews
+         , uniqExact(visitor) AS day_visitors
+    FROM hits
+    WHERE site = {site:String}
+      AND event = 'l'
+      AND referrer_domain IS NOT NULL
+      AND timestamp >= toDateTime({start:Int64}, 'UTC')
+      AND timestamp < toDateTime({end:Int64}, 'UTC')
+      AND ({include_bots:UInt8} OR bot < 2)
+    GROUP BY domain, day
+)
+GROUP BY source
+ORDER BY pageviews DESC, source
+LIMIT 100
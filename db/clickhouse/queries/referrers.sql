@@ -0,0 +1,28 @@
+-- Top referrers on site between start_date and end_date (inclusive, in timezone), as in
+-- db/queries/referrers.sql. The visitors of each day of zone are summed, as they are from its daily
+-- rollups. Bots are excluded unless include_bots is true. The referrers are paged with limit and
+-- offset, and only those whose domain and path match the LIKE pattern search are included unless it
+-- is null.
+SELECT referrer_domain AS domain
+     , referrer_path AS path
+     , sum(day_pageviews) AS pageviews
+     , sum(day_visitors) AS visitors
+FROM (
+    SELECT referrer_domain
+         , referrer_path
+         , toDate(timestamp, {zone:String}) AS day
+         , count() AS day_pageviews
+         , uniqExact(visitor) AS day_visitors
+    FROM hits
+    WHERE site = {site:String}
+      AND event = 'l'
+      AND referrer_domain IS NOT NULL
+      AND timestamp >= toDateTime({start:Int64}, 'UTC')
+      AND timestamp < toDateTime({end:Int64}, 'UTC')
+      AND ({include_bots:UInt8} OR bot < 2)
+    GROUP BY referrer_domain, referrer_path, day
+)
+WHERE isNull({search:Nullable(String)}) OR concat(referrer_domain, coalesce(referrer_path, '')) ILIKE {search:Nullable(String)}
+GROUP BY referrer_domain, referrer_path
+ORDER BY pageviews DESC, referrer_domain, referrer_path
+LIMIT {limit:UInt32} OFFSET {offset:UInt32}
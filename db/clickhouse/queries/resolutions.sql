@@ -0,0 +1,20 @@
+-- The twenty most common screen resolutions, in CSS pixels, of visitors to site between start_date
+-- and end_date (inclusive, in timezone), with the device class of each, as in
+-- db/queries/resolutions.sql. Bots are excluded unless include_bots is true.
+SELECT screen_width AS width
+     , screen_height AS height
+     , device
+     , count() AS pageviews
+     , uniqExact(visitor) AS visitors
+FROM hits
+WHERE site = {site:String}
+  AND event = 'l'
+  AND screen_width IS NOT NULL
+  AND screen_height IS NOT NULL
+  AND pixel_ratio IS NOT NULL
+  AND timestamp >= toDateTime({start:Int64}, 'UTC')
+  AND timestamp < toDateTime({end:Int64}, 'UTC')
+  AND ({include_bots:UInt8} OR bot < 2)
+GROUP BY screen_width, screen_height, device
+ORDER BY visitors DESC, pageviews DESC, width DESC, height DESC
+LIMIT 20
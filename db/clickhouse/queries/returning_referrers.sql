@@ -0,0 +1,74 @@
+-- New and returning visitors by referrer source on site between start_date and end_date (inclusive,
+-- in timezone), with referrers grouped as in referrer_sources.sql and direct visits as a null
+-- source, as in db/queries/returning_referrers.sql. A page load is from a returning visitor if they
+-- were first seen at least 30 minutes before the start of its visit, with visits stitched as in
+-- pageviews.sql. Visitors are counted as returning if any of their page loads were. Bots are
+-- excluded unless include_bots is true.
+WITH
+    stitched AS (
+        SELECT timestamp
+             , visitor
+             , event
+             , bot
+             , referrer_domain
+             , toUnixTimestamp(timestamp) - lagInFrame(toUnixTimestamp(timestamp), 1, 0) OVER (
+                   PARTITION BY visitor ORDER BY timestamp ROWS BETWEEN 1 PRECEDING AND CURRENT ROW
+               ) > 1800 AS starts_visit
+        FROM hits
+        WHERE site = {site:String}
+          AND event IN ('l', 'v', 'h')
+          AND timestamp >= toDateTime({start:Int64} - 86400, 'UTC')
+          AND timestamp < toDateTime({end:Int64}, 'UTC')
+    ),
+    visits AS (
+        SELECT timestamp
+             , visitor
+             , event
+             , bot
+             , referrer_domain
+             , max(if(starts_visit, toUnixTimestamp(timestamp), 0)) OVER (
+                   PARTITION BY visitor ORDER BY timestamp ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW
+               ) AS visit_start
+        FROM stitched
+    ),
+    seen AS (
+        SELECT visitor, toUnixTimestamp(min(timestamp)) AS first_seen
+        FROM hits
+        WHERE timestamp < toDateTime({end:Int64}, 'UTC')
+          AND visitor IN (SELECT visitor FROM stitched)
+        GROUP BY visitor
+    )
+SELECT source
+     , pageviews - returning_pageviews AS new_pageviews
+     , returning_pageviews
+     , visitors - returning_visitors AS new_visitors
+     , returning_visitors
+FROM (
+    SELECT multiIf(
+               domain = '', NULL,
+               group_index > 0, {group_names:Array(String)}[group_index],
+               startsWith(domain, 'www.'), substring(domain, 5),
+               domain
+           ) AS source
+         , count() AS pageviews
+         , countIf(returned) AS returning_pageviews
+         , uniqExact(visitor) AS visitors
+         , uniqExactIf(visitor, returned) AS returning_visitors
+    FROM (
+        SELECT ifNull(visits.referrer_domain, '') AS domain
+             , arrayFirstIndex(
+                   group_domain -> domain = group_domain OR endsWith(domain, concat('.', group_domain)),
+                   {group_domains:Array(String)}
+               ) AS group_index
+             , visits.visitor AS visitor
+             , seen.first_seen < visits.visit_start - 1800 AS returned
+        FROM visits
+        INNER JOIN seen ON visits.visitor = seen.visitor
+        WHERE visits.event = 'l'
+          AND visits.timestamp >= toDateTime({start:Int64}, 'UTC')
+          AND ({include_bots:UInt8} OR visits.bot < 2)
+    )
+    GROUP BY source
+)
+ORDER BY pageviews DESC, source
+LIMIT 100
@@ -0,0 +1,47 @@
+-- Number of visits, bounce rate and average visit duration (in seconds) on site for visits that
+-- started between start_date and end_date (inclusive, in timezone), as in db/queries/sessions.sql.
+-- Visits are stitched as in pageviews.sql, from a day either side of the period, and only start
+-- with a page load, as a view or hide on its own is from a page loaded before we started counting.
+-- A bounce is a visit with one pageview, and a visit is from a bot if any of its hits are. Bots are
+-- excluded unless include_bots is true.
+WITH
+    stitched AS (
+        SELECT timestamp
+             , visitor
+             , event
+             , bot
+             , toUnixTimestamp(timestamp) - lagInFrame(toUnixTimestamp(timestamp), 1, 0) OVER (
+                   PARTITION BY visitor ORDER BY timestamp ROWS BETWEEN 1 PRECEDING AND CURRENT ROW
+               ) > 1800 AS starts_visit
+        FROM hits
+        WHERE site = {site:String}
+          AND event IN ('l', 'v', 'h')
+          AND timestamp >= toDateTime({start:Int64} - 86400, 'UTC')
+          AND timestamp < toDateTime({end:Int64} + 86400, 'UTC')
+    ),
+    visits AS (
+        SELECT visitor
+             , minIf(toUnixTimestamp(timestamp), event = 'l') AS started
+             , max(toUnixTimestamp(timestamp)) AS ended
+             , countIf(event = 'l') AS page_loads
+             , max(bot) AS highest_bot
+        FROM (
+            SELECT timestamp
+                 , visitor
+                 , event
+                 , bot
+                 , max(if(starts_visit, toUnixTimestamp(timestamp), 0)) OVER (
+                       PARTITION BY visitor ORDER BY timestamp ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW
+                   ) AS visit_start
+            FROM stitched
+        )
+        GROUP BY visitor, visit_start
+        HAVING page_loads > 0
+    )
+SELECT count() AS visits
+     , avg(page_loads = 1) AS bounce_rate
+     , avg(ended - started) AS average_duration
+FROM visits
+WHERE started >= {start:Int64}
+  AND started < {end:Int64}
+  AND ({include_bots:UInt8} OR highest_bot < 2)
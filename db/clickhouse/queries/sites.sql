@@ -0,0 +1,6 @@
+-- All sites that have been visited, as in db/queries/sites.sql. Sites only visited by bots are
+-- excluded unless include_bots is true.
+SELECT DISTINCT site AS domain
+FROM hits
+WHERE {include_bots:UInt8} OR (event = 'l' AND bot < 2)
+ORDER BY domain
@@ -0,0 +1,20 @@
+-- Pageviews by subdivision of country on site between start_date and end_date (inclusive, in
+-- timezone), as in db/queries/subdivisions.sql, with hits from the country without a known
+-- subdivision in a null one. Bots are excluded unless include_bots is true.
+SELECT iso_code AS subdivision
+     , pageviews
+     , visitors
+FROM (
+    SELECT concat(country, '-', subdivision) AS iso_code
+         , count() AS pageviews
+         , uniqExact(visitor) AS visitors
+    FROM hits
+    WHERE site = {site:String}
+      AND event = 'l'
+      AND country = {country:String}
+      AND timestamp >= toDateTime({start:Int64}, 'UTC')
+      AND timestamp < toDateTime({end:Int64}, 'UTC')
+      AND ({include_bots:UInt8} OR bot < 2)
+    GROUP BY iso_code
+)
+ORDER BY pageviews DESC, iso_code
@@ -0,0 +1,63 @@
+-- Average time on page (in seconds) for the pages on site between start_date and end_date
+-- (inclusive, in timezone), as in db/queries/time_on_page.sql. Visits are stitched as in
+-- sessions.sql, and the time on page runs from a page load until the page was last hidden, where a
+-- hide is of the latest load of its path in its visit. Only page loads that we saw being hidden are
+-- counted. Bots are excluded unless include_bots is true, and a visit is from a bot if any of its
+-- hits are.
+WITH
+    stitched AS (
+        SELECT timestamp
+             , visitor
+             , event
+             , path
+             , bot
+             , toUnixTimestamp(timestamp) - lagInFrame(toUnixTimestamp(timestamp), 1, 0) OVER (
+                   PARTITION BY visitor ORDER BY timestamp ROWS BETWEEN 1 PRECEDING AND CURRENT ROW
+               ) > 1800 AS starts_visit
+        FROM hits
+        WHERE site = {site:String}
+          AND event IN ('l', 'v', 'h')
+          AND timestamp >= toDateTime({start:Int64} - 86400, 'UTC')
+          AND timestamp < toDateTime({end:Int64} + 86400, 'UTC')
+    ),
+    visits AS (
+        SELECT timestamp
+             , visitor
+             , event
+             , path
+             , bot
+             , max(if(starts_visit, toUnixTimestamp(timestamp), 0)) OVER (
+                   PARTITION BY visitor ORDER BY timestamp ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW
+               ) AS visit_start
+        FROM stitched
+    ),
+    loads AS (
+        SELECT event
+             , path
+             , toUnixTimestamp(timestamp) AS seen
+             , max(if(event = 'l', toUnixTimestamp(timestamp), 0)) OVER (
+                   PARTITION BY visitor, visit_start, path ORDER BY timestamp, event = 'h' ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW
+               ) AS loaded
+             , max(bot) OVER (PARTITION BY visitor, visit_start) AS visit_bot
+             , visitor
+             , visit_start
+        FROM visits
+    ),
+    durations AS (
+        SELECT path AS page
+             , max(seen) - loaded AS duration
+        FROM loads
+        WHERE event = 'h'
+          AND loaded > 0
+          AND loaded >= {start:Int64}
+          AND loaded < {end:Int64}
+          AND ({include_bots:UInt8} OR visit_bot < 2)
+        GROUP BY visitor, visit_start, path, loaded
+    )
+SELECT page AS path
+     , avg(duration) AS average_duration
+     , count() AS views
+FROM durations
+GROUP BY page
+ORDER BY views DESC
+LIMIT 100
@@ -0,0 +1,18 @@
+-- The user agents of visitors to site between start_date and end_date (inclusive, in timezone) whose
+-- browser or operating system could not be worked out, as in db/queries/unparsed_user_agents.sql.
+-- Bots are excluded unless include_bots is true.
+SELECT user_agent
+     , nullIf(any(browser_name), '') AS browser
+     , nullIf(any(os_name), '') AS os
+     , count() AS pageviews
+     , uniqExact(visitor) AS visitors
+FROM hits
+WHERE site = {site:String}
+  AND event = 'l'
+  AND (browser_name = '' OR os_name = '')
+  AND timestamp >= toDateTime({start:Int64}, 'UTC')
+  AND timestamp < toDateTime({end:Int64}, 'UTC')
+  AND ({include_bots:UInt8} OR bot < 2)
+GROUP BY user_agent
+ORDER BY pageviews DESC, user_agent
+LIMIT 100
@@ -0,0 +1,46 @@
+-- The hits written by the ClickHouse sink, or stored in ClickHouse with storage = "clickhouse", one
+-- row per hit with its dimensions, as ClickHouse is quick to scan and compresses repeated values well.
+-- The visitor is a hash of their identifier, so like the identifier it changes when the salts rotate.
+CREATE TABLE IF NOT EXISTS hits (
+    timestamp          DateTime('UTC'),
+    site               LowCardinality(String),
+    event              LowCardinality(String),
+    path               String,
+    title              Nullable(String),
+    referrer_domain    Nullable(String),
+    referrer_path      Nullable(String),
+    keyword            Nullable(String),
+    utm_source         Nullable(String),
+    utm_medium         Nullable(String),
+    utm_campaign       Nullable(String),
+    utm_term           Nullable(String),
+    utm_content        Nullable(String),
+    target             Nullable(String),
+    event_name         Nullable(String),
+    goals              Array(String),
+    visitor            UInt64,
+    user_agent         String,
+    browser_name       LowCardinality(String),
+    browser_version    LowCardinality(String),
+    os_name            LowCardinality(String),
+    os_version         LowCardinality(String),
+    bot                UInt8, -- The highest isbot score of the hit, of which 2 and above are bots
+    device             LowCardinality(Nullable(String)),
+    language           LowCardinality(String),
+    secondary_language LowCardinality(String),
+    country            LowCardinality(Nullable(String)),
+    subdivision        LowCardinality(Nullable(String)),
+    city               Nullable(String),
+    postal             Nullable(String),
+    screen_height      Nullable(Int32),
+    screen_width       Nullable(Int32),
+    pixel_ratio        Nullable(Float64),
+    scroll_depth       Nullable(Int16),
+    engaged_seconds    Nullable(Int32),
+    time_to_first_byte Nullable(Int32),
+    dom_content_loaded Nullable(Int32),
+    load_time          Nullable(Int32)
+)
+ENGINE = MergeTree
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY (site, timestamp)
@@ -0,0 +1,67 @@
+-- Upgrades a database created by schema.sql, from before there were migrations, to the schema that
+-- 0001_initial.sql creates. Such a database has a user_version of 0 like an empty one, but the
+-- domain of each path is in paths and there is no sites table. Each of those domains becomes a
+-- site, and paths and hits are rebuilt with the site_id of each row. 0001_initial.sql then creates
+-- the indexes and the tables that schema.sql did not have.
+
+CREATE TABLE sites (
+    site_id INTEGER PRIMARY KEY,
+    domain  TEXT NOT NULL UNIQUE CHECK(domain != '' AND lower(domain) = domain)
+) STRICT;
+
+INSERT INTO sites (domain) SELECT DISTINCT domain FROM paths ORDER BY domain;
+
+
+CREATE TABLE paths_legacy (
+    path_id INTEGER PRIMARY KEY,
+    site_id INTEGER NOT NULL REFERENCES sites(site_id),
+    path    TEXT NOT NULL CHECK(path != ''),
+    UNIQUE(site_id, path)
+) STRICT;
+
+INSERT INTO paths_legacy (path_id, site_id, path)
+SELECT paths.path_id, sites.site_id, paths.path
+FROM paths
+INNER JOIN sites ON paths.domain = sites.domain;
+
+
+-- Refers to paths_legacy, which is renamed to paths below along with the references to it
+CREATE TABLE hits_legacy (
+    hit_id        INTEGER PRIMARY KEY,
+    timestamp     INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    site_id       INTEGER NOT NULL REFERENCES sites(site_id),
+
+    event         TEXT NOT NULL,
+    user_id       INTEGER NOT NULL REFERENCES users(user_id),
+    user_agent_id INTEGER NOT NULL REFERENCES user_agents(user_agent_id),
+    bot           INTEGER,  -- E.g. a botty IP address range or selenium
+    location_id   INTEGER REFERENCES locations(location_id),
+    language_id   INTEGER REFERENCES languages(language_id),
+
+    path_id       INTEGER NOT NULL REFERENCES paths_legacy(path_id),
+    referrer_id   INTEGER REFERENCES referrers(referrer_id),
+    display_id    INTEGER REFERENCES displays(display_id)
+) STRICT;
+
+INSERT INTO hits_legacy (hit_id, timestamp, site_id, event, user_id, user_agent_id, bot, location_id, language_id, path_id, referrer_id, display_id)
+SELECT hits.hit_id
+     , hits.timestamp
+     , paths_legacy.site_id
+     , hits.event
+     , hits.user_id
+     , hits.user_agent_id
+     , hits.bot
+     , hits.location_id
+     , hits.language_id
+     , hits.path_id
+     , hits.referrer_id
+     , hits.display_id
+FROM hits
+INNER JOIN paths_legacy ON hits.path_id = paths_legacy.path_id;
+
+
+DROP TABLE hits;
+DROP TABLE paths;
+
+ALTER TABLE paths_legacy RENAME TO paths;
+ALTER TABLE hits_legacy RENAME TO hits;
@@ -0,0 +1,203 @@
+-- Represents an unique user identified by either a persistent identifier (generally frowned upon)
+-- or an pseudo-anonymised identifier such as a cryptographic hash of the user-agent and IP address.
+-- The identifier is cleared after some time to anonomise users and save space.
+CREATE TABLE IF NOT EXISTS users (
+    user_id    INTEGER PRIMARY KEY,
+    identifier BLOB UNIQUE,
+    first_seen INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    last_seen  INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+) STRICT;
+
+
+-- Each of the allowed domains is a separate site with its own statistics.
+CREATE TABLE IF NOT EXISTS sites (
+    site_id INTEGER PRIMARY KEY,
+    domain  TEXT NOT NULL UNIQUE CHECK(domain != '' AND lower(domain) = domain)
+) STRICT;
+
+
+CREATE TABLE IF NOT EXISTS paths (
+    path_id INTEGER PRIMARY KEY,
+    site_id INTEGER NOT NULL REFERENCES sites(site_id),
+    path    TEXT NOT NULL CHECK(path != ''),
+    UNIQUE(site_id, path)
+) STRICT;
+
+
+CREATE TABLE IF NOT EXISTS referrers (
+    referrer_id INTEGER PRIMARY KEY,
+    domain      TEXT NOT NULL CHECK(domain != '' AND lower(domain) = domain),
+    path        TEXT CHECK(path != '')
+) STRICT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS referrers_domain_path ON referrers (domain, path);
+CREATE UNIQUE INDEX IF NOT EXISTS referrers_domain ON referrers (domain) WHERE path IS NULL;
+
+
+CREATE TABLE IF NOT EXISTS browsers (
+    browser_id      INTEGER PRIMARY KEY,
+    browser_name    TEXT NOT NULL CHECK(browser_name != ''),
+    browser_version TEXT CHECK(browser_version != '')
+) STRICT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS browsers_name_version ON browsers (browser_name, browser_version);
+CREATE UNIQUE INDEX IF NOT EXISTS browsers_name ON browsers (browser_name) WHERE browser_version IS NULL;
+
+
+CREATE TABLE IF NOT EXISTS oss (
+    os_id      INTEGER PRIMARY KEY,
+    os_name    TEXT NOT NULL CHECK(os_name != ''),
+    os_version TEXT CHECK(os_version != '')
+) STRICT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS oss_name_version ON oss (os_name, os_version);
+CREATE UNIQUE INDEX IF NOT EXISTS oss_name ON oss (os_name) WHERE os_version IS NULL;
+
+
+CREATE TABLE IF NOT EXISTS user_agents (
+    user_agent_id INTEGER PRIMARY KEY,
+    user_agent    TEXT NOT NULL UNIQUE,
+    browser_id    INTEGER REFERENCES browsers(browser_id),
+    os_id         INTEGER REFERENCES oss(os_id),
+    bot           INTEGER NOT NULL
+) STRICT;
+
+
+CREATE TABLE IF NOT EXISTS languages (
+    language_id INTEGER PRIMARY KEY,
+    iso_639_3   TEXT NOT NULL UNIQUE CHECK(length(iso_639_3) = 3),
+    name        TEXT NOT NULL
+) STRICT;
+
+
+CREATE TABLE IF NOT EXISTS displays (
+    display_id    INTEGER PRIMARY KEY,
+    screen_height INTEGER,
+    screen_width  INTEGER,
+    pixel_ratio   REAL,
+    UNIQUE(screen_height, screen_width, pixel_ratio)
+) STRICT;
+
+
+CREATE TABLE IF NOT EXISTS locations (
+    location_id INTEGER PRIMARY KEY,
+    parent_id   INTEGER REFERENCES locations(location_id),
+    country     TEXT CHECK(country != ''),
+    subdivision TEXT CHECK(subdivision != ''),
+    city        TEXT CHECK(city != ''),
+    postal      TEXT CHECK(postal != ''),
+    name        TEXT GENERATED ALWAYS AS (
+        CASE
+            WHEN country IS NOT NULL THEN country
+            WHEN subdivision IS NOT NULL THEN subdivision
+            WHEN city IS NOT NULL THEN city
+            WHEN postal IS NOT NULL THEN postal
+            ELSE NULL
+        END
+    ) VIRTUAL,
+
+    CHECK(location_id != parent_id),
+    
+    -- A country has no parent but every other location must have a parent
+    CHECK(CAST(parent_id IS NOT NULL AS INTEGER) + CAST(country IS NOT NULL AS INTEGER) = 1),
+
+    -- Every location can only be one of a country, subdivision, city or postal
+    CHECK(CAST(country IS NOT NULL AS INTEGER) + CAST(subdivision IS NOT NULL AS INTEGER) + CAST(city IS NOT NULL AS INTEGER) + CAST(postal IS NOT NULL AS INTEGER) = 1)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_locations_country ON locations (country) WHERE country IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_locations_subdivision ON locations (parent_id, subdivision) WHERE subdivision IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_locations_city ON locations (parent_id, city) WHERE city IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_locations_postal ON locations (parent_id, postal) WHERE postal IS NOT NULL;
+
+CREATE TRIGGER IF NOT EXISTS valid_location_parent
+AFTER INSERT ON locations
+BEGIN
+    SELECT CASE
+        WHEN
+            NEW.subdivision IS NOT NULL AND (SELECT country IS NULL FROM locations WHERE location_id = NEW.parent_id)
+        THEN
+            RAISE(ABORT, 'subdivision without a country parent')
+        
+        WHEN
+            NEW.city IS NOT NULL AND (SELECT country IS NULL AND subdivision IS NULL FROM locations WHERE location_id = NEW.parent_id)
+        THEN
+            RAISE(ABORT, 'city without a country or subdivision parent')
+
+        WHEN
+            NEW.postal IS NOT NULL AND (SELECT city IS NULL FROM locations WHERE location_id = NEW.parent_id)
+        THEN
+            RAISE(ABORT, 'postal without a city parent')
+    END;
+END;
+
+
+CREATE TABLE IF NOT EXISTS hits (
+    hit_id        INTEGER PRIMARY KEY,
+    timestamp     INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    site_id       INTEGER NOT NULL REFERENCES sites(site_id),
+
+    event         TEXT NOT NULL,
+    user_id       INTEGER NOT NULL REFERENCES users(user_id),
+    user_agent_id INTEGER NOT NULL REFERENCES user_agents(user_agent_id),
+    bot           INTEGER,  -- E.g. a botty IP address range or selenium
+    location_id   INTEGER REFERENCES locations(location_id),
+    language_id   INTEGER REFERENCES languages(language_id),
+    
+    path_id       INTEGER NOT NULL REFERENCES paths(path_id),
+    referrer_id   INTEGER REFERENCES referrers(referrer_id),
+    display_id    INTEGER REFERENCES displays(display_id)
+) STRICT;
+
+CREATE INDEX IF NOT EXISTS hits_timestamp ON hits (timestamp);
+CREATE INDEX IF NOT EXISTS hits_site_timestamp ON hits (site_id, timestamp);
+
+
+-- Summaries of the hits table, maintained by the aggregator, so that the dashboard queries do not
+-- have to scan every hit. Only page loads are counted. Visitors are the number of unique users in
+-- each hour or day for each combination of path, referrer, country and browser, so cannot be summed
+-- without double counting. Use the totals tables for the number of unique visitors in a period.
+CREATE TABLE IF NOT EXISTS hits_hourly (
+    hour        INTEGER NOT NULL, -- Start of the hour as a Unix timestamp
+    site_id     INTEGER NOT NULL REFERENCES sites(site_id),
+    path_id     INTEGER NOT NULL REFERENCES paths(path_id),
+    referrer_id INTEGER REFERENCES referrers(referrer_id),
+    country     TEXT,
+    browser_id  INTEGER REFERENCES browsers(browser_id),
+    pageviews   INTEGER NOT NULL,
+    visitors    INTEGER NOT NULL
+) STRICT;
+
+CREATE INDEX IF NOT EXISTS hits_hourly_site_hour ON hits_hourly (site_id, hour);
+
+
+CREATE TABLE IF NOT EXISTS hits_daily (
+    day         INTEGER NOT NULL, -- Start of the day (UTC) as a Unix timestamp
+    site_id     INTEGER NOT NULL REFERENCES sites(site_id),
+    path_id     INTEGER NOT NULL REFERENCES paths(path_id),
+    referrer_id INTEGER REFERENCES referrers(referrer_id),
+    country     TEXT,
+    browser_id  INTEGER REFERENCES browsers(browser_id),
+    pageviews   INTEGER NOT NULL,
+    visitors    INTEGER NOT NULL
+) STRICT;
+
+CREATE INDEX IF NOT EXISTS hits_daily_site_day ON hits_daily (site_id, day);
+
+
+CREATE TABLE IF NOT EXISTS totals_hourly (
+    hour      INTEGER NOT NULL,
+    site_id   INTEGER NOT NULL REFERENCES sites(site_id),
+    pageviews INTEGER NOT NULL,
+    visitors  INTEGER NOT NULL,
+    PRIMARY KEY (site_id, hour)
+) STRICT;
+
+
+CREATE TABLE IF NOT EXISTS totals_daily (
+    day       INTEGER NOT NULL,
+    site_id   INTEGER NOT NULL REFERENCES sites(site_id),
+    pageviews INTEGER NOT NULL,
+    visitors  INTEGER NOT NULL,
+    PRIMARY KEY (site_id, day)
+) STRICT;
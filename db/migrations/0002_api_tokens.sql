@@ -0,0 +1,8 @@
+-- Tokens for the REST API. Only a hash of each token is stored.
+CREATE TABLE api_tokens (
+    token_id   INTEGER PRIMARY KEY,
+    name       TEXT NOT NULL UNIQUE CHECK(name != ''),
+    hash       BLOB NOT NULL UNIQUE,
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    last_used  INTEGER
+) STRICT;
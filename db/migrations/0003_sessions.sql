@@ -0,0 +1,40 @@
+-- Visits, stitched together from the page load, view and hide events of each user by the session
+-- stitcher. A visit ends after 30 minutes of inactivity.
+CREATE TABLE sessions (
+    session_id    INTEGER PRIMARY KEY,
+    site_id       INTEGER NOT NULL REFERENCES sites(site_id),
+    user_id       INTEGER NOT NULL REFERENCES users(user_id),
+    started       INTEGER NOT NULL,
+    ended         INTEGER NOT NULL,
+    entry_path_id INTEGER NOT NULL REFERENCES paths(path_id),
+    exit_path_id  INTEGER NOT NULL REFERENCES paths(path_id),
+    pageviews     INTEGER NOT NULL,
+    duration      INTEGER GENERATED ALWAYS AS (ended - started) VIRTUAL,
+    CHECK(ended >= started)
+) STRICT;
+
+CREATE INDEX sessions_site_user_ended ON sessions (site_id, user_id, ended);
+CREATE INDEX sessions_site_started ON sessions (site_id, started);
+
+
+-- Each page load in a session. The duration is the time until the page was hidden, or NULL if we
+-- never saw it being hidden.
+CREATE TABLE session_pages (
+    hit_id     INTEGER PRIMARY KEY, -- The page load hit
+    session_id INTEGER NOT NULL REFERENCES sessions(session_id),
+    path_id    INTEGER NOT NULL REFERENCES paths(path_id),
+    timestamp  INTEGER NOT NULL,
+    duration   INTEGER
+) STRICT;
+
+CREATE INDEX session_pages_session ON session_pages (session_id);
+CREATE INDEX session_pages_path_timestamp ON session_pages (path_id, timestamp);
+
+
+-- The last hit processed by the session stitcher
+CREATE TABLE sessions_progress (
+    id          INTEGER PRIMARY KEY CHECK(id = 1),
+    last_hit_id INTEGER NOT NULL
+) STRICT;
+
+INSERT INTO sessions_progress (id, last_hit_id) VALUES (1, 0);
@@ -0,0 +1,21 @@
+-- UTM campaign parameters of the page URL. Any of them may be missing.
+CREATE TABLE campaigns (
+    campaign_id INTEGER PRIMARY KEY,
+    source      TEXT CHECK(source != ''),
+    medium      TEXT CHECK(medium != ''),
+    campaign    TEXT CHECK(campaign != ''),
+    term        TEXT CHECK(term != ''),
+    content     TEXT CHECK(content != ''),
+    CHECK(COALESCE(source, medium, campaign, term, content) IS NOT NULL)
+) STRICT;
+
+-- NULLs are distinct in unique indexes so index on expressions instead
+CREATE UNIQUE INDEX campaigns_unique ON campaigns (
+    ifnull(source, ''),
+    ifnull(medium, ''),
+    ifnull(campaign, ''),
+    ifnull(term, ''),
+    ifnull(content, '')
+);
+
+ALTER TABLE hits ADD COLUMN campaign_id INTEGER REFERENCES campaigns(campaign_id);
@@ -0,0 +1,7 @@
+-- The URLs of outbound links and downloads that were clicked
+CREATE TABLE targets (
+    target_id INTEGER PRIMARY KEY,
+    url       TEXT NOT NULL UNIQUE CHECK(url != '')
+) STRICT;
+
+ALTER TABLE hits ADD COLUMN target_id INTEGER REFERENCES targets(target_id);
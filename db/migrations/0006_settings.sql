@@ -0,0 +1,5 @@
+-- Settings managed with the admin command. These take precedence over the configuration file.
+CREATE TABLE settings (
+    name  TEXT PRIMARY KEY,
+    value TEXT NOT NULL
+) STRICT;
@@ -0,0 +1,71 @@
+-- Split the rollups into bot and human traffic so that the dashboard queries can exclude bots. The
+-- rollups are recomputed from scratch by the aggregator as the tables are empty.
+DROP TABLE hits_hourly;
+DROP TABLE hits_daily;
+DROP TABLE totals_hourly;
+DROP TABLE totals_daily;
+
+-- A hit is from a bot if either its user agent, IP address range or Javascript checks say so. The
+-- bot column is 1 for bots and 0 otherwise.
+CREATE TABLE hits_hourly (
+    hour        INTEGER NOT NULL, -- Start of the hour as a Unix timestamp
+    site_id     INTEGER NOT NULL REFERENCES sites(site_id),
+    path_id     INTEGER NOT NULL REFERENCES paths(path_id),
+    referrer_id INTEGER REFERENCES referrers(referrer_id),
+    country     TEXT,
+    browser_id  INTEGER REFERENCES browsers(browser_id),
+    bot         INTEGER NOT NULL CHECK(bot IN (0, 1)),
+    pageviews   INTEGER NOT NULL,
+    visitors    INTEGER NOT NULL
+) STRICT;
+
+CREATE INDEX hits_hourly_site_hour ON hits_hourly (site_id, hour);
+
+
+CREATE TABLE hits_daily (
+    day         INTEGER NOT NULL, -- Start of the day (UTC) as a Unix timestamp
+    site_id     INTEGER NOT NULL REFERENCES sites(site_id),
+    path_id     INTEGER NOT NULL REFERENCES paths(path_id),
+    referrer_id INTEGER REFERENCES referrers(referrer_id),
+    country     TEXT,
+    browser_id  INTEGER REFERENCES browsers(browser_id),
+    bot         INTEGER NOT NULL CHECK(bot IN (0, 1)),
+    pageviews   INTEGER NOT NULL,
+    visitors    INTEGER NOT NULL
+) STRICT;
+
+CREATE INDEX hits_daily_site_day ON hits_daily (site_id, day);
+
+
+CREATE TABLE totals_hourly (
+    hour      INTEGER NOT NULL,
+    site_id   INTEGER NOT NULL REFERENCES sites(site_id),
+    bot       INTEGER NOT NULL CHECK(bot IN (0, 1)),
+    pageviews INTEGER NOT NULL,
+    visitors  INTEGER NOT NULL,
+    PRIMARY KEY (site_id, hour, bot)
+) STRICT;
+
+
+CREATE TABLE totals_daily (
+    day       INTEGER NOT NULL,
+    site_id   INTEGER NOT NULL REFERENCES sites(site_id),
+    bot       INTEGER NOT NULL CHECK(bot IN (0, 1)),
+    pageviews INTEGER NOT NULL,
+    visitors  INTEGER NOT NULL,
+    PRIMARY KEY (site_id, day, bot)
+) STRICT;
+
+
+-- A visit is from a bot if any of its hits are
+ALTER TABLE sessions ADD COLUMN bot INTEGER NOT NULL DEFAULT 0 CHECK(bot IN (0, 1));
+
+UPDATE sessions SET bot = 1
+WHERE EXISTS (
+    SELECT 1
+    FROM session_pages
+    INNER JOIN hits ON session_pages.hit_id = hits.hit_id
+    INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+    WHERE session_pages.session_id = sessions.session_id
+      AND (COALESCE(hits.bot, 0) >= 2 OR user_agents.bot >= 2)
+);
@@ -0,0 +1,4 @@
+-- How far down the page the visitor scrolled, as a percentage, and for how many seconds the page was
+-- visible. Only set on page hide events, when engagement tracking is enabled.
+ALTER TABLE hits ADD COLUMN scroll_depth INTEGER CHECK(scroll_depth BETWEEN 0 AND 100);
+ALTER TABLE hits ADD COLUMN engaged_seconds INTEGER CHECK(engaged_seconds >= 0);
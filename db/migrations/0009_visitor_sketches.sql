@@ -0,0 +1,10 @@
+-- HyperLogLog registers to estimate the unique visitors of each site per day without storing any
+-- identifiers, when anonymous visitors are enabled. Registers that are still zero are not stored.
+CREATE TABLE visitor_sketches (
+    site_id  INTEGER NOT NULL REFERENCES sites(site_id),
+    day      INTEGER NOT NULL,
+    bot      INTEGER NOT NULL CHECK(bot IN (0,1)),
+    register INTEGER NOT NULL,
+    rank     INTEGER NOT NULL,
+    PRIMARY KEY (site_id, day, bot, register)
+) STRICT, WITHOUT ROWID;
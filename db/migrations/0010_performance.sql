@@ -0,0 +1,6 @@
+-- How many milliseconds after navigation started the first byte of the page arrived, the DOM was
+-- loaded and the page finished loading. Only set on the first page hide of a page load, when
+-- performance tracking is enabled.
+ALTER TABLE hits ADD COLUMN ttfb_ms INTEGER CHECK(ttfb_ms >= 0);
+ALTER TABLE hits ADD COLUMN dom_content_loaded_ms INTEGER CHECK(dom_content_loaded_ms >= 0);
+ALTER TABLE hits ADD COLUMN load_ms INTEGER CHECK(load_ms >= 0);
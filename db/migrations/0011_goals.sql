@@ -0,0 +1,17 @@
+-- The names of custom events, which sites send from Javascript with sheepcount("signup")
+CREATE TABLE event_names (
+    event_name_id INTEGER PRIMARY KEY,
+    name          TEXT NOT NULL UNIQUE CHECK(name != '')
+) STRICT;
+
+ALTER TABLE hits ADD COLUMN event_name_id INTEGER REFERENCES event_names(event_name_id);
+
+-- The goals in the configuration that each hit completed, matched when the hit was written. Goals
+-- are kept by name so that changing the configuration does not change past completions.
+CREATE TABLE goals (
+    goal   TEXT NOT NULL CHECK(goal != ''),
+    hit_id INTEGER NOT NULL REFERENCES hits(hit_id) ON DELETE CASCADE,
+    PRIMARY KEY (goal, hit_id)
+) STRICT, WITHOUT ROWID;
+
+CREATE INDEX goals_hit_id ON goals (hit_id);
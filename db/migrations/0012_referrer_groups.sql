@@ -0,0 +1,26 @@
+-- Names for referring domains, such as Twitter for both t.co and twitter.com. They are replaced from
+-- the built in list and the configuration each time SheepCount starts.
+CREATE TABLE referrer_groups (
+    domain TEXT PRIMARY KEY CHECK(domain != '' AND lower(domain) = domain),
+    name   TEXT NOT NULL CHECK(name != '')
+) STRICT, WITHOUT ROWID;
+
+-- The source of each referrer: the name of the group of the longest domain that the referrer is or
+-- is a subdomain of, so that www.google.com and google.com are both Google, or else the domain
+-- without www.
+CREATE VIEW referrer_sources AS
+SELECT referrers.referrer_id
+     , referrers.domain
+     , referrers.path
+     , COALESCE(
+           (
+               SELECT referrer_groups.name
+               FROM referrer_groups
+               WHERE referrers.domain = referrer_groups.domain
+                  OR substr(referrers.domain, -length(referrer_groups.domain) - 1) = '.' || referrer_groups.domain
+               ORDER BY length(referrer_groups.domain) DESC
+               LIMIT 1
+           ),
+           CASE WHEN referrers.domain LIKE 'www.%' THEN substr(referrers.domain, 5) ELSE referrers.domain END
+       ) AS source
+FROM referrers;
@@ -0,0 +1,7 @@
+-- The search terms of visitors who arrived from a search engine that put them in the referrer
+CREATE TABLE keywords (
+    keyword_id INTEGER PRIMARY KEY,
+    keyword    TEXT NOT NULL UNIQUE CHECK(keyword != '')
+) STRICT;
+
+ALTER TABLE hits ADD COLUMN keyword_id INTEGER REFERENCES keywords(keyword_id);
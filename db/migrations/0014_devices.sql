@@ -0,0 +1,3 @@
+-- Whether each hit was from a mobile, tablet or desktop, worked out from the user agent and the
+-- width of the screen when the hit was recorded
+ALTER TABLE hits ADD COLUMN device TEXT CHECK(device IN ('mobile', 'tablet', 'desktop'));
@@ -0,0 +1,2 @@
+-- The language that the visitor prefers after the language of language_id, from Accept-Language
+ALTER TABLE hits ADD COLUMN secondary_language_id INTEGER REFERENCES languages(language_id);
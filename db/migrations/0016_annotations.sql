@@ -0,0 +1,11 @@
+-- Notes on the traffic of a site at a time, such as "launched v2.0", which are returned with the
+-- pageviews of the day that they fall on
+CREATE TABLE annotations (
+    annotation_id INTEGER PRIMARY KEY,
+    site_id       INTEGER NOT NULL REFERENCES sites(site_id),
+    timestamp     INTEGER NOT NULL,
+    text          TEXT NOT NULL CHECK(text != ''),
+    created_at    INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+) STRICT;
+
+CREATE INDEX annotations_site_id_timestamp ON annotations (site_id, timestamp);
@@ -0,0 +1,19 @@
+-- Accounts that can log in to the dashboard, each with its own salted argon2id password hash. Viewers
+-- can only read the stats, while admins can also change them, such as by adding annotations. The
+-- generation is increased whenever the password changes, which logs out the sessions of the account.
+CREATE TABLE users_admin (
+    account_id    INTEGER PRIMARY KEY,
+    name          TEXT NOT NULL UNIQUE CHECK(name != ''),
+    password_hash TEXT NOT NULL,
+    password_salt TEXT NOT NULL,
+    role          TEXT NOT NULL CHECK(role IN ('admin', 'viewer')),
+    generation    INTEGER NOT NULL DEFAULT 1,
+    created_at    INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+) STRICT;
+
+-- The only sites that an account can see. An account without any can see all of them.
+CREATE TABLE users_admin_sites (
+    account_id INTEGER NOT NULL REFERENCES users_admin(account_id) ON DELETE CASCADE,
+    domain     TEXT NOT NULL CHECK(domain != '' AND lower(domain) = domain),
+    PRIMARY KEY (account_id, domain)
+) STRICT, WITHOUT ROWID;
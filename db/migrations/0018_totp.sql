@@ -0,0 +1,11 @@
+-- The base32 secret of the TOTP second factor of an account, if it has one, and the time step of the
+-- last code used, which cannot be used again
+ALTER TABLE users_admin ADD COLUMN totp_secret TEXT;
+ALTER TABLE users_admin ADD COLUMN totp_last_step INTEGER;
+
+-- Single-use codes for logging in to an account without its TOTP app. Only their hashes are stored.
+CREATE TABLE users_admin_recovery_codes (
+    account_id INTEGER NOT NULL REFERENCES users_admin(account_id) ON DELETE CASCADE,
+    hash       BLOB NOT NULL,
+    PRIMARY KEY (account_id, hash)
+) STRICT, WITHOUT ROWID;
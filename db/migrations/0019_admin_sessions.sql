@@ -0,0 +1,10 @@
+-- Logins to the dashboard, so that they can be ended on the server before their cookies expire. Only
+-- hashes of the session IDs in the cookies are stored. Sessions of the shared password have no account.
+CREATE TABLE admin_sessions (
+    hash       BLOB PRIMARY KEY,
+    account_id INTEGER REFERENCES users_admin(account_id) ON DELETE CASCADE,
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    expires_at INTEGER NOT NULL
+) STRICT, WITHOUT ROWID;
+
+CREATE INDEX admin_sessions_account_id ON admin_sessions(account_id);
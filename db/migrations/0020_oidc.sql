@@ -0,0 +1,4 @@
+-- The subject of the OpenID Connect provider that an account was created for, if it was
+ALTER TABLE users_admin ADD COLUMN oidc_subject TEXT;
+
+CREATE UNIQUE INDEX users_admin_oidc_subject ON users_admin(oidc_subject) WHERE oidc_subject IS NOT NULL;
@@ -0,0 +1,23 @@
+-- When each user was first seen, as the time of their first hit rather than when the row was
+-- written, as hits can be written late from the spool. A visitor is returning if they were first
+-- seen before the visit that a hit is in, and new otherwise. Users are shared between the sites, so
+-- a visitor of one site is returning when they first visit another.
+ALTER TABLE users ADD COLUMN created_at INTEGER;
+
+UPDATE users SET created_at = first.created_at
+FROM (SELECT user_id, MIN(timestamp) AS created_at FROM hits GROUP BY user_id) AS first
+WHERE users.user_id = first.user_id;
+
+UPDATE users SET created_at = first_seen WHERE created_at IS NULL;
+
+
+-- The pageviews and unique visitors of the totals from returning visitors. A visitor with hits from
+-- both their first visit and a later one in the same hour or day is returning. The rollups are
+-- recomputed from scratch by the aggregator as the tables are empty.
+DELETE FROM totals_hourly;
+DELETE FROM totals_daily;
+
+ALTER TABLE totals_hourly ADD COLUMN returning_pageviews INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE totals_hourly ADD COLUMN returning_visitors INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE totals_daily ADD COLUMN returning_pageviews INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE totals_daily ADD COLUMN returning_visitors INTEGER NOT NULL DEFAULT 0;
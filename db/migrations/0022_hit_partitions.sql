@@ -0,0 +1,25 @@
+-- Hits are kept in a table for each month, hits_YYYYMM, so that the hits of a month can be dropped
+-- all at once. The hits table becomes hits_template, which is always empty and whose schema new
+-- months are created with, and hits becomes a view of every month. The hits that have already been
+-- written are moved into their months when the database is next opened.
+
+-- Foreign keys cannot refer to a view, so the goals of the hits of a month are deleted when it is
+-- dropped instead
+CREATE TABLE goals_new (
+    goal   TEXT NOT NULL CHECK(goal != ''),
+    hit_id INTEGER NOT NULL,
+    PRIMARY KEY (goal, hit_id)
+) STRICT, WITHOUT ROWID;
+
+INSERT INTO goals_new (goal, hit_id) SELECT goal, hit_id FROM goals;
+DROP TABLE goals;
+ALTER TABLE goals_new RENAME TO goals;
+
+CREATE INDEX goals_hit_id ON goals (hit_id);
+
+
+ALTER TABLE hits RENAME TO hits_template;
+DROP INDEX hits_timestamp;
+DROP INDEX hits_site_timestamp;
+
+CREATE VIEW hits AS SELECT * FROM hits_template;
@@ -0,0 +1,3 @@
+-- Human-readable titles of pages, from the sitemaps of the sites or a mapping of paths to titles,
+-- which the dashboard shows instead of the paths
+ALTER TABLE paths ADD COLUMN title TEXT CHECK(title != '');
@@ -0,0 +1,4 @@
+-- Where the title of a page came from: the sitemap of the site, the configured mapping of paths to
+-- titles, or the page itself when it was loaded. The latest title that pages send replaces any but
+-- that of the mapping.
+ALTER TABLE paths ADD COLUMN title_source TEXT CHECK(title_source IN ('sitemap', 'mapping', 'page'));
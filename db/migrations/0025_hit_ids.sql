@@ -0,0 +1,14 @@
+-- The ID of the last hit that was written. IDs are not taken from the largest in the months of hits,
+-- as once every month has been dropped they would start again from 1, behind the session stitcher
+-- and clashing with the session pages that are left.
+CREATE TABLE hit_ids (
+    id          INTEGER PRIMARY KEY CHECK(id = 1),
+    last_hit_id INTEGER NOT NULL
+) STRICT;
+
+INSERT INTO hit_ids (id, last_hit_id)
+VALUES (1, MAX(
+    COALESCE((SELECT MAX(hit_id) FROM hits), 0),
+    COALESCE((SELECT MAX(hit_id) FROM session_pages), 0),
+    (SELECT last_hit_id FROM sessions_progress)
+));
@@ -0,0 +1,3 @@
+-- The time zone that the dashboard counts days in for an account, as an IANA name, instead of that
+-- of the dashboard.
+ALTER TABLE users_admin ADD COLUMN timezone TEXT CHECK(timezone != '');
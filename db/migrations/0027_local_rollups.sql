@@ -0,0 +1,46 @@
+-- The time zones other than UTC whose days are rolled up, which are those of the dashboard and of
+-- the accounts. Since is the first local midnight that has been rolled up, the first after the
+-- oldest hits when the time zone was first aggregated, and is NULL until then. Earlier days are
+-- counted from the UTC rollups.
+CREATE TABLE rollup_timezones (
+    timezone TEXT PRIMARY KEY CHECK(timezone != ''),
+    since    INTEGER
+) STRICT, WITHOUT ROWID;
+
+
+-- Rollups of the days of the time zones, like hits_daily and totals_daily, so that a visitor seen in
+-- several hours of a day is counted once rather than once for each hour
+CREATE TABLE hits_local_daily (
+    timezone    TEXT NOT NULL REFERENCES rollup_timezones(timezone) ON DELETE CASCADE,
+    day         INTEGER NOT NULL, -- Local midnight as a Unix timestamp
+    site_id     INTEGER NOT NULL REFERENCES sites(site_id),
+    path_id     INTEGER NOT NULL REFERENCES paths(path_id),
+    referrer_id INTEGER REFERENCES referrers(referrer_id),
+    country     TEXT,
+    browser_id  INTEGER REFERENCES browsers(browser_id),
+    bot         INTEGER NOT NULL CHECK(bot IN (0, 1)),
+    pageviews   INTEGER NOT NULL,
+    visitors    INTEGER NOT NULL
+) STRICT;
+
+CREATE INDEX hits_local_daily_timezone_site_day ON hits_local_daily (timezone, site_id, day);
+
+
+CREATE TABLE totals_local_daily (
+    timezone            TEXT NOT NULL REFERENCES rollup_timezones(timezone) ON DELETE CASCADE,
+    day                 INTEGER NOT NULL,
+    site_id             INTEGER NOT NULL REFERENCES sites(site_id),
+    bot                 INTEGER NOT NULL CHECK(bot IN (0, 1)),
+    pageviews           INTEGER NOT NULL,
+    visitors            INTEGER NOT NULL,
+    returning_pageviews INTEGER NOT NULL,
+    returning_visitors  INTEGER NOT NULL,
+    PRIMARY KEY (timezone, site_id, day, bot)
+) STRICT;
+
+
+-- Sketches of anonymous visitors are kept for each hour rather than each UTC day, so that they can
+-- be merged into the days of any time zone. The sketch of each earlier day stays in its first hour.
+ALTER TABLE visitor_sketches RENAME COLUMN day TO hour;
+
+CREATE INDEX visitor_sketches_hour ON visitor_sketches (hour);
@@ -0,0 +1,3 @@
+-- The user of every hit of a visitor without identifiers, with anonymous_visitors, instead of a new
+-- user for each hit. It was never first seen, so its hits are never from returning visitors.
+INSERT INTO users (user_id, identifier, first_seen, last_seen, created_at) VALUES (0, NULL, 0, 0, NULL);
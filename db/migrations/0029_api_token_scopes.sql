@@ -0,0 +1,10 @@
+-- What API tokens can do, as for accounts. Viewers can only read the stats, while admins can also
+-- change them and erase visitors. The tokens that there were already keep being able to do anything.
+ALTER TABLE api_tokens ADD COLUMN role TEXT NOT NULL DEFAULT 'admin' CHECK(role IN ('admin', 'viewer'));
+
+-- The only sites that an API token can see. A token without any can see all of them.
+CREATE TABLE api_token_sites (
+    token_id INTEGER NOT NULL REFERENCES api_tokens(token_id) ON DELETE CASCADE,
+    domain   TEXT NOT NULL CHECK(domain != '' AND lower(domain) = domain),
+    PRIMARY KEY (token_id, domain)
+) STRICT, WITHOUT ROWID;
@@ -0,0 +1,19 @@
+-- Bot traffic by user agent on :site between :start_date and :end_date (inclusive, in :timezone). The bot
+-- score is the highest of the user agent and IP address range or Javascript checks.
+SELECT json_group_array(json_object('user_agent', user_agent, 'bot', bot, 'hits', hits, 'pageviews', pageviews, 'visitors', visitors))
+FROM (
+    SELECT user_agents.user_agent
+         , MAX(COALESCE(hits.bot, 0), user_agents.bot) AS bot
+         , COUNT(*) AS hits
+         , SUM(hits.event = 'l') AS pageviews
+         , COUNT(DISTINCT hits.user_id) AS visitors
+    FROM hits
+    INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+    WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND hits.timestamp >= :start
+      AND hits.timestamp < :end
+      AND (COALESCE(hits.bot, 0) >= 2 OR user_agents.bot >= 2)
+    GROUP BY hits.user_agent_id
+    ORDER BY hits DESC
+    LIMIT 100
+);
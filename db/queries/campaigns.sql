@@ -0,0 +1,31 @@
+-- Top UTM campaigns on :site between :start_date and :end_date (inclusive, in :timezone).
+-- Bots are excluded unless :include_bots is true.
+SELECT json_group_array(json_object(
+    'source', source,
+    'medium', medium,
+    'campaign', campaign,
+    'term', term,
+    'content', content,
+    'pageviews', pageviews,
+    'visitors', visitors
+))
+FROM (
+    SELECT campaigns.source
+         , campaigns.medium
+         , campaigns.campaign
+         , campaigns.term
+         , campaigns.content
+         , COUNT(*) AS pageviews
+         , COUNT(DISTINCT hits.user_id) AS visitors
+    FROM hits
+    INNER JOIN campaigns ON hits.campaign_id = campaigns.campaign_id
+    INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+    WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND hits.event = 'l'
+      AND hits.timestamp >= :start
+      AND hits.timestamp < :end
+      AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+    GROUP BY hits.campaign_id
+    ORDER BY pageviews DESC
+    LIMIT 100
+);
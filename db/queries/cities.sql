@@ -0,0 +1,34 @@
+-- Pageviews by city in :region on :site between :start_date and :end_date (inclusive, in
+-- :timezone). The region is a country or a subdivision given by its ISO code, such as GB or GB-ENG,
+-- and hits from it without a known city have a null one. Bots are excluded unless :include_bots is
+-- true.
+WITH RECURSIVE
+    tree(location_id, country, subdivision, city) AS (
+        SELECT location_id, country, NULL, NULL
+        FROM locations
+        WHERE country = :region OR :region LIKE country || '-%'
+        UNION ALL
+        SELECT locations.location_id
+             , tree.country
+             , COALESCE(tree.subdivision, locations.subdivision)
+             , COALESCE(tree.city, locations.city)
+        FROM locations INNER JOIN tree ON locations.parent_id = tree.location_id
+    )
+SELECT json_group_array(json_object('city', city, 'pageviews', pageviews, 'visitors', visitors))
+FROM (
+    SELECT tree.city
+         , COUNT(*) AS pageviews
+         , COUNT(DISTINCT hits.user_id) AS visitors
+    FROM hits
+    INNER JOIN tree ON hits.location_id = tree.location_id
+    INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+    WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND hits.event = 'l'
+      AND hits.timestamp >= :start
+      AND hits.timestamp < :end
+      AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+      AND (tree.country = :region OR tree.country || '-' || tree.subdivision = :region)
+    GROUP BY tree.city
+    ORDER BY pageviews DESC, tree.city
+    LIMIT 100
+);
@@ -0,0 +1,20 @@
+-- Most clicked outbound links and downloads on :site between :start_date and :end_date (inclusive, in :timezone).
+-- Bots are excluded unless :include_bots is true.
+SELECT json_group_array(json_object('url', url, 'type', type, 'clicks', clicks, 'visitors', visitors))
+FROM (
+    SELECT targets.url
+         , CASE hits.event WHEN 'o' THEN 'outbound' ELSE 'download' END AS type
+         , COUNT(*) AS clicks
+         , COUNT(DISTINCT hits.user_id) AS visitors
+    FROM hits
+    INNER JOIN targets ON hits.target_id = targets.target_id
+    INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+    WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND hits.event IN ('o', 'd')
+      AND hits.timestamp >= :start
+      AND hits.timestamp < :end
+      AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+    GROUP BY hits.target_id, hits.event
+    ORDER BY clicks DESC
+    LIMIT 100
+);
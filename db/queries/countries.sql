@@ -0,0 +1,31 @@
+-- Pageviews by country on :site between :start_date and :end_date (inclusive, in :timezone), from
+-- the daily rollups of :zone once it has them, and before then from the UTC daily or hourly ones as
+-- in pages.sql. Bots are excluded unless :include_bots is true.
+WITH local AS (
+    SELECT MAX(:start, MIN(:end, COALESCE((SELECT since FROM rollup_timezones WHERE timezone = :zone), :end))) AS since
+)
+SELECT json_group_array(json_object('country', country, 'pageviews', pageviews, 'visitors', visitors))
+FROM (
+    SELECT rollup.country
+         , SUM(rollup.pageviews) AS pageviews
+         , SUM(rollup.visitors) AS visitors
+    FROM (
+        SELECT site_id, country, bot, pageviews, visitors
+        FROM hits_local_daily
+        WHERE timezone = :zone AND day >= (SELECT since FROM local) AND day < :end
+        UNION ALL
+        SELECT site_id, country, bot, pageviews, visitors
+        FROM hits_daily
+        WHERE :start % 86400 = 0 AND (SELECT since FROM local) % 86400 = 0
+          AND day >= :start AND day < (SELECT since FROM local)
+        UNION ALL
+        SELECT site_id, country, bot, pageviews, visitors
+        FROM hits_hourly
+        WHERE (:start % 86400 != 0 OR (SELECT since FROM local) % 86400 != 0)
+          AND hour >= :start AND hour < (SELECT since FROM local)
+    ) AS rollup
+    WHERE rollup.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND (:include_bots OR rollup.bot = 0)
+    GROUP BY rollup.country
+    ORDER BY pageviews DESC
+);
@@ -0,0 +1,25 @@
+-- The share of visitors using a mobile, tablet or desktop on :site between :start_date and
+-- :end_date (inclusive, in :timezone), as a percentage of the visitors whose device is known. Bots
+-- are excluded unless :include_bots is true.
+SELECT json_group_array(json_object('device', device, 'pageviews', pageviews, 'visitors', visitors, 'share', share))
+FROM (
+    SELECT device
+         , pageviews
+         , visitors
+         , ROUND(100.0 * visitors / SUM(visitors) OVER (), 1) AS share
+    FROM (
+        SELECT hits.device
+             , COUNT(*) AS pageviews
+             , COUNT(DISTINCT hits.user_id) AS visitors
+        FROM hits
+        INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+        WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+          AND hits.event = 'l'
+          AND hits.device IS NOT NULL
+          AND hits.timestamp >= :start
+          AND hits.timestamp < :end
+          AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+        GROUP BY hits.device
+    )
+    ORDER BY visitors DESC, device
+);
@@ -0,0 +1,22 @@
+-- Average scroll depth (as a percentage) and engaged time (in seconds) for the pages on :site between
+-- :start_date and :end_date (inclusive, in :timezone). Only page hides sent with engagement tracking enabled
+-- are counted. Bots are excluded unless :include_bots is true.
+SELECT json_group_array(json_object('path', path, 'scroll_depth', scroll_depth, 'engaged_seconds', engaged_seconds, 'views', views))
+FROM (
+    SELECT paths.path
+         , AVG(hits.scroll_depth) AS scroll_depth
+         , AVG(hits.engaged_seconds) AS engaged_seconds
+         , COUNT(*) AS views
+    FROM hits
+    INNER JOIN paths ON hits.path_id = paths.path_id
+    INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+    WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND hits.event = 'h'
+      AND hits.scroll_depth IS NOT NULL
+      AND hits.timestamp >= :start
+      AND hits.timestamp < :end
+      AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+    GROUP BY hits.path_id
+    ORDER BY views DESC
+    LIMIT 100
+);
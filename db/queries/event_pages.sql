@@ -0,0 +1,21 @@
+-- The pages of :site that the custom event :event was sent from between :start_date and :end_date
+-- (inclusive, in :timezone), how many times and by how many visitors. Bots are excluded unless
+-- :include_bots is true.
+SELECT json_group_array(json_object('path', path, 'events', events, 'visitors', visitors))
+FROM (
+    SELECT paths.path
+         , COUNT(*) AS events
+         , COUNT(DISTINCT hits.user_id) AS visitors
+    FROM hits
+    INNER JOIN paths ON hits.path_id = paths.path_id
+    INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+    WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND hits.event = 'c'
+      AND hits.event_name_id = (SELECT event_name_id FROM event_names WHERE name = :event)
+      AND hits.timestamp >= :start
+      AND hits.timestamp < :end
+      AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+    GROUP BY hits.path_id
+    ORDER BY events DESC, paths.path
+    LIMIT 100
+);
@@ -0,0 +1,32 @@
+-- Custom events sent on :site between :start_date and :end_date (inclusive, in :timezone), by name:
+-- how many times each was sent, the number of visitors who sent it and the conversion rate, the
+-- percentage of the visitors with a page load in the period who did. Bots are excluded unless
+-- :include_bots is true.
+WITH visitors AS (
+    SELECT DISTINCT hits.user_id
+    FROM hits
+    INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+    WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND hits.event = 'l'
+      AND hits.timestamp >= :start
+      AND hits.timestamp < :end
+      AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+)
+SELECT json_group_array(json_object('name', name, 'events', events, 'visitors', visitors, 'conversion_rate', conversion_rate))
+FROM (
+    SELECT event_names.name
+         , COUNT(*) AS events
+         , COUNT(DISTINCT hits.user_id) AS visitors
+         , ROUND(100.0 * COUNT(DISTINCT hits.user_id) / MAX((SELECT COUNT(*) FROM visitors), 1), 1) AS conversion_rate
+    FROM hits
+    INNER JOIN event_names ON hits.event_name_id = event_names.event_name_id
+    INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+    WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND hits.event = 'c'
+      AND hits.timestamp >= :start
+      AND hits.timestamp < :end
+      AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+    GROUP BY hits.event_name_id
+    ORDER BY events DESC, event_names.name
+    LIMIT 100
+);
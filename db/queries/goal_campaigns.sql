@@ -0,0 +1,46 @@
+-- Conversion rate of each goal by UTM campaign on :site between :start_date and :end_date
+-- (inclusive, in :timezone): of the visitors who arrived with each source, medium and campaign, the
+-- percentage who completed the goal in the period. Only goals completed in the period are included.
+-- Bots are excluded unless :include_bots is true.
+WITH arrivals AS (
+    SELECT DISTINCT campaigns.source, campaigns.medium, campaigns.campaign, hits.user_id
+    FROM hits
+    INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+    INNER JOIN campaigns ON hits.campaign_id = campaigns.campaign_id
+    WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND hits.event = 'l'
+      AND hits.timestamp >= :start
+      AND hits.timestamp < :end
+      AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+),
+completions AS (
+    SELECT DISTINCT goals.goal, hits.user_id
+    FROM goals
+    INNER JOIN hits ON goals.hit_id = hits.hit_id
+    WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND hits.timestamp >= :start
+      AND hits.timestamp < :end
+)
+SELECT json_group_array(json_object(
+    'goal', goal,
+    'source', source,
+    'medium', medium,
+    'campaign', campaign,
+    'visitors', visitors,
+    'conversions', conversions,
+    'conversion_rate', conversion_rate
+))
+FROM (
+    SELECT goal_names.goal
+         , arrivals.source
+         , arrivals.medium
+         , arrivals.campaign
+         , COUNT(*) AS visitors
+         , COUNT(completions.user_id) AS conversions
+         , ROUND(100.0 * COUNT(completions.user_id) / COUNT(*), 1) AS conversion_rate
+    FROM (SELECT DISTINCT goal FROM completions) AS goal_names
+    CROSS JOIN arrivals
+    LEFT JOIN completions ON completions.goal = goal_names.goal AND completions.user_id = arrivals.user_id
+    GROUP BY goal_names.goal, arrivals.source, arrivals.medium, arrivals.campaign
+    ORDER BY goal_names.goal, conversions DESC, visitors DESC
+);
@@ -0,0 +1,42 @@
+-- Conversion rate of each goal by referring domain on :site between :start_date and :end_date
+-- (inclusive, in :timezone): of the visitors whose first page load in the period came from each
+-- domain, or directly if the domain is null, the percentage who completed the goal in the period. Only goals completed in the period
+-- are included. Bots are excluded unless :include_bots is true.
+WITH arrivals AS (
+    SELECT domain, user_id
+    FROM (
+        SELECT referrers.domain
+             , hits.user_id
+             , ROW_NUMBER() OVER (PARTITION BY hits.user_id ORDER BY hits.timestamp, hits.hit_id) AS arrival
+        FROM hits
+        INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+        LEFT JOIN referrers ON hits.referrer_id = referrers.referrer_id
+        WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+          AND hits.event = 'l'
+          AND hits.timestamp >= :start
+          AND hits.timestamp < :end
+          AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+    )
+    WHERE arrival = 1
+),
+completions AS (
+    SELECT DISTINCT goals.goal, hits.user_id
+    FROM goals
+    INNER JOIN hits ON goals.hit_id = hits.hit_id
+    WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND hits.timestamp >= :start
+      AND hits.timestamp < :end
+)
+SELECT json_group_array(json_object('goal', goal, 'domain', domain, 'visitors', visitors, 'conversions', conversions, 'conversion_rate', conversion_rate))
+FROM (
+    SELECT goal_names.goal
+         , arrivals.domain
+         , COUNT(*) AS visitors
+         , COUNT(completions.user_id) AS conversions
+         , ROUND(100.0 * COUNT(completions.user_id) / COUNT(*), 1) AS conversion_rate
+    FROM (SELECT DISTINCT goal FROM completions) AS goal_names
+    CROSS JOIN arrivals
+    LEFT JOIN completions ON completions.goal = goal_names.goal AND completions.user_id = arrivals.user_id
+    GROUP BY goal_names.goal, arrivals.domain
+    ORDER BY goal_names.goal, conversions DESC, visitors DESC
+);
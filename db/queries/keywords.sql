@@ -0,0 +1,26 @@
+-- Top search terms for each path on :site between :start_date and :end_date (inclusive, in
+-- :timezone): the ten search terms with the most page loads for each path, and the visitors who
+-- searched for them. Bots are excluded unless :include_bots is true.
+SELECT json_group_array(json_object('path', path, 'keyword', keyword, 'pageviews', pageviews, 'visitors', visitors))
+FROM (
+    SELECT path, keyword, pageviews, visitors
+    FROM (
+        SELECT paths.path
+             , keywords.keyword
+             , COUNT(*) AS pageviews
+             , COUNT(DISTINCT hits.user_id) AS visitors
+             , ROW_NUMBER() OVER (PARTITION BY paths.path ORDER BY COUNT(*) DESC, keywords.keyword) AS rank
+        FROM hits
+        INNER JOIN keywords ON hits.keyword_id = keywords.keyword_id
+        INNER JOIN paths ON hits.path_id = paths.path_id
+        INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+        WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+          AND hits.event = 'l'
+          AND hits.timestamp >= :start
+          AND hits.timestamp < :end
+          AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+        GROUP BY paths.path, keywords.keyword
+    )
+    WHERE rank <= 10
+    ORDER BY path, pageviews DESC, keyword
+);
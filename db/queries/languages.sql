@@ -0,0 +1,24 @@
+-- Visitors to :site between :start_date and :end_date (inclusive, in :timezone) by the language
+-- that they prefer, and how many more prefer it second. Bots are excluded unless :include_bots is
+-- true.
+SELECT json_group_array(json_object('language', language, 'name', name, 'visitors', visitors, 'secondary_visitors', secondary_visitors))
+FROM (
+    SELECT languages.iso_639_3 AS language
+         , languages.name
+         , COUNT(DISTINCT CASE WHEN filtered.language_id = languages.language_id THEN filtered.user_id END) AS visitors
+         , COUNT(DISTINCT CASE WHEN filtered.secondary_language_id = languages.language_id THEN filtered.user_id END) AS secondary_visitors
+    FROM (
+        SELECT hits.user_id, hits.language_id, hits.secondary_language_id
+        FROM hits
+        INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+        WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+          AND hits.event = 'l'
+          AND hits.timestamp >= :start
+          AND hits.timestamp < :end
+          AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+    ) AS filtered
+    INNER JOIN languages ON languages.language_id IN (filtered.language_id, filtered.secondary_language_id)
+    GROUP BY languages.language_id
+    ORDER BY visitors DESC, secondary_visitors DESC, languages.iso_639_3
+    LIMIT 100
+);
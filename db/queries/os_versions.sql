@@ -0,0 +1,40 @@
+-- Visitors to :site between :start_date and :end_date (inclusive, in :timezone) by operating
+-- system and major version, such as 15 for iOS 15.5, with their share of all visitors as a
+-- percentage. The ten with the most visitors are listed and the rest are put together as Other.
+-- Bots are excluded unless :include_bots is true.
+WITH
+    filtered AS (
+        SELECT hits.user_id
+             , oss.os_name AS os
+             , CASE
+                   WHEN instr(oss.os_version, '.') > 0 THEN substr(oss.os_version, 1, instr(oss.os_version, '.') - 1)
+                   ELSE oss.os_version
+               END AS version
+        FROM hits
+        INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+        LEFT JOIN oss ON user_agents.os_id = oss.os_id
+        WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+          AND hits.event = 'l'
+          AND hits.timestamp >= :start
+          AND hits.timestamp < :end
+          AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+    ),
+    ranked AS (
+        SELECT os
+             , version
+             , ROW_NUMBER() OVER (ORDER BY COUNT(DISTINCT user_id) DESC, COUNT(*) DESC, os NULLS LAST, CAST(version AS INTEGER) DESC, version) AS rank
+        FROM filtered
+        GROUP BY os, version
+    )
+SELECT json_group_array(json_object('os', os, 'version', version, 'pageviews', pageviews, 'visitors', visitors, 'share', share))
+FROM (
+    SELECT CASE WHEN ranked.rank <= 10 THEN filtered.os ELSE 'Other' END AS os
+         , CASE WHEN ranked.rank <= 10 THEN filtered.version END AS version
+         , COUNT(*) AS pageviews
+         , COUNT(DISTINCT filtered.user_id) AS visitors
+         , ROUND(100.0 * COUNT(DISTINCT filtered.user_id) / (SELECT COUNT(DISTINCT user_id) FROM filtered), 1) AS share
+    FROM filtered
+    INNER JOIN ranked ON filtered.os IS ranked.os AND filtered.version IS ranked.version
+    GROUP BY CASE WHEN ranked.rank <= 10 THEN ranked.rank ELSE 11 END
+    ORDER BY MIN(ranked.rank)
+);
@@ -0,0 +1,38 @@
+-- Most viewed pages on :site between :start_date and :end_date (inclusive, in :timezone). The days
+-- of :zone are counted from its own daily rollups once it has them. Before then, the UTC daily
+-- rollups are used if the days start at UTC midnights, and otherwise the hourly ones, which count a
+-- visitor seen in several hours of a day once for each of them.
+-- Bots are excluded unless :include_bots is true. The pages are paged with :limit and :offset, and only
+-- those whose path or title matches the LIKE pattern :search are included unless it is NULL.
+WITH local AS (
+    SELECT MAX(:start, MIN(:end, COALESCE((SELECT since FROM rollup_timezones WHERE timezone = :zone), :end))) AS since
+)
+SELECT json_group_array(json_object('path', path, 'title', title, 'pageviews', pageviews, 'visitors', visitors))
+FROM (
+    SELECT paths.path
+         , paths.title
+         , SUM(rollup.pageviews) AS pageviews
+         , SUM(rollup.visitors) AS visitors
+    FROM (
+        SELECT site_id, path_id, bot, pageviews, visitors
+        FROM hits_local_daily
+        WHERE timezone = :zone AND day >= (SELECT since FROM local) AND day < :end
+        UNION ALL
+        SELECT site_id, path_id, bot, pageviews, visitors
+        FROM hits_daily
+        WHERE :start % 86400 = 0 AND (SELECT since FROM local) % 86400 = 0
+          AND day >= :start AND day < (SELECT since FROM local)
+        UNION ALL
+        SELECT site_id, path_id, bot, pageviews, visitors
+        FROM hits_hourly
+        WHERE (:start % 86400 != 0 OR (SELECT since FROM local) % 86400 != 0)
+          AND hour >= :start AND hour < (SELECT since FROM local)
+    ) AS rollup
+    INNER JOIN paths ON rollup.path_id = paths.path_id
+    WHERE rollup.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND (:include_bots OR rollup.bot = 0)
+      AND (:search IS NULL OR paths.path LIKE :search ESCAPE '\' OR paths.title LIKE :search ESCAPE '\')
+    GROUP BY rollup.path_id
+    ORDER BY pageviews DESC, paths.path
+    LIMIT :limit OFFSET :offset
+);
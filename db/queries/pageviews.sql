@@ -0,0 +1,67 @@
+-- Pageviews and unique visitors for each day on :site between :start_date and :end_date (inclusive,
+-- in :timezone). :days has the UTC timestamps that each day starts and ends at, which differ by 23 or
+-- 25 hours when the clocks change. The days of :zone are counted from its own daily rollups once it
+-- has them. Before then, the UTC daily rollups are used if every day is a UTC day, and otherwise the
+-- hourly ones, which count a visitor seen in several hours of a day once for each of them.
+-- Bots are excluded unless :include_bots is true. The visitors are split into new ones and returning
+-- ones, who had visited before. Each day has the annotations that fall on it, and a
+-- day without pageviews is only included if it has some.
+WITH days AS (
+    SELECT json_extract(value, '$.date') AS date
+         , json_extract(value, '$.start') AS day_start
+         , json_extract(value, '$.end') AS day_end
+    FROM json_each(:days)
+),
+local AS (
+    SELECT MAX(:start, MIN(:end, COALESCE((SELECT since FROM rollup_timezones WHERE timezone = :zone), :end))) AS since
+),
+utc AS (
+    SELECT COUNT(*) = 0 AS utc FROM days WHERE day_start % 86400 != 0 OR day_end % 86400 != 0
+),
+totals AS (
+    SELECT day AS timestamp, site_id, bot, pageviews, visitors, returning_visitors
+    FROM totals_local_daily
+    WHERE timezone = :zone AND day >= (SELECT since FROM local) AND day < :end
+    UNION ALL
+    SELECT day, site_id, bot, pageviews, visitors, returning_visitors
+    FROM totals_daily
+    WHERE (SELECT utc FROM utc)
+      AND day >= :start AND day < (SELECT since FROM local)
+    UNION ALL
+    SELECT hour, site_id, bot, pageviews, visitors, returning_visitors
+    FROM totals_hourly
+    WHERE NOT (SELECT utc FROM utc)
+      AND hour >= :start AND hour < (SELECT since FROM local)
+)
+SELECT json_group_array(json_object(
+    'date', date,
+    'pageviews', pageviews,
+    'visitors', visitors,
+    'new_visitors', visitors - returning_visitors,
+    'returning_visitors', returning_visitors,
+    'annotations', json(annotations)
+))
+FROM (
+    SELECT days.date
+         , COALESCE(SUM(totals.pageviews), 0) AS pageviews
+         , COALESCE(SUM(totals.visitors), 0) AS visitors
+         , COALESCE(SUM(totals.returning_visitors), 0) AS returning_visitors
+         , (
+            SELECT json_group_array(json_object('time', strftime('%Y-%m-%dT%H:%M:%SZ', time, 'unixepoch'), 'text', text))
+            FROM (
+                SELECT annotations.timestamp AS time, annotations.text
+                FROM annotations
+                WHERE annotations.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+                  AND annotations.timestamp >= days.day_start
+                  AND annotations.timestamp < days.day_end
+                ORDER BY annotations.timestamp, annotations.annotation_id
+            )
+         ) AS annotations
+    FROM days
+    LEFT JOIN totals ON totals.timestamp >= days.day_start AND totals.timestamp < days.day_end
+                    AND totals.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+                    AND (:include_bots OR totals.bot = 0)
+    GROUP BY days.date, days.day_start, days.day_end
+    HAVING COUNT(totals.timestamp) > 0 OR annotations != '[]'
+    ORDER BY days.date
+);
@@ -0,0 +1,51 @@
+-- The median and 95th percentile time to first byte, DOMContentLoaded and load, in milliseconds, for
+-- the pages on :site between :start_date and :end_date (inclusive, in :timezone). Only page hides sent with
+-- performance tracking enabled are counted. Bots are excluded unless :include_bots is true.
+WITH timings AS (
+    SELECT hits.path_id
+         , hits.ttfb_ms
+         , hits.dom_content_loaded_ms
+         , hits.load_ms
+         , COUNT(*) OVER (PARTITION BY hits.path_id) AS views
+         , ROW_NUMBER() OVER (PARTITION BY hits.path_id ORDER BY hits.ttfb_ms) AS ttfb_rank
+         , ROW_NUMBER() OVER (PARTITION BY hits.path_id ORDER BY hits.dom_content_loaded_ms) AS dom_content_loaded_rank
+         , ROW_NUMBER() OVER (PARTITION BY hits.path_id ORDER BY hits.load_ms) AS load_rank
+    FROM hits
+    INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+    WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND hits.event = 'h'
+      AND hits.load_ms IS NOT NULL
+      AND hits.timestamp >= :start
+      AND hits.timestamp < :end
+      AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+),
+-- The nearest rank of the pth percentile of n values is ceil(n * p / 100)
+percentiles AS (
+    SELECT path_id
+         , views
+         , MAX(CASE WHEN ttfb_rank = (views * 50 + 99) / 100 THEN ttfb_ms END) AS ttfb_p50
+         , MAX(CASE WHEN ttfb_rank = (views * 95 + 99) / 100 THEN ttfb_ms END) AS ttfb_p95
+         , MAX(CASE WHEN dom_content_loaded_rank = (views * 50 + 99) / 100 THEN dom_content_loaded_ms END) AS dom_content_loaded_p50
+         , MAX(CASE WHEN dom_content_loaded_rank = (views * 95 + 99) / 100 THEN dom_content_loaded_ms END) AS dom_content_loaded_p95
+         , MAX(CASE WHEN load_rank = (views * 50 + 99) / 100 THEN load_ms END) AS load_p50
+         , MAX(CASE WHEN load_rank = (views * 95 + 99) / 100 THEN load_ms END) AS load_p95
+    FROM timings
+    GROUP BY path_id
+)
+SELECT json_group_array(json_object(
+    'path', path,
+    'views', views,
+    'ttfb_p50', ttfb_p50,
+    'ttfb_p95', ttfb_p95,
+    'dom_content_loaded_p50', dom_content_loaded_p50,
+    'dom_content_loaded_p95', dom_content_loaded_p95,
+    'load_p50', load_p50,
+    'load_p95', load_p95
+))
+FROM (
+    SELECT paths.path, percentiles.*
+    FROM percentiles
+    INNER JOIN paths ON percentiles.path_id = paths.path_id
+    ORDER BY views DESC
+    LIMIT 100
+);
@@ -0,0 +1,34 @@
+-- Top referrer sources on :site between :start_date and :end_date (inclusive, in :timezone), with
+-- referrers grouped by the referrer_sources view, so that t.co and twitter.com are both Twitter.
+-- As in pages.sql, the daily rollups of :zone are used once it has them, and before then the UTC
+-- daily or hourly ones. Bots are excluded unless :include_bots is true.
+WITH local AS (
+    SELECT MAX(:start, MIN(:end, COALESCE((SELECT since FROM rollup_timezones WHERE timezone = :zone), :end))) AS since
+)
+SELECT json_group_array(json_object('source', source, 'pageviews', pageviews, 'visitors', visitors))
+FROM (
+    SELECT referrer_sources.source
+         , SUM(rollup.pageviews) AS pageviews
+         , SUM(rollup.visitors) AS visitors
+    FROM (
+        SELECT site_id, referrer_id, bot, pageviews, visitors
+        FROM hits_local_daily
+        WHERE timezone = :zone AND day >= (SELECT since FROM local) AND day < :end
+        UNION ALL
+        SELECT site_id, referrer_id, bot, pageviews, visitors
+        FROM hits_daily
+        WHERE :start % 86400 = 0 AND (SELECT since FROM local) % 86400 = 0
+          AND day >= :start AND day < (SELECT since FROM local)
+        UNION ALL
+        SELECT site_id, referrer_id, bot, pageviews, visitors
+        FROM hits_hourly
+        WHERE (:start % 86400 != 0 OR (SELECT since FROM local) % 86400 != 0)
+          AND hour >= :start AND hour < (SELECT since FROM local)
+    ) AS rollup
+    INNER JOIN referrer_sources ON rollup.referrer_id = referrer_sources.referrer_id
+    WHERE rollup.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND (:include_bots OR rollup.bot = 0)
+    GROUP BY referrer_sources.source
+    ORDER BY pageviews DESC, referrer_sources.source
+    LIMIT 100
+);
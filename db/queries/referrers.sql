@@ -0,0 +1,37 @@
+-- Top referrers on :site between :start_date and :end_date (inclusive, in :timezone). The days of
+-- :zone are counted from its own daily rollups once it has them, and before then from the UTC daily
+-- rollups if the days start at UTC midnights, or otherwise the hourly ones.
+-- Bots are excluded unless :include_bots is true. The referrers are paged with :limit and :offset, and
+-- only those whose domain and path match the LIKE pattern :search are included unless it is NULL.
+WITH local AS (
+    SELECT MAX(:start, MIN(:end, COALESCE((SELECT since FROM rollup_timezones WHERE timezone = :zone), :end))) AS since
+)
+SELECT json_group_array(json_object('domain', domain, 'path', path, 'pageviews', pageviews, 'visitors', visitors))
+FROM (
+    SELECT referrers.domain
+         , referrers.path
+         , SUM(rollup.pageviews) AS pageviews
+         , SUM(rollup.visitors) AS visitors
+    FROM (
+        SELECT site_id, referrer_id, bot, pageviews, visitors
+        FROM hits_local_daily
+        WHERE timezone = :zone AND day >= (SELECT since FROM local) AND day < :end
+        UNION ALL
+        SELECT site_id, referrer_id, bot, pageviews, visitors
+        FROM hits_daily
+        WHERE :start % 86400 = 0 AND (SELECT since FROM local) % 86400 = 0
+          AND day >= :start AND day < (SELECT since FROM local)
+        UNION ALL
+        SELECT site_id, referrer_id, bot, pageviews, visitors
+        FROM hits_hourly
+        WHERE (:start % 86400 != 0 OR (SELECT since FROM local) % 86400 != 0)
+          AND hour >= :start AND hour < (SELECT since FROM local)
+    ) AS rollup
+    INNER JOIN referrers ON rollup.referrer_id = referrers.referrer_id
+    WHERE rollup.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND (:include_bots OR rollup.bot = 0)
+      AND (:search IS NULL OR referrers.domain || COALESCE(referrers.path, '') LIKE :search ESCAPE '\')
+    GROUP BY rollup.referrer_id
+    ORDER BY pageviews DESC, referrers.domain, referrers.path
+    LIMIT :limit OFFSET :offset
+);
@@ -0,0 +1,22 @@
+-- The twenty most common screen resolutions, in CSS pixels, of visitors to :site between
+-- :start_date and :end_date (inclusive, in :timezone), with the device class of each. Bots are
+-- excluded unless :include_bots is true.
+SELECT json_group_array(json_object('width', width, 'height', height, 'device', device, 'pageviews', pageviews, 'visitors', visitors))
+FROM (
+    SELECT displays.screen_width AS width
+         , displays.screen_height AS height
+         , hits.device
+         , COUNT(*) AS pageviews
+         , COUNT(DISTINCT hits.user_id) AS visitors
+    FROM hits
+    INNER JOIN displays ON hits.display_id = displays.display_id
+    INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+    WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND hits.event = 'l'
+      AND hits.timestamp >= :start
+      AND hits.timestamp < :end
+      AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+    GROUP BY displays.screen_width, displays.screen_height, hits.device
+    ORDER BY visitors DESC, pageviews DESC, width DESC, height DESC
+    LIMIT 20
+);
@@ -0,0 +1,38 @@
+-- New and returning visitors by referrer source on :site between :start_date and :end_date
+-- (inclusive, in :timezone), with referrers grouped as in referrer_sources and direct visits as a
+-- null source. A page load is from a returning visitor if they had a visit before the one it is in,
+-- as in the totals rollups. Visitors are counted as returning if any of their page loads were. Bots
+-- are excluded unless :include_bots is true.
+SELECT json_group_array(json_object(
+    'source', source,
+    'new_pageviews', pageviews - returning_pageviews,
+    'returning_pageviews', returning_pageviews,
+    'new_visitors', visitors - returning_visitors,
+    'returning_visitors', returning_visitors
+))
+FROM (
+    SELECT referrer_sources.source
+         , COUNT(*) AS pageviews
+         , SUM(returned) AS returning_pageviews
+         , COUNT(DISTINCT user_id) AS visitors
+         , COUNT(DISTINCT CASE WHEN returned THEN user_id END) AS returning_visitors
+    FROM (
+        SELECT hits.referrer_id
+             , hits.user_id
+             , COALESCE(users.created_at < COALESCE(sessions.started, hits.timestamp) - 1800, 0) AS returned
+        FROM hits
+        INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+        INNER JOIN users ON hits.user_id = users.user_id
+        LEFT JOIN session_pages ON hits.hit_id = session_pages.hit_id
+        LEFT JOIN sessions ON session_pages.session_id = sessions.session_id
+        WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+          AND hits.event = 'l'
+          AND hits.timestamp >= :start
+          AND hits.timestamp < :end
+          AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+    ) AS page_loads
+    LEFT JOIN referrer_sources ON page_loads.referrer_id = referrer_sources.referrer_id
+    GROUP BY referrer_sources.source
+    ORDER BY pageviews DESC, referrer_sources.source
+    LIMIT 100
+);
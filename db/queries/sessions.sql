@@ -0,0 +1,13 @@
+-- Number of visits, bounce rate and average visit duration (in seconds) on :site for visits that
+-- started between :start_date and :end_date (inclusive, in :timezone). A bounce is a visit with one pageview.
+-- Bots are excluded unless :include_bots is true.
+SELECT json_object(
+    'visits', COUNT(*),
+    'bounce_rate', AVG(pageviews = 1),
+    'average_duration', AVG(duration)
+)
+FROM sessions
+WHERE site_id = (SELECT site_id FROM sites WHERE domain = :site)
+  AND started >= :start
+  AND started < :end
+  AND (:include_bots OR bot = 0);
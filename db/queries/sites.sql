@@ -0,0 +1,9 @@
+-- All sites that have been visited. Sites only visited by bots are excluded unless :include_bots is
+-- true.
+SELECT json_group_array(domain)
+FROM (
+    SELECT domain
+    FROM sites
+    WHERE :include_bots OR EXISTS (SELECT 1 FROM totals_daily WHERE totals_daily.site_id = sites.site_id AND bot = 0)
+    ORDER BY domain
+);
@@ -0,0 +1,27 @@
+-- Pageviews by subdivision of :country, such as the states of the US, on :site between :start_date
+-- and :end_date (inclusive, in :timezone). Subdivisions are given by their ISO 3166-2 codes, such as
+-- US-CA, and hits from the country without a known subdivision have a null one. Bots are excluded
+-- unless :include_bots is true.
+WITH RECURSIVE
+    tree(location_id, country, subdivision) AS (
+        SELECT location_id, country, NULL FROM locations WHERE country = :country
+        UNION ALL
+        SELECT locations.location_id, tree.country, COALESCE(tree.subdivision, locations.subdivision)
+        FROM locations INNER JOIN tree ON locations.parent_id = tree.location_id
+    )
+SELECT json_group_array(json_object('subdivision', subdivision, 'pageviews', pageviews, 'visitors', visitors))
+FROM (
+    SELECT tree.country || '-' || tree.subdivision AS subdivision
+         , COUNT(*) AS pageviews
+         , COUNT(DISTINCT hits.user_id) AS visitors
+    FROM hits
+    INNER JOIN tree ON hits.location_id = tree.location_id
+    INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+    WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND hits.event = 'l'
+      AND hits.timestamp >= :start
+      AND hits.timestamp < :end
+      AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+    GROUP BY tree.subdivision
+    ORDER BY pageviews DESC, subdivision
+);
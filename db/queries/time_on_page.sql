@@ -0,0 +1,20 @@
+-- Average time on page (in seconds) for the pages on :site between :start_date and :end_date
+-- (inclusive, in :timezone). Only page loads that we saw being hidden are counted. Bots are excluded unless
+-- :include_bots is true.
+SELECT json_group_array(json_object('path', path, 'average_duration', average_duration, 'views', views))
+FROM (
+    SELECT paths.path
+         , AVG(session_pages.duration) AS average_duration
+         , COUNT(*) AS views
+    FROM session_pages
+    INNER JOIN paths ON session_pages.path_id = paths.path_id
+    INNER JOIN sessions ON session_pages.session_id = sessions.session_id
+    WHERE paths.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND session_pages.duration IS NOT NULL
+      AND session_pages.timestamp >= :start
+      AND session_pages.timestamp < :end
+      AND (:include_bots OR sessions.bot = 0)
+    GROUP BY session_pages.path_id
+    ORDER BY views DESC
+    LIMIT 100
+);
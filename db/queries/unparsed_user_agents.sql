@@ -0,0 +1,24 @@
+-- The user agents of visitors to :site between :start_date and :end_date (inclusive, in :timezone)
+-- whose browser or operating system could not be worked out, with the most common first, so that
+-- they can be reported to zgo.at/gadget. Bots are excluded unless :include_bots is true.
+SELECT json_group_array(json_object('user_agent', user_agent, 'browser', browser, 'os', os, 'pageviews', pageviews, 'visitors', visitors))
+FROM (
+    SELECT user_agents.user_agent
+         , browsers.browser_name AS browser
+         , oss.os_name AS os
+         , COUNT(*) AS pageviews
+         , COUNT(DISTINCT hits.user_id) AS visitors
+    FROM hits
+    INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+    LEFT JOIN browsers ON user_agents.browser_id = browsers.browser_id
+    LEFT JOIN oss ON user_agents.os_id = oss.os_id
+    WHERE hits.site_id = (SELECT site_id FROM sites WHERE domain = :site)
+      AND hits.event = 'l'
+      AND hits.timestamp >= :start
+      AND hits.timestamp < :end
+      AND (:include_bots OR (COALESCE(hits.bot, 0) < 2 AND user_agents.bot < 2))
+      AND (user_agents.browser_id IS NULL OR user_agents.os_id IS NULL)
+    GROUP BY user_agents.user_agent_id
+    ORDER BY pageviews DESC, user_agents.user_agent
+    LIMIT 100
+);
@@ -1,9 +1,14 @@
-package main
+package sheepcount
 
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -14,10 +19,17 @@ func TestInsertLocation(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer db.Close()
+	db.SetMaxOpenConns(1)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		t.Fatal(err)
@@ -69,7 +81,7 @@ func TestInsertLocation(t *testing.T) {
 	}
 
 	getOrInsertId := func(location *Location) sql.NullInt64 {
-		id, err := dbInsertLocation(ctx, tx, location)
+		id, err := writer.insertLocation(ctx, tx, location)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -132,3 +144,1634 @@ func TestInsertLocation(t *testing.T) {
 	assert.Equal(t, validId(28), getOrInsertId(location("FR", "IDF", "Paris", "")))
 	assert.Equal(t, validId(27), getOrInsertId(location("FR", "IDF", "", "")))
 }
+
+func TestWriteBatch(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	hit := func(path string, referrer string, goals ...string) Hit {
+		hit := Hit{
+			Timestamp:         1654041600,
+			IdentifierCurrent: []byte("a"),
+			Visitor:           0x8000000000000000,
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              path,
+			Goals:             goals,
+		}
+		if referrer != "" {
+			hit.ReferrerDomain = sql.NullString{String: referrer, Valid: true}
+		}
+		return hit
+	}
+
+	for _, batch := range [][]Hit{
+		{hit("/", "www.google.com"), hit("/pricing", "", "pricing"), hit("/signup", "", "pricing", "signup")},
+		{hit("/", "")},
+	} {
+		if err := writer.WriteBatch(ctx, conn, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := conn.QueryContext(ctx, `
+	SELECT hits.hit_id, paths.path, referrers.domain, (SELECT group_concat(goal) FROM goals WHERE goals.hit_id = hits.hit_id)
+	FROM hits
+	INNER JOIN paths ON hits.path_id = paths.path_id
+	LEFT JOIN referrers ON hits.referrer_id = referrers.referrer_id
+	ORDER BY hits.hit_id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var got []string
+	for rows.Next() {
+		var id int64
+		var path string
+		var referrer, goals sql.NullString
+		if err := rows.Scan(&id, &path, &referrer, &goals); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%d %s %s %s", id, path, referrer.String, goals.String))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hits of each batch are in order, and the goals belong to the right hits
+	assert.Equal(t, []string{
+		"1 / www.google.com ",
+		"2 /pricing  pricing",
+		"3 /signup  pricing,signup",
+		"4 /  ",
+	}, got)
+
+	var sketches int
+	if err := conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM visitor_sketches").Scan(&sketches); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, sketches)
+}
+
+func TestAggregate(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	hit := func(timestamp int64, identifier string, event EventType, path string) *Hit {
+		return &Hit{
+			Timestamp:         timestamp,
+			IdentifierCurrent: []byte(identifier),
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             event,
+			Domain:            "example.com",
+			Path:              path,
+		}
+	}
+
+	hits := []*Hit{
+		hit(1654041600, "a", PageLoad, "/"),        // 2022-06-01 00:00
+		hit(1654041660, "a", PageLoad, "/about"),   // 2022-06-01 00:01
+		hit(1654041720, "a", PageHide, "/about"),   // 2022-06-01 00:02
+		hit(1654045200, "b", PageLoad, "/"),        // 2022-06-01 01:00
+		hit(1654128000, "a", PageLoad, "/"),        // 2022-06-02 00:00
+		hit(1654128060, "c", PageLoad, "/contact"), // 2022-06-02 00:01
+	}
+	for _, hit := range hits {
+		if err := writer.InsertHit(ctx, tx, hit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Aggregating twice must not double count
+	for i := 0; i < 2; i++ {
+		if err := dbAggregate(ctx, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var pageviews, visitors int
+	var row Row = db.QueryRowContext(ctx, "SELECT SUM(pageviews), SUM(visitors) FROM hits_hourly")
+	if err := row.Scan(&pageviews, &visitors); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 5, pageviews)
+	assert.Equal(t, 5, visitors) // Visitor a is counted for both / and /about
+
+	queries, err := NewQueries(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := queries.Get("pageviews")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output string
+	row = query.QueryRowContext(ctx, sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-02"), sql.Named("include_bots", false))
+	if err := row.Scan(&output); err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, `[{"date": "2022-06-01", "pageviews": 3, "visitors": 2, "new_visitors": 2, "returning_visitors": 0, "annotations": []}, {"date": "2022-06-02", "pageviews": 2, "visitors": 2, "new_visitors": 1, "returning_visitors": 1, "annotations": []}]`, output)
+
+	compared, err := queryWithComparison(ctx, query, "previous", []interface{}{sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-02"), sql.Named("end_date", "2022-06-02"), sql.Named("include_bots", false)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(
+		t,
+		`{
+			"current": [{"date": "2022-06-02", "pageviews": 2, "visitors": 2, "new_visitors": 1, "returning_visitors": 1, "annotations": []}],
+			"comparison": [{"date": "2022-06-01", "pageviews": 3, "visitors": 2, "new_visitors": 2, "returning_visitors": 0, "annotations": []}],
+			"comparison_start_date": "2022-06-01",
+			"comparison_end_date": "2022-06-01"
+		}`,
+		string(compared),
+	)
+
+	// In New York, four hours behind UTC, the hits of the first UTC day were on the previous day
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row = query.QueryRowContext(ctx, sql.Named("site", "example.com"), sql.Named("start_date", "2022-05-31"), sql.Named("end_date", "2022-06-01"), sql.Named("include_bots", false), sql.Named("timezone", newYork))
+	if err := row.Scan(&output); err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, `[{"date": "2022-05-31", "pageviews": 3, "visitors": 2, "new_visitors": 2, "returning_visitors": 0, "annotations": []}, {"date": "2022-06-01", "pageviews": 2, "visitors": 2, "new_visitors": 1, "returning_visitors": 1, "annotations": []}]`, output)
+
+	query, err = queries.Get("pages")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row = query.QueryRowContext(ctx, sql.Named("site", "example.com"), sql.Named("start_date", "2022-05-31"), sql.Named("end_date", "2022-05-31"), sql.Named("include_bots", false), sql.Named("timezone", newYork))
+	if err := row.Scan(&output); err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, `[{"path": "/", "title": null, "pageviews": 2, "visitors": 2}, {"path": "/about", "title": null, "pageviews": 1, "visitors": 1}]`, output)
+
+	// A page of the pages, and those that match a search
+	pages := func(args ...interface{}) string {
+		args = append(args, sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-02"), sql.Named("include_bots", false))
+		if err := query.QueryRowContext(ctx, args...).Scan(&output); err != nil {
+			t.Fatal(err)
+		}
+		return output
+	}
+	assert.JSONEq(t, `[{"path": "/about", "title": null, "pageviews": 1, "visitors": 1}]`, pages(sql.Named("limit", 1), sql.Named("offset", 1)))
+	assert.JSONEq(t, `[{"path": "/contact", "title": null, "pageviews": 1, "visitors": 1}]`, pages(sql.Named("offset", 2)))
+	assert.JSONEq(t, `[{"path": "/contact", "title": null, "pageviews": 1, "visitors": 1}]`, pages(sql.Named("search", likePattern("con"))))
+
+	// Pages can be found by their titles too
+	if err := dbSetPathTitle(ctx, db, "example.com", "/about", "About Us", titleFromMapping); err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, `[{"path": "/about", "title": "About Us", "pageviews": 1, "visitors": 1}]`, pages(sql.Named("search", likePattern("us"))))
+	assert.JSONEq(t, `[]`, pages(sql.Named("search", likePattern("_"))))
+}
+
+func TestLocalDayVisitors(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	// Visitor a is seen in two hours of the same day in New York, 2022-06-01
+	for _, h := range []struct {
+		timestamp  int64
+		identifier string
+	}{
+		{1654092000, "a"}, // 2022-06-01 14:00 UTC
+		{1654095600, "b"}, // 2022-06-01 15:00 UTC
+		{1654099200, "a"}, // 2022-06-01 16:00 UTC
+	} {
+		hit := &Hit{
+			Timestamp:         h.timestamp,
+			IdentifierCurrent: []byte(h.identifier),
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              "/",
+			ReferrerDomain:    sql.NullString{String: "news.ycombinator.com", Valid: true},
+			Location:          Location{Country: sql.NullString{String: "US", Valid: true}},
+		}
+		if err := writer.InsertHit(ctx, tx, hit); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// As is an anonymous visitor on another site, whose hits each have their own user
+	for _, timestamp := range []int64{1654092000, 1654095600, 1654099200} {
+		hit := &Hit{
+			Timestamp: timestamp,
+			UserAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:     PageLoad,
+			Domain:    "example.org",
+			Path:      "/",
+		}
+		hit.setIdentifiers(true, []byte("c0123456"), nil)
+		if err := writer.InsertHit(ctx, tx, hit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	newYork, err := loadTimezone("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dbSetRollupTimezones(ctx, db, newYork); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO rollup_timezones (timezone) VALUES ('Asia/Kolkata')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbAggregate(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	queries, err := NewQueries(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runSite := func(name string, site string, loc *time.Location) string {
+		query, err := queries.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := []interface{}{sql.Named("site", site), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-01"), sql.Named("include_bots", false), sql.Named("timezone", loc)}
+		if name == "pages" || name == "referrers" {
+			args = append(args, sql.Named("limit", 10), sql.Named("offset", 0), sql.Named("search", nil))
+		}
+		var output string
+		if err := query.QueryRowContext(ctx, args...).Scan(&output); err != nil {
+			t.Fatal(err)
+		}
+		return output
+	}
+	run := func(name string) string {
+		return runSite(name, "example.com", newYork)
+	}
+
+	// Each visitor is counted once for the day, not once for each hour, and a's second visit is a
+	// return
+	assert.JSONEq(t, `[{"date": "2022-06-01", "pageviews": 3, "visitors": 2, "new_visitors": 1, "returning_visitors": 1, "annotations": []}]`, run("pageviews"))
+	assert.JSONEq(t, `[{"path": "/", "title": null, "pageviews": 3, "visitors": 2}]`, run("pages"))
+	assert.JSONEq(t, `[{"domain": "news.ycombinator.com", "path": null, "pageviews": 3, "visitors": 2}]`, run("referrers"))
+	assert.JSONEq(t, `[{"source": "news.ycombinator.com", "pageviews": 3, "visitors": 2}]`, run("referrer_sources"))
+	assert.JSONEq(t, `[{"country": "US", "pageviews": 3, "visitors": 2}]`, run("countries"))
+	assert.JSONEq(t, `[{"browser": "Firefox", "pageviews": 3, "visitors": 2}]`, run("browsers"))
+
+	// The anonymous visitor is counted once from the sketches of the hours
+	assert.JSONEq(t, `[{"date": "2022-06-01", "pageviews": 3, "visitors": 1, "new_visitors": 1, "returning_visitors": 0, "annotations": []}]`, runSite("pageviews", "example.org", newYork))
+	assert.JSONEq(t, `[{"date": "2022-06-01", "pageviews": 3, "visitors": 1, "new_visitors": 1, "returning_visitors": 0, "annotations": []}]`, runSite("pageviews", "example.org", time.UTC))
+
+	// The days of a time zone that is not rolled up are counted from the hours
+	chicago, err := loadTimezone("America/Chicago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, `[{"path": "/", "title": null, "pageviews": 3, "visitors": 3}]`, runSite("pages", "example.com", chicago))
+
+	// Except in time zones that are not a whole number of hours from UTC, whose days are only
+	// counted once they are rolled up, from the day that the oldest hits start in
+	kolkata, err := loadTimezone("Asia/Kolkata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, `[{"path": "/", "title": null, "pageviews": 3, "visitors": 2}]`, runSite("pages", "example.com", kolkata))
+	kathmandu, err := loadTimezone("Asia/Kathmandu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages, err := queries.Get("pages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output string
+	err = pages.QueryRowContext(
+		ctx,
+		sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-01"),
+		sql.Named("include_bots", false), sql.Named("timezone", kathmandu),
+		sql.Named("limit", 10), sql.Named("offset", 0), sql.Named("search", nil),
+	).Scan(&output)
+	assert.IsType(t, &ErrBadInput{}, err)
+
+	// The rollups of the days are kept once the hits have been dropped, and are only aggregated
+	// again from the first day after the hits that are left, 2022-07-01 in New York
+	tx, err = db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	hit := &Hit{
+		Timestamp:         1656676800, // 2022-07-01 12:00 UTC
+		IdentifierCurrent: []byte("a"),
+		UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+		Event:             PageLoad,
+		Domain:            "example.com",
+		Path:              "/",
+	}
+	if err := writer.InsertHit(ctx, tx, hit); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = dbDropHitPartitions(ctx, db, 1656633600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dbAggregate(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, `[{"path": "/", "title": null, "pageviews": 3, "visitors": 2}]`, run("pages"))
+
+	var days []int64
+	rows, err := db.QueryContext(ctx, "SELECT day FROM totals_local_daily WHERE timezone = 'America/New_York' AND site_id = (SELECT site_id FROM sites WHERE domain = 'example.com') ORDER BY day")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day int64
+		if err := rows.Scan(&day); err != nil {
+			t.Fatal(err)
+		}
+		days = append(days, day)
+	}
+	assert.Equal(t, []int64{1654056000, 1656648000}, days)
+
+	// A time zone that is no longer used stops being rolled up
+	if err := dbSetRollupTimezones(ctx, db, time.UTC); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT (SELECT COUNT(*) FROM rollup_timezones) + (SELECT COUNT(*) FROM totals_local_daily) + (SELECT COUNT(*) FROM hits_local_daily)").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, n)
+}
+
+// The first roll up of a time zone is of all of the days since the oldest hits, which are rolled
+// up a few at a time.
+func TestLocalDaysInBatches(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	// More than localDaysPerTransaction days apart
+	for _, timestamp := range []int64{1654092000, 1660564800} { // 2022-06-01 and 2022-08-15 12:00 UTC
+		hit := &Hit{
+			Timestamp:         timestamp,
+			IdentifierCurrent: []byte("a"),
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              "/",
+		}
+		if err := writer.InsertHit(ctx, tx, hit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	newYork, err := loadTimezone("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dbSetRollupTimezones(ctx, db, newYork); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rolling up again recomputes the last days without losing the others
+	for i := 0; i < 2; i++ {
+		if err := dbAggregate(ctx, db); err != nil {
+			t.Fatal(err)
+		}
+
+		var days []int64
+		rows, err := db.QueryContext(ctx, "SELECT day FROM totals_local_daily WHERE timezone = 'America/New_York' ORDER BY day")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var day int64
+			if err := rows.Scan(&day); err != nil {
+				t.Fatal(err)
+			}
+			days = append(days, day)
+		}
+		rows.Close()
+		assert.Equal(t, []int64{1654056000, 1660536000}, days)
+	}
+}
+
+func TestLikePattern(t *testing.T) {
+	assert.Equal(t, "%sheep%", likePattern("sheep"))
+	assert.Equal(t, `%100\%\_sheep\\%`, likePattern(`100%_sheep\`))
+}
+
+func TestMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sheepcount.sqlite3")
+
+	db, err := dbConnect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrations, err := loadMigrations(contentFs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(migrations), version)
+
+	// Pretend that the database was created by a newer version of SheepCount
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	_, err = dbConnect(path)
+	assert.Error(t, err)
+}
+
+// A database created by schema.sql, from before there were migrations, is upgraded to the first
+// migration and then migrated as usual.
+func TestMigrateLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sheepcount.sqlite3")
+
+	schema, err := os.ReadFile(filepath.Join("testdata", "schema.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacy, err := sql.Open("sqlite3", path+"?_foreign_keys=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.Exec(string(schema) + `
+		INSERT INTO users (user_id, identifier, first_seen, last_seen) VALUES (1, x'01', 1654041600, 1654041600);
+		INSERT INTO user_agents (user_agent_id, user_agent, bot) VALUES (1, 'Mozilla/5.0', 0);
+		INSERT INTO paths (path_id, domain, path) VALUES (1, 'example.com', '/'), (2, 'example.org', '/'), (3, 'example.com', '/about');
+		INSERT INTO hits (hit_id, timestamp, event, user_id, user_agent_id, path_id) VALUES
+			(1, 1654041600, 'l', 1, 1, 1),
+			(2, 1654041660, 'l', 1, 1, 3),
+			(3, 1654045200, 'l', 1, 1, 2);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy.Close()
+
+	db, err := dbConnect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	migrations, err := loadMigrations(contentFs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(migrations), version)
+
+	sites, err := dbSites(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"example.com", "example.org"}, sites)
+
+	// Each hit keeps its ID and is now in the site of its path
+	rows, err := db.Query(`
+		SELECT hits.hit_id, sites.domain, paths.path
+		FROM hits
+		INNER JOIN sites ON hits.site_id = sites.site_id
+		INNER JOIN paths ON hits.path_id = paths.path_id AND paths.site_id = sites.site_id
+		ORDER BY hits.hit_id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var hits []string
+	for rows.Next() {
+		var id int
+		var domain, path string
+		if err := rows.Scan(&id, &domain, &path); err != nil {
+			t.Fatal(err)
+		}
+		hits = append(hits, fmt.Sprintf("%d %s%s", id, domain, path))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"1 example.com/", "2 example.com/about", "3 example.org/"}, hits)
+
+	var violations int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pragma_foreign_key_check").Scan(&violations); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, violations)
+
+	// And is rolled up
+	if err := dbAggregate(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	var pageviews int
+	if err := db.QueryRow("SELECT SUM(pageviews) FROM totals_daily WHERE site_id = (SELECT site_id FROM sites WHERE domain = 'example.com')").Scan(&pageviews); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, pageviews)
+
+	// Which only happens once
+	db.Close()
+	db, err = dbConnect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
+
+func TestConnectReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sheepcount.sqlite3")
+
+	db, err := dbConnect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	readDB, err := dbConnectReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readDB.Close()
+
+	_, err = db.Exec("INSERT INTO sites (domain) VALUES ('example.com')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes by the writer are seen, but the reader cannot write
+	sites, err := dbSites(context.Background(), readDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"example.com"}, sites)
+
+	_, err = readDB.Exec("INSERT INTO sites (domain) VALUES ('example.org')")
+	assert.Error(t, err)
+
+	// A read that is still going does not block the writer
+	tx, err := readDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	var n int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM sites").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec("INSERT INTO sites (domain) VALUES ('example.net')")
+	assert.NoError(t, err)
+
+	_, err = dbConnectReadOnly(filepath.Join(t.TempDir(), "missing.sqlite3"))
+	assert.Error(t, err)
+}
+
+func TestSessions(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	hit := func(timestamp int64, identifier string, event EventType, path string) *Hit {
+		return &Hit{
+			Timestamp:         timestamp,
+			IdentifierCurrent: []byte(identifier),
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             event,
+			Domain:            "example.com",
+			Path:              path,
+		}
+	}
+
+	insert := func(hits ...*Hit) {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+
+		for _, hit := range hits {
+			if err := writer.InsertHit(ctx, tx, hit); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insert(
+		hit(1654041600, "a", PageLoad, "/"),      // 2022-06-01 00:00
+		hit(1654041660, "a", PageLoad, "/about"), // 2022-06-01 00:01
+		hit(1654045200, "b", PageLoad, "/"),      // 2022-06-01 01:00
+		hit(1654045260, "b", PageLoad, "/about"), // 2022-06-01 01:01
+	)
+	if err := dbStitchSessions(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hide event arrives after the first run and must be stitched into the existing visit
+	insert(
+		hit(1654041720, "a", PageHide, "/about"), // 2022-06-01 00:02
+		hit(1654128000, "a", PageLoad, "/"),      // 2022-06-02 00:00, a new visit
+		hit(1654128060, "c", PageLoad, "/"),      // 2022-06-02 00:01
+	)
+	if err := dbStitchSessions(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	queries, err := NewQueries(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(name string) string {
+		query, err := queries.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var output string
+		row := query.QueryRowContext(ctx, sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-02"), sql.Named("include_bots", false))
+		if err := row.Scan(&output); err != nil {
+			t.Fatal(err)
+		}
+		return output
+	}
+
+	assert.JSONEq(t, `{"visits": 4, "bounce_rate": 0.5, "average_duration": 45.0}`, run("sessions"))
+	assert.JSONEq(t, `[{"path": "/about", "average_duration": 60.0, "views": 1}]`, run("time_on_page"))
+}
+
+func TestBots(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	const firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0"
+	const googlebot = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+
+	hit := func(timestamp int64, identifier string, userAgent string, bot sql.NullInt16) *Hit {
+		return &Hit{
+			Timestamp:         timestamp,
+			IdentifierCurrent: []byte(identifier),
+			UserAgent:         userAgent,
+			Bot:               bot,
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              "/",
+		}
+	}
+
+	hits := []*Hit{
+		hit(1654041600, "a", firefox, sql.NullInt16{}),
+		hit(1654041660, "b", googlebot, sql.NullInt16{}),
+		hit(1654045260, "b", googlebot, sql.NullInt16{}),
+		hit(1654041780, "c", firefox, sql.NullInt16{Int16: 2, Valid: true}), // E.g. from a botty IP address range
+	}
+	for _, hit := range hits {
+		if err := writer.InsertHit(ctx, tx, hit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dbStitchSessions(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbAggregate(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	queries, err := NewQueries(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(name string, includeBots bool) string {
+		query, err := queries.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var output string
+		row := query.QueryRowContext(ctx, sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-01"), sql.Named("include_bots", includeBots))
+		if err := row.Scan(&output); err != nil {
+			t.Fatal(err)
+		}
+		return output
+	}
+
+	assert.JSONEq(t, `[{"date": "2022-06-01", "pageviews": 1, "visitors": 1, "new_visitors": 1, "returning_visitors": 0, "annotations": []}]`, run("pageviews", false))
+	assert.JSONEq(t, `[{"date": "2022-06-01", "pageviews": 4, "visitors": 3, "new_visitors": 2, "returning_visitors": 1, "annotations": []}]`, run("pageviews", true))
+	assert.JSONEq(t, `{"visits": 1, "bounce_rate": 1.0, "average_duration": 0.0}`, run("sessions", false))
+	assert.JSONEq(t, `{"visits": 4, "bounce_rate": 1.0, "average_duration": 0.0}`, run("sessions", true))
+
+	assert.JSONEq(
+		t,
+		`[
+			{"user_agent": "`+googlebot+`", "bot": 3, "hits": 2, "pageviews": 2, "visitors": 1},
+			{"user_agent": "`+firefox+`", "bot": 2, "hits": 1, "pageviews": 1, "visitors": 1}
+		]`,
+		run("bots", false),
+	)
+}
+
+func TestPerformanceQuery(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	ms := func(ms int) sql.NullInt32 {
+		return sql.NullInt32{Int32: int32(ms), Valid: true}
+	}
+
+	// Twenty page hides with load times of 100ms, 200ms, ... 2000ms and one without timings
+	for i := 1; i <= 21; i++ {
+		hit := &Hit{
+			Timestamp:         1654041600 + int64(i),
+			IdentifierCurrent: []byte{byte(i)},
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             PageHide,
+			Domain:            "example.com",
+			Path:              "/",
+		}
+		if i <= 20 {
+			hit.TimeToFirstByte = ms(10 * i)
+			hit.DOMContentLoaded = ms(50 * i)
+			hit.LoadTime = ms(100 * i)
+		}
+		if err := writer.InsertHit(ctx, tx, hit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	queries, err := NewQueries(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := queries.Get("performance")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output string
+	row := query.QueryRowContext(ctx, sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-01"), sql.Named("include_bots", false))
+	if err := row.Scan(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(
+		t,
+		`[{
+			"path": "/",
+			"views": 20,
+			"ttfb_p50": 100,
+			"ttfb_p95": 190,
+			"dom_content_loaded_p50": 500,
+			"dom_content_loaded_p95": 950,
+			"load_p50": 1000,
+			"load_p95": 1900
+		}]`,
+		output,
+	)
+}
+
+func TestKeywordsQuery(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	hits := []struct {
+		identifier string
+		path       string
+		keyword    string
+	}{
+		{"a", "/", "sheep"},
+		{"a", "/", "sheep"},
+		{"b", "/", "sheep"},
+		{"c", "/", "counting sheep"},
+		{"c", "/about", "sheep count"},
+		{"d", "/about", ""},
+	}
+	for i, h := range hits {
+		hit := &Hit{
+			Timestamp:         1654041600 + int64(i),
+			IdentifierCurrent: []byte(h.identifier),
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              h.path,
+			ReferrerDomain:    sql.NullString{String: "www.google.com", Valid: true},
+		}
+		if h.keyword != "" {
+			hit.Keyword = sql.NullString{String: h.keyword, Valid: true}
+		}
+		if err := writer.InsertHit(ctx, tx, hit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	queries, err := NewQueries(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := queries.Get("keywords")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output string
+	row := query.QueryRowContext(ctx, sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-01"), sql.Named("include_bots", false))
+	if err := row.Scan(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(
+		t,
+		`[
+			{"path": "/", "keyword": "sheep", "pageviews": 3, "visitors": 2},
+			{"path": "/", "keyword": "counting sheep", "pageviews": 1, "visitors": 1},
+			{"path": "/about", "keyword": "sheep count", "pageviews": 1, "visitors": 1}
+		]`,
+		output,
+	)
+}
+
+func TestLocationQueries(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	nullString := func(s string) sql.NullString {
+		return sql.NullString{String: s, Valid: s != ""}
+	}
+
+	hits := []struct {
+		identifier  string
+		country     string
+		subdivision string
+		city        string
+	}{
+		{"a", "GB", "ENG", "London"},
+		{"a", "GB", "ENG", "London"},
+		{"b", "GB", "ENG", "Leeds"},
+		{"c", "GB", "SCT", "Edinburgh"},
+		{"d", "GB", "", ""},
+		{"e", "SG", "", "Singapore"},
+	}
+	for i, h := range hits {
+		hit := &Hit{
+			Timestamp:         1654041600 + int64(i),
+			IdentifierCurrent: []byte(h.identifier),
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              "/",
+			Location: Location{
+				Country:     nullString(h.country),
+				Subdivision: nullString(h.subdivision),
+				City:        nullString(h.city),
+			},
+		}
+		if err := writer.InsertHit(ctx, tx, hit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	queries, err := NewQueries(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(name string, args ...interface{}) string {
+		query, err := queries.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		args = append(args, sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-01"), sql.Named("include_bots", false))
+
+		var output string
+		if err := query.QueryRowContext(ctx, args...).Scan(&output); err != nil {
+			t.Fatal(err)
+		}
+		return output
+	}
+
+	assert.JSONEq(
+		t,
+		`[
+			{"subdivision": "GB-ENG", "pageviews": 3, "visitors": 2},
+			{"subdivision": null, "pageviews": 1, "visitors": 1},
+			{"subdivision": "GB-SCT", "pageviews": 1, "visitors": 1}
+		]`,
+		run("subdivisions", sql.Named("country", "GB")),
+	)
+	assert.JSONEq(
+		t,
+		`[
+			{"city": "London", "pageviews": 2, "visitors": 1},
+			{"city": "Leeds", "pageviews": 1, "visitors": 1}
+		]`,
+		run("cities", sql.Named("region", "GB-ENG")),
+	)
+	assert.JSONEq(
+		t,
+		`[
+			{"city": "London", "pageviews": 2, "visitors": 1},
+			{"city": null, "pageviews": 1, "visitors": 1},
+			{"city": "Edinburgh", "pageviews": 1, "visitors": 1},
+			{"city": "Leeds", "pageviews": 1, "visitors": 1}
+		]`,
+		run("cities", sql.Named("region", "GB")),
+	)
+	assert.JSONEq(t, `[{"city": "Singapore", "pageviews": 1, "visitors": 1}]`, run("cities", sql.Named("region", "SG")))
+}
+
+func TestDeviceQueries(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	hits := []struct {
+		identifier string
+		width      int32
+		height     int32
+		device     string
+	}{
+		{"a", 390, 844, "mobile"},
+		{"a", 390, 844, "mobile"},
+		{"b", 390, 844, "mobile"},
+		{"c", 1920, 1080, "desktop"},
+		{"d", 810, 1080, "tablet"},
+		{"e", 0, 0, ""}, // From the tracking pixel
+	}
+	for i, h := range hits {
+		hit := &Hit{
+			Timestamp:         1654041600 + int64(i),
+			IdentifierCurrent: []byte(h.identifier),
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              "/",
+		}
+		if h.width > 0 {
+			hit.ScreenWidth = sql.NullInt32{Int32: h.width, Valid: true}
+			hit.ScreenHeight = sql.NullInt32{Int32: h.height, Valid: true}
+			hit.PixelRatio = sql.NullFloat64{Float64: 2, Valid: true}
+		}
+		if h.device != "" {
+			hit.Device = sql.NullString{String: h.device, Valid: true}
+		}
+		if err := writer.InsertHit(ctx, tx, hit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	queries, err := NewQueries(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(name string) string {
+		query, err := queries.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var output string
+		row := query.QueryRowContext(ctx, sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-01"), sql.Named("include_bots", false))
+		if err := row.Scan(&output); err != nil {
+			t.Fatal(err)
+		}
+		return output
+	}
+
+	assert.JSONEq(
+		t,
+		`[
+			{"device": "mobile", "pageviews": 3, "visitors": 2, "share": 50.0},
+			{"device": "desktop", "pageviews": 1, "visitors": 1, "share": 25.0},
+			{"device": "tablet", "pageviews": 1, "visitors": 1, "share": 25.0}
+		]`,
+		run("devices"),
+	)
+	assert.JSONEq(
+		t,
+		`[
+			{"width": 390, "height": 844, "device": "mobile", "pageviews": 3, "visitors": 2},
+			{"width": 1920, "height": 1080, "device": "desktop", "pageviews": 1, "visitors": 1},
+			{"width": 810, "height": 1080, "device": "tablet", "pageviews": 1, "visitors": 1}
+		]`,
+		run("resolutions"),
+	)
+}
+
+func TestVersionQueries(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	firefox := func(version int) string {
+		return fmt.Sprintf("Mozilla/5.0 (X11; Linux x86_64; rv:%d.0) Gecko/20100101 Firefox/%d.0", version, version)
+	}
+
+	// Firefox 102 has the most visitors, then 101 and then one each for 90 to 100
+	userAgents := []string{firefox(102), firefox(102), firefox(102), firefox(101), firefox(101)}
+	for version := 90; version <= 100; version++ {
+		userAgents = append(userAgents, firefox(version))
+	}
+	userAgents = append(userAgents, "Mozilla/5.0 (Sheep) SheepBrowser/1.0")
+
+	for i, userAgent := range userAgents {
+		hit := &Hit{
+			Timestamp:         1654041600 + int64(i),
+			IdentifierCurrent: []byte(strconv.Itoa(i)),
+			UserAgent:         userAgent,
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              "/",
+		}
+		if err := writer.InsertHit(ctx, tx, hit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	queries, err := NewQueries(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(name string) string {
+		query, err := queries.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var output string
+		row := query.QueryRowContext(ctx, sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-01"), sql.Named("include_bots", false))
+		if err := row.Scan(&output); err != nil {
+			t.Fatal(err)
+		}
+		return output
+	}
+
+	assert.JSONEq(
+		t,
+		`[
+			{"browser": "Firefox", "version": "102", "pageviews": 3, "visitors": 3, "share": 17.6},
+			{"browser": "Firefox", "version": "101", "pageviews": 2, "visitors": 2, "share": 11.8},
+			{"browser": "Firefox", "version": "100", "pageviews": 1, "visitors": 1, "share": 5.9},
+			{"browser": "Firefox", "version": "99", "pageviews": 1, "visitors": 1, "share": 5.9},
+			{"browser": "Firefox", "version": "98", "pageviews": 1, "visitors": 1, "share": 5.9},
+			{"browser": "Firefox", "version": "97", "pageviews": 1, "visitors": 1, "share": 5.9},
+			{"browser": "Firefox", "version": "96", "pageviews": 1, "visitors": 1, "share": 5.9},
+			{"browser": "Firefox", "version": "95", "pageviews": 1, "visitors": 1, "share": 5.9},
+			{"browser": "Firefox", "version": "94", "pageviews": 1, "visitors": 1, "share": 5.9},
+			{"browser": "Firefox", "version": "93", "pageviews": 1, "visitors": 1, "share": 5.9},
+			{"browser": "Other", "version": null, "pageviews": 4, "visitors": 4, "share": 23.5}
+		]`,
+		run("browser_versions"),
+	)
+	assert.JSONEq(
+		t,
+		`[
+			{"os": "Linux", "version": null, "pageviews": 16, "visitors": 16, "share": 94.1},
+			{"os": null, "version": null, "pageviews": 1, "visitors": 1, "share": 5.9}
+		]`,
+		run("os_versions"),
+	)
+	assert.JSONEq(
+		t,
+		`[{"user_agent": "Mozilla/5.0 (Sheep) SheepBrowser/1.0", "browser": null, "os": null, "pageviews": 1, "visitors": 1}]`,
+		run("unparsed_user_agents"),
+	)
+}
+
+func TestLanguagesQuery(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	hits := []struct {
+		identifier string
+		primary    string
+		secondary  string
+	}{
+		{"a", "eng", ""},
+		{"a", "eng", ""},
+		{"b", "eng", "fra"},
+		{"c", "fra", "eng"},
+		{"d", "deu", "fra"},
+		{"e", "", ""},
+	}
+	for i, h := range hits {
+		hit := &Hit{
+			Timestamp:         1654041600 + int64(i),
+			IdentifierCurrent: []byte(h.identifier),
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              "/",
+			Language:          h.primary,
+			SecondaryLanguage: h.secondary,
+		}
+		if err := writer.InsertHit(ctx, tx, hit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	queries, err := NewQueries(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := queries.Get("languages")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output string
+	row := query.QueryRowContext(ctx, sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-01"), sql.Named("include_bots", false))
+	if err := row.Scan(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(
+		t,
+		`[
+			{"language": "eng", "name": "English", "visitors": 2, "secondary_visitors": 1},
+			{"language": "fra", "name": "French", "visitors": 1, "secondary_visitors": 2},
+			{"language": "deu", "name": "German", "visitors": 1, "secondary_visitors": 0}
+		]`,
+		output,
+	)
+}
+
+func TestReturningReferrersQuery(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	hits := []struct {
+		timestamp  int64
+		identifier string
+		referrer   string
+	}{
+		{1654041600, "a", "www.google.com"}, // 2022-06-01 00:00, a's first visit
+		{1654041660, "a", ""},               // 2022-06-01 00:01, in the same visit
+		{1654052400, "a", ""},               // 2022-06-01 03:00, a returns
+		{1654056000, "b", "www.google.com"}, // 2022-06-01 04:00
+		{1654055100, "b", "www.google.com"}, // 2022-06-01 03:45, written late from the spool
+		{1654059600, "c", "t.co"},           // 2022-06-01 05:00
+	}
+	for _, h := range hits {
+		hit := &Hit{
+			Timestamp:         h.timestamp,
+			IdentifierCurrent: []byte(h.identifier),
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              "/",
+		}
+		if h.referrer != "" {
+			hit.ReferrerDomain = sql.NullString{String: h.referrer, Valid: true}
+		}
+		if err := writer.InsertHit(ctx, tx, hit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Users are created at their first hit, even if it was written after a later one
+	var createdAt int64
+	if err := db.QueryRowContext(ctx, "SELECT created_at FROM users WHERE identifier = ?", []byte("b")).Scan(&createdAt); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(1654055100), createdAt)
+
+	if err := dbStitchSessions(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbAggregate(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	var returningPageviews, returningVisitors int
+	var row Row = db.QueryRowContext(ctx, "SELECT SUM(returning_pageviews), SUM(returning_visitors) FROM totals_daily")
+	if err := row.Scan(&returningPageviews, &returningVisitors); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, returningPageviews)
+	assert.Equal(t, 1, returningVisitors)
+
+	queries, err := NewQueries(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query, err := queries.Get("returning_referrers")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output string
+	row = query.QueryRowContext(ctx, sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-01"), sql.Named("include_bots", false))
+	if err := row.Scan(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(
+		t,
+		`[
+			{"source": "google.com", "new_pageviews": 3, "returning_pageviews": 0, "new_visitors": 2, "returning_visitors": 0},
+			{"source": null, "new_pageviews": 1, "returning_pageviews": 1, "new_visitors": 0, "returning_visitors": 1},
+			{"source": "t.co", "new_pageviews": 1, "returning_pageviews": 0, "new_visitors": 1, "returning_visitors": 0}
+		]`,
+		output,
+	)
+}
+
+func TestEventsQueries(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	hits := []struct {
+		identifier string
+		path       string
+		event      string
+	}{
+		{"a", "/", ""},
+		{"b", "/", ""},
+		{"c", "/", ""},
+		{"d", "/pricing", ""},
+		{"a", "/", "signup"},
+		{"a", "/pricing", "signup"},
+		{"b", "/pricing", "signup"},
+		{"c", "/", "play"},
+	}
+	for i, h := range hits {
+		hit := &Hit{
+			Timestamp:         1654041600 + int64(i),
+			IdentifierCurrent: []byte(h.identifier),
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              h.path,
+		}
+		if h.event != "" {
+			hit.Event = CustomEvent
+			hit.EventName = sql.NullString{String: h.event, Valid: true}
+		}
+		if err := writer.InsertHit(ctx, tx, hit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	queries, err := NewQueries(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(name string, args ...interface{}) string {
+		query, err := queries.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		args = append(args, sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-01"), sql.Named("include_bots", false))
+		var output string
+		if err := query.QueryRowContext(ctx, args...).Scan(&output); err != nil {
+			t.Fatal(err)
+		}
+		return output
+	}
+
+	assert.JSONEq(
+		t,
+		`[
+			{"name": "signup", "events": 3, "visitors": 2, "conversion_rate": 50.0},
+			{"name": "play", "events": 1, "visitors": 1, "conversion_rate": 25.0}
+		]`,
+		run("events"),
+	)
+
+	assert.JSONEq(
+		t,
+		`[
+			{"path": "/pricing", "events": 2, "visitors": 2},
+			{"path": "/", "events": 1, "visitors": 1}
+		]`,
+		run("event_pages", sql.Named("event", "signup")),
+	)
+}
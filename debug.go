@@ -0,0 +1,161 @@
+package sheepcount
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"zgo.at/gadget"
+	"zgo.at/isbot"
+)
+
+// With ?debug=1, the event endpoint replies with what it would have recorded instead of recording
+// it, so that site owners can see what is collected from their browser. Only requests from
+// localhost, or from an administrator who is logged in, can debug, as the reply includes the
+// location of the visitor.
+type debugResponse struct {
+	Hits    []debugHit `json:"hits"`
+	Ignored string     `json:"ignored,omitempty"` // Why nothing would have been recorded
+}
+
+// A hit as it would be written to the database, with the user agent and location looked up.
+// Identifiers are never sent back.
+type debugHit struct {
+	Timestamp         time.Time         `json:"timestamp"`
+	Site              string            `json:"site"`
+	Event             EventType         `json:"event"`
+	Path              string            `json:"path"`
+	ReferrerDomain    *string           `json:"referrer_domain"`
+	ReferrerPath      *string           `json:"referrer_path"`
+	Keyword           *string           `json:"keyword"`
+	Campaign          map[string]string `json:"campaign,omitempty"`
+	Target            *string           `json:"target"`
+	EventName         *string           `json:"event_name"`
+	Goals             []string          `json:"goals"`
+	UserAgent         string            `json:"user_agent"`
+	BrowserName       string            `json:"browser_name"`
+	BrowserVersion    string            `json:"browser_version"`
+	OSName            string            `json:"os_name"`
+	OSVersion         string            `json:"os_version"`
+	Bot               int               `json:"bot"`
+	Device            *string           `json:"device"`
+	Language          string            `json:"language"`
+	SecondaryLanguage string            `json:"secondary_language"`
+	ScreenHeight      *int32            `json:"screen_height"`
+	ScreenWidth       *int32            `json:"screen_width"`
+	PixelRatio        *float64          `json:"pixel_ratio"`
+	ScrollDepth       *int16            `json:"scroll_depth"`
+	EngagedSeconds    *int32            `json:"engaged_seconds"`
+	TimeToFirstByte   *int32            `json:"time_to_first_byte"`
+	DOMContentLoaded  *int32            `json:"dom_content_loaded"`
+	LoadTime          *int32            `json:"load_time"`
+	Country           *string           `json:"country"`
+	Subdivision       *string           `json:"subdivision"`
+	City              *string           `json:"city"`
+	Postal            *string           `json:"postal"`
+	LocationBlocked   bool              `json:"location_blocked"` // Hits from the location are not recorded
+}
+
+// Can the request debug the event endpoint?
+func (sheepcount *SheepCount) canDebug(r *http.Request) bool {
+	if ip := remoteIP(r); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	account := sheepcount.session(r)
+	return account != nil && account.canWrite()
+}
+
+func newDebugHit(sheepcount *SheepCount, hit Hit) debugHit {
+	blocked := false
+	if sheepcount.state != nil {
+		blocked = !hit.resolveLocation(&sheepcount.state.GeoIP, sheepcount.geo)
+	}
+	ua := gadget.ParseUA(hit.UserAgent)
+
+	debug := debugHit{
+		Timestamp:         time.Unix(hit.Timestamp, 0).UTC(),
+		Site:              hit.Domain,
+		Event:             hit.Event,
+		Path:              hit.Path,
+		ReferrerDomain:    nullableString(hit.ReferrerDomain),
+		ReferrerPath:      nullableString(hit.ReferrerPath),
+		Keyword:           nullableString(hit.Keyword),
+		Target:            nullableString(hit.Target),
+		EventName:         nullableString(hit.EventName),
+		Goals:             hit.Goals,
+		UserAgent:         hit.UserAgent,
+		BrowserName:       ua.BrowserName,
+		BrowserVersion:    ua.BrowserVersion,
+		OSName:            ua.OSName,
+		OSVersion:         ua.OSVersion,
+		Bot:               int(isbot.UserAgent(hit.UserAgent)),
+		Device:            nullableString(hit.Device),
+		Language:          hit.Language,
+		SecondaryLanguage: hit.SecondaryLanguage,
+		ScreenHeight:      nullableInt32(hit.ScreenHeight),
+		ScreenWidth:       nullableInt32(hit.ScreenWidth),
+		ScrollDepth:       nullableInt16(hit.ScrollDepth),
+		EngagedSeconds:    nullableInt32(hit.EngagedSeconds),
+		TimeToFirstByte:   nullableInt32(hit.TimeToFirstByte),
+		DOMContentLoaded:  nullableInt32(hit.DOMContentLoaded),
+		LoadTime:          nullableInt32(hit.LoadTime),
+		Country:           nullableString(hit.Country),
+		Subdivision:       nullableString(hit.Subdivision),
+		City:              nullableString(hit.City),
+		Postal:            nullableString(hit.Postal),
+		LocationBlocked:   blocked,
+	}
+
+	if hit.Bot.Valid {
+		debug.Bot = int(hit.Bot.Int16)
+	}
+	if hit.PixelRatio.Valid {
+		debug.PixelRatio = &hit.PixelRatio.Float64
+	}
+
+	for name, value := range map[string]sql.NullString{
+		"utm_source":   hit.Campaign.Source,
+		"utm_medium":   hit.Campaign.Medium,
+		"utm_campaign": hit.Campaign.Name,
+		"utm_term":     hit.Campaign.Term,
+		"utm_content":  hit.Campaign.Content,
+	} {
+		if value.Valid {
+			if debug.Campaign == nil {
+				debug.Campaign = make(map[string]string)
+			}
+			debug.Campaign[name] = value.String
+		}
+	}
+
+	return debug
+}
+
+// The value of a nullable column, or nil so that it is null in JSON.
+func nullableString(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+func nullableInt16(n sql.NullInt16) *int16 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int16
+}
+
+func nullableInt32(n sql.NullInt32) *int32 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int32
+}
+
+func writeDebugResponse(w http.ResponseWriter, response debugResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
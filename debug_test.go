@@ -0,0 +1,62 @@
+package sheepcount
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugEvent(t *testing.T) {
+	config := DefaultConfig()
+	config.Domains = []string{"example.com"}
+	config.RespectDNT = true
+	sheepcount := &SheepCount{Config: config, fingerprinter: fingerprintNone}
+
+	post := func(remoteAddr string, headers map[string]string) *httptest.ResponseRecorder {
+		body := `{"e": "l", "u": "https://example.com/pricing?utm_source=newsletter", "r": "https://www.google.com/", "h": 1080, "w": 1920, "p": 2}`
+		r := httptest.NewRequest(http.MethodPost, "http://stats.example.com/event?debug=1", strings.NewReader(body))
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0")
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		// Nothing is recorded, so there is no channel for the hits
+		handleEvent(sheepcount, nil, w, r)
+		return w
+	}
+
+	w := post("127.0.0.1:1234", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var response debugResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Empty(t, response.Ignored)
+	if assert.Len(t, response.Hits, 1) {
+		hit := response.Hits[0]
+		assert.Equal(t, "example.com", hit.Site)
+		assert.Equal(t, PageLoad, hit.Event)
+		assert.Equal(t, "/pricing", hit.Path)
+		assert.Equal(t, map[string]string{"utm_source": "newsletter"}, hit.Campaign)
+		assert.Equal(t, "www.google.com", *hit.ReferrerDomain)
+		assert.Equal(t, "Firefox", hit.BrowserName)
+		assert.Equal(t, "desktop", *hit.Device)
+		assert.Equal(t, int32(1920), *hit.ScreenWidth)
+	}
+	assert.NotContains(t, w.Body.String(), "identifier")
+
+	// Why nothing would have been recorded
+	w = post("[::1]:1234", map[string]string{"DNT": "1"})
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"hits": [], "ignored": "do not track"}`, w.Body.String())
+
+	// Only from localhost or an administrator
+	w = post("192.0.2.1:1234", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,100 @@
+package sheepcount
+
+import (
+	"encoding/binary"
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The number of hits dropped because the same visitor sent the same event for the same page within
+// the deduplication window, such as by double-clicking a link or a single page app rendering twice
+var duplicateHits = expvar.NewInt("duplicate_hits")
+
+// Remembers when each visitor last sent each event for each page so that repeats within the window
+// can be dropped before they reach the database writer. It is safe for concurrent use.
+type deduplicator struct {
+	sync.Mutex
+	window    time.Duration
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+// Returns nil if window is zero, which disables deduplication.
+func newDeduplicator(window time.Duration) *deduplicator {
+	if window <= 0 {
+		return nil
+	}
+
+	return &deduplicator{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Is the hit a repeat of one within the window? Queued events are sent late, so hits are compared
+// by when they happened rather than when they arrived. Page hides never are, as switching back and
+// forth between tabs hides the page each time and each hide adds its own time on the page.
+func (dedup *deduplicator) Duplicate(hit *Hit) bool {
+	if dedup == nil || hit.Event == PageHide {
+		return false
+	}
+
+	key := dedupKey(hit)
+	at := time.Unix(hit.Timestamp, 0)
+
+	dedup.Lock()
+	defer dedup.Unlock()
+
+	dedup.sweep(at)
+
+	if last, ok := dedup.seen[key]; ok {
+		diff := at.Sub(last)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff < dedup.window {
+			return true
+		}
+	}
+
+	dedup.seen[key] = at
+	return false
+}
+
+// Forget hits older than the window, as nothing can be a repeat of them, so that the map does not
+// grow forever.
+func (dedup *deduplicator) sweep(now time.Time) {
+	if now.Sub(dedup.lastSweep) < time.Minute {
+		return
+	}
+	dedup.lastSweep = now
+
+	for key, last := range dedup.seen {
+		if now.Sub(last) >= dedup.window {
+			delete(dedup.seen, key)
+		}
+	}
+}
+
+// The visitor, page and event of the hit. Clicks on different links and different custom events
+// are different events.
+func dedupKey(hit *Hit) string {
+	var b strings.Builder
+
+	if hit.Visitor != 0 {
+		var visitor [8]byte
+		binary.BigEndian.PutUint64(visitor[:], hit.Visitor)
+		b.Write(visitor[:])
+	} else {
+		b.Write(hit.IdentifierCurrent)
+	}
+
+	for _, s := range []string{string(hit.Event), hit.Domain, hit.Path, hit.Target.String, hit.EventName.String} {
+		b.WriteByte(0)
+		b.WriteString(s)
+	}
+
+	return b.String()
+}
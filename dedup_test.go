@@ -0,0 +1,45 @@
+package sheepcount
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduplicator(t *testing.T) {
+	dedup := newDeduplicator(5 * time.Second)
+
+	hit := func(timestamp int64, identifier string, event EventType, path string) *Hit {
+		return &Hit{Timestamp: timestamp, IdentifierCurrent: []byte(identifier), Event: event, Domain: "example.com", Path: path}
+	}
+
+	assert.False(t, dedup.Duplicate(hit(1654041600, "a", PageView, "/")))
+	assert.True(t, dedup.Duplicate(hit(1654041602, "a", PageView, "/")))
+
+	// Other visitors, pages and events are not duplicates
+	assert.False(t, dedup.Duplicate(hit(1654041602, "b", PageView, "/")))
+	assert.False(t, dedup.Duplicate(hit(1654041602, "a", PageView, "/about")))
+	assert.False(t, dedup.Duplicate(hit(1654041602, "a", PageHide, "/")))
+
+	// Nor are page hides, as each one counts the time on the page since it was last shown
+	assert.False(t, dedup.Duplicate(hit(1654041603, "a", PageHide, "/")))
+
+	// Nor are clicks on different links
+	click := hit(1654041602, "a", OutboundClick, "/")
+	click.Target = sql.NullString{String: "https://example.org/", Valid: true}
+	assert.False(t, dedup.Duplicate(click))
+	click.Target.String = "https://example.net/"
+	assert.False(t, dedup.Duplicate(click))
+
+	// Queued events can arrive out of order
+	assert.True(t, dedup.Duplicate(hit(1654041599, "a", PageView, "/")))
+
+	// The window is measured from the last hit that was kept
+	assert.False(t, dedup.Duplicate(hit(1654041605, "a", PageView, "/")))
+	assert.True(t, dedup.Duplicate(hit(1654041609, "a", PageView, "/")))
+
+	// Zero disables deduplication
+	assert.False(t, newDeduplicator(0).Duplicate(hit(1654041600, "a", PageView, "/")))
+}
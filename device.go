@@ -0,0 +1,50 @@
+package sheepcount
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Screens narrower than these, in CSS pixels, are of phones and tablets.
+const (
+	maxMobileWidth = 600
+	maxTabletWidth = 1024
+)
+
+// Whether the visitor is using a mobile, tablet or desktop, from what the user agent says and, if
+// the script sent it, the width of the screen. The user agent wins as it is more reliable: a phone
+// held sideways can be as wide as a tablet. Without either, such as for the tracking pixel of a
+// user agent that does not say, the device is unknown.
+func deviceClass(userAgent string, screenWidth sql.NullInt32) sql.NullString {
+	device := func(class string) sql.NullString {
+		return sql.NullString{String: class, Valid: true}
+	}
+
+	switch {
+	case strings.Contains(userAgent, "iPad") || strings.Contains(userAgent, "Tablet"):
+		return device("tablet")
+	case strings.Contains(userAgent, "Android") && !strings.Contains(userAgent, "Mobile"):
+		return device("tablet")
+	case strings.Contains(userAgent, "Mobi") || strings.Contains(userAgent, "iPhone"):
+		return device("mobile")
+	}
+
+	if screenWidth.Valid {
+		switch {
+		case screenWidth.Int32 < maxMobileWidth:
+			return device("mobile")
+		case screenWidth.Int32 < maxTabletWidth:
+			return device("tablet")
+		default:
+			return device("desktop")
+		}
+	}
+
+	for _, platform := range []string{"Windows NT", "Macintosh", "X11", "CrOS"} {
+		if strings.Contains(userAgent, platform) {
+			return device("desktop")
+		}
+	}
+
+	return sql.NullString{}
+}
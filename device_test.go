@@ -0,0 +1,46 @@
+package sheepcount
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceClass(t *testing.T) {
+	const (
+		iPhone  = "Mozilla/5.0 (iPhone; CPU iPhone OS 15_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.5 Mobile/15E148 Safari/604.1"
+		iPad    = "Mozilla/5.0 (iPad; CPU OS 15_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.5 Mobile/15E148 Safari/604.1"
+		pixel   = "Mozilla/5.0 (Linux; Android 12; Pixel 6) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/102.0.0.0 Mobile Safari/537.36"
+		galaxy  = "Mozilla/5.0 (Linux; Android 12; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/102.0.0.0 Safari/537.36"
+		firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0"
+		curl    = "curl/7.83.1"
+	)
+
+	width := func(w int32) sql.NullInt32 {
+		return sql.NullInt32{Int32: w, Valid: true}
+	}
+
+	tests := []struct {
+		userAgent string
+		width     sql.NullInt32
+		want      string
+	}{
+		{iPhone, width(390), "mobile"},
+		{iPhone, width(844), "mobile"}, // Held sideways
+		{pixel, sql.NullInt32{}, "mobile"},
+		{iPad, width(1024), "tablet"},
+		{galaxy, width(1280), "tablet"},
+		{firefox, width(1920), "desktop"},
+		{firefox, sql.NullInt32{}, "desktop"},
+		{curl, width(800), "tablet"},
+		{curl, width(375), "mobile"},
+		{curl, sql.NullInt32{}, ""},
+	}
+
+	for _, test := range tests {
+		device := deviceClass(test.userAgent, test.width)
+		assert.Equal(t, test.want, device.String, test.userAgent)
+		assert.Equal(t, test.want != "", device.Valid, test.userAgent)
+	}
+}
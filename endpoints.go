@@ -0,0 +1,56 @@
+package sheepcount
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Ad blockers block well-known tracking paths, so the paths of the script, the endpoint that it
+// sends events to and the tracking pixel can be changed to something first-party looking, such as
+// /s/counter.js, /s/e and /s/p.gif.
+type EndpointConfig struct {
+	Script string `toml:"script"` // Where the Javascript is served
+	Event  string `toml:"event"`  // Where the Javascript sends events
+	Pixel  string `toml:"pixel"`  // Where the tracking pixel for visitors without Javascript is served
+}
+
+// Paths that are already served, which the endpoints must not shadow
+var reservedPaths = []string{
+	"/snippet", "/embed", "/healthz", "/readyz", "/debug/", "/queries/", "/events", "/events/stream",
+	"/api/", "/public/", "/export", "/login", "/logout", "/static/", "/favicon.ico", "/index.html",
+}
+
+func (config *EndpointConfig) validate() error {
+	paths := []string{config.Script, config.Event, config.Pixel}
+	for i, p := range paths {
+		if !strings.HasPrefix(p, "/") || p == "/" || strings.HasSuffix(p, "/") || path.Clean(p) != p {
+			return fmt.Errorf("invalid endpoint path: %q", p)
+		}
+
+		for _, reserved := range reservedPaths {
+			if p == reserved || (strings.HasSuffix(reserved, "/") && strings.HasPrefix(p, reserved)) {
+				return fmt.Errorf("endpoint path %s is already used", p)
+			}
+		}
+
+		for _, other := range paths[:i] {
+			if p == other {
+				return fmt.Errorf("endpoint path %s is used twice", p)
+			}
+		}
+	}
+
+	return nil
+}
+
+// The event endpoint relative to the directory of the script. The script resolves it against its
+// own URL so that it keeps working when a reverse proxy serves Sheep Count under a prefix.
+func (config *EndpointConfig) relativeEvent() string {
+	dir, up := path.Dir(config.Script), ""
+	for dir != "/" && !strings.HasPrefix(config.Event, dir+"/") {
+		dir, up = path.Dir(dir), up+"../"
+	}
+
+	return up + strings.TrimPrefix(strings.TrimPrefix(config.Event, dir), "/")
+}
@@ -0,0 +1,38 @@
+package sheepcount
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpoints(t *testing.T) {
+	tests := []struct {
+		script string
+		event  string
+		valid  bool
+		rel    string
+	}{
+		{"/count.js", "/event", true, "event"},
+		{"/s/counter.js", "/s/e", true, "e"},
+		{"/a/b/x.js", "/a/c/e", true, "../c/e"},
+		{"/a/x.js", "/e", true, "../e"},
+		{"/x.js", "/a/e", true, "a/e"},
+		{"count.js", "/event", false, ""},
+		{"/s/", "/event", false, ""},
+		{"/count.js", "/count.js", false, ""},
+		{"/static/count.js", "/event", false, ""},
+		{"/count.js", "/sheep.gif", false, ""},
+		{"/count.js", "/snippet", false, ""},
+	}
+
+	for _, test := range tests {
+		config := EndpointConfig{Script: test.script, Event: test.event, Pixel: "/sheep.gif"}
+		if !test.valid {
+			assert.Error(t, config.validate(), "%s %s", test.script, test.event)
+			continue
+		}
+		assert.NoError(t, config.validate(), "%s %s", test.script, test.event)
+		assert.Equal(t, test.rel, config.relativeEvent(), "%s %s", test.script, test.event)
+	}
+}
@@ -0,0 +1,353 @@
+package sheepcount
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+)
+
+// What is known about a visitor who asks for their data to be erased. Visitors are not stored by IP
+// address, so their identifiers are worked out again from what the fingerprint mode hashes: the IP
+// address and headers, the site for daily-site fingerprints, or the identifier kept by the browser
+// for ETag fingerprints.
+type erasureRequest struct {
+	IP         string            `json:"ip"`
+	Headers    map[string]string `json:"headers"`
+	Site       string            `json:"site"`
+	Identifier string            `json:"identifier"`
+}
+
+// What was erased.
+type erasure struct {
+	Users    int64 `json:"users"`    // The visitors whose identifiers were deleted
+	Hits     int64 `json:"hits"`     // Their hits, which no longer have a location, language or display
+	Sessions int64 `json:"sessions"` // Their visits, which are now of an anonymous visitor
+}
+
+// The identifiers of the visitor with the current and previous salts, worked out by the fingerprint
+// mode from a request made up of what is known about them.
+func (sheepcount *SheepCount) erasureIdentifiers(request *erasureRequest) ([][]byte, error) {
+	if sheepcount.AnonymousVisitors || sheepcount.FingerprintMode == "none" {
+		return nil, errors.New("visitors are not identified, so there is nothing to erase")
+	}
+
+	r := &http.Request{Header: make(http.Header), URL: &url.URL{}}
+
+	switch sheepcount.FingerprintMode {
+	case "etag":
+		if !etagIdentifierRegexp.MatchString(request.Identifier) {
+			return nil, errors.New("identifier must be the 32 hex digits that the browser keeps")
+		}
+		r.URL.RawQuery = url.Values{"i": {request.Identifier}}.Encode()
+
+	default:
+		if sheepcount.SiteSalts && request.Site == "" {
+			return nil, errors.New("site is required, as each site has its own salts")
+		}
+
+		ip := parseIP(request.IP)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %q", request.IP)
+		}
+		r.RemoteAddr = ip.String()
+
+		for name, value := range request.Headers {
+			r.Header.Set(name, value)
+		}
+		if request.Site != "" {
+			r.Header.Set("Origin", "https://"+request.Site)
+		}
+	}
+
+	current, previous, err := sheepcount.fingerprintRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return [][]byte{current, previous}, nil
+}
+
+// Erase the visitors with any of the identifiers. Each is replaced by a new visitor without an
+// identifier, so that their hits are still counted once but can no longer be linked to anyone, and
+// the location, language and display of their hits are removed.
+func dbEraseVisitors(ctx context.Context, db *sql.DB, identifiers [][]byte) (erasure, error) {
+	var erased erasure
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return erased, err
+	}
+	defer tx.Rollback()
+
+	// See the comment in HitWriter.WriteBatch
+	if _, err := tx.ExecContext(ctx, "ROLLBACK; BEGIN IMMEDIATE"); err != nil {
+		return erased, err
+	}
+
+	for _, identifier := range identifiers {
+		var userId int64
+		err := tx.QueryRowContext(ctx, "SELECT user_id FROM users WHERE identifier = ?", identifier).Scan(&userId)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return erased, err
+		}
+
+		var anonymousId int64
+		// Which was first seen at the same time, so that its visits are still new or returning
+		err = tx.QueryRowContext(ctx, "INSERT INTO users (identifier, created_at) SELECT NULL, created_at FROM users WHERE user_id = ? RETURNING user_id", userId).Scan(&anonymousId)
+		if err != nil {
+			return erased, err
+		}
+
+		hits, err := dbUpdateHits(
+			ctx,
+			tx,
+			"UPDATE %s SET user_id = ?, location_id = NULL, language_id = NULL, secondary_language_id = NULL, display_id = NULL WHERE user_id = ?",
+			anonymousId,
+			userId,
+		)
+		if err != nil {
+			return erased, err
+		}
+
+		result, err := tx.ExecContext(ctx, "UPDATE sessions SET user_id = ? WHERE user_id = ?", anonymousId, userId)
+		if err != nil {
+			return erased, err
+		}
+		sessions, err := result.RowsAffected()
+		if err != nil {
+			return erased, err
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM users WHERE user_id = ?", userId); err != nil {
+			return erased, err
+		}
+
+		erased.Users++
+		erased.Hits += hits
+		erased.Sessions += sessions
+	}
+
+	return erased, tx.Commit()
+}
+
+// Erase the visitors with any of the identifiers from ClickHouse, as dbEraseVisitors does from
+// SQLite. The visitor of a hit is the start of its identifier, which is replaced by a random one.
+// There are no visits to erase, as they are stitched from the hits when they are queried. The
+// mutations are waited for, so that the hits have been erased once this returns.
+func clickhouseEraseVisitors(ctx context.Context, client *clickhouseClient, identifiers [][]byte) (erasure, error) {
+	var erased erasure
+
+	for _, identifier := range identifiers {
+		if len(identifier) < 8 {
+			continue
+		}
+		visitor := binary.BigEndian.Uint64(identifier)
+
+		var row struct {
+			Hits int64 `json:"hits"`
+		}
+		err := client.queryRow(ctx, "SELECT count() AS hits FROM hits WHERE visitor = {visitor:UInt64}", url.Values{"param_visitor": {strconv.FormatUint(visitor, 10)}}, &row)
+		if err != nil {
+			return erased, err
+		}
+		if row.Hits == 0 {
+			continue
+		}
+
+		var anonymous [8]byte
+		if _, err := rand.Read(anonymous[:]); err != nil {
+			return erased, err
+		}
+
+		err = client.exec(
+			ctx,
+			fmt.Sprintf(
+				`ALTER TABLE hits UPDATE visitor = %d, country = NULL, subdivision = NULL, city = NULL, postal = NULL,
+					language = '', secondary_language = '', screen_height = NULL, screen_width = NULL, pixel_ratio = NULL
+				WHERE visitor = %d`,
+				binary.BigEndian.Uint64(anonymous[:]),
+				visitor,
+			),
+			url.Values{"mutations_sync": {"1"}},
+			nil,
+		)
+		if err != nil {
+			return erased, err
+		}
+
+		erased.Users++
+		erased.Hits += row.Hits
+	}
+
+	return erased, nil
+}
+
+// Erase a visitor for a data subject request. The body is an erasureRequest and the response says
+// what was erased. It needs an admin API token for every site, so that it cannot be used by
+// cross-site requests, as visitors can have visited any of them.
+func handleErase(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	token := apiAuthenticated(sheepcount, w, r)
+	if token == nil {
+		return
+	}
+	if !token.canWrite() || !token.canSee("") {
+		writeAPIError(w, http.StatusForbidden, "erasing visitors needs an admin token for every site")
+		return
+	}
+
+	var request erasureRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	identifiers, err := sheepcount.erasureIdentifiers(&request)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var erased erasure
+	if sheepcount.clickhouse != nil {
+		erased, err = clickhouseEraseVisitors(r.Context(), sheepcount.clickhouse, identifiers)
+	} else {
+		erased, err = dbEraseVisitors(r.Context(), sheepcount.db, identifiers)
+	}
+	if err != nil {
+		log.Print(err)
+		writeAPIError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	log.Printf("Erased %d visitors with %d hits for a data subject request", erased.Users, erased.Hits)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(erased)
+}
+
+func newDeleteUserCommand(configPath *string, databasePath *string) *cobra.Command {
+	var request erasureRequest
+	var headers []string
+
+	cmd := &cobra.Command{
+		Use:   "delete-user",
+		Short: "Erase the data of a visitor, given their IP address and headers or their identifier",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config := DefaultConfig()
+			if _, err := toml.DecodeFile(*configPath, &config); err != nil {
+				return err
+			}
+
+			request.Headers = make(map[string]string, len(headers))
+			for _, header := range headers {
+				name, value, ok := cut(header, ":")
+				if !ok {
+					return fmt.Errorf("header must be Name: value, not %s", header)
+				}
+				request.Headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+			}
+
+			// The daily salt is never saved, so only the running server knows it
+			if config.FingerprintMode == "daily-site" {
+				return errors.New("daily-site identifiers are only known by the running server, so use POST /api/v1/erase")
+			}
+
+			state, err := loadSalts(statePath)
+			if err != nil {
+				return err
+			}
+
+			sheepcount := &SheepCount{state: state, Config: config}
+			sheepcount.fingerprinter, err = newFingerprinter(config.FingerprintMode)
+			if err != nil {
+				return err
+			}
+
+			identifiers, err := sheepcount.erasureIdentifiers(&request)
+			if err != nil {
+				return err
+			}
+
+			var erased erasure
+			if config.clickhouseStorage() {
+				if err := config.validateStorage(); err != nil {
+					return err
+				}
+				erased, err = clickhouseEraseVisitors(cmd.Context(), newClickhouseClient(config.ClickHouse, 0), identifiers)
+			} else {
+				var db *sql.DB
+				db, err = dbConnect(*databasePath)
+				if err != nil {
+					return err
+				}
+				defer db.Close()
+
+				erased, err = dbEraseVisitors(cmd.Context(), db, identifiers)
+			}
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("users     %d\nhits      %d\nsessions  %d\n", erased.Users, erased.Hits, erased.Sessions)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&request.IP, "ip", "", "IP address of the visitor")
+	cmd.Flags().StringArrayVar(&headers, "header", nil, "A header hashed into the fingerprint, such as \"User-Agent: Mozilla/5.0 ...\" (repeatable)")
+	cmd.Flags().StringVar(&request.Identifier, "identifier", "", "Identifier kept by the browser, with fingerprint_mode = \"etag\"")
+	cmd.Flags().StringVar(&request.Site, "site", "", "Site that the visitor visited, with site_salts = true")
+
+	return cmd
+}
+
+// Only the salts of the state file, as loading all of it downloads the GeoIP database if there is none.
+func loadSalts(statePath string) (*State, error) {
+	f, err := os.Open(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("there are no salts in %s, so no visitors can be identified", statePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	state := &State{}
+	if err := json.NewDecoder(f).Decode(state); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", statePath, err)
+	}
+
+	return state, nil
+}
+
+// strings.Cut is not in Go 1.17.
+func cut(s string, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,204 @@
+package sheepcount
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEraseVisitors(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	require.NoError(t, err)
+	defer writer.Close()
+
+	sheepcount := &SheepCount{Config: DefaultConfig(), state: &State{}}
+	sheepcount.state.Salts.Current[0] = 1
+	sheepcount.state.Salts.Previous[0] = 2
+
+	identifiers, err := sheepcount.erasureIdentifiers(&erasureRequest{
+		IP:      "[2001:db8::1]:443",
+		Headers: map[string]string{"User-Agent": "Mozilla/5.0"},
+	})
+	require.NoError(t, err)
+	require.Len(t, identifiers, 2)
+
+	hit := func(timestamp int64, identifier []byte, path string) *Hit {
+		return &Hit{
+			Timestamp:         timestamp,
+			IdentifierCurrent: identifier,
+			UserAgent:         "Mozilla/5.0",
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              path,
+			Language:          "eng",
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	for _, hit := range []*Hit{
+		hit(1654041600, identifiers[1], "/"), // Before the salts were rotated
+		hit(1654041660, identifiers[1], "/about"),
+		hit(1654045200, identifiers[0], "/"),
+		hit(1654045200, []byte("someone else"), "/"),
+	} {
+		require.NoError(t, writer.InsertHit(ctx, tx, hit))
+	}
+	require.NoError(t, tx.Commit())
+	require.NoError(t, dbStitchSessions(ctx, db))
+
+	erased, err := dbEraseVisitors(ctx, db, identifiers)
+	require.NoError(t, err)
+	assert.Equal(t, erasure{Users: 2, Hits: 3, Sessions: 2}, erased)
+
+	count := func(query string) int {
+		var n int
+		require.NoError(t, db.QueryRowContext(ctx, query).Scan(&n))
+		return n
+	}
+
+	assert.Equal(t, 1, count("SELECT COUNT(*) FROM users WHERE identifier IS NOT NULL"))
+	assert.Equal(t, 3, count("SELECT COUNT(*) FROM users WHERE user_id != 0"), "each erased visitor is still counted once")
+	assert.Equal(t, 4, count("SELECT COUNT(*) FROM hits"))
+	assert.Equal(t, 1, count("SELECT COUNT(*) FROM hits WHERE language_id IS NOT NULL"))
+	assert.Equal(t, 3, count("SELECT COUNT(*) FROM sessions"))
+
+	// Erasing again finds nothing
+	erased, err = dbEraseVisitors(ctx, db, identifiers)
+	require.NoError(t, err)
+	assert.Equal(t, erasure{}, erased)
+}
+
+func TestClickhouseEraseVisitors(t *testing.T) {
+	var updates []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		query := params.Get("query")
+		switch {
+		case strings.HasPrefix(query, "SELECT count()"):
+			if params.Get("param_visitor") == "72623859790382856" {
+				io.WriteString(w, `{"hits":3}`+"\n")
+			} else {
+				io.WriteString(w, `{"hits":0}`+"\n")
+			}
+		case strings.HasPrefix(query, "ALTER TABLE hits UPDATE"):
+			assert.Equal(t, "1", params.Get("mutations_sync"))
+			updates = append(updates, query)
+		default:
+			t.Errorf("unexpected query %s", query)
+		}
+	}))
+	defer server.Close()
+
+	client := newClickhouseClient(ClickHouseConfig{URL: server.URL}, 0)
+	identifiers := [][]byte{
+		{1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{8, 7, 6, 5, 4, 3, 2, 1},
+		{1, 2, 3},
+	}
+
+	// Only the visitor with hits is updated, and identifiers too short to be a visitor are skipped
+	erased, err := clickhouseEraseVisitors(context.Background(), client, identifiers)
+	require.NoError(t, err)
+	assert.Equal(t, erasure{Users: 1, Hits: 3}, erased)
+	require.Len(t, updates, 1)
+	assert.True(t, strings.HasSuffix(updates[0], "WHERE visitor = 72623859790382856"))
+	assert.Contains(t, updates[0], "country = NULL")
+}
+
+func TestDeleteUserCommandError(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	configPath := filepath.Join(dir, "sheepcount.toml")
+	databasePath := filepath.Join(dir, "sheepcount.sqlite3")
+	require.NoError(t, os.WriteFile(configPath, nil, 0600))
+
+	state := &State{}
+	state.Salts.Current[0] = 1
+	require.NoError(t, state.Save(statePath))
+
+	sheepcount := &SheepCount{Config: DefaultConfig(), state: state}
+	request := erasureRequest{IP: "192.0.2.1", Headers: map[string]string{"User-Agent": "Mozilla/5.0"}}
+	identifiers, err := sheepcount.erasureIdentifiers(&request)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	db, err := dbConnect(databasePath)
+	require.NoError(t, err)
+	writer, err := NewHitWriter(ctx, db)
+	require.NoError(t, err)
+	tx, err := db.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, writer.InsertHit(ctx, tx, &Hit{
+		Timestamp:         1654041600,
+		IdentifierCurrent: identifiers[0],
+		UserAgent:         "Mozilla/5.0",
+		Event:             PageLoad,
+		Domain:            "example.com",
+		Path:              "/",
+	}))
+	require.NoError(t, tx.Commit())
+	writer.Close()
+
+	// The visitor is found, but their anonymous user cannot be inserted
+	_, err = db.ExecContext(ctx, "CREATE TRIGGER fail_erasure BEFORE INSERT ON users BEGIN SELECT RAISE(ABORT, 'erasure failed'); END")
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	cmd := newDeleteUserCommand(&configPath, &databasePath)
+	cmd.SetArgs([]string{"--ip", request.IP, "--header", "User-Agent: Mozilla/5.0"})
+	cmd.SilenceUsage = true
+	cmd.SilenceErrors = true
+	assert.ErrorContains(t, cmd.ExecuteContext(ctx), "erasure failed")
+}
+
+func TestErasureIdentifiers(t *testing.T) {
+	sheepcount := &SheepCount{Config: DefaultConfig(), state: &State{}}
+
+	_, err := sheepcount.erasureIdentifiers(&erasureRequest{IP: "not an address"})
+	assert.Error(t, err)
+
+	// With site salts, the identifiers depend on the site
+	sheepcount.SiteSalts = true
+	_, err = sheepcount.erasureIdentifiers(&erasureRequest{IP: "192.0.2.1"})
+	assert.Error(t, err)
+	identifiers, err := sheepcount.erasureIdentifiers(&erasureRequest{IP: "192.0.2.1", Site: "example.com"})
+	require.NoError(t, err)
+	other, err := sheepcount.erasureIdentifiers(&erasureRequest{IP: "192.0.2.1", Site: "example.org"})
+	require.NoError(t, err)
+	assert.NotEqual(t, identifiers, other)
+	sheepcount.SiteSalts = false
+
+	sheepcount.FingerprintMode = "none"
+	_, err = sheepcount.erasureIdentifiers(&erasureRequest{IP: "192.0.2.1"})
+	assert.Error(t, err)
+
+	sheepcount.FingerprintMode = "etag"
+	sheepcount.fingerprinter, err = newFingerprinter("etag")
+	require.NoError(t, err)
+	_, err = sheepcount.erasureIdentifiers(&erasureRequest{Identifier: "xyz"})
+	assert.Error(t, err)
+	identifiers, err = sheepcount.erasureIdentifiers(&erasureRequest{Identifier: "0123456789abcdef0123456789abcdef"})
+	require.NoError(t, err)
+	assert.Equal(t, identifiers[0], identifiers[1])
+}
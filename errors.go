@@ -1,4 +1,4 @@
-package main
+package sheepcount
 
 import (
 	_ "embed"
@@ -69,3 +69,19 @@ func (err *InternalError) Unwrap() error {
 func (err *InternalError) StatusCode() int {
 	return http.StatusInternalServerError
 }
+
+type ErrTooLarge struct {
+	limit int64
+}
+
+func (err *ErrTooLarge) Error() string {
+	return fmt.Sprintf("too large: more than %d bytes", err.limit)
+}
+
+func (err *ErrTooLarge) Unwrap() error {
+	return nil
+}
+
+func (err *ErrTooLarge) StatusCode() int {
+	return http.StatusRequestEntityTooLarge
+}
@@ -0,0 +1,78 @@
+package sheepcount
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+)
+
+const settingEventTokenKey = "event_token_key"
+
+// The number of events rejected for not having a valid token
+var spamHits = expvar.NewInt("spam_hits")
+
+// The key for event tokens is generated the first time that it is needed and kept in the settings.
+func dbEventTokenKey(ctx context.Context, db *sql.DB) ([]byte, error) {
+	settings, err := dbSettings(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := settings[settingEventTokenKey]
+	if !ok {
+		if key, err = randomHex(32); err != nil {
+			return nil, err
+		}
+		if err := dbSetSettings(ctx, db, map[string]string{settingEventTokenKey: key}); err != nil {
+			return nil, err
+		}
+	}
+
+	return hex.DecodeString(key)
+}
+
+// The token that events for site must have. It is an HMAC of the domain so that nothing needs to be
+// stored for each site, and it is the same every time that the script is served.
+func eventToken(key []byte, site string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(site))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:18])
+}
+
+func (sheepcount *SheepCount) checkEventToken(site string, token string) Error {
+	if sheepcount.eventTokenKey == nil {
+		return nil
+	}
+
+	if !hmac.Equal([]byte(token), []byte(eventToken(sheepcount.eventTokenKey, site))) {
+		spamHits.Add(1)
+		return &ErrNotAuthorized{wrapped: fmt.Errorf("invalid event token for %s", site)}
+	}
+
+	return nil
+}
+
+// The tokens of the sites that the script can send events for, which are all public as they are in
+// the script that every visitor downloads. They stop junk being sent without loading the script.
+func (sheepcount *SheepCount) eventTokens(allowLocalhost bool) map[string]string {
+	if sheepcount.eventTokenKey == nil {
+		return nil
+	}
+
+	sites := sheepcount.Domains
+	if allowLocalhost {
+		sites = []string{"localhost", "127.0.0.1"}
+	}
+
+	tokens := make(map[string]string, len(sites))
+	for _, site := range sites {
+		tokens[site] = eventToken(sheepcount.eventTokenKey, site)
+	}
+
+	return tokens
+}
@@ -0,0 +1,388 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// A hit joined with all of its dimensions
+type ExportedHit struct {
+	Timestamp         time.Time `json:"timestamp"`
+	Site              string    `json:"site"`
+	Event             EventType `json:"event"`
+	Path              string    `json:"path"`
+	ReferrerDomain    *string   `json:"referrer_domain"`
+	ReferrerPath      *string   `json:"referrer_path"`
+	UserAgent         string    `json:"user_agent"`
+	BrowserName       *string   `json:"browser_name"`
+	BrowserVersion    *string   `json:"browser_version"`
+	OSName            *string   `json:"os_name"`
+	OSVersion         *string   `json:"os_version"`
+	Bot               *int64    `json:"bot"`
+	Country           *string   `json:"country"`
+	Subdivision       *string   `json:"subdivision"`
+	City              *string   `json:"city"`
+	Postal            *string   `json:"postal"`
+	Language          *string   `json:"language"`
+	ScreenHeight      *int64    `json:"screen_height"`
+	ScreenWidth       *int64    `json:"screen_width"`
+	PixelRatio        *float64  `json:"pixel_ratio"`
+	Device            *string   `json:"device"`
+	SecondaryLanguage *string   `json:"secondary_language"`
+}
+
+var exportHeader = []string{
+	"timestamp",
+	"site",
+	"event",
+	"path",
+	"referrer_domain",
+	"referrer_path",
+	"user_agent",
+	"browser_name",
+	"browser_version",
+	"os_name",
+	"os_version",
+	"bot",
+	"country",
+	"subdivision",
+	"city",
+	"postal",
+	"language",
+	"screen_height",
+	"screen_width",
+	"pixel_ratio",
+	"device",
+	"secondary_language",
+}
+
+func (hit *ExportedHit) record() []string {
+	nullString := func(s *string) string {
+		if s != nil {
+			return *s
+		}
+		return ""
+	}
+	nullInt := func(i *int64) string {
+		if i != nil {
+			return strconv.FormatInt(*i, 10)
+		}
+		return ""
+	}
+
+	pixelRatio := ""
+	if hit.PixelRatio != nil {
+		pixelRatio = strconv.FormatFloat(*hit.PixelRatio, 'f', -1, 64)
+	}
+
+	return []string{
+		hit.Timestamp.Format(time.RFC3339),
+		hit.Site,
+		string(hit.Event),
+		hit.Path,
+		nullString(hit.ReferrerDomain),
+		nullString(hit.ReferrerPath),
+		hit.UserAgent,
+		nullString(hit.BrowserName),
+		nullString(hit.BrowserVersion),
+		nullString(hit.OSName),
+		nullString(hit.OSVersion),
+		nullInt(hit.Bot),
+		nullString(hit.Country),
+		nullString(hit.Subdivision),
+		nullString(hit.City),
+		nullString(hit.Postal),
+		nullString(hit.Language),
+		nullInt(hit.ScreenHeight),
+		nullInt(hit.ScreenWidth),
+		pixelRatio,
+		nullString(hit.Device),
+		nullString(hit.SecondaryLanguage),
+	}
+}
+
+const exportQuery = `
+	WITH RECURSIVE
+		-- Walk up the locations tree to get the full location for every location_id
+		l(location_id, ancestor_id, country, subdivision, city, postal) AS (
+			SELECT location_id, parent_id, country, subdivision, city, postal FROM locations
+			UNION ALL
+			SELECT l.location_id
+				, locations.parent_id
+				, COALESCE(l.country, locations.country)
+				, COALESCE(l.subdivision, locations.subdivision)
+				, COALESCE(l.city, locations.city)
+				, COALESCE(l.postal, locations.postal)
+			FROM l INNER JOIN locations ON locations.location_id = l.ancestor_id
+		),
+		full_locations AS (
+			SELECT location_id, country, subdivision, city, postal FROM l WHERE ancestor_id IS NULL
+		)
+	SELECT hits.timestamp
+		, sites.domain
+		, hits.event
+		, paths.path
+		, referrers.domain
+		, referrers.path
+		, user_agents.user_agent
+		, browsers.browser_name
+		, browsers.browser_version
+		, oss.os_name
+		, oss.os_version
+		, COALESCE(hits.bot, user_agents.bot) -- See zgo.at/isbot for the meaning of this
+		, full_locations.country
+		, full_locations.subdivision
+		, full_locations.city
+		, full_locations.postal
+		, languages.iso_639_3
+		, displays.screen_height
+		, displays.screen_width
+		, displays.pixel_ratio
+		, hits.device
+		, secondary_languages.iso_639_3
+	FROM hits
+	INNER JOIN sites ON hits.site_id = sites.site_id
+	INNER JOIN paths ON hits.path_id = paths.path_id
+	INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+	LEFT JOIN referrers ON hits.referrer_id = referrers.referrer_id
+	LEFT JOIN browsers ON user_agents.browser_id = browsers.browser_id
+	LEFT JOIN oss ON user_agents.os_id = oss.os_id
+	LEFT JOIN full_locations ON hits.location_id = full_locations.location_id
+	LEFT JOIN languages ON hits.language_id = languages.language_id
+	LEFT JOIN languages AS secondary_languages ON hits.secondary_language_id = secondary_languages.language_id
+	LEFT JOIN displays ON hits.display_id = displays.display_id
+	WHERE hits.timestamp >= :start
+	  AND hits.timestamp < :end
+	  AND (:site IS NULL OR sites.domain = :site)
+	ORDER BY hits.timestamp, hits.hit_id`
+
+// Call fn for every hit between start (inclusive) and end (exclusive). If site is empty, hits for
+// all sites are exported.
+func dbExport(ctx context.Context, db *sql.DB, start time.Time, end time.Time, site string, fn func(*ExportedHit) error) error {
+	var siteParam sql.NullString
+	if site != "" {
+		siteParam = sql.NullString{String: site, Valid: true}
+	}
+
+	rows, err := db.QueryContext(
+		ctx,
+		exportQuery,
+		sql.Named("start", start.Unix()),
+		sql.Named("end", end.Unix()),
+		sql.Named("site", siteParam),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hit ExportedHit
+		var timestamp int64
+
+		err := rows.Scan(
+			&timestamp,
+			&hit.Site,
+			&hit.Event,
+			&hit.Path,
+			&hit.ReferrerDomain,
+			&hit.ReferrerPath,
+			&hit.UserAgent,
+			&hit.BrowserName,
+			&hit.BrowserVersion,
+			&hit.OSName,
+			&hit.OSVersion,
+			&hit.Bot,
+			&hit.Country,
+			&hit.Subdivision,
+			&hit.City,
+			&hit.Postal,
+			&hit.Language,
+			&hit.ScreenHeight,
+			&hit.ScreenWidth,
+			&hit.PixelRatio,
+			&hit.Device,
+			&hit.SecondaryLanguage,
+		)
+		if err != nil {
+			return err
+		}
+		hit.Timestamp = time.Unix(timestamp, 0).UTC()
+
+		if err := fn(&hit); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Write hits as either CSV or newline delimited JSON.
+func writeExport(ctx context.Context, db *sql.DB, w io.Writer, format string, start time.Time, end time.Time, site string) error {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(exportHeader); err != nil {
+			return err
+		}
+
+		err := dbExport(ctx, db, start, end, site, func(hit *ExportedHit) error {
+			return cw.Write(hit.record())
+		})
+		if err != nil {
+			return err
+		}
+
+		cw.Flush()
+		return cw.Error()
+
+	case "ndjson":
+		enc := json.NewEncoder(w)
+		return dbExport(ctx, db, start, end, site, func(hit *ExportedHit) error {
+			return enc.Encode(hit)
+		})
+
+	default:
+		return fmt.Errorf("unknown export format: %s", format)
+	}
+}
+
+// Parse a YYYY-MM-DD date range where both the start and end dates are inclusive.
+func parseDateRange(startDate string, endDate string) (time.Time, time.Time, error) {
+	start, err := time.Parse("2006-01-02", startDate)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid start date: %w", err)
+	}
+
+	end, err := time.Parse("2006-01-02", endDate)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid end date: %w", err)
+	}
+	end = end.AddDate(0, 0, 1)
+
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, fmt.Errorf("start date is after end date")
+	}
+
+	return start, end, nil
+}
+
+func handleExport(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/export" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Without a site, the hits of every site are exported
+	account := sheepcount.session(r)
+	if account == nil || !account.canSee(r.URL.Query().Get("site")) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// The hits in ClickHouse can be exported from it directly
+	if sheepcount.clickhouse != nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		io.WriteString(w, "exports are only available with sqlite storage")
+		return
+	}
+
+	params := r.URL.Query()
+
+	start, end, err := parseDateRange(params.Get("start_date"), params.Get("end_date"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	format := params.Get("format")
+	switch format {
+	case "", "csv":
+		format = "csv"
+		w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "Invalid format")
+		return
+	}
+
+	site := params.Get("site")
+
+	filename := fmt.Sprintf("sheepcount-%s-%s.%s", params.Get("start_date"), params.Get("end_date"), format)
+	if site != "" {
+		filename = fmt.Sprintf("sheepcount-%s-%s-%s.%s", site, params.Get("start_date"), params.Get("end_date"), format)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	// Once we start writing it is too late to change the status code, so just log any errors
+	if err := writeExport(r.Context(), sheepcount.readDB, w, format, start, end, site); err != nil {
+		log.Printf("cannot export hits: %s", err)
+	}
+}
+
+func newExportCommand(databasePath *string) *cobra.Command {
+	var startDate, endDate, format, site, output string
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export hits as CSV or newline delimited JSON",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			start, end, err := parseDateRange(startDate, endDate)
+			if err != nil {
+				return err
+			}
+
+			format = strings.ToLower(format)
+			if format != "csv" && format != "ndjson" {
+				return fmt.Errorf("unknown export format: %s", format)
+			}
+
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			var w io.Writer = os.Stdout
+			if output != "" && output != "-" {
+				f, err := os.Create(output)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				w = f
+			}
+
+			return writeExport(cmd.Context(), db, w, format, start, end, site)
+		},
+	}
+
+	today := time.Now().UTC().Format("2006-01-02")
+	cmd.Flags().StringVar(&startDate, "start", today, "First date to export (YYYY-MM-DD)")
+	cmd.Flags().StringVar(&endDate, "end", today, "Last date to export (YYYY-MM-DD)")
+	cmd.Flags().StringVar(&format, "format", "csv", "Output format: csv or ndjson")
+	cmd.Flags().StringVar(&site, "site", "", "Only export hits for this site")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "File to write to (default stdout)")
+
+	return cmd
+}
@@ -0,0 +1,233 @@
+package sheepcount
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/hkdf"
+)
+
+// How visitors are told apart, chosen with fingerprint_mode. Each returns the identifiers of the
+// visitor with the current and the previous salts.
+var fingerprinters = map[string]func(*SheepCount, *http.Request) ([]byte, []byte, Error){
+	// A hash of the IP address and some headers with the rotating salts, or with site_salts, with
+	// salts derived from them for the site
+	"ip-headers": fingerprintIPHeaders,
+
+	// A random identifier that the browser keeps in its cache, as the ETag of the response to a GET
+	// request to the event endpoint, and the script sends with each event. It lasts until the cache
+	// is cleared, so is more accurate but less private.
+	"etag": fingerprintETag,
+
+	// Every hit is from a different visitor
+	"none": fingerprintNone,
+
+	// A hash of the site, IP address and headers with a salt that changes at midnight UTC, so
+	// visitors cannot be followed from one day to the next or from one site to another. The salt
+	// is only kept in memory, so visitors are counted again after a restart.
+	"daily-site": fingerprintDailySite,
+}
+
+func newFingerprinter(mode string) (func(*SheepCount, *http.Request) ([]byte, []byte, Error), error) {
+	if mode == "" {
+		return nil, nil
+	}
+
+	fingerprinter, ok := fingerprinters[mode]
+	if !ok {
+		return nil, fmt.Errorf("invalid fingerprint mode: %s", mode)
+	}
+
+	return fingerprinter, nil
+}
+
+func fingerprintIPHeaders(sheepcount *SheepCount, r *http.Request) ([]byte, []byte, Error) {
+	sheepcount.state.Salts.RLock()
+	currentSalt, previousSalt := sheepcount.state.Salts.Current, sheepcount.state.Salts.Previous
+	sheepcount.state.Salts.RUnlock()
+
+	current, previous := currentSalt[:], previousSalt[:]
+	if sheepcount.SiteSalts {
+		site := requestSite(r)
+		current, previous = siteSalt(current, site), siteSalt(previous, site)
+	}
+
+	hasherCurrent, err := blake2b.New(blake2b.Size256, current)
+	if err != nil {
+		return nil, nil, NewInternalError(err)
+	}
+
+	hasherPrevious, err := blake2b.New(blake2b.Size256, previous)
+	if err != nil {
+		return nil, nil, NewInternalError(err)
+	}
+
+	sheepcount.hashIP(r, hasherCurrent, hasherPrevious)
+
+	for _, header := range sheepcount.HeadersToHash {
+		hasherCurrent.Write([]byte(r.Header.Get(header)))
+		hasherPrevious.Write([]byte(r.Header.Get(header)))
+	}
+
+	identCurrent, identPrevious := hasherCurrent.Sum(nil), hasherPrevious.Sum(nil)
+	sheepcount.wipeHashers(hasherCurrent, hasherPrevious)
+	return identCurrent, identPrevious, nil
+}
+
+// Write the IP address of the visitor to the keyed hashes. With forget_ips, the bytes of the
+// address are written rather than its text, as strings cannot be wiped, and are wiped afterwards.
+func (sheepcount *SheepCount) hashIP(r *http.Request, hashers ...hash.Hash) {
+	ip := sheepcount.visitorIP(r)
+
+	if !sheepcount.ForgetIPs {
+		for _, hasher := range hashers {
+			hasher.Write([]byte(ip.String()))
+		}
+		return
+	}
+
+	buf := ip.To16()
+	for _, hasher := range hashers {
+		hasher.Write(buf)
+	}
+	wipe(buf)
+	wipe(ip)
+}
+
+// With forget_ips, reset the hashers once they are summed, which overwrites the block that still
+// holds the address with the key.
+func (sheepcount *SheepCount) wipeHashers(hashers ...hash.Hash) {
+	if sheepcount.ForgetIPs {
+		for _, hasher := range hashers {
+			hasher.Reset()
+		}
+	}
+}
+
+func wipe(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
+
+// A salt for the site, derived from one of the rotating salts with HKDF, so that the identifiers of a
+// visitor on one site cannot be matched with those on another without the salts. Enabling site_salts
+// changes every identifier, so visitors are counted again.
+func siteSalt(salt []byte, site string) []byte {
+	derived := make([]byte, len(salt))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, salt, nil, []byte("sheepcount site salt "+site)), derived); err != nil {
+		panic(err) // Only if far more is read than HKDF can derive
+	}
+	return derived
+}
+
+// The site is the origin of the page that sent the event, or failing that its referrer.
+func requestSite(r *http.Request) string {
+	site := r.Header.Get("Origin")
+	if site == "" {
+		site = r.Header.Get("Referer")
+	}
+	if u, err := url.Parse(site); err == nil {
+		site = u.Hostname()
+	}
+	return strings.ToLower(site)
+}
+
+var etagIdentifierRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// The identifier is given in the i query parameter. Without one, such as from the tracking pixel,
+// the visitor cannot be recognised.
+func fingerprintETag(sheepcount *SheepCount, r *http.Request) ([]byte, []byte, Error) {
+	id := r.URL.Query().Get("i")
+	if !etagIdentifierRegexp.MatchString(id) {
+		return fingerprintNone(sheepcount, r)
+	}
+
+	identifier := blake2b.Sum256([]byte(id))
+	return identifier[:], identifier[:], nil
+}
+
+func fingerprintNone(sheepcount *SheepCount, r *http.Request) ([]byte, []byte, Error) {
+	identifier := make([]byte, blake2b.Size256)
+	if _, err := rand.Read(identifier); err != nil {
+		return nil, nil, NewInternalError(err)
+	}
+	return identifier, identifier, nil
+}
+
+type dailySalt struct {
+	sync.Mutex
+	day  string
+	salt [16]byte
+}
+
+func (daily *dailySalt) get(now time.Time) ([]byte, error) {
+	daily.Lock()
+	defer daily.Unlock()
+
+	if day := now.UTC().Format("2006-01-02"); day != daily.day {
+		if _, err := rand.Read(daily.salt[:]); err != nil {
+			return nil, err
+		}
+		daily.day = day
+	}
+
+	salt := daily.salt
+	return salt[:], nil
+}
+
+func fingerprintDailySite(sheepcount *SheepCount, r *http.Request) ([]byte, []byte, Error) {
+	salt, err := sheepcount.dailySalt.get(time.Now())
+	if err != nil {
+		return nil, nil, NewInternalError(err)
+	}
+
+	hasher, err := blake2b.New(blake2b.Size256, salt)
+	if err != nil {
+		return nil, nil, NewInternalError(err)
+	}
+
+	hasher.Write([]byte(requestSite(r)))
+	hasher.Write([]byte{0})
+	sheepcount.hashIP(r, hasher)
+	for _, header := range sheepcount.HeadersToHash {
+		hasher.Write([]byte(r.Header.Get(header)))
+	}
+
+	identifier := hasher.Sum(nil)
+	sheepcount.wipeHashers(hasher)
+	return identifier, identifier, nil
+}
+
+// With etag fingerprinting, the script first fetches its identifier from the event endpoint. The
+// browser caches the response and revalidates it with If-None-Match every time, so gets the same
+// identifier back until its cache is cleared.
+func handleIdentifier(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	if match := r.Header.Get("If-None-Match"); len(match) == 34 && etagIdentifierRegexp.MatchString(match[1:33]) {
+		w.Header().Set("ETag", match)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("ETag", `"`+id+`"`)
+	w.Write([]byte(id))
+}
@@ -0,0 +1,123 @@
+package sheepcount
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprinters(t *testing.T) {
+	sheepcount := &SheepCount{Config: DefaultConfig(), state: &State{}}
+	sheepcount.state.Salts.Current[0] = 1
+
+	request := func(target string, origin string, remoteAddr string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, target, nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("User-Agent", "Mozilla/5.0")
+		r.RemoteAddr = remoteAddr
+		return r
+	}
+
+	fingerprint := func(mode string, r *http.Request) []byte {
+		fingerprinter, err := newFingerprinter(mode)
+		require.NoError(t, err)
+		current, previous, herr := fingerprinter(sheepcount, r)
+		require.Nil(t, herr)
+		require.Len(t, current, 32)
+		require.Len(t, previous, 32)
+		return current
+	}
+
+	a := request("http://stats.example.com/event", "https://example.com", "192.0.2.1")
+	b := request("http://stats.example.com/event", "https://example.org", "192.0.2.1")
+	c := request("http://stats.example.com/event", "https://example.com", "192.0.2.2")
+
+	assert.Equal(t, fingerprint("ip-headers", a), fingerprint("ip-headers", b))
+	assert.NotEqual(t, fingerprint("ip-headers", a), fingerprint("ip-headers", c))
+
+	assert.NotEqual(t, fingerprint("none", a), fingerprint("none", a))
+
+	// With site salts, the same visitor has different identifiers on each site
+	sheepcount.SiteSalts = true
+	assert.Equal(t, fingerprint("ip-headers", a), fingerprint("ip-headers", a))
+	assert.NotEqual(t, fingerprint("ip-headers", a), fingerprint("ip-headers", b))
+	assert.NotEqual(t, fingerprint("ip-headers", a), fingerprint("ip-headers", c))
+	assert.Equal(t, siteSalt(sheepcount.state.Salts.Current[:], "example.com"), siteSalt(sheepcount.state.Salts.Current[:], "example.com"))
+	assert.NotEqual(t, siteSalt(sheepcount.state.Salts.Current[:], "example.com"), siteSalt(sheepcount.state.Salts.Previous[:], "example.com"))
+	sheepcount.SiteSalts = false
+
+	assert.Equal(t, fingerprint("daily-site", a), fingerprint("daily-site", a))
+	assert.NotEqual(t, fingerprint("daily-site", a), fingerprint("daily-site", b))
+	assert.NotEqual(t, fingerprint("daily-site", a), fingerprint("daily-site", c))
+
+	// The salt changes the next day
+	today, err := sheepcount.dailySalt.get(time.Now())
+	require.NoError(t, err)
+	tomorrow, err := sheepcount.dailySalt.get(time.Now().Add(24 * time.Hour))
+	require.NoError(t, err)
+	assert.NotEqual(t, today, tomorrow)
+
+	const id = "0123456789abcdef0123456789abcdef"
+	d := request("http://stats.example.com/event?i="+id, "https://example.com", "192.0.2.1")
+	e := request("http://stats.example.com/event?i="+id, "https://example.org", "192.0.2.2")
+	assert.Equal(t, fingerprint("etag", d), fingerprint("etag", e))
+	assert.NotEqual(t, fingerprint("etag", a), fingerprint("etag", a), "without an identifier every hit is unique")
+
+	// Visitors of the same network are the same visitor with anonymized IPs
+	sheepcount.AnonymizeIPs = true
+	for _, mode := range []string{"ip-headers", "daily-site"} {
+		assert.Equal(t, fingerprint(mode, a), fingerprint(mode, c), mode)
+		assert.NotEqual(t, fingerprint(mode, a), fingerprint(mode, request("http://stats.example.com/event", "https://example.com", "192.0.3.1")), mode)
+	}
+	sheepcount.AnonymizeIPs = false
+
+	// Forgetting addresses changes the identifiers, but not who is told apart
+	withText := fingerprint("ip-headers", a)
+	sheepcount.ForgetIPs = true
+	assert.NotEqual(t, withText, fingerprint("ip-headers", a))
+	for _, mode := range []string{"ip-headers", "daily-site"} {
+		assert.Equal(t, fingerprint(mode, a), fingerprint(mode, a), mode)
+		assert.NotEqual(t, fingerprint(mode, a), fingerprint(mode, c), mode)
+	}
+	sheepcount.ForgetIPs = false
+
+	_, err = newFingerprinter("cookie")
+	assert.Error(t, err)
+}
+
+func TestETagIdentifier(t *testing.T) {
+	config := DefaultConfig()
+	config.FingerprintMode = "etag"
+	config.Domains = []string{"example.com"}
+	sheepcount := &SheepCount{Config: config}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://stats.example.com/event", nil)
+	r.Header.Set("Origin", "https://example.com")
+	handleEvent(sheepcount, nil, w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "private, no-cache", w.Header().Get("Cache-Control"))
+
+	id := w.Body.String()
+	assert.Regexp(t, `^[0-9a-f]{32}$`, id)
+	assert.Equal(t, `"`+id+`"`, w.Header().Get("ETag"))
+
+	// The browser revalidates its cached identifier
+	r = httptest.NewRequest(http.MethodGet, "http://stats.example.com/event", nil)
+	r.Header.Set("If-None-Match", `"`+id+`"`)
+	w = httptest.NewRecorder()
+	handleEvent(sheepcount, nil, w, r)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, `"`+id+`"`, w.Header().Get("ETag"))
+
+	// Only with etag fingerprinting
+	sheepcount.FingerprintMode = ""
+	w = httptest.NewRecorder()
+	handleEvent(sheepcount, nil, w, httptest.NewRequest(http.MethodGet, "http://stats.example.com/event", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -0,0 +1,152 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// Deletes the rows of a dimension table that nothing references any more. The row with the largest
+// ID is always kept, as otherwise SQLite would give its ID to the next row inserted and the cached
+// IDs of a running server could then refer to the wrong row. The queries are run in order, so the
+// browsers and operating systems of deleted user agents are deleted too.
+var garbageQueries = []struct {
+	table string
+	query string
+}{
+	{"paths", `
+		DELETE FROM paths
+		WHERE path_id NOT IN (SELECT path_id FROM hits)
+		  AND path_id NOT IN (SELECT path_id FROM hits_hourly)
+		  AND path_id NOT IN (SELECT path_id FROM hits_daily)
+		  AND path_id NOT IN (SELECT path_id FROM hits_local_daily)
+		  AND path_id NOT IN (SELECT entry_path_id FROM sessions)
+		  AND path_id NOT IN (SELECT exit_path_id FROM sessions)
+		  AND path_id NOT IN (SELECT path_id FROM session_pages)
+		  AND path_id != (SELECT MAX(path_id) FROM paths)`},
+	{"referrers", `
+		DELETE FROM referrers
+		WHERE referrer_id NOT IN (SELECT referrer_id FROM hits WHERE referrer_id IS NOT NULL)
+		  AND referrer_id NOT IN (SELECT referrer_id FROM hits_hourly WHERE referrer_id IS NOT NULL)
+		  AND referrer_id NOT IN (SELECT referrer_id FROM hits_daily WHERE referrer_id IS NOT NULL)
+		  AND referrer_id NOT IN (SELECT referrer_id FROM hits_local_daily WHERE referrer_id IS NOT NULL)
+		  AND referrer_id != (SELECT MAX(referrer_id) FROM referrers)`},
+	{"campaigns", `
+		DELETE FROM campaigns
+		WHERE campaign_id NOT IN (SELECT campaign_id FROM hits WHERE campaign_id IS NOT NULL)
+		  AND campaign_id != (SELECT MAX(campaign_id) FROM campaigns)`},
+	{"targets", `
+		DELETE FROM targets
+		WHERE target_id NOT IN (SELECT target_id FROM hits WHERE target_id IS NOT NULL)
+		  AND target_id != (SELECT MAX(target_id) FROM targets)`},
+	{"keywords", `
+		DELETE FROM keywords
+		WHERE keyword_id NOT IN (SELECT keyword_id FROM hits WHERE keyword_id IS NOT NULL)
+		  AND keyword_id != (SELECT MAX(keyword_id) FROM keywords)`},
+	{"event_names", `
+		DELETE FROM event_names
+		WHERE event_name_id NOT IN (SELECT event_name_id FROM hits WHERE event_name_id IS NOT NULL)
+		  AND event_name_id != (SELECT MAX(event_name_id) FROM event_names)`},
+	{"displays", `
+		DELETE FROM displays
+		WHERE display_id NOT IN (SELECT display_id FROM hits WHERE display_id IS NOT NULL)
+		  AND display_id != (SELECT MAX(display_id) FROM displays)`},
+	{"user_agents", `
+		DELETE FROM user_agents
+		WHERE user_agent_id NOT IN (SELECT user_agent_id FROM hits)
+		  AND user_agent_id != (SELECT MAX(user_agent_id) FROM user_agents)`},
+	{"browsers", `
+		DELETE FROM browsers
+		WHERE browser_id NOT IN (SELECT browser_id FROM user_agents WHERE browser_id IS NOT NULL)
+		  AND browser_id NOT IN (SELECT browser_id FROM hits_hourly WHERE browser_id IS NOT NULL)
+		  AND browser_id NOT IN (SELECT browser_id FROM hits_daily WHERE browser_id IS NOT NULL)
+		  AND browser_id NOT IN (SELECT browser_id FROM hits_local_daily WHERE browser_id IS NOT NULL)
+		  AND browser_id != (SELECT MAX(browser_id) FROM browsers)`},
+	{"oss", `
+		DELETE FROM oss
+		WHERE os_id NOT IN (SELECT os_id FROM user_agents WHERE os_id IS NOT NULL)
+		  AND os_id != (SELECT MAX(os_id) FROM oss)`},
+	// Locations are a tree, so keep the ancestors of the locations in use too
+	{"locations", `
+		WITH RECURSIVE used(location_id) AS (
+			SELECT location_id FROM hits WHERE location_id IS NOT NULL
+			UNION
+			SELECT MAX(location_id) FROM locations
+			UNION
+			SELECT locations.parent_id
+			FROM locations INNER JOIN used ON locations.location_id = used.location_id
+			WHERE locations.parent_id IS NOT NULL
+		)
+		DELETE FROM locations WHERE location_id NOT IN (SELECT location_id FROM used WHERE location_id IS NOT NULL)`},
+}
+
+type garbageCollected struct {
+	table   string
+	deleted int64
+}
+
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// Delete the unreferenced rows of the dimension tables in one transaction, returning how many were
+// deleted from each.
+func dbCollectGarbage(ctx context.Context, db txBeginner) ([]garbageCollected, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// See the comment in HitWriter.WriteBatch
+	if _, err := tx.ExecContext(ctx, "ROLLBACK; BEGIN IMMEDIATE"); err != nil {
+		return nil, err
+	}
+
+	collected := make([]garbageCollected, 0, len(garbageQueries))
+	for _, garbage := range garbageQueries {
+		result, err := tx.ExecContext(ctx, garbage.query)
+		if err != nil {
+			return nil, fmt.Errorf("%s delete error: %w", garbage.table, err)
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		collected = append(collected, garbageCollected{table: garbage.table, deleted: n})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return collected, nil
+}
+
+func newGCCommand(databasePath *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "gc",
+		Short: "Delete paths, referrers, user agents and so on that no hits refer to any more",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			collected, err := dbCollectGarbage(cmd.Context(), db)
+			if err != nil {
+				return err
+			}
+
+			for _, garbage := range collected {
+				fmt.Printf("%-12s %d\n", garbage.table, garbage.deleted)
+			}
+			return nil
+		},
+	}
+}
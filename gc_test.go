@@ -0,0 +1,99 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	require.NoError(t, err)
+	defer writer.Close()
+
+	conn, err := db.Conn(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	nullString := func(s string) sql.NullString {
+		return sql.NullString{String: s, Valid: true}
+	}
+
+	hit := func(path string, referrer string, userAgent string, city string) Hit {
+		return Hit{
+			Timestamp:         1654041600,
+			IdentifierCurrent: []byte(path),
+			UserAgent:         userAgent,
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              path,
+			ReferrerDomain:    nullString(referrer),
+			ReferrerPath:      nullString("/"),
+			Location:          Location{Country: nullString("GB"), Subdivision: nullString("ENG"), City: nullString(city)},
+		}
+	}
+
+	const firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0"
+	const chrome = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/102.0.0.0 Safari/537.36"
+
+	// The first hit is pruned and the last is there to keep the largest IDs in use
+	require.NoError(t, writer.WriteBatch(ctx, conn, []Hit{
+		hit("/old", "old.example.org", chrome, "Leeds"),
+		hit("/", "new.example.org", firefox, "London"),
+		hit("/about", "new.example.org", firefox, "London"),
+	}))
+	_, err = conn.ExecContext(ctx, "DELETE FROM hits_202206 WHERE path_id = (SELECT path_id FROM paths WHERE path = '/old')")
+	require.NoError(t, err)
+
+	collected, err := dbCollectGarbage(ctx, conn)
+	require.NoError(t, err)
+
+	deleted := make(map[string]int64)
+	for _, garbage := range collected {
+		deleted[garbage.table] = garbage.deleted
+	}
+	assert.Equal(t, map[string]int64{
+		"paths":       1,
+		"referrers":   1,
+		"campaigns":   0,
+		"targets":     0,
+		"event_names": 0,
+		"keywords":    0,
+		"displays":    0,
+		"user_agents": 1,
+		"browsers":    1,
+		"oss":         1,
+		"locations":   1,
+	}, deleted)
+
+	count := func(query string) int {
+		var n int
+		require.NoError(t, conn.QueryRowContext(ctx, query).Scan(&n))
+		return n
+	}
+	assert.Equal(t, 2, count("SELECT COUNT(*) FROM paths"))
+	assert.Equal(t, 0, count("SELECT COUNT(*) FROM paths WHERE path = '/old'"))
+	assert.Equal(t, 0, count("SELECT COUNT(*) FROM locations WHERE city = 'Leeds'"))
+	assert.Equal(t, 1, count("SELECT COUNT(*) FROM locations WHERE subdivision = 'ENG' AND city IS NULL"))
+
+	// Nothing is left to collect and the writer can carry on
+	collected, err = dbCollectGarbage(ctx, conn)
+	require.NoError(t, err)
+	for _, garbage := range collected {
+		assert.Zero(t, garbage.deleted, garbage.table)
+	}
+
+	writer.ClearCache()
+	require.NoError(t, writer.WriteBatch(ctx, conn, []Hit{hit("/old", "old.example.org", chrome, "Leeds")}))
+}
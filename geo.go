@@ -0,0 +1,102 @@
+package sheepcount
+
+import (
+	"database/sql"
+	"net"
+	"strings"
+)
+
+// What to record of the location of visitors. Countries are ISO 3166-1 codes such as DE, and regions
+// are ISO 3166-2 codes such as US-CA. EU stands for all the countries in the European Union.
+type GeoConfig struct {
+	Block       []string `toml:"block"`        // Do not record hits from these countries or regions
+	CountryOnly []string `toml:"country_only"` // Only record the country of hits from these countries or regions
+}
+
+var euCountries = []string{
+	"AT", "BE", "BG", "CY", "CZ", "DE", "DK", "EE", "ES", "FI", "FR", "GR", "HR", "HU",
+	"IE", "IT", "LT", "LU", "LV", "MT", "NL", "PL", "PT", "RO", "SE", "SI", "SK",
+}
+
+// Compiled version of GeoConfig
+type geoRules struct {
+	blocked             map[string]bool
+	blockedSubdivisions bool // Whether the whole location must be looked up to block hits
+	countryOnly         map[string]bool
+}
+
+func geoCodes(codes []string) map[string]bool {
+	set := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		code = strings.ToUpper(code)
+		if code == "EU" {
+			for _, country := range euCountries {
+				set[country] = true
+			}
+			continue
+		}
+		set[code] = true
+	}
+	return set
+}
+
+func (config *GeoConfig) compile() *geoRules {
+	rules := &geoRules{
+		blocked:     geoCodes(config.Block),
+		countryOnly: geoCodes(config.CountryOnly),
+	}
+	for code := range rules.blocked {
+		if strings.Contains(code, "-") {
+			rules.blockedSubdivisions = true
+		}
+	}
+	return rules
+}
+
+func matchesGeo(codes map[string]bool, location *Location) bool {
+	if !location.Country.Valid {
+		return false
+	}
+	if codes[location.Country.String] {
+		return true
+	}
+	return location.Subdivision.Valid && codes[location.Country.String+"-"+location.Subdivision.String]
+}
+
+// Should hits from the location not be recorded?
+func (rules *geoRules) block(location *Location) bool {
+	return rules != nil && matchesGeo(rules.blocked, location)
+}
+
+// Should hits from the address not be recorded? It is checked as requests are handled, before the
+// database writer looks up the location, so that blocked hits are not shown in real time either. A
+// location that cannot be looked up is not blocked.
+func (rules *geoRules) blockIP(geo *GeoIP, ip net.IP) bool {
+	if rules == nil || len(rules.blocked) == 0 || ip == nil {
+		return false
+	}
+
+	var location Location
+	if rules.blockedSubdivisions {
+		record, err := geo.City(ip)
+		if err != nil {
+			return false
+		}
+		var hit Hit
+		hit.lookupLocation(record)
+		location = hit.Location
+	} else {
+		record, err := geo.Country(ip)
+		if err != nil || record.Country.IsoCode == "" {
+			return false
+		}
+		location.Country = sql.NullString{String: record.Country.IsoCode, Valid: true}
+	}
+
+	return rules.block(&location)
+}
+
+// Should only the country of the location be recorded?
+func (rules *geoRules) truncate(location *Location) bool {
+	return rules != nil && matchesGeo(rules.countryOnly, location)
+}
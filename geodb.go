@@ -1,6 +1,7 @@
-package main
+package sheepcount
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,7 +10,9 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
 	"github.com/mattn/go-isatty"
@@ -17,7 +20,7 @@ import (
 	"github.com/schollz/progressbar/v3"
 )
 
-const geoLite2DownloadUrl = "https://raw.githubusercontent.com/P3TERX/GeoLite.mmdb/download/GeoLite2-City.mmdb"
+var geoLite2DownloadUrl = "https://raw.githubusercontent.com/P3TERX/GeoLite.mmdb/download/GeoLite2-City.mmdb"
 
 func newClient() *retryablehttp.Client {
 	client := retryablehttp.NewClient()
@@ -30,9 +33,19 @@ type GeoIP struct {
 	reader *geoip2.Reader
 	path   string
 	etag   string
+	dir    string // Where to store downloaded databases
+
+	// A database that something else keeps up to date, such as geoipupdate, which is used instead
+	// of downloading one. It is never deleted. It is memory mapped, so must be replaced by renaming
+	// a new file over it rather than written over, as geoipupdate does.
+	external string
 }
 
 func (geoip *GeoIP) Load() error {
+	if geoip.external != "" {
+		return geoip.Reload()
+	}
+
 	if geoip.path == "" && geoip.etag == "" {
 		// Empty - let's download for the first time
 		return geoip.Update()
@@ -81,7 +94,12 @@ func (geoip *GeoIP) Update() error {
 		return fmt.Errorf("GeoIp update: no etag")
 	}
 
-	f, err := os.CreateTemp(os.TempDir(), "*.mmdb")
+	dir := geoip.dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	f, err := os.CreateTemp(dir, "GeoLite2-City-*.mmdb")
 	if err != nil {
 		return err
 	}
@@ -149,13 +167,86 @@ func (geoip *GeoIP) Update() error {
 	return nil
 }
 
+// Reopen the external database, such as after geoipupdate has replaced it. Lookups carry on with
+// the previous database while the new one is opened, and it is kept if the new one cannot be.
+func (geoip *GeoIP) Reload() error {
+	if geoip.external == "" {
+		return errors.New("geoip_path is not set")
+	}
+
+	reader, err := geoip2.Open(geoip.external)
+	if err != nil {
+		return err
+	}
+
+	geoip.Lock()
+	previousReader := geoip.reader
+	geoip.reader = reader
+	geoip.Unlock()
+
+	if previousReader != nil {
+		return previousReader.Close()
+	}
+	return nil
+}
+
+// Reload the external database whenever SheepCount is sent the reload signal, until the context is
+// cancelled.
+func (geoip *GeoIP) ReloadOnSignal(ctx context.Context) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, geoIPReloadSignal)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-signals:
+			if err := geoip.Reload(); err != nil {
+				log.Printf("Cannot reload GeoIP database: %s", err)
+				continue
+			}
+			log.Printf("Reloaded GeoIP database %s", geoip.external)
+		}
+	}
+}
+
 func (geoip *GeoIP) City(ipAddress net.IP) (*geoip2.City, error) {
 	geoip.RLock()
 	defer geoip.RUnlock()
 
+	if geoip.reader == nil {
+		return nil, errors.New("no GeoIP database is loaded")
+	}
+
 	return geoip.reader.City(ipAddress)
 }
 
+// Only the country of the address, which is quicker to look up than its whole location.
+func (geoip *GeoIP) Country(ipAddress net.IP) (*geoip2.Country, error) {
+	geoip.RLock()
+	defer geoip.RUnlock()
+
+	if geoip.reader == nil {
+		return nil, errors.New("no GeoIP database is loaded")
+	}
+
+	return geoip.reader.Country(ipAddress)
+}
+
+// When the loaded database was built, or false if no database is loaded.
+func (geoip *GeoIP) BuildTime() (time.Time, bool) {
+	geoip.RLock()
+	defer geoip.RUnlock()
+
+	if geoip.reader == nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(geoip.reader.Metadata().BuildEpoch), 0).UTC(), true
+}
+
 func (geoip *GeoIP) MarshalJSON() ([]byte, error) {
 	geoip.RLock()
 	defer geoip.RUnlock()
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package sheepcount
+
+import (
+	"os"
+	"syscall"
+)
+
+// Sent by whatever replaces geoip_path, such as with kill -USR1 after geoipupdate
+var geoIPReloadSignal os.Signal = syscall.SIGUSR1
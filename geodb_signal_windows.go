@@ -0,0 +1,6 @@
+package sheepcount
+
+import "os"
+
+// Windows has no SIGUSR1, so geoip_path is only opened at the start
+var geoIPReloadSignal os.Signal
@@ -0,0 +1,182 @@
+package sheepcount
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Just enough of the MaxMind DB format to write a database where every IPv4 address is in the
+// country.
+type mmdbMap [][2]interface{}
+
+func encodeMMDB(buf *bytes.Buffer, value interface{}) {
+	control := func(typ int, size int) {
+		if typ <= 7 {
+			buf.WriteByte(byte(typ<<5 | size))
+		} else {
+			buf.WriteByte(byte(size))
+			buf.WriteByte(byte(typ - 7))
+		}
+	}
+	uint := func(typ int, n uint64) {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], n)
+		trimmed := bytes.TrimLeft(b[:], "\x00")
+		control(typ, len(trimmed))
+		buf.Write(trimmed)
+	}
+
+	switch v := value.(type) {
+	case string:
+		control(2, len(v))
+		buf.WriteString(v)
+	case uint16:
+		uint(5, uint64(v))
+	case uint32:
+		uint(6, uint64(v))
+	case uint64:
+		uint(9, v)
+	case []interface{}:
+		control(11, len(v))
+		for _, item := range v {
+			encodeMMDB(buf, item)
+		}
+	case mmdbMap:
+		control(7, len(v))
+		for _, pair := range v {
+			encodeMMDB(buf, pair[0])
+			encodeMMDB(buf, pair[1])
+		}
+	default:
+		panic("cannot encode")
+	}
+}
+
+func writeTestGeoIP(t *testing.T, path string, country string, built time.Time) {
+	var buf bytes.Buffer
+
+	// One node, whose records both point to the start of the data section, after the 16 byte
+	// separator
+	buf.Write([]byte{0, 0, 17, 0, 0, 17})
+	buf.Write(make([]byte, 16))
+	encodeMMDB(&buf, mmdbMap{{"country", mmdbMap{{"iso_code", country}}}})
+
+	buf.WriteString("\xab\xcd\xefMaxMind.com")
+	encodeMMDB(&buf, mmdbMap{
+		{"binary_format_major_version", uint16(2)},
+		{"binary_format_minor_version", uint16(0)},
+		{"build_epoch", uint64(built.Unix())},
+		{"database_type", "GeoLite2-City"},
+		{"description", mmdbMap{{"en", "Test"}}},
+		{"ip_version", uint16(4)},
+		{"languages", []interface{}{"en"}},
+		{"node_count", uint32(1)},
+		{"record_size", uint16(24)},
+	})
+
+	replaceFile(t, path, buf.Bytes())
+}
+
+// Replace the file all at once, as geoipupdate does, since the open database is memory mapped.
+func replaceFile(t *testing.T, path string, data []byte) {
+	tmp := path + ".tmp"
+	require.NoError(t, os.WriteFile(tmp, data, 0600))
+	require.NoError(t, os.Rename(tmp, path))
+}
+
+func TestGeoIPReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "GeoLite2-City.mmdb")
+	writeTestGeoIP(t, path, "GB", time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC))
+
+	geo := &GeoIP{external: path}
+	require.NoError(t, geo.Load())
+	defer geo.Close()
+
+	country := func() string {
+		record, err := geo.City(net.ParseIP("192.0.2.1"))
+		require.NoError(t, err)
+		return record.Country.IsoCode
+	}
+	assert.Equal(t, "GB", country())
+
+	writeTestGeoIP(t, path, "FR", time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, "GB", country())
+	require.NoError(t, geo.Reload())
+	assert.Equal(t, "FR", country())
+	built, ok := geo.BuildTime()
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC), built)
+
+	// A database that cannot be opened leaves the previous one
+	replaceFile(t, path, []byte("not a database"))
+	assert.Error(t, geo.Reload())
+	assert.Equal(t, "FR", country())
+
+	// Only an external database can be reloaded
+	assert.Error(t, (&GeoIP{}).Reload())
+}
+
+func TestGeoIPUpdate(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.mmdb")
+
+	etag := `"v1"`
+	writeTestGeoIP(t, source, "GB", time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		http.ServeFile(w, r, source)
+	}))
+	defer server.Close()
+
+	defer func(url string) { geoLite2DownloadUrl = url }(geoLite2DownloadUrl)
+	geoLite2DownloadUrl = server.URL
+
+	state := &State{GeoIP: GeoIP{dir: dir}}
+	require.NoError(t, state.Salts.Load(DefaultConfig().SaltRotationDuration))
+	require.NoError(t, state.GeoIP.Update())
+	defer state.GeoIP.Close()
+	first := state.GeoIP.path
+
+	// An unchanged database is not downloaded again
+	require.NoError(t, state.GeoIP.Update())
+	assert.Equal(t, first, state.GeoIP.path)
+
+	etag = `"v2"`
+	writeTestGeoIP(t, source, "FR", time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, state.GeoIP.Update())
+	assert.NotEqual(t, first, state.GeoIP.path)
+	_, err := os.Stat(first)
+	assert.True(t, os.IsNotExist(err), "the previous database is removed")
+
+	// The state points at the new database, so that it is opened after a restart
+	statePath := filepath.Join(dir, "sheepcount.state")
+	require.NoError(t, state.Save(statePath))
+	contents, err := os.ReadFile(statePath)
+	require.NoError(t, err)
+
+	var saved State
+	require.NoError(t, json.Unmarshal(contents, &saved))
+	assert.Equal(t, state.GeoIP.path, saved.GeoIP.path)
+	assert.Equal(t, `"v2"`, saved.GeoIP.etag)
+
+	require.NoError(t, saved.GeoIP.Load())
+	defer saved.GeoIP.Close()
+	record, err := saved.GeoIP.City(net.ParseIP("192.0.2.1"))
+	require.NoError(t, err)
+	assert.Equal(t, "FR", record.Country.IsoCode)
+}
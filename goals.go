@@ -0,0 +1,68 @@
+package sheepcount
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A goal is completed by a page load of a path, such as /thanks, or by a custom event, such as
+// signup, on any site unless sites are given.
+type GoalConfig struct {
+	Name  string   `toml:"name"`
+	Path  string   `toml:"path"`
+	Event string   `toml:"event"`
+	Sites []string `toml:"sites"`
+}
+
+func validateGoals(goals []GoalConfig) error {
+	names := make(map[string]bool, len(goals))
+	for _, goal := range goals {
+		if goal.Name == "" {
+			return errors.New("goals must have a name")
+		}
+		if names[goal.Name] {
+			return fmt.Errorf("goal %s is defined twice", goal.Name)
+		}
+		names[goal.Name] = true
+
+		if (goal.Path == "") == (goal.Event == "") {
+			return fmt.Errorf("goal %s must have either a path or an event", goal.Name)
+		}
+		if goal.Event != "" && len(goal.Event) > maxEventNameLength {
+			return fmt.Errorf("goal %s has an event name longer than %d bytes", goal.Name, maxEventNameLength)
+		}
+	}
+
+	return nil
+}
+
+// The names of the goals that the hit completes.
+func (config *Config) completedGoals(hit *Hit) []string {
+	var completed []string
+
+	for _, goal := range config.Goals {
+		if len(goal.Sites) > 0 && !contains(goal.Sites, hit.Domain) {
+			continue
+		}
+
+		switch {
+		case goal.Path != "" && hit.Event == PageLoad && hit.Path == goal.Path:
+		case goal.Event != "" && hit.Event == CustomEvent && hit.EventName.String == goal.Event:
+		default:
+			continue
+		}
+
+		completed = append(completed, goal.Name)
+	}
+
+	return completed
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
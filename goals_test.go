@@ -0,0 +1,136 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompletedGoals(t *testing.T) {
+	config := DefaultConfig()
+	config.Goals = []GoalConfig{
+		{Name: "thanks", Path: "/thanks"},
+		{Name: "signup", Event: "signup"},
+		{Name: "blog signup", Event: "signup", Sites: []string{"blog.example.com"}},
+	}
+	assert.NoError(t, validateGoals(config.Goals))
+
+	assert.Equal(t, []string{"thanks"}, config.completedGoals(&Hit{Event: PageLoad, Domain: "example.com", Path: "/thanks"}))
+	assert.Empty(t, config.completedGoals(&Hit{Event: PageHide, Domain: "example.com", Path: "/thanks"}))
+	assert.Empty(t, config.completedGoals(&Hit{Event: PageLoad, Domain: "example.com", Path: "/"}))
+
+	signup := &Hit{Event: CustomEvent, EventName: sql.NullString{String: "signup", Valid: true}, Domain: "example.com", Path: "/"}
+	assert.Equal(t, []string{"signup"}, config.completedGoals(signup))
+	signup.Domain = "blog.example.com"
+	assert.Equal(t, []string{"signup", "blog signup"}, config.completedGoals(signup))
+
+	assert.Error(t, validateGoals([]GoalConfig{{Name: "thanks", Path: "/thanks", Event: "thanks"}}))
+	assert.Error(t, validateGoals([]GoalConfig{{Name: "thanks"}}))
+	assert.Error(t, validateGoals([]GoalConfig{{Path: "/thanks"}}))
+	assert.Error(t, validateGoals([]GoalConfig{{Name: "thanks", Path: "/thanks"}, {Name: "thanks", Path: "/thank-you"}}))
+}
+
+func TestGoalQueries(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	config := DefaultConfig()
+	config.Goals = []GoalConfig{{Name: "thanks", Path: "/thanks"}, {Name: "signup", Event: "signup"}}
+
+	hit := func(timestamp int64, identifier string, event EventType, path string, referrer string) *Hit {
+		hit := &Hit{
+			Timestamp:         timestamp,
+			IdentifierCurrent: []byte(identifier),
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             event,
+			Domain:            "example.com",
+			Path:              path,
+		}
+		if referrer != "" {
+			hit.ReferrerDomain = sql.NullString{String: referrer, Valid: true}
+		}
+		if event == CustomEvent {
+			hit.EventName = sql.NullString{String: "signup", Valid: true}
+		}
+		hit.Goals = config.completedGoals(hit)
+		return hit
+	}
+
+	hits := []*Hit{
+		hit(1654041600, "a", PageLoad, "/", "google.com"),
+		hit(1654041660, "a", PageLoad, "/thanks", ""),
+		hit(1654041720, "b", PageLoad, "/", "google.com"),
+		hit(1654041780, "c", PageLoad, "/", ""),
+		hit(1654041840, "c", CustomEvent, "/", ""),
+	}
+	for _, hit := range hits {
+		if err := writer.InsertHit(ctx, tx, hit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	queries, err := NewQueries(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(name string) string {
+		query, err := queries.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var output string
+		row := query.QueryRowContext(ctx, sql.Named("site", "example.com"), sql.Named("start_date", "2022-06-01"), sql.Named("end_date", "2022-06-01"), sql.Named("include_bots", false))
+		if err := row.Scan(&output); err != nil {
+			t.Fatal(err)
+		}
+		return output
+	}
+
+	assert.JSONEq(
+		t,
+		`[
+			{"goal": "signup", "completions": 1, "visitors": 1, "conversion_rate": 33.3},
+			{"goal": "thanks", "completions": 1, "visitors": 1, "conversion_rate": 33.3}
+		]`,
+		run("goals"),
+	)
+
+	// Visitor a arrived from Google and converted, b arrived from Google and did not, and c arrived
+	// directly and signed up
+	assert.JSONEq(
+		t,
+		`[
+			{"goal": "signup", "domain": null, "visitors": 1, "conversions": 1, "conversion_rate": 100.0},
+			{"goal": "signup", "domain": "google.com", "visitors": 2, "conversions": 0, "conversion_rate": 0.0},
+			{"goal": "thanks", "domain": "google.com", "visitors": 2, "conversions": 1, "conversion_rate": 50.0},
+			{"goal": "thanks", "domain": null, "visitors": 1, "conversions": 0, "conversion_rate": 0.0}
+		]`,
+		run("goal_referrers"),
+	)
+}
@@ -0,0 +1,108 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type healthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthStatus struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+func checkDatabase(ctx context.Context, db *sql.DB) healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	var one int
+	if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		return healthCheck{OK: false, Detail: err.Error()}
+	}
+
+	return healthCheck{OK: true}
+}
+
+func checkClickhouse(ctx context.Context, client *clickhouseClient) healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	if err := client.ping(ctx); err != nil {
+		return healthCheck{OK: false, Detail: err.Error()}
+	}
+
+	return healthCheck{OK: true}
+}
+
+func checkGeoIP(sheepcount *SheepCount) healthCheck {
+	buildTime, ok := sheepcount.state.GeoIP.BuildTime()
+	if !ok {
+		return healthCheck{OK: false, Detail: "no database loaded"}
+	}
+
+	return healthCheck{OK: true, Detail: "built " + buildTime.Format("2006-01-02")}
+}
+
+// The hit channel fills up if the database writer cannot keep up, at which point handlers block.
+func checkHits(hits chan Hit) healthCheck {
+	queued, capacity := len(hits), cap(hits)
+	if queued >= capacity*9/10 {
+		return healthCheck{OK: false, Detail: "hit queue is saturated"}
+	}
+
+	return healthCheck{OK: true}
+}
+
+func writeHealth(w http.ResponseWriter, checks map[string]healthCheck) {
+	status := healthStatus{Status: "ok", Checks: checks}
+	statusCode := http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			status.Status = "unavailable"
+			statusCode = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(status)
+}
+
+// Liveness: is the process able to talk to its database?
+func handleHealthz(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeHealth(w, map[string]healthCheck{
+		"database": checkDatabase(r.Context(), sheepcount.db),
+	})
+}
+
+// Readiness: can we accept and record hits right now?
+func handleReadyz(sheepcount *SheepCount, hits chan Hit, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	checks := map[string]healthCheck{
+		"database": checkDatabase(r.Context(), sheepcount.db),
+		"geoip":    checkGeoIP(sheepcount),
+		"hits":     checkHits(hits),
+	}
+	if sheepcount.clickhouse != nil {
+		checks["clickhouse"] = checkClickhouse(r.Context(), sheepcount.clickhouse)
+	}
+
+	writeHealth(w, checks)
+}
@@ -0,0 +1,92 @@
+package sheepcount
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	tmpl, err := NewTemplates()
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "GeoLite2-City.mmdb")
+	writeTestGeoIP(t, path, "GB", time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC))
+
+	config := DefaultConfig()
+	config.Domains = []string{"example.com"}
+	config.Hostname = "stats.example.com"
+	config.AdminListener.Address = "10.8.0.1:4445"
+	sheepcount := &SheepCount{
+		db:          db,
+		tmpl:        tmpl,
+		state:       &State{GeoIP: GeoIP{external: path}},
+		realtime:    NewRealtime(),
+		broadcaster: NewBroadcaster(),
+		hits:        make(chan Hit, 10),
+		Config:      config,
+	}
+	require.NoError(t, sheepcount.state.GeoIP.Load())
+	defer sheepcount.state.GeoIP.Close()
+
+	// The status code and checks of a health route on a listener
+	check := func(handler http.Handler, path string) (int, healthStatus) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://10.8.0.1:4445"+path, nil))
+
+		var status healthStatus
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+		return w.Code, status
+	}
+
+	handlers := map[string]http.Handler{"public": sheepcount.PublicHandler(), "admin": sheepcount.AdminHandler()}
+	for name, handler := range handlers {
+		for _, path := range []string{"/healthz", "/readyz"} {
+			code, status := check(handler, path)
+			assert.Equal(t, http.StatusOK, code, name+path)
+			assert.Equal(t, "ok", status.Status, name+path)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://10.8.0.1:4445/healthz", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code, name)
+	}
+
+	// A saturated hit queue stops new hits being accepted, but the process is still alive
+	for i := 0; i < cap(sheepcount.hits); i++ {
+		sheepcount.hits <- Hit{}
+	}
+	for name, handler := range handlers {
+		code, status := check(handler, "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, code, name)
+		assert.Equal(t, "unavailable", status.Status, name)
+		assert.False(t, status.Checks["hits"].OK, name)
+
+		code, _ = check(handler, "/healthz")
+		assert.Equal(t, http.StatusOK, code, name)
+	}
+	for len(sheepcount.hits) > 0 {
+		<-sheepcount.hits
+	}
+
+	// Neither is healthy without the database
+	require.NoError(t, db.Close())
+	for name, handler := range handlers {
+		for _, path := range []string{"/healthz", "/readyz"} {
+			code, status := check(handler, path)
+			assert.Equal(t, http.StatusServiceUnavailable, code, name+path)
+			assert.False(t, status.Checks["database"].OK, name+path)
+		}
+	}
+}
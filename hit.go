@@ -1,16 +1,22 @@
-package main
+package sheepcount
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"expvar"
 	"fmt"
+	"io"
+	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
-	"golang.org/x/text/language"
+	"github.com/oschwald/geoip2-golang"
 	"zgo.at/isbot"
 )
 
@@ -20,8 +26,18 @@ const (
 	PageLoad EventType = "l"
 	PageView EventType = "v"
 	PageHide EventType = "h"
+
+	// Clicks on links, which are only tracked if enabled
+	OutboundClick EventType = "o" // A link to another site
+	Download      EventType = "d" // A link to a file on this site
+
+	// Sent by the site itself, such as when a visitor signs up
+	CustomEvent EventType = "c"
 )
 
+// The longest name of a custom event
+const maxEventNameLength = 100
+
 func (e *EventType) UnmarshalJSON(src []byte) error {
 	var event string
 	if err := json.Unmarshal(src, &event); err != nil {
@@ -38,6 +54,12 @@ func (e *EventType) UnmarshalJSON(src []byte) error {
 		*e = PageView
 	case string(PageHide):
 		*e = PageHide
+	case string(OutboundClick):
+		*e = OutboundClick
+	case string(Download):
+		*e = Download
+	case string(CustomEvent):
+		*e = CustomEvent
 	default:
 		return fmt.Errorf("unknown event: %v", event)
 	}
@@ -53,6 +75,22 @@ type Event struct {
 	ScreenHeight int32     `json:"h"`
 	ScreenWidth  int32     `json:"w"`
 	PixelRatio   float64   `json:"p"`
+	Target       string    `json:"t"` // The link that was clicked
+	Name         string    `json:"c"` // The name of a custom event
+	Token        string    `json:"k"` // The token of the site, if tokens are required
+	Age          int64     `json:"a"` // How many milliseconds ago the event happened, if it was queued
+	Canonical    string    `json:"l"` // The canonical URL of the page, if the site asks for it
+	Title        string    `json:"i"` // The title of the page, with page loads if titles are tracked
+
+	// Sent with page hides when engagement tracking is enabled
+	ScrollDepth    *int `json:"s,omitempty"` // The furthest scrolled down the page, as a percentage
+	EngagedSeconds *int `json:"g,omitempty"` // How long the page was visible
+
+	// Sent with the first page hide of a page load when performance tracking is enabled, in
+	// milliseconds since navigation started
+	TimeToFirstByte  *int `json:"f,omitempty"`
+	DOMContentLoaded *int `json:"m,omitempty"`
+	LoadTime         *int `json:"n,omitempty"`
 }
 
 // Unnormalised data
@@ -60,12 +98,18 @@ type Hit struct {
 	Timestamp          int64
 	IdentifierCurrent  []byte
 	IdentifierPrevious []byte
+	Visitor            uint64 // With anonymous visitors, a hash of the visitor instead of identifiers
 	UserAgent          string
 	Bot                sql.NullInt16
 
 	Event EventType
 
-	Language string
+	Language          string
+	SecondaryLanguage string // The next language that the visitor prefers, if any
+
+	// The address of the visitor, kept only until the database writer has looked up the location.
+	// It is never written to the database or the spool.
+	IP net.IP `json:"-"`
 
 	Location
 
@@ -74,9 +118,27 @@ type Hit struct {
 	ReferrerDomain sql.NullString
 	ReferrerPath   sql.NullString
 
+	Campaign Campaign
+
+	Target sql.NullString // The URL of the link that was clicked
+
+	Keyword sql.NullString // The search terms, if the referrer is a search engine that gives them
+
+	EventName sql.NullString // The name of a custom event
+	Title     sql.NullString // The title of the page that was loaded
+	Goals     []string       // The names of the goals that the hit completed
+
+	ScrollDepth    sql.NullInt16
+	EngagedSeconds sql.NullInt32
+
+	TimeToFirstByte  sql.NullInt32
+	DOMContentLoaded sql.NullInt32
+	LoadTime         sql.NullInt32
+
 	ScreenHeight sql.NullInt32
 	ScreenWidth  sql.NullInt32
 	PixelRatio   sql.NullFloat64
+	Device       sql.NullString // mobile, tablet or desktop
 }
 
 type Location struct {
@@ -86,66 +148,333 @@ type Location struct {
 	Postal      sql.NullString
 }
 
-func NewHit(sheepcount *SheepCount, r *http.Request) (Hit, Error) {
+// The UTM parameters of the page URL
+type Campaign struct {
+	Source  sql.NullString // utm_source
+	Medium  sql.NullString // utm_medium
+	Name    sql.NullString // utm_campaign
+	Term    sql.NullString // utm_term
+	Content sql.NullString // utm_content
+}
+
+func (campaign *Campaign) Valid() bool {
+	return campaign.Source.Valid || campaign.Medium.Valid || campaign.Name.Valid || campaign.Term.Valid || campaign.Content.Valid
+}
+
+// Create the hits of a request to the event endpoint, which has either one event or an array of
+// events that the script queued. If any event is invalid, none of them are counted.
+func NewHits(sheepcount *SheepCount, r *http.Request) ([]Hit, Error) {
+	now := time.Now()
+
+	events, err := decodeEvents(r.Body)
+	if err != nil {
+		// Go 1.17 has no http.MaxBytesError to check for
+		if err.Error() == "http: request body too large" {
+			rejectedEvents.Add("too_large", 1)
+			return nil, &ErrTooLarge{limit: sheepcount.MaxEventSize}
+		}
+		rejectedEvents.Add("malformed", 1)
+		return nil, BadInput(err)
+	}
+
+	// Everything but the events themselves is the same for each hit
+	var base Hit
+
+	identCurrent, identPrevious, herr := sheepcount.fingerprintRequest(r)
+	if herr != nil {
+		return nil, herr
+	}
+	base.setIdentifiers(sheepcount.AnonymousVisitors, identCurrent, identPrevious)
+
+	if err := base.fromRequest(sheepcount, r); err != nil {
+		return nil, err
+	}
+
+	allowLocalhost := sheepcount.listenerOptions(r).allowLocalhost
+	hits := make([]Hit, 0, len(events))
+	for i := range events {
+		event := &events[i]
+
+		if event.Age < 0 || event.Age > maxEventAge.Milliseconds() {
+			rejectedEvents.Add("invalid", 1)
+			return nil, BadInput(fmt.Errorf("invalid event age: %d", event.Age))
+		}
+
+		hit := base
+		hit.Timestamp = now.Add(-time.Duration(event.Age) * time.Millisecond).Unix()
+
+		if event.Event == PageLoad && event.Referrer == "" {
+			event.Referrer = headerReferrer(event.Url, r.Header.Get("Referer"))
+		}
+
+		if err := hit.fromEvent(sheepcount, allowLocalhost, event); err != nil {
+			if _, ok := err.(*ErrIgnored); ok {
+				continue
+			}
+			if _, ok := err.(*ErrBadInput); ok {
+				rejectedEvents.Add("invalid", 1)
+			}
+			return nil, err
+		}
+		hit.Goals = sheepcount.completedGoals(&hit)
+
+		hits = append(hits, hit)
+	}
+
+	if len(hits) == 0 && len(events) > 0 {
+		return nil, &ErrIgnored{reason: "all events"}
+	}
+
+	return hits, nil
+}
+
+// The most events that can be sent at once
+const maxBatchEvents = 50
+
+// The number of requests to the event endpoint rejected because the body was too large, was not
+// valid JSON or had unknown fields, or had an invalid event
+var rejectedEvents = expvar.NewMap("rejected_events")
+
+// How long the script can queue an event for before sending it
+const maxEventAge = time.Hour
+
+func decodeEvents(r io.Reader) ([]Event, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	// Reject unknown fields, as the script never sends them
+	unmarshal := func(v interface{}) error {
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(v)
+	}
+
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) == 0 || trimmed[0] != '[' {
+		var event Event
+		if err := unmarshal(&event); err != nil {
+			return nil, err
+		}
+		return []Event{event}, nil
+	}
+
+	var events []Event
+	if err := unmarshal(&events); err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("no events")
+	}
+	if len(events) > maxBatchEvents {
+		return nil, fmt.Errorf("too many events: %d", len(events))
+	}
+
+	return events, nil
+}
+
+// Create a hit from a request for the tracking pixel. As there is no Javascript, all that we know
+// comes from the request headers: the page URL is either given in the url query parameter or taken
+// from the Referer header, and there is no screen information.
+func NewPixelHit(sheepcount *SheepCount, r *http.Request) (Hit, Error) {
 	var hit Hit
 	hit.Timestamp = time.Now().Unix()
 
-	var event Event
-	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
-		return hit, BadInput(err)
+	query := r.URL.Query()
+
+	pageUrl := query.Get("url")
+	if pageUrl == "" {
+		pageUrl = r.Header.Get("Referer")
+	}
+	if pageUrl == "" {
+		return hit, BadInput(fmt.Errorf("no page url"))
 	}
 
 	identCurrent, identPrevious, err := sheepcount.fingerprintRequest(r)
 	if err != nil {
 		return hit, err
 	}
-	hit.IdentifierCurrent = identCurrent
-	hit.IdentifierPrevious = identPrevious
+	hit.setIdentifiers(sheepcount.AnonymousVisitors, identCurrent, identPrevious)
 
 	if err := hit.fromRequest(sheepcount, r); err != nil {
 		return hit, err
 	}
 
-	if err := hit.fromEvent(sheepcount, &event); err != nil {
+	hit.Event = PageLoad
+	hit.Device = deviceClass(hit.UserAgent, sql.NullInt32{})
+
+	if err := hit.setPageAndReferrer(sheepcount, sheepcount.listenerOptions(r).allowLocalhost, pageUrl, "", query.Get("ref")); err != nil {
+		return hit, err
+	}
+
+	if err := sheepcount.checkEventToken(hit.Domain, query.Get("k")); err != nil {
 		return hit, err
 	}
 
+	hit.Goals = sheepcount.completedGoals(&hit)
+
 	return hit, nil
 }
 
 func (hit *Hit) fromRequest(sheepcount *SheepCount, r *http.Request) Error {
-	hit.UserAgent = r.Header.Get("User-Agent")
-
-	// Language
-	tags, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
-	if len(tags) > 0 {
-		base, c := tags[0].Base()
-		if c == language.Exact || c == language.High {
-			hit.Language = base.ISO3()
+	ip := sheepcount.visitorIP(r)
+	if sheepcount.ignore.ignoreIP(ip) {
+		if sheepcount.ForgetIPs {
+			return &ErrIgnored{reason: "ip address"}
 		}
+		return &ErrIgnored{reason: fmt.Sprintf("ip address %s", ip)}
 	}
 
+	hit.UserAgent = r.Header.Get("User-Agent")
+
+	hit.Language, hit.SecondaryLanguage = acceptLanguages(r.Header.Get("Accept-Language"))
+
 	// Is this considered a bot because of the IP range?
-	if bot := isbot.IPRange(r.RemoteAddr); isbot.Is(bot) {
+	if bot := botIPRange(ip); isbot.Is(bot) {
 		hit.Bot = sql.NullInt16{Int16: int16(bot), Valid: true}
 	}
 
-	if err := hit.setLocation(&sheepcount.state.GeoIP, net.ParseIP(r.RemoteAddr)); err != nil {
-		return err
+	// The location is looked up later by the database writer, so that requests do not wait for it,
+	// unless the address must not be kept
+	hit.IP = ip
+	if sheepcount.ForgetIPs {
+		located := true
+		if sheepcount.state != nil {
+			located = hit.resolveLocation(&sheepcount.state.GeoIP, sheepcount.geo)
+		}
+		hit.IP = nil
+		wipe(ip)
+		if !located {
+			return &ErrIgnored{reason: "location"}
+		}
+	} else if sheepcount.state != nil && sheepcount.geo.blockIP(&sheepcount.state.GeoIP, ip) {
+		return &ErrIgnored{reason: "location"}
 	}
 
 	return nil
 }
 
-func (hit *Hit) fromEvent(sheepcount *SheepCount, event *Event) Error {
+// The referrer of a page load from the Referer header of the request, for when document.referrer is
+// empty, as browsers strip it under different referrer policies. The header of a request that the
+// page makes is usually the page itself, or just its origin, so it is only taken when it is of
+// another domain, and otherwise the page load has no referrer as before.
+func headerReferrer(pageUrl string, header string) string {
+	hu, err := url.Parse(header)
+	if header == "" || err != nil || (hu.Scheme != "https" && hu.Scheme != "http") || hu.Hostname() == "" {
+		return ""
+	}
+
+	pu, err := url.Parse(pageUrl)
+	if err != nil || strings.EqualFold(hu.Hostname(), pu.Hostname()) {
+		return ""
+	}
+
+	return header
+}
+
+// The bot that owns the IP range of the address, if any.
+func botIPRange(ip net.IP) isbot.Result {
+	if ip == nil {
+		return 0
+	}
+	return isbot.IPRange(ip.String())
+}
+
+func (hit *Hit) fromEvent(sheepcount *SheepCount, allowLocalhost bool, event *Event) Error {
 	// Event
 	hit.Event = event.Event
 
 	// Page and referrer URL
-	if err := hit.setPageAndReferrer(sheepcount, event.Url, event.Referrer); err != nil {
+	if err := hit.setPageAndReferrer(sheepcount, allowLocalhost, event.Url, event.Canonical, event.Referrer); err != nil {
 		return err
 	}
 
+	if err := sheepcount.checkEventToken(hit.Domain, event.Token); err != nil {
+		return err
+	}
+
+	// Link target
+	if event.Event == OutboundClick || event.Event == Download {
+		if !sheepcount.TrackClicks {
+			return BadInput(fmt.Errorf("click tracking is disabled"))
+		}
+
+		tu, err := url.Parse(event.Target)
+		if err != nil {
+			return BadInput(err)
+		}
+		if !(tu.Scheme == "http" || tu.Scheme == "https") || tu.Host == "" {
+			return BadInput(fmt.Errorf("invalid target: %s", event.Target))
+		}
+		tu.Fragment = ""
+
+		hit.Target = sql.NullString{String: tu.String(), Valid: true}
+	} else if event.Target != "" {
+		return BadInput(fmt.Errorf("target given for %s event", event.Event))
+	}
+
+	// Custom event name
+	if event.Event == CustomEvent {
+		if event.Name == "" || len(event.Name) > maxEventNameLength {
+			return BadInput(fmt.Errorf("invalid event name: %q", event.Name))
+		}
+		hit.EventName = sql.NullString{String: event.Name, Valid: true}
+	} else if event.Name != "" {
+		return BadInput(fmt.Errorf("name given for %s event", event.Event))
+	}
+
+	// Page title. Ignore it if tracking has been disabled since the script was cached.
+	if event.Title != "" {
+		if event.Event != PageLoad {
+			return BadInput(fmt.Errorf("title given for %s event", event.Event))
+		}
+		if title := cleanTitle(event.Title); sheepcount.TrackTitles && title != "" {
+			hit.Title = sql.NullString{String: title, Valid: true}
+		}
+	}
+
+	// Engagement. Ignore it if tracking has been disabled since the script was cached.
+	if event.ScrollDepth != nil || event.EngagedSeconds != nil {
+		if event.Event != PageHide {
+			return BadInput(fmt.Errorf("engagement given for %s event", event.Event))
+		}
+		if event.ScrollDepth == nil || event.EngagedSeconds == nil {
+			return BadInput(fmt.Errorf("incomplete engagement"))
+		}
+		if depth := *event.ScrollDepth; depth < 0 || depth > 100 {
+			return BadInput(fmt.Errorf("invalid scroll depth: %d", depth))
+		}
+		if seconds := *event.EngagedSeconds; seconds < 0 || seconds > math.MaxInt32 {
+			return BadInput(fmt.Errorf("invalid engaged seconds: %d", seconds))
+		}
+
+		if sheepcount.TrackEngagement {
+			hit.ScrollDepth = sql.NullInt16{Int16: int16(*event.ScrollDepth), Valid: true}
+			hit.EngagedSeconds = sql.NullInt32{Int32: int32(*event.EngagedSeconds), Valid: true}
+		}
+	}
+
+	// Performance. Likewise ignore it if tracking has been disabled.
+	if event.TimeToFirstByte != nil || event.DOMContentLoaded != nil || event.LoadTime != nil {
+		if event.Event != PageHide {
+			return BadInput(fmt.Errorf("performance given for %s event", event.Event))
+		}
+		if event.TimeToFirstByte == nil || event.DOMContentLoaded == nil || event.LoadTime == nil {
+			return BadInput(fmt.Errorf("incomplete performance"))
+		}
+		for _, ms := range []int{*event.TimeToFirstByte, *event.DOMContentLoaded, *event.LoadTime} {
+			if ms < 0 || ms > math.MaxInt32 {
+				return BadInput(fmt.Errorf("invalid timing: %d", ms))
+			}
+		}
+
+		if sheepcount.TrackPerformance {
+			hit.TimeToFirstByte = sql.NullInt32{Int32: int32(*event.TimeToFirstByte), Valid: true}
+			hit.DOMContentLoaded = sql.NullInt32{Int32: int32(*event.DOMContentLoaded), Valid: true}
+			hit.LoadTime = sql.NullInt32{Int32: int32(*event.LoadTime), Valid: true}
+		}
+	}
+
 	// JS bot
 	if bot := event.JsBot; bot >= 150 {
 		if !hit.Bot.Valid || (hit.Bot.Valid && isbot.IsNot(isbot.Result(bot))) {
@@ -172,20 +501,58 @@ func (hit *Hit) fromEvent(sheepcount *SheepCount, event *Event) Error {
 		return BadInput(fmt.Errorf("invalid pixel ratio: %f", event.PixelRatio))
 	}
 
+	hit.Device = deviceClass(hit.UserAgent, hit.ScreenWidth)
+
 	return nil
 }
 
-func (hit *Hit) setLocation(geo *GeoIP, ip net.IP) Error {
+// Look up the location of the hit from its IP address and then forget the address. Returns false
+// if hits from the location are not recorded. A hit whose location cannot be looked up is recorded
+// without one.
+func (hit *Hit) resolveLocation(geo *GeoIP, rules *geoRules) bool {
+	ip := hit.IP
+	hit.IP = nil
+	if ip == nil {
+		return true
+	}
+
+	start := time.Now()
 	record, err := geo.City(ip)
+	geoIPDuration.Record(context.Background(), milliseconds(time.Since(start)))
 	if err != nil {
-		return NewInternalError(fmt.Errorf("geoip2 error: %w", err))
+		log.Printf("Cannot look up location: %s", err)
+		return true
 	}
 
+	hit.lookupLocation(record)
+
+	if rules.block(&hit.Location) {
+		return false
+	}
+	if rules.truncate(&hit.Location) {
+		hit.Location = Location{Country: hit.Country}
+	}
+
+	return true
+}
+
+// Look up the locations of a batch of hits, dropping those from blocked locations.
+func resolveLocations(hits []Hit, geo *GeoIP, rules *geoRules) []Hit {
+	resolved := hits[:0]
+	for i := range hits {
+		if hits[i].resolveLocation(geo, rules) {
+			resolved = append(resolved, hits[i])
+		}
+	}
+	return resolved
+}
+
+func (hit *Hit) lookupLocation(record *geoip2.City) {
 	if country := record.Country.IsoCode; country != "" {
 		hit.Country = sql.NullString{String: country, Valid: true}
 	} else {
 		// Can't have subdivisions, city and postal without country
-		return nil
+		return
 	}
 
 	// Maxmind can provide multiple levels of country subdivision, for example for the UK where it
@@ -201,44 +568,54 @@ func (hit *Hit) setLocation(geo *GeoIP, ip net.IP) Error {
 		hit.City = sql.NullString{String: city, Valid: true}
 	} else {
 		// Can't have postal without city
-		return nil
+		return
 	}
 
 	if postal := record.Postal.Code; postal != "" {
 		hit.Postal = sql.NullString{String: postal, Valid: true}
 	}
+}
 
-	return nil
+// Can hits be recorded for the domain, on a listener that allows hits from localhost or not?
+func (sheepcount *SheepCount) allowedDomain(domain string, allowLocalhost bool) bool {
+	if allowLocalhost {
+		return domain == "localhost" || domain == "127.0.0.1"
+	}
+	return contains(sheepcount.Domains, domain)
 }
 
-func (hit *Hit) setPageAndReferrer(sheepcount *SheepCount, pageUrl string, referrerUrl string) Error {
+// The page is counted at its canonical URL if there is one and it is on an allowed domain, which
+// may be a different one. The campaign is always that of the URL that was visited, as canonical
+// URLs leave out the UTM parameters.
+func (hit *Hit) setPageAndReferrer(sheepcount *SheepCount, allowLocalhost bool, pageUrl string, canonicalUrl string, referrerUrl string) Error {
 	pu, err := url.Parse(pageUrl)
 	if err != nil {
 		return BadInput(err)
 	}
 
 	domain := strings.ToLower(pu.Hostname())
-
-	if sheepcount.AllowLocalhost {
-		if domain == "localhost" || domain == "127.0.0.1" {
-			hit.Domain = domain
-		}
-	} else {
-		for _, allowedDomain := range sheepcount.Domains {
-			if domain == allowedDomain {
-				hit.Domain = domain
-				break
-			}
-		}
-	}
-	if hit.Domain == "" {
+	if !sheepcount.allowedDomain(domain, allowLocalhost) {
 		return BadInput(fmt.Errorf("invalid domain: %s", domain))
 	}
 
 	if pu.Path == "" {
 		return BadInput(fmt.Errorf("invalid path"))
 	}
-	hit.Path = pu.Path
+	hit.Campaign = campaignFromQuery(pu.Query())
+
+	// A canonical URL that cannot be counted is ignored rather than the hit, as it comes from the
+	// HTML of the page rather than the visit
+	if cu, err := url.Parse(canonicalUrl); canonicalUrl != "" && err == nil && (cu.Scheme == "https" || cu.Scheme == "http") && cu.Path != "" {
+		if canonicalDomain := strings.ToLower(cu.Hostname()); sheepcount.allowedDomain(canonicalDomain, allowLocalhost) {
+			domain, pu = canonicalDomain, cu
+		}
+	}
+	hit.Domain = domain
+	hit.Path = sheepcount.Paths.Normalize(pu)
+
+	if sheepcount.ignore.ignorePath(hit.Domain, hit.Path) {
+		return &ErrIgnored{reason: fmt.Sprintf("path %s", hit.Path)}
+	}
 
 	if referrerUrl == "" {
 		return nil
@@ -255,16 +632,33 @@ func (hit *Hit) setPageAndReferrer(sheepcount *SheepCount, pageUrl string, refer
 		hit.ReferrerDomain = sql.NullString{String: referrerDomain, Valid: true}
 	}
 
+	if hit.ReferrerDomain.String != hit.Domain && sheepcount.referrerSpam.Contains(hit.ReferrerDomain.String) {
+		if sheepcount.ReferrerSpam.Action != "mark" {
+			return &ErrIgnored{reason: fmt.Sprintf("referrer spam from %s", hit.ReferrerDomain.String)}
+		}
+		hit.Bot = sql.NullInt16{Int16: botReferrerSpam, Valid: true}
+	}
+
 	// Cross-domain referrers are generally anonomised by browsers. But if we see a referrer with a
 	// path or with query parameters, then we know this is not the case.
 	// Assume that own-domain referrers are not anonomised.
-	if hit.ReferrerDomain.String == hit.Domain || ru.Path != "/" || ru.RawQuery != "" {
+	if hit.ReferrerDomain.String == hit.Domain {
+		// Normalise in the same way as the page so that internal referrers match pages
+		hit.ReferrerPath = sql.NullString{String: sheepcount.Paths.Normalize(ru), Valid: true}
+	} else if ru.Path != "/" || ru.RawQuery != "" {
 		path := url.URL{
 			Path: ru.Path,
 		}
 
 		if ru.RawQuery != "" {
 			q := ru.Query()
+
+			// The search terms are kept on their own rather than in the path of the referrer
+			if keyword, param := searchKeyword(hit.ReferrerDomain.String, q); keyword != "" {
+				hit.Keyword = sql.NullString{String: keyword, Valid: true}
+				q.Del(param)
+			}
+
 			stripTrackingTags(q)
 			path.RawQuery = q.Encode()
 		}
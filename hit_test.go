@@ -1,5 +1,595 @@
-package main
+package sheepcount
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
 
 // func TestReferrer(t *testing.T) {
 // 	extractPageAndReferrer("https://www.jamesatkins.net/", "https://www.bbc.co.uk/")
 // }
+
+func TestNormalizePath(t *testing.T) {
+	config := PathConfig{
+		FoldTrailingSlash: true,
+		Lowercase:         true,
+		StripIndex:        true,
+		QueryParameters:   []string{"page", "id"},
+	}
+
+	tests := []struct {
+		url  string
+		path string
+	}{
+		{"https://example.com/", "/"},
+		{"https://example.com/About", "/about"},
+		{"https://example.com/about/", "/about"},
+		{"https://example.com/docs/index.html", "/docs"},
+		{"https://example.com/index.htm", "/"},
+		{"https://example.com/blog?utm_source=x&page=2", "/blog?page=2"},
+		{"https://example.com/blog?page=2&id=1", "/blog?id=1&page=2"},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if path := config.Normalize(u); path != test.path {
+			t.Errorf("%s: expected %s, got %s", test.url, test.path, path)
+		}
+	}
+}
+
+func TestIgnorePath(t *testing.T) {
+	config := IgnoreConfig{
+		Paths:       []string{"/admin/*", "*.xml", "/draft-?"},
+		PathRegexps: []string{`/user/\d+`},
+		AllowedPrefixes: map[string][]string{
+			"docs.example.com": {"/guide/", "/api/"},
+		},
+	}
+	rules, err := config.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		domain string
+		path   string
+		ignore bool
+	}{
+		{"example.com", "/", false},
+		{"example.com", "/admin/users", true},
+		{"example.com", "/admin", false},
+		{"example.com", "/sitemap.xml", true},
+		{"example.com", "/feeds/all.xml?page=2", true},
+		{"example.com", "/draft-1", true},
+		{"example.com", "/draft-12", false},
+		{"example.com", "/user/42", true},
+		{"example.com", "/user/42/posts", false},
+		{"example.com", "/user/bob", false},
+		{"docs.example.com", "/guide/install", false},
+		{"docs.example.com", "/api/", false},
+		{"docs.example.com", "/blog/", true},
+		{"docs.example.com", "/admin/users", true},
+	}
+
+	for _, test := range tests {
+		if ignore := rules.ignorePath(test.domain, test.path); ignore != test.ignore {
+			t.Errorf("%s%s: expected %v, got %v", test.domain, test.path, test.ignore, ignore)
+		}
+	}
+}
+
+func TestIgnoreIP(t *testing.T) {
+	config := IgnoreConfig{Networks: []string{"192.0.2.0/24", "2001:db8::1"}}
+	rules, err := config.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := IgnoreConfig{LocalNetworks: true}
+	localRules, err := local.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rules  *ignoreRules
+		ip     string
+		ignore bool
+	}{
+		{rules, "192.0.2.1", true},
+		{rules, "192.0.2.255", true},
+		{rules, "198.51.100.1", false},
+		{rules, "2001:db8::1", true},
+		{rules, "2001:db8::2", false},
+		{rules, "10.0.0.1", false},
+		{localRules, "10.0.0.1", true},
+		{localRules, "192.168.1.1", true},
+		{localRules, "100.64.0.1", true},
+		{localRules, "::1", true},
+		{localRules, "198.51.100.1", false},
+		{nil, "192.0.2.1", false},
+	}
+
+	for _, test := range tests {
+		if ignore := test.rules.ignoreIP(net.ParseIP(test.ip)); ignore != test.ignore {
+			t.Errorf("%s: expected %v, got %v", test.ip, test.ignore, ignore)
+		}
+	}
+}
+
+func TestInvalidIgnoreRules(t *testing.T) {
+	tests := []IgnoreConfig{
+		{PathRegexps: []string{"/user/(\\d+"}},
+		{Networks: []string{"192.0.2.0/33"}},
+		{Networks: []string{"example.com"}},
+	}
+
+	for _, config := range tests {
+		if _, err := config.compile(); err == nil {
+			t.Errorf("%+v: expected an error", config)
+		}
+
+		// Which stops the server from starting
+		full := DefaultConfig()
+		full.Ignore = config
+		invalid := false
+		for _, err := range full.Validate() {
+			invalid = invalid || strings.Contains(err.Error(), "invalid ignore")
+		}
+		if !invalid {
+			t.Errorf("%+v: expected the configuration to be invalid", config)
+		}
+	}
+}
+
+func TestHashRouting(t *testing.T) {
+	tests := []struct {
+		hashRouting string
+		url         string
+		path        string
+	}{
+		{"", "https://example.com/docs/#/intro", "/docs/"},
+		{"path", "https://example.com/docs/#/intro", "/intro"},
+		{"path", "https://example.com/#!/guide/install?page=2&utm_source=x", "/guide/install?page=2"},
+		{"path", "https://example.com/docs/#section", "/docs/"},
+		{"path", "https://example.com/docs/#//example.org/", "/docs/"},
+		{"append", "https://example.com/docs/#/intro", "/docs/#/intro"},
+		{"append", "https://example.com/#/intro?page=2", "/#/intro"},
+		{"append", "https://example.com/docs?page=3#/intro", "/docs/#/intro?page=3"},
+	}
+
+	for _, test := range tests {
+		config := PathConfig{QueryParameters: []string{"page"}, HashRouting: test.hashRouting}
+		u, err := url.Parse(test.url)
+		require.NoError(t, err)
+		assert.Equal(t, test.path, config.Normalize(u), test.url)
+	}
+
+	config := PathConfig{HashRouting: "query"}
+	assert.Error(t, config.validate())
+}
+
+func TestEngagement(t *testing.T) {
+	config := DefaultConfig()
+	config.Domains = []string{"example.com"}
+	config.TrackEngagement = true
+	sheepcount := &SheepCount{Config: config}
+
+	event := func(e string) *Event {
+		var event Event
+		err := json.Unmarshal([]byte(`{"e": "`+e+`", "u": "https://example.com/", "r": "", "b": 0, "h": 1080, "w": 1920, "p": 1, "s": 75, "g": 42}`), &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &event
+	}
+
+	var hit Hit
+	if err := hit.fromEvent(sheepcount, false, event("h")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sql.NullInt16{Int16: 75, Valid: true}, hit.ScrollDepth)
+	assert.Equal(t, sql.NullInt32{Int32: 42, Valid: true}, hit.EngagedSeconds)
+
+	hit = Hit{}
+	assert.Error(t, hit.fromEvent(sheepcount, false, event("l")))
+
+	// Ignored, rather than an error, when tracking is disabled
+	sheepcount.TrackEngagement = false
+	hit = Hit{}
+	if err := hit.fromEvent(sheepcount, false, event("h")); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, hit.ScrollDepth.Valid)
+	assert.False(t, hit.EngagedSeconds.Valid)
+}
+
+func TestPageTitles(t *testing.T) {
+	config := DefaultConfig()
+	config.Domains = []string{"example.com"}
+	config.TrackTitles = true
+	sheepcount := &SheepCount{Config: config}
+
+	event := func(e string, title string) *Event {
+		var event Event
+		err := json.Unmarshal([]byte(`{"e": "`+e+`", "u": "https://example.com/", "r": "", "b": 0, "h": 1080, "w": 1920, "p": 1, "i": "`+title+`"}`), &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &event
+	}
+
+	var hit Hit
+	if err := hit.fromEvent(sheepcount, false, event("l", `  About\n Us  `)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sql.NullString{String: "About Us", Valid: true}, hit.Title)
+
+	hit = Hit{}
+	assert.Error(t, hit.fromEvent(sheepcount, false, event("h", "About Us")))
+
+	// Ignored, rather than an error, when tracking is disabled
+	sheepcount.TrackTitles = false
+	hit = Hit{}
+	if err := hit.fromEvent(sheepcount, false, event("l", "About Us")); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, hit.Title.Valid)
+}
+
+func TestPerformance(t *testing.T) {
+	config := DefaultConfig()
+	config.Domains = []string{"example.com"}
+	config.TrackPerformance = true
+	sheepcount := &SheepCount{Config: config}
+
+	event := func(e string, timings string) *Event {
+		var event Event
+		err := json.Unmarshal([]byte(`{"e": "`+e+`", "u": "https://example.com/", "r": "", "b": 0, "h": 1080, "w": 1920, "p": 1`+timings+`}`), &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &event
+	}
+
+	var hit Hit
+	if err := hit.fromEvent(sheepcount, false, event("h", `, "f": 120, "m": 450, "n": 900`)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sql.NullInt32{Int32: 120, Valid: true}, hit.TimeToFirstByte)
+	assert.Equal(t, sql.NullInt32{Int32: 450, Valid: true}, hit.DOMContentLoaded)
+	assert.Equal(t, sql.NullInt32{Int32: 900, Valid: true}, hit.LoadTime)
+
+	for _, invalid := range []*Event{
+		event("l", `, "f": 120, "m": 450, "n": 900`),
+		event("h", `, "f": 120, "n": 900`),
+		event("h", `, "f": -1, "m": 450, "n": 900`),
+	} {
+		hit = Hit{}
+		assert.Error(t, hit.fromEvent(sheepcount, false, invalid))
+	}
+
+	// Ignored, rather than an error, when tracking is disabled
+	sheepcount.TrackPerformance = false
+	hit = Hit{}
+	if err := hit.fromEvent(sheepcount, false, event("h", `, "f": 120, "m": 450, "n": 900`)); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, hit.LoadTime.Valid)
+}
+
+func TestEventToken(t *testing.T) {
+	config := DefaultConfig()
+	config.Domains = []string{"example.com", "example.org"}
+	sheepcount := &SheepCount{Config: config, eventTokenKey: []byte("key")}
+
+	tokens := sheepcount.eventTokens(false)
+	assert.Len(t, tokens, 2)
+	assert.NotEqual(t, tokens["example.com"], tokens["example.org"])
+
+	event := func(token string) *Event {
+		return &Event{Event: PageLoad, Url: "https://example.com/", ScreenHeight: 1080, ScreenWidth: 1920, PixelRatio: 1, Token: token}
+	}
+
+	var hit Hit
+	assert.NoError(t, hit.fromEvent(sheepcount, false, event(tokens["example.com"])))
+
+	spam := spamHits.Value()
+	for _, token := range []string{"", "junk", tokens["example.org"]} {
+		hit = Hit{}
+		err := hit.fromEvent(sheepcount, false, event(token))
+		if assert.Error(t, err) {
+			assert.Equal(t, http.StatusForbidden, err.StatusCode())
+		}
+	}
+	assert.Equal(t, spam+3, spamHits.Value())
+}
+
+func TestGeoRules(t *testing.T) {
+	rules := (&GeoConfig{Block: []string{"ru", "US-CA"}, CountryOnly: []string{"EU"}}).compile()
+
+	location := func(country string, subdivision string) *Location {
+		var l Location
+		if country != "" {
+			l.Country = sql.NullString{String: country, Valid: true}
+		}
+		if subdivision != "" {
+			l.Subdivision = sql.NullString{String: subdivision, Valid: true}
+		}
+		return &l
+	}
+
+	assert.True(t, rules.block(location("RU", "")))
+	assert.True(t, rules.block(location("US", "CA")))
+	assert.False(t, rules.block(location("US", "NY")))
+	assert.False(t, rules.block(location("", "")))
+
+	assert.True(t, rules.truncate(location("DE", "BY")))
+	assert.False(t, rules.truncate(location("GB", "ENG")))
+
+	var none *geoRules
+	assert.False(t, none.block(location("RU", "")))
+}
+
+func TestResolveLocation(t *testing.T) {
+	hit := Hit{Domain: "example.com", IP: net.ParseIP("192.0.2.1")}
+
+	// The address is never spooled
+	encoded, err := json.Marshal(&hit)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(encoded), "192.0.2.1")
+
+	// Without a GeoIP database the hit is still recorded, and the address is forgotten
+	var geo GeoIP
+	hits := resolveLocations([]Hit{hit, {Domain: "example.org"}}, &geo, nil)
+	assert.Len(t, hits, 2)
+	for _, hit := range hits {
+		assert.Nil(t, hit.IP)
+		assert.False(t, hit.Country.Valid)
+	}
+}
+
+func TestBlockedLocationRealtime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "GeoLite2-City.mmdb")
+	writeTestGeoIP(t, path, "RU", time.Now())
+
+	config := DefaultConfig()
+	config.Domains = []string{"example.com"}
+	config.Geo.Block = []string{"RU"}
+	sheepcount := &SheepCount{
+		state:         &State{GeoIP: GeoIP{external: path}},
+		geo:           config.Geo.compile(),
+		realtime:      NewRealtime(),
+		broadcaster:   NewBroadcaster(),
+		hits:          make(chan Hit, 1),
+		Config:        config,
+		fingerprinter: fingerprintNone,
+	}
+	require.NoError(t, sheepcount.state.GeoIP.Load())
+	defer sheepcount.state.GeoIP.Close()
+
+	send := func() int {
+		body := `{"e": "l", "u": "https://example.com/pricing", "h": 1080, "w": 1920, "p": 2}`
+		r := httptest.NewRequest(http.MethodPost, config.Endpoints.Event, strings.NewReader(body))
+		r.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		sheepcount.Handler().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Hits from blocked locations are dropped before they are counted in real time
+	assert.Equal(t, http.StatusNoContent, send())
+	assert.Empty(t, sheepcount.hits)
+	assert.Zero(t, sheepcount.realtime.Stats("example.com", time.Now()).Visitors)
+
+	sheepcount.geo = (&GeoConfig{Block: []string{"US-CA"}}).compile()
+	assert.Equal(t, http.StatusNoContent, send())
+	assert.Len(t, sheepcount.hits, 1)
+	assert.Equal(t, 1, sheepcount.realtime.Stats("example.com", time.Now()).Visitors)
+}
+
+func TestForgetIPs(t *testing.T) {
+	config := DefaultConfig()
+	config.Domains = []string{"example.com"}
+	config.ForgetIPs = true
+	config.Ignore.Networks = []string{"198.51.100.0/24"}
+	ignore, err := config.Ignore.compile()
+	require.NoError(t, err)
+	sheepcount := &SheepCount{Config: config, state: &State{}, ignore: ignore}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	request := func(remoteAddr string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "http://stats.example.com/event", strings.NewReader(`{"e": "l", "u": "https://example.com/", "r": "", "b": 0, "h": 1080, "w": 1920, "p": 1}`))
+		r.Header.Set("User-Agent", "Mozilla/5.0")
+		r.RemoteAddr = remoteAddr
+		return r
+	}
+
+	hits, herr := NewHits(sheepcount, request("203.0.113.7"))
+	require.Nil(t, herr)
+	require.Len(t, hits, 1)
+	assert.Nil(t, hits[0].IP)
+	assert.NotContains(t, fmt.Sprintf("%+v", hits[0]), "203.0.113.7")
+	encoded, err := json.Marshal(&hits[0])
+	require.NoError(t, err)
+	assert.NotContains(t, string(encoded), "203.0.113.7")
+
+	// The same visitor is still recognised
+	again, herr := NewHits(sheepcount, request("203.0.113.7"))
+	require.Nil(t, herr)
+	assert.Equal(t, hits[0].IdentifierCurrent, again[0].IdentifierCurrent)
+
+	_, herr = NewHits(sheepcount, request("198.51.100.7"))
+	require.IsType(t, &ErrIgnored{}, herr)
+	assert.NotContains(t, herr.Error(), "198.51.100.7")
+
+	// Nor are addresses logged when they are taken from the headers of a reverse proxy
+	handler := ipAddress(true, nil, sheepcount.ForgetIPs, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, herr := NewHits(sheepcount, r)
+		assert.Nil(t, herr)
+	}))
+	for _, header := range []string{"192.0.2.9, 203.0.113.7", "", "203.0.113.7, 198.51.100.x"} {
+		r := request("[2001:db8::7]:4711")
+		if header != "" {
+			r.Header.Set("X-Forwarded-For", header)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	assert.Contains(t, logs.String(), "X-Forwarded-For is not valid")
+
+	for _, ip := range []string{"203.0.113.7", "198.51.100.7", "2001:db8::7", "192.0.2.9"} {
+		assert.NotContains(t, logs.String(), ip)
+	}
+}
+
+func TestDecodeEvents(t *testing.T) {
+	events, err := decodeEvents(strings.NewReader(`{"e": "l", "u": "https://example.com/"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []Event{{Event: PageLoad, Url: "https://example.com/"}}, events)
+
+	events, err = decodeEvents(strings.NewReader(` [{"e": "v", "u": "https://example.com/", "a": 5000}, {"e": "h", "u": "https://example.com/"}]`))
+	assert.NoError(t, err)
+	assert.Equal(t, []Event{
+		{Event: PageView, Url: "https://example.com/", Age: 5000},
+		{Event: PageHide, Url: "https://example.com/"},
+	}, events)
+
+	for _, body := range []string{``, `[]`, `[{"e": "x"}]`, `{"e": "l"`, `{"e": "l", "z": 1}`, "[" + strings.Repeat(`{"e": "v"},`, maxBatchEvents) + `{"e": "h"}]`} {
+		_, err := decodeEvents(strings.NewReader(body))
+		assert.Error(t, err, body)
+	}
+}
+
+func TestRejectedEvents(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxEventSize = 64
+	sheepcount := &SheepCount{Config: config}
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "http://stats.example.com/event", strings.NewReader(body))
+		handleEvent(sheepcount, nil, w, r)
+		return w
+	}
+
+	rejected := func(reason string) int64 {
+		if n, ok := rejectedEvents.Get(reason).(*expvar.Int); ok {
+			return n.Value()
+		}
+		return 0
+	}
+	tooLarge, malformed := rejected("too_large"), rejected("malformed")
+
+	w := post(`{"e": "l", "u": "https://example.com/` + strings.Repeat("a", 64) + `"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.JSONEq(t, `{"error": "too large: more than 64 bytes"}`, w.Body.String())
+
+	w = post(`{"e": "l", "unknown": true}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	assert.Equal(t, tooLarge+1, rejected("too_large"))
+	assert.Equal(t, malformed+1, rejected("malformed"))
+}
+
+func TestSearchKeywords(t *testing.T) {
+	config := DefaultConfig()
+	config.Domains = []string{"example.com"}
+	sheepcount := &SheepCount{Config: config}
+
+	tests := []struct {
+		referrer     string
+		keyword      sql.NullString
+		referrerPath sql.NullString
+	}{
+		{"https://www.google.co.uk/search?q=Counting++Sheep&hl=en", sql.NullString{String: "counting sheep", Valid: true}, sql.NullString{String: "/search?hl=en", Valid: true}},
+		{"https://duckduckgo.com/?q=sheep", sql.NullString{String: "sheep", Valid: true}, sql.NullString{String: "/", Valid: true}},
+		{"https://uk.search.yahoo.com/search?p=sheep", sql.NullString{String: "sheep", Valid: true}, sql.NullString{String: "/search", Valid: true}},
+		{"https://www.google.com/", sql.NullString{}, sql.NullString{}},
+		{"https://www.bing.com/search?q=+", sql.NullString{}, sql.NullString{String: "/search?q=+", Valid: true}},
+		{"https://example.org/page?q=sheep", sql.NullString{}, sql.NullString{String: "/page?q=sheep", Valid: true}},
+	}
+
+	for _, test := range tests {
+		var hit Hit
+		assert.Nil(t, hit.setPageAndReferrer(sheepcount, false, "https://example.com/", "", test.referrer), test.referrer)
+		assert.Equal(t, test.keyword, hit.Keyword, test.referrer)
+		assert.Equal(t, test.referrerPath, hit.ReferrerPath, test.referrer)
+	}
+
+	keyword, _ := searchKeyword("google.com", url.Values{"q": {strings.Repeat("é", maxKeywordLength+1)}})
+	assert.Equal(t, strings.Repeat("é", maxKeywordLength), keyword)
+}
+
+func TestCanonicalUrl(t *testing.T) {
+	config := DefaultConfig()
+	config.Domains = []string{"example.com", "www.example.com"}
+	sheepcount := &SheepCount{Config: config}
+
+	tests := []struct {
+		canonical string
+		domain    string
+		path      string
+	}{
+		{"", "example.com", "/blog/page/2"},
+		{"https://example.com/blog", "example.com", "/blog"},
+		{"https://WWW.example.com/blog", "www.example.com", "/blog"},
+		{"https://example.org/blog", "example.com", "/blog/page/2"},
+		{"ftp://example.com/blog", "example.com", "/blog/page/2"},
+		{"https://example.com", "example.com", "/blog/page/2"},
+		{"%", "example.com", "/blog/page/2"},
+	}
+
+	for _, test := range tests {
+		var hit Hit
+		assert.Nil(t, hit.setPageAndReferrer(sheepcount, false, "https://example.com/blog/page/2?utm_source=newsletter", test.canonical, ""), test.canonical)
+		assert.Equal(t, test.domain, hit.Domain, test.canonical)
+		assert.Equal(t, test.path, hit.Path, test.canonical)
+		assert.Equal(t, sql.NullString{String: "newsletter", Valid: true}, hit.Campaign.Source, test.canonical)
+	}
+}
+
+func TestHeaderReferrer(t *testing.T) {
+	const page = "https://example.com/blog"
+
+	tests := []struct {
+		header   string
+		referrer string
+	}{
+		{"", ""},
+		{"https://news.example.org/item?id=1", "https://news.example.org/item?id=1"},
+		{"https://example.com/blog", ""},
+		{"https://EXAMPLE.com/", ""},
+		{"android-app://com.example.app/", ""},
+		{"/relative", ""},
+		{"%", ""},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.referrer, headerReferrer(page, test.header), test.header)
+	}
+}
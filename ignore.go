@@ -0,0 +1,139 @@
+package sheepcount
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type IgnoreConfig struct {
+	Paths       []string `toml:"paths"`        // Glob patterns such as /admin/* or *.xml, where * matches anything
+	PathRegexps []string `toml:"path_regexps"` // Regular expressions matched against the whole path
+	Networks    []string `toml:"networks"`     // IP addresses or ranges in CIDR notation, such as 192.0.2.0/24
+
+	// Ignore visitors from loopback, private, link-local and carrier-grade NAT addresses, such as
+	// from the office network when SheepCount runs on it
+	LocalNetworks bool `toml:"local_networks"`
+
+	// For each domain, only count paths that start with one of these prefixes
+	AllowedPrefixes map[string][]string `toml:"allowed_prefixes"`
+}
+
+// Compiled version of IgnoreConfig
+type ignoreRules struct {
+	paths           []*regexp.Regexp
+	networks        []*net.IPNet
+	allowedPrefixes map[string][]string
+}
+
+func (config *IgnoreConfig) compile() (*ignoreRules, error) {
+	rules := &ignoreRules{allowedPrefixes: config.AllowedPrefixes}
+
+	for _, glob := range config.Paths {
+		pattern := regexp.QuoteMeta(glob)
+		pattern = strings.ReplaceAll(pattern, `\*`, `.*`)
+		pattern = strings.ReplaceAll(pattern, `\?`, `.`)
+		rules.paths = append(rules.paths, regexp.MustCompile("^"+pattern+"$"))
+	}
+
+	for _, expr := range config.PathRegexps {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore regexp %q: %w", expr, err)
+		}
+		rules.paths = append(rules.paths, re)
+	}
+
+	networks, err := parseNetworks(config.Networks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ignore network: %w", err)
+	}
+	rules.networks = networks
+
+	if config.LocalNetworks {
+		local, err := parseNetworks(localNetworks)
+		if err != nil {
+			panic(err)
+		}
+		rules.networks = append(rules.networks, local...)
+	}
+
+	return rules, nil
+}
+
+// Addresses that are not on the public internet. Carrier-grade NAT addresses are shared by many
+// customers of an ISP, but are not seen outside of it.
+var localNetworks = []string{
+	"127.0.0.0/8",    // Loopback
+	"10.0.0.0/8",     // Private
+	"172.16.0.0/12",  // Private
+	"192.168.0.0/16", // Private
+	"169.254.0.0/16", // Link-local
+	"100.64.0.0/10",  // Carrier-grade NAT
+	"::1/128",        // Loopback
+	"fc00::/7",       // Unique local
+	"fe80::/10",      // Link-local
+}
+
+func (rules *ignoreRules) ignoreIP(ip net.IP) bool {
+	if rules == nil || ip == nil {
+		return false
+	}
+
+	for _, network := range rules.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rules *ignoreRules) ignorePath(domain string, path string) bool {
+	if rules == nil {
+		return false
+	}
+
+	// Match against the path without any query parameters kept by normalisation
+	path = strings.SplitN(path, "?", 2)[0]
+
+	if prefixes, ok := rules.allowedPrefixes[domain]; ok {
+		allowed := false
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(path, prefix) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return true
+		}
+	}
+
+	for _, re := range rules.paths {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A hit that matched an ignore rule. This is not really an error, so it is silently dropped.
+type ErrIgnored struct {
+	reason string
+}
+
+func (err *ErrIgnored) Error() string {
+	return fmt.Sprintf("ignored: %s", err.reason)
+}
+
+func (err *ErrIgnored) Unwrap() error {
+	return nil
+}
+
+func (err *ErrIgnored) StatusCode() int {
+	return http.StatusNoContent
+}
@@ -0,0 +1,81 @@
+package sheepcount
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// The ISO 639-3 codes of the two languages that the visitor prefers most, from the Accept-Language
+// header. Languages are ordered by their q-weights, ties keeping the order of the header, and
+// regional variants count once, so "en-GB, en;q=0.9, fr;q=0.8" is English and then French. The
+// header is parsed one language at a time so that a malformed one does not lose the rest.
+func acceptLanguages(header string) (string, string) {
+	type weighted struct {
+		iso string
+		q   float64
+	}
+
+	var languages []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+
+		if iso := languageISO3(tag); iso != "" {
+			languages = append(languages, weighted{iso, q})
+		}
+	}
+
+	sort.SliceStable(languages, func(i, j int) bool { return languages[i].q > languages[j].q })
+
+	var primary, secondary string
+	for _, l := range languages {
+		if primary == "" {
+			primary = l.iso
+		} else if l.iso != primary {
+			secondary = l.iso
+			break
+		}
+	}
+
+	return primary, secondary
+}
+
+// The ISO 639-3 code of the language of a BCP 47 tag. If the tag is not valid or its language is
+// only a guess, such as for an unknown region, the primary subtag is used as the language on its
+// own, so that en_GB and en-XX are still English.
+func languageISO3(tag string) string {
+	if t, err := language.Parse(tag); err == nil {
+		if base, c := t.Base(); c == language.Exact || c == language.High {
+			return base.ISO3()
+		}
+	}
+
+	subtags := strings.FieldsFunc(tag, func(r rune) bool { return r == '-' || r == '_' })
+	if len(subtags) == 0 || strings.EqualFold(subtags[0], "und") {
+		return ""
+	}
+	if base, err := language.ParseBase(subtags[0]); err == nil {
+		return base.ISO3()
+	}
+
+	return ""
+}
@@ -0,0 +1,33 @@
+package sheepcount
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptLanguages(t *testing.T) {
+	tests := []struct {
+		header    string
+		primary   string
+		secondary string
+	}{
+		{"", "", ""},
+		{"*", "", ""},
+		{"en-GB", "eng", ""},
+		{"en-GB,en;q=0.9,fr;q=0.8", "eng", "fra"},
+		{"fr;q=0.5, de", "deu", "fra"},       // Ordered by weight
+		{"de;q=0.8, es;q=0.8", "deu", "spa"}, // Ties keep their order
+		{"ja, en;q=0", "jpn", ""},            // Not acceptable
+		{"en_US, pt-BR;q=0.7", "eng", "por"},
+		{"en-XX, cy", "eng", "cym"},
+		{"xx-invalid!, nl", "nld", ""}, // A malformed language does not lose the others
+		{"und, sv", "swe", ""},
+	}
+
+	for _, test := range tests {
+		primary, secondary := acceptLanguages(test.header)
+		assert.Equal(t, test.primary, primary, test.header)
+		assert.Equal(t, test.secondary, secondary, test.header)
+	}
+}
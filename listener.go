@@ -0,0 +1,146 @@
+package sheepcount
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Serve the dashboard, logging in, the queries and the API on a different address than the
+// endpoints that collect hits, such as 10.8.0.1:4445 that is only reachable over a VPN, or
+// unix:/run/sheepcount/admin.sock. The main addresses then only serve the script, the event
+// endpoint, the tracking pixel, and the public dashboards and badges.
+type AdminListenerConfig = ListenerConfig
+
+// An address to serve on, such as 127.0.0.1:4444, or unix:/run/sheepcount/sheepcount.sock for a
+// Unix socket.
+type ListenerConfig struct {
+	Address string `toml:"address"`
+
+	// Who can connect to the Unix socket
+	Socket SocketConfig `toml:"socket"`
+}
+
+func (config *ListenerConfig) Enabled() bool {
+	return config.Address != ""
+}
+
+func (config *ListenerConfig) validate() error {
+	if !config.Enabled() {
+		return nil
+	}
+
+	if path, ok := config.unixPath(); ok {
+		if path == "" {
+			return fmt.Errorf("invalid listener address: %q", config.Address)
+		}
+		return config.Socket.validate()
+	}
+
+	if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		return fmt.Errorf("invalid listener address: %w", err)
+	}
+	return nil
+}
+
+// The path of the Unix socket, if the address is one.
+func (config *ListenerConfig) unixPath() (string, bool) {
+	if !strings.HasPrefix(config.Address, "unix:") {
+		return "", false
+	}
+	return strings.TrimPrefix(config.Address, "unix:"), true
+}
+
+// Listen on the address, with TLS over TCP if there is a configuration for it.
+func (config *ListenerConfig) listen(tlsConfig *tls.Config) (net.Listener, error) {
+	if path, ok := config.unixPath(); ok {
+		return listenUnix(path, &config.Socket)
+	}
+
+	l, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen: %w", err)
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	return l, nil
+}
+
+// Listen on each of the addresses, or on none of them if any cannot be listened on. Run adds TLS.
+func listenAll(configs []ListenerConfig) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for i := range configs {
+		l, err := configs[i].listen(nil)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("%s: %w", configs[i].Address, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// How the requests that come in on a listener are treated. Requests through a Unix socket come from
+// a reverse proxy, so the address of the visitor is taken from its headers, but TCP listeners only
+// trust the headers of the trusted proxies unless the whole server is behind a reverse proxy. Hits
+// from localhost are only allowed over plain HTTP on TCP, as with --port.
+type listenerOptions struct {
+	reverseProxy   bool
+	allowLocalhost bool
+}
+
+type listenerOptionsKey struct{}
+
+// The options of a socket that is served with TLS if it is over TCP and there is a configuration
+// for it.
+func (sheepcount *SheepCount) socketOptions(socket net.Listener, withTLS bool) listenerOptions {
+	if socket.Addr().Network() == "unix" {
+		return listenerOptions{reverseProxy: true}
+	}
+	return listenerOptions{
+		reverseProxy:   sheepcount.ReverseProxy,
+		allowLocalhost: sheepcount.AllowLocalhost && !withTLS,
+	}
+}
+
+// Add TLS to the sockets over TCP, if there is a configuration for it, and work out the options of
+// each of them. Unix sockets are served over plain HTTP, as only the reverse proxy connects to them.
+func (sheepcount *SheepCount) prepareSockets(sockets []net.Listener, tlsConfig *tls.Config) []listenerOptions {
+	options := make([]listenerOptions, len(sockets))
+	for i := range sockets {
+		options[i] = sheepcount.socketOptions(sockets[i], tlsConfig != nil)
+		if tlsConfig != nil && sockets[i].Addr().Network() != "unix" {
+			sockets[i] = tls.NewListener(sockets[i], tlsConfig)
+		}
+	}
+	return options
+}
+
+// The options of the listener that the request came in on. Requests that Run did not serve use
+// those of the configuration.
+func (sheepcount *SheepCount) listenerOptions(r *http.Request) listenerOptions {
+	if options, ok := r.Context().Value(listenerOptionsKey{}).(listenerOptions); ok {
+		return options
+	}
+	return sheepcount.configOptions()
+}
+
+// The listener options of the configuration, for handlers that Run does not serve.
+func (sheepcount *SheepCount) configOptions() listenerOptions {
+	return listenerOptions{reverseProxy: sheepcount.ReverseProxy, allowLocalhost: sheepcount.AllowLocalhost}
+}
+
+// Middleware to record the options of the listener in the context of the request.
+func withListenerOptions(options listenerOptions, next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerOptionsKey{}, options)))
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,89 @@
+package sheepcount
+
+import (
+	"container/list"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A least recently used cache of database IDs. It is not safe for concurrent use.
+type lruCache struct {
+	capacity int
+	order    *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key string
+	id  int64
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element, capacity),
+	}
+}
+
+func (cache *lruCache) Get(key string) (int64, bool) {
+	elem, ok := cache.items[key]
+	if !ok {
+		return 0, false
+	}
+
+	cache.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).id, true
+}
+
+func (cache *lruCache) Put(key string, id int64) {
+	if elem, ok := cache.items[key]; ok {
+		elem.Value.(*lruEntry).id = id
+		cache.order.MoveToFront(elem)
+		return
+	}
+
+	cache.items[key] = cache.order.PushFront(&lruEntry{key: key, id: id})
+
+	if cache.order.Len() > cache.capacity {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (cache *lruCache) Clear() {
+	cache.order.Init()
+	cache.items = make(map[string]*list.Element, cache.capacity)
+}
+
+// Build a cache key from several values, distinguishing between NULL and empty values.
+func cacheKey(parts ...interface{}) string {
+	var b strings.Builder
+	for _, part := range parts {
+		switch p := part.(type) {
+		case string:
+			b.WriteString(strconv.Quote(p))
+		case int64:
+			b.WriteString(strconv.FormatInt(p, 10))
+		case sql.NullString:
+			if p.Valid {
+				b.WriteString(strconv.Quote(p.String))
+			}
+		case sql.NullInt32:
+			if p.Valid {
+				b.WriteString(strconv.FormatInt(int64(p.Int32), 10))
+			}
+		case sql.NullFloat64:
+			if p.Valid {
+				b.WriteString(strconv.FormatFloat(p.Float64, 'g', -1, 64))
+			}
+		default:
+			panic(fmt.Sprintf("cacheKey: unsupported type %T", part))
+		}
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
@@ -0,0 +1,266 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type MaintenanceConfig struct {
+	// How often to copy the write-ahead log into the database and truncate it, as it otherwise only
+	// shrinks when no one is reading. Zero leaves it to SQLite.
+	CheckpointInterval time.Duration `toml:"checkpoint_interval"`
+
+	// When to check the database for corruption, in cron format such as "0 4 * * 0" or @weekly.
+	// Empty disables the checks.
+	IntegrityCheck string `toml:"integrity_check"`
+
+	// How many months of raw hits to keep before the current one. The hits of earlier months are
+	// dropped, but their rollups are kept, so the dashboard still shows their totals. Zero keeps every
+	// hit.
+	RetentionMonths int `toml:"retention_months"`
+}
+
+// How large the write-ahead log was before the last checkpoint, how many checkpoints could not
+// finish because of readers, and how many problems the last integrity check found
+var (
+	walSize             = expvar.NewInt("wal_size_bytes")
+	walCheckpointsBusy  = expvar.NewInt("wal_checkpoints_busy")
+	integrityCheckFails = expvar.NewInt("integrity_check_problems")
+)
+
+// The most problems that an integrity check reports
+const maxIntegrityProblems = 100
+
+type checkpointResult struct {
+	busy     bool  // Whether readers or writers stopped the checkpoint from finishing
+	walBytes int64 // The size of the write-ahead log before the checkpoint
+}
+
+// Copy the write-ahead log into the database and truncate it. A truncating checkpoint reports an
+// empty log when it succeeds, so a passive one first finds out how large the log was, and does most
+// of the copying without waiting for readers.
+func dbCheckpoint(ctx context.Context, db *sql.DB) (checkpointResult, error) {
+	var result checkpointResult
+
+	var busy int
+	var frames, ignored int64
+	if err := db.QueryRowContext(ctx, "PRAGMA wal_checkpoint(PASSIVE)").Scan(&busy, &frames, &ignored); err != nil {
+		return result, fmt.Errorf("cannot checkpoint: %w", err)
+	}
+
+	var pageSize int64
+	if err := db.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize); err != nil {
+		return result, err
+	}
+	// Not in WAL mode, such as for in-memory databases, there are -1 frames
+	if frames > 0 {
+		result.walBytes = frames * pageSize
+	}
+
+	if err := db.QueryRowContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &ignored, &ignored); err != nil {
+		return result, fmt.Errorf("cannot checkpoint: %w", err)
+	}
+	result.busy = busy != 0
+
+	return result, nil
+}
+
+// Check the database for corruption, returning the problems found. The quick check skips
+// checking that indexes match their tables, which takes much longer.
+func dbQuickCheck(ctx context.Context, db *sql.DB) ([]string, error) {
+	// Pragmas cannot have parameters
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("PRAGMA quick_check(%d)", maxIntegrityProblems))
+	if err != nil {
+		return nil, fmt.Errorf("cannot check integrity: %w", err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var problem string
+		if err := rows.Scan(&problem); err != nil {
+			return nil, err
+		}
+		if problem != "ok" {
+			problems = append(problems, problem)
+		}
+	}
+
+	return problems, rows.Err()
+}
+
+// The start of the earliest month whose hits are kept.
+func retentionCutoff(now time.Time, months int) int64 {
+	month := time.Unix(hitPartitionOf(now.Unix()).start, 0).UTC()
+	return month.AddDate(0, -months, 0).Unix()
+}
+
+func dropOldHits(ctx context.Context, db *sql.DB, months int) error {
+	dropped, err := dbDropHitPartitions(ctx, db, retentionCutoff(time.Now(), months))
+	if err != nil {
+		return fmt.Errorf("cannot drop old hits: %w", err)
+	}
+	for _, table := range dropped {
+		log.Printf("Dropped the hits of %s", table)
+	}
+	return nil
+}
+
+func checkpoint(ctx context.Context, db *sql.DB) error {
+	result, err := dbCheckpoint(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	walSize.Set(result.walBytes)
+	if result.busy {
+		walCheckpointsBusy.Add(1)
+		log.Printf("Write-ahead log of %d bytes could not be truncated as the database is busy", result.walBytes)
+	}
+	return nil
+}
+
+func quickCheck(ctx context.Context, db *sql.DB) error {
+	problems, err := dbQuickCheck(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	integrityCheckFails.Set(int64(len(problems)))
+	for _, problem := range problems {
+		log.Printf("Database is corrupt: %s", problem)
+	}
+	return nil
+}
+
+// Checkpoint the write-ahead log at the configured interval, check the integrity of the database on
+// the configured schedule, and drop the hits of months that are no longer kept each day. Checking
+// only reads, so it uses the read-only database to not hold up the database writer.
+func Maintainer(ctx context.Context, db *sql.DB, readDB *sql.DB, config *MaintenanceConfig) error {
+	var checkpoints <-chan time.Time
+	if config.CheckpointInterval > 0 {
+		ticker := time.NewTicker(config.CheckpointInterval)
+		defer ticker.Stop()
+		checkpoints = ticker.C
+	}
+
+	var drops <-chan time.Time
+	if config.RetentionMonths > 0 {
+		if err := dropOldHits(ctx, db, config.RetentionMonths); err != nil {
+			log.Print(err)
+		}
+		ticker := time.NewTicker(24 * time.Hour)
+		defer ticker.Stop()
+		drops = ticker.C
+	}
+
+	var schedule *cronSchedule
+	if config.IntegrityCheck != "" {
+		var err error
+		if schedule, err = parseCron(config.IntegrityCheck); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var checks <-chan time.Time
+		var timer *time.Timer
+		if schedule != nil {
+			next := schedule.Next(time.Now())
+			if next.IsZero() {
+				return fmt.Errorf("integrity check schedule %q never runs", config.IntegrityCheck)
+			}
+			timer = time.NewTimer(time.Until(next))
+			checks = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return ctx.Err()
+
+		case <-checkpoints:
+			if err := checkpoint(ctx, db); err != nil {
+				log.Print(err)
+			}
+
+		case <-drops:
+			if err := dropOldHits(ctx, db, config.RetentionMonths); err != nil {
+				log.Print(err)
+			}
+
+		case <-checks:
+			start := time.Now()
+			if err := quickCheck(ctx, readDB); err != nil {
+				log.Print(err)
+			} else {
+				log.Printf("Checked database integrity in %s", time.Since(start).Round(time.Millisecond))
+			}
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func newMaintenanceCommand(databasePath *string) *cobra.Command {
+	var retentionMonths int
+
+	cmd := &cobra.Command{
+		Use:   "maintenance",
+		Short: "Truncate the write-ahead log, drop old hits and check the database for corruption",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			result, err := dbCheckpoint(cmd.Context(), db)
+			if err != nil {
+				return err
+			}
+			if result.busy {
+				fmt.Printf("checkpoint  busy, %d bytes\n", result.walBytes)
+			} else {
+				fmt.Printf("checkpoint  ok, %d bytes\n", result.walBytes)
+			}
+
+			if retentionMonths > 0 {
+				dropped, err := dbDropHitPartitions(cmd.Context(), db, retentionCutoff(time.Now(), retentionMonths))
+				if err != nil {
+					return err
+				}
+				for _, table := range dropped {
+					fmt.Printf("retention   dropped %s\n", table)
+				}
+			}
+
+			problems, err := dbQuickCheck(cmd.Context(), db)
+			if err != nil {
+				return err
+			}
+			if len(problems) == 0 {
+				fmt.Println("integrity   ok")
+				return nil
+			}
+			for _, problem := range problems {
+				fmt.Printf("integrity   %s\n", problem)
+			}
+			return fmt.Errorf("database is corrupt: %d problems found", len(problems))
+		},
+	}
+
+	cmd.Flags().IntVar(&retentionMonths, "retention-months", 0, "Drop the hits of months before this many months ago, keeping their rollups")
+	return cmd
+}
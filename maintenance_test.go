@@ -0,0 +1,42 @@
+package sheepcount
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sheepcount.sqlite3")
+	db, err := dbConnect(path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	_, err = db.Exec("INSERT INTO sites(domain) VALUES ('example.com')")
+	require.NoError(t, err)
+
+	result, err := dbCheckpoint(ctx, db)
+	require.NoError(t, err)
+	assert.False(t, result.busy)
+	assert.Positive(t, result.walBytes)
+
+	// The log was truncated
+	result, err = dbCheckpoint(ctx, db)
+	require.NoError(t, err)
+	assert.Zero(t, result.walBytes)
+
+	readDB, err := dbConnectReadOnly(path)
+	require.NoError(t, err)
+	defer readDB.Close()
+
+	problems, err := dbQuickCheck(ctx, readDB)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	require.NoError(t, quickCheck(ctx, readDB))
+	assert.Zero(t, integrityCheckFails.Value())
+}
@@ -0,0 +1,274 @@
+package sheepcount
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Each query in db/queries has a manifest next to it, <name>.toml, that declares the parameters that
+// it takes and who can run it from the dashboard. The manifests are checked against the queries when
+// they are loaded, and requests are checked against the manifests, so a query is only ever given the
+// parameters that it expects.
+type queryManifest struct {
+	Auth       string                     `toml:"auth"`    // viewer, the default, or admin
+	CSV        bool                       `toml:"csv"`     // The results can be downloaded from /queries/<name>.csv
+	Columns    []string                   `toml:"columns"` // The keys of the result objects, in order, for the header of downloads
+	Parameters map[string]*queryParameter `toml:"parameters"`
+}
+
+// A parameter of a query. Those that are not given get their default, or NULL if they are optional
+// and have none.
+type queryParameter struct {
+	Type      string      `toml:"type"` // string, int, bool, date, timezone or search
+	Required  bool        `toml:"required"`
+	Default   interface{} `toml:"default"`
+	Min       *int64      `toml:"min"`
+	Max       *int64      `toml:"max"`
+	MaxLength int         `toml:"max_length"` // Of strings and searches
+}
+
+// Searches are bound as LIKE patterns that match the term anywhere.
+const maxSearchLength = 200
+
+// The period of a query is converted by bindPeriod into whichever of these it uses.
+var periodParameters = map[string]bool{"start_date": true, "end_date": true, "timezone": true}
+var derivedParameters = map[string]bool{"start": true, "end": true, "days": true, "zone": true}
+
+func parseQueryManifest(data string, query string) (*queryManifest, error) {
+	var manifest queryManifest
+	md, err := toml.Decode(data, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown manifest key %s", undecoded[0])
+	}
+
+	if manifest.Auth == "" {
+		manifest.Auth = roleViewer
+	}
+	if !validRole(manifest.Auth) {
+		return nil, fmt.Errorf("auth must be %s or %s, not %s", roleAdmin, roleViewer, manifest.Auth)
+	}
+
+	// Downloads always have a header, even without any rows to take it from
+	if manifest.CSV && len(manifest.Columns) == 0 {
+		return nil, errors.New("csv needs the columns of the result")
+	}
+	for _, column := range manifest.Columns {
+		if !strings.Contains(query, "'"+column+"'") {
+			return nil, fmt.Errorf("the column %s is not in the query", column)
+		}
+	}
+
+	for name, parameter := range manifest.Parameters {
+		if err := parameter.validate(); err != nil {
+			return nil, fmt.Errorf("parameter %s: %w", name, err)
+		}
+	}
+
+	// Every parameter of the query must be declared, and every declared parameter used
+	used := queryParameters(query)
+	for name := range used {
+		if derivedParameters[name] {
+			if manifest.Parameters["start_date"] == nil || manifest.Parameters["end_date"] == nil {
+				return nil, fmt.Errorf("the query uses :%s but start_date and end_date are not declared", name)
+			}
+			continue
+		}
+		if manifest.Parameters[name] == nil {
+			return nil, fmt.Errorf("the query uses :%s but it is not declared", name)
+		}
+	}
+	for name := range manifest.Parameters {
+		if periodParameters[name] {
+			if !used["start"] && !used["end"] && !used["days"] {
+				return nil, fmt.Errorf("%s is declared but the query has no period", name)
+			}
+			continue
+		}
+		if !used[name] {
+			return nil, fmt.Errorf("%s is declared but the query does not use it", name)
+		}
+	}
+
+	return &manifest, nil
+}
+
+func (parameter *queryParameter) validate() error {
+	switch parameter.Type {
+	case "string", "int", "bool", "date", "timezone", "search":
+	default:
+		return fmt.Errorf("unknown type %q", parameter.Type)
+	}
+
+	if (parameter.Min != nil || parameter.Max != nil) && parameter.Type != "int" {
+		return errors.New("only ints can have a min or max")
+	}
+	if parameter.MaxLength != 0 && parameter.Type != "string" && parameter.Type != "search" {
+		return errors.New("only strings and searches can have a max_length")
+	}
+
+	if parameter.Default == nil {
+		return nil
+	}
+	if parameter.Required {
+		return errors.New("a required parameter cannot have a default")
+	}
+
+	// TOML has its own types, so the default is checked by parsing it as if it had been given
+	var value string
+	switch d := parameter.Default.(type) {
+	case string:
+		value = d
+	case int64:
+		value = strconv.FormatInt(d, 10)
+	case bool:
+		value = strconv.FormatBool(d)
+	default:
+		return fmt.Errorf("invalid default %v", d)
+	}
+	if parameter.Type == "timezone" || parameter.Type == "search" {
+		return fmt.Errorf("a %s cannot have a default", parameter.Type)
+	}
+	v, err := parameter.parse(value)
+	if err != nil {
+		return fmt.Errorf("invalid default: %w", err)
+	}
+	parameter.Default = v
+
+	return nil
+}
+
+// Convert the value of the parameter from a request to the type that is bound.
+func (parameter *queryParameter) parse(v string) (interface{}, error) {
+	switch parameter.Type {
+	case "int":
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, errors.New("must be an integer")
+		}
+		if parameter.Min != nil && n < *parameter.Min {
+			return nil, fmt.Errorf("must be at least %d", *parameter.Min)
+		}
+		if parameter.Max != nil && n > *parameter.Max {
+			return nil, fmt.Errorf("must be at most %d", *parameter.Max)
+		}
+		return n, nil
+	case "bool":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.New("must be true or false")
+		}
+		return b, nil
+	case "date":
+		if !validDate(v) {
+			return nil, errors.New("must be in YYYY-MM-DD format")
+		}
+		return v, nil
+	case "timezone":
+		loc, err := loadTimezone(v)
+		if err != nil {
+			return nil, errors.New("must be an IANA time zone name")
+		}
+		return loc, nil
+	case "search":
+		if len(v) > parameter.maxLength(maxSearchLength) {
+			return nil, fmt.Errorf("must be at most %d bytes", parameter.maxLength(maxSearchLength))
+		}
+		if v == "" {
+			return nil, nil
+		}
+		return likePattern(v), nil
+	default:
+		if max := parameter.maxLength(0); max > 0 && len(v) > max {
+			return nil, fmt.Errorf("must be at most %d bytes", max)
+		}
+		return v, nil
+	}
+}
+
+func (parameter *queryParameter) maxLength(fallback int) int {
+	if parameter.MaxLength > 0 {
+		return parameter.MaxLength
+	}
+	return fallback
+}
+
+// Check the parameters of a request against the manifest and convert them into arguments of the
+// query. Parameters that are not declared are rejected, and those that are not given are left to
+// bindDefaults.
+func (manifest *queryManifest) bind(values url.Values) ([]interface{}, error) {
+	for name := range values {
+		if manifest.Parameters[name] == nil {
+			return nil, BadInput(fmt.Errorf("unknown parameter %s", name))
+		}
+	}
+
+	return manifest.bindRest(values, nil)
+}
+
+// Convert the parameters of a request that are not in args already, such as the country of the
+// regions for the API, which works out the site and period itself. Other parameters are ignored.
+func (manifest *queryManifest) bindRest(values url.Values, args []interface{}) ([]interface{}, error) {
+	given := make(map[string]bool)
+	for _, arg := range args {
+		if named, ok := arg.(sql.NamedArg); ok {
+			given[named.Name] = true
+		}
+	}
+
+	// In order, so that errors are always about the same parameter
+	names := make([]string, 0, len(manifest.Parameters))
+	for name := range manifest.Parameters {
+		if !given[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		parameter := manifest.Parameters[name]
+		if !values.Has(name) {
+			if parameter.Required {
+				return nil, BadInput(fmt.Errorf("%s is required", name))
+			}
+			continue
+		}
+
+		v, err := parameter.parse(values.Get(name))
+		if err != nil {
+			return nil, BadInput(fmt.Errorf("%s %w", name, err))
+		}
+		args = append(args, sql.Named(name, v))
+	}
+
+	return args, nil
+}
+
+// Add the defaults of the parameters that have not been given, such as the first page of a list for
+// reports, which do not page them.
+func (manifest *queryManifest) bindDefaults(args []interface{}) []interface{} {
+	given := make(map[string]bool)
+	for _, arg := range args {
+		if named, ok := arg.(sql.NamedArg); ok {
+			given[named.Name] = true
+		}
+	}
+
+	for name, parameter := range manifest.Parameters {
+		if given[name] || parameter.Required || periodParameters[name] {
+			continue
+		}
+		args = append(args, sql.Named(name, parameter.Default))
+	}
+
+	return args
+}
@@ -0,0 +1,133 @@
+package sheepcount
+
+import (
+	"database/sql"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testManifestQuery = `-- Pages of :site that match :search
+SELECT json_group_array(path) FROM paths
+WHERE :site IS NOT NULL AND :start < :end AND (:search IS NULL OR path LIKE :search) LIMIT :limit`
+
+func TestParseQueryManifest(t *testing.T) {
+	manifest, err := parseQueryManifest(`
+[parameters.site]
+type = "string"
+required = true
+
+[parameters.start_date]
+type = "date"
+required = true
+
+[parameters.end_date]
+type = "date"
+required = true
+
+[parameters.timezone]
+type = "timezone"
+
+[parameters.search]
+type = "search"
+
+[parameters.limit]
+type = "int"
+default = 100
+min = 1
+max = 1000
+`, testManifestQuery)
+	require.NoError(t, err)
+	assert.Equal(t, roleViewer, manifest.Auth)
+	assert.Equal(t, int64(100), manifest.Parameters["limit"].Default)
+
+	for name, data := range map[string]string{
+		"undeclared":   ``,
+		"unused":       `[parameters.country]` + "\n" + `type = "string"`,
+		"unknown key":  `[parameters.site]` + "\n" + `type = "string"` + "\n" + `optional = true`,
+		"unknown type": `[parameters.site]` + "\n" + `type = "float"`,
+		"bad default":  `[parameters.site]` + "\n" + `type = "int"` + "\n" + `default = "ten"`,
+		"out of range": `[parameters.site]` + "\n" + `type = "int"` + "\n" + `default = 0` + "\n" + `min = 1`,
+		"min":          `[parameters.site]` + "\n" + `type = "string"` + "\n" + `min = 1`,
+		"auth":         `auth = "owner"`,
+		"csv":          `csv = true` + "\n" + `[parameters.site]` + "\n" + `type = "string"`,
+		"columns":      `columns = ["country"]` + "\n" + `[parameters.site]` + "\n" + `type = "string"`,
+	} {
+		_, err := parseQueryManifest(data, "SELECT :site")
+		assert.Error(t, err, name)
+	}
+
+	// The period is declared with dates, not with what the query is given
+	_, err = parseQueryManifest(`[parameters.site]`+"\n"+`type = "string"`, "SELECT :site, :days")
+	assert.Error(t, err)
+	_, err = parseQueryManifest(`[parameters.start_date]`+"\n"+`type = "date"`, "SELECT 1")
+	assert.Error(t, err)
+}
+
+func TestQueryManifestBind(t *testing.T) {
+	manifest, err := parseQueryManifest(`
+[parameters.site]
+type = "string"
+required = true
+
+[parameters.start_date]
+type = "date"
+
+[parameters.end_date]
+type = "date"
+
+[parameters.timezone]
+type = "timezone"
+
+[parameters.search]
+type = "search"
+
+[parameters.limit]
+type = "int"
+default = 100
+min = 1
+max = 1000
+`, testManifestQuery)
+	require.NoError(t, err)
+
+	london, err := time.LoadLocation("Europe/London")
+	require.NoError(t, err)
+
+	args, err := manifest.bind(url.Values{"site": {"example.com"}, "timezone": {"Europe/London"}, "search": {"50%"}})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []interface{}{
+		sql.Named("site", "example.com"),
+		sql.Named("timezone", london),
+		sql.Named("search", `%50\%%`),
+	}, args)
+
+	// The parameters that are not given get their defaults, except the period
+	assert.ElementsMatch(t, []interface{}{
+		sql.Named("site", "example.com"),
+		sql.Named("timezone", london),
+		sql.Named("search", `%50\%%`),
+		sql.Named("limit", int64(100)),
+	}, manifest.bindDefaults(args))
+
+	for name, values := range map[string]url.Values{
+		"unknown":  {"site": {"example.com"}, "country": {"GB"}},
+		"required": {"search": {"blog"}},
+		"int":      {"site": {"example.com"}, "limit": {"ten"}},
+		"max":      {"site": {"example.com"}, "limit": {"1001"}},
+		"date":     {"site": {"example.com"}, "start_date": {"yesterday"}},
+		"timezone": {"site": {"example.com"}, "timezone": {"Mars/Olympus_Mons"}},
+	} {
+		_, err := manifest.bind(values)
+		if assert.Error(t, err, name) {
+			assert.IsType(t, &ErrBadInput{}, err, name)
+		}
+	}
+
+	// Parameters that have been bound already, or are not declared, are left alone
+	args, err = manifest.bindRest(url.Values{"site": {"ignored"}, "limit": {"10"}, "compare": {"previous"}}, []interface{}{sql.Named("site", "example.com")})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []interface{}{sql.Named("site", "example.com"), sql.Named("limit", int64(10))}, args)
+}
@@ -1,36 +1,234 @@
-package main
+package sheepcount
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 )
 
-var xRealIPHeader = http.CanonicalHeaderKey("X-Real-IP")
+var (
+	xRealIPHeader       = http.CanonicalHeaderKey("X-Real-IP")
+	xForwardedForHeader = http.CanonicalHeaderKey("X-Forwarded-For")
+	forwardedHeader     = http.CanonicalHeaderKey("Forwarded")
+)
+
+// Parse a list of IP addresses and CIDR ranges. A single address is treated as a range of one.
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// Parse an IP address that may have a port, be in brackets or have an IPv6 zone, as in RemoteAddr
+// and proxy headers. IPv4-mapped IPv6 addresses such as ::ffff:192.0.2.1 are returned as IPv4, so
+// that the same visitor has the same address however they connect. Returns nil if it is invalid.
+func parseIP(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	if i := strings.IndexByte(addr, '%'); i >= 0 {
+		addr = addr[:i]
+	}
+
+	ip := net.ParseIP(addr)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// The normalised IP address of whoever sent the request, as set by the ipAddress middleware.
+func remoteIP(r *http.Request) net.IP {
+	return parseIP(r.RemoteAddr)
+}
+
+// How much of an address is kept by anonymize_ips
+var (
+	anonymizedIPv4Mask = net.CIDRMask(24, 32)
+	anonymizedIPv6Mask = net.CIDRMask(48, 128)
+)
+
+// The /24 network of an IPv4 address or the /48 network of an IPv6 one, as an address.
+func anonymizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(anonymizedIPv4Mask)
+	}
+	return ip.Mask(anonymizedIPv6Mask)
+}
+
+// The IP address of the visitor who sent the request, truncated if anonymize_ips is enabled.
+func (sheepcount *SheepCount) visitorIP(r *http.Request) net.IP {
+	ip := remoteIP(r)
+	if sheepcount.AnonymizeIPs && ip != nil {
+		ip = anonymizeIP(ip)
+	}
+	return ip
+}
+
+func trusted(ip net.IP, trustedProxies []*net.IPNet) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Walk the hops of the X-Forwarded-For or Forwarded header from the right, skipping our trusted
+// proxies, and return the first untrusted address. Anything to the left of that could have been
+// forged by the client. If every hop is trusted, then the leftmost is the client. Without trusted
+// proxies, it is the rightmost, which the reverse proxy added itself. A hop that hides its address
+// cannot be trusted either, so the walk stops there and the last trusted hop is returned, which is
+// nil if there is none.
+func forwardedFor(hops []string, trustedProxies []*net.IPNet) (net.IP, bool) {
+	var ip net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hiddenHop(hops[i]) {
+			return ip, true
+		}
+		ip = parseIP(hops[i])
+		if ip == nil {
+			return nil, false
+		}
+		if !trusted(ip, trustedProxies) {
+			return ip, true
+		}
+	}
+
+	return ip, ip != nil
+}
+
+// Whether a hop is the unknown or an obfuscated node of RFC 7239, such as for=unknown or
+// for="_hidden:4711", which some proxies send instead of an address.
+func hiddenHop(hop string) bool {
+	hop = strings.TrimSpace(hop)
+	return strings.HasPrefix(hop, "_") || strings.EqualFold(hop, "unknown") ||
+		len(hop) > len("unknown:") && strings.EqualFold(hop[:len("unknown:")], "unknown:")
+}
+
+// The addresses of the hops in a Forwarded header (RFC 7239), such as
+// for=192.0.2.43, for="[2001:db8:cafe::17]:4711";proto=https, in the same order as X-Forwarded-For.
+// Hops without a for parameter make the header invalid.
+func forwardedHops(header string) ([]string, bool) {
+	var hops []string
+	for _, element := range strings.Split(header, ",") {
+		var hop string
+		for _, pair := range strings.Split(element, ";") {
+			name, value, _ := cut(strings.TrimSpace(pair), "=")
+			if strings.EqualFold(name, "for") {
+				hop = strings.Trim(value, `"`)
+			}
+		}
+		if hop == "" {
+			return nil, false
+		}
+		hops = append(hops, hop)
+	}
+	return hops, true
+}
 
 // Middleware to set RemoteAddr to the IP address of whoever sent the request or reply with 500 error.
-func ipAddress(reverseProxy bool, next http.Handler) http.Handler {
+// Behind a reverse proxy, or when the request comes from one of the trusted proxies, the address is
+// taken from the proxy headers. With trusted proxies, the Forwarded header is preferred, then
+// X-Forwarded-For and then X-Real-IP. Without, X-Real-IP is preferred, and otherwise the last hop of
+// Forwarded or X-Forwarded-For is used, as Caddy and Traefik only send those. If IP addresses must
+// be forgotten, none are logged.
+func ipAddress(reverseProxy bool, trustedProxies []*net.IPNet, forgetIPs bool, next http.Handler) http.Handler {
+	var warnOnce sync.Once
+
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		var ip net.IP
-		if reverseProxy {
-			if xrip := r.Header.Get(xRealIPHeader); xrip != "" {
-				ip = net.ParseIP(xrip)
-				if ip == nil {
-					log.Printf("X-Real-IP' %s' is not valid", xrip)
-					w.WriteHeader(http.StatusInternalServerError)
-					return
+		peer := parseIP(r.RemoteAddr)
+
+		if !reverseProxy && peer == nil {
+			if forgetIPs {
+				log.Print("remote address is not valid")
+			} else {
+				log.Printf("remote address '%s' is not valid", r.RemoteAddr)
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		ip := peer
+		if reverseProxy || trusted(peer, trustedProxies) {
+			// Some proxies, such as HAProxy, add their hop as another line of the header rather than
+			// to the end of the line that the client sent, so the lines are joined in order
+			forwarded := strings.Join(r.Header.Values(forwardedHeader), ",")
+			xff := strings.Join(r.Header.Values(xForwardedForHeader), ",")
+			xrip := r.Header.Get(xRealIPHeader)
+
+			var header, value string
+			switch {
+			case forwarded != "" && (len(trustedProxies) > 0 || xrip == ""):
+				header, value = forwardedHeader, forwarded
+			case xff != "" && (len(trustedProxies) > 0 || xrip == ""):
+				header, value = xForwardedForHeader, xff
+			case xrip != "":
+				header, value = xRealIPHeader, xrip
+			}
+
+			var ok bool
+			switch header {
+			case forwardedHeader:
+				var hops []string
+				if hops, ok = forwardedHops(forwarded); ok {
+					ip, ok = forwardedFor(hops, trustedProxies)
 				}
+			case xForwardedForHeader:
+				ip, ok = forwardedFor(strings.Split(xff, ","), trustedProxies)
+			case xRealIPHeader:
+				ip = parseIP(xrip)
+				ok = ip != nil
+			default:
+				// Every request would look like it came from the proxy
+				if reverseProxy {
+					warnOnce.Do(func() {
+						if forgetIPs {
+							log.Print("Warning: behind a reverse proxy but a request has no Forwarded, X-Forwarded-For or X-Real-IP header, so the address of the proxy is used")
+						} else {
+							log.Printf("Warning: behind a reverse proxy but the request from '%s' has no Forwarded, X-Forwarded-For or X-Real-IP header, so the address of the proxy is used", r.RemoteAddr)
+						}
+					})
+				}
+				ok = true
 			}
-		} else {
-			host, _, err := net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
-				log.Printf("cannot get IP address from %s", r.RemoteAddr)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+			// Every hop was hidden, so the request came from the peer as far as we can tell
+			if ok && ip == nil {
+				ip = peer
+				ok = ip != nil
 			}
-			ip = net.ParseIP(host)
-			if ip == nil {
-				log.Printf("remote address '%s' is not valid", host)
+			if !ok {
+				if forgetIPs {
+					log.Printf("%s is not valid", header)
+				} else {
+					log.Printf("%s '%s' is not valid", header, value)
+				}
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
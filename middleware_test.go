@@ -0,0 +1,182 @@
+package sheepcount
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPAddress(t *testing.T) {
+	trustedProxies, err := parseNetworks([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr    string
+		xForwardedFor string
+		ip            string
+	}{
+		{"203.0.113.7:1234", "", "203.0.113.7"},
+		{"203.0.113.7:1234", "198.51.100.1", "203.0.113.7"},                   // Untrusted peer
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},                     // Trusted peer
+		{"10.0.0.1:1234", "1.1.1.1, 198.51.100.1, 192.0.2.1", "198.51.100.1"}, // Skip trusted hops only
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},                   // All trusted
+		{"[2001:db8::1]:1234", "", "2001:db8::1"},
+		{"[::ffff:203.0.113.7]:1234", "", "203.0.113.7"},                // IPv4-mapped
+		{"10.0.0.1:1234", "[2001:db8::2]:443, 10.0.0.2", "2001:db8::2"}, // Hop with a port
+	}
+
+	for _, test := range tests {
+		var ip string
+		handler := ipAddress(false, trustedProxies, false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip = r.RemoteAddr
+		}))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.xForwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", test.xForwardedFor)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		assert.Equal(t, test.ip, ip, test)
+	}
+
+	// A proxy that adds its hop as another line does not let the client pick its address in the first
+	for _, header := range []string{"X-Forwarded-For", "Forwarded"} {
+		var ip string
+		handler := ipAddress(false, trustedProxies, false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip = r.RemoteAddr
+		}))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		if header == "Forwarded" {
+			r.Header.Add(header, "for=203.0.113.66")
+			r.Header.Add(header, "for=198.51.100.1")
+		} else {
+			r.Header.Add(header, "203.0.113.66")
+			r.Header.Add(header, "198.51.100.1")
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		assert.Equal(t, "198.51.100.1", ip, header)
+	}
+}
+
+func TestReverseProxyHeaders(t *testing.T) {
+	trustedProxies, err := parseNetworks([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		trustedProxies []*net.IPNet
+		headers        map[string]string
+		ip             string
+	}{
+		{nil, map[string]string{}, "127.0.0.1"},
+		{nil, map[string]string{"X-Real-IP": "198.51.100.1", "X-Forwarded-For": "203.0.113.7"}, "198.51.100.1"},
+		{nil, map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1"}, "198.51.100.1"}, // Caddy and Traefik
+		{nil, map[string]string{"Forwarded": `for=1.1.1.1, for="198.51.100.1:4711";proto=https`}, "198.51.100.1"},
+		{trustedProxies, map[string]string{"Forwarded": `For="[2001:db8::1]:4711", for=10.0.0.2`, "X-Forwarded-For": "203.0.113.7"}, "2001:db8::1"},
+		{trustedProxies, map[string]string{"X-Real-IP": "203.0.113.7", "X-Forwarded-For": "198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{trustedProxies, map[string]string{"Forwarded": "for=unknown"}, "127.0.0.1"},
+		{trustedProxies, map[string]string{"Forwarded": `for="_hidden:4711"`}, "127.0.0.1"},
+		{trustedProxies, map[string]string{"Forwarded": "for=198.51.100.1, for=unknown, for=10.0.0.2"}, "10.0.0.2"},
+		{trustedProxies, map[string]string{"X-Forwarded-For": "198.51.100.1, unknown, 10.0.0.2"}, "10.0.0.2"},
+		{nil, map[string]string{"Forwarded": "proto=https"}, ""}, // Invalid
+	}
+
+	for _, test := range tests {
+		var ip string
+		handler := ipAddress(true, test.trustedProxies, false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip = r.RemoteAddr
+		}))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if test.ip == "" {
+			assert.Equal(t, http.StatusInternalServerError, w.Code, test)
+		} else {
+			assert.Equal(t, test.ip, ip, test)
+		}
+	}
+}
+
+func TestParseIP(t *testing.T) {
+	tests := []struct {
+		addr string
+		ip   string
+	}{
+		{"203.0.113.7", "203.0.113.7"},
+		{"203.0.113.7:1234", "203.0.113.7"},
+		{" 203.0.113.7 ", "203.0.113.7"},
+		{"::ffff:203.0.113.7", "203.0.113.7"},
+		{"[::ffff:203.0.113.7]:1234", "203.0.113.7"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:db8::1]:1234", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"[fe80::1%eth0]:1234", "fe80::1"},
+	}
+
+	for _, test := range tests {
+		ip := parseIP(test.addr)
+		if assert.NotNil(t, ip, test.addr) {
+			assert.Equal(t, test.ip, ip.String(), test.addr)
+		}
+	}
+
+	// Mapped addresses are the same length as IPv4 ones, so that they match IPv4 ranges
+	assert.Len(t, parseIP("::ffff:203.0.113.7"), net.IPv4len)
+
+	assert.Nil(t, parseIP(""))
+	assert.Nil(t, parseIP("example.com:80"))
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	assert.Equal(t, "203.0.113.0", anonymizeIP(parseIP("203.0.113.7")).String())
+	assert.Equal(t, "203.0.113.0", anonymizeIP(parseIP("::ffff:203.0.113.7")).String())
+	assert.Equal(t, "2001:db8:cafe::", anonymizeIP(parseIP("2001:db8:cafe:17::1")).String())
+
+	sheepcount := &SheepCount{Config: DefaultConfig()}
+	r := httptest.NewRequest(http.MethodPost, "/event", nil)
+	r.RemoteAddr = "203.0.113.7"
+	assert.Equal(t, "203.0.113.7", sheepcount.visitorIP(r).String())
+	sheepcount.AnonymizeIPs = true
+	assert.Equal(t, "203.0.113.0", sheepcount.visitorIP(r).String())
+
+	r.RemoteAddr = ""
+	assert.Nil(t, sheepcount.visitorIP(r))
+}
+
+func TestIgnoreLocalNetworks(t *testing.T) {
+	rules, err := (&IgnoreConfig{LocalNetworks: true}).compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "100.64.0.1", "::ffff:192.168.1.1", "::1", "fd00::1", "fe80::1%eth0"} {
+		assert.True(t, rules.ignoreIP(parseIP(addr)), addr)
+	}
+	for _, addr := range []string{"203.0.113.7", "100.128.0.1", "172.32.0.1", "2001:db8::1"} {
+		assert.False(t, rules.ignoreIP(parseIP(addr)), addr)
+	}
+
+	rules, err = (&IgnoreConfig{}).compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, rules.ignoreIP(parseIP("192.168.1.1")))
+}
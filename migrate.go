@@ -0,0 +1,144 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrations live in db/migrations and are named NNNN_description.sql. They are applied in order and
+// the number of the last migration applied is stored in the database's user_version.
+type migration struct {
+	version int
+	name    string
+	path    string
+}
+
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, "db/migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+
+		prefix := strings.SplitN(name, "_", 2)[0]
+		version, err := strconv.Atoi(strings.TrimSuffix(prefix, ".sql"))
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration name: %s", name)
+		}
+
+		migrations = append(migrations, migration{
+			version: version,
+			name:    name,
+			path:    path.Join("db", "migrations", name),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+
+	// Migrations must be numbered 1, 2, 3, ... with no gaps or duplicates
+	for i, migration := range migrations {
+		if migration.version != i+1 {
+			return nil, fmt.Errorf("migration %s is out of sequence: expected version %d", migration.name, i+1)
+		}
+	}
+
+	return migrations, nil
+}
+
+// Apply any pending migrations in a single transaction. Refuse to touch a database with a schema
+// that is newer than the migrations we know about.
+func dbMigrate(ctx context.Context, db *sql.DB) error {
+	migrations, err := loadMigrations(contentFs)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// See the comment in HitWriter.WriteBatch
+	if _, err := tx.ExecContext(ctx, "ROLLBACK; BEGIN IMMEDIATE"); err != nil {
+		return err
+	}
+
+	var version int
+	if err := tx.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than the latest supported version %d", version, len(migrations))
+	}
+
+	if version == len(migrations) {
+		return nil
+	}
+
+	if version == 0 {
+		legacy, err := dbLegacySchema(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if legacy {
+			contents, err := fs.ReadFile(contentFs, "db/legacy.sql")
+			if err != nil {
+				return err
+			}
+
+			if _, err := tx.ExecContext(ctx, string(contents)); err != nil {
+				return fmt.Errorf("upgrade from schema.sql failed: %w", err)
+			}
+
+			log.Print("Upgraded database created by schema.sql")
+		}
+	}
+
+	for _, migration := range migrations[version:] {
+		contents, err := fs.ReadFile(contentFs, migration.path)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, string(contents)); err != nil {
+			return fmt.Errorf("migration %s failed: %w", migration.name, err)
+		}
+
+		log.Printf("Applied database migration %s", migration.name)
+	}
+
+	// PRAGMA does not support bound parameters
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", len(migrations))); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Whether the database was created by schema.sql, before there were migrations. Its user_version is
+// 0 like an empty database, but it has tables, and the domain of each path is in paths. The
+// migrations cannot be applied to it as they are, as 0001_initial.sql would keep the old tables.
+func dbLegacySchema(ctx context.Context, tx *sql.Tx) (bool, error) {
+	var n int
+	row := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info('paths') WHERE name = 'domain'")
+	if err := row.Scan(&n); err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
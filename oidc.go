@@ -0,0 +1,649 @@
+package sheepcount
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// Logging in to the dashboard with an OpenID Connect provider, such as a single sign-on service, as
+// well as with passwords. Everyone who logs in this way gets an account named after their email
+// address, whose role and sites come from the first access rule that they match.
+type OIDCConfig struct {
+	Issuer       string       `toml:"issuer"` // Empty disables it
+	ClientID     string       `toml:"client_id"`
+	ClientSecret string       `toml:"client_secret"`
+	RedirectURL  string       `toml:"redirect_url"` // If empty, /login/oidc/callback on the hostname
+	Scopes       []string     `toml:"scopes"`       // Asked for on top of openid and email, such as groups
+	GroupsClaim  string       `toml:"groups_claim"` // The claim of the ID token that lists the groups
+	Access       []OIDCAccess `toml:"access"`
+
+	// Count email addresses as verified when the ID token does not say whether they are, for
+	// providers that only give verified ones. Otherwise the email rules only match addresses whose
+	// email_verified claim is true.
+	TrustUnverifiedEmails bool `toml:"trust_unverified_emails"`
+}
+
+// Who can log in with the provider, by their verified email address or group. An email address
+// that starts with @ matches the whole domain.
+type OIDCAccess struct {
+	Emails []string `toml:"emails"`
+	Groups []string `toml:"groups"`
+	Role   string   `toml:"role"`  // viewer if empty
+	Sites  []string `toml:"sites"` // The only sites that can be seen, or all of them if empty
+}
+
+func (config *OIDCConfig) Enabled() bool {
+	return config.Issuer != ""
+}
+
+func (config *OIDCConfig) validate() error {
+	if !config.Enabled() {
+		return nil
+	}
+	if u, err := url.Parse(config.Issuer); err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid oidc issuer: %s", config.Issuer)
+	}
+	if config.ClientID == "" {
+		return errors.New("oidc client_id must be set")
+	}
+	if config.RedirectURL != "" {
+		if u, err := url.Parse(config.RedirectURL); err != nil || !u.IsAbs() {
+			return fmt.Errorf("invalid oidc redirect_url: %s", config.RedirectURL)
+		}
+	}
+	if len(config.Access) == 0 {
+		return errors.New("oidc access must not be empty, or no one can log in")
+	}
+	for _, access := range config.Access {
+		if access.Role != "" && !validRole(access.Role) {
+			return fmt.Errorf("oidc access role must be %s or %s, not %s", roleAdmin, roleViewer, access.Role)
+		}
+		if len(access.Emails) == 0 && len(access.Groups) == 0 {
+			return errors.New("oidc access rules need emails or groups")
+		}
+	}
+	return nil
+}
+
+// The claims of an ID token that Sheep Count uses.
+type oidcClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      json.RawMessage `json:"aud"` // A string or an array of them
+	Expiry        int64           `json:"exp"`
+	Nonce         string          `json:"nonce"`
+	Email         string          `json:"email"`
+	EmailVerified *bool           `json:"email_verified"`
+	Groups        []string        `json:"-"`
+}
+
+func (claims *oidcClaims) hasAudience(clientID string) bool {
+	var audience []string
+	if err := json.Unmarshal(claims.Audience, &audience); err != nil {
+		var single string
+		if err := json.Unmarshal(claims.Audience, &single); err != nil {
+			return false
+		}
+		audience = []string{single}
+	}
+	for _, a := range audience {
+		if a == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// The first access rule that the claims match, or nil if they match none. Email addresses only count
+// once the provider has verified them.
+func (config *OIDCConfig) access(claims *oidcClaims) *OIDCAccess {
+	email := strings.ToLower(claims.Email)
+	if claims.EmailVerified == nil && !config.TrustUnverifiedEmails || claims.EmailVerified != nil && !*claims.EmailVerified {
+		email = ""
+	}
+
+	for i := range config.Access {
+		access := &config.Access[i]
+		for _, allowed := range access.Emails {
+			allowed = strings.ToLower(allowed)
+			if email != "" && (email == allowed || (strings.HasPrefix(allowed, "@") && strings.HasSuffix(email, allowed))) {
+				return access
+			}
+		}
+		for _, allowed := range access.Groups {
+			for _, group := range claims.Groups {
+				if group == allowed {
+					return access
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// The endpoints of the provider, from its discovery document.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// A client of the provider, which fetches its endpoints and signing keys when first needed.
+type oidcProvider struct {
+	config *OIDCConfig
+	client *retryablehttp.Client
+
+	sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+}
+
+func newOIDCProvider(config *OIDCConfig) *oidcProvider {
+	return &oidcProvider{config: config, client: newClient()}
+}
+
+func (provider *oidcProvider) getJSON(ctx context.Context, u string, value interface{}) error {
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "SheepCount")
+
+	resp, err := provider.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(value)
+}
+
+func (provider *oidcProvider) endpoints(ctx context.Context) (*oidcDiscovery, error) {
+	provider.Lock()
+	defer provider.Unlock()
+
+	if provider.discovery != nil {
+		return provider.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := provider.getJSON(ctx, strings.TrimSuffix(provider.config.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != provider.config.Issuer {
+		return nil, fmt.Errorf("the provider says that its issuer is %s, not %s", discovery.Issuer, provider.config.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("the discovery document of the provider is missing endpoints")
+	}
+
+	provider.discovery = &discovery
+	return provider.discovery, nil
+}
+
+// A JSON web key, of which only RSA and P-256 keys are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (key *jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch key.Kty {
+	case "RSA":
+		n, err := decode(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(key.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if key.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", key.Crv)
+		}
+		x, err := decode(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", key.Kty)
+	}
+}
+
+// The signing key with the ID. The keys are fetched again if it is not known, as providers rotate them.
+func (provider *oidcProvider) key(ctx context.Context, jwksURI string, kid string) (crypto.PublicKey, error) {
+	provider.Lock()
+	defer provider.Unlock()
+
+	if key, ok := provider.keys[kid]; ok {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := provider.getJSON(ctx, jwksURI, &set); err != nil {
+		return nil, err
+	}
+
+	provider.keys = make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		provider.keys[k.Kid] = key
+	}
+
+	if key, ok := provider.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// Check the signature and claims of an ID token.
+func (provider *oidcProvider) verify(ctx context.Context, idToken string, nonce string, now time.Time) (*oidcClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	discovery, err := provider.endpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key, err := provider.key(ctx, discovery.JWKSURI, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errors.New("invalid ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return nil, errors.New("invalid ID token signature")
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return nil, errors.New("invalid ID token signature")
+		}
+	default:
+		return nil, errors.New("unsupported key")
+	}
+
+	var claims oidcClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	// Allow for clocks that are a little out
+	const skew = time.Minute
+	switch {
+	case claims.Issuer != discovery.Issuer:
+		return nil, fmt.Errorf("ID token is from %s", claims.Issuer)
+	case !claims.hasAudience(provider.config.ClientID):
+		return nil, errors.New("ID token is for another client")
+	case now.Add(-skew).Unix() >= claims.Expiry:
+		return nil, errors.New("ID token has expired")
+	case claims.Nonce != nonce:
+		return nil, errors.New("ID token has the wrong nonce")
+	case claims.Subject == "":
+		return nil, errors.New("ID token has no subject")
+	}
+
+	groupsClaim := provider.config.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	var other map[string]json.RawMessage
+	if err := decodeJWTPart(parts[1], &other); err != nil {
+		return nil, err
+	}
+	if groups, ok := other[groupsClaim]; ok {
+		// Ignore groups in other formats, as they cannot be matched anyway
+		json.Unmarshal(groups, &claims.Groups)
+	}
+
+	return &claims, nil
+}
+
+func decodeJWTPart(part string, value interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, value)
+}
+
+// Swap the authorization code for an ID token.
+func (provider *oidcProvider) exchange(ctx context.Context, code string, redirectURL string, verifier string) (string, error) {
+	discovery, err := provider.endpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("code_verifier", verifier)
+
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "SheepCount")
+	req.SetBasicAuth(url.QueryEscape(provider.config.ClientID), url.QueryEscape(provider.config.ClientSecret))
+
+	resp, err := provider.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s: %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token endpoint returned no ID token")
+	}
+
+	return body.IDToken, nil
+}
+
+// The account for someone who logged in with the provider, which is created the first time and given
+// the role and sites of their access rule every time.
+func dbOIDCAccount(ctx context.Context, db *sql.DB, subject string, name string, access *OIDCAccess) (*account, error) {
+	role := access.Role
+	if role == "" {
+		role = roleViewer
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Accounts without a password hash cannot be logged in to with a password
+	var id int64
+	err = tx.QueryRowContext(
+		ctx,
+		`INSERT INTO users_admin (name, password_hash, password_salt, role, oidc_subject) VALUES (?, '', '', ?, ?)
+		ON CONFLICT (oidc_subject) WHERE oidc_subject IS NOT NULL DO UPDATE SET name = excluded.name, role = excluded.role
+		RETURNING account_id`,
+		name, role, subject,
+	).Scan(&id)
+	if isConstraintError(err) {
+		return nil, fmt.Errorf("an account called %s already exists", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM users_admin_sites WHERE account_id = ?", id); err != nil {
+		return nil, err
+	}
+	for _, site := range access.Sites {
+		_, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO users_admin_sites (account_id, domain) VALUES (?, ?)", id, strings.ToLower(site))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return dbAccount(ctx, db, id)
+}
+
+const oidcCookieName = "oidc"
+
+// How long there is to log in with the provider
+const oidcTimeout = 10 * time.Minute
+
+// Remembers the login with the provider between the redirect to it and the callback from it.
+type oidcCookie struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"` // For PKCE
+	Since    int64  `json:"t"`
+}
+
+func (sheepcount *SheepCount) oidcRedirectURL(r *http.Request) string {
+	if sheepcount.OIDC.RedirectURL != "" {
+		return sheepcount.OIDC.RedirectURL
+	}
+
+	scheme := "http"
+	if r.TLS != nil || sheepcount.TLS.Enabled() || sheepcount.listenerOptions(r).reverseProxy {
+		scheme = "https"
+	}
+	return scheme + "://" + sheepcount.getHost(r) + "/login/oidc/callback"
+}
+
+func (sheepcount *SheepCount) setOIDCCookie(w http.ResponseWriter, r *http.Request, value oidcCookie, maxAge int) error {
+	encoded, err := sheepcount.cookieCodec().Encode(oidcCookieName, value)
+	if err != nil {
+		return err
+	}
+
+	// The callback is a redirect from the provider, which strict cookies would not be sent with
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    encoded,
+		Path:     "/login/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   sheepcount.TLS.Enabled() || sheepcount.listenerOptions(r).reverseProxy,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// Send the browser to the provider to log in.
+func handleOIDCLogin(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	if sheepcount.oidc == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	discovery, err := sheepcount.oidc.endpoints(r.Context())
+	if err != nil {
+		log.Printf("Cannot reach the OpenID Connect provider: %s", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	var flow oidcCookie
+	for _, value := range []*string{&flow.State, &flow.Nonce, &flow.Verifier} {
+		if *value, err = randomHex(32); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	flow.Since = time.Now().Unix()
+
+	if err := sheepcount.setOIDCCookie(w, r, flow, int(oidcTimeout/time.Second)); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(flow.Verifier))
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", sheepcount.OIDC.ClientID)
+	query.Set("redirect_uri", sheepcount.oidcRedirectURL(r))
+	query.Set("scope", strings.Join(append([]string{"openid", "email"}, sheepcount.OIDC.Scopes...), " "))
+	query.Set("state", flow.State)
+	query.Set("nonce", flow.Nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, discovery.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// Where the provider sends the browser back to after logging in.
+func handleOIDCCallback(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	if sheepcount.oidc == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The flow can only be finished once
+	var flow oidcCookie
+	if cookie, err := r.Cookie(oidcCookieName); err == nil {
+		sheepcount.cookieCodec().Decode(oidcCookieName, cookie.Value, &flow)
+	}
+	if err := sheepcount.setOIDCCookie(w, r, oidcCookie{}, -1); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	value, err := sheepcount.oidcLogin(r, flow)
+	if err != nil {
+		log.Printf("Cannot log in with OpenID Connect: %s", err)
+		value = authCookie{SSOFailed: true}
+	}
+
+	if err := sheepcount.setAuthCookie(w, r, value); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// The auth cookie for the callback from the provider, which has access denied if no access rule matches.
+func (sheepcount *SheepCount) oidcLogin(r *http.Request, flow oidcCookie) (authCookie, error) {
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		return authCookie{}, fmt.Errorf("the provider returned %s %s", e, query.Get("error_description"))
+	}
+	if flow.State == "" || time.Since(time.Unix(flow.Since, 0)) > oidcTimeout {
+		return authCookie{}, errors.New("the login has expired")
+	}
+	if query.Get("state") != flow.State {
+		return authCookie{}, errors.New("the state does not match")
+	}
+
+	idToken, err := sheepcount.oidc.exchange(r.Context(), query.Get("code"), sheepcount.oidcRedirectURL(r), flow.Verifier)
+	if err != nil {
+		return authCookie{}, err
+	}
+
+	claims, err := sheepcount.oidc.verify(r.Context(), idToken, flow.Nonce, time.Now())
+	if err != nil {
+		return authCookie{}, err
+	}
+
+	access := sheepcount.OIDC.access(claims)
+	if access == nil {
+		log.Printf("No OpenID Connect access rule matches %s (%s)", claims.Subject, claims.Email)
+		return authCookie{AccessDenied: true}, nil
+	}
+
+	name := claims.Email
+	if name == "" {
+		name = claims.Subject
+	}
+	account, err := dbOIDCAccount(r.Context(), sheepcount.db, claims.Subject, strings.ToLower(name), access)
+	if err != nil {
+		return authCookie{}, err
+	}
+
+	return sheepcount.startSession(r.Context(), account.Id, account.Generation)
+}
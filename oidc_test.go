@@ -0,0 +1,252 @@
+package sheepcount
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A provider that logs in whoever the test says, with ID tokens signed by an RSA key.
+type testOIDCProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+	nonce  string
+}
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	provider := &testOIDCProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 provider.URL,
+			"authorization_endpoint": provider.URL + "/authorize",
+			"token_endpoint":         provider.URL + "/token",
+			"jwks_uri":               provider.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "sheepcount" || secret != "secret" || r.PostFormValue("code") != "code" || r.PostFormValue("code_verifier") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		claims := map[string]interface{}{
+			"iss":   provider.URL,
+			"aud":   "sheepcount",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": provider.nonce,
+		}
+		for k, v := range provider.claims {
+			claims[k] = v
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": provider.sign(t, claims)})
+	})
+	provider.Server = httptest.NewServer(mux)
+
+	return provider
+}
+
+func (provider *testOIDCProvider) sign(t *testing.T, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, provider.key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDC(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	provider := newTestOIDCProvider(t)
+	defer provider.Close()
+
+	config := DefaultConfig()
+	config.CookieKey = "0123456789abcdef0123456789abcdef"
+	config.OIDC = OIDCConfig{
+		Issuer:       provider.URL,
+		ClientID:     "sheepcount",
+		ClientSecret: "secret",
+		Access: []OIDCAccess{
+			{Groups: []string{"analytics"}, Role: roleAdmin},
+			{Emails: []string{"@example.com"}, Sites: []string{"example.com"}},
+		},
+	}
+	sheepcount := &SheepCount{db: db, Config: config}
+	sheepcount.oidc = newOIDCProvider(&sheepcount.OIDC)
+
+	// Log in with the provider, returning the session
+	login := func(claims map[string]interface{}, state string) authCookie {
+		w := httptest.NewRecorder()
+		handleOIDCLogin(sheepcount, w, httptest.NewRequest(http.MethodGet, "http://stats.example.com/login/oidc", nil))
+		require.Equal(t, http.StatusFound, w.Code)
+
+		location, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, provider.URL+"/authorize", location.Scheme+"://"+location.Host+location.Path)
+		query := location.Query()
+		assert.Equal(t, "http://stats.example.com/login/oidc/callback", query.Get("redirect_uri"))
+		assert.Equal(t, "S256", query.Get("code_challenge_method"))
+		provider.nonce = query.Get("nonce")
+		provider.claims = claims
+		if state == "" {
+			state = query.Get("state")
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "http://stats.example.com/login/oidc/callback?code=code&state="+state, nil)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		w = httptest.NewRecorder()
+		handleOIDCCallback(sheepcount, w, r)
+		require.Equal(t, http.StatusFound, w.Code)
+
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, c := range w.Result().Cookies() {
+			if c.Name == authCookieName {
+				r.AddCookie(c)
+			}
+		}
+		return sheepcount.getAuthCookie(r)
+	}
+
+	session := func(token authCookie) *account {
+		encoded, err := sheepcount.cookieCodec().Encode(authCookieName, token)
+		require.NoError(t, err)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: authCookieName, Value: encoded})
+		return sheepcount.session(r)
+	}
+
+	// The first matching rule gives the role and sites of the account
+	token := login(map[string]interface{}{"sub": "1", "email": "Alice@example.com", "email_verified": true}, "")
+	assert.True(t, token.LoggedIn)
+	if account := session(token); assert.NotNil(t, account) {
+		assert.Equal(t, "alice@example.com", account.Name)
+		assert.Equal(t, roleViewer, account.Role)
+		assert.Equal(t, []string{"example.com"}, account.Sites)
+	}
+
+	// Which is updated the next time they log in
+	token = login(map[string]interface{}{"sub": "1", "email": "alice@example.com", "groups": []string{"analytics"}}, "")
+	if account := session(token); assert.NotNil(t, account) {
+		assert.Equal(t, roleAdmin, account.Role)
+		assert.Empty(t, account.Sites)
+	}
+
+	var accounts int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM users_admin").Scan(&accounts))
+	assert.Equal(t, 1, accounts)
+
+	// Unverified email addresses do not count
+	token = login(map[string]interface{}{"sub": "2", "email": "bob@example.com", "email_verified": false}, "")
+	assert.False(t, token.LoggedIn)
+	assert.True(t, token.AccessDenied)
+
+	token = login(map[string]interface{}{"sub": "3", "email": "carol@example.org"}, "")
+	assert.True(t, token.AccessDenied)
+
+	// Nor do those that the provider does not say are verified, unless it is trusted to only give
+	// verified ones
+	token = login(map[string]interface{}{"sub": "4", "email": "dave@example.com"}, "")
+	assert.False(t, token.LoggedIn)
+	assert.True(t, token.AccessDenied)
+
+	sheepcount.OIDC.TrustUnverifiedEmails = true
+	token = login(map[string]interface{}{"sub": "4", "email": "dave@example.com"}, "")
+	assert.True(t, token.LoggedIn)
+	token = login(map[string]interface{}{"sub": "2", "email": "bob@example.com", "email_verified": false}, "")
+	assert.True(t, token.AccessDenied)
+	sheepcount.OIDC.TrustUnverifiedEmails = false
+
+	// Nor can the callback be forged
+	token = login(map[string]interface{}{"sub": "1", "email": "alice@example.com"}, "forged")
+	assert.False(t, token.LoggedIn)
+	assert.True(t, token.SSOFailed)
+
+	// The accounts cannot be logged in to with a password
+	_, err = dbLogin(context.Background(), db, "alice@example.com", "")
+	assert.Equal(t, ErrInvalidLogin, err)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	provider := newTestOIDCProvider(t)
+	defer provider.Close()
+
+	oidc := newOIDCProvider(&OIDCConfig{Issuer: provider.URL, ClientID: "sheepcount"})
+	ctx := context.Background()
+	now := time.Now()
+
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   provider.URL,
+			"sub":   "1",
+			"aud":   []string{"other", "sheepcount"},
+			"exp":   now.Add(time.Hour).Unix(),
+			"nonce": "nonce",
+		}
+		for k, v := range changes {
+			c[k] = v
+		}
+		return c
+	}
+
+	_, err := oidc.verify(ctx, provider.sign(t, claims(nil)), "nonce", now)
+	assert.NoError(t, err)
+
+	for name, changes := range map[string]map[string]interface{}{
+		"issuer":   {"iss": "https://evil.example.com"},
+		"audience": {"aud": "other"},
+		"expired":  {"exp": now.Add(-time.Hour).Unix()},
+		"nonce":    {"nonce": "replayed"},
+	} {
+		_, err := oidc.verify(ctx, provider.sign(t, claims(changes)), "nonce", now)
+		assert.Error(t, err, name)
+	}
+
+	// Tampering breaks the signature
+	parts := strings.Split(provider.sign(t, claims(nil)), ".")
+	payload, err := json.Marshal(claims(map[string]interface{}{"sub": "2"}))
+	require.NoError(t, err)
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	_, err = oidc.verify(ctx, strings.Join(parts, "."), "nonce", now)
+	assert.Error(t, err)
+}
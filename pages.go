@@ -1,26 +1,57 @@
-package main
+package sheepcount
 
 import (
+	"context"
 	"crypto/subtle"
-	"encoding/hex"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/gorilla/securecookie"
-	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/blake2b"
 )
 
 const authCookieName = "auth"
 
 type authCookie struct {
-	LoggedIn        bool `json:"l"`
-	InvalidPassword bool `json:"msg_invalid_password,omitempty"`
-	JustLoggedOut   bool `json:"msg_logged_out,omitempty"`
+	LoggedIn        bool   `json:"l"`
+	Account         int64  `json:"a,omitempty"` // Zero for the shared password
+	Generation      int64  `json:"g,omitempty"` // Of the password of the account
+	Session         string `json:"s,omitempty"` // The ID of the session on the server
+	InvalidPassword bool   `json:"msg_invalid_password,omitempty"`
+	InvalidCode     bool   `json:"msg_invalid_code,omitempty"`
+	AccessDenied    bool   `json:"msg_access_denied,omitempty"`
+	SSOFailed       bool   `json:"msg_sso_failed,omitempty"`
+	JustLoggedOut   bool   `json:"msg_logged_out,omitempty"`
+
+	// The account whose password has been entered, waiting for its second factor, and when
+	Pending      int64 `json:"p,omitempty"`
+	PendingSince int64 `json:"ps,omitempty"`
 }
 
-func getAuthCookie(r *http.Request, key string) authCookie {
+// The keys that sign and encrypt the auth cookie. AES needs a key of 32 bytes, so the encryption key
+// is hashed.
+func (config *Config) cookieKeys() ([]byte, []byte) {
+	encryptionKey := config.CookieEncryptionKey
+	if encryptionKey == "" {
+		encryptionKey = "encryption:" + config.CookieKey
+	}
+	blockKey := blake2b.Sum256([]byte(encryptionKey))
+	return []byte(config.CookieKey), blockKey[:]
+}
+
+// The auth cookie is signed and encrypted, and it is rejected once the session lifetime has passed
+// since it was set.
+func (sheepcount *SheepCount) cookieCodec() *securecookie.SecureCookie {
+	sc := securecookie.New(sheepcount.cookieKeys())
+	sc.SetSerializer(securecookie.JSONEncoder{})
+	sc.MaxAge(int(sheepcount.SessionLifetime / time.Second))
+	return sc
+}
+
+func (sheepcount *SheepCount) getAuthCookie(r *http.Request) authCookie {
 	var value authCookie
 
 	cookie, err := r.Cookie(authCookieName)
@@ -28,16 +59,61 @@ func getAuthCookie(r *http.Request, key string) authCookie {
 		return value
 	}
 
-	sc := securecookie.New([]byte(key), nil)
-	sc.SetSerializer(securecookie.JSONEncoder{})
-
-	if err := sc.Decode(authCookieName, cookie.Value, &value); err != nil {
+	if err := sheepcount.cookieCodec().Decode(authCookieName, cookie.Value, &value); err != nil {
 		return value
 	}
 
 	return value
 }
 
+func (sheepcount *SheepCount) setAuthCookie(w http.ResponseWriter, r *http.Request, value authCookie) error {
+	encoded, err := sheepcount.cookieCodec().Encode(authCookieName, value)
+	if err != nil {
+		return err
+	}
+
+	cookie := http.Cookie{
+		Name:     authCookieName,
+		Value:    encoded,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   sheepcount.TLS.Enabled() || sheepcount.listenerOptions(r).reverseProxy,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if sheepcount.CookieSameSite == "strict" {
+		cookie.SameSite = http.SameSiteStrictMode
+	}
+	// Only sessions outlast the browser, as the other cookies are just for flash messages and logging in
+	if value.LoggedIn {
+		cookie.MaxAge = int(sheepcount.SessionLifetime / time.Second)
+	}
+
+	http.SetCookie(w, &cookie)
+	return nil
+}
+
+// The configured domains followed by any other sites that have been visited, such as localhost, of
+// those that the account can see.
+func (sheepcount *SheepCount) sites(ctx context.Context, account *account) ([]string, error) {
+	visited, err := dbSites(ctx, sheepcount.db)
+	if err != nil {
+		return nil, err
+	}
+
+	sites := make([]string, 0, len(sheepcount.Domains)+len(visited))
+	seen := make(map[string]bool)
+	for _, domains := range [][]string{sheepcount.Domains, visited} {
+		for _, site := range domains {
+			if !seen[site] && account.canSee(site) {
+				seen[site] = true
+				sites = append(sites, site)
+			}
+		}
+	}
+
+	return sites, nil
+}
+
 func handleHome(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
 	if !(r.URL.Path == "/" || r.URL.Path == "/index.html") {
 		w.WriteHeader(http.StatusNotFound)
@@ -49,48 +125,71 @@ func handleHome(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	token := getAuthCookie(r, sheepcount.CookieKey)
+	token := sheepcount.getAuthCookie(r)
 
 	w.Header().Add("Content-Type", "text/html; charset=UTF-8")
 
-	if token.LoggedIn {
-		if err := sheepcount.tmpl.ExecuteTemplate(w, "app.html.tmpl", nil); err != nil {
+	if account := sheepcount.session(r); account != nil {
+		sites, err := sheepcount.sites(r.Context(), account)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// Show the first site unless another has been selected
+		site := r.URL.Query().Get("site")
+		if (site == "" || !account.canSee(site)) && len(sites) > 0 {
+			site = sites[0]
+		}
+
+		params := struct {
+			Sites []string
+			Site  string
+		}{
+			Sites: sites,
+			Site:  site,
+		}
+		if err := sheepcount.tmpl.ExecuteTemplate(w, "app.html.tmpl", params); err != nil {
 			log.Print(err)
 		}
 		return
 	}
 
 	// Rudimentary flash message - just show once
-	if token.InvalidPassword || token.JustLoggedOut {
+	secondFactor := token.pendingSecondFactor(time.Now())
+	if token.InvalidPassword || token.InvalidCode || token.AccessDenied || token.SSOFailed || token.JustLoggedOut {
 		var token authCookie
+		if secondFactor {
+			token = authCookie{Pending: token.Pending, Generation: token.Generation, PendingSince: token.PendingSince}
+		}
 
-		sc := securecookie.New([]byte(sheepcount.CookieKey), nil)
-		sc.SetSerializer(securecookie.JSONEncoder{})
-
-		encoded, err := sc.Encode(authCookieName, token)
-		if err != nil {
+		if err := sheepcount.setAuthCookie(w, r, token); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-
-		cookie := http.Cookie{
-			Name:     authCookieName,
-			Value:    encoded,
-			Path:     "/",
-			HttpOnly: true,
-		}
-
-		http.SetCookie(w, &cookie)
 	}
 
 	params := struct {
 		ShowAbout       bool
+		SecondFactor    bool
 		InvalidPassword bool
+		InvalidCode     bool
+		AccessDenied    bool
+		SSOFailed       bool
 		JustLoggedOut   bool
+		SSO             bool
+		ScriptPath      string
 	}{
 		ShowAbout:       true,
+		SecondFactor:    secondFactor,
 		InvalidPassword: token.InvalidPassword,
+		InvalidCode:     token.InvalidCode,
+		AccessDenied:    token.AccessDenied,
+		SSOFailed:       token.SSOFailed,
+		SSO:             sheepcount.oidc != nil,
 		JustLoggedOut:   token.JustLoggedOut,
+		ScriptPath:      sheepcount.Endpoints.Script,
 	}
 	if err := sheepcount.tmpl.ExecuteTemplate(w, "home.html.tmpl", params); err != nil {
 		log.Print(err)
@@ -98,6 +197,62 @@ func handleHome(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// The world map of visitors, which drills down into regions and cities.
+func handleMap(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	handleSitePage(sheepcount, w, r, "/map", "map.html.tmpl")
+}
+
+// The custom events that sites send, which drills down into the pages they were sent from.
+func handleEvents(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	handleSitePage(sheepcount, w, r, "/events", "events.html.tmpl")
+}
+
+// A page of the dashboard about one site, the one in the site parameter, or else the first that the
+// account can see. The page runs its queries itself.
+func handleSitePage(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request, path string, name string) {
+	if r.URL.Path != path {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	account := sheepcount.session(r)
+	if account == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	site := r.URL.Query().Get("site")
+	if site == "" || !account.canSee(site) {
+		sites, err := sheepcount.sites(r.Context(), account)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if len(sites) == 0 {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		site = sites[0]
+	}
+
+	w.Header().Add("Content-Type", "text/html; charset=UTF-8")
+
+	params := struct {
+		Site string
+	}{
+		Site: site,
+	}
+	if err := sheepcount.tmpl.ExecuteTemplate(w, name, params); err != nil {
+		log.Print(err)
+	}
+}
+
 func handleLogin(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/login" {
 		w.WriteHeader(http.StatusNotFound)
@@ -109,55 +264,87 @@ func handleLogin(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// CSRF mitigation by checking origin
-
-	origin, err := url.Parse(r.Header.Get("Origin"))
-	if err != nil {
+	if !sheepcount.sameOrigin(r) {
 		w.WriteHeader(http.StatusBadRequest)
 		io.WriteString(w, "Invalid origin")
 		return
 	}
 
-	if origin.Host != sheepcount.getHost(r) {
+	if err := r.ParseForm(); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		io.WriteString(w, "Invalid origin")
 		return
 	}
 
-	if err := r.ParseForm(); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	value, err := sheepcount.login(r.Context(), r.Form.Get("name"), r.Form.Get("password"))
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := sheepcount.setAuthCookie(w, r, value); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	password := r.Form.Get("password")
-	key := hex.EncodeToString(argon2.IDKey([]byte(password), []byte(sheepcount.CookieKey), 1, 64*1024, 4, 32))
+	http.Redirect(w, r, "/", http.StatusFound)
+}
 
+// CSRF mitigation for forms and requests of the dashboard by checking their origin.
+func (sheepcount *SheepCount) sameOrigin(r *http.Request) bool {
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil {
+		return false
+	}
+	return origin.Host == sheepcount.getHost(r)
+}
+
+// Log in to an account, or with the shared password if there are no accounts yet.
+func (sheepcount *SheepCount) login(ctx context.Context, name string, password string) (authCookie, error) {
 	var value authCookie
 
-	if subtle.ConstantTimeCompare([]byte(key), []byte(sheepcount.Password)) == 1 {
-		value.LoggedIn = true
-	} else {
-		value.InvalidPassword = true
+	hasAccounts, err := dbHasAccounts(ctx, sheepcount.db)
+	if err != nil {
+		return value, err
 	}
 
-	sc := securecookie.New([]byte(sheepcount.CookieKey), nil)
-	sc.SetSerializer(securecookie.JSONEncoder{})
+	if !hasAccounts {
+		key := hashPassword(password, sheepcount.passwordSalt())
+		if sheepcount.Password != "" && subtle.ConstantTimeCompare([]byte(key), []byte(sheepcount.Password)) == 1 {
+			return sheepcount.startSession(ctx, 0, 0)
+		}
+		value.InvalidPassword = true
+		return value, nil
+	}
 
-	encoded, err := sc.Encode(authCookieName, value)
+	account, err := dbLogin(ctx, sheepcount.db, name, password)
+	if err == ErrInvalidLogin {
+		value.InvalidPassword = true
+		return value, nil
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return value, err
 	}
 
-	cookie := http.Cookie{
-		Name:     authCookieName,
-		Value:    encoded,
-		Path:     "/",
-		HttpOnly: true,
+	// Accounts with a second factor are not logged in until its code has been entered as well
+	if account.TwoFactor {
+		value.Pending = account.Id
+		value.Generation = account.Generation
+		value.PendingSince = time.Now().Unix()
+		return value, nil
 	}
 
-	http.SetCookie(w, &cookie)
-	http.Redirect(w, r, "/", http.StatusFound)
+	return sheepcount.startSession(ctx, account.Id, account.Generation)
+}
+
+// The cookie of a new session of the account, or of the shared password if the ID is zero.
+func (sheepcount *SheepCount) startSession(ctx context.Context, id int64, generation int64) (authCookie, error) {
+	session, err := dbCreateAdminSession(ctx, sheepcount.db, id, time.Now().Add(sheepcount.SessionLifetime))
+	if err != nil {
+		return authCookie{}, err
+	}
+
+	return authCookie{LoggedIn: true, Account: id, Generation: generation, Session: session}, nil
 }
 
 func handleLogout(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
@@ -171,27 +358,20 @@ func handleLogout(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	token := getAuthCookie(r, sheepcount.CookieKey)
+	token := sheepcount.getAuthCookie(r)
 
 	if token.LoggedIn {
-		sc := securecookie.New([]byte(sheepcount.CookieKey), nil)
-		sc.SetSerializer(securecookie.JSONEncoder{})
-
-		authCookie := authCookie{JustLoggedOut: true}
-
-		encoded, err := sc.Encode(authCookieName, authCookie)
-		if err != nil {
+		// End the session on the server too, in case the cookie has been copied
+		if err := dbEndAdminSession(r.Context(), sheepcount.db, token.Session); err != nil {
+			log.Print(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		cookie := http.Cookie{
-			Name:     authCookieName,
-			Value:    encoded,
-			Path:     "/",
-			HttpOnly: true,
+		if err := sheepcount.setAuthCookie(w, r, authCookie{JustLoggedOut: true}); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
-		http.SetCookie(w, &cookie)
 	}
 
 	http.Redirect(w, r, "/", http.StatusFound)
@@ -0,0 +1,363 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The hits of each month, in UTC, are kept in a table of their own, hits_YYYYMM, so that a month of
+// hits can be dropped all at once rather than deleted a row at a time, and so that queries of recent
+// hits, such as those of the aggregator, only read the recent months. The hits view unions every
+// month for the queries that can read any hit, and the empty hits_template table has the schema that
+// new months are created with. Migrations that change the schema of hits must change hits_template
+// and every month.
+type hitPartition struct {
+	table string
+	start int64 // The first second of the month
+	end   int64 // The first second of the next month
+}
+
+func newHitPartition(month time.Time) hitPartition {
+	start := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return hitPartition{
+		table: "hits_" + start.Format("200601"),
+		start: start.Unix(),
+		end:   start.AddDate(0, 1, 0).Unix(),
+	}
+}
+
+// The month that a hit at the timestamp is kept in.
+func hitPartitionOf(timestamp int64) hitPartition {
+	return newHitPartition(time.Unix(timestamp, 0).UTC())
+}
+
+func parseHitPartition(table string) (hitPartition, bool) {
+	if !strings.HasPrefix(table, "hits_") {
+		return hitPartition{}, false
+	}
+	month, err := time.Parse("200601", strings.TrimPrefix(table, "hits_"))
+	if err != nil {
+		return hitPartition{}, false
+	}
+	return newHitPartition(month), true
+}
+
+type queryExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// The months that have tables, in order.
+func dbHitPartitions(ctx context.Context, db queryExecer) ([]hitPartition, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'table' AND name GLOB 'hits_[0-9][0-9][0-9][0-9][0-9][0-9]' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var partitions []hitPartition
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		if partition, ok := parseHitPartition(table); ok {
+			partitions = append(partitions, partition)
+		}
+	}
+
+	return partitions, rows.Err()
+}
+
+var hitTemplateCreate = regexp.MustCompile(`^CREATE TABLE "?hits_template"?`)
+
+// Create the table of a month with the schema of hits_template. It is not in the hits view until
+// that is recreated.
+func dbCreateHitPartition(ctx context.Context, db queryExecer, partition hitPartition) error {
+	var schema string
+	if err := db.QueryRowContext(ctx, "SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'hits_template'").Scan(&schema); err != nil {
+		return fmt.Errorf("cannot find the schema of hits: %w", err)
+	}
+
+	create := hitTemplateCreate.ReplaceAllLiteralString(schema, "CREATE TABLE "+partition.table)
+	if create == schema {
+		return fmt.Errorf("unexpected schema of hits_template: %s", schema)
+	}
+
+	for _, query := range []string{
+		create,
+		fmt.Sprintf("CREATE INDEX %[1]s_timestamp ON %[1]s (timestamp)", partition.table),
+		fmt.Sprintf("CREATE INDEX %[1]s_site_timestamp ON %[1]s (site_id, timestamp)", partition.table),
+	} {
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("cannot create %s: %w", partition.table, err)
+		}
+	}
+
+	return nil
+}
+
+// Recreate the hits view with the months.
+func dbCreateHitsView(ctx context.Context, db queryExecer, partitions []hitPartition) error {
+	if _, err := db.ExecContext(ctx, "DROP VIEW IF EXISTS hits"); err != nil {
+		return err
+	}
+
+	_, err := db.ExecContext(ctx, "CREATE VIEW hits AS SELECT * FROM "+hitsUnion(partitions, 0))
+	return err
+}
+
+// Create the tables of the months of the timestamps that do not have one yet, returning every month.
+func dbEnsureHitPartitions(ctx context.Context, db queryExecer, timestamps []int64) ([]hitPartition, error) {
+	partitions, err := dbHitPartitions(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	exists := make(map[string]bool, len(partitions))
+	for _, partition := range partitions {
+		exists[partition.table] = true
+	}
+
+	created := false
+	for _, timestamp := range timestamps {
+		partition := hitPartitionOf(timestamp)
+		if exists[partition.table] {
+			continue
+		}
+		if err := dbCreateHitPartition(ctx, db, partition); err != nil {
+			return nil, err
+		}
+		exists[partition.table] = true
+		partitions = append(partitions, partition)
+		created = true
+	}
+
+	if created {
+		sort.Slice(partitions, func(i, j int) bool { return partitions[i].start < partitions[j].start })
+		if err := dbCreateHitsView(ctx, db, partitions); err != nil {
+			return nil, err
+		}
+	}
+
+	return partitions, nil
+}
+
+// The months that can have hits from the timestamp onwards, unioned together for a query to select
+// from instead of the hits view, so that the earlier months are not read at all.
+func hitsUnion(partitions []hitPartition, since int64) string {
+	tables := []string{"hits_template"}
+	for _, partition := range partitions {
+		if partition.end > since {
+			tables = append(tables, partition.table)
+		}
+	}
+
+	// hits_template is empty, so is only needed if there are no months
+	if len(tables) > 1 {
+		tables = tables[1:]
+	}
+	if len(tables) == 1 {
+		return tables[0]
+	}
+	return "(SELECT * FROM " + strings.Join(tables, " UNION ALL SELECT * FROM ") + ")"
+}
+
+// An SQL condition that the column, a timestamp, is in one of the months.
+func hitsMonths(column string, partitions []hitPartition) string {
+	if len(partitions) == 0 {
+		return "FALSE"
+	}
+
+	conditions := make([]string, len(partitions))
+	for i, partition := range partitions {
+		conditions[i] = fmt.Sprintf("(%s >= %d AND %s < %d)", column, partition.start, column, partition.end)
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")"
+}
+
+// Take the IDs of the next n hits, returning the first. They carry on from hit_ids, which is kept
+// when months are dropped, or from the largest ID in any month if that is larger, as hits can be
+// written to any of them. Finding the largest ID of each month is quick.
+func dbNextHitIds(ctx context.Context, db queryExecer, partitions []hitPartition, n int) (int64, error) {
+	maxima := []string{"SELECT last_hit_id AS hit_id FROM hit_ids", "SELECT MAX(hit_id) FROM hits_template"}
+	for _, partition := range partitions {
+		maxima = append(maxima, "SELECT MAX(hit_id) FROM "+partition.table)
+	}
+
+	var hitId int64
+	query := "SELECT COALESCE(MAX(hit_id), 0) + 1 FROM (" + strings.Join(maxima, " UNION ALL ") + ")"
+	if err := db.QueryRowContext(ctx, query).Scan(&hitId); err != nil {
+		return 0, err
+	}
+
+	if _, err := db.ExecContext(ctx, "UPDATE hit_ids SET last_hit_id = ?", hitId+int64(n)-1); err != nil {
+		return 0, err
+	}
+
+	return hitId, nil
+}
+
+// Run an UPDATE of hits, with %s in place of the table, on every month, returning how many hits
+// were updated. The table of each month is called hits in the query.
+func dbUpdateHits(ctx context.Context, db queryExecer, query string, args ...interface{}) (int64, error) {
+	partitions, err := dbHitPartitions(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	var updated int64
+	for _, partition := range partitions {
+		result, err := db.ExecContext(ctx, fmt.Sprintf(query, partition.table+" AS hits"), args...)
+		if err != nil {
+			return updated, fmt.Errorf("%s update error: %w", partition.table, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return updated, err
+		}
+		updated += n
+	}
+
+	return updated, nil
+}
+
+// Move any hits in hits_template, which are those written before hits were kept by month, into the
+// tables of their months.
+func dbMoveTemplateHits(ctx context.Context, db *sql.DB) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// See the comment in HitWriter.WriteBatch
+	if _, err := tx.ExecContext(ctx, "ROLLBACK; BEGIN IMMEDIATE"); err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT DISTINCT (timestamp / 86400) * 86400 FROM hits_template")
+	if err != nil {
+		return 0, err
+	}
+	var days []int64
+	for rows.Next() {
+		var day int64
+		if err := rows.Scan(&day); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		days = append(days, day)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(days) == 0 {
+		return 0, nil
+	}
+
+	partitions, err := dbEnsureHitPartitions(ctx, tx, days)
+	if err != nil {
+		return 0, err
+	}
+
+	var moved int64
+	for _, partition := range partitions {
+		result, err := tx.ExecContext(
+			ctx,
+			fmt.Sprintf("INSERT INTO %s SELECT * FROM hits_template WHERE timestamp >= ? AND timestamp < ?", partition.table),
+			partition.start,
+			partition.end,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("%s insert error: %w", partition.table, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		moved += n
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM hits_template"); err != nil {
+		return 0, err
+	}
+
+	return moved, tx.Commit()
+}
+
+// Drop the months that ended before the timestamp, and the goals and session pages of their hits,
+// returning their tables. Visits that are left without any pages are deleted too. The rollups of
+// their hits are kept.
+func dbDropHitPartitions(ctx context.Context, db *sql.DB, before int64) ([]string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// See the comment in HitWriter.WriteBatch
+	if _, err := tx.ExecContext(ctx, "ROLLBACK; BEGIN IMMEDIATE"); err != nil {
+		return nil, err
+	}
+
+	partitions, err := dbHitPartitions(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var dropped []string
+	var kept []hitPartition
+	for _, partition := range partitions {
+		if partition.end > before {
+			kept = append(kept, partition)
+			continue
+		}
+
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM goals WHERE hit_id IN (SELECT hit_id FROM %s)", partition.table)); err != nil {
+			return nil, fmt.Errorf("%s goals delete error: %w", partition.table, err)
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM session_pages WHERE hit_id IN (SELECT hit_id FROM %s)", partition.table)); err != nil {
+			return nil, fmt.Errorf("%s session pages delete error: %w", partition.table, err)
+		}
+		if _, err := tx.ExecContext(ctx, "DROP TABLE "+partition.table); err != nil {
+			return nil, err
+		}
+		dropped = append(dropped, partition.table)
+	}
+
+	if len(dropped) == 0 {
+		return nil, nil
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM sessions WHERE NOT EXISTS (SELECT 1 FROM session_pages WHERE session_pages.session_id = sessions.session_id)")
+	if err != nil {
+		return nil, fmt.Errorf("sessions delete error: %w", err)
+	}
+
+	if err := dbCreateHitsView(ctx, tx, kept); err != nil {
+		return nil, err
+	}
+
+	// As are the users that have no hits or visits left, other than that of anonymous visitors
+	_, err = tx.ExecContext(
+		ctx,
+		`DELETE FROM users
+		WHERE user_id != ?
+		  AND user_id NOT IN (SELECT user_id FROM hits)
+		  AND user_id NOT IN (SELECT user_id FROM sessions)`,
+		anonymousUserId,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("users delete error: %w", err)
+	}
+
+	return dropped, tx.Commit()
+}
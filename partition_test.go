@@ -0,0 +1,118 @@
+package sheepcount
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHitPartitions(t *testing.T) {
+	db, err := dbConnect(filepath.Join(t.TempDir(), "sheepcount.sqlite3"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+
+	writer, err := NewHitWriter(ctx, db)
+	require.NoError(t, err)
+	defer writer.Close()
+
+	conn, err := db.Conn(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	hit := func(timestamp int64, identifier string) Hit {
+		return Hit{
+			Timestamp:         timestamp,
+			IdentifierCurrent: []byte(identifier),
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              "/",
+			Goals:             []string{"visit"},
+		}
+	}
+
+	// A batch can have hits of more than one month
+	require.NoError(t, writer.WriteBatch(ctx, conn, []Hit{
+		hit(1653998400, "a"), // 2022-05-31 12:00
+		hit(1654041600, "b"), // 2022-06-01 00:00
+		hit(1653998460, "c"), // 2022-05-31 12:01
+	}))
+
+	partitions, err := dbHitPartitions(ctx, conn)
+	require.NoError(t, err)
+	require.Len(t, partitions, 2)
+	assert.Equal(t, hitPartition{table: "hits_202205", start: 1651363200, end: 1654041600}, partitions[0])
+	assert.Equal(t, hitPartition{table: "hits_202206", start: 1654041600, end: 1656633600}, partitions[1])
+
+	count := func(query string) int {
+		var n int
+		require.NoError(t, conn.QueryRowContext(ctx, query).Scan(&n))
+		return n
+	}
+	assert.Equal(t, 2, count("SELECT COUNT(*) FROM hits_202205"))
+	assert.Equal(t, 1, count("SELECT COUNT(*) FROM hits_202206"))
+	assert.Equal(t, 3, count("SELECT COUNT(DISTINCT hit_id) FROM hits"))
+	assert.Equal(t, 3, count("SELECT COUNT(*) FROM goals"))
+
+	// IDs carry on from the largest in any month
+	require.NoError(t, writer.WriteBatch(ctx, conn, []Hit{hit(1651363200, "d")})) // 2022-05-01 00:00
+	assert.Equal(t, 4, count("SELECT hit_id FROM hits_202205 WHERE timestamp = 1651363200"))
+
+	require.NoError(t, dbAggregate(ctx, db))
+	assert.Equal(t, 4, count("SELECT SUM(pageviews) FROM hits_daily"))
+	require.NoError(t, dbStitchSessions(ctx, db))
+	assert.Equal(t, 4, count("SELECT COUNT(*) FROM sessions"))
+
+	// Dropping May keeps its rollups, but not its visits or the users that were only seen in it
+	dropped, err := dbDropHitPartitions(ctx, db, retentionCutoff(time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC), 0))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hits_202205"}, dropped)
+	assert.Equal(t, 1, count("SELECT COUNT(*) FROM hits"))
+	assert.Equal(t, 1, count("SELECT COUNT(*) FROM goals"))
+	assert.Equal(t, 1, count("SELECT COUNT(*) FROM session_pages"))
+	assert.Equal(t, 1, count("SELECT COUNT(*) FROM sessions"))
+	assert.Equal(t, 2, count("SELECT COUNT(*) FROM users"), "b and the anonymous user are left")
+
+	require.NoError(t, dbAggregate(ctx, db))
+	assert.Equal(t, 4, count("SELECT SUM(pageviews) FROM hits_daily"))
+
+	// Nothing more to drop
+	dropped, err = dbDropHitPartitions(ctx, db, retentionCutoff(time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC), 0))
+	require.NoError(t, err)
+	assert.Empty(t, dropped)
+
+	// Hits written before they were kept by month are moved into their months
+	_, err = conn.ExecContext(ctx, "INSERT INTO hits_template SELECT * FROM hits_202206; DELETE FROM hits_202206")
+	require.NoError(t, err)
+	moved, err := dbMoveTemplateHits(ctx, db)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, moved)
+	assert.Equal(t, 0, count("SELECT COUNT(*) FROM hits_template"))
+	assert.Equal(t, 1, count("SELECT COUNT(*) FROM hits_202206"))
+
+	// After every month has been dropped, such as after a quiet spell, IDs still carry on, so the
+	// session stitcher sees the new hits
+	dropped, err = dbDropHitPartitions(ctx, db, retentionCutoff(time.Date(2022, 8, 15, 0, 0, 0, 0, time.UTC), 0))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hits_202206"}, dropped)
+	assert.Equal(t, 0, count("SELECT COUNT(*) FROM sessions"))
+
+	require.NoError(t, writer.WriteBatch(ctx, conn, []Hit{hit(1659355200, "e")})) // 2022-08-01 12:00
+	assert.Equal(t, 5, count("SELECT hit_id FROM hits"))
+	require.NoError(t, dbStitchSessions(ctx, db))
+	assert.Equal(t, 5, count("SELECT hit_id FROM session_pages"))
+	assert.Equal(t, 1, count("SELECT COUNT(*) FROM sessions"))
+}
+
+func TestRetentionCutoff(t *testing.T) {
+	now := time.Date(2022, 3, 31, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC).Unix(), retentionCutoff(now, 0))
+	assert.Equal(t, time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC).Unix(), retentionCutoff(now, 1))
+	assert.Equal(t, time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC).Unix(), retentionCutoff(now, 12))
+}
@@ -0,0 +1,93 @@
+package sheepcount
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+type PathConfig struct {
+	FoldTrailingSlash bool     `toml:"fold_trailing_slash"` // Treat /about/ and /about as the same page
+	Lowercase         bool     `toml:"lowercase"`           // Treat /About and /about as the same page
+	StripIndex        bool     `toml:"strip_index"`         // Treat /docs/index.html and /docs/ as the same page
+	QueryParameters   []string `toml:"query_parameters"`    // Query parameters that are kept as part of the path
+	HashRouting       string   `toml:"hash_routing"`        // Count routes in the fragment, such as #/docs, by replacing the path with them or appending them to it
+}
+
+func (config *PathConfig) validate() error {
+	switch config.HashRouting {
+	case "", "path", "append":
+		return nil
+	default:
+		return fmt.Errorf("hash_routing must be path or append, not %q", config.HashRouting)
+	}
+}
+
+// The route in the fragment of a URL, such as #/docs/intro or #!/docs/intro, if there is one.
+// Other fragments are anchors within the page.
+func hashRoute(fragment string) (*url.URL, bool) {
+	fragment = strings.TrimPrefix(fragment, "!")
+	if !strings.HasPrefix(fragment, "/") || strings.HasPrefix(fragment, "//") {
+		return nil, false
+	}
+	route, err := url.Parse(fragment)
+	if err != nil {
+		return nil, false
+	}
+	return route, true
+}
+
+// Normalize the path, and any whitelisted query parameters, of a page URL so that different URLs
+// for the same page are counted together.
+func (config *PathConfig) Normalize(u *url.URL) string {
+	path, query := u.Path, u.RawQuery
+
+	if route, ok := hashRoute(u.Fragment); ok {
+		switch config.HashRouting {
+		case "path":
+			// Hash routers keep the query of the route in the fragment too
+			path, query = route.Path, route.RawQuery
+		case "append":
+			path = strings.TrimRight(path, "/") + "/#" + route.Path
+		}
+	}
+
+	if config.Lowercase {
+		path = strings.ToLower(path)
+	}
+
+	if config.StripIndex {
+		for _, index := range []string{"index.html", "index.htm"} {
+			if strings.HasSuffix(path, "/"+index) {
+				path = strings.TrimSuffix(path, index)
+				break
+			}
+		}
+	}
+
+	if config.FoldTrailingSlash && path != "/" {
+		path = strings.TrimRight(path, "/")
+		if path == "" {
+			path = "/"
+		}
+	}
+
+	if len(config.QueryParameters) == 0 || query == "" {
+		return path
+	}
+
+	q, _ := url.ParseQuery(query)
+	kept := make(url.Values)
+	for _, param := range config.QueryParameters {
+		if values, ok := q[param]; ok {
+			kept[param] = values
+		}
+	}
+
+	if len(kept) == 0 {
+		return path
+	}
+
+	// Encode sorts by key so the order of the parameters in the original URL does not matter
+	return path + "?" + kept.Encode()
+}
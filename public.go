@@ -0,0 +1,140 @@
+package sheepcount
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The queries that can be run on the stats of a public site. The others, such as campaigns and
+// clicks, might reveal more than the owner meant to share.
+var publicQueries = map[string]bool{
+	"pageviews":        true,
+	"pages":            true,
+	"referrers":        true,
+	"referrer_sources": true,
+	"countries":        true,
+	"browsers":         true,
+}
+
+func (config *Config) isPublic(site string) bool {
+	for _, public := range config.PublicSites {
+		if public == site {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve a read-only stats page for a public site at /public/<site>, and the JSON of the public
+// queries at /public/<site>/<query>. Neither needs logging in and bots are always excluded.
+func handlePublic(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	site, queryName := strings.TrimPrefix(r.URL.Path, "/public/"), ""
+	if i := strings.Index(site, "/"); i >= 0 {
+		site, queryName = site[:i], site[i+1:]
+	}
+
+	if !sheepcount.isPublic(site) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	startDate, endDate, ok := requestDates(r.URL.Query(), sheepcount.location)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if queryName == "" {
+		handlePublicPage(sheepcount, site, startDate, endDate, w, r)
+		return
+	}
+
+	if !publicQueries[queryName] {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	query, err := sheepcount.queries.Get(queryName)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var output []byte
+	row := query.QueryRowContext(
+		r.Context(),
+		sql.Named("site", site),
+		sql.Named("start_date", startDate),
+		sql.Named("end_date", endDate),
+		sql.Named("include_bots", false),
+		sql.Named("timezone", sheepcount.location),
+	)
+	if err := row.Scan(&output); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	err = json.NewEncoder(&buf).Encode(struct {
+		Site      string          `json:"site"`
+		StartDate string          `json:"start_date"`
+		EndDate   string          `json:"end_date"`
+		Data      json.RawMessage `json:"data"`
+	}{
+		Site:      site,
+		StartDate: startDate,
+		EndDate:   endDate,
+		Data:      output,
+	})
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Let other sites show the numbers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	buf.WriteTo(w)
+}
+
+func handlePublicPage(sheepcount *SheepCount, site string, startDate string, endDate string, w http.ResponseWriter, r *http.Request) {
+	start, err1 := time.Parse("2006-01-02", startDate)
+	end, err2 := time.Parse("2006-01-02", endDate)
+	if err1 != nil || err2 != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	stats, err := reportSiteStats(r.Context(), sheepcount.queries, site, [2]time.Time{start, end}, sheepcount.location)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	params := struct {
+		Site  string
+		Stats reportStats
+	}{
+		Site:  site,
+		Stats: stats,
+	}
+
+	w.Header().Add("Content-Type", "text/html; charset=UTF-8")
+	if err := sheepcount.tmpl.ExecuteTemplate(w, "public.html.tmpl", params); err != nil {
+		log.Print(err)
+	}
+}
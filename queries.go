@@ -1,13 +1,20 @@
-package main
+package sheepcount
 
 import (
 	"bytes"
-	"database/sql"
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/mattn/go-sqlite3"
@@ -36,6 +43,11 @@ func validDate(date string) bool {
 	return true
 }
 
+// A LIKE pattern that matches the term anywhere, with any wildcards in it escaped with a backslash.
+func likePattern(term string) string {
+	return "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term) + "%"
+}
+
 // SQLite produces JSON and we just return that. Nothing more!
 func handleQueries(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -48,13 +60,15 @@ func handleQueries(sheepcount *SheepCount, w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	token := getAuthCookie(r, sheepcount.CookieKey)
-	if !token.LoggedIn {
+	account := sheepcount.session(r)
+	if account == nil || !account.canSee(r.URL.Query().Get("site")) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
 	queryName := strings.TrimPrefix(r.URL.Path, "/queries/")
+	download := strings.HasSuffix(queryName, ".csv")
+	queryName = strings.TrimSuffix(queryName, ".csv")
 
 	query, err := sheepcount.queries.Get(queryName)
 	if err == ErrQueryNotFound {
@@ -67,57 +81,83 @@ func handleQueries(sheepcount *SheepCount, w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Convert the query parameters to sql NamedParemeters
-	params := r.URL.Query()
-	args := make([]interface{}, 0, len(params))
-
-	for k, vs := range params {
-		if len(vs) > 0 {
-			v := vs[0]
+	manifest := query.Manifest()
+	if manifest.Auth == roleAdmin && !account.canWrite() {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if download && !manifest.CSV {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-			// For common parameters, check they are of the correct types
+	params := r.URL.Query()
 
-			if k == "start_date" || k == "end_date" {
-				if !validDate(v) {
-					w.WriteHeader(http.StatusBadRequest)
-					return
-				}
-				args = append(args, sql.Named(k, v))
-				continue
-			}
+	// Dates are in the time zone of the account, or of the dashboard, unless another is given. It
+	// is part of the key of the cached results, as accounts can have different ones. Another must
+	// be one whose days are rolled up.
+	if manifest.Parameters["timezone"] != nil {
+		if !params.Has("timezone") {
+			params.Set("timezone", sheepcount.accountLocation(account).String())
+		} else if ok, err := dbRolledUpTimezone(r.Context(), sheepcount.db, params.Get("timezone")); err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, errTimezoneNotRolledUp.Error())
+			return
+		}
+	}
 
-			if k == "utc_offset" {
-				offset, err := strconv.ParseInt(v, 10, 64)
-				if err != nil {
-					w.WriteHeader(http.StatusBadRequest)
-					return
-				}
-				args = append(args, sql.Named(k, offset))
-				continue
-			}
+	// Downloads have as many rows as can be had at once, unless fewer are asked for
+	if limit := manifest.Parameters["limit"]; download && limit != nil && limit.Max != nil && !params.Has("limit") {
+		params.Set("limit", strconv.FormatInt(*limit.Max, 10))
+	}
 
-			// For other parameters, try and convert to integer or float, and if this fails,
-			// use as a string
+	// Results are cached by the query and all of its parameters, as the account has been checked
+	// against them already
+	key := queryName + "?" + params.Encode()
 
-			integer, err := strconv.ParseInt(v, 10, 64)
-			if err == nil {
-				args = append(args, sql.Named(k, integer))
-				continue
-			}
+	// Compare with the previous period or the same period last year
+	compare := params.Get("compare")
+	params.Del("compare")
+	if download && compare != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "Comparisons cannot be downloaded as CSV")
+		return
+	}
 
-			float, err := strconv.ParseFloat(v, 64)
-			if err == nil {
-				args = append(args, sql.Named(k, float))
-				continue
-			}
+	// Only the parameters in the manifest of the query, of the types that it declares
+	args, err := manifest.bind(params)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
 
-			args = append(args, sql.Named(k, v))
+	now := time.Now()
+	if result, ok := sheepcount.queryCache.Get(key, now); ok {
+		if download {
+			writeQueryCSV(w, queryName, manifest.Columns, r.URL.Query(), result.output)
+			return
 		}
+		writeQueryResult(w, result.output, result.expires.Sub(now))
+		return
 	}
+	generation := sheepcount.queryCache.Generation()
 
-	var output []byte
-	row := query.QueryRowContext(r.Context(), args...)
-	if err := row.Scan(&output); err != nil {
+	output, err := sheepcount.runQuery(r.Context(), queryName, query, compare, args)
+	if err == errQueryTimeout {
+		writeAPIError(w, http.StatusGatewayTimeout, err.Error())
+		return
+	}
+	if _, ok := err.(*ErrBadInput); ok {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+	if err != nil {
 		if errsqlite, ok := err.(sqlite3.Error); ok {
 			log.Print(errsqlite.Code)
 			log.Print(errsqlite.ExtendedCode)
@@ -135,6 +175,119 @@ func handleQueries(sheepcount *SheepCount, w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	expires := sheepcount.queryCache.Put(key, generation, buf.Bytes(), now)
+	if download {
+		writeQueryCSV(w, queryName, manifest.Columns, r.URL.Query(), buf.Bytes())
+		return
+	}
+	writeQueryResult(w, buf.Bytes(), expires.Sub(now))
+}
+
+var errQueryTimeout = errors.New("the query took too long")
+
+var errTimezoneNotRolledUp = errors.New("timezone must be UTC or the time zone of the dashboard or an account")
+
+// The dashboard and API queries that were interrupted for taking longer than query_timeout, by
+// query
+var slowQueries = expvar.NewMap("slow_queries")
+
+// Run a query, with the comparison period if there is one. It is interrupted if it takes longer
+// than the query timeout, rather than tying up a read connection for however long it takes.
+func (sheepcount *SheepCount) runQuery(ctx context.Context, name string, query Query, compare string, args []interface{}) ([]byte, error) {
+	if sheepcount.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sheepcount.QueryTimeout)
+		defer cancel()
+	}
+
+	var output []byte
+	var err error
+	if compare != "" {
+		output, err = queryWithComparison(ctx, query, compare, args)
+	} else {
+		err = query.QueryRowContext(ctx, args...).Scan(&output)
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		slowQueries.Add(name, 1)
+		log.Printf("Query %s interrupted after %s", name, sheepcount.QueryTimeout)
+		return nil, errQueryTimeout
+	}
+
+	return output, err
+}
+
+// The rows of the result of a query, an array of objects, under a header of the columns of its
+// manifest. Numbers are kept as they were, nulls are empty and anything else is left as JSON.
+func queryRecords(output []byte, columns []string) ([][]string, error) {
+	var rows []map[string]json.RawMessage
+	if err := json.Unmarshal(output, &rows); err != nil {
+		return nil, fmt.Errorf("the result is not an array of objects: %w", err)
+	}
+
+	records := [][]string{columns}
+	for i, row := range rows {
+		if len(row) != len(columns) {
+			return nil, fmt.Errorf("row %d does not have the columns %s", i, strings.Join(columns, ", "))
+		}
+
+		record := make([]string, len(columns))
+		for j, column := range columns {
+			value, ok := row[column]
+			if !ok {
+				return nil, fmt.Errorf("row %d has no %s", i, column)
+			}
+			record[j] = csvValue(value)
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// Paths, titles and referrers are sent by anyone, so strings that spreadsheets would take as
+// formulas are quoted.
+func csvValue(value json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+			return "'" + s
+		}
+		return s
+	}
+	if string(value) == "null" {
+		return ""
+	}
+	return string(value)
+}
+
+// Write the result of a query as a CSV file named after the query, site and period.
+func writeQueryCSV(w http.ResponseWriter, name string, columns []string, params url.Values, output []byte) {
+	records, err := queryRecords(output, columns)
+	if err != nil {
+		log.Printf("Cannot convert %s to CSV: %s", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("sheepcount-%s-%s-%s-%s.csv", params.Get("site"), name, params.Get("start_date"), params.Get("end_date"))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	cw := csv.NewWriter(w)
+	if err := cw.WriteAll(records); err != nil {
+		log.Printf("Cannot write %s as CSV: %s", name, err)
+	}
+}
+
+// Browsers can keep the result for as long as the server does, which is not at all if it is not
+// cached. It is only for the account that is logged in, so shared caches cannot keep it.
+func writeQueryResult(w http.ResponseWriter, output []byte, maxAge time.Duration) {
+	if maxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(maxAge/time.Second)))
+	} else {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
 	w.Header().Add("Content-Type", "application/json")
-	buf.WriteTo(w)
+	w.Write(output)
 }
@@ -0,0 +1,157 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testQuery struct {
+	db    *sql.DB
+	query string
+}
+
+func (query *testQuery) QueryRowContext(ctx context.Context, args ...interface{}) Row {
+	return query.db.QueryRowContext(ctx, query.query, args...)
+}
+
+func (query *testQuery) Manifest() *queryManifest {
+	return &queryManifest{}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	config := DefaultConfig()
+	config.QueryTimeout = 50 * time.Millisecond
+	sheepcount := &SheepCount{Config: config}
+	ctx := context.Background()
+
+	output, err := sheepcount.runQuery(ctx, "quick", &testQuery{db, "SELECT json_object('n', 1)"}, "", nil)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"n": 1}`, string(output))
+
+	forever := &testQuery{db, "WITH RECURSIVE c(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM c) SELECT json_object('n', MAX(n)) FROM c"}
+	slow := func() int64 {
+		if n, ok := slowQueries.Get("forever").(interface{ Value() int64 }); ok {
+			return n.Value()
+		}
+		return 0
+	}
+	before := slow()
+
+	start := time.Now()
+	_, err = sheepcount.runQuery(ctx, "forever", forever, "", nil)
+	assert.Equal(t, errQueryTimeout, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, before+1, slow())
+}
+
+func TestQueryRecords(t *testing.T) {
+	columns := []string{"path", "title", "pageviews"}
+	records, err := queryRecords([]byte(`[{"path": "/", "title": "Home, \"sweet\" home", "pageviews": 3}, {"pageviews": -1, "path": "/about", "title": null}]`), columns)
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"path", "title", "pageviews"},
+		{"/", `Home, "sweet" home`, "3"},
+		{"/about", "", "-1"},
+	}, records)
+
+	// The header is written without any rows too
+	records, err = queryRecords([]byte(`[]`), columns)
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{columns}, records)
+
+	// Strings that spreadsheets would run as formulas are quoted
+	records, err = queryRecords([]byte(`[
+		{"path": "=HYPERLINK(\"https://example.net\")", "title": "+1", "pageviews": 1},
+		{"path": "-2+3", "title": "@SUM(A1)", "pageviews": 1},
+		{"path": "\tx", "title": "\r=1", "pageviews": 1}]`), columns)
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"path", "title", "pageviews"},
+		{`'=HYPERLINK("https://example.net")`, "'+1", "1"},
+		{"'-2+3", "'@SUM(A1)", "1"},
+		{"'\tx", "'\r=1", "1"},
+	}, records)
+
+	_, err = queryRecords([]byte(`{"visitors": 1}`), columns)
+	assert.Error(t, err)
+	_, err = queryRecords([]byte(`[1, 2]`), columns)
+	assert.Error(t, err)
+	_, err = queryRecords([]byte(`[{"path": "/", "visitors": 1, "pageviews": 1}]`), columns)
+	assert.Error(t, err)
+}
+
+func TestQueryCSV(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO sites (site_id, domain) VALUES (1, 'example.com');
+		INSERT INTO paths (path_id, site_id, path, title) VALUES (1, 1, '/', 'Home'), (2, 1, '/about', NULL);
+		INSERT INTO hits_daily (day, site_id, path_id, country, bot, pageviews, visitors) VALUES
+			(1654041600, 1, 1, 'GB', 0, 3, 2),
+			(1654041600, 1, 2, 'FR', 0, 1, 1);`)
+	require.NoError(t, err)
+
+	queries, err := NewQueries(db)
+	require.NoError(t, err)
+
+	config := DefaultConfig()
+	config.CookieKey = "0123456789abcdef0123456789abcdef"
+	config.Password = hashPassword("shared", config.passwordSalt())
+	sheepcount := &SheepCount{db: db, queries: queries, location: time.UTC, queryCache: newQueryCache(time.Minute), Config: config}
+
+	token, err := sheepcount.login(ctx, "", "shared")
+	require.NoError(t, err)
+	encoded, err := sheepcount.cookieCodec().Encode(authCookieName, token)
+	require.NoError(t, err)
+
+	get := func(target string, loggedIn bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		if loggedIn {
+			r.AddCookie(&http.Cookie{Name: authCookieName, Value: encoded})
+		}
+		w := httptest.NewRecorder()
+		handleQueries(sheepcount, w, r)
+		return w
+	}
+
+	const period = "site=example.com&start_date=2022-06-01&end_date=2022-06-01"
+
+	w := get("/queries/pages.csv?"+period, true)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=UTF-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="sheepcount-example.com-pages-2022-06-01-2022-06-01.csv"`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, "path,title,pageviews,visitors\n/,Home,3,2\n/about,,1,1\n", w.Body.String())
+
+	// The JSON of the same query is cached separately
+	w = get("/queries/pages?"+period, true)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	w = get("/queries/countries.csv?"+period, true)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "country,pageviews,visitors\nGB,3,2\nFR,1,1\n", w.Body.String())
+
+	// Without any hits there is still a header
+	w = get("/queries/referrers.csv?"+period, true)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "domain,path,pageviews,visitors\n", w.Body.String())
+
+	assert.Equal(t, http.StatusForbidden, get("/queries/pages.csv?"+period, false).Code)
+	assert.Equal(t, http.StatusNotFound, get("/queries/sites.csv?include_bots=true", true).Code)
+	assert.Equal(t, http.StatusBadRequest, get("/queries/pages.csv?"+period+"&compare=previous", true).Code)
+}
@@ -0,0 +1,115 @@
+package sheepcount
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// How many of the requests for dashboard queries were answered from the cache, and how many ran the
+// query
+var queryCacheHits = expvar.NewInt("query_cache_hits")
+var queryCacheMisses = expvar.NewInt("query_cache_misses")
+
+// The most results that are cached, so that requests for every possible period cannot use up memory
+const queryCacheSize = 1000
+
+type cachedResult struct {
+	output  []byte
+	expires time.Time
+}
+
+// The results of the dashboard queries, which can be slow over long periods, keyed by the query and
+// its parameters. Results are kept for the TTL at most, and are all dropped whenever the aggregator
+// has rolled up new hits. It is safe for concurrent use.
+type queryCache struct {
+	sync.Mutex
+	ttl        time.Duration
+	generation uint64
+	results    map[string]cachedResult
+}
+
+// Returns nil if ttl is zero, which disables caching.
+func newQueryCache(ttl time.Duration) *queryCache {
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &queryCache{
+		ttl:     ttl,
+		results: make(map[string]cachedResult),
+	}
+}
+
+// The generation changes whenever the cache is invalidated. A result is only put in the cache if
+// the generation has not changed since before the query was run, so that results of queries that
+// were running while the hits were rolled up are not kept.
+func (cache *queryCache) Generation() uint64 {
+	if cache == nil {
+		return 0
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+	return cache.generation
+}
+
+func (cache *queryCache) Get(key string, now time.Time) (cachedResult, bool) {
+	if cache == nil {
+		return cachedResult{}, false
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	result, ok := cache.results[key]
+	if !ok || !now.Before(result.expires) {
+		queryCacheMisses.Add(1)
+		return cachedResult{}, false
+	}
+	queryCacheHits.Add(1)
+	return result, true
+}
+
+// Returns when the result expires, which is now if it is not cached.
+func (cache *queryCache) Put(key string, generation uint64, output []byte, now time.Time) time.Time {
+	if cache == nil {
+		return now
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	if generation != cache.generation {
+		return now
+	}
+
+	if len(cache.results) >= queryCacheSize {
+		for k, result := range cache.results {
+			if !now.Before(result.expires) {
+				delete(cache.results, k)
+			}
+		}
+		// Start again if every result is fresh
+		if len(cache.results) >= queryCacheSize {
+			cache.results = make(map[string]cachedResult)
+		}
+	}
+
+	expires := now.Add(cache.ttl)
+	cache.results[key] = cachedResult{output: output, expires: expires}
+	return expires
+}
+
+// Drop every result, such as when new hits have been rolled up or an annotation has been added.
+func (cache *queryCache) Invalidate() {
+	if cache == nil {
+		return
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	cache.generation++
+	cache.results = make(map[string]cachedResult)
+}
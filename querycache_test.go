@@ -0,0 +1,98 @@
+package sheepcount
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryCache(t *testing.T) {
+	assert.Nil(t, newQueryCache(0))
+
+	cache := newQueryCache(time.Minute)
+	now := time.Now()
+
+	_, ok := cache.Get("pages?site=example.com", now)
+	assert.False(t, ok)
+
+	expires := cache.Put("pages?site=example.com", cache.Generation(), []byte("[]"), now)
+	assert.Equal(t, now.Add(time.Minute), expires)
+
+	result, ok := cache.Get("pages?site=example.com", now.Add(59*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("[]"), result.output)
+	assert.Equal(t, expires, result.expires)
+
+	_, ok = cache.Get("pages?site=example.com", now.Add(time.Minute))
+	assert.False(t, ok)
+
+	// Invalidating drops every result, and those of queries that were running at the time
+	generation := cache.Generation()
+	cache.Put("pages?site=example.com", generation, []byte("[]"), now)
+	cache.Invalidate()
+	_, ok = cache.Get("pages?site=example.com", now)
+	assert.False(t, ok)
+
+	assert.Equal(t, now, cache.Put("pages?site=example.com", generation, []byte("[]"), now))
+	_, ok = cache.Get("pages?site=example.com", now)
+	assert.False(t, ok)
+
+	// A nil cache caches nothing
+	var disabled *queryCache
+	disabled.Put("pages?site=example.com", disabled.Generation(), []byte("[]"), now)
+	_, ok = disabled.Get("pages?site=example.com", now)
+	assert.False(t, ok)
+	disabled.Invalidate()
+}
+
+func TestQueryCacheHandler(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+
+	queries, err := NewQueries(db)
+	require.NoError(t, err)
+
+	config := DefaultConfig()
+	config.CookieKey = "0123456789abcdef0123456789abcdef"
+	config.Password = hashPassword("shared", config.passwordSalt())
+	sheepcount := &SheepCount{db: db, queries: queries, location: time.UTC, queryCache: newQueryCache(time.Minute), Config: config}
+
+	token, err := sheepcount.login(ctx, "", "shared")
+	require.NoError(t, err)
+	encoded, err := sheepcount.cookieCodec().Encode(authCookieName, token)
+	require.NoError(t, err)
+
+	get := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/queries/sites?include_bots=true", nil)
+		r.AddCookie(&http.Cookie{Name: authCookieName, Value: encoded})
+		w := httptest.NewRecorder()
+		handleQueries(sheepcount, w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w
+	}
+
+	w := get()
+	assert.Equal(t, "private, max-age=60", w.Header().Get("Cache-Control"))
+	assert.NotContains(t, w.Body.String(), "example.com")
+
+	// The result is served from the cache until it is invalidated
+	_, err = db.ExecContext(ctx, "INSERT INTO sites (domain) VALUES ('example.com')")
+	require.NoError(t, err)
+	assert.NotContains(t, get().Body.String(), "example.com")
+
+	sheepcount.queryCache.Invalidate()
+	assert.Contains(t, get().Body.String(), "example.com")
+
+	// Without a cache, browsers must check with the server
+	sheepcount.queryCache = nil
+	assert.Equal(t, "private, no-cache", get().Header().Get("Cache-Control"))
+}
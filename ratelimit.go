@@ -0,0 +1,135 @@
+package sheepcount
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RateLimitConfig struct {
+	Rate  float64 `toml:"rate"`  // Requests per second. Zero disables rate limiting.
+	Burst int     `toml:"burst"` // How many requests can be made at once
+	Key   string  `toml:"key"`   // Limit by ip, identifier or both
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A token bucket rate limiter for each key. It is safe for concurrent use.
+type rateLimiter struct {
+	sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Take a token from the bucket for key. If there are none, return how long until there will be.
+func (limiter *rateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	limiter.sweep(now)
+
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limiter.burst, last: now}
+		limiter.buckets[key] = b
+	}
+
+	b.tokens = math.Min(limiter.burst, b.tokens+now.Sub(b.last).Seconds()*limiter.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / limiter.rate * float64(time.Second))
+		return false, wait
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// Forget buckets that have refilled, as they are the same as new buckets, so that the map does not
+// grow forever.
+func (limiter *rateLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < time.Minute {
+		return
+	}
+	limiter.lastSweep = now
+
+	full := time.Duration(limiter.burst / limiter.rate * float64(time.Second))
+	for key, b := range limiter.buckets {
+		if now.Sub(b.last) >= full {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// Create middleware to reply with 429 Too Many Requests to clients that exceed the rate limit. The
+// handlers that it wraps share the same limits.
+func newRateLimit(sheepcount *SheepCount) (func(http.HandlerFunc) http.HandlerFunc, error) {
+	config := sheepcount.RateLimit
+	if config.Rate <= 0 {
+		return func(next http.HandlerFunc) http.HandlerFunc { return next }, nil
+	}
+
+	var byIP, byIdentifier bool
+	switch config.Key {
+	case "", "ip":
+		byIP = true
+	case "identifier":
+		byIdentifier = true
+	case "both":
+		byIP, byIdentifier = true, true
+	default:
+		return nil, fmt.Errorf("invalid rate limit key: %s", config.Key)
+	}
+
+	ipLimiter := newRateLimiter(config.Rate, config.Burst)
+	identifierLimiter := newRateLimiter(config.Rate, config.Burst)
+
+	middleware := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			now := time.Now()
+
+			allowed, wait := true, time.Duration(0)
+			if byIP {
+				allowed, wait = ipLimiter.Allow(r.RemoteAddr, now)
+			}
+			if allowed && byIdentifier {
+				identifier, _, err := sheepcount.fingerprintRequest(r)
+				if err == nil {
+					allowed, wait = identifierLimiter.Allow(hex.EncodeToString(identifier), now)
+				}
+			}
+
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+
+			next(w, r)
+		}
+	}
+
+	return middleware, nil
+}
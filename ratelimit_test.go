@@ -0,0 +1,33 @@
+package sheepcount
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(1, 2)
+	now := time.Unix(1654041600, 0)
+
+	allowed, _ := limiter.Allow("a", now)
+	assert.True(t, allowed)
+	allowed, _ = limiter.Allow("a", now)
+	assert.True(t, allowed)
+
+	// Burst used up
+	allowed, wait := limiter.Allow("a", now)
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, wait)
+
+	// Other keys have their own bucket
+	allowed, _ = limiter.Allow("b", now)
+	assert.True(t, allowed)
+
+	// One token is added each second
+	allowed, _ = limiter.Allow("a", now.Add(time.Second))
+	assert.True(t, allowed)
+	allowed, _ = limiter.Allow("a", now.Add(time.Second))
+	assert.False(t, allowed)
+}
@@ -0,0 +1,129 @@
+package sheepcount
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	realtimeWindow   = 5 * time.Minute
+	realtimeCapacity = 8192
+)
+
+type realtimeHit struct {
+	timestamp  int64
+	identifier string
+	event      EventType
+	domain     string
+	path       string
+}
+
+// Keeps the most recent hits in memory so that we can show who is on the site right now without
+// waiting for them to be written to the database. It is safe for concurrent use.
+type Realtime struct {
+	sync.Mutex
+	hits []realtimeHit // Ring buffer
+	next int
+}
+
+func NewRealtime() *Realtime {
+	return &Realtime{hits: make([]realtimeHit, 0, realtimeCapacity)}
+}
+
+func (realtime *Realtime) Record(hit *Hit) {
+	rh := realtimeHit{
+		timestamp:  hit.Timestamp,
+		identifier: string(hit.IdentifierCurrent),
+		event:      hit.Event,
+		domain:     hit.Domain,
+		path:       hit.Path,
+	}
+
+	realtime.Lock()
+	defer realtime.Unlock()
+
+	if len(realtime.hits) < cap(realtime.hits) {
+		realtime.hits = append(realtime.hits, rh)
+	} else {
+		realtime.hits[realtime.next] = rh
+	}
+	realtime.next = (realtime.next + 1) % cap(realtime.hits)
+}
+
+type RealtimePage struct {
+	Path     string `json:"path"`
+	Visitors int    `json:"visitors"`
+}
+
+type RealtimeStats struct {
+	Visitors int            `json:"visitors"`
+	Pages    []RealtimePage `json:"pages"`
+}
+
+// Active visitors are those that have been seen on the site in the last few minutes and have not
+// since hidden the page. Each is counted on the last page they were seen on.
+func (realtime *Realtime) Stats(site string, now time.Time) RealtimeStats {
+	since := now.Add(-realtimeWindow).Unix()
+	latest := make(map[string]realtimeHit)
+
+	realtime.Lock()
+	for _, hit := range realtime.hits {
+		if hit.domain != site || hit.timestamp < since {
+			continue
+		}
+		if previous, ok := latest[hit.identifier]; !ok || hit.timestamp >= previous.timestamp {
+			latest[hit.identifier] = hit
+		}
+	}
+	realtime.Unlock()
+
+	visitors := make(map[string]int)
+	stats := RealtimeStats{Pages: []RealtimePage{}}
+	for _, hit := range latest {
+		if hit.event == PageHide {
+			continue
+		}
+		stats.Visitors++
+		visitors[hit.path]++
+	}
+
+	for path, n := range visitors {
+		stats.Pages = append(stats.Pages, RealtimePage{Path: path, Visitors: n})
+	}
+	sort.Slice(stats.Pages, func(i, j int) bool {
+		if stats.Pages[i].Visitors != stats.Pages[j].Visitors {
+			return stats.Pages[i].Visitors > stats.Pages[j].Visitors
+		}
+		return stats.Pages[i].Path < stats.Pages[j].Path
+	})
+	if len(stats.Pages) > 10 {
+		stats.Pages = stats.Pages[:10]
+	}
+
+	return stats
+}
+
+func handleRealtime(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	site := r.URL.Query().Get("site")
+	if site == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !authorized(sheepcount, r, site) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(sheepcount.realtime.Stats(site, time.Now()))
+}
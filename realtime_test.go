@@ -0,0 +1,43 @@
+package sheepcount
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRealtime(t *testing.T) {
+	now := time.Unix(1654041600, 0)
+	realtime := NewRealtime()
+
+	hit := func(ago time.Duration, identifier string, event EventType, path string) *Hit {
+		return &Hit{
+			Timestamp:         now.Add(-ago).Unix(),
+			IdentifierCurrent: []byte(identifier),
+			Event:             event,
+			Domain:            "example.com",
+			Path:              path,
+		}
+	}
+
+	for _, h := range []*Hit{
+		hit(10*time.Minute, "a", PageLoad, "/"), // Too long ago
+		hit(4*time.Minute, "b", PageLoad, "/"),  // Moved on to /about
+		hit(3*time.Minute, "b", PageLoad, "/about"),
+		hit(2*time.Minute, "c", PageLoad, "/about"),
+		hit(2*time.Minute, "d", PageLoad, "/"), // Left
+		hit(1*time.Minute, "d", PageHide, "/"),
+		hit(1*time.Minute, "e", PageLoad, "/contact"),
+	} {
+		realtime.Record(h)
+	}
+
+	assert.Equal(t, RealtimeStats{
+		Visitors: 3,
+		Pages: []RealtimePage{
+			{Path: "/about", Visitors: 2},
+			{Path: "/contact", Visitors: 1},
+		},
+	}, realtime.Stats("example.com", now))
+}
@@ -1,10 +1,90 @@
-package main
+package sheepcount
 
 import (
+	"bufio"
+	"context"
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"io"
 	"net/url"
 	"strings"
+	"unicode"
 )
 
+//go:embed referrer_groups.txt
+var builtinReferrerGroups string
+
+// Parse a list of referrer groups, one per line with the domain and then the name. Blank lines and
+// comments starting with # are skipped.
+func parseReferrerGroups(r io.Reader) (map[string]string, error) {
+	groups := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		i := strings.IndexFunc(line, unicode.IsSpace)
+		if i < 0 {
+			return nil, fmt.Errorf("referrer group %s has no name", line)
+		}
+		groups[strings.ToLower(line[:i])] = strings.TrimSpace(line[i:])
+	}
+
+	return groups, scanner.Err()
+}
+
+// The built in referrer groups with those in the configuration on top. A group with an empty name
+// in the configuration removes the built in one for that domain.
+func referrerGroups(overrides map[string]string) (map[string]string, error) {
+	groups, err := parseReferrerGroups(strings.NewReader(builtinReferrerGroups))
+	if err != nil {
+		return nil, err
+	}
+
+	for domain, name := range overrides {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" {
+			return nil, fmt.Errorf("referrer group %q has no domain", name)
+		}
+
+		if name = strings.TrimSpace(name); name == "" {
+			delete(groups, domain)
+		} else {
+			groups[domain] = name
+		}
+	}
+
+	return groups, nil
+}
+
+// Replace the referrer groups that the referrer_sources view uses.
+func dbSetReferrerGroups(ctx context.Context, db *sql.DB, groups map[string]string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM referrer_groups"); err != nil {
+		return err
+	}
+
+	for domain, name := range groups {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO referrer_groups (domain, name) VALUES (?, ?)", domain, name); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 // See https://github.com/arp242/goatcounter/blob/dc6295ecec161085d667866ab1c9e2e59dc63065/hit.go#L120
 func stripTrackingTags(q url.Values) {
 	if len(q) == 0 {
@@ -50,3 +130,67 @@ func stripTrackingTags(q url.Values) {
 	// Presumably a tracking thing?
 	q.Del("continueFlag")
 }
+
+// Search engines that put the search terms in the query string of the referrer, with a part of
+// their domain and the parameter that has the search terms. Google and Yandex have a domain for each
+// country, such as google.co.uk, so the top level domain is left out.
+var searchEngines = []struct {
+	domain string
+	param  string
+}{
+	{"google", "q"},
+	{"bing", "q"},
+	{"duckduckgo", "q"},
+	{"search.yahoo", "p"},
+	{"yandex", "text"},
+	{"baidu", "wd"},
+	{"ecosia", "q"},
+	{"search.brave", "q"},
+	{"startpage", "query"},
+	{"qwant", "q"},
+	{"kagi", "q"},
+}
+
+// The longest search terms that are kept, in characters
+const maxKeywordLength = 100
+
+// The search terms in the query string of a referrer from a search engine, in lower case and with
+// spaces collapsed, and the parameter that they were in, or empty strings if there are none.
+func searchKeyword(domain string, q url.Values) (string, string) {
+	for _, engine := range searchEngines {
+		if !strings.Contains("."+domain+".", "."+engine.domain+".") {
+			continue
+		}
+
+		keyword := strings.ToLower(strings.Join(strings.Fields(q.Get(engine.param)), " "))
+		if keyword == "" {
+			return "", ""
+		}
+		if runes := []rune(keyword); len(runes) > maxKeywordLength {
+			keyword = strings.TrimSpace(string(runes[:maxKeywordLength]))
+		}
+
+		return keyword, engine.param
+	}
+
+	return "", ""
+}
+
+// Extract the UTM campaign parameters from the query string of a page URL. This must be done before
+// stripTrackingTags throws them away.
+func campaignFromQuery(q url.Values) Campaign {
+	param := func(name string) sql.NullString {
+		if value := strings.TrimSpace(q.Get(name)); value != "" {
+			return sql.NullString{String: value, Valid: true}
+		}
+		return sql.NullString{}
+	}
+
+	return Campaign{
+		Source:  param("utm_source"),
+		Medium:  param("utm_medium"),
+		Name:    param("utm_campaign"),
+		Term:    param("utm_term"),
+		Content: param("utm_content"),
+	}
+}
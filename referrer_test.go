@@ -0,0 +1,71 @@
+package sheepcount
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReferrerGroups(t *testing.T) {
+	groups, err := referrerGroups(map[string]string{
+		"Example.com": "Example",
+		"reddit.com":  "",
+		"t.co":        "X",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "Google", groups["google.com"])
+	assert.Equal(t, "Hacker News", groups["news.ycombinator.com"])
+	assert.Equal(t, "Example", groups["example.com"])
+	assert.Equal(t, "X", groups["t.co"])
+	assert.NotContains(t, groups, "reddit.com")
+
+	_, err = parseReferrerGroups(strings.NewReader("example.com\n"))
+	assert.Error(t, err)
+}
+
+func TestReferrerSources(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+
+	groups := map[string]string{"twitter.com": "Twitter", "t.co": "Twitter", "google.com": "Google", "news.google.com": "Google News"}
+	if err := dbSetReferrerGroups(ctx, db, groups); err != nil {
+		t.Fatal(err)
+	}
+	// Setting them again replaces them
+	if err := dbSetReferrerGroups(ctx, db, groups); err != nil {
+		t.Fatal(err)
+	}
+
+	sources := map[string]string{
+		"t.co":               "Twitter",
+		"mobile.twitter.com": "Twitter",
+		"www.google.com":     "Google",
+		"news.google.com":    "Google News",
+		"notgoogle.com":      "notgoogle.com",
+		"www.example.com":    "example.com",
+	}
+	for domain := range sources {
+		if _, err := db.ExecContext(ctx, "INSERT INTO referrers (domain) VALUES (?)", domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for domain, source := range sources {
+		var got string
+		if err := db.QueryRowContext(ctx, "SELECT source FROM referrer_sources WHERE domain = ?", domain).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, source, got, domain)
+	}
+}
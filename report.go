@@ -0,0 +1,348 @@
+package sheepcount
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+)
+
+type ReportConfig struct {
+	Schedule string   `toml:"schedule"` // When to send, in cron format such as "0 8 * * 1" or @weekly. Empty disables reports.
+	Period   string   `toml:"period"`   // Either week (the last seven days) or month (the last calendar month)
+	Sites    []string `toml:"sites"`    // Defaults to all domains
+	From     string   `toml:"from"`
+	To       []string `toml:"to"`
+
+	SMTP SMTPConfig `toml:"smtp"`
+}
+
+type SMTPConfig struct {
+	Host     string `toml:"host"`
+	Port     int    `toml:"port"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+}
+
+type reportPage struct {
+	Path      string `json:"path"`
+	Pageviews int    `json:"pageviews"`
+}
+
+// Referrers are grouped by source, so that t.co and twitter.com are both Twitter
+type reportReferrer struct {
+	Source    string `json:"source"`
+	Pageviews int    `json:"pageviews"`
+}
+
+type reportStats struct {
+	Start     string
+	End       string
+	Pageviews int
+	Visitors  int // The sum of daily unique visitors
+	Pages     []reportPage
+	Referrers []reportReferrer
+}
+
+type reportSite struct {
+	Site     string
+	Current  reportStats
+	Previous reportStats
+}
+
+func (site reportSite) PageviewsChange() string {
+	return percentChange(site.Previous.Pageviews, site.Current.Pageviews)
+}
+
+func (site reportSite) VisitorsChange() string {
+	return percentChange(site.Previous.Visitors, site.Current.Visitors)
+}
+
+func percentChange(previous int, current int) string {
+	if previous == 0 {
+		return "–"
+	}
+	return fmt.Sprintf("%+.0f%%", 100*float64(current-previous)/float64(previous))
+}
+
+type report struct {
+	Period string
+	Sites  []reportSite
+}
+
+// The inclusive date ranges for the current and previous periods of a report sent at now.
+func reportPeriods(period string, now time.Time) (current [2]time.Time, previous [2]time.Time, err error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch period {
+	case "", "week":
+		current = [2]time.Time{today.AddDate(0, 0, -7), today.AddDate(0, 0, -1)}
+		previous = [2]time.Time{today.AddDate(0, 0, -14), today.AddDate(0, 0, -8)}
+	case "month":
+		thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		current = [2]time.Time{thisMonth.AddDate(0, -1, 0), thisMonth.AddDate(0, 0, -1)}
+		previous = [2]time.Time{thisMonth.AddDate(0, -2, 0), thisMonth.AddDate(0, -1, -1)}
+	default:
+		err = fmt.Errorf("invalid report period: %s", period)
+	}
+
+	return current, previous, err
+}
+
+func runReportQuery(ctx context.Context, queries Queries, name string, site string, dates [2]time.Time, loc *time.Location, v interface{}) error {
+	query, err := queries.Get(name)
+	if err != nil {
+		return err
+	}
+
+	var output []byte
+	row := query.QueryRowContext(
+		ctx,
+		sql.Named("site", site),
+		sql.Named("start_date", dates[0].Format("2006-01-02")),
+		sql.Named("end_date", dates[1].Format("2006-01-02")),
+		sql.Named("include_bots", false),
+		sql.Named("timezone", loc),
+	)
+	if err := row.Scan(&output); err != nil {
+		return fmt.Errorf("%s query error: %w", name, err)
+	}
+
+	return json.Unmarshal(output, v)
+}
+
+func reportSiteStats(ctx context.Context, queries Queries, site string, dates [2]time.Time, loc *time.Location) (reportStats, error) {
+	stats := reportStats{
+		Start: dates[0].Format("2 January 2006"),
+		End:   dates[1].Format("2 January 2006"),
+	}
+
+	var days []struct {
+		Pageviews int `json:"pageviews"`
+		Visitors  int `json:"visitors"`
+	}
+	if err := runReportQuery(ctx, queries, "pageviews", site, dates, loc, &days); err != nil {
+		return stats, err
+	}
+	for _, day := range days {
+		stats.Pageviews += day.Pageviews
+		stats.Visitors += day.Visitors
+	}
+
+	if err := runReportQuery(ctx, queries, "pages", site, dates, loc, &stats.Pages); err != nil {
+		return stats, err
+	}
+	if len(stats.Pages) > 10 {
+		stats.Pages = stats.Pages[:10]
+	}
+
+	if err := runReportQuery(ctx, queries, "referrer_sources", site, dates, loc, &stats.Referrers); err != nil {
+		return stats, err
+	}
+	if len(stats.Referrers) > 10 {
+		stats.Referrers = stats.Referrers[:10]
+	}
+
+	return stats, nil
+}
+
+func buildReport(ctx context.Context, queries Queries, config *Config, now time.Time) (*report, error) {
+	loc, err := config.location()
+	if err != nil {
+		return nil, err
+	}
+
+	// The periods are whole days in the time zone of the dashboard
+	current, previous, err := reportPeriods(config.Report.Period, now.In(loc))
+	if err != nil {
+		return nil, err
+	}
+
+	sites := config.Report.Sites
+	if len(sites) == 0 {
+		sites = config.Domains
+	}
+
+	r := &report{Period: config.Report.Period}
+	if r.Period == "" {
+		r.Period = "week"
+	}
+
+	for _, site := range sites {
+		rs := reportSite{Site: site}
+
+		if rs.Current, err = reportSiteStats(ctx, queries, site, current, loc); err != nil {
+			return nil, err
+		}
+		if rs.Previous, err = reportSiteStats(ctx, queries, site, previous, loc); err != nil {
+			return nil, err
+		}
+
+		r.Sites = append(r.Sites, rs)
+	}
+
+	return r, nil
+}
+
+// Render the report as a MIME message ready to be sent.
+func renderReport(tmpl Templater, config *Config, r *report, now time.Time) ([]byte, error) {
+	var body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&body, "report.html.tmpl", r); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", config.Report.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(config.Report.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", fmt.Sprintf("Sheep Count %sly report", r.Period)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprint(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprint(&msg, "Content-Type: text/html; charset=UTF-8\r\n")
+	fmt.Fprint(&msg, "Content-Transfer-Encoding: quoted-printable\r\n")
+	fmt.Fprint(&msg, "\r\n")
+
+	qp := quotedprintable.NewWriter(&msg)
+	if _, err := qp.Write(body.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+
+	return msg.Bytes(), nil
+}
+
+// SMTP servers on other ports are expected to support STARTTLS, which is used automatically.
+func sendMail(config *SMTPConfig, from string, to []string, msg []byte) error {
+	if config.Host == "" {
+		return errors.New("no SMTP host configured")
+	}
+
+	port := config.Port
+	if port == 0 {
+		port = 587
+	}
+
+	var auth smtp.Auth
+	if config.Username != "" {
+		auth = smtp.PlainAuth("", config.Username, config.Password, config.Host)
+	}
+
+	return smtp.SendMail(net.JoinHostPort(config.Host, strconv.Itoa(port)), auth, from, to, msg)
+}
+
+func sendReport(ctx context.Context, queries Queries, tmpl Templater, config *Config, now time.Time) error {
+	if len(config.Report.To) == 0 {
+		return errors.New("no report recipients configured")
+	}
+
+	r, err := buildReport(ctx, queries, config, now)
+	if err != nil {
+		return err
+	}
+
+	msg, err := renderReport(tmpl, config, r, now)
+	if err != nil {
+		return err
+	}
+
+	return sendMail(&config.Report.SMTP, config.Report.From, config.Report.To, msg)
+}
+
+// Send reports on the configured schedule.
+func Reporter(ctx context.Context, queries Queries, tmpl Templater, config *Config) error {
+	schedule, err := parseCron(config.Report.Schedule)
+	if err != nil {
+		return err
+	}
+
+	for {
+		next := schedule.Next(time.Now())
+		if next.IsZero() {
+			return fmt.Errorf("report schedule %q never runs", config.Report.Schedule)
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		if err := sendReport(ctx, queries, tmpl, config, time.Now()); err != nil {
+			log.Printf("Cannot send report: %s", err)
+		}
+	}
+}
+
+func newReportCommand(configPath *string, databasePath *string) *cobra.Command {
+	var now bool
+
+	cmd := &cobra.Command{
+		Use:   "report",
+		Short: "Print the summary email report, or send it with --now",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config := DefaultConfig()
+			if _, err := toml.DecodeFile(*configPath, &config); err != nil {
+				return err
+			}
+
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			settings, err := dbSettings(cmd.Context(), db)
+			if err != nil {
+				return err
+			}
+			config.applySettings(settings)
+
+			queries, _, err := config.newQueries(db)
+			if err != nil {
+				return err
+			}
+
+			tmpl, err := NewTemplates()
+			if err != nil {
+				return err
+			}
+
+			if now {
+				if err := sendReport(cmd.Context(), queries, tmpl, &config, time.Now()); err != nil {
+					return err
+				}
+				log.Printf("Sent report to %s", strings.Join(config.Report.To, ", "))
+				return nil
+			}
+
+			r, err := buildReport(cmd.Context(), queries, &config, time.Now())
+			if err != nil {
+				return err
+			}
+
+			return tmpl.ExecuteTemplate(os.Stdout, "report.html.tmpl", r)
+		},
+	}
+
+	cmd.Flags().BoolVar(&now, "now", false, "Send the report now")
+
+	return cmd
+}
@@ -0,0 +1,219 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// A visit ends after this many seconds without any events from the user.
+const sessionTimeout = 30 * 60
+
+// The maximum number of hits to stitch in a single transaction.
+const sessionBatchSize = 10000
+
+type sessionHit struct {
+	hitId     int64
+	timestamp int64
+	siteId    int64
+	userId    int64
+	event     EventType
+	pathId    int64
+	bot       bool
+}
+
+// Stitch the page load, view and hide events of each user into visits. Hits are processed in the
+// order they were written, carrying on from where the last run finished.
+func dbStitchSessions(ctx context.Context, db *sql.DB) error {
+	for {
+		n, err := dbStitchSessionsBatch(ctx, db)
+		if err != nil {
+			return err
+		}
+		if n < sessionBatchSize {
+			return nil
+		}
+	}
+}
+
+func dbStitchSessionsBatch(ctx context.Context, db *sql.DB) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// See the comment in HitWriter.WriteBatch
+	if _, err := tx.ExecContext(ctx, "ROLLBACK; BEGIN IMMEDIATE"); err != nil {
+		return 0, err
+	}
+
+	var lastHitId int64
+	if err := tx.QueryRowContext(ctx, "SELECT last_hit_id FROM sessions_progress").Scan(&lastHitId); err != nil {
+		return 0, fmt.Errorf("sessions progress error: %w", err)
+	}
+
+	rows, err := tx.QueryContext(
+		ctx,
+		`SELECT hits.hit_id, hits.timestamp, hits.site_id, hits.user_id, hits.event, hits.path_id
+			, COALESCE(hits.bot, 0) >= 2 OR user_agents.bot >= 2
+		FROM hits
+		INNER JOIN user_agents ON hits.user_agent_id = user_agents.user_agent_id
+		WHERE hits.hit_id > ?
+		ORDER BY hits.hit_id
+		LIMIT ?`,
+		lastHitId,
+		sessionBatchSize,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var hits []sessionHit
+	for rows.Next() {
+		var hit sessionHit
+		if err := rows.Scan(&hit.hitId, &hit.timestamp, &hit.siteId, &hit.userId, &hit.event, &hit.pathId, &hit.bot); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		hits = append(hits, hit)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	if len(hits) == 0 {
+		return 0, nil
+	}
+
+	for _, hit := range hits {
+		// Anonymous visitors cannot be told apart, so have no visits
+		if hit.userId == anonymousUserId {
+			continue
+		}
+		if err := stitchHit(ctx, tx, &hit); err != nil {
+			return 0, fmt.Errorf("cannot stitch hit %d: %w", hit.hitId, err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE sessions_progress SET last_hit_id = ?", hits[len(hits)-1].hitId)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(hits), tx.Commit()
+}
+
+func stitchHit(ctx context.Context, tx *sql.Tx, hit *sessionHit) error {
+	var sessionId int64
+	row := tx.QueryRowContext(
+		ctx,
+		"SELECT session_id FROM sessions WHERE site_id = ? AND user_id = ? AND ended >= ? AND started <= ? ORDER BY ended DESC LIMIT 1",
+		hit.siteId,
+		hit.userId,
+		hit.timestamp-sessionTimeout,
+		hit.timestamp+sessionTimeout, // Hits can be written out of order, such as when they are imported
+	)
+	err := row.Scan(&sessionId)
+
+	if err == sql.ErrNoRows {
+		// Only a page load can start a visit. A view or hide event on its own is from a page that
+		// was loaded in an earlier visit, or before we started counting.
+		if hit.event != PageLoad {
+			return nil
+		}
+
+		row := tx.QueryRowContext(
+			ctx,
+			`INSERT INTO sessions (site_id, user_id, started, ended, entry_path_id, exit_path_id, pageviews, bot)
+			VALUES (?, ?, ?, ?, ?, ?, 1, ?)
+			RETURNING session_id`,
+			hit.siteId,
+			hit.userId,
+			hit.timestamp,
+			hit.timestamp,
+			hit.pathId,
+			hit.pathId,
+			hit.bot,
+		)
+		if err := row.Scan(&sessionId); err != nil {
+			return err
+		}
+
+		return insertSessionPage(ctx, tx, sessionId, hit)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch hit.event {
+	case PageLoad:
+		_, err := tx.ExecContext(
+			ctx,
+			`UPDATE sessions SET
+				entry_path_id = CASE WHEN :timestamp < started THEN :path_id ELSE entry_path_id END,
+				exit_path_id = CASE WHEN :timestamp >= ended THEN :path_id ELSE exit_path_id END,
+				started = MIN(started, :timestamp),
+				ended = MAX(ended, :timestamp),
+				pageviews = pageviews + 1,
+				bot = MAX(bot, :bot)
+			WHERE session_id = :session_id`,
+			sql.Named("timestamp", hit.timestamp),
+			sql.Named("path_id", hit.pathId),
+			sql.Named("bot", hit.bot),
+			sql.Named("session_id", sessionId),
+		)
+		if err != nil {
+			return err
+		}
+
+		return insertSessionPage(ctx, tx, sessionId, hit)
+
+	case PageView, PageHide:
+		_, err := tx.ExecContext(
+			ctx,
+			"UPDATE sessions SET ended = MAX(ended, ?), bot = MAX(bot, ?) WHERE session_id = ?",
+			hit.timestamp,
+			hit.bot,
+			sessionId,
+		)
+		if err != nil {
+			return err
+		}
+
+		if hit.event == PageHide {
+			// The time on page runs until the page was last hidden
+			_, err := tx.ExecContext(
+				ctx,
+				`UPDATE session_pages SET duration = :timestamp - timestamp
+				WHERE hit_id = (
+					SELECT hit_id FROM session_pages
+					WHERE session_id = :session_id AND path_id = :path_id AND timestamp <= :timestamp
+					ORDER BY hit_id DESC
+					LIMIT 1
+				)`,
+				sql.Named("timestamp", hit.timestamp),
+				sql.Named("session_id", sessionId),
+				sql.Named("path_id", hit.pathId),
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func insertSessionPage(ctx context.Context, tx *sql.Tx, sessionId int64, hit *sessionHit) error {
+	_, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO session_pages (hit_id, session_id, path_id, timestamp) VALUES (?, ?, ?, ?)",
+		hit.hitId,
+		sessionId,
+		hit.pathId,
+		hit.timestamp,
+	)
+	return err
+}
@@ -1,20 +1,24 @@
-package main
+package sheepcount
 
 import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
-	"io/fs"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,10 +27,28 @@ import (
 )
 
 type SheepCount struct {
-	db      *sql.DB
-	state   *State
-	queries Queries
-	tmpl    Templater
+	db             *sql.DB
+	readDB         *sql.DB // Read-only, for the queries and exports
+	state          *State
+	queries        Queries
+	clickhouse     *clickhouseClient // Nil unless hits are stored in ClickHouse
+	tmpl           Templater
+	ignore         *ignoreRules
+	trustedProxies []*net.IPNet
+	realtime       *Realtime
+	broadcaster    *Broadcaster
+	eventTokenKey  []byte // Nil unless event tokens are required
+	referrerSpam   *referrerSpam
+	geo            *geoRules
+	dailySalt      dailySalt // For daily-site fingerprinting
+	location       *time.Location
+	dedup          *deduplicator
+	oidc           *oidcProvider // Nil unless logging in with OpenID Connect is configured
+	badges         *badges
+	queryCache     *queryCache // Nil unless query_cache_ttl is set
+	sinks          []Sink      // Written to as well as the database
+	hits           chan Hit    // To the database writer
+	rateLimit      func(http.HandlerFunc) http.HandlerFunc
 
 	Config
 
@@ -36,18 +58,123 @@ type SheepCount struct {
 }
 
 type Config struct {
-	Domains   []string `toml:"domains"`
-	Password  string   `toml:"password"`
-	CookieKey string   `toml:"cookie_key"`
-	CSRFKey   string   `toml:"csrf_key"`
+	Domains      []string `toml:"domains"`
+	Password     string   `toml:"password"`
+	PasswordSalt string   `toml:"password_salt"` // If empty, the cookie key is used
+	CookieKey    string   `toml:"cookie_key"`
+	CSRFKey      string   `toml:"csrf_key"`
+
+	// The key that encrypts the auth cookie. If empty, it is derived from the cookie key.
+	CookieEncryptionKey string `toml:"cookie_encryption_key"`
+
+	SessionLifetime time.Duration `toml:"session_lifetime"` // How long logging in to the dashboard lasts
+	CookieSameSite  string        `toml:"cookie_same_site"` // lax (the default) or strict
 
 	HeadersToHash        []string      `toml:"headers"`
+	FingerprintMode      string        `toml:"fingerprint_mode"` // ip-headers (the default), etag, none or daily-site
+	SiteSalts            bool          `toml:"site_salts"`       // With ip-headers, derive salts for each site so visitors cannot be linked between them
 	SaltRotationDuration time.Duration `toml:"rotation_frequency"`
+	AggregationInterval  time.Duration `toml:"aggregation_interval"`
+	GeoIPUpdateInterval  time.Duration `toml:"geoip_update_interval"` // Zero disables updates
+	GCInterval           time.Duration `toml:"gc_interval"`           // How often to delete unused paths, referrers and so on. Zero disables it.
+	MaxEventSize         int64         `toml:"max_event_size"`        // The largest request body, in bytes, that the event endpoint accepts
+	DedupWindow          time.Duration `toml:"dedup_window"`          // Repeats of an event by a visitor on a page within this are dropped. Zero disables it.
+	QueryCacheTTL        time.Duration `toml:"query_cache_ttl"`       // How long the results of dashboard queries are cached, at most. Zero disables it.
+	QueryTimeout         time.Duration `toml:"query_timeout"`         // Dashboard and API queries that take longer are interrupted. Zero disables it.
+	GeoIPDirectory       string        `toml:"geoip_directory"`
+	GeoIPPath            string        `toml:"geoip_path"` // A database kept up to date by something else, instead of downloading one. SIGUSR1 reopens it.
+	SpoolPath            string        `toml:"spool_path"` // Where hits are saved if they cannot be written to the database
 	AllowLocalhost       bool
 	ReverseProxy         bool
-	Hostname             string `toml:"hostname"` // If behind a reverse proxy, the server hostname
+	Hostname             string `toml:"hostname"`          // If behind a reverse proxy or using autocert, the server hostname
+	RespectDNT           bool   `toml:"respect_dnt"`       // Do not record visitors who send Do Not Track or Global Privacy Control
+	RequireConsent       bool   `toml:"require_consent"`   // Hold events in the browser until the site calls sheepcount.grantConsent()
+	TrackClicks          bool   `toml:"track_clicks"`      // Record clicks on outbound links and file downloads
+	TrackEngagement      bool   `toml:"track_engagement"`  // Record scroll depth and time on page when pages are hidden
+	TrackPerformance     bool   `toml:"track_performance"` // Record how long pages took to load
+	TrackTitles          bool   `toml:"track_titles"`      // Record the titles of pages when they are loaded, for the dashboard to show
+	EventTokens          bool   `toml:"event_tokens"`      // Reject events without the token for their site from the script
+
+	// Store no identifiers of visitors, not even for a day, and estimate the unique visitors of
+	// each day instead. Sessions and time on page cannot be worked out without identifiers, and the
+	// hits of every visitor have the same user, so count as one visitor of each page, referrer and
+	// so on.
+	AnonymousVisitors bool `toml:"anonymous_visitors"`
+
+	// Truncate IP addresses to their /24 (IPv4) or /48 (IPv6) network before anything else uses
+	// them, so that visitors are fingerprinted and located, and matched against the ignore rules, by
+	// the network alone. Enabling it changes every identifier, so visitors are counted again.
+	AnonymizeIPs bool `toml:"anonymize_ips"`
+
+	// Look up the location of visitors while their events are handled, rather than in the database
+	// writer, so that their IP addresses are never kept in hits, and wipe the buffers that addresses
+	// are hashed from. The bytes of the address are hashed instead of its text, so enabling it
+	// changes every identifier and visitors are counted again.
+	ForgetIPs bool `toml:"forget_ips"`
+
+	// The time zone, as an IANA name such as Europe/London, whose days the dashboard, reports and
+	// public pages count in. The setting made with `sheepcount admin set-timezone` overrides it, and
+	// accounts can have their own with `sheepcount user set-timezone`. The days of these time zones
+	// are rolled up. Those from before a time zone was first used are counted from rollups of UTC
+	// hours, so in zones that are not a whole number of hours from UTC, such as Asia/Kolkata, they
+	// cannot be counted.
+	Timezone string `toml:"timezone"`
+
+	// Origins whose pages can send events, such as https://www.example.com, or * for any. If empty,
+	// pages of the domains can.
+	CORSOrigins []string `toml:"cors_origins"`
+
+	// Proxies whose Forwarded and X-Forwarded-For headers are trusted, as IP addresses or CIDR ranges
+	TrustedProxies []string `toml:"trusted_proxies"`
+
+	// Domains whose stats anyone can see, without logging in, at /public/<domain>
+	PublicSites []string `toml:"public_sites"`
+
+	// Domains whose pageviews anyone can show as badges at /badge/<domain>/<path>.svg, on top of the
+	// public sites
+	BadgeSites []string `toml:"badge_sites"`
+
+	// Page loads and custom events to count as conversions
+	Goals []GoalConfig `toml:"goals"`
+
+	// Where hits are stored: sqlite, the default, or clickhouse, for sites with more traffic than
+	// SQLite can keep up with. With clickhouse, hits are written to the [clickhouse] server and
+	// counted from there, and the database only has the accounts, settings and annotations.
+	Storage string `toml:"storage"`
+
+	// Where hits are written to as well as the database, such as files or other SheepCounts
+	Sinks []SinkConfig `toml:"sinks"`
+
+	// Names for referring domains, such as "t.co" = "Twitter", on top of the built in ones. An empty
+	// name removes a built in one.
+	ReferrerGroups map[string]string `toml:"referrer_groups"`
+
+	Paths         PathConfig          `toml:"paths"`
+	Endpoints     EndpointConfig      `toml:"endpoints"`
+	Ignore        IgnoreConfig        `toml:"ignore"`
+	Geo           GeoConfig           `toml:"geo"`
+	ReferrerSpam  ReferrerSpamConfig  `toml:"referrer_spam"`
+	PageTitles    PageTitlesConfig    `toml:"page_titles"`
+	Report        ReportConfig        `toml:"report"`
+	Backup        BackupConfig        `toml:"backup"`
+	Maintenance   MaintenanceConfig   `toml:"maintenance"`
+	Alerts        AlertConfig         `toml:"alerts"`
+	RateLimit     RateLimitConfig     `toml:"rate_limit"`
+	TLS           TLSConfig           `toml:"tls"`
+	OIDC          OIDCConfig          `toml:"oidc"`
+	Socket        SocketConfig        `toml:"socket"`
+	AdminListener AdminListenerConfig `toml:"admin_listener"`
+	Telemetry     TelemetryConfig     `toml:"telemetry"`
+	ClickHouse    ClickHouseConfig    `toml:"clickhouse"`
+
+	// Addresses to serve on all at once, instead of the --port or --socket flag, such as
+	// 127.0.0.1:4444 for the event endpoint behind one proxy and a Unix socket behind another. With
+	// a Unix socket among them, requests are taken to come through a reverse proxy.
+	Listeners []ListenerConfig `toml:"listeners"`
 }
 
+const statePath = "sheepcount.state"
+
 type State struct {
 	Salts Salts `json:"salts"`
 	GeoIP GeoIP `json:"geoip"`
@@ -75,45 +202,300 @@ type Queries interface {
 }
 
 type Query interface {
-	QueryRowContext(context.Context, ...interface{}) *sql.Row
+	QueryRowContext(context.Context, ...interface{}) Row
+	Manifest() *queryManifest
+}
+
+// The single row of JSON that a query returns, which *sql.Row is for SQLite.
+type Row interface {
+	Scan(dest ...interface{}) error
 }
 
-func NewSheepCount(db *sql.DB, config Config) (*SheepCount, error) {
+func NewSheepCount(db *sql.DB, readDB *sql.DB, config Config) (*SheepCount, error) {
 	tmpl, err := NewTemplates()
 	if err != nil {
 		return nil, err
 	}
 
-	queries, err := NewQueries(db)
+	settings, err := dbSettings(context.Background(), db)
+	if err != nil {
+		return nil, err
+	}
+	config.applySettings(settings)
+
+	if err := config.Endpoints.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Paths.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.OIDC.validate(); err != nil {
+		return nil, err
+	}
+	// Anything else would silently be lax
+	if config.CookieSameSite != "lax" && config.CookieSameSite != "strict" {
+		return nil, fmt.Errorf("cookie_same_site must be lax or strict, not %q", config.CookieSameSite)
+	}
+	if err := validateGoals(config.Goals); err != nil {
+		return nil, err
+	}
+	if err := validateCORSOrigins(config.CORSOrigins); err != nil {
+		return nil, err
+	}
+
+	ignore, err := config.Ignore.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	referrerSpam, err := newReferrerSpam(&config.ReferrerSpam)
+	if err != nil {
+		return nil, err
+	}
+
+	sinks, err := newSinks(config.Sinks)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := referrerGroups(config.ReferrerGroups)
+	if err != nil {
+		return nil, err
+	}
+	if err := dbSetReferrerGroups(context.Background(), db, groups); err != nil {
+		return nil, fmt.Errorf("cannot set referrer groups: %w", err)
+	}
+
+	queries, clickhouse, err := config.newQueries(readDB)
+	if err != nil {
+		return nil, err
+	}
+
+	// The sites are not added by writing their hits to ClickHouse, but annotations refer to them
+	if clickhouse != nil {
+		if err := dbAddSites(context.Background(), db, config.Domains); err != nil {
+			return nil, fmt.Errorf("cannot add sites: %w", err)
+		}
+	}
+
+	trustedProxies, err := parseNetworks(config.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+
+	fingerprinter, err := newFingerprinter(config.FingerprintMode)
 	if err != nil {
 		return nil, err
 	}
 
+	location, err := config.location()
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone: %w", err)
+	}
+
+	var eventTokenKey []byte
+	if config.EventTokens {
+		if eventTokenKey, err = dbEventTokenKey(context.Background(), db); err != nil {
+			return nil, fmt.Errorf("cannot load event token key: %w", err)
+		}
+	}
+
+	var oidc *oidcProvider
+	if config.OIDC.Enabled() {
+		oidc = newOIDCProvider(&config.OIDC)
+	}
+
 	state := &State{}
-	if err := state.Load("sheepcount.state", &config); err != nil {
+	if err := state.Load(statePath, &config); err != nil {
 		return nil, fmt.Errorf("cannot load state: %w", err)
 	}
 
+	// Loading generates or rotates the salts if they are new or out of date
+	if err := state.Save(statePath); err != nil {
+		return nil, fmt.Errorf("cannot persist state: %w", err)
+	}
+
 	sheepcount := &SheepCount{
-		db:      db,
-		state:   state,
-		queries: queries,
-		tmpl:    tmpl,
-		Config:  config,
+		db:             db,
+		readDB:         readDB,
+		state:          state,
+		queries:        queries,
+		clickhouse:     clickhouse,
+		tmpl:           tmpl,
+		ignore:         ignore,
+		trustedProxies: trustedProxies,
+		realtime:       NewRealtime(),
+		broadcaster:    NewBroadcaster(),
+		eventTokenKey:  eventTokenKey,
+		referrerSpam:   referrerSpam,
+		geo:            config.Geo.compile(),
+		location:       location,
+		dedup:          newDeduplicator(config.DedupWindow),
+		oidc:           oidc,
+		badges:         newBadges(),
+		queryCache:     newQueryCache(config.QueryCacheTTL),
+		sinks:          sinks,
+		hits:           make(chan Hit, 1024),
+		Config:         config,
+		fingerprinter:  fingerprinter,
+	}
+
+	if sheepcount.rateLimit, err = newRateLimit(sheepcount); err != nil {
+		return nil, err
+	}
+
+	return sheepcount, nil
+}
+
+// Open the database at the given path, creating or migrating it if needed, for a SheepCount that is
+// embedded in another program. The program serves Handler and runs RunBackground until it exits,
+// and then calls Close.
+func New(databasePath string, config Config) (*SheepCount, error) {
+	db, err := dbConnect(databasePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open database: %w", err)
+	}
+
+	readDB, err := dbConnectReadOnly(databasePath)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot open database: %w", err)
+	}
+
+	sheepcount, err := NewSheepCount(db, readDB, config)
+	if err != nil {
+		readDB.Close()
+		db.Close()
+		return nil, err
 	}
 
 	return sheepcount, nil
 }
 
-func (sheepcount *SheepCount) Run(ctx context.Context, socket net.Listener) error {
+// Close the databases opened by New.
+func (sheepcount *SheepCount) Close() error {
+	if _, err := sheepcount.db.Exec("PRAGMA optimize"); err != nil {
+		log.Print(err)
+	}
+
+	readErr := sheepcount.readDB.Close()
+	if err := sheepcount.db.Close(); err != nil {
+		return err
+	}
+	return readErr
+}
+
+// Serve on the sockets, and run the background goroutines, until the context is cancelled. With a
+// separate admin listener, the sockets only serve the public endpoints.
+func (sheepcount *SheepCount) Run(ctx context.Context, sockets []net.Listener) error {
+	// Set up TLS before starting anything so that configuration errors are reported immediately
+	var tlsConfig *tls.Config
+	var redirectSocket net.Listener
+	var redirectHandler http.Handler
+	if sheepcount.TLS.Enabled() {
+		var err error
+		tlsConfig, redirectHandler, err = sheepcount.tlsConfig()
+		if err != nil {
+			return err
+		}
+
+		if sheepcount.TLS.RedirectAddress != "" {
+			redirectSocket, err = net.Listen("tcp", sheepcount.TLS.RedirectAddress)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	options := sheepcount.prepareSockets(sockets, tlsConfig)
+
+	var adminSocket net.Listener
+	if sheepcount.AdminListener.Enabled() {
+		// Over TCP, it is served with TLS when the main address is, as the session cookies are then
+		// only sent over HTTPS
+		var err error
+		adminSocket, err = sheepcount.AdminListener.listen(tlsConfig)
+		if err != nil {
+			if redirectSocket != nil {
+				redirectSocket.Close()
+			}
+			return fmt.Errorf("admin listener: %w", err)
+		}
+	}
+
 	errgrp, ctx := errgroup.WithContext(ctx)
 
-	hits := make(chan Hit, 1024)
+	errgrp.Go(func() error {
+		return sheepcount.RunBackground(ctx)
+	})
+
+	// Run a server until the context is cancelled, and then give it a bit of time to shut down
+	serve := func(srv *http.Server, socket net.Listener) {
+		errgrp.Go(func() error {
+			if err := srv.Serve(socket); err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		})
+
+		errgrp.Go(func() error {
+			<-ctx.Done()
+
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			return srv.Shutdown(shutdownCtx)
+		})
+	}
+
+	// Each socket has its own server, as Shutdown closes every socket of a server, and its own
+	// options, but they share the routes
+	if adminSocket != nil {
+		mux := sheepcount.routes(sheepcount.publicRoutes)
+		for i, socket := range sockets {
+			serve(&http.Server{Handler: sheepcount.wrapHandler(mux, options[i])}, socket)
+		}
+
+		// Shutdown waits for active connections, so end the long-lived event streams
+		adminOptions := sheepcount.socketOptions(adminSocket, tlsConfig != nil)
+		adminSrv := &http.Server{Handler: sheepcount.wrapHandler(sheepcount.routes(sheepcount.adminRoutes), adminOptions)}
+		adminSrv.RegisterOnShutdown(sheepcount.broadcaster.Close)
+		serve(adminSrv, adminSocket)
+	} else {
+		mux := sheepcount.routes(sheepcount.publicRoutes, sheepcount.adminRoutes)
+		for i, socket := range sockets {
+			srv := &http.Server{Handler: sheepcount.wrapHandler(mux, options[i])}
+			srv.RegisterOnShutdown(sheepcount.broadcaster.Close)
+			serve(srv, socket)
+		}
+	}
+
+	if redirectSocket != nil {
+		serve(&http.Server{Handler: recoverer(redirectHandler)}, redirectSocket)
+	}
+
+	return errgrp.Wait()
+}
+
+// Write hits to the database and keep the rollups, salts and everything else up to date until the
+// context is cancelled.
+func (sheepcount *SheepCount) RunBackground(ctx context.Context) error {
+	errgrp, ctx := errgroup.WithContext(ctx)
 
 	errgrp.Go(func() error {
-		return DatabaseWriter(ctx, sheepcount.db, hits)
+		return DatabaseWriter(ctx, sheepcount.db, sheepcount.clickhouse, NewSpool(sheepcount.SpoolPath), sheepcount.hits, &sheepcount.state.GeoIP, sheepcount.geo, sheepcount.GCInterval, sheepcount.sinks)
 	})
 
+	// Goroutine to keep the rollups up-to-date, which ClickHouse does without
+	if sheepcount.clickhouse == nil {
+		errgrp.Go(func() error {
+			if err := dbSetRollupTimezones(ctx, sheepcount.db, sheepcount.location); err != nil {
+				return fmt.Errorf("cannot set the time zones to roll up: %w", err)
+			}
+			return Aggregator(ctx, sheepcount.db, sheepcount.AggregationInterval, sheepcount.queryCache.Invalidate)
+		})
+	}
+
 	// Goroutine to rotate the salts and delete expired identifiers
 	errgrp.Go(func() error {
 		// When is the next time we need to rotate the salts?
@@ -128,17 +510,8 @@ func (sheepcount *SheepCount) Run(ctx context.Context, socket net.Listener) erro
 				return ctx.Err()
 
 			case <-after:
-				if err := sheepcount.state.Salts.Rotate(); err != nil {
-					return fmt.Errorf("error rotating salts: %w", err)
-				}
-
-				n, err := dbDeleteExpired(ctx, 2*sheepcount.SaltRotationDuration, sheepcount.db)
-				if err != nil {
-					return fmt.Errorf("cannot delete expired identifiers: %w", err)
-				}
-
-				if n > 0 {
-					log.Printf("Deleted %d expired identifiers.", n)
+				if err := sheepcount.rotateSalts(ctx); err != nil {
+					return err
 				}
 			}
 		}
@@ -153,115 +526,243 @@ func (sheepcount *SheepCount) Run(ctx context.Context, socket net.Listener) erro
 				return ctx.Err()
 
 			case <-ticker.C:
-				if err := sheepcount.state.Salts.Rotate(); err != nil {
-					return fmt.Errorf("error rotating salts: %w", err)
-				}
-
-				n, err := dbDeleteExpired(ctx, 2*sheepcount.SaltRotationDuration, sheepcount.db)
-				if err != nil {
-					return fmt.Errorf("cannot delete expired identifiers: %w", err)
-				}
-
-				if n > 0 {
-					log.Printf("Deleted %d expired identifiers.", n)
+				if err := sheepcount.rotateSalts(ctx); err != nil {
+					return err
 				}
 			}
 		}
 	})
 
-	// Goroutine to keep geolocation database up-to-date
-	errgrp.Go(func() error {
-		ticker := time.NewTicker(6 * time.Hour)
-		defer ticker.Stop()
+	// Goroutine to keep geolocation database up-to-date, unless something else does
+	if sheepcount.GeoIPPath != "" {
+		if geoIPReloadSignal != nil {
+			errgrp.Go(func() error {
+				return sheepcount.state.GeoIP.ReloadOnSignal(ctx)
+			})
+		}
+	} else if sheepcount.GeoIPUpdateInterval > 0 {
+		errgrp.Go(func() error {
+			ticker := time.NewTicker(sheepcount.GeoIPUpdateInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+
+				case <-ticker.C:
+					if err := sheepcount.state.GeoIP.Update(); err != nil {
+						log.Printf("Cannot update GeoIP database: %s", err)
+						continue
+					}
+
+					// Persist the new path and etag straight away so that a crash does not leave
+					// the state pointing at a database that has been deleted.
+					if err := sheepcount.state.Save(statePath); err != nil {
+						log.Printf("Cannot persist state: %s", err)
+					}
+				}
+			}
+		})
+	}
 
-		for {
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
+	// Goroutine to keep the referrer spam list up-to-date
+	if sheepcount.ReferrerSpam.URL != "" {
+		errgrp.Go(func() error {
+			ticker := time.NewTicker(sheepcount.ReferrerSpam.RefreshInterval)
+			defer ticker.Stop()
 
-			case <-ticker.C:
-				if err := sheepcount.state.GeoIP.Update(); err != nil {
-					log.Printf("Cannot update GeoIP database: %s", err)
+			for {
+				if err := sheepcount.referrerSpam.Refresh(ctx, sheepcount.ReferrerSpam.URL); err != nil {
+					log.Printf("Cannot refresh referrer spam list: %s", err)
+				}
+
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-ticker.C:
 				}
 			}
-		}
-	})
+		})
+	}
+
+	// Goroutine to look up the titles of pages
+	if sheepcount.PageTitles.Enabled() {
+		errgrp.Go(func() error {
+			return sheepcount.PageTitler(ctx)
+		})
+	}
+
+	// Goroutine to send email reports
+	if sheepcount.Report.Schedule != "" {
+		errgrp.Go(func() error {
+			return Reporter(ctx, sheepcount.queries, sheepcount.tmpl, &sheepcount.Config)
+		})
+	}
+
+	// Goroutine to back up the database
+	if sheepcount.Backup.Schedule != "" {
+		errgrp.Go(func() error {
+			return Backuper(ctx, sheepcount.db, &sheepcount.Backup)
+		})
+	}
+
+	// Goroutine to keep the write-ahead log small, drop old hits and check for corruption
+	if sheepcount.Maintenance.CheckpointInterval > 0 || sheepcount.Maintenance.IntegrityCheck != "" || sheepcount.Maintenance.RetentionMonths > 0 {
+		errgrp.Go(func() error {
+			return Maintainer(ctx, sheepcount.db, sheepcount.readDB, &sheepcount.Maintenance)
+		})
+	}
+
+	// Goroutine to send alerts about unusual traffic
+	if sheepcount.Alerts.WebhookURL != "" {
+		errgrp.Go(func() error {
+			return Monitor(ctx, sheepcount.db, &sheepcount.Alerts)
+		})
+	}
 
 	// Goroutine to persist state on exit
 	errgrp.Go(func() error {
 		<-ctx.Done()
 
-		if err := sheepcount.state.Save("sheepcount.state"); err != nil {
+		// End the event streams too, as no more hits will be broadcast, so that the server that
+		// serves Handler can shut down
+		sheepcount.broadcaster.Close()
+
+		if err := sheepcount.state.Save(statePath); err != nil {
 			return fmt.Errorf("error persisting state: %w", err)
 		}
 
 		return nil
 	})
 
-	// Create the HTTP server
+	return errgrp.Wait()
+}
+
+// The handler of every endpoint, which mounts them at the same paths as the standalone server does.
+// Hits are only written while RunBackground is running.
+func (sheepcount *SheepCount) Handler() http.Handler {
+	return sheepcount.wrapHandler(sheepcount.routes(sheepcount.publicRoutes, sheepcount.adminRoutes), sheepcount.configOptions())
+}
+
+// Serves the script, the event endpoint, the tracking pixel, and the public dashboards and badges,
+// which visitors and other sites must be able to reach.
+func (sheepcount *SheepCount) PublicHandler() http.Handler {
+	return sheepcount.wrapHandler(sheepcount.routes(sheepcount.publicRoutes), sheepcount.configOptions())
+}
+
+// Serves the dashboard, logging in, the queries and the API, which only its users need to reach.
+func (sheepcount *SheepCount) AdminHandler() http.Handler {
+	return sheepcount.wrapHandler(sheepcount.routes(sheepcount.adminRoutes), sheepcount.configOptions())
+}
+
+// A mux with the routes, and the routes that every listener serves.
+func (sheepcount *SheepCount) routes(add ...func(*http.ServeMux)) *http.ServeMux {
 	mux := http.NewServeMux()
+	for _, routes := range add {
+		routes(mux)
+	}
+	sheepcount.commonRoutes(mux)
+	return mux
+}
+
+func (sheepcount *SheepCount) publicRoutes(mux *http.ServeMux) {
+	rateLimit := sheepcount.rateLimit
+	if rateLimit == nil {
+		rateLimit = func(next http.HandlerFunc) http.HandlerFunc { return next }
+	}
+
+	mux.HandleFunc(sheepcount.Endpoints.Event, rateLimit(func(w http.ResponseWriter, r *http.Request) { handleEvent(sheepcount, sheepcount.hits, w, r) }))
+	mux.HandleFunc(sheepcount.Endpoints.Pixel, rateLimit(func(w http.ResponseWriter, r *http.Request) { handlePixel(sheepcount, sheepcount.hits, w, r) }))
+	mux.Handle(sheepcount.Endpoints.Script, gzipResponse(http.HandlerFunc(sheepcount.handleJavascript)))
+	// Other SheepCounts forward hits here
+	mux.HandleFunc("/api/v1/hits", func(w http.ResponseWriter, r *http.Request) {
+		handleForwardedHits(sheepcount, sheepcount.hits, w, r)
+	})
+	mux.HandleFunc("/public/", func(w http.ResponseWriter, r *http.Request) {
+		handlePublic(sheepcount, w, r)
+	})
+	mux.HandleFunc("/badge/", func(w http.ResponseWriter, r *http.Request) {
+		handleBadge(sheepcount, w, r)
+	})
+}
+
+func (sheepcount *SheepCount) adminRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { handleHome(sheepcount, w, r) })
-	mux.HandleFunc("/event", func(w http.ResponseWriter, r *http.Request) { handleEvent(sheepcount, hits, w, r) })
-	mux.HandleFunc("/count.js", sheepcount.handleJavascript)
-	mux.HandleFunc("/queries/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/map", func(w http.ResponseWriter, r *http.Request) { handleMap(sheepcount, w, r) })
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) { handleEvents(sheepcount, w, r) })
+	mux.HandleFunc("/snippet", func(w http.ResponseWriter, r *http.Request) { handleSnippet(sheepcount, w, r) })
+	mux.HandleFunc("/embed", func(w http.ResponseWriter, r *http.Request) { handleEmbed(sheepcount, w, r) })
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(sheepcount, r, "") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		expvar.Handler().ServeHTTP(w, r)
+	})
+	mux.Handle("/queries/", gzipResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		handleQueries(sheepcount, w, r)
+	})))
+	mux.HandleFunc("/events/stream", func(w http.ResponseWriter, r *http.Request) {
+		handleStream(sheepcount, w, r)
+	})
+	mux.HandleFunc("/api/realtime", func(w http.ResponseWriter, r *http.Request) {
+		handleRealtime(sheepcount, w, r)
+	})
+	mux.HandleFunc("/api/annotations", func(w http.ResponseWriter, r *http.Request) {
+		handleAnnotations(sheepcount, w, r)
+	})
+	mux.HandleFunc("/api/v1/erase", func(w http.ResponseWriter, r *http.Request) {
+		handleErase(sheepcount, w, r)
+	})
+	mux.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		handleAPI(sheepcount, w, r)
+	})
+	mux.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) {
+		handleExport(sheepcount, w, r)
 	})
 	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
 		handleLogin(sheepcount, w, r)
 	})
+	mux.HandleFunc("/login/totp", func(w http.ResponseWriter, r *http.Request) {
+		handleSecondFactor(sheepcount, w, r)
+	})
+	mux.HandleFunc("/login/oidc", func(w http.ResponseWriter, r *http.Request) {
+		handleOIDCLogin(sheepcount, w, r)
+	})
+	mux.HandleFunc("/login/oidc/callback", func(w http.ResponseWriter, r *http.Request) {
+		handleOIDCCallback(sheepcount, w, r)
+	})
 	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
 		handleLogout(sheepcount, w, r)
 	})
+}
+
+// Health checks, and the stylesheets and scripts of both the dashboard and the public dashboards
+func (sheepcount *SheepCount) commonRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { handleHealthz(sheepcount, w, r) })
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) { handleReadyz(sheepcount, sheepcount.hits, w, r) })
 	mux.HandleFunc("/static/", func(w http.ResponseWriter, r *http.Request) {
-		http.FileServer(http.FS(contentFs)).ServeHTTP(w, r)
+		handleStatic(w, r, strings.TrimPrefix(r.URL.Path, "/static/"))
 	})
 	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-
-		f, err := contentFs.Open("static/favicon.ico")
-		if errors.Is(err, fs.ErrNotExist) {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		defer f.Close()
-
-		w.Header().Set("Content-Type", "image/x-icon")
-		io.Copy(w, f)
+		handleStatic(w, r, "favicon.ico")
 	})
+}
 
-	srv := http.Server{Handler: recoverer(ipAddress(sheepcount.ReverseProxy, mux))}
-
-	// Goroutine to run the server
-	errgrp.Go(func() error {
-		if err := srv.Serve(socket); err != http.ErrServerClosed {
-			return err
-		}
-		return nil
-	})
-
-	// Goroutine to shutdown the server gracefully
-	errgrp.Go(func() error {
-		<-ctx.Done()
-
-		// Give the server a bit of time to shutdown
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-
-		return srv.Shutdown(shutdownCtx)
-	})
+// Each listener has its own wrapper, as whether the proxy headers are trusted depends on it.
+func (sheepcount *SheepCount) wrapHandler(mux *http.ServeMux, options listenerOptions) http.Handler {
+	var handler http.Handler = mux
+	if sheepcount.Telemetry.Enabled {
+		handler = traceRequests(mux)
+	}
 
-	return errgrp.Wait()
+	handler = ipAddress(options.reverseProxy, sheepcount.trustedProxies, sheepcount.ForgetIPs, handler)
+	return recoverer(withListenerOptions(options, handler))
 }
 
 func (sheepcount *SheepCount) getHost(r *http.Request) string {
-	if sheepcount.ReverseProxy {
+	if sheepcount.listenerOptions(r).reverseProxy {
 		return sheepcount.Hostname
 	} else {
 		return r.Host
@@ -274,21 +775,7 @@ func (sheepcount *SheepCount) handleJavascript(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	var eventUrl url.URL
-	eventUrl.Path = "event"
-	if sheepcount.ReverseProxy {
-		eventUrl.Scheme = "https"
-		eventUrl.Host = sheepcount.Hostname
-	} else {
-		if r.TLS == nil {
-			eventUrl.Scheme = "http"
-		} else {
-			eventUrl.Scheme = "https"
-		}
-		eventUrl.Host = r.Host
-	}
-
-	js, hash, err := sheepJS(sheepcount.tmpl, sheepcount.AllowLocalhost, eventUrl.String())
+	js, hash, err := sheepcount.script(sheepcount.listenerOptions(r).allowLocalhost)
 	if err != nil {
 		log.Printf("cannot serve javascript: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -301,52 +788,125 @@ func (sheepcount *SheepCount) handleJavascript(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	// Sites must be able to fetch the script with CORS to check its integrity
+	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Cache-Control", "max-age=86400, must-revalidate")
 	w.Header().Set("Content-Type", "application/javascript")
 	w.Header().Set("ETag", etag)
 	w.Write(js)
 }
 
-func (sheepcount *SheepCount) fingerprintRequest(r *http.Request) ([]byte, []byte, Error) {
-	if sheepcount.fingerprinter != nil {
-		return sheepcount.fingerprinter(sheepcount, r)
+// The Javascript served at the script endpoint and its hash. It only depends on the configuration
+// and whether the listener allows hits from localhost.
+func (sheepcount *SheepCount) script(allowLocalhost bool) ([]byte, []byte, error) {
+	params := scriptParams{
+		AllowLocalhost:   allowLocalhost,
+		RespectDNT:       sheepcount.RespectDNT,
+		RequireConsent:   sheepcount.RequireConsent,
+		TrackClicks:      sheepcount.TrackClicks,
+		TrackEngagement:  sheepcount.TrackEngagement,
+		TrackPerformance: sheepcount.TrackPerformance,
+		TrackTitles:      sheepcount.TrackTitles,
+		ETagIdentifier:   sheepcount.FingerprintMode == "etag",
+		HashRouting:      sheepcount.Paths.HashRouting != "",
+		EventTokens:      sheepcount.eventTokens(allowLocalhost),
+		EventPath:        sheepcount.Endpoints.relativeEvent(),
 	}
 
-	sheepcount.state.Salts.RLock()
-	defer sheepcount.state.Salts.RUnlock()
-
-	hasherCurrent, err := blake2b.New(blake2b.Size256, sheepcount.state.Salts.Current[:])
-	if err != nil {
-		return nil, nil, NewInternalError(err)
-	}
+	return sheepJS(sheepcount.tmpl, params)
+}
 
-	hasherPrevious, err := blake2b.New(blake2b.Size256, sheepcount.state.Salts.Previous[:])
-	if err != nil {
-		return nil, nil, NewInternalError(err)
+// The scheme and host that visitors use to reach this server.
+func (sheepcount *SheepCount) baseURL(r *http.Request) url.URL {
+	var u url.URL
+	if sheepcount.listenerOptions(r).reverseProxy {
+		u.Scheme = "https"
+		u.Host = sheepcount.Hostname
+	} else if sheepcount.AdminListener.Enabled() {
+		// Snippets are shown on the admin listener, but sites must load the script from the public one
+		u.Scheme = "http"
+		if sheepcount.TLS.Enabled() {
+			u.Scheme = "https"
+		}
+		u.Host = sheepcount.Hostname
+	} else {
+		if r.TLS == nil {
+			u.Scheme = "http"
+		} else {
+			u.Scheme = "https"
+		}
+		u.Host = r.Host
 	}
+	return u
+}
 
-	hasherCurrent.Write([]byte(r.RemoteAddr))
-	hasherPrevious.Write([]byte(r.RemoteAddr))
-
-	for _, header := range sheepcount.HeadersToHash {
-		hasherCurrent.Write([]byte(r.Header.Get(header)))
-		hasherPrevious.Write([]byte(r.Header.Get(header)))
+func (sheepcount *SheepCount) fingerprintRequest(r *http.Request) ([]byte, []byte, Error) {
+	if sheepcount.fingerprinter != nil {
+		return sheepcount.fingerprinter(sheepcount, r)
 	}
 
-	return hasherCurrent.Sum(nil), hasherPrevious.Sum(nil), nil
+	return fingerprintIPHeaders(sheepcount, r)
 }
 
 func DefaultConfig() Config {
 	return Config{
 		HeadersToHash:        []string{"User-Agent", "Accept-Encoding", "Accept-Language"},
 		SaltRotationDuration: 12 * time.Hour,
+		AggregationInterval:  5 * time.Minute,
+		GeoIPUpdateInterval:  6 * time.Hour,
+		GCInterval:           24 * time.Hour,
+		MaxEventSize:         128 << 10,
+		DedupWindow:          5 * time.Second,
+		QueryTimeout:         30 * time.Second,
+		SessionLifetime:      7 * 24 * time.Hour,
+		CookieSameSite:       "lax",
+		GeoIPDirectory:       ".",
+		SpoolPath:            "sheepcount.spool",
 		AllowLocalhost:       false,
 		ReverseProxy:         false,
 		Hostname:             "",
+		Timezone:             "UTC",
+		Storage:              storageSQLite,
+		Endpoints: EndpointConfig{
+			Script: "/count.js",
+			Event:  "/event",
+			Pixel:  "/sheep.gif",
+		},
+		ReferrerSpam: ReferrerSpamConfig{
+			RefreshInterval: 24 * time.Hour,
+		},
+		PageTitles: PageTitlesConfig{
+			RefreshInterval: 24 * time.Hour,
+		},
+		Backup: BackupConfig{
+			Directory: "backups",
+		},
+		Maintenance: MaintenanceConfig{
+			CheckpointInterval: time.Hour,
+			IntegrityCheck:     "@weekly",
+		},
+		Alerts: AlertConfig{
+			CheckInterval: 5 * time.Minute,
+			SpikeFactor:   3,
+			MinPageviews:  20,
+			ReferrerShare: 0.5,
+		},
+		TLS: TLSConfig{
+			CacheDir:        "certs",
+			Address:         ":443",
+			RedirectAddress: ":80",
+		},
+		Telemetry: TelemetryConfig{
+			Endpoint:    "localhost:4318",
+			SampleRatio: 1,
+		},
 	}
 }
 
 func (state *State) Load(statePath string, config *Config) error {
+	state.GeoIP.dir = config.GeoIPDirectory
+	state.GeoIP.external = config.GeoIPPath
+
 	f, err := os.Open(statePath)
 	if errors.Is(err, os.ErrNotExist) {
 		if err := state.Salts.Load(config.SaltRotationDuration); err != nil {
@@ -389,27 +949,50 @@ func (state *State) Load(statePath string, config *Config) error {
 	return nil
 }
 
+// Write the state to a temporary file and rename it over the old one, so that a crash part way
+// through leaves either the old or the new state and never a mixture of the two.
 func (state *State) Save(statePath string) error {
 	state.Salts.RLock()
-	defer state.Salts.RUnlock()
-
 	contents, err := json.Marshal(state)
+	state.Salts.RUnlock()
 	if err != nil {
 		return err
 	}
 
-	f, err := os.OpenFile(statePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	tmp := statePath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	_, err = f.Write(contents)
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, statePath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Make the rename itself durable
+	dir, err := os.Open(filepath.Dir(statePath))
 	if err != nil {
 		return err
 	}
+	defer dir.Close()
 
-	return nil
+	return dir.Sync()
 }
 
 func (salts *Salts) Load(rotationFreq time.Duration) error {
@@ -436,6 +1019,29 @@ func (salts *Salts) Load(rotationFreq time.Duration) error {
 	return nil
 }
 
+// Rotate the salts, persist them straight away so that a crash does not lose the new salt and
+// count every visitor again, and delete the identifiers made with the salt that was dropped.
+func (sheepcount *SheepCount) rotateSalts(ctx context.Context) error {
+	if err := sheepcount.state.Salts.Rotate(); err != nil {
+		return fmt.Errorf("error rotating salts: %w", err)
+	}
+
+	if err := sheepcount.state.Save(statePath); err != nil {
+		log.Printf("Cannot persist state: %s", err)
+	}
+
+	n, err := dbDeleteExpired(ctx, 2*sheepcount.SaltRotationDuration, sheepcount.db)
+	if err != nil {
+		return fmt.Errorf("cannot delete expired identifiers: %w", err)
+	}
+
+	if n > 0 {
+		log.Printf("Deleted %d expired identifiers.", n)
+	}
+
+	return nil
+}
+
 func (salts *Salts) Rotate() error {
 	salts.Lock()
 	defer salts.Unlock()
@@ -453,35 +1059,154 @@ func (salts *Salts) Rotate() error {
 }
 
 func handleEvent(sheepcount *SheepCount, hits chan<- Hit, w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		handlePreflight(sheepcount, w, r)
+		return
+	}
+
+	if r.Method == http.MethodGet && sheepcount.FingerprintMode == "etag" {
+		if !sheepcount.cors(w, r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		handleIdentifier(sheepcount, w, r)
+		return
+	}
+
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !sheepcount.cors(w, r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	debug := r.URL.Query().Get("debug") == "1"
+	if debug && !sheepcount.canDebug(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 
-	hit, err := NewHit(sheepcount, r)
+	if sheepcount.RespectDNT && doNotTrack(r) {
+		if debug {
+			writeDebugResponse(w, debugResponse{Hits: []debugHit{}, Ignored: "do not track"})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, sheepcount.MaxEventSize)
+
+	batch, err := NewHits(sheepcount, r)
 	if err != nil {
-		w.WriteHeader(err.StatusCode())
+		if ignored, ok := err.(*ErrIgnored); ok {
+			if debug {
+				writeDebugResponse(w, debugResponse{Hits: []debugHit{}, Ignored: ignored.reason})
+				return
+			}
+			w.WriteHeader(err.StatusCode())
+			return
+		}
 		log.Print(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(err.StatusCode())
+		json.NewEncoder(w).Encode(struct {
+			Error string `json:"error"`
+		}{
+			Error: err.Error(),
+		})
 		return
 	}
 
-	hits <- hit
+	if debug {
+		response := debugResponse{Hits: make([]debugHit, 0, len(batch))}
+		for _, hit := range batch {
+			response.Hits = append(response.Hits, newDebugHit(sheepcount, hit))
+		}
+		writeDebugResponse(w, response)
+		return
+	}
+
+	for _, hit := range batch {
+		sheepcount.submit(hits, hit)
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func sheepJS(tmpl Templater, allowLocalhost bool, url string) ([]byte, []byte, error) {
-	var buf bytes.Buffer
+// Pass a new hit to the live dashboards and then to the database writer, unless it is a duplicate.
+func (sheepcount *SheepCount) submit(hits chan<- Hit, hit Hit) {
+	if sheepcount.dedup.Duplicate(&hit) {
+		duplicateHits.Add(1)
+		return
+	}
 
-	params := struct {
-		AllowLocalhost bool
-		Url            string
-	}{
-		AllowLocalhost: allowLocalhost,
-		Url:            url,
+	sheepcount.realtime.Record(&hit)
+	sheepcount.broadcaster.Publish(&hit)
+	hits <- hit
+}
+
+// Has the visitor asked not to be tracked with either the Do Not Track or Global Privacy Control
+// headers?
+func doNotTrack(r *http.Request) bool {
+	return r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+}
+
+// A transparent 1x1 GIF
+var pixelGif = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// Tracking pixel for visitors with Javascript disabled.
+func handlePixel(sheepcount *SheepCount, hits chan<- Hit, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
 	}
 
+	if !(sheepcount.RespectDNT && doNotTrack(r)) {
+		hit, err := NewPixelHit(sheepcount, r)
+		if _, ok := err.(*ErrIgnored); err != nil && !ok {
+			w.WriteHeader(err.StatusCode())
+			log.Print(err)
+			return
+		}
+
+		if err == nil {
+			sheepcount.submit(hits, hit)
+		}
+	}
+
+	// Every page view must request the pixel again
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Content-Length", strconv.Itoa(len(pixelGif)))
+	w.Write(pixelGif)
+}
+
+// Parameters for the Javascript template
+type scriptParams struct {
+	AllowLocalhost   bool
+	RespectDNT       bool
+	RequireConsent   bool
+	TrackClicks      bool
+	TrackEngagement  bool
+	TrackPerformance bool
+	TrackTitles      bool
+	ETagIdentifier   bool              // Fetch the identifier of the visitor before sending events
+	HashRouting      bool              // Count changes to the route in the fragment as page loads
+	EventTokens      map[string]string // The token for each domain, if tokens are required
+	EventPath        string            // Where to send events, relative to the script
+}
+
+func sheepJS(tmpl Templater, params scriptParams) ([]byte, []byte, error) {
+	var buf bytes.Buffer
+
 	if err := tmpl.ExecuteTemplate(&buf, "sheepcount.js.tmpl", params); err != nil {
 		return nil, nil, err
 	}
@@ -0,0 +1,161 @@
+package sheepcount
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sheepcount.state")
+
+	// A longer file from before must not leave anything behind
+	require.NoError(t, os.WriteFile(path, []byte(`{"salts": {}, "geoip": {}, "padding": "`+string(make([]byte, 1024))+`"}`), 0600))
+
+	state := &State{}
+	require.NoError(t, state.Salts.Load(DefaultConfig().SaltRotationDuration))
+	previous := state.Salts.Current
+	require.NoError(t, state.Salts.Rotate())
+	require.NoError(t, state.Save(path))
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var saved State
+	require.NoError(t, json.Unmarshal(contents, &saved))
+	assert.Equal(t, state.Salts.Current, saved.Salts.Current)
+	assert.Equal(t, previous, saved.Salts.Previous)
+	assert.True(t, state.Salts.LastRotated.Equal(saved.Salts.LastRotated))
+
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err), "the temporary file is renamed")
+}
+
+func TestHandler(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	config := DefaultConfig()
+	config.Domains = []string{"example.com"}
+	sheepcount := &SheepCount{
+		db:            db,
+		realtime:      NewRealtime(),
+		broadcaster:   NewBroadcaster(),
+		hits:          make(chan Hit, 1),
+		Config:        config,
+		fingerprinter: fingerprintNone,
+	}
+	handler := sheepcount.Handler()
+
+	// Hits are sent to the database writer of RunBackground
+	body := `{"e": "l", "u": "https://example.com/pricing", "h": 1080, "w": 1920, "p": 2}`
+	r := httptest.NewRequest(http.MethodPost, "http://stats.example.com"+config.Endpoints.Event, strings.NewReader(body))
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	require.Len(t, sheepcount.hits, 1)
+	assert.Equal(t, "/pricing", (<-sheepcount.hits).Path)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestAdminListener(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	tmpl, err := NewTemplates()
+	require.NoError(t, err)
+
+	config := DefaultConfig()
+	config.Domains = []string{"example.com"}
+	config.Hostname = "stats.example.com"
+	config.AdminListener.Address = "10.8.0.1:4445"
+	sheepcount := &SheepCount{
+		db:          db,
+		tmpl:        tmpl,
+		realtime:    NewRealtime(),
+		broadcaster: NewBroadcaster(),
+		hits:        make(chan Hit, 1),
+		Config:      config,
+	}
+	public, admin := sheepcount.PublicHandler(), sheepcount.AdminHandler()
+
+	status := func(handler http.Handler, method string, path string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "http://10.8.0.1:4445"+path, nil))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, status(public, http.MethodGet, config.Endpoints.Script))
+	assert.Equal(t, http.StatusOK, status(public, http.MethodGet, "/healthz"))
+	assert.Equal(t, http.StatusNotFound, status(public, http.MethodGet, "/"))
+	assert.Equal(t, http.StatusNotFound, status(public, http.MethodGet, "/debug/vars"))
+	assert.Equal(t, http.StatusNotFound, status(public, http.MethodGet, "/login"))
+
+	assert.Equal(t, http.StatusNotFound, status(admin, http.MethodPost, config.Endpoints.Event))
+	assert.Equal(t, http.StatusNotFound, status(admin, http.MethodGet, config.Endpoints.Script))
+	assert.Equal(t, http.StatusOK, status(admin, http.MethodGet, "/healthz"))
+	assert.Equal(t, http.StatusForbidden, status(admin, http.MethodGet, "/debug/vars"))
+
+	// Snippets are shown on the admin listener, but point to the public one
+	origin := sheepcount.baseURL(httptest.NewRequest(http.MethodGet, "http://10.8.0.1:4445/snippet", nil))
+	assert.Equal(t, "http://stats.example.com", origin.String())
+
+	for _, address := range []string{"10.8.0.1:4445", "unix:/run/sheepcount/admin.sock", ""} {
+		listener := AdminListenerConfig{Address: address}
+		assert.NoError(t, listener.validate(), address)
+	}
+	for _, address := range []string{"10.8.0.1", "unix:"} {
+		listener := AdminListenerConfig{Address: address}
+		assert.Error(t, listener.validate(), address)
+	}
+}
+
+// Mistakes in the configuration that Validate would find stop Sheep Count from starting, even
+// without running check first.
+func TestNewSheepCountInvalidConfig(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	for _, test := range []struct {
+		name   string
+		modify func(*Config)
+	}{
+		{"hash_routing", func(config *Config) { config.Paths.HashRouting = "fragment" }},
+		{"cookie_same_site", func(config *Config) { config.CookieSameSite = "Strict" }},
+		{"goal signup must have either a path or an event", func(config *Config) {
+			config.Goals = []GoalConfig{{Name: "signup", Path: "/thanks", Event: "signup"}}
+		}},
+		{"invalid cors origin", func(config *Config) { config.CORSOrigins = []string{"https://example.com/"} }},
+		{"oidc issuer", func(config *Config) {
+			config.OIDC = OIDCConfig{Issuer: "http://login.example.com", ClientID: "sheepcount", Access: []OIDCAccess{{Emails: []string{"me@example.com"}}}}
+		}},
+		{"oidc access role", func(config *Config) {
+			config.OIDC = OIDCConfig{Issuer: "https://login.example.com", ClientID: "sheepcount", Access: []OIDCAccess{{Emails: []string{"me@example.com"}, Role: "Admin"}}}
+		}},
+	} {
+		config := DefaultConfig()
+		config.Domains = []string{"example.com"}
+		test.modify(&config)
+
+		_, err := NewSheepCount(db, db, config)
+		assert.ErrorContains(t, err, test.name)
+	}
+}
@@ -0,0 +1,296 @@
+package sheepcount
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// The number of hits that could not be written to each sink, or were dropped because the sink had
+// fallen behind
+var sinkDroppedHits = expvar.NewMap("sink_dropped_hits")
+
+// Where the database writer sends each batch of hits, once their locations have been looked up.
+// Hits are always written to where they are stored, and also to any sinks that are configured.
+type Sink interface {
+	WriteBatch(ctx context.Context, hits []Hit) error
+	Close() error
+	String() string // For logging
+}
+
+// A sink that hits are written to as well as the database, configured with [[sinks]].
+type SinkConfig struct {
+	Type     string `toml:"type"`     // ndjson, forward or clickhouse
+	Path     string `toml:"path"`     // The file that ndjson appends to
+	URL      string `toml:"url"`      // Where forward POSTs to, such as https://stats.example.org/api/v1/hits, or the HTTP interface of ClickHouse
+	Token    string `toml:"token"`    // Sent by forward as a bearer token, such as an API token of another SheepCount
+	Secret   string `toml:"secret"`   // Key for the signature of the body, as with alert webhooks
+	Database string `toml:"database"` // The ClickHouse database, or the default database of the user if empty
+	User     string `toml:"user"`     // The ClickHouse user and password
+	Password string `toml:"password"`
+}
+
+func (config *SinkConfig) validate() error {
+	switch config.Type {
+	case "ndjson":
+		if config.Path == "" {
+			return errors.New("ndjson sink path must be set")
+		}
+	case "forward":
+		if u, err := url.Parse(config.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid forward sink url: %s", config.URL)
+		}
+	case "clickhouse":
+		if u, err := url.Parse(config.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid clickhouse sink url: %s", config.URL)
+		}
+	default:
+		return fmt.Errorf("unknown sink type %q", config.Type)
+	}
+	return nil
+}
+
+func (config *SinkConfig) clickhouse() ClickHouseConfig {
+	return ClickHouseConfig{URL: config.URL, Database: config.Database, User: config.User, Password: config.Password}
+}
+
+func newSinks(configs []SinkConfig) ([]Sink, error) {
+	sinks := make([]Sink, 0, len(configs))
+	for i := range configs {
+		config := configs[i]
+		if err := config.validate(); err != nil {
+			return nil, err
+		}
+
+		switch config.Type {
+		case "ndjson":
+			sinks = append(sinks, &ndjsonSink{file: NewSpool(config.Path)})
+		case "forward":
+			client := newClient()
+			client.RetryMax = 2
+			client.HTTPClient.Timeout = 30 * time.Second
+			sinks = append(sinks, &forwardSink{config: config, client: client})
+		case "clickhouse":
+			client := newClickhouseClient(config.clickhouse(), 30*time.Second)
+			sinks = append(sinks, &clickhouseSink{client: client})
+		}
+	}
+	return sinks, nil
+}
+
+// Writes to the database on a connection of its own. Batches that cannot be written are saved to the
+// spool, to be replayed later.
+type sqliteSink struct {
+	conn   *sql.Conn
+	writer *HitWriter
+	spool  *Spool
+}
+
+func newSQLiteSink(ctx context.Context, db *sql.DB, spool *Spool) (*sqliteSink, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := NewHitWriter(ctx, db)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &sqliteSink{conn: conn, writer: writer, spool: spool}, nil
+}
+
+func (sink *sqliteSink) WriteBatch(ctx context.Context, hits []Hit) error {
+	if err := sink.writer.WriteBatch(ctx, sink.conn, hits); err != nil {
+		log.Printf("Cannot write %d hits, saving to spool: %s", len(hits), err)
+		if err := sink.spool.Append(hits); err != nil {
+			return fmt.Errorf("cannot save hits to spool: %w", err)
+		}
+	}
+	return nil
+}
+
+// Delete unused dimension rows. It is done between batches so that the writer never uses the cached
+// ID of a row that has just been deleted.
+func (sink *sqliteSink) collectGarbage(ctx context.Context) ([]garbageCollected, error) {
+	collected, err := dbCollectGarbage(ctx, sink.conn)
+	sink.writer.ClearCache()
+	return collected, err
+}
+
+func (sink *sqliteSink) Close() error {
+	err := sink.writer.Close()
+	if err := sink.conn.Close(); err != nil {
+		return err
+	}
+	return err
+}
+
+func (sink *sqliteSink) String() string {
+	return "database"
+}
+
+// Saves the batches that a sink cannot write to the spool, to be replayed later, for a sink that hits
+// are stored in rather than copied to.
+type spooledSink struct {
+	sink  Sink
+	spool *Spool
+}
+
+func (sink *spooledSink) WriteBatch(ctx context.Context, hits []Hit) error {
+	if err := sink.sink.WriteBatch(ctx, hits); err != nil {
+		log.Printf("Cannot write %d hits to %s, saving to spool: %s", len(hits), sink.sink, err)
+		if err := sink.spool.Append(hits); err != nil {
+			return fmt.Errorf("cannot save hits to spool: %w", err)
+		}
+	}
+	return nil
+}
+
+func (sink *spooledSink) Close() error {
+	return sink.sink.Close()
+}
+
+func (sink *spooledSink) String() string {
+	return sink.sink.String()
+}
+
+// Appends hits to a file, one JSON object per line in the same format as the spool.
+type ndjsonSink struct {
+	file *Spool
+}
+
+func (sink *ndjsonSink) WriteBatch(ctx context.Context, hits []Hit) error {
+	return sink.file.Append(hits)
+}
+
+func (sink *ndjsonSink) Close() error {
+	return nil
+}
+
+func (sink *ndjsonSink) String() string {
+	return "ndjson sink " + sink.file.path
+}
+
+// POSTs each batch as newline delimited JSON, in the same format as the spool, to a webhook or to
+// POST /api/v1/hits of another SheepCount, which records them as if they had been sent to it.
+type forwardSink struct {
+	config SinkConfig
+	client *retryablehttp.Client
+}
+
+func (sink *forwardSink) WriteBatch(ctx context.Context, hits []Hit) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for i := range hits {
+		if err := encoder.Encode(&hits[i]); err != nil {
+			return err
+		}
+	}
+
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodPost, sink.config.URL, body.Bytes())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("User-Agent", "SheepCount")
+	if sink.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+sink.config.Token)
+	}
+	if sink.config.Secret != "" {
+		req.Header.Set("X-SheepCount-Signature", webhookSignature(sink.config.Secret, body.Bytes()))
+	}
+
+	resp, err := sink.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", sink.config.URL, resp.Status)
+	}
+	return nil
+}
+
+func (sink *forwardSink) Close() error {
+	return nil
+}
+
+func (sink *forwardSink) String() string {
+	return "forward sink " + sink.config.URL
+}
+
+// How many batches each sink can fall behind the database by before batches are dropped.
+const sinkBacklog = 16
+
+// Write the batches sent on the channel to the sink until it is closed, so that a slow sink does not
+// hold up the database writer.
+func runSink(sink Sink, batches <-chan []Hit) {
+	for hits := range batches {
+		// Like the database, sinks are written to during shutdown
+		if err := sink.WriteBatch(context.Background(), hits); err != nil {
+			log.Printf("Cannot write %d hits to %s: %s", len(hits), sink, err)
+			sinkDroppedHits.Add(sink.String(), int64(len(hits)))
+		}
+	}
+}
+
+// The largest batch that POST /api/v1/hits accepts, in bytes.
+const maxForwardedBatchSize = 4 << 20
+
+// Record hits forwarded by another SheepCount. It needs an API token, as identifiers and locations
+// are taken as they are.
+func handleForwardedHits(sheepcount *SheepCount, hits chan<- Hit, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// Forwarded hits can be of any site
+	token := apiAuthenticated(sheepcount, w, r)
+	if token == nil {
+		return
+	}
+	if !token.canWrite() || !token.canSee("") {
+		writeAPIError(w, http.StatusForbidden, "forwarding hits needs an admin token for every site")
+		return
+	}
+
+	var batch []Hit
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxForwardedBatchSize))
+	for {
+		var hit Hit
+		err := decoder.Decode(&hit)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !contains(sheepcount.Domains, hit.Domain) {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid domain: %s", hit.Domain))
+			return
+		}
+		batch = append(batch, hit)
+	}
+
+	for _, hit := range batch {
+		sheepcount.submit(hits, hit)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,135 @@
+package sheepcount
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSinkConfig(t *testing.T) {
+	for _, config := range []SinkConfig{
+		{Type: "ndjson"},
+		{Type: "forward", URL: "ftp://stats.example.org/"},
+		{Type: "clickhouse", URL: "clickhouse:9000"},
+		{Type: "kafka"},
+	} {
+		_, err := newSinks([]SinkConfig{config})
+		assert.Error(t, err, config.Type)
+	}
+}
+
+func TestSinks(t *testing.T) {
+	ctx := context.Background()
+
+	// Another SheepCount that the hits are forwarded to
+	mirrorDB, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer mirrorDB.Close()
+	mirrorDB.SetMaxOpenConns(1)
+
+	token, err := dbCreateAPIToken(ctx, mirrorDB, "forward", roleAdmin, nil)
+	require.NoError(t, err)
+
+	mirrorConfig := DefaultConfig()
+	mirrorConfig.Domains = []string{"example.com"}
+	mirror := &SheepCount{db: mirrorDB, realtime: NewRealtime(), broadcaster: NewBroadcaster(), Config: mirrorConfig}
+	forwarded := make(chan Hit, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleForwardedHits(mirror, forwarded, w, r)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	db, err := dbConnect(filepath.Join(dir, "sheepcount.sqlite3"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	sinks, err := newSinks([]SinkConfig{
+		{Type: "ndjson", Path: filepath.Join(dir, "hits.ndjson")},
+		{Type: "forward", URL: server.URL, Token: token},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	hitC := make(chan Hit)
+	done := make(chan error)
+	go func() {
+		done <- DatabaseWriter(ctx, db, nil, NewSpool(filepath.Join(dir, "sheepcount.spool")), hitC, &GeoIP{}, nil, 0, sinks)
+	}()
+
+	for _, path := range []string{"/", "/about"} {
+		hitC <- Hit{
+			Timestamp:          1654041600,
+			IdentifierCurrent:  []byte("a"),
+			IdentifierPrevious: []byte("a"),
+			UserAgent:          "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:              PageLoad,
+			Domain:             "example.com",
+			Path:               path,
+		}
+	}
+
+	// The remaining hits are written to every sink when shutting down
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	var n int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM hits").Scan(&n))
+	assert.Equal(t, 2, n)
+
+	f, err := os.Open(filepath.Join(dir, "hits.ndjson"))
+	require.NoError(t, err)
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[1], `"Path":"/about"`)
+
+	require.Len(t, forwarded, 2)
+	hit := <-forwarded
+	assert.Equal(t, "example.com", hit.Domain)
+	assert.Equal(t, []byte("a"), hit.IdentifierCurrent)
+	assert.Equal(t, "/about", (<-forwarded).Path)
+}
+
+func TestForwardedHits(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	token, err := dbCreateAPIToken(context.Background(), db, "forward", roleAdmin, nil)
+	require.NoError(t, err)
+
+	config := DefaultConfig()
+	config.Domains = []string{"example.com"}
+	sheepcount := &SheepCount{db: db, realtime: NewRealtime(), broadcaster: NewBroadcaster(), Config: config}
+
+	post := func(token string, body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/hits", strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handleForwardedHits(sheepcount, make(chan Hit, 16), w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, post(token, `{"Domain": "example.com", "Path": "/", "Event": "l"}`+"\n"))
+	assert.Equal(t, http.StatusUnauthorized, post("", `{"Domain": "example.com", "Path": "/", "Event": "l"}`))
+	assert.Equal(t, http.StatusBadRequest, post(token, `{"Domain": "example.org", "Path": "/", "Event": "l"}`))
+	assert.Equal(t, http.StatusBadRequest, post(token, `{"Domain": "example.com", "Event": "x"}`))
+}
@@ -0,0 +1,110 @@
+package sheepcount
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// The script tag to embed in sites, with the Subresource Integrity hash of the current script so
+// that sites with a strict Content Security Policy can pin it. The hash only changes with the
+// configuration or a new version of Sheep Count. Pass nonce to add a nonce attribute, such as a
+// placeholder for the templates of the site.
+func handleSnippet(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !authorized(sheepcount, r, "") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	origin := sheepcount.baseURL(r)
+	script, err := sheepcount.scriptTag(origin, r.URL.Query().Get("nonce"))
+	if err != nil {
+		log.Printf("cannot render javascript: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, "<!-- Content-Security-Policy: script-src %s; connect-src %s -->\n", origin.String(), origin.String())
+	fmt.Fprintln(w, script)
+}
+
+// The full recommended snippet for the site given by domain: the script tag and, for visitors
+// without Javascript, the tracking pixel. The pixel has no page URL so it sends the whole URL of
+// the page as the referrer, and the token of the site if tokens are required.
+func handleEmbed(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	domain := r.URL.Query().Get("domain")
+	if !authorized(sheepcount, r, domain) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !sheepcount.isTracked(domain) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	origin := sheepcount.baseURL(r)
+	script, err := sheepcount.scriptTag(origin, r.URL.Query().Get("nonce"))
+	if err != nil {
+		log.Printf("cannot render javascript: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	pixel := origin
+	pixel.Path = sheepcount.Endpoints.Pixel
+	if sheepcount.eventTokenKey != nil {
+		pixel.RawQuery = url.Values{"k": {eventToken(sheepcount.eventTokenKey, domain)}}.Encode()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, "<!-- Sheep Count for %s. Content-Security-Policy: script-src %s; connect-src %s; img-src %s -->\n", domain, origin.String(), origin.String(), origin.String())
+	fmt.Fprintln(w, script)
+	fmt.Fprintf(w, `<noscript><img src="%s" alt="" width="1" height="1" referrerpolicy="no-referrer-when-downgrade"></noscript>`+"\n", html.EscapeString(pixel.String()))
+}
+
+func (config *Config) isTracked(domain string) bool {
+	for _, tracked := range config.Domains {
+		if tracked == domain {
+			return true
+		}
+	}
+	return false
+}
+
+func (sheepcount *SheepCount) scriptTag(origin url.URL, nonce string) (string, error) {
+	// The snippet may be shown on a different listener than the one that sites load the script from
+	js, _, err := sheepcount.script(sheepcount.AllowLocalhost)
+	if err != nil {
+		return "", err
+	}
+
+	src := origin
+	src.Path = sheepcount.Endpoints.Script
+
+	hash := sha512.Sum384(js)
+	integrity := "sha384-" + base64.StdEncoding.EncodeToString(hash[:])
+
+	if nonce != "" {
+		nonce = fmt.Sprintf(` nonce="%s"`, html.EscapeString(nonce))
+	}
+
+	return fmt.Sprintf(`<script src="%s" integrity="%s" crossorigin="anonymous"%s defer></script>`, src.String(), integrity, nonce), nil
+}
@@ -0,0 +1,111 @@
+package sheepcount
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnippet(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	tmpl, err := NewTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sheepcount := &SheepCount{db: db, tmpl: tmpl, Config: DefaultConfig()}
+
+	token, err := dbCreateAPIToken(context.Background(), db, "test", roleAdmin, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The script must be the same whichever host it is requested from
+	script := func(host string) []byte {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://"+host+"/count.js", nil)
+		sheepcount.handleJavascript(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w.Body.Bytes()
+	}
+	js := script("stats.example.com")
+	assert.Equal(t, js, script("other.example.com"))
+
+	hash := sha512.Sum384(js)
+	integrity := "sha384-" + base64.StdEncoding.EncodeToString(hash[:])
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://stats.example.com/snippet?nonce=abc", nil)
+	handleSnippet(sheepcount, w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = httptest.NewRecorder()
+	r.Header.Set("Authorization", "Bearer "+token)
+	handleSnippet(sheepcount, w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(
+		t,
+		"<!-- Content-Security-Policy: script-src http://stats.example.com; connect-src http://stats.example.com -->\n"+
+			`<script src="http://stats.example.com/count.js" integrity="`+integrity+`" crossorigin="anonymous" nonce="abc" defer></script>`+"\n",
+		w.Body.String(),
+	)
+}
+
+func TestEmbed(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	tmpl, err := NewTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultConfig()
+	config.Domains = []string{"example.com"}
+	sheepcount := &SheepCount{db: db, tmpl: tmpl, Config: config, eventTokenKey: []byte("key")}
+
+	token, err := dbCreateAPIToken(context.Background(), db, "test", roleAdmin, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	embed := func(domain string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://stats.example.com/embed?domain="+domain, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		handleEmbed(sheepcount, w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, embed("other.example.com").Code)
+
+	w := embed("example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	script, err := sheepcount.scriptTag(sheepcount.baseURL(httptest.NewRequest(http.MethodGet, "http://stats.example.com/", nil)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(
+		t,
+		"<!-- Sheep Count for example.com. Content-Security-Policy: script-src http://stats.example.com; connect-src http://stats.example.com; img-src http://stats.example.com -->\n"+
+			script+"\n"+
+			`<noscript><img src="http://stats.example.com/sheep.gif?k=`+eventToken([]byte("key"), "example.com")+`" alt="" width="1" height="1" referrerpolicy="no-referrer-when-downgrade"></noscript>`+"\n",
+		w.Body.String(),
+	)
+}
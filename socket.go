@@ -0,0 +1,125 @@
+package sheepcount
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+)
+
+// Who can connect to the Unix socket given with --socket. By default only the user running
+// SheepCount can, so a reverse proxy running as another user needs the mode and group set, such as
+// mode = "0660" and group = "www-data".
+type SocketConfig struct {
+	Mode  string `toml:"mode"`  // Permissions in octal
+	Owner string `toml:"owner"` // User name or ID
+	Group string `toml:"group"` // Group name or ID
+
+	// Put the socket in the abstract namespace on Linux instead of the file system. It has no
+	// permissions, so any process in the same network namespace can connect to it.
+	Abstract bool `toml:"abstract"`
+}
+
+func (config *SocketConfig) validate() error {
+	if _, err := config.mode(); err != nil {
+		return err
+	}
+	if _, _, err := config.ownership(); err != nil {
+		return err
+	}
+	if config.Abstract && runtime.GOOS != "linux" {
+		return errors.New("abstract sockets are only supported on Linux")
+	}
+	if config.Abstract && (config.Owner != "" || config.Group != "") {
+		return errors.New("abstract sockets have no owner or group")
+	}
+	return nil
+}
+
+func (config *SocketConfig) mode() (os.FileMode, error) {
+	if config.Mode == "" {
+		return 0700, nil
+	}
+
+	mode, err := strconv.ParseUint(config.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket mode %q: must be permissions in octal, such as 0660", config.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// The user and group IDs to give the socket, or -1 to leave them as they are.
+func (config *SocketConfig) ownership() (int, int, error) {
+	uid, gid := -1, -1
+
+	if config.Owner != "" {
+		id := config.Owner
+		if _, err := strconv.Atoi(id); err != nil {
+			u, err := user.Lookup(config.Owner)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid socket owner: %w", err)
+			}
+			id = u.Uid
+		}
+		uid, _ = strconv.Atoi(id)
+	}
+
+	if config.Group != "" {
+		id := config.Group
+		if _, err := strconv.Atoi(id); err != nil {
+			g, err := user.LookupGroup(config.Group)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid socket group: %w", err)
+			}
+			id = g.Gid
+		}
+		gid, _ = strconv.Atoi(id)
+	}
+
+	return uid, gid, nil
+}
+
+// Listen on a Unix socket, replacing any left behind by a previous run, and set who can connect.
+func listenUnix(path string, config *SocketConfig) (net.Listener, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	if config.Abstract {
+		l, err := net.Listen("unix", "@"+path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot listen: %w", err)
+		}
+		return l, nil
+	}
+
+	// Delete the socket first
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot remove old socket: %w", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen: %w", err)
+	}
+
+	mode, _ := config.mode()
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	uid, gid, _ := config.ownership()
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("cannot change the owner of the socket: %w", err)
+		}
+	}
+
+	return l, nil
+}
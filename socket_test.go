@@ -0,0 +1,136 @@
+package sheepcount
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSocketConfig(t *testing.T) {
+	mode, err := (&SocketConfig{}).mode()
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), mode)
+
+	mode, err = (&SocketConfig{Mode: "0660"}).mode()
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), mode)
+
+	assert.Error(t, (&SocketConfig{Mode: "rw-rw----"}).validate())
+	assert.Error(t, (&SocketConfig{Mode: "1777"}).validate())
+	assert.Error(t, (&SocketConfig{Owner: "no-such-user-of-sheepcount"}).validate())
+
+	uid, gid, err := (&SocketConfig{Owner: "1000"}).ownership()
+	require.NoError(t, err)
+	assert.Equal(t, 1000, uid)
+	assert.Equal(t, -1, gid)
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sheepcount.sock")
+
+	// A socket left behind is replaced
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+
+	gid := strconv.Itoa(os.Getgid())
+	l, err := listenUnix(path, &SocketConfig{Mode: "0660", Group: gid})
+	require.NoError(t, err)
+	defer l.Close()
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+	assert.NotZero(t, info.Mode()&os.ModeSocket)
+
+	if runtime.GOOS == "linux" {
+		l, err := listenUnix("sheepcount-test-"+strconv.Itoa(os.Getpid()), &SocketConfig{Abstract: true})
+		require.NoError(t, err)
+		defer l.Close()
+
+		conn, err := net.Dial("unix", "@sheepcount-test-"+strconv.Itoa(os.Getpid()))
+		require.NoError(t, err)
+		conn.Close()
+	}
+}
+
+func TestListenAll(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sheepcount.sock")
+
+	listeners, err := listenAll([]ListenerConfig{{Address: "127.0.0.1:0"}, {Address: "unix:" + path}})
+	require.NoError(t, err)
+	require.Len(t, listeners, 2)
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	assert.Equal(t, "tcp", listeners[0].Addr().Network())
+	assert.Equal(t, "unix", listeners[1].Addr().Network())
+	for _, l := range listeners {
+		conn, err := net.Dial(l.Addr().Network(), l.Addr().String())
+		require.NoError(t, err)
+		conn.Close()
+	}
+
+	// Those listened on already are closed if another cannot be
+	other := filepath.Join(t.TempDir(), "other.sock")
+	_, err = listenAll([]ListenerConfig{{Address: "unix:" + other}, {Address: "unix:" + filepath.Join(other, "missing", "sheepcount.sock")}})
+	assert.Error(t, err)
+	_, err = net.Dial("unix", other)
+	assert.Error(t, err)
+}
+
+func TestListenerOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sheepcount.sock")
+
+	sockets, err := listenAll([]ListenerConfig{{Address: "127.0.0.1:0"}, {Address: "unix:" + path}})
+	require.NoError(t, err)
+	defer func() {
+		for _, l := range sockets {
+			l.Close()
+		}
+	}()
+
+	config := DefaultConfig()
+	config.AllowLocalhost = true
+	sheepcount := &SheepCount{Config: config}
+
+	// Only the TCP listener is served with TLS, and only the Unix socket is behind a reverse proxy
+	options := sheepcount.prepareSockets(sockets, &tls.Config{})
+	assert.Equal(t, listenerOptions{}, options[0])
+	assert.Equal(t, listenerOptions{reverseProxy: true}, options[1])
+	assert.NotEqual(t, "*net.TCPListener", fmt.Sprintf("%T", sockets[0]))
+	assert.IsType(t, &net.UnixListener{}, sockets[1])
+
+	// The proxy headers are only trusted from the Unix socket
+	var ip string
+	var debug bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		ip = r.RemoteAddr
+		debug = sheepcount.canDebug(r)
+	})
+
+	for i, want := range []string{"203.0.113.7", "127.0.0.1"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "203.0.113.7:1234"
+		r.Header.Set("X-Real-IP", "127.0.0.1")
+		sheepcount.wrapHandler(mux, options[i]).ServeHTTP(httptest.NewRecorder(), r)
+		assert.Equal(t, want, ip)
+		assert.Equal(t, i == 1, debug)
+	}
+
+	// Hits from localhost are allowed over plain HTTP, as with --port
+	options = sheepcount.prepareSockets(sockets, nil)
+	assert.Equal(t, listenerOptions{allowLocalhost: true}, options[0])
+}
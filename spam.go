@@ -0,0 +1,127 @@
+package sheepcount
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+type ReferrerSpamConfig struct {
+	Domains         []string      `toml:"domains"`          // Extra spam domains, as well as the built in list
+	URL             string        `toml:"url"`              // A list of spam domains, one per line, to refresh from. Empty disables refreshing.
+	RefreshInterval time.Duration `toml:"refresh_interval"` // How often to refresh from the URL
+	Action          string        `toml:"action"`           // Either drop hits with spam referrers (the default) or mark them as bots
+}
+
+// Not an isbot result, but anything of at least two is counted as a bot.
+const botReferrerSpam = 170
+
+//go:embed referrer_spam.txt
+var builtinReferrerSpam string
+
+// Domains that send referrer spam, from the built in list, the configuration and the remote list. It
+// is safe for concurrent use.
+type referrerSpam struct {
+	sync.RWMutex
+	local  map[string]bool
+	remote map[string]bool
+}
+
+// Parse a list of domains, one per line. Blank lines and comments starting with # are skipped.
+func parseSpamList(r io.Reader) (map[string]bool, error) {
+	domains := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.ToLower(strings.TrimSpace(line)); line != "" {
+			domains[line] = true
+		}
+	}
+
+	return domains, scanner.Err()
+}
+
+func newReferrerSpam(config *ReferrerSpamConfig) (*referrerSpam, error) {
+	switch config.Action {
+	case "", "drop", "mark":
+	default:
+		return nil, fmt.Errorf("invalid referrer spam action: %s", config.Action)
+	}
+
+	if config.URL != "" && config.RefreshInterval <= 0 {
+		return nil, fmt.Errorf("invalid referrer spam refresh interval: %s", config.RefreshInterval)
+	}
+
+	local, err := parseSpamList(strings.NewReader(builtinReferrerSpam))
+	if err != nil {
+		return nil, err
+	}
+	for _, domain := range config.Domains {
+		local[strings.ToLower(domain)] = true
+	}
+
+	return &referrerSpam{local: local}, nil
+}
+
+// Is the domain, or any domain that it is a subdomain of, in the list?
+func (spam *referrerSpam) Contains(domain string) bool {
+	if spam == nil {
+		return false
+	}
+
+	spam.RLock()
+	defer spam.RUnlock()
+
+	for {
+		if spam.local[domain] || spam.remote[domain] {
+			return true
+		}
+
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			return false
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// Replace the remote list with the one at url.
+func (spam *referrerSpam) Refresh(ctx context.Context, url string) error {
+	req, err := retryablehttp.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := newClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP error: %s", resp.Status)
+	}
+
+	remote, err := parseSpamList(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	spam.Lock()
+	spam.remote = remote
+	spam.Unlock()
+
+	return nil
+}
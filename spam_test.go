@@ -0,0 +1,39 @@
+package sheepcount
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReferrerSpam(t *testing.T) {
+	spam, err := newReferrerSpam(&ReferrerSpamConfig{Domains: []string{"Spammer.example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, spam.Contains("semalt.com"))
+	assert.True(t, spam.Contains("www.semalt.com"))
+	assert.True(t, spam.Contains("spammer.example"))
+	assert.False(t, spam.Contains("example"))
+	assert.False(t, spam.Contains("notsemalt.com"))
+	assert.False(t, spam.Contains("remote.example"))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("# Spammers\nremote.example\n\n  Other.Example  # Also a spammer\n"))
+	}))
+	defer server.Close()
+
+	if err := spam.Refresh(context.Background(), server.URL); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, spam.Contains("remote.example"))
+	assert.True(t, spam.Contains("a.other.example"))
+	assert.True(t, spam.Contains("semalt.com"))
+
+	_, err = newReferrerSpam(&ReferrerSpamConfig{Action: "shout"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,133 @@
+package sheepcount
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// An append-only file of hits, one JSON object per line, that could not be written to the database.
+// They are replayed once the database is writable again. Hits are removed from the spool only after
+// they have been committed, so a crash in between can at worst write them twice.
+type Spool struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewSpool(path string) *Spool {
+	return &Spool{path: path}
+}
+
+func (spool *Spool) Append(hits []Hit) error {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+
+	f, err := os.OpenFile(spool.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	return writeHits(f, hits)
+}
+
+// Read the spooled hits and pass them to write, which returns how many of them, from the first, it
+// committed. If write succeeds then the spool is emptied, and otherwise only the hits that it did not
+// commit are kept, so that they are not written twice.
+func (spool *Spool) Replay(write func([]Hit) (int, error)) (int, error) {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+
+	f, err := os.Open(spool.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var hits []Hit
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var hit Hit
+		if err := json.Unmarshal(scanner.Bytes(), &hit); err != nil {
+			// Probably a partially written line from a crash during Append
+			log.Printf("Skipping invalid hit on line %d of spool: %s", line, err)
+			continue
+		}
+		hits = append(hits, hit)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("cannot read spool: %w", err)
+	}
+
+	if len(hits) > 0 {
+		n, err := write(hits)
+		if err != nil {
+			if n > 0 {
+				if err := spool.rewrite(hits[n:]); err != nil {
+					return n, fmt.Errorf("cannot remove replayed hits from spool: %w", err)
+				}
+			}
+			return n, err
+		}
+	}
+
+	if err := os.Remove(spool.path); err != nil {
+		return 0, err
+	}
+
+	return len(hits), nil
+}
+
+// Replace the spooled hits with the given ones. The new file is renamed over the old one so that a
+// crash leaves one or the other.
+func (spool *Spool) rewrite(hits []Hit) error {
+	tmp := spool.path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := writeHits(f, hits); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, spool.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// Write the hits to the file, one per line, sync it and close it.
+func writeHits(f *os.File, hits []Hit) error {
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for i := range hits {
+		if err := encoder.Encode(&hits[i]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
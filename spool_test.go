@@ -0,0 +1,91 @@
+package sheepcount
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpool(t *testing.T) {
+	spool := NewSpool(filepath.Join(t.TempDir(), "sheepcount.spool"))
+
+	hits := []Hit{
+		{
+			Timestamp:         1654041600,
+			IdentifierCurrent: []byte("a"),
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              "/",
+			ReferrerDomain:    sql.NullString{String: "www.bbc.co.uk", Valid: true},
+			PixelRatio:        sql.NullFloat64{Float64: 1.5, Valid: true},
+		},
+		{
+			Timestamp: 1654041660,
+			Event:     PageHide,
+			Domain:    "example.com",
+			Path:      "/about",
+		},
+	}
+
+	if err := spool.Append(hits[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append(hits[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed write must keep the hits in the spool
+	_, err := spool.Replay(func([]Hit) (int, error) { return 0, errors.New("database is locked") })
+	assert.Error(t, err)
+
+	var replayed []Hit
+	n, err := spool.Replay(func(hits []Hit) (int, error) {
+		replayed = hits
+		return len(hits), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, n)
+	assert.Equal(t, hits, replayed)
+
+	// The spool is now empty
+	n, err = spool.Replay(func([]Hit) (int, error) { return 0, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, n)
+}
+
+func TestSpoolPartialReplay(t *testing.T) {
+	spool := NewSpool(filepath.Join(t.TempDir(), "sheepcount.spool"))
+
+	hits := []Hit{
+		{Timestamp: 1654041600, Event: PageLoad, Domain: "example.com", Path: "/"},
+		{Timestamp: 1654041660, Event: PageLoad, Domain: "example.com", Path: "/about"},
+		{Timestamp: 1654041720, Event: PageLoad, Domain: "example.com", Path: "/contact"},
+	}
+	if err := spool.Append(hits); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first hit was committed before the write failed, so it must not be replayed again
+	n, err := spool.Replay(func([]Hit) (int, error) { return 1, errors.New("database is locked") })
+	assert.Error(t, err)
+	assert.Equal(t, 1, n)
+
+	var replayed []Hit
+	n, err = spool.Replay(func(hits []Hit) (int, error) {
+		replayed = hits
+		return len(hits), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, n)
+	assert.Equal(t, hits[1:], replayed)
+}
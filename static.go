@@ -0,0 +1,232 @@
+package sheepcount
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// A file in static/. Each file is served both under its own name and under a name with a hash of
+// its content, such as style.1f2e3d4c5b6a7988.css, which the templates link to so that browsers can
+// cache it forever and still fetch the new version after an upgrade.
+type staticAsset struct {
+	name        string
+	hashedName  string
+	hash        string
+	contentType string
+	content     []byte
+	gzip        []byte // Nil if compressing does not make it smaller
+	brotli      []byte // Only if a precompressed .br file was built next to it
+}
+
+type staticAssets struct {
+	byName       map[string]*staticAsset
+	byHashedName map[string]*staticAsset
+}
+
+// How long browsers can cache files with a hash in their name.
+const staticMaxAge = 365 * 24 * time.Hour
+
+// Read and compress the files in the static directory of fsys. Files ending in .gz or .br are not
+// served themselves, but are precompressed versions of the file with the same name without the
+// extension. Any file without a .gz version is compressed with gzip now.
+func loadStaticAssets(fsys fs.FS) (*staticAssets, error) {
+	assets := &staticAssets{
+		byName:       make(map[string]*staticAsset),
+		byHashedName: make(map[string]*staticAsset),
+	}
+
+	entries, err := fs.ReadDir(fsys, "static")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".br") {
+			continue
+		}
+
+		content, err := fs.ReadFile(fsys, path.Join("static", name))
+		if err != nil {
+			return nil, err
+		}
+
+		sum := blake2b.Sum256(content)
+		hash := hex.EncodeToString(sum[:8])
+		ext := path.Ext(name)
+
+		asset := &staticAsset{
+			name:        name,
+			hashedName:  strings.TrimSuffix(name, ext) + "." + hash + ext,
+			hash:        hash,
+			contentType: mime.TypeByExtension(ext),
+			content:     content,
+		}
+		if asset.contentType == "" {
+			asset.contentType = http.DetectContentType(content)
+		}
+
+		if asset.gzip, err = readPrecompressed(fsys, name+".gz"); err != nil {
+			return nil, err
+		}
+		if asset.gzip == nil && compressible(asset.contentType) {
+			if asset.gzip, err = gzipBytes(content); err != nil {
+				return nil, fmt.Errorf("cannot compress %s: %w", name, err)
+			}
+		}
+		if asset.gzip != nil && len(asset.gzip) >= len(content) {
+			asset.gzip = nil
+		}
+
+		if asset.brotli, err = readPrecompressed(fsys, name+".br"); err != nil {
+			return nil, err
+		}
+
+		assets.byName[name] = asset
+		assets.byHashedName[asset.hashedName] = asset
+	}
+
+	return assets, nil
+}
+
+func readPrecompressed(fsys fs.FS, name string) ([]byte, error) {
+	b, err := fs.ReadFile(fsys, path.Join("static", name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Images other than SVGs are already compressed.
+func compressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "image/svg+xml" ||
+		mediaType == "image/x-icon" ||
+		mediaType == "image/vnd.microsoft.icon" ||
+		mediaType == "application/javascript" ||
+		mediaType == "application/json"
+}
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// The path of a file in static/ with its hash in the name, or without if there is no such file.
+func (assets *staticAssets) URL(name string) string {
+	if asset, ok := assets.byName[name]; ok {
+		return "/static/" + asset.hashedName
+	}
+	return "/static/" + name
+}
+
+// Functions available to the templates.
+var templateFuncs = template.FuncMap{
+	"static": staticURL,
+}
+
+// The path of a file in static/ for templates to link to, such as {{ static "style.css" }}.
+func staticURL(name string) (string, error) {
+	assets, err := NewStaticAssets()
+	if err != nil {
+		return "", err
+	}
+	return assets.URL(name), nil
+}
+
+// Serve a file in static/.
+func handleStatic(w http.ResponseWriter, r *http.Request, name string) {
+	assets, err := NewStaticAssets()
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	assets.serve(w, r, name)
+}
+
+// Serve a file with a hashed name with a long-lived Cache-Control, and one with its plain name, such
+// as the favicon, with an ETag so that browsers check whether it has changed. Files are compressed
+// with brotli or gzip if the browser accepts them.
+func (assets *staticAssets) serve(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	asset, ok := assets.byHashedName[name]
+	if ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", int(staticMaxAge.Seconds())))
+	} else if asset, ok = assets.byName[name]; ok {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		http.NotFound(w, r)
+		return
+	}
+
+	content, etag := asset.content, asset.hash
+	if asset.brotli != nil || asset.gzip != nil {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		acceptEncoding := r.Header.Get("Accept-Encoding")
+		switch {
+		case asset.brotli != nil && acceptsEncoding(acceptEncoding, "br"):
+			content, etag = asset.brotli, etag+"-br"
+			w.Header().Set("Content-Encoding", "br")
+		case asset.gzip != nil && acceptsEncoding(acceptEncoding, "gzip"):
+			content, etag = asset.gzip, etag+"-gz"
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	}
+
+	w.Header().Set("Content-Type", asset.contentType)
+	w.Header().Set("ETag", `"`+etag+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+// Does the Accept-Encoding header accept the encoding? An encoding with a quality of zero is refused.
+func acceptsEncoding(header string, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(fields[0]), encoding) {
+			continue
+		}
+
+		for _, param := range fields[1:] {
+			param = strings.ReplaceAll(strings.TrimSpace(param), " ", "")
+			if param == "q=0" || strings.HasPrefix(param, "q=0.") && strings.Trim(param[4:], "0") == "" {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
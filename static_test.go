@@ -0,0 +1,117 @@
+package sheepcount
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticAssets(t *testing.T) {
+	css := strings.Repeat("body { color: black; }\n", 100)
+	assets, err := loadStaticAssets(fstest.MapFS{
+		"static/style.css":    {Data: []byte(css)},
+		"static/style.css.br": {Data: []byte("brotli")},
+		"static/icon.png":     {Data: []byte("\x89PNG\r\n\x1a\nnot really")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := assets.URL("style.css")
+	assert.Regexp(t, `^/static/style\.[0-9a-f]{16}\.css$`, url)
+	assert.Equal(t, "/static/missing.css", assets.URL("missing.css"))
+	assert.Equal(t, "/static/style.css.br", assets.URL("style.css.br"))
+
+	get := func(name string, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/static/"+name, nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		assets.serve(w, r, name)
+		return w
+	}
+
+	// Hashed names are cached forever
+	w := get(strings.TrimPrefix(url, "/static/"), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "public, max-age=31536000, immutable", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "text/css; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, css, w.Body.String())
+
+	// Plain names have to be revalidated
+	w = get("style.css", "gzip")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Less(t, w.Body.Len(), len(css))
+	reader, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, css, string(b))
+
+	// Precompressed brotli is preferred
+	w = get("style.css", "gzip, deflate, br")
+	assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "brotli", w.Body.String())
+	w = get("style.css", "gzip, br;q=0")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+
+	// PNGs are not compressed again
+	w = get("icon.png", "gzip")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Empty(t, w.Header().Get("Vary"))
+
+	// Revalidation
+	etag := get("style.css", "").Header().Get("ETag")
+	r := httptest.NewRequest(http.MethodGet, "/static/style.css", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	assets.serve(w, r, "style.css")
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	assert.Equal(t, http.StatusNotFound, get("style.0000000000000000.css", "").Code)
+	assert.Equal(t, http.StatusNotFound, get("style.css.br", "").Code)
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	assert.True(t, acceptsEncoding("gzip", "gzip"))
+	assert.True(t, acceptsEncoding("deflate, GZIP;q=0.5", "gzip"))
+	assert.False(t, acceptsEncoding("deflate", "gzip"))
+	assert.False(t, acceptsEncoding("gzip;q=0", "gzip"))
+	assert.False(t, acceptsEncoding("gzip; q=0.000", "gzip"))
+	assert.True(t, acceptsEncoding("gzip;q=0.001", "gzip"))
+	assert.False(t, acceptsEncoding("", "gzip"))
+}
+
+func TestEmbeddedStaticAssets(t *testing.T) {
+	assets, err := NewStaticAssets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := NewTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "home.html.tmpl", nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, buf.String(), `href="`+assets.URL("style.css")+`"`)
+}
@@ -0,0 +1,149 @@
+package sheepcount
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+)
+
+type statsCountry struct {
+	Country   *string `json:"country"`
+	Pageviews int     `json:"pageviews"`
+}
+
+type siteStats struct {
+	reportStats
+	Countries []statsCountry
+}
+
+// The inclusive dates of the last number of days, up to and including today.
+func statsPeriod(days int, now time.Time) [2]time.Time {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return [2]time.Time{today.AddDate(0, 0, 1-days), today}
+}
+
+// The same statistics as the report, with the top countries too.
+func buildSiteStats(ctx context.Context, queries Queries, site string, dates [2]time.Time, loc *time.Location) (siteStats, error) {
+	var stats siteStats
+
+	var err error
+	if stats.reportStats, err = reportSiteStats(ctx, queries, site, dates, loc); err != nil {
+		return stats, err
+	}
+
+	if err := runReportQuery(ctx, queries, "countries", site, dates, loc, &stats.Countries); err != nil {
+		return stats, err
+	}
+	if len(stats.Countries) > 10 {
+		stats.Countries = stats.Countries[:10]
+	}
+
+	return stats, nil
+}
+
+func printSiteStats(w io.Writer, site string, days int, stats *siteStats) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "%s, the last %d days (%s to %s)\n\n", site, days, stats.Start, stats.End)
+	fmt.Fprintf(tw, "Pageviews\t%d\n", stats.Pageviews)
+	fmt.Fprintf(tw, "Visitors\t%d\n", stats.Visitors)
+
+	fmt.Fprint(tw, "\nPage\tPageviews\n")
+	for _, page := range stats.Pages {
+		fmt.Fprintf(tw, "%s\t%d\n", page.Path, page.Pageviews)
+	}
+
+	fmt.Fprint(tw, "\nReferrer\tPageviews\n")
+	for _, referrer := range stats.Referrers {
+		fmt.Fprintf(tw, "%s\t%d\n", referrer.Source, referrer.Pageviews)
+	}
+
+	fmt.Fprint(tw, "\nCountry\tPageviews\n")
+	for _, country := range stats.Countries {
+		name := "Unknown"
+		if country.Country != nil {
+			name = *country.Country
+		}
+		fmt.Fprintf(tw, "%s\t%d\n", name, country.Pageviews)
+	}
+
+	return tw.Flush()
+}
+
+func newStatsCommand(configPath *string, databasePath *string) *cobra.Command {
+	var days int
+	var sites []string
+
+	cmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Print the pageviews, visitors and top pages, referrers and countries of each site",
+		Long: "Print the pageviews, visitors and top pages, referrers and countries of each site over the last days, " +
+			"counting from the rollups that the server keeps up to date.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if days < 1 {
+				return fmt.Errorf("days must be positive, not %d", days)
+			}
+
+			config := DefaultConfig()
+			if _, err := toml.DecodeFile(*configPath, &config); err != nil {
+				return err
+			}
+
+			// The server may be running, so the database is only read
+			db, err := dbConnectReadOnly(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			settings, err := dbSettings(cmd.Context(), db)
+			if err != nil {
+				return err
+			}
+			config.applySettings(settings)
+
+			loc, err := config.location()
+			if err != nil {
+				return err
+			}
+
+			queries, _, err := config.newQueries(db)
+			if err != nil {
+				return err
+			}
+
+			if len(sites) == 0 {
+				sites = config.Domains
+			}
+			dates := statsPeriod(days, time.Now().In(loc))
+
+			for i, site := range sites {
+				stats, err := buildSiteStats(cmd.Context(), queries, site, dates, loc)
+				if err != nil {
+					return err
+				}
+
+				if i > 0 {
+					fmt.Println()
+				}
+				if err := printSiteStats(os.Stdout, site, days, &stats); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVar(&days, "days", 7, "How many days to count, up to and including today, such as 7 or 30")
+	cmd.Flags().StringArrayVar(&sites, "site", nil, "A site to show, instead of all of them (repeatable)")
+
+	return cmd
+}
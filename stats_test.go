@@ -0,0 +1,84 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+
+	writer, err := NewHitWriter(ctx, db)
+	require.NoError(t, err)
+	defer writer.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	hits := []struct {
+		timestamp  int64
+		identifier string
+		path       string
+		referrer   string
+	}{
+		{1654041600, "a", "/", "news.ycombinator.com"}, // 2022-06-01
+		{1654041660, "a", "/about", ""},
+		{1654128000, "b", "/", ""},                     // 2022-06-02
+		{1653955200, "c", "/", "news.ycombinator.com"}, // 2022-05-31, before the period
+	}
+	for _, h := range hits {
+		hit := &Hit{
+			Timestamp:         h.timestamp,
+			IdentifierCurrent: []byte(h.identifier),
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              h.path,
+			Location:          Location{Country: sql.NullString{String: "GB", Valid: true}},
+		}
+		if h.referrer != "" {
+			hit.ReferrerDomain = sql.NullString{String: h.referrer, Valid: true}
+			hit.ReferrerPath = sql.NullString{String: "/", Valid: true}
+		}
+		require.NoError(t, writer.InsertHit(ctx, tx, hit))
+	}
+	require.NoError(t, tx.Commit())
+	require.NoError(t, dbAggregate(ctx, db))
+
+	queries, err := NewQueries(db)
+	require.NoError(t, err)
+
+	dates := statsPeriod(2, time.Date(2022, 6, 2, 15, 0, 0, 0, time.UTC))
+	stats, err := buildSiteStats(ctx, queries, "example.com", dates, time.UTC)
+	require.NoError(t, err)
+
+	var out strings.Builder
+	require.NoError(t, printSiteStats(&out, "example.com", 2, &stats))
+	assert.Equal(t, `example.com, the last 2 days (1 June 2022 to 2 June 2022)
+
+Pageviews  3
+Visitors   2
+
+Page    Pageviews
+/       2
+/about  1
+
+Referrer              Pageviews
+news.ycombinator.com  1
+
+Country  Pageviews
+GB       3
+`, out.String())
+}
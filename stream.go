@@ -0,0 +1,159 @@
+package sheepcount
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// What a dashboard is told about each new hit. Identifiers are never sent to the browser.
+type streamedHit struct {
+	Timestamp int64     `json:"timestamp"`
+	Event     EventType `json:"event"`
+	Path      string    `json:"path"`
+}
+
+type subscriber struct {
+	site string
+	c    chan streamedHit
+}
+
+// Fans out new hits to the dashboards that are subscribed to them. Slow subscribers miss hits rather
+// than holding up the handlers. It is safe for concurrent use.
+type Broadcaster struct {
+	sync.Mutex
+	subscribers map[*subscriber]struct{}
+	closed      bool
+}
+
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{subscribers: make(map[*subscriber]struct{})}
+}
+
+// Subscribe to the hits for a site. The channel is closed when the broadcaster is closed.
+func (broadcaster *Broadcaster) Subscribe(site string) (*subscriber, bool) {
+	broadcaster.Lock()
+	defer broadcaster.Unlock()
+
+	if broadcaster.closed {
+		return nil, false
+	}
+
+	sub := &subscriber{site: site, c: make(chan streamedHit, 64)}
+	broadcaster.subscribers[sub] = struct{}{}
+	return sub, true
+}
+
+func (broadcaster *Broadcaster) Unsubscribe(sub *subscriber) {
+	broadcaster.Lock()
+	defer broadcaster.Unlock()
+
+	if _, ok := broadcaster.subscribers[sub]; ok {
+		delete(broadcaster.subscribers, sub)
+		close(sub.c)
+	}
+}
+
+func (broadcaster *Broadcaster) Publish(hit *Hit) {
+	broadcaster.Lock()
+	defer broadcaster.Unlock()
+
+	for sub := range broadcaster.subscribers {
+		if sub.site != hit.Domain {
+			continue
+		}
+
+		select {
+		case sub.c <- streamedHit{Timestamp: hit.Timestamp, Event: hit.Event, Path: hit.Path}:
+		default:
+		}
+	}
+}
+
+// Disconnect all subscribers, for example because the server is shutting down.
+func (broadcaster *Broadcaster) Close() {
+	broadcaster.Lock()
+	defer broadcaster.Unlock()
+
+	broadcaster.closed = true
+	for sub := range broadcaster.subscribers {
+		delete(broadcaster.subscribers, sub)
+		close(sub.c)
+	}
+}
+
+// Stream new hits on a site to a logged-in dashboard as Server-Sent Events.
+func handleStream(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	account := sheepcount.session(r)
+	if account == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	site := r.URL.Query().Get("site")
+	if site == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !account.canSee(site) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	sub, ok := sheepcount.broadcaster.Subscribe(site)
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer sheepcount.broadcaster.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // Stop nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Send a comment regularly so that proxies do not close an idle connection
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case hit, ok := <-sub.c:
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(hit)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: hit\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
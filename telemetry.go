@@ -0,0 +1,211 @@
+package sheepcount
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/instrument/syncfloat64"
+	"go.opentelemetry.io/otel/metric/instrument/syncint64"
+	"go.opentelemetry.io/otel/metric/unit"
+	controller "go.opentelemetry.io/otel/sdk/metric/controller/basic"
+	processor "go.opentelemetry.io/otel/sdk/metric/processor/basic"
+	"go.opentelemetry.io/otel/sdk/metric/selector/simple"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Traces and metrics of the HTTP handlers, database writer and GeoIP lookups, exported with OTLP
+// over HTTP to a collector such as the OpenTelemetry Collector, Jaeger or Grafana Agent.
+type TelemetryConfig struct {
+	Enabled     bool              `toml:"enabled"`
+	Endpoint    string            `toml:"endpoint"`     // The host and port of the collector
+	Insecure    bool              `toml:"insecure"`     // Use HTTP rather than HTTPS
+	Headers     map[string]string `toml:"headers"`      // Sent with every export, such as for authentication
+	ServiceName string            `toml:"service_name"` // To tell several SheepCounts apart
+	SampleRatio float64           `toml:"sample_ratio"` // The share of requests that are traced
+}
+
+func (config *TelemetryConfig) validate() error {
+	if !config.Enabled {
+		return nil
+	}
+	if config.Endpoint == "" {
+		return errors.New("telemetry endpoint must be set")
+	}
+	if config.SampleRatio < 0 || config.SampleRatio > 1 {
+		return errors.New("telemetry sample_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+const instrumentationName = "github.com/james-atkins/sheepcount"
+
+// The tracer and instruments use the global providers, so they do nothing until telemetry is
+// started, or record to the providers of the program that SheepCount is embedded in.
+var (
+	tracer = otel.Tracer(instrumentationName)
+	meter  = global.Meter(instrumentationName)
+
+	requestDuration = mustHistogram(meter.SyncFloat64().Histogram(
+		"sheepcount.http.server.duration",
+		instrument.WithUnit(unit.Milliseconds),
+		instrument.WithDescription("How long requests take to handle"),
+	))
+	batchDuration = mustHistogram(meter.SyncFloat64().Histogram(
+		"sheepcount.writer.batch.duration",
+		instrument.WithUnit(unit.Milliseconds),
+		instrument.WithDescription("How long batches of hits take to write to the database"),
+	))
+	batchSize = mustInt64Histogram(meter.SyncInt64().Histogram(
+		"sheepcount.writer.batch.hits",
+		instrument.WithUnit(unit.Dimensionless),
+		instrument.WithDescription("The number of hits in each batch"),
+	))
+	geoIPDuration = mustHistogram(meter.SyncFloat64().Histogram(
+		"sheepcount.geoip.lookup.duration",
+		instrument.WithUnit(unit.Milliseconds),
+		instrument.WithDescription("How long looking up the location of a hit takes"),
+	))
+)
+
+func mustHistogram(histogram syncfloat64.Histogram, err error) syncfloat64.Histogram {
+	if err != nil {
+		panic(err)
+	}
+	return histogram
+}
+
+func mustInt64Histogram(histogram syncint64.Histogram, err error) syncint64.Histogram {
+	if err != nil {
+		panic(err)
+	}
+	return histogram
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Start exporting traces and metrics, if telemetry is enabled. The returned function flushes and
+// stops the exporters.
+func startTelemetry(ctx context.Context, config *TelemetryConfig) (func(context.Context) error, error) {
+	if !config.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = "sheepcount"
+	}
+	res := resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))
+
+	traceOptions := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint), otlptracehttp.WithHeaders(config.Headers)}
+	metricOptions := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(config.Endpoint), otlpmetrichttp.WithHeaders(config.Headers)}
+	if config.Insecure {
+		traceOptions = append(traceOptions, otlptracehttp.WithInsecure())
+		metricOptions = append(metricOptions, otlpmetrichttp.WithInsecure())
+	}
+
+	traceExporter, err := otlptracehttp.New(ctx, traceOptions...)
+	if err != nil {
+		return nil, err
+	}
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(traceExporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+
+	metricExporter, err := otlpmetrichttp.New(ctx, metricOptions...)
+	if err != nil {
+		tracerProvider.Shutdown(ctx)
+		return nil, err
+	}
+	meterProvider := controller.New(
+		processor.NewFactory(simple.NewWithHistogramDistribution(), metricExporter),
+		controller.WithExporter(metricExporter),
+		controller.WithResource(res),
+	)
+	if err := meterProvider.Start(ctx); err != nil {
+		tracerProvider.Shutdown(ctx)
+		return nil, err
+	}
+
+	otel.SetTracerProvider(tracerProvider)
+	global.SetMeterProvider(meterProvider)
+
+	shutdown := func(ctx context.Context) error {
+		// Stopping the controller exports the last metrics
+		err := meterProvider.Stop(ctx)
+		if err := metricExporter.Shutdown(ctx); err != nil {
+			return err
+		}
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			return err
+		}
+		return err
+	}
+	return shutdown, nil
+}
+
+// Middleware to trace requests and record how long they take, by the pattern of the mux that they
+// are routed to rather than their path, as paths such as /public/<domain> are unbounded.
+func traceRequests(mux *http.ServeMux) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		attributes := []attribute.KeyValue{semconv.HTTPMethodKey.String(r.Method), semconv.HTTPRouteKey.String(route)}
+
+		ctx, span := tracer.Start(r.Context(), route, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attributes...))
+		defer span.End()
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(recorder.status))
+		if recorder.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+		attributes = append(attributes, semconv.HTTPStatusCodeKey.Int(recorder.status))
+		requestDuration.Record(ctx, milliseconds(time.Since(start)), attributes...)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// Remembers the status code of a response. It can be flushed, for the event stream.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if !recorder.wroteHeader {
+		recorder.status = status
+		recorder.wroteHeader = true
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(b []byte) (int, error) {
+	recorder.wroteHeader = true
+	return recorder.ResponseWriter.Write(b)
+}
+
+func (recorder *statusRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,59 @@
+package sheepcount
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+)
+
+func TestTraceRequests(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/public/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	mux.HandleFunc("/events/stream", func(w http.ResponseWriter, r *http.Request) {
+		_, ok := w.(http.Flusher)
+		assert.True(t, ok, "the event stream must be able to flush")
+	})
+	handler := traceRequests(mux)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/public/example.com", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/events/stream", nil))
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+
+	// Spans are named by the route, not the path
+	assert.Equal(t, "/public/", spans[0].Name())
+	assert.Contains(t, spans[0].Attributes(), semconv.HTTPStatusCodeKey.Int(http.StatusNotFound))
+	assert.Equal(t, "/events/stream", spans[1].Name())
+	assert.Contains(t, spans[1].Attributes(), semconv.HTTPStatusCodeKey.Int(http.StatusOK))
+}
+
+func TestTelemetryConfig(t *testing.T) {
+	config := DefaultConfig().Telemetry
+	assert.NoError(t, config.validate())
+
+	config.Enabled = true
+	assert.NoError(t, config.validate())
+
+	config.SampleRatio = 2
+	assert.Error(t, config.validate())
+
+	config.SampleRatio = 1
+	config.Endpoint = ""
+	assert.Error(t, config.validate())
+}
@@ -0,0 +1,306 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// Embed the time zone database in case the system has none, as in many containers
+	_ "time/tzdata"
+)
+
+// The longest period that the days of a query are listed for.
+const maxPeriodDays = 100 * 366
+
+// A day in the time zone of the dashboard, with the UTC timestamps of its midnight and the next.
+// Most days are 24 hours long, but those on which the clocks change are 23 or 25 hours long.
+type localDay struct {
+	Date  string `json:"date"`
+	Start int64  `json:"start"`
+	End   int64  `json:"end"`
+}
+
+// The midnight in loc at the start of a YYYY-MM-DD date. Out of range days and months are
+// normalised, so 2022-02-30 is 2022-03-02.
+func localMidnight(date string, loc *time.Location) (time.Time, bool) {
+	if !validDate(date) {
+		return time.Time{}, false
+	}
+
+	year, _ := strconv.Atoi(date[0:4])
+	month, _ := strconv.Atoi(date[5:7])
+	day, _ := strconv.Atoi(date[8:10])
+
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, loc), true
+}
+
+// Each day from startDate to endDate inclusive in loc.
+func localDays(startDate string, endDate string, loc *time.Location) ([]localDay, bool) {
+	start, ok1 := localMidnight(startDate, loc)
+	end, ok2 := localMidnight(endDate, loc)
+	if !ok1 || !ok2 {
+		return nil, false
+	}
+
+	days := []localDay{}
+	for day := start; !day.After(end); {
+		if len(days) == maxPeriodDays {
+			return nil, false
+		}
+
+		next := time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, loc)
+		days = append(days, localDay{Date: day.Format("2006-01-02"), Start: day.Unix(), End: next.Unix()})
+		day = next
+	}
+
+	return days, true
+}
+
+var (
+	sqlCommentRegexp   = regexp.MustCompile(`--[^\n]*`)
+	sqlParameterRegexp = regexp.MustCompile(`:([a-z_]+)`)
+)
+
+// The names of the named parameters of a query.
+func queryParameters(query string) map[string]bool {
+	parameters := make(map[string]bool)
+	for _, match := range sqlParameterRegexp.FindAllStringSubmatch(sqlCommentRegexp.ReplaceAllString(query, ""), -1) {
+		parameters[match[1]] = true
+	}
+	return parameters
+}
+
+// Queries are given their period as start_date and end_date, which are dates in the time zone given
+// by the timezone argument, or UTC if there is none. SQLite only knows about UTC offsets, not time
+// zones, so before binding these are converted in Go into whichever of these the query uses:
+//
+//   - start and end, the UTC timestamps of the start of start_date and of the day after end_date;
+//   - days, a JSON array of the days of the period with the timestamps that they start and end at;
+//   - zone, the name of the time zone, whose daily rollups the query can use if it has them.
+//
+// Periods that are not UTC days and that the rollups of the zone do not cover are counted from the
+// hourly rollups, whose hours start on the UTC hour, so checkHourlyPeriod rejects those periods in
+// zones that are not a whole number of hours from UTC.
+//
+// database/sql checks that a query is given exactly as many arguments as it has parameters, so the
+// others are not bound, nor are named arguments that the query does not use, such as include_bots,
+// which the API gives every query. Invalid dates are bound as NULL, which matches nothing.
+func bindPeriod(parameters map[string]bool, args []interface{}) []interface{} {
+	startDate, endDate, loc, hasPeriod := queryPeriod(args)
+
+	bound := make([]interface{}, 0, len(args)+1)
+	for _, arg := range args {
+		named, ok := arg.(sql.NamedArg)
+		if !ok {
+			bound = append(bound, arg)
+			continue
+		}
+
+		switch named.Name {
+		case "start_date", "end_date", "timezone":
+		default:
+			if parameters[named.Name] {
+				bound = append(bound, arg)
+			}
+		}
+	}
+
+	if !hasPeriod {
+		return bound
+	}
+
+	if parameters["start"] || parameters["end"] {
+		var start, end interface{}
+		if s, ok := localMidnight(startDate, loc); ok {
+			start = s.Unix()
+		}
+		if e, ok := localMidnight(endDate, loc); ok {
+			end = time.Date(e.Year(), e.Month(), e.Day()+1, 0, 0, 0, 0, loc).Unix()
+		}
+
+		if parameters["start"] {
+			bound = append(bound, sql.Named("start", start))
+		}
+		if parameters["end"] {
+			bound = append(bound, sql.Named("end", end))
+		}
+	}
+
+	if parameters["zone"] {
+		bound = append(bound, sql.Named("zone", loc.String()))
+	}
+
+	if parameters["days"] {
+		var value interface{}
+		if days, ok := localDays(startDate, endDate, loc); ok {
+			b, _ := json.Marshal(days)
+			value = string(b)
+		}
+		bound = append(bound, sql.Named("days", value))
+	}
+
+	return bound
+}
+
+// The start_date, end_date and timezone of the arguments of a query, and whether it has a period.
+func queryPeriod(args []interface{}) (string, string, *time.Location, bool) {
+	var startDate, endDate string
+	var hasPeriod bool
+	loc := time.UTC
+
+	for _, arg := range args {
+		named, ok := arg.(sql.NamedArg)
+		if !ok {
+			continue
+		}
+
+		switch named.Name {
+		case "start_date":
+			startDate, _ = named.Value.(string)
+			hasPeriod = true
+		case "end_date":
+			endDate, _ = named.Value.(string)
+			hasPeriod = true
+		case "timezone":
+			if l, ok := named.Value.(*time.Location); ok && l != nil {
+				loc = l
+			}
+		}
+	}
+
+	return startDate, endDate, loc, hasPeriod
+}
+
+// Queries that use zone count the days that the rollups of the zone do not cover from the hourly
+// rollups. Their hours start on the UTC hour, so in a zone that is not a whole number of hours from
+// UTC, such as Asia/Kolkata, the days before the zone was first rolled up, and those before the
+// oldest hits, cannot be counted. A period with any of those days is bad input, unless the site has
+// no hourly rollups in them to count.
+func checkHourlyPeriod(ctx context.Context, db *sql.DB, parameters map[string]bool, args []interface{}) error {
+	if !parameters["zone"] {
+		return nil
+	}
+
+	startDate, endDate, loc, hasPeriod := queryPeriod(args)
+	if !hasPeriod {
+		return nil
+	}
+	days, ok := localDays(startDate, endDate, loc)
+	if !ok || len(days) == 0 {
+		return nil
+	}
+
+	// Whether the days that start before end start and end on UTC hours
+	wholeHours := func(end int64) bool {
+		for _, day := range days {
+			if day.Start >= end {
+				break
+			}
+			if day.Start%3600 != 0 || day.End%3600 != 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	end := days[len(days)-1].End
+	if wholeHours(end) {
+		return nil
+	}
+
+	// The days from since are counted from the rollups of the zone, as the query does
+	var since sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT since FROM rollup_timezones WHERE timezone = ?", loc.String()).Scan(&since)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if since.Valid && since.Int64 < end {
+		end = since.Int64
+	}
+	if end <= days[0].Start || wholeHours(end) {
+		return nil
+	}
+
+	var site string
+	for _, arg := range args {
+		if named, ok := arg.(sql.NamedArg); ok && named.Name == "site" {
+			site, _ = named.Value.(string)
+		}
+	}
+
+	var hourly bool
+	err = db.QueryRowContext(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM totals_hourly WHERE site_id = (SELECT site_id FROM sites WHERE domain = ?) AND hour >= ? AND hour < ?)",
+		site, days[0].Start-days[0].Start%3600, end,
+	).Scan(&hourly)
+	if err != nil || !hourly {
+		return err
+	}
+
+	return BadInput(fmt.Errorf(
+		"the days in %s before %s cannot be counted, as they have not been rolled up and it is not a whole number of hours from UTC",
+		loc, time.Unix(end, 0).In(loc).Format("2006-01-02"),
+	))
+}
+
+// A row of a query that could not be run, whose Scan returns why.
+type errRow struct {
+	err error
+}
+
+func (row errRow) Scan(dest ...interface{}) error {
+	return row.err
+}
+
+// A prepared query whose period is converted by bindPeriod.
+type preparedQuery struct {
+	db         *sql.DB
+	stmt       *sql.Stmt
+	parameters map[string]bool
+	manifest   *queryManifest
+}
+
+func (query *preparedQuery) QueryRowContext(ctx context.Context, args ...interface{}) Row {
+	args = query.manifest.bindDefaults(args)
+	if err := checkHourlyPeriod(ctx, query.db, query.parameters, args); err != nil {
+		return errRow{err}
+	}
+	return query.stmt.QueryRowContext(ctx, bindPeriod(query.parameters, args)...)
+}
+
+func (query *preparedQuery) Manifest() *queryManifest {
+	return query.manifest
+}
+
+// The time zones that have been loaded by loadTimezone, by name.
+var timezones sync.Map
+
+// Load a time zone by its IANA name, such as Europe/London.
+func loadTimezone(name string) (*time.Location, error) {
+	if loc, ok := timezones.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+
+	timezones.Store(name, loc)
+	return loc, nil
+}
+
+// The time zone for the dates of the dashboard, reports and public pages.
+func (config *Config) location() (*time.Location, error) {
+	if strings.TrimSpace(config.Timezone) == "" {
+		return time.UTC, nil
+	}
+	return loadTimezone(config.Timezone)
+}
@@ -0,0 +1,146 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalDays(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The clocks go forward on 27 March 2022 and back on 30 October 2022
+	days, ok := localDays("2022-03-26", "2022-03-27", london)
+	assert.True(t, ok)
+	assert.Equal(t, []localDay{
+		{Date: "2022-03-26", Start: 1648252800, End: 1648339200},
+		{Date: "2022-03-27", Start: 1648339200, End: 1648422000},
+	}, days)
+
+	days, ok = localDays("2022-10-30", "2022-10-30", london)
+	assert.True(t, ok)
+	assert.Equal(t, []localDay{{Date: "2022-10-30", Start: 1667084400, End: 1667174400}}, days)
+
+	days, ok = localDays("2022-06-02", "2022-06-01", london)
+	assert.True(t, ok)
+	assert.Empty(t, days)
+
+	_, ok = localDays("yesterday", "2022-06-01", london)
+	assert.False(t, ok)
+
+	_, ok = localDays("0001-01-01", "9999-12-31", london)
+	assert.False(t, ok)
+}
+
+func TestLoadTimezone(t *testing.T) {
+	for _, name := range []string{"UTC", "Europe/London", "America/New_York", "Asia/Kolkata", "Australia/Lord_Howe"} {
+		loc, err := loadTimezone(name)
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, name, loc.String())
+		}
+	}
+
+	_, err := loadTimezone("Nowhere/Else")
+	assert.Error(t, err)
+}
+
+func TestCheckHourlyPeriod(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+
+	// A pageview at 06:00 UTC on 1 June, which is 11:30 in Kolkata
+	_, err = db.Exec("INSERT INTO sites (domain) VALUES ('example.com'), ('example.org')")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO totals_hourly (hour, site_id, bot, pageviews, visitors) VALUES (1654063200, 1, 0, 1, 1)")
+	require.NoError(t, err)
+
+	kolkata, err := loadTimezone("Asia/Kolkata")
+	require.NoError(t, err)
+	newYork, err := loadTimezone("America/New_York")
+	require.NoError(t, err)
+
+	check := func(parameters string, site string, loc *time.Location) error {
+		args := []interface{}{
+			sql.Named("site", site),
+			sql.Named("start_date", "2022-06-01"),
+			sql.Named("end_date", "2022-06-02"),
+			sql.Named("timezone", loc),
+		}
+		return checkHourlyPeriod(ctx, db, queryParameters(parameters), args)
+	}
+
+	// The hours cannot be counted in the days of Kolkata until they are rolled up
+	err = check("SELECT :site, :start, :zone", "example.com", kolkata)
+	assert.IsType(t, &ErrBadInput{}, err)
+	assert.EqualError(t, err, "bad input: the days in Asia/Kolkata before 2022-06-03 cannot be counted, as they have not been rolled up and it is not a whole number of hours from UTC")
+
+	// Unless the query does not use the rollups, the hours are whole, or there are none to count
+	assert.NoError(t, check("SELECT :site, :start", "example.com", kolkata))
+	assert.NoError(t, check("SELECT :site, :start, :zone", "example.com", newYork))
+	assert.NoError(t, check("SELECT :site, :start, :zone", "example.org", kolkata))
+
+	// Once the days are rolled up, only those before are counted from the hours
+	_, err = db.Exec("INSERT INTO rollup_timezones (timezone, since) VALUES ('Asia/Kolkata', 1654108200)")
+	require.NoError(t, err)
+	assert.EqualError(t, check("SELECT :site, :start, :zone", "example.com", kolkata), "bad input: the days in Asia/Kolkata before 2022-06-02 cannot be counted, as they have not been rolled up and it is not a whole number of hours from UTC")
+	_, err = db.Exec("UPDATE rollup_timezones SET since = 1654021800")
+	require.NoError(t, err)
+	assert.NoError(t, check("SELECT :site, :start, :zone", "example.com", kolkata))
+}
+
+func TestBindPeriod(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := []interface{}{
+		sql.Named("site", "example.com"),
+		sql.Named("start_date", "2022-06-01"),
+		sql.Named("end_date", "2022-06-01"),
+		sql.Named("timezone", newYork),
+	}
+
+	assert.Equal(
+		t,
+		[]interface{}{sql.Named("site", "example.com"), sql.Named("start", int64(1654056000)), sql.Named("end", int64(1654142400))},
+		bindPeriod(queryParameters("SELECT :site, :start, :end -- :days"), args),
+	)
+	assert.Equal(
+		t,
+		[]interface{}{sql.Named("site", "example.com"), sql.Named("days", `[{"date":"2022-06-01","start":1654056000,"end":1654142400}]`)},
+		bindPeriod(queryParameters("SELECT :site, :days"), args),
+	)
+
+	// Without a time zone the dates are in UTC
+	assert.Equal(
+		t,
+		[]interface{}{sql.Named("start", int64(1654041600))},
+		bindPeriod(queryParameters("SELECT :start"), args[1:3]),
+	)
+
+	// Arguments that the query does not use are not bound
+	assert.Equal(
+		t,
+		[]interface{}{sql.Named("site", "example.com"), sql.Named("start", int64(1654056000))},
+		bindPeriod(queryParameters("SELECT :site, :start"), append([]interface{}{sql.Named("include_bots", false)}, args...)),
+	)
+
+	// Invalid dates match nothing
+	assert.Equal(
+		t,
+		[]interface{}{sql.Named("start", nil)},
+		bindPeriod(queryParameters("SELECT :start"), []interface{}{sql.Named("start_date", "today"), sql.Named("end_date", "2022-06-01")}),
+	)
+}
@@ -0,0 +1,289 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// Show titles of pages in the dashboard, such as "About Us" instead of /about-us-v2-final.
+type PageTitlesConfig struct {
+	// Fetch the sitemap.xml of each domain, and the titles of the pages in it that have been visited
+	Sitemap bool `toml:"sitemap"`
+
+	// A file or URL of a JSON object of titles by domain and path, such as
+	// {"example.com": {"/about-us-v2-final": "About Us"}}. They take precedence over the sitemap.
+	Mapping string `toml:"mapping"`
+
+	RefreshInterval time.Duration `toml:"refresh_interval"` // How often to look for new titles
+}
+
+func (config *PageTitlesConfig) Enabled() bool {
+	return config.Sitemap || config.Mapping != ""
+}
+
+func (config *PageTitlesConfig) validate() error {
+	if config.Enabled() && config.RefreshInterval <= 0 {
+		return fmt.Errorf("page titles refresh_interval must be positive, not %s", config.RefreshInterval)
+	}
+	return nil
+}
+
+const (
+	maxTitleFetches  = 50      // The most pages whose titles are fetched from each site at once
+	maxTitleBodySize = 1 << 20 // Sitemaps and pages are only read this far
+	maxTitleLength   = 200
+)
+
+func fetchTitleSource(ctx context.Context, client *retryablehttp.Client, u string) ([]byte, error) {
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: HTTP error: %s", u, resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxTitleBodySize))
+}
+
+// The pages of a sitemap, or the other sitemaps of a sitemap index.
+type sitemap struct {
+	Pages    []string `xml:"url>loc"`
+	Sitemaps []string `xml:"sitemap>loc"`
+}
+
+func parseSitemap(data []byte) (*sitemap, error) {
+	var s sitemap
+	if err := xml.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid sitemap: %w", err)
+	}
+	return &s, nil
+}
+
+var titleElement = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// The title of an HTML page, with its whitespace collapsed, or empty if it has none.
+func pageTitle(page []byte) string {
+	match := titleElement.FindSubmatch(page)
+	if match == nil {
+		return ""
+	}
+
+	return cleanTitle(html.UnescapeString(string(match[1])))
+}
+
+// A title with its whitespace collapsed and control characters removed, cut to the longest that is
+// kept.
+func cleanTitle(title string) string {
+	title = strings.Join(strings.FieldsFunc(title, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}), " ")
+	if runes := []rune(title); len(runes) > maxTitleLength {
+		title = strings.TrimSpace(string(runes[:maxTitleLength]))
+	}
+	return title
+}
+
+// Titles by domain and then by path.
+type pageTitles map[string]map[string]string
+
+func loadTitleMapping(ctx context.Context, client *retryablehttp.Client, source string) (pageTitles, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://") {
+		data, err = fetchTitleSource(ctx, client, source)
+	} else {
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var titles pageTitles
+	if err := json.Unmarshal(data, &titles); err != nil {
+		return nil, fmt.Errorf("invalid page titles: %w", err)
+	}
+	return titles, nil
+}
+
+// Where titles come from
+const (
+	titleFromSitemap = "sitemap"
+	titleFromMapping = "mapping"
+)
+
+// Set the title of a path of a site, if it has been visited. An empty title removes it.
+func dbSetPathTitle(ctx context.Context, db *sql.DB, domain string, path string, title string, source string) error {
+	_, err := db.ExecContext(
+		ctx,
+		`UPDATE paths SET title = NULLIF(:title, ''), title_source = CASE WHEN :title != '' THEN :source END
+		WHERE site_id = (SELECT site_id FROM sites WHERE domain = :domain) AND path = :path
+		  AND (title IS NOT NULLIF(:title, '') OR title_source IS NOT :source)`,
+		sql.Named("title", title),
+		sql.Named("source", source),
+		sql.Named("domain", domain),
+		sql.Named("path", path),
+	)
+	return err
+}
+
+// Whether the path of a site has been visited and does not have a title yet.
+func dbPathUntitled(ctx context.Context, db *sql.DB, domain string, path string) (bool, error) {
+	var untitled bool
+	err := db.QueryRowContext(
+		ctx,
+		"SELECT title IS NULL FROM paths WHERE site_id = (SELECT site_id FROM sites WHERE domain = ?) AND path = ?",
+		domain,
+		path,
+	).Scan(&untitled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return untitled, err
+}
+
+// The pages in the sitemap of the domain, following a sitemap index one level down.
+func (sheepcount *SheepCount) sitemapPages(ctx context.Context, client *retryablehttp.Client, domain string) ([]string, error) {
+	data, err := fetchTitleSource(ctx, client, "https://"+domain+"/sitemap.xml")
+	if err != nil {
+		return nil, err
+	}
+	index, err := parseSitemap(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := index.Pages
+	for _, loc := range index.Sitemaps {
+		data, err := fetchTitleSource(ctx, client, loc)
+		if err != nil {
+			return nil, err
+		}
+		s, err := parseSitemap(data)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, s.Pages...)
+	}
+
+	return pages, nil
+}
+
+// Fetch the titles of the pages in the sitemap of the domain that have been visited but do not have
+// a title yet, returning how many were found. Only so many pages are fetched at once, and the rest
+// are left for next time.
+func (sheepcount *SheepCount) refreshSitemapTitles(ctx context.Context, client *retryablehttp.Client, domain string) (int, error) {
+	pages, err := sheepcount.sitemapPages(ctx, client, domain)
+	if err != nil {
+		return 0, err
+	}
+
+	fetches, found := 0, 0
+	for _, page := range pages {
+		u, err := url.Parse(strings.TrimSpace(page))
+		if err != nil || !strings.EqualFold(u.Hostname(), domain) || u.Path == "" {
+			continue
+		}
+
+		path := sheepcount.Paths.Normalize(u)
+		untitled, err := dbPathUntitled(ctx, sheepcount.db, domain, path)
+		if err != nil {
+			return found, err
+		}
+		if !untitled {
+			continue
+		}
+
+		if fetches == maxTitleFetches {
+			break
+		}
+		fetches++
+
+		body, err := fetchTitleSource(ctx, client, u.String())
+		if err != nil {
+			log.Printf("Cannot fetch the title of %s: %s", u, err)
+			continue
+		}
+		if title := pageTitle(body); title != "" {
+			if err := dbSetPathTitle(ctx, sheepcount.db, domain, path, title, titleFromSitemap); err != nil {
+				return found, err
+			}
+			found++
+		}
+	}
+
+	return found, nil
+}
+
+func (sheepcount *SheepCount) refreshPageTitles(ctx context.Context) error {
+	client := newClient()
+
+	if sheepcount.PageTitles.Sitemap {
+		for _, domain := range sheepcount.Domains {
+			found, err := sheepcount.refreshSitemapTitles(ctx, client, domain)
+			if err != nil {
+				log.Printf("Cannot refresh the page titles of %s from its sitemap: %s", domain, err)
+				continue
+			}
+			if found > 0 {
+				log.Printf("Found %d page titles in the sitemap of %s", found, domain)
+			}
+		}
+	}
+
+	if sheepcount.PageTitles.Mapping != "" {
+		titles, err := loadTitleMapping(ctx, client, sheepcount.PageTitles.Mapping)
+		if err != nil {
+			return err
+		}
+		for domain, paths := range titles {
+			for path, title := range paths {
+				if err := dbSetPathTitle(ctx, sheepcount.db, domain, path, cleanTitle(title), titleFromMapping); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Look for new page titles at the configured interval.
+func (sheepcount *SheepCount) PageTitler(ctx context.Context) error {
+	ticker := time.NewTicker(sheepcount.PageTitles.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := sheepcount.refreshPageTitles(ctx); err != nil {
+			log.Printf("Cannot refresh page titles: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSitemap(t *testing.T) {
+	s, err := parseSitemap([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>https://example.com/</loc><lastmod>2022-06-01</lastmod></url>
+  <url><loc>https://example.com/about-us-v2-final</loc></url>
+</urlset>`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://example.com/", "https://example.com/about-us-v2-final"}, s.Pages)
+	assert.Empty(t, s.Sitemaps)
+
+	s, err = parseSitemap([]byte(`<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>https://example.com/sitemap-posts.xml</loc></sitemap>
+</sitemapindex>`))
+	require.NoError(t, err)
+	assert.Empty(t, s.Pages)
+	assert.Equal(t, []string{"https://example.com/sitemap-posts.xml"}, s.Sitemaps)
+
+	_, err = parseSitemap([]byte(`<urlset>`))
+	assert.Error(t, err)
+}
+
+func TestPageTitle(t *testing.T) {
+	assert.Equal(t, "About Us & Contact", pageTitle([]byte("<html><head><TITLE lang=\"en\">\n  About Us &amp;\n Contact </TITLE></head></html>")))
+	assert.Equal(t, "", pageTitle([]byte("<html><head></head></html>")))
+}
+
+func TestTitleMapping(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO sites (site_id, domain) VALUES (1, 'example.com'), (2, 'example.org');
+		INSERT INTO paths (site_id, path) VALUES (1, '/about-us-v2-final'), (2, '/about-us-v2-final'), (1, '/');`)
+	require.NoError(t, err)
+
+	mapping := filepath.Join(t.TempDir(), "titles.json")
+	require.NoError(t, os.WriteFile(mapping, []byte(`{"example.com": {"/about-us-v2-final": "About Us", "/never-visited": "Never"}}`), 0600))
+
+	config := DefaultConfig()
+	config.PageTitles.Mapping = mapping
+	sheepcount := &SheepCount{Config: config, db: db}
+	require.NoError(t, sheepcount.refreshPageTitles(ctx))
+
+	titles := make(map[string]string)
+	rows, err := db.QueryContext(ctx, "SELECT sites.domain || paths.path, paths.title FROM paths INNER JOIN sites ON paths.site_id = sites.site_id WHERE paths.title IS NOT NULL")
+	require.NoError(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var page, title string
+		require.NoError(t, rows.Scan(&page, &title))
+		titles[page] = title
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, map[string]string{"example.com/about-us-v2-final": "About Us"}, titles)
+
+	untitled, err := dbPathUntitled(ctx, db, "example.com", "/")
+	require.NoError(t, err)
+	assert.True(t, untitled)
+	untitled, err = dbPathUntitled(ctx, db, "example.com", "/about-us-v2-final")
+	require.NoError(t, err)
+	assert.False(t, untitled)
+}
+
+func TestPageSentTitles(t *testing.T) {
+	db, err := dbConnect(filepath.Join(t.TempDir(), "sheepcount.sqlite3"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+
+	writer, err := NewHitWriter(ctx, db)
+	require.NoError(t, err)
+	defer writer.Close()
+
+	conn, err := db.Conn(ctx)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	write := func(path string, title string) {
+		hit := Hit{
+			Timestamp:         1654041600,
+			IdentifierCurrent: []byte("a"),
+			UserAgent:         "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0",
+			Event:             PageLoad,
+			Domain:            "example.com",
+			Path:              path,
+			Title:             sql.NullString{String: title, Valid: title != ""},
+		}
+		require.NoError(t, writer.WriteBatch(ctx, conn, []Hit{hit}))
+	}
+
+	title := func(path string) (string, string) {
+		var title, source sql.NullString
+		err := conn.QueryRowContext(ctx, "SELECT title, title_source FROM paths WHERE path = ?", path).Scan(&title, &source)
+		require.NoError(t, err)
+		return title.String, source.String
+	}
+
+	write("/", "Home")
+	write("/about", "About")
+	write("/about", "About Us")
+	write("/about", "")
+
+	// The latest title that was sent
+	home, source := title("/")
+	assert.Equal(t, "Home", home)
+	assert.Equal(t, "page", source)
+	about, _ := title("/about")
+	assert.Equal(t, "About Us", about)
+
+	// Titles from the sitemap are replaced, but not those from the mapping
+	require.NoError(t, dbSetPathTitle(ctx, db, "example.com", "/", "Sitemap Home", titleFromSitemap))
+	require.NoError(t, dbSetPathTitle(ctx, db, "example.com", "/about", "About the Company", titleFromMapping))
+	writer.ClearCache()
+	write("/", "Home")
+	write("/about", "About Us")
+
+	home, _ = title("/")
+	assert.Equal(t, "Home", home)
+	about, source = title("/about")
+	assert.Equal(t, "About the Company", about)
+	assert.Equal(t, titleFromMapping, source)
+}
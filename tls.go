@@ -0,0 +1,129 @@
+package sheepcount
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type TLSConfig struct {
+	// Paths to a PEM encoded certificate and private key
+	Certificate string `toml:"certificate"`
+	Key         string `toml:"key"`
+
+	// Instead of using a certificate and key, obtain a certificate from Let's Encrypt
+	Autocert bool   `toml:"autocert"`
+	Email    string `toml:"email"`     // Contact email address for the ACME account
+	CacheDir string `toml:"cache_dir"` // Directory to store certificates obtained by autocert
+
+	// How autocert proves control of the hostname: tls-alpn-01 (the default) on the HTTPS listener,
+	// or http-01 on the redirect listener, for when Let's Encrypt cannot reach the HTTPS listener
+	// directly, such as behind a proxy on port 443 that does not pass ALPN through
+	Challenge string `toml:"challenge"`
+
+	Address         string `toml:"address"`          // Address for the HTTPS server
+	RedirectAddress string `toml:"redirect_address"` // Address for the HTTP to HTTPS redirect server
+}
+
+func (config *TLSConfig) Enabled() bool {
+	return config.Autocert || config.Certificate != "" || config.Key != ""
+}
+
+func (config *TLSConfig) validateChallenge() error {
+	switch config.Challenge {
+	case "", "tls-alpn-01":
+		return nil
+	case "http-01":
+		if !config.Autocert {
+			return errors.New("the http-01 challenge needs autocert")
+		}
+		if config.RedirectAddress == "" {
+			return errors.New("the http-01 challenge is solved on the redirect address, so it must be set")
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid ACME challenge %s: must be tls-alpn-01 or http-01", config.Challenge)
+	}
+}
+
+// The TLS configuration of the HTTPS listener and the handler for the redirect listener, which
+// also solves HTTP-01 challenges if autocert uses them.
+func (sheepcount *SheepCount) tlsConfig() (*tls.Config, http.Handler, error) {
+	if err := sheepcount.TLS.validateChallenge(); err != nil {
+		return nil, nil, err
+	}
+
+	if sheepcount.TLS.Autocert {
+		if sheepcount.Hostname == "" {
+			return nil, nil, fmt.Errorf("hostname must be set to use autocert")
+		}
+
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(sheepcount.TLS.CacheDir),
+			HostPolicy: autocert.HostWhitelist(sheepcount.Hostname),
+			Email:      sheepcount.TLS.Email,
+		}
+
+		// The TLS-ALPN-01 challenge is solved on the HTTPS listener itself, and the HTTP-01
+		// challenge on the redirect listener, which passes everything else on to the redirect
+		if sheepcount.TLS.Challenge == "http-01" {
+			return manager.TLSConfig(), manager.HTTPHandler(httpsRedirect(sheepcount.TLS.Address)), nil
+		}
+		return manager.TLSConfig(), httpsRedirect(sheepcount.TLS.Address), nil
+	}
+
+	if sheepcount.TLS.Certificate == "" || sheepcount.TLS.Key == "" {
+		return nil, nil, fmt.Errorf("both a TLS certificate and key must be given")
+	}
+
+	cert, err := tls.LoadX509KeyPair(sheepcount.TLS.Certificate, sheepcount.TLS.Key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot load TLS certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	return config, httpsRedirect(sheepcount.TLS.Address), nil
+}
+
+// Handler that redirects every HTTP request to its HTTPS equivalent, on the port of the HTTPS
+// listener at address, which is left out of the URL if it is 443.
+func httpsRedirect(address string) http.Handler {
+	var port string
+	if _, p, err := net.SplitHostPort(address); err == nil && p != "443" && p != "https" {
+		port = p
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,44 @@
+package sheepcount
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	for _, test := range []struct {
+		address string
+		host    string
+		target  string
+	}{
+		{":443", "example.com", "https://example.com/blog?page=2"},
+		{":443", "example.com:80", "https://example.com/blog?page=2"},
+		{"0.0.0.0:https", "example.com", "https://example.com/blog?page=2"},
+		{":8443", "example.com:8080", "https://example.com:8443/blog?page=2"},
+		{"[::]:8443", "[2001:db8::1]", "https://[2001:db8::1]:8443/blog?page=2"},
+		{":443", "[2001:db8::1]:80", "https://[2001:db8::1]/blog?page=2"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://"+test.host+"/blog?page=2", nil)
+		w := httptest.NewRecorder()
+		httpsRedirect(test.address).ServeHTTP(w, r)
+		assert.Equal(t, http.StatusMovedPermanently, w.Code, test.address)
+		assert.Equal(t, test.target, w.Header().Get("Location"), test.address)
+	}
+
+	// Other methods are not redirected, as their bodies have been sent over HTTP already
+	r := httptest.NewRequest(http.MethodHead, "http://example.com/", nil)
+	w := httptest.NewRecorder()
+	httpsRedirect(":443").ServeHTTP(w, r)
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		r := httptest.NewRequest(method, "http://example.com/api/event", nil)
+		w := httptest.NewRecorder()
+		httpsRedirect(":443").ServeHTTP(w, r)
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code, method)
+		assert.Empty(t, w.Header().Get("Location"), method)
+	}
+}
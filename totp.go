@@ -0,0 +1,353 @@
+package sheepcount
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Time-based one-time passwords (RFC 6238) as the second factor of dashboard accounts, with the
+// defaults that authenticator apps expect: HMAC-SHA1, six digits and a new code every 30 seconds.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1 // Codes this many steps either side are accepted, for clocks that are a little out
+
+	// How long after the password there is to enter the code
+	totpPendingTimeout = 5 * time.Minute
+
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Wrong codes slow down guessing: five attempts for each account and then one every 30 seconds.
+var totpAttempts = newRateLimiter(1.0/30, 5)
+
+func newTOTPSecret() (string, error) {
+	var secret [20]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret[:]), nil
+}
+
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// The time step of the code, if it is valid at now for the secret.
+func totpVerify(secret string, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	step := now.Unix() / totpPeriod
+	for i := step - totpSkew; i <= step+totpSkew; i++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, i)), []byte(code)) == 1 {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// The URI for the QR code that authenticator apps scan.
+func totpURI(secret string, name string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", "SheepCount")
+	return "otpauth://totp/" + url.PathEscape("SheepCount:"+name) + "?" + query.Encode()
+}
+
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		var random [5]byte
+		if _, err := rand.Read(random[:]); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(random[:]))
+		codes[i] = code[:4] + "-" + code[4:]
+	}
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := blake2b.Sum256([]byte(code))
+	return hash[:]
+}
+
+// Turn on the second factor of an account, replacing any recovery codes. The sessions of the
+// account are logged out, as they only needed the password.
+func dbEnableTOTP(ctx context.Context, db *sql.DB, name string, secret string, recoveryCodes []string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRowContext(
+		ctx,
+		"UPDATE users_admin SET totp_secret = ?, totp_last_step = NULL, generation = generation + 1 WHERE name = ? RETURNING account_id",
+		secret, name,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM users_admin_recovery_codes WHERE account_id = ?", id); err != nil {
+		return false, err
+	}
+	for _, code := range recoveryCodes {
+		_, err := tx.ExecContext(ctx, "INSERT INTO users_admin_recovery_codes (account_id, hash) VALUES (?, ?)", id, hashRecoveryCode(code))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+func dbDisableTOTP(ctx context.Context, db *sql.DB, name string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRowContext(ctx, "UPDATE users_admin SET totp_secret = NULL, totp_last_step = NULL WHERE name = ? RETURNING account_id", name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM users_admin_recovery_codes WHERE account_id = ?", id); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// Check the second factor of an account, either a TOTP code that has not been used yet or a recovery
+// code, which is then used up.
+func dbVerifySecondFactor(ctx context.Context, db *sql.DB, id int64, code string, now time.Time) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var secret sql.NullString
+	var lastStep sql.NullInt64
+	err = tx.QueryRowContext(ctx, "SELECT totp_secret, totp_last_step FROM users_admin WHERE account_id = ?", id).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows || (err == nil && !secret.Valid) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if step, ok := totpVerify(secret.String, code, now); ok {
+		// A code cannot be used twice, such as by someone watching it being typed
+		if lastStep.Valid && step <= lastStep.Int64 {
+			return false, nil
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE users_admin SET totp_last_step = ? WHERE account_id = ?", step, id); err != nil {
+			return false, err
+		}
+		return true, tx.Commit()
+	}
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM users_admin_recovery_codes WHERE account_id = ? AND hash = ?", id, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// Is the cookie of someone who has entered the password of an account with a second factor, and has
+// not entered the code yet?
+func (token *authCookie) pendingSecondFactor(now time.Time) bool {
+	return !token.LoggedIn && token.Pending != 0 && now.Sub(time.Unix(token.PendingSince, 0)) < totpPendingTimeout
+}
+
+// The second step of logging in to an account with a second factor.
+func handleSecondFactor(sheepcount *SheepCount, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !sheepcount.sameOrigin(r) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid origin")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	token := sheepcount.getAuthCookie(r)
+	if !token.pendingSecondFactor(now) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	value := authCookie{Pending: token.Pending, Generation: token.Generation, PendingSince: token.PendingSince, InvalidCode: true}
+
+	if ok, _ := totpAttempts.Allow(fmt.Sprint(token.Pending), now); ok {
+		verified, err := dbVerifySecondFactor(r.Context(), sheepcount.db, token.Pending, r.Form.Get("code"), now)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// The password may have changed since it was entered
+		account, err := dbAccount(r.Context(), sheepcount.db, token.Pending)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if verified && account != nil && account.Generation == token.Generation {
+			if value, err = sheepcount.startSession(r.Context(), account.Id, account.Generation); err != nil {
+				log.Print(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	if err := sheepcount.setAuthCookie(w, r, value); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func newTOTPCommand(databasePath *string) *cobra.Command {
+	var disable bool
+
+	cmd := &cobra.Command{
+		Use:   "totp <name>",
+		Short: "Set up a TOTP app as the second factor of an account, logging out its sessions",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := dbConnect(*databasePath)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			if disable {
+				ok, err := dbDisableTOTP(cmd.Context(), db, args[0])
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return fmt.Errorf("no such account: %s", args[0])
+				}
+				return nil
+			}
+
+			var exists bool
+			if err := db.QueryRowContext(cmd.Context(), "SELECT EXISTS (SELECT 1 FROM users_admin WHERE name = ?)", args[0]).Scan(&exists); err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("no such account: %s", args[0])
+			}
+
+			secret, err := newTOTPSecret()
+			if err != nil {
+				return err
+			}
+
+			fmt.Println("Add this account to the TOTP app, by turning the URI into a QR code or entering the secret:")
+			fmt.Println()
+			fmt.Println("  " + totpURI(secret, args[0]))
+			fmt.Println("  " + secret)
+			fmt.Println()
+
+			// Check that the app has it before it is needed to log in
+			fmt.Fprint(os.Stderr, "Code from the app: ")
+			code, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && code == "" {
+				return err
+			}
+			if _, ok := totpVerify(secret, strings.TrimSpace(code), time.Now()); !ok {
+				return errors.New("the code is wrong, so the second factor has not been set up")
+			}
+
+			codes, err := newRecoveryCodes()
+			if err != nil {
+				return err
+			}
+
+			if _, err := dbEnableTOTP(cmd.Context(), db, args[0], secret, codes); err != nil {
+				return err
+			}
+
+			fmt.Println()
+			fmt.Println("Keep these recovery codes somewhere safe. Each logs in once without the app:")
+			fmt.Println()
+			for _, code := range codes {
+				fmt.Println("  " + code)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&disable, "disable", false, "Remove the second factor and its recovery codes")
+
+	return cmd
+}
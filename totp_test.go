@@ -0,0 +1,169 @@
+package sheepcount
+
+import (
+	"context"
+	"encoding/base32"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// The SHA1 test vectors of RFC 6238, of which the last six digits are the code
+	secret := []byte("12345678901234567890")
+	for timestamp, code := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		assert.Equal(t, code, totpCode(secret, timestamp/totpPeriod), timestamp)
+	}
+
+	encoded := base32.StdEncoding.EncodeToString(secret)
+	step, ok := totpVerify(encoded, "287 082", time.Unix(59, 0))
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), step)
+
+	// The code of the step before or after is accepted, but not two steps away
+	_, ok = totpVerify(encoded, "287082", time.Unix(89, 0))
+	assert.True(t, ok)
+	_, ok = totpVerify(encoded, "287082", time.Unix(120, 0))
+	assert.False(t, ok)
+	_, ok = totpVerify("not base32!", "287082", time.Unix(59, 0))
+	assert.False(t, ok)
+}
+
+func TestSecondFactor(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx := context.Background()
+
+	config := DefaultConfig()
+	config.CookieKey = "0123456789abcdef0123456789abcdef"
+	config.Domains = []string{"example.com"}
+	tmpl, err := NewTemplates()
+	require.NoError(t, err)
+	sheepcount := &SheepCount{db: db, tmpl: tmpl, Config: config}
+
+	require.NoError(t, dbAddAccount(ctx, db, "alice", "secret", roleAdmin, nil))
+	token, err := sheepcount.login(ctx, "alice", "secret")
+	require.NoError(t, err)
+	require.True(t, token.LoggedIn)
+
+	secret, err := newTOTPSecret()
+	require.NoError(t, err)
+	codes, err := newRecoveryCodes()
+	require.NoError(t, err)
+	require.Len(t, codes, recoveryCodeCount)
+
+	ok, err := dbEnableTOTP(ctx, db, "alice", secret, codes)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = dbEnableTOTP(ctx, db, "nobody", secret, codes)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	cookie := func(token authCookie) *http.Cookie {
+		encoded, err := sheepcount.cookieCodec().Encode(authCookieName, token)
+		require.NoError(t, err)
+		return &http.Cookie{Name: authCookieName, Value: encoded}
+	}
+
+	// Turning on the second factor logs out the sessions that only had the password
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie(token))
+	assert.Nil(t, sheepcount.session(r))
+
+	// Now the password alone is not enough
+	pending, err := sheepcount.login(ctx, "alice", "secret")
+	require.NoError(t, err)
+	assert.False(t, pending.LoggedIn)
+	assert.NotZero(t, pending.Pending)
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie(pending))
+	assert.Nil(t, sheepcount.session(r))
+	w := httptest.NewRecorder()
+	handleHome(sheepcount, w, r)
+	assert.Contains(t, w.Body.String(), `action="/login/totp"`)
+
+	secondFactor := func(token authCookie, code string) authCookie {
+		r := httptest.NewRequest(http.MethodPost, "/login/totp", strings.NewReader(url.Values{"code": {code}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", "http://example.com")
+		r.AddCookie(cookie(token))
+		w := httptest.NewRecorder()
+		handleSecondFactor(sheepcount, w, r)
+		require.Equal(t, http.StatusFound, w.Code)
+
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		return sheepcount.getAuthCookie(r)
+	}
+
+	result := secondFactor(pending, "000000")
+	assert.False(t, result.LoggedIn)
+	assert.True(t, result.InvalidCode)
+	assert.Equal(t, pending.Pending, result.Pending)
+
+	now := time.Now()
+	key, err := totpEncoding.DecodeString(secret)
+	require.NoError(t, err)
+	code := totpCode(key, now.Unix()/totpPeriod)
+
+	result = secondFactor(pending, code)
+	assert.True(t, result.LoggedIn)
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie(result))
+	if account := sheepcount.session(r); assert.NotNil(t, account) {
+		assert.Equal(t, "alice", account.Name)
+		assert.True(t, account.TwoFactor)
+	}
+
+	// A code cannot be used twice
+	ok, err = dbVerifySecondFactor(ctx, db, pending.Pending, code, now)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// Nor can a recovery code, which works in any format
+	recovery := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+	ok, err = dbVerifySecondFactor(ctx, db, pending.Pending, recovery, now)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = dbVerifySecondFactor(ctx, db, pending.Pending, codes[0], now)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// The code must be entered soon after the password
+	expired := pending
+	expired.PendingSince = now.Add(-totpPendingTimeout).Unix()
+	result = secondFactor(expired, codes[1])
+	assert.False(t, result.LoggedIn)
+	assert.Zero(t, result.Pending)
+
+	// Without the second factor, the password is enough again
+	ok, err = dbDisableTOTP(ctx, db, "alice")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	token, err = sheepcount.login(ctx, "alice", "secret")
+	require.NoError(t, err)
+	assert.True(t, token.LoggedIn)
+
+	var remaining int
+	require.NoError(t, db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users_admin_recovery_codes").Scan(&remaining))
+	assert.Zero(t, remaining)
+}
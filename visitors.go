@@ -0,0 +1,180 @@
+package sheepcount
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// Unique visitors are estimated with a HyperLogLog sketch of 2^precision registers for each site and
+// hour, which has a standard error of about 1.04/sqrt(2^precision), or 3%. The sketches of the hours
+// of a day are merged by taking the largest rank of each register.
+const sketchPrecision = 10
+const sketchRegisters = 1 << sketchPrecision
+
+// The user of the hits of anonymous visitors, which have no identifiers. Its hits are not stitched into
+// visits, and as it was never first seen, they are not from returning visitors.
+const anonymousUserId = 0
+
+// Either keep the identifiers of the visitor or, with anonymous visitors, only a hash to add to the
+// hour's sketch. As the identifiers are salted, visitors who return after the salts are rotated are
+// counted again that day.
+func (hit *Hit) setIdentifiers(anonymous bool, current []byte, previous []byte) {
+	if anonymous {
+		hit.Visitor = binary.BigEndian.Uint64(current)
+		return
+	}
+
+	hit.IdentifierCurrent = current
+	hit.IdentifierPrevious = previous
+}
+
+// The register for a hash is chosen by its first bits and the rank is the position of the first
+// one bit of the rest.
+func sketchRegister(hash uint64) (int64, int64) {
+	register := hash >> (64 - sketchPrecision)
+	rank := bits.LeadingZeros64(hash<<sketchPrecision|1<<(sketchPrecision-1)) + 1
+	return int64(register), int64(rank)
+}
+
+// Estimate the number of distinct hashes from the ranks of the non-zero registers.
+func sketchEstimate(ranks []int64) int64 {
+	const m = float64(sketchRegisters)
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	zeros := m - float64(len(ranks))
+	sum := zeros
+	for _, rank := range ranks {
+		sum += math.Pow(2, -float64(rank))
+	}
+
+	estimate := alpha * m * m / sum
+
+	// Use linear counting for small cardinalities, where HyperLogLog is biased
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/zeros)
+	}
+
+	return int64(math.Round(estimate))
+}
+
+// The bot flag is the same as in the rollups. The hits are written in the same transaction so the
+// user agent has been inserted already. Like the hits, the registers of a batch are updated by a
+// single statement from a JSON array.
+const insertSketchesQuery = `
+	INSERT INTO visitor_sketches (site_id, hour, bot, register, rank)
+	SELECT json_extract(value, '$.site_id')
+	     , (json_extract(value, '$.timestamp') / 3600) * 3600
+	     , COALESCE(json_extract(value, '$.bot'), 0) >= 2 OR user_agents.bot >= 2
+	     , json_extract(value, '$.register')
+	     , json_extract(value, '$.rank')
+	FROM json_each(?)
+	INNER JOIN user_agents ON user_agents.user_agent_id = json_extract(value, '$.user_agent_id')
+	WHERE true
+	ON CONFLICT DO UPDATE SET rank = MAX(rank, excluded.rank)`
+
+// The sketches of the hours of each UTC day since the given one.
+const selectDailySketchesQuery = `
+	SELECT site_id, (hour / 86400) * 86400, bot, MAX(rank)
+	FROM visitor_sketches
+	WHERE hour >= ?
+	GROUP BY 1, 2, 3, register
+	ORDER BY 1, 2, 3`
+
+// The sketches of the hours of each of the days in the JSON array, which start and end at the UTC
+// timestamps in it, as bindPeriod gives them. In time zones that are not a whole number of hours
+// from UTC, the hour that a day starts part way through is in the day before.
+const selectLocalSketchesQuery = `
+	SELECT visitor_sketches.site_id, days.start, visitor_sketches.bot, MAX(visitor_sketches.rank)
+	FROM (SELECT json_extract(value, '$.start') AS start, json_extract(value, '$.end') AS end FROM json_each(?)) AS days
+	INNER JOIN visitor_sketches ON visitor_sketches.hour >= days.start AND visitor_sketches.hour < days.end
+	GROUP BY 1, 2, 3, visitor_sketches.register
+	ORDER BY 1, 2, 3`
+
+type visitorEstimate struct {
+	siteId   int64
+	day      int64
+	bot      bool
+	visitors int64
+}
+
+// Estimate the visitors of each site and day from the merged sketches that the query selects.
+func dbEstimateVisitors(ctx context.Context, tx *sql.Tx, query string, arg interface{}) ([]visitorEstimate, error) {
+	rows, err := tx.QueryContext(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var estimates []visitorEstimate
+	var ranks []int64
+	for rows.Next() {
+		var e visitorEstimate
+		var rank int64
+		if err := rows.Scan(&e.siteId, &e.day, &e.bot, &rank); err != nil {
+			return nil, err
+		}
+
+		if n := len(estimates); n == 0 || estimates[n-1].siteId != e.siteId || estimates[n-1].day != e.day || estimates[n-1].bot != e.bot {
+			if n > 0 {
+				estimates[n-1].visitors = sketchEstimate(ranks)
+			}
+			estimates = append(estimates, e)
+			ranks = ranks[:0]
+		}
+		ranks = append(ranks, rank)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if n := len(estimates); n > 0 {
+		estimates[n-1].visitors = sketchEstimate(ranks)
+	}
+
+	return estimates, nil
+}
+
+// Replace the visitors of the daily totals since the given day, which are counted from the users of
+// the hits, with the estimates from the sketches. Without identifiers each hit has its own user.
+func dbEstimateDailyVisitors(ctx context.Context, tx *sql.Tx, since int64) error {
+	estimates, err := dbEstimateVisitors(ctx, tx, selectDailySketchesQuery, since)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range estimates {
+		_, err := tx.ExecContext(
+			ctx,
+			"UPDATE totals_daily SET visitors = ? WHERE site_id = ? AND day = ? AND bot = ?",
+			e.visitors, e.siteId, e.day, e.bot,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The same for the daily totals of a time zone, whose days are in the JSON array.
+func dbEstimateLocalVisitors(ctx context.Context, tx *sql.Tx, timezone string, days string) error {
+	estimates, err := dbEstimateVisitors(ctx, tx, selectLocalSketchesQuery, days)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range estimates {
+		_, err := tx.ExecContext(
+			ctx,
+			"UPDATE totals_local_daily SET visitors = ? WHERE timezone = ? AND site_id = ? AND day = ? AND bot = ?",
+			e.visitors, timezone, e.siteId, e.day, e.bot,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package sheepcount
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSketchEstimate(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for _, n := range []int{10, 1000, 100000} {
+		registers := make(map[int64]int64)
+		for i := 0; i < n; i++ {
+			hash := rng.Uint64()
+			register, rank := sketchRegister(hash)
+			if rank > registers[register] {
+				registers[register] = rank
+			}
+
+			// Adding the same visitor again changes nothing
+			register, rank = sketchRegister(hash)
+			assert.LessOrEqual(t, rank, registers[register])
+		}
+
+		var ranks []int64
+		for _, rank := range registers {
+			ranks = append(ranks, rank)
+		}
+
+		assert.InEpsilon(t, n, sketchEstimate(ranks), 0.1, "%d visitors", n)
+	}
+
+	assert.Equal(t, int64(0), sketchEstimate(nil))
+}
+
+func TestAnonymousVisitors(t *testing.T) {
+	db, err := dbConnect(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer, err := NewHitWriter(ctx, db)
+	require.NoError(t, err)
+	defer writer.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	hit := func(timestamp int64, identifier string, event EventType) *Hit {
+		var hit Hit
+		hit.Timestamp = timestamp
+		hit.setIdentifiers(true, []byte(identifier+"0123456"), nil)
+		hit.UserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:101.0) Gecko/20100101 Firefox/101.0"
+		hit.Event = event
+		hit.Domain = "example.com"
+		hit.Path = "/"
+		return &hit
+	}
+
+	hits := []*Hit{
+		hit(1654041600, "a", PageLoad), // 2022-06-01 00:00
+		hit(1654041660, "a", PageLoad), // 2022-06-01 00:01
+		hit(1654041720, "a", PageHide), // 2022-06-01 00:02
+		hit(1654045200, "b", PageLoad), // 2022-06-01 01:00
+		hit(1654128000, "a", PageLoad), // 2022-06-02 00:00
+	}
+	for _, hit := range hits {
+		require.Nil(t, hit.IdentifierCurrent)
+		require.NoError(t, writer.InsertHit(ctx, tx, hit))
+	}
+	require.NoError(t, tx.Commit())
+
+	// The hits all have the anonymous user rather than one each, and are not stitched into visits
+	var users, sessions int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM users").Scan(&users))
+	assert.Equal(t, 1, users)
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM hits WHERE user_id != ?", anonymousUserId).Scan(&users))
+	assert.Equal(t, 0, users)
+	require.NoError(t, dbStitchSessions(ctx, db))
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&sessions))
+	assert.Equal(t, 0, sessions)
+
+	require.NoError(t, dbAggregate(ctx, db))
+
+	rows, err := db.Query("SELECT day, pageviews, visitors FROM totals_daily ORDER BY day")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var totals [][3]int64
+	for rows.Next() {
+		var day, pageviews, visitors int64
+		require.NoError(t, rows.Scan(&day, &pageviews, &visitors))
+		totals = append(totals, [3]int64{day, pageviews, visitors})
+	}
+	require.NoError(t, rows.Err())
+
+	assert.Equal(t, [][3]int64{{1654041600, 3, 2}, {1654128000, 1, 1}}, totals)
+}